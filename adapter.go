@@ -54,3 +54,36 @@ type StoreWriterAdapter interface {
 	// sequence/position, which may be required when snapshotting.
 	GetState() interface{}
 }
+
+// SequenceAdvancer is implemented by loader adapters that can skip forward
+// over sequence numbers without an event being replayed. Stores use this to
+// support streams that begin at a configured sequence, or that contain gaps.
+type SequenceAdvancer interface {
+	// AdvanceSequence moves the aggregate forward to the specified sequence,
+	// as though all events up to and including that sequence had been seen.
+	AdvanceSequence(sequence int64) error
+}
+
+// StateAdapter is implemented by loader adapters that can expose the state of the
+// aggregate being loaded, so that snapshot middleware can snap it after a refresh
+// that replayed a long history.
+type StateAdapter interface {
+	// GetState returns the state of the aggregate in it's current position.
+	GetState() interface{}
+}
+
+// SnapshotRebuilder is implemented by adapters that are rebuilding the snapshot
+// of an aggregate (see AggregateBase.RebuildSnapshot). Snapshot middleware should
+// ignore any stored snapshot when refreshing such an aggregate, so that its full
+// history is replayed, and should write a snapshot when it is committed even
+// though there are no events.
+type SnapshotRebuilder interface {
+	// RebuildingSnapshot returns true if the snapshot is being rebuilt.
+	RebuildingSnapshot() bool
+}
+
+// IsRebuildingSnapshot checks if an adapter is rebuilding a snapshot.
+func IsRebuildingSnapshot(adapter interface{}) bool {
+	rebuilder, ok := adapter.(SnapshotRebuilder)
+	return ok && rebuilder.RebuildingSnapshot()
+}
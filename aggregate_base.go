@@ -4,9 +4,6 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
-
-	"github.com/go-gadgets/eventsourcing/utilities/mapping"
-	"github.com/mitchellh/mapstructure"
 )
 
 const (
@@ -55,6 +52,36 @@ type AggregateBase struct {
 	// This is required because we generally only have a reference to the
 	// nested AggregateBase and there's no way to get back to the parent.
 	stateFunc StateFetchFunc
+
+	// featureFlags is the provider command handlers consult for flags.
+	featureFlags FeatureFlagProvider
+
+	// evaluatedFlags are the flags evaluated since the last commit, which
+	// are recorded in the metadata of the committed events.
+	evaluatedFlags map[string]bool
+
+	// reporter receives panics that occur while handling commands.
+	reporter Reporter
+
+	// category is the category recorded in the metadata of committed events.
+	category string
+
+	// strictSnapshots rejects snapshots that don't match the state exactly.
+	strictSnapshots bool
+
+	// commitID is the ID of the commit in progress, recorded in the metadata of
+	// its events, if it has one.
+	commitID string
+
+	// lineage is the correlation and causation recorded in the metadata of the
+	// events committed next, if set.
+	lineage lineage
+}
+
+// lineage places a commit within a business transaction.
+type lineage struct {
+	correlationID string // ID of the business transaction
+	causationID   string // ID of the command or event that caused the commit
 }
 
 // Initialize sets the initial state of the AggregateBase and ensures we are
@@ -69,6 +96,79 @@ func (agg *AggregateBase) Initialize(key string, registry EventRegistry, store E
 	agg.eventStore = store
 	agg.uncommittedEvents = make([]Event, 0)
 	agg.stateFunc = state
+	agg.evaluatedFlags = nil
+	agg.lineage = lineage{}
+}
+
+// UseFeatureFlags sets the feature flag provider that command handlers can
+// consult via FeatureEnabled.
+func (agg *AggregateBase) UseFeatureFlags(provider FeatureFlagProvider) {
+	agg.featureFlags = provider
+}
+
+// UseCategory sets the category of the aggregate (i.e. its type, "Counter"), which
+// is recorded in the metadata of the events it commits, so that stores can read
+// the events of every aggregate in the category (see CategoryReader).
+func (agg *AggregateBase) UseCategory(category string) {
+	agg.category = category
+}
+
+// UseLineage sets the business transaction the events committed next belong to,
+// and the ID of the command or event that caused them, which are recorded in their
+// metadata so that the transaction can be traced across aggregates (see
+// CorrelationReader and BuildLineage). Either ID may be empty. The lineage applies
+// to the next commit only.
+func (agg *AggregateBase) UseLineage(correlationID string, causationID string) {
+	agg.lineage = lineage{
+		correlationID: correlationID,
+		causationID:   causationID,
+	}
+}
+
+// ContinueLineage records that the events committed next were caused by an event,
+// i.e. by a saga reacting to it, within the same business transaction. An event
+// committed without a correlation ID starts a transaction of its own.
+func (agg *AggregateBase) ContinueLineage(event GlobalEvent) {
+	cause := EventID(event.Key, event.Sequence)
+	correlationID := CorrelationIDOf(event.Metadata)
+	if correlationID == "" {
+		correlationID = cause
+	}
+	agg.UseLineage(correlationID, cause)
+}
+
+// UseStrictSnapshots makes snapshots restore strictly: a field of the wrong type,
+// or a field the state doesn't have, fails the restore instead of being converted
+// or ignored, so snapshot middleware replays the aggregate's events instead.
+// States that implement SnapshotRestorer decode snapshots themselves regardless.
+func (agg *AggregateBase) UseStrictSnapshots() {
+	agg.strictSnapshots = true
+}
+
+// UseReporter sets the reporter that panics during command handling are sent to.
+// Once set, panics are recovered and returned from Handle as errors.
+func (agg *AggregateBase) UseReporter(reporter Reporter) {
+	agg.reporter = reporter
+}
+
+// FeatureEnabled determines if a feature flag is enabled for this aggregate. The
+// outcome is recorded in the metadata of the events committed next, so that
+// behaviour can be analysed later. If no provider is set, all flags are disabled.
+func (agg *AggregateBase) FeatureEnabled(flag string) (bool, error) {
+	if agg.featureFlags == nil {
+		return false, nil
+	}
+
+	enabled, errFlag := agg.featureFlags.FeatureEnabled(flag, agg.key)
+	if errFlag != nil {
+		return false, errFlag
+	}
+
+	if agg.evaluatedFlags == nil {
+		agg.evaluatedFlags = make(map[string]bool)
+	}
+	agg.evaluatedFlags[flag] = enabled
+	return enabled, nil
 }
 
 // Handle processes a command against the aggregate.
@@ -87,16 +187,26 @@ func (agg *AggregateBase) handleInternal(command Command) error {
 		return fmt.Errorf("Unsupported command type: %v", commandType)
 	}
 
-	events, errResult := handler(command)
-	if errResult != nil {
-		return errResult
+	report := ErrorReport{
+		Operation:   OperationCommand,
+		Domain:      agg.eventRegistry.Domain(),
+		Key:         agg.key,
+		Sequence:    agg.sequenceNumber,
+		CommandType: commandType,
 	}
 
-	for _, evt := range events {
-		agg.ApplyEvent(evt)
-	}
+	return RecoverPanics(agg.reporter, report, func() error {
+		events, errResult := handler(command)
+		if errResult != nil {
+			return errResult
+		}
 
-	return nil
+		for _, evt := range events {
+			agg.ApplyEvent(evt)
+		}
+
+		return nil
+	})
 }
 
 // Run performs a load, mutate, commit cycle on an aggregate
@@ -178,6 +288,81 @@ func (agg *AggregateBase) Refresh() error {
 	return agg.eventStore.Refresh(adapter)
 }
 
+// RebuildSnapshot loads the aggregate by replaying its full history, ignoring
+// any stored snapshot, and then asks snapshot middleware to write a fresh
+// snapshot of the result. This is used to pre-warm snapshots after replay logic
+// changes. The aggregate must be newly initialized.
+func (agg *AggregateBase) RebuildSnapshot() error {
+	if agg.sequenceNumber != 0 || agg.isDirty() {
+		return fmt.Errorf("Cannot rebuild snapshot of aggregate %v, it has already been loaded or modified", agg.key)
+	}
+
+	errRefresh := agg.eventStore.Refresh(&aggregateBaseLoaderAdapter{
+		aggregate: agg,
+		state:     agg.stateFunc(),
+		rebuild:   true,
+	})
+	if errRefresh != nil {
+		return errRefresh
+	}
+
+	return agg.eventStore.CommitEvents(&aggregateBaseStoreAdapter{
+		aggregate: agg,
+		state:     agg.stateFunc(),
+		rebuild:   true,
+	})
+}
+
+// Compact refreshes the aggregate, and then replaces its history in the store with
+// a baseline of its current state, returning the number of events removed. The
+// aggregate must not have uncommitted events. Events committed by other writers
+// after the refresh are kept, and replay on top of the baseline.
+func (agg *AggregateBase) Compact() (int64, error) {
+	if agg.isDirty() {
+		return 0, fmt.Errorf("Cannot compact aggregate %v, it has uncommitted events", agg.key)
+	}
+
+	errRefresh := agg.Refresh()
+	if errRefresh != nil {
+		return 0, errRefresh
+	}
+	if agg.sequenceNumber == 0 {
+		return 0, nil
+	}
+
+	return Compact(agg.eventStore, agg.key, agg.sequenceNumber, agg.stateFunc())
+}
+
+// restoreState decodes a snapshot over the state of the aggregate. States are
+// decoded into a copy, which replaces the state only once the whole snapshot has
+// been decoded, so a snapshot that fails to restore leaves the state untouched
+// for its events to be replayed instead.
+func (agg *AggregateBase) restoreState(state interface{}, snapshot interface{}) error {
+	restorer, ok := state.(SnapshotRestorer)
+	if ok {
+		return restorer.RestoreSnapshot(snapshot)
+	}
+
+	codec := CodecFor(agg.getEventRegistry())
+	if agg.strictSnapshots {
+		codec = NewStrictMapCodec(DecodeHookFor(agg.getEventRegistry()))
+	}
+
+	target := reflect.ValueOf(state)
+	if target.Kind() != reflect.Ptr || target.Elem().Kind() != reflect.Struct {
+		return codec.Decode(snapshot, state)
+	}
+
+	staged := reflect.New(target.Elem().Type())
+	staged.Elem().Set(target.Elem())
+	errDecode := codec.Decode(snapshot, staged.Interface())
+	if errDecode != nil {
+		return errDecode
+	}
+	target.Elem().Set(staged.Elem())
+	return nil
+}
+
 // GetKey fetches the key of this aggregate instance.
 func (agg *AggregateBase) GetKey() string {
 	return agg.key
@@ -210,9 +395,26 @@ func (agg *AggregateBase) Commit() error {
 	// Clear the uncommittedEvents array
 	agg.uncommittedEvents = make([]Event, 0)
 	agg.committedSequenceNumber = agg.sequenceNumber
+	agg.evaluatedFlags = nil
+	agg.lineage = lineage{}
 	return nil
 }
 
+// CommitWithID commits the state of the aggregate as Commit does, recording a
+// client-generated ID with the events. Stores that support it (the key-value
+// stores that keep event metadata) treat a retry of a commit that was written,
+// but whose outcome was lost (i.e. to a network failure), as a success rather
+// than a ConcurrencyFault, provided it has the same ID. The ID should be unique
+// to the commit, such as the ID of the request being handled.
+func (agg *AggregateBase) CommitWithID(id string) error {
+	agg.commitID = id
+	defer func() {
+		agg.commitID = ""
+	}()
+
+	return agg.Commit()
+}
+
 // getEventRegistry fetches the event registry associated with this
 // aggregate instance.
 func (agg *AggregateBase) getEventRegistry() EventRegistry {
@@ -317,6 +519,7 @@ func buildReplayMappings(subject interface{}) map[EventType]func(Event) {
 type aggregateBaseLoaderAdapter struct {
 	aggregate *AggregateBase
 	state     interface{}
+	rebuild   bool // Rebuilding the snapshot
 }
 
 // GetKey fetches the aggregate key
@@ -345,21 +548,22 @@ func (adapter *aggregateBaseLoaderAdapter) ReplayEvent(event Event) {
 	adapter.aggregate.committedSequenceNumber++
 }
 
+// AdvanceSequence moves the aggregate forward to a later sequence number
+// without replaying an event.
+func (adapter *aggregateBaseLoaderAdapter) AdvanceSequence(sequence int64) error {
+	if sequence < adapter.aggregate.sequenceNumber {
+		return fmt.Errorf("Cannot move aggregate %v backwards from %v to %v", adapter.aggregate.key, adapter.aggregate.sequenceNumber, sequence)
+	}
+
+	adapter.aggregate.sequenceNumber = sequence
+	adapter.aggregate.committedSequenceNumber = sequence
+	return nil
+}
+
 // RestoreSnapshot sets the current position and restores the snapshot
 // state over the top of the aggregate.
 func (adapter *aggregateBaseLoaderAdapter) RestoreSnapshot(sequence int64, snapshot interface{}) error {
-	config := &mapstructure.DecoderConfig{
-		DecodeHook:       mapping.MapTimeFromJSON,
-		TagName:          "json",
-		Result:           adapter.state,
-		WeaklyTypedInput: true,
-	}
-	decoder, errDecoder := mapstructure.NewDecoder(config)
-	if errDecoder != nil {
-		return errDecoder
-	}
-
-	errDecode := decoder.Decode(snapshot)
+	errDecode := adapter.aggregate.restoreState(adapter.state, snapshot)
 	if errDecode == nil {
 		adapter.aggregate.sequenceNumber = sequence
 		adapter.aggregate.committedSequenceNumber = sequence
@@ -368,10 +572,26 @@ func (adapter *aggregateBaseLoaderAdapter) RestoreSnapshot(sequence int64, snaps
 	return errDecode
 }
 
+// GetState returns the state of the aggregate being loaded
+func (adapter *aggregateBaseLoaderAdapter) GetState() interface{} {
+	return adapter.state
+}
+
+// SnapshotVersion gets the snapshot schema version of the aggregate state
+func (adapter *aggregateBaseLoaderAdapter) SnapshotVersion() string {
+	return StateVersion(adapter.state)
+}
+
+// RebuildingSnapshot returns true if the snapshot is being rebuilt
+func (adapter *aggregateBaseLoaderAdapter) RebuildingSnapshot() bool {
+	return adapter.rebuild
+}
+
 // aggregateBaseStoreAdapter is an event-store adapter for saving events
 type aggregateBaseStoreAdapter struct {
 	state     interface{}    // State is the untyped instance-level reference
 	aggregate *AggregateBase // the nested AggregateBase within the state
+	rebuild   bool           // Rebuilding the snapshot
 }
 
 // GetKey gets the key of the aggregate
@@ -403,3 +623,44 @@ func (adapter *aggregateBaseStoreAdapter) GetUncommittedEvents() (int64, []Event
 func (adapter *aggregateBaseStoreAdapter) GetState() interface{} {
 	return adapter.state
 }
+
+// SnapshotVersion gets the snapshot schema version of the aggregate state
+func (adapter *aggregateBaseStoreAdapter) SnapshotVersion() string {
+	return StateVersion(adapter.state)
+}
+
+// RebuildingSnapshot returns true if the snapshot is being rebuilt
+func (adapter *aggregateBaseStoreAdapter) RebuildingSnapshot() bool {
+	return adapter.rebuild
+}
+
+// GetEventMetadata returns the metadata to record with the uncommitted events.
+func (adapter *aggregateBaseStoreAdapter) GetEventMetadata() map[string]interface{} {
+	if len(adapter.aggregate.evaluatedFlags) == 0 && adapter.aggregate.category == "" && adapter.aggregate.commitID == "" && adapter.aggregate.lineage == (lineage{}) {
+		return nil
+	}
+
+	metadata := make(map[string]interface{})
+	if adapter.aggregate.category != "" {
+		metadata[MetadataCategory] = adapter.aggregate.category
+	}
+	if adapter.aggregate.commitID != "" {
+		metadata[MetadataCommitID] = adapter.aggregate.commitID
+	}
+	if adapter.aggregate.lineage.correlationID != "" {
+		metadata[MetadataCorrelationID] = adapter.aggregate.lineage.correlationID
+	}
+	if adapter.aggregate.lineage.causationID != "" {
+		metadata[MetadataCausationID] = adapter.aggregate.lineage.causationID
+	}
+
+	if len(adapter.aggregate.evaluatedFlags) > 0 {
+		flags := make(map[string]interface{}, len(adapter.aggregate.evaluatedFlags))
+		for flag, enabled := range adapter.aggregate.evaluatedFlags {
+			flags[flag] = enabled
+		}
+		metadata[MetadataFeatureFlags] = flags
+	}
+
+	return metadata
+}
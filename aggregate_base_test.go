@@ -169,3 +169,96 @@ func BenchmarkBaseAggregateWireupSpeed(b *testing.B) {
 		instance.Initialize("dummy-key", counterRegistry, store)
 	}
 }
+
+// TestBaseAggregateRebuildSnapshotLoaded checks snapshots can only be rebuilt
+// from a newly initialized aggregate.
+func TestBaseAggregateRebuildSnapshotLoaded(t *testing.T) {
+	instance := &SimpleAggregate{}
+	instance.Initialize("dummy-key", counterRegistry, NewNullStore())
+	assert.Nil(t, instance.RebuildSnapshot())
+
+	instance.ApplyEvent(InitializeEvent{TargetValue: 3})
+	assert.NotNil(t, instance.RebuildSnapshot(), "Modified aggregates should not be rebuilt")
+}
+
+// snapshotStore is a store that restores a fixed snapshot
+type snapshotStore struct {
+	NullStore
+	snapshot interface{}
+}
+
+func (store *snapshotStore) Refresh(loader StoreLoaderAdapter) error {
+	return loader.RestoreSnapshot(5, store.snapshot)
+}
+
+// restoringAggregate decodes its own snapshots
+type restoringAggregate struct {
+	AggregateBase
+	count int
+}
+
+// RestoreSnapshot restores the unexported count
+func (agg *restoringAggregate) RestoreSnapshot(snapshot interface{}) error {
+	count, ok := snapshot.(map[string]interface{})["count"].(int)
+	if !ok {
+		return errors.New("No count in snapshot")
+	}
+	agg.count = count
+	return nil
+}
+
+// TestBaseAggregateRestoreSnapshot checks snapshots restore weakly by default,
+// and failed restores leave the state untouched
+func TestBaseAggregateRestoreSnapshot(t *testing.T) {
+	instance := SimpleAggregate{}
+	instance.Initialize("weak", counterRegistry, &snapshotStore{snapshot: map[string]interface{}{
+		"current_count": "3",
+		"renamed_field": 1,
+	}})
+	assert.Nil(t, instance.Refresh())
+	assert.Equal(t, 3, instance.CurrentCount)
+	assert.Equal(t, int64(5), instance.SequenceNumber())
+
+	failed := SimpleAggregate{}
+	failed.Initialize("failed", counterRegistry, &snapshotStore{snapshot: map[string]interface{}{
+		"current_count": 3,
+		"target_value":  "lots",
+	}})
+	assert.NotNil(t, failed.Refresh())
+	assert.Equal(t, 0, failed.CurrentCount, "A failed restore should not be partly applied")
+	assert.Equal(t, int64(0), failed.SequenceNumber())
+}
+
+// TestBaseAggregateRestoreSnapshotStrict checks strict restores reject
+// conversions and unknown fields
+func TestBaseAggregateRestoreSnapshotStrict(t *testing.T) {
+	snapshots := []map[string]interface{}{
+		{"current_count": "3"},
+		{"current_count": 3, "renamed_field": 1},
+	}
+	for _, snapshot := range snapshots {
+		instance := SimpleAggregate{}
+		instance.Initialize("strict", counterRegistry, &snapshotStore{snapshot: snapshot})
+		instance.UseStrictSnapshots()
+		assert.NotNil(t, instance.Refresh())
+		assert.Equal(t, 0, instance.CurrentCount)
+	}
+
+	instance := SimpleAggregate{}
+	instance.Initialize("strict", counterRegistry, &snapshotStore{snapshot: map[string]interface{}{
+		"current_count":     3,
+		"_snapshot_version": "v1",
+	}})
+	instance.UseStrictSnapshots()
+	assert.Nil(t, instance.Refresh())
+	assert.Equal(t, 3, instance.CurrentCount)
+}
+
+// TestBaseAggregateSnapshotRestorer checks states can decode their own snapshots
+func TestBaseAggregateSnapshotRestorer(t *testing.T) {
+	instance := &restoringAggregate{}
+	instance.Initialize("restorer", counterRegistry, &snapshotStore{snapshot: map[string]interface{}{"count": 7}}, func() interface{} { return instance })
+	assert.Nil(t, instance.Refresh())
+	assert.Equal(t, 7, instance.count)
+	assert.Equal(t, int64(5), instance.SequenceNumber())
+}
@@ -0,0 +1,91 @@
+package eventsourcing
+
+import "strings"
+
+// Capability describes what a middleware does, so that the order of a chain of
+// middleware can be validated. Providers describe their middleware with its
+// capabilities (see UseMiddleware), while other middleware can be declared by
+// hand (see DeclareMiddleware). Capabilities can be combined, i.e. Caching|Durable
+// for lazy snapshots kept in Redis.
+type Capability int
+
+const (
+	// Caching middleware serves refreshes without reaching the middleware beneath
+	// it, i.e. lazy snapshots.
+	Caching Capability = 1 << iota
+
+	// Durable middleware keeps state that outlives the process, i.e. snapshots in
+	// MongoDB or Redis.
+	Durable
+
+	// Publishing middleware distributes events once they are committed.
+	Publishing
+)
+
+// String describes the capabilities
+func (capabilities Capability) String() string {
+	names := make([]string, 0)
+	for _, known := range []struct {
+		capability Capability
+		name       string
+	}{{Caching, "caching"}, {Durable, "durable"}, {Publishing, "publishing"}} {
+		if capabilities&known.capability != 0 {
+			names = append(names, known.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// OrderingProblem describes a pair of middleware registered in an order that
+// doesn't make sense. Middleware registered later wraps (runs before) middleware
+// registered earlier.
+type OrderingProblem struct {
+	Outer  string // Middleware registered later, which runs first
+	Inner  string // Middleware it wraps
+	Reason string // Why the order is a problem
+	Severe bool   // Severe problems break correctness, while others waste work or risk it
+}
+
+// declared is a middleware whose capabilities have been declared
+type declared struct {
+	name         string
+	capabilities Capability
+}
+
+// orderingProblems checks every pair of declared middleware, given in the order
+// they were registered
+func orderingProblems(layers []declared) []OrderingProblem {
+	problems := make([]OrderingProblem, 0)
+	for innerIndex, inner := range layers {
+		for _, outer := range layers[innerIndex+1:] {
+			reason, severe := orderingProblem(outer.capabilities, inner.capabilities)
+			if reason == "" {
+				continue
+			}
+			problems = append(problems, OrderingProblem{
+				Outer:  outer.name,
+				Inner:  inner.name,
+				Reason: reason,
+				Severe: severe,
+			})
+		}
+	}
+	return problems
+}
+
+// orderingProblem checks if one middleware can sensibly wrap another
+func orderingProblem(outer Capability, inner Capability) (string, bool) {
+	snapshots := Caching | Durable
+	switch {
+	case inner&Caching != 0 && outer&snapshots != 0:
+		return "a cache beneath snapshot middleware is only reached once the outer snapshot is read, and can restore an older state over it", true
+	case inner&Durable != 0 && outer&Durable != 0:
+		return "each durable layer reads and writes its own snapshots, so stack snapshot providers with layeredsnap instead", false
+	case outer&Publishing != 0 && inner&snapshots != 0:
+		return "commits whose snapshot write fails are reported as failed, so events that were stored are not published", false
+	}
+	return "", false
+}
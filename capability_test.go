@@ -0,0 +1,134 @@
+package eventsourcing
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// passThrough is middleware that does nothing but call the next handler
+func passThrough() (CommitMiddleware, RefreshMiddleware, func() error) {
+	return func(writer StoreWriterAdapter, next NextHandler) error {
+			return next()
+		}, func(reader StoreLoaderAdapter, next NextHandler) error {
+			return next()
+		}, nil
+}
+
+// described describes pass-through middleware
+func described(name string, capabilities Capability) Middleware {
+	commit, refresh, cleanup := passThrough()
+	return Describe(name, capabilities, commit, refresh, cleanup)
+}
+
+// chain registers declared middleware in order, innermost first
+func chain(layers ...declared) EventStoreWithMiddleware {
+	store := NewMiddlewareWrapper(NewTestStore())
+	for _, layer := range layers {
+		store.Use(passThrough())
+		DeclareMiddleware(store, layer.name, layer.capabilities)
+	}
+	return store
+}
+
+// TestCapabilityString checks capabilities are described by name
+func TestCapabilityString(t *testing.T) {
+	assert.Equal(t, "none", Capability(0).String())
+	assert.Equal(t, "caching|durable", (Caching | Durable).String())
+}
+
+// TestValidateOrdering checks sensible chains pass, and caches beneath snapshot
+// middleware are rejected
+func TestValidateOrdering(t *testing.T) {
+	sensible := chain(
+		declared{"publish", Publishing},
+		declared{"mongosnap", Durable},
+		declared{"memorysnap", Caching},
+		declared{"logging", 0},
+	)
+	assert.Nil(t, ValidateMiddleware(sensible, nil))
+
+	errCache := ValidateMiddleware(chain(
+		declared{"memorysnap", Caching},
+		declared{"mongosnap", Durable},
+	), nil)
+	isFault, fault := IsMiddlewareOrderingFault(errCache)
+	assert.True(t, isFault)
+	assert.Len(t, fault.Problems, 1)
+	assert.Equal(t, "mongosnap", fault.Problems[0].Outer)
+	assert.Equal(t, "memorysnap", fault.Problems[0].Inner)
+	assert.Contains(t, errCache.Error(), "mongosnap wraps memorysnap")
+}
+
+// TestUseMiddleware checks described middleware declares its capabilities as it
+// is registered, and middleware that can't sensibly wrap the chain is rejected
+func TestUseMiddleware(t *testing.T) {
+	store := NewMiddlewareWrapper(NewTestStore())
+	assert.Nil(t, UseMiddleware(store, described("mongosnap", Durable)))
+	assert.Nil(t, UseMiddleware(store, described("memorysnap", Caching)))
+
+	errOrder := UseMiddleware(store, described("redissnap", Durable))
+	isFault, fault := IsMiddlewareOrderingFault(errOrder)
+	assert.True(t, isFault)
+	assert.Len(t, fault.Problems, 1)
+	assert.Equal(t, "redissnap", fault.Problems[0].Outer)
+	assert.Equal(t, "memorysnap", fault.Problems[0].Inner)
+	assert.Len(t, store.(*wrapper).commit, 2)
+
+	assert.Nil(t, UseMiddleware(store, described("publish", Publishing)))
+	assert.Nil(t, ValidateMiddleware(store, nil))
+	assert.Len(t, store.(*wrapper).declared, 3)
+}
+
+// legacyWrapper is a store with middleware that doesn't check the order of its
+// middleware, as implemented outside this package
+type legacyWrapper struct {
+	EventStore
+	commits int
+}
+
+// Use a middleware, counting its commit middleware
+func (store *legacyWrapper) Use(commit CommitMiddleware, refresh RefreshMiddleware, cleanup func() error) {
+	store.HandleCommit(commit)
+}
+
+// HandleCleanup ignores a cleanup
+func (store *legacyWrapper) HandleCleanup(cleanup func() error) {}
+
+// HandleCommit counts a commit middleware
+func (store *legacyWrapper) HandleCommit(middleware CommitMiddleware) {
+	store.commits++
+}
+
+// HandleRefresh ignores a refresh middleware
+func (store *legacyWrapper) HandleRefresh(middleware RefreshMiddleware) {}
+
+// TestUseMiddlewareUnchecked checks stores that don't check the order of their
+// middleware still register described middleware, without validating it
+func TestUseMiddlewareUnchecked(t *testing.T) {
+	store := &legacyWrapper{EventStore: NewTestStore()}
+	assert.Nil(t, UseMiddleware(store, described("memorysnap", Caching)))
+	assert.Nil(t, UseMiddleware(store, described("mongosnap", Durable)))
+	DeclareMiddleware(store, "logging", 0)
+	assert.Nil(t, ValidateMiddleware(store, nil))
+	assert.Equal(t, 2, store.commits)
+	assert.NotNil(t, HandleSnapshots(store, nil))
+}
+
+// TestValidateOrderingWarnings checks questionable chains are logged, not rejected
+func TestValidateOrderingWarnings(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(buffer, nil)))
+
+	store := chain(
+		declared{"redissnap", Durable},
+		declared{"mongosnap", Durable},
+		declared{"publish", Publishing},
+	)
+	assert.Nil(t, ValidateMiddleware(store, logger))
+	assert.Contains(t, buffer.String(), "inner=redissnap outer=mongosnap")
+	assert.Contains(t, buffer.String(), "inner=redissnap outer=publish")
+	assert.Contains(t, buffer.String(), "inner=mongosnap outer=publish")
+}
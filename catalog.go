@@ -0,0 +1,16 @@
+package eventsourcing
+
+// EventCatalog is an interface implemented by event registries that can list the
+// event types registered with them, allowing the event contract of a service to be
+// discovered (i.e. for documentation).
+type EventCatalog interface {
+	// EventTypes gets the registered event types, in name order.
+	EventTypes() []EventType
+}
+
+// CommandCatalog is an interface implemented by command registries that can list
+// the command types registered with them.
+type CommandCatalog interface {
+	// CommandTypes gets the registered command types, in name order.
+	CommandTypes() []CommandType
+}
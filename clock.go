@@ -0,0 +1,63 @@
+package eventsourcing
+
+import "time"
+
+// Clock is a source of time for components that act periodically (polling,
+// flushing, checkpointing), allowing tests to substitute a virtual clock that is
+// advanced on demand rather than waiting in real time.
+type Clock interface {
+	// Now gets the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse, and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+
+	// NewTicker creates a ticker that sends the current time every period.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals, in the manner of time.Ticker.
+type Ticker interface {
+	// C gets the channel on which ticks are delivered.
+	C() <-chan time.Time
+
+	// Stop turns off the ticker.
+	Stop()
+}
+
+// SystemClock is the Clock that follows real time.
+var SystemClock Clock = systemClock{}
+
+// systemClock is a Clock backed by the time package.
+type systemClock struct{}
+
+// Now gets the current time
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// After waits for the duration to elapse
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// NewTicker creates a ticker
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{ticker: time.NewTicker(d)}
+}
+
+// systemTicker is a Ticker backed by a time.Ticker.
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+// C gets the channel on which ticks are delivered
+func (wrapped systemTicker) C() <-chan time.Time {
+	return wrapped.ticker.C
+}
+
+// Stop turns off the ticker
+func (wrapped systemTicker) Stop() {
+	wrapped.ticker.Stop()
+}
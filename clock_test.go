@@ -0,0 +1,20 @@
+package eventsourcing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSystemClock checks the system clock follows real time.
+func TestSystemClock(t *testing.T) {
+	before := time.Now()
+	assert.False(t, SystemClock.Now().Before(before))
+
+	<-SystemClock.After(time.Millisecond)
+	ticker := SystemClock.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	tick := <-ticker.C()
+	assert.True(t, tick.After(before))
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// Workloads measured against each store.
+const (
+	WorkloadCommit     = "commit"     // Sequential single-event commits
+	WorkloadRefresh    = "refresh"    // Rebuilding aggregates from their full streams
+	WorkloadBulk       = "bulk"       // Commits of a batch of events to a new aggregate
+	WorkloadContention = "contention" // Concurrent writers racing to commit to one aggregate
+)
+
+// Options controls the size of the workloads.
+type Options struct {
+	Aggregates int // Aggregates written and refreshed
+	Events     int // Single-event commits made to each aggregate
+	BatchSize  int // Events in each bulk commit
+	Writers    int // Concurrent writers in the contention workload
+	Attempts   int // Commits attempted by each writer in the contention workload
+}
+
+// Measurement holds the outcome of a workload.
+type Measurement struct {
+	Workload  string          `json:"workload"`
+	Count     int             `json:"count"`  // Operations attempted
+	Faults    int             `json:"faults"` // Operations rejected with a concurrency fault
+	Errors    int             `json:"errors"` // Operations that failed otherwise
+	Elapsed   time.Duration   `json:"elapsed"`
+	latencies []time.Duration // Latency of each operation, in the order they finished
+}
+
+// Percentile gets the latency below which the specified fraction of operations
+// completed, i.e. 0.99 for the 99th percentile.
+func (measurement Measurement) Percentile(fraction float64) time.Duration {
+	if len(measurement.latencies) == 0 {
+		return 0
+	}
+
+	sorted := make([]time.Duration, len(measurement.latencies))
+	copy(sorted, measurement.latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	index := int(fraction*float64(len(sorted))+0.5) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index]
+}
+
+// Throughput gets the operations completed per second.
+func (measurement Measurement) Throughput() float64 {
+	if measurement.Elapsed <= 0 {
+		return 0
+	}
+	return float64(measurement.Count) / measurement.Elapsed.Seconds()
+}
+
+// FaultRate gets the fraction of operations that failed, for any reason.
+func (measurement Measurement) FaultRate() float64 {
+	if measurement.Count == 0 {
+		return 0
+	}
+	return float64(measurement.Faults+measurement.Errors) / float64(measurement.Count)
+}
+
+// record adds the outcome of an operation.
+func (measurement *Measurement) record(latency time.Duration, err error) {
+	measurement.Count++
+	measurement.latencies = append(measurement.latencies, latency)
+	if err == nil {
+		return
+	}
+	if fault, _ := eventsourcing.IsConcurrencyFault(err); fault {
+		measurement.Faults++
+		return
+	}
+	measurement.Errors++
+}
+
+// Result holds the measurements of a store.
+type Result struct {
+	Store        string        `json:"store"`
+	Measurements []Measurement `json:"measurements"`
+	Events       int64         `json:"events"`        // Events written by the workloads
+	StorageBytes int64         `json:"storage_bytes"` // Bytes used to store them, -1 if unknown
+	Err          string        `json:"error,omitempty"`
+}
+
+// BytesPerEvent gets the storage used per event written, or -1 if unknown.
+func (result Result) BytesPerEvent() float64 {
+	if result.StorageBytes < 0 || result.Events == 0 {
+		return -1
+	}
+	return float64(result.StorageBytes) / float64(result.Events)
+}
+
+// Run measures the workloads against a store.
+func Run(target Target, options Options) Result {
+	result := Result{
+		Store:        target.Name,
+		StorageBytes: -1,
+	}
+
+	store, errOpen := target.Open()
+	if errOpen != nil {
+		result.Err = errOpen.Error()
+		return result
+	}
+	defer store.Close()
+
+	prefix := fmt.Sprintf("es-bench-%v-", uuid.NewV4())
+	keys := make([]string, options.Aggregates)
+	for index := range keys {
+		keys[index] = fmt.Sprintf("%v%v", prefix, index)
+	}
+
+	commits := measureCommits(store, keys, options.Events)
+	refreshes := measureRefreshes(store, keys)
+	bulk := measureBulk(store, prefix, options.Aggregates, options.BatchSize)
+	contention := measureContention(store, prefix+"contended", options.Writers, options.Attempts)
+	result.Measurements = []Measurement{commits, refreshes, bulk, contention}
+
+	result.Events = int64(commits.Count-commits.Faults-commits.Errors) +
+		int64(bulk.Count-bulk.Faults-bulk.Errors)*int64(options.BatchSize) +
+		int64(contention.Count-contention.Faults-contention.Errors)
+
+	if target.Size != nil {
+		size, errSize := target.Size()
+		if errSize != nil {
+			result.Err = errSize.Error()
+		} else {
+			result.StorageBytes = size
+		}
+	}
+
+	if target.Cleanup != nil {
+		errCleanup := target.Cleanup()
+		if errCleanup != nil && result.Err == "" {
+			result.Err = errCleanup.Error()
+		}
+	}
+
+	return result
+}
+
+// measureCommits commits events to each aggregate one at a time.
+func measureCommits(store eventsourcing.EventStore, keys []string, events int) Measurement {
+	measurement := Measurement{Workload: WorkloadCommit}
+	started := time.Now()
+	for _, key := range keys {
+		agg := newCounter(key, store)
+		for index := 0; index < events; index++ {
+			agg.ApplyEvent(IncrementEvent{IncrementBy: 1})
+			began := time.Now()
+			errCommit := agg.Commit()
+			measurement.record(time.Since(began), errCommit)
+			if errCommit != nil {
+				break
+			}
+		}
+	}
+	measurement.Elapsed = time.Since(started)
+	return measurement
+}
+
+// measureRefreshes rebuilds each aggregate from the store.
+func measureRefreshes(store eventsourcing.EventStore, keys []string) Measurement {
+	measurement := Measurement{Workload: WorkloadRefresh}
+	started := time.Now()
+	for _, key := range keys {
+		agg := newCounter(key, store)
+		began := time.Now()
+		errRefresh := agg.Refresh()
+		measurement.record(time.Since(began), errRefresh)
+	}
+	measurement.Elapsed = time.Since(started)
+	return measurement
+}
+
+// measureBulk commits a batch of events to each of a number of new aggregates.
+func measureBulk(store eventsourcing.EventStore, prefix string, aggregates int, batch int) Measurement {
+	measurement := Measurement{Workload: WorkloadBulk}
+	started := time.Now()
+	for index := 0; index < aggregates; index++ {
+		agg := newCounter(fmt.Sprintf("%vbulk-%v", prefix, index), store)
+		for event := 0; event < batch; event++ {
+			agg.ApplyEvent(IncrementEvent{IncrementBy: 1})
+		}
+		began := time.Now()
+		errCommit := agg.Commit()
+		measurement.record(time.Since(began), errCommit)
+	}
+	measurement.Elapsed = time.Since(started)
+	return measurement
+}
+
+// measureContention has several writers race to commit to a single aggregate,
+// without retrying, so that the rate of concurrency faults can be compared.
+func measureContention(store eventsourcing.EventStore, key string, writers int, attempts int) Measurement {
+	measurement := Measurement{Workload: WorkloadContention}
+	lock := sync.Mutex{}
+	group := sync.WaitGroup{}
+	started := time.Now()
+	for writer := 0; writer < writers; writer++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for attempt := 0; attempt < attempts; attempt++ {
+				began := time.Now()
+				agg := newCounter(key, store)
+				errCommit := agg.Refresh()
+				if errCommit == nil {
+					agg.ApplyEvent(IncrementEvent{IncrementBy: 1})
+					errCommit = agg.Commit()
+				}
+				latency := time.Since(began)
+
+				lock.Lock()
+				measurement.record(latency, errCommit)
+				lock.Unlock()
+			}
+		}()
+	}
+	group.Wait()
+	measurement.Elapsed = time.Since(started)
+	return measurement
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+)
+
+var smallOptions = Options{
+	Aggregates: 3,
+	Events:     4,
+	BatchSize:  10,
+	Writers:    4,
+	Attempts:   5,
+}
+
+// TestRunMemory checks every workload is measured against a store.
+func TestRunMemory(t *testing.T) {
+	cleaned := false
+	result := Run(Target{
+		Name: "memory",
+		Open: func() (eventsourcing.EventStore, error) {
+			return memory.NewStore(), nil
+		},
+		Size: func() (int64, error) {
+			return 1000, nil
+		},
+		Cleanup: func() error {
+			cleaned = true
+			return nil
+		},
+	}, smallOptions)
+
+	assert.Empty(t, result.Err)
+	assert.True(t, cleaned)
+	assert.Len(t, result.Measurements, 4)
+
+	workloads := map[string]Measurement{}
+	for _, measurement := range result.Measurements {
+		workloads[measurement.Workload] = measurement
+	}
+	assert.Equal(t, 12, workloads[WorkloadCommit].Count)
+	assert.Equal(t, 3, workloads[WorkloadRefresh].Count)
+	assert.Equal(t, 3, workloads[WorkloadBulk].Count)
+	contention := workloads[WorkloadContention]
+	assert.Equal(t, 20, contention.Count)
+	assert.Equal(t, 0, contention.Errors)
+
+	expected := int64(12 + 3*10 + contention.Count - contention.Faults)
+	assert.Equal(t, expected, result.Events)
+	assert.Equal(t, float64(1000)/float64(expected), result.BytesPerEvent())
+}
+
+// TestRunOpenFailure checks stores that can't be opened are reported.
+func TestRunOpenFailure(t *testing.T) {
+	result := Run(Target{
+		Name: "broken",
+		Open: func() (eventsourcing.EventStore, error) {
+			return nil, errors.New("unreachable")
+		},
+	}, smallOptions)
+
+	assert.Equal(t, "unreachable", result.Err)
+	assert.Empty(t, result.Measurements)
+	assert.Equal(t, float64(-1), result.BytesPerEvent())
+
+	out := &bytes.Buffer{}
+	assert.Nil(t, writeText(out, []Result{result}))
+	assert.Contains(t, out.String(), "failed: unreachable")
+}
+
+// TestMeasurement checks percentiles, throughput and fault rates.
+func TestMeasurement(t *testing.T) {
+	measurement := Measurement{Elapsed: time.Second}
+	for index := 1; index <= 100; index++ {
+		measurement.record(time.Duration(index)*time.Millisecond, nil)
+	}
+	assert.Equal(t, 50*time.Millisecond, measurement.Percentile(0.50))
+	assert.Equal(t, 95*time.Millisecond, measurement.Percentile(0.95))
+
+	measurement.record(time.Second, eventsourcing.NewConcurrencyFault("key", 1))
+	measurement.record(time.Second, errors.New("failed"))
+	assert.Equal(t, time.Second, measurement.Percentile(1))
+	assert.Equal(t, float64(102), measurement.Throughput())
+	assert.Equal(t, 1, measurement.Faults)
+	assert.Equal(t, 1, measurement.Errors)
+	assert.InDelta(t, 2.0/102.0, measurement.FaultRate(), 0.0001)
+	assert.Equal(t, time.Duration(0), Measurement{}.Percentile(0.5))
+}
+
+// TestReports checks the text and JSON reports.
+func TestReports(t *testing.T) {
+	text := &bytes.Buffer{}
+	assert.Nil(t, run(text, []string{"memory"}, "text", Config{}, smallOptions))
+	assert.Contains(t, text.String(), "contention")
+	assert.Contains(t, text.String(), "bytes/event")
+
+	encoded := &bytes.Buffer{}
+	assert.Nil(t, run(encoded, []string{"memory"}, "json", Config{}, smallOptions))
+	report := []map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(encoded.Bytes(), &report))
+	assert.Len(t, report, 1)
+	assert.Equal(t, "memory", report[0]["store"])
+	assert.Len(t, report[0]["measurements"], 4)
+}
+
+// TestTargets checks stores are validated before benchmarking.
+func TestTargets(t *testing.T) {
+	assert.NotNil(t, run(&bytes.Buffer{}, []string{"memory"}, "xml", Config{}, smallOptions))
+	assert.NotNil(t, run(&bytes.Buffer{}, []string{"cassandra"}, "text", Config{}, smallOptions))
+
+	_, errDynamo := newTarget("dynamo", Config{})
+	assert.NotNil(t, errDynamo)
+	_, errPostgres := newTarget("postgres", Config{})
+	assert.NotNil(t, errPostgres)
+
+	target, errMongo := newTarget("mongo", Config{})
+	require.Nil(t, errMongo)
+	assert.NotNil(t, target.Size)
+}
@@ -0,0 +1,35 @@
+package main
+
+import "github.com/go-gadgets/eventsourcing"
+
+// registry holds the events of the benchmark aggregate.
+var registry eventsourcing.EventRegistry
+
+func init() {
+	registry = eventsourcing.NewStandardEventRegistry("Benchmark")
+	registry.RegisterEvent(IncrementEvent{})
+}
+
+// Counter is the aggregate written by the workloads.
+type Counter struct {
+	eventsourcing.AggregateBase
+	Count int `json:"count"`
+}
+
+// IncrementEvent increments a counter.
+type IncrementEvent struct {
+	IncrementBy int `json:"increment_by"`
+}
+
+// newCounter creates a counter aggregate for a key.
+func newCounter(key string, store eventsourcing.EventStore) *Counter {
+	agg := &Counter{}
+	agg.Initialize(key, registry, store, func() interface{} { return agg })
+	agg.AutomaticWireup(agg)
+	return agg
+}
+
+// ReplayIncrementEvent applies an IncrementEvent to the counter.
+func (agg *Counter) ReplayIncrementEvent(event IncrementEvent) {
+	agg.Count += event.IncrementBy
+}
@@ -0,0 +1,7 @@
+//go:build pq
+// +build pq
+
+package main
+
+// Link the lib/pq driver, registered as "postgres", for the Postgres store.
+import _ "github.com/lib/pq"
@@ -0,0 +1,55 @@
+module github.com/go-gadgets/eventsourcing/cmd/es-bench
+
+go 1.24.0
+
+require (
+	github.com/aws/aws-sdk-go-v2 v1.41.1
+	github.com/go-gadgets/eventsourcing v0.0.0-00010101000000-000000000000
+	github.com/go-gadgets/eventsourcing/stores/cockroach v0.0.0-00010101000000-000000000000
+	github.com/go-gadgets/eventsourcing/stores/dynamo v0.0.0-00010101000000-000000000000
+	github.com/go-gadgets/eventsourcing/stores/mongo v0.0.0-00010101000000-000000000000
+	github.com/go-gadgets/eventsourcing/utilities/mongodoc v0.0.0-00010101000000-000000000000
+	github.com/lib/pq v1.10.9
+	github.com/satori/go.uuid v1.2.0
+	github.com/stretchr/testify v1.5.1
+	go.mongodb.org/mongo-driver v1.17.6
+)
+
+require (
+	github.com/aws/aws-sdk-go-v2/internal/configsources v1.4.16 // indirect
+	github.com/aws/aws-sdk-go-v2/internal/endpoints/v2 v2.7.16 // indirect
+	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.53.5 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/accept-encoding v1.13.4 // indirect
+	github.com/aws/aws-sdk-go-v2/service/internal/endpoint-discovery v1.11.16 // indirect
+	github.com/aws/smithy-go v1.24.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-gadgets/eventsourcing/utilities/dynamoattr v0.0.0-00010101000000-000000000000 // indirect
+	github.com/golang/snappy v0.0.4 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/mitchellh/mapstructure v0.0.0-20180220230111-00c29f56e238 // indirect
+	github.com/montanaflynn/stats v0.7.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/sirupsen/logrus v1.0.5 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/scram v1.1.2 // indirect
+	github.com/xdg-go/stringprep v1.0.4 // indirect
+	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
+	golang.org/x/crypto v0.42.0 // indirect
+	golang.org/x/sync v0.17.0 // indirect
+	golang.org/x/sys v0.36.0 // indirect
+	golang.org/x/term v0.35.0 // indirect
+	golang.org/x/text v0.29.0 // indirect
+	gopkg.in/airbrake/gobrake.v2 v2.0.9 // indirect
+	gopkg.in/gemnasium/logrus-airbrake-hook.v2 v2.1.2 // indirect
+	gopkg.in/yaml.v2 v2.3.0 // indirect
+)
+
+replace (
+	github.com/go-gadgets/eventsourcing => ../..
+	github.com/go-gadgets/eventsourcing/stores/cockroach => ../../stores/cockroach
+	github.com/go-gadgets/eventsourcing/stores/dynamo => ../../stores/dynamo
+	github.com/go-gadgets/eventsourcing/stores/mongo => ../../stores/mongo
+	github.com/go-gadgets/eventsourcing/utilities/dynamoattr => ../../utilities/dynamoattr
+	github.com/go-gadgets/eventsourcing/utilities/mongodoc => ../../utilities/mongodoc
+)
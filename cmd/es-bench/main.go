@@ -0,0 +1,82 @@
+/*
+Command es-bench runs the same workloads against several event stores and prints
+a comparison of their latency percentiles, throughput, fault rates and storage
+used per event, to guide the choice of store for a workload:
+
+	es-bench -stores memory,mongo,postgres -postgres-dsn postgres://localhost/bench
+
+The workloads are sequential single-event commits, full refreshes of the
+aggregates written, bulk commits of a batch of events, and concurrent writers
+racing to commit to a single aggregate without retrying (whose fault rate shows
+how often commits conflict). Each run writes to aggregates with unique keys, and
+Mongo and Postgres runs use a new collection or table that is dropped afterwards
+unless -keep is set. DynamoDB runs use an existing table, and don't measure
+storage, since DynamoDB only refreshes table sizes every few hours.
+
+The Postgres store is the CockroachDB store, which needs a database/sql driver
+for the Postgres wire protocol: build with -tags pq to link lib/pq.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+func main() {
+	config := Config{}
+	options := Options{}
+	stores := flag.String("stores", "memory", "Comma-separated stores to benchmark: memory, mongo, dynamo, postgres")
+	format := flag.String("format", "text", "Report format: text or json")
+	flag.IntVar(&options.Aggregates, "aggregates", 20, "Aggregates written and refreshed")
+	flag.IntVar(&options.Events, "events", 50, "Single-event commits made to each aggregate")
+	flag.IntVar(&options.BatchSize, "batch", 100, "Events in each bulk commit")
+	flag.IntVar(&options.Writers, "writers", 8, "Concurrent writers in the contention workload")
+	flag.IntVar(&options.Attempts, "attempts", 20, "Commits attempted by each contending writer")
+	flag.StringVar(&config.MongoURL, "mongo-url", "mongodb://localhost:27017", "MongoDB dial URL")
+	flag.StringVar(&config.MongoDatabase, "mongo-db", "es_bench", "MongoDB database")
+	flag.StringVar(&config.DynamoTable, "dynamo-table", "", "Existing DynamoDB table")
+	flag.StringVar(&config.DynamoEndpoint, "dynamo-endpoint", "", "DynamoDB endpoint, i.e. http://localhost:8000")
+	flag.StringVar(&config.DynamoRegion, "dynamo-region", os.Getenv("AWS_REGION"), "DynamoDB region")
+	flag.StringVar(&config.PostgresDriver, "postgres-driver", "postgres", "database/sql driver for Postgres")
+	flag.StringVar(&config.PostgresDSN, "postgres-dsn", "", "Postgres connection string")
+	flag.BoolVar(&config.Keep, "keep", false, "Keep the collections and tables written")
+	flag.Parse()
+
+	errRun := run(os.Stdout, strings.Split(*stores, ","), *format, config, options)
+	if errRun != nil {
+		fmt.Fprintf(os.Stderr, "es-bench: %v\n", errRun)
+		os.Exit(1)
+	}
+}
+
+// run benchmarks the named stores in turn, and writes the report.
+func run(out io.Writer, stores []string, format string, config Config, options Options) error {
+	write := writeText
+	switch format {
+	case "text":
+	case "json":
+		write = writeJSON
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	targets := make([]Target, 0, len(stores))
+	for _, name := range stores {
+		target, errTarget := newTarget(strings.TrimSpace(name), config)
+		if errTarget != nil {
+			return errTarget
+		}
+		targets = append(targets, target)
+	}
+
+	results := make([]Result, len(targets))
+	for index, target := range targets {
+		results[index] = Run(target, options)
+	}
+
+	return write(out, results)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// writeText writes a table comparing the stores, followed by the storage they used.
+func writeText(out io.Writer, results []Result) error {
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "store\tworkload\tops\tops/s\tp50\tp95\tp99\tfault rate\t")
+	for _, result := range results {
+		if len(result.Measurements) == 0 {
+			fmt.Fprintf(table, "%v\tfailed: %v\t\t\t\t\t\t\t\n", result.Store, result.Err)
+			continue
+		}
+		for _, measurement := range result.Measurements {
+			fmt.Fprintf(table, "%v\t%v\t%v\t%.1f\t%v\t%v\t%v\t%.2f%%\t\n",
+				result.Store,
+				measurement.Workload,
+				measurement.Count,
+				measurement.Throughput(),
+				formatLatency(measurement.Percentile(0.50)),
+				formatLatency(measurement.Percentile(0.95)),
+				formatLatency(measurement.Percentile(0.99)),
+				100*measurement.FaultRate(),
+			)
+		}
+	}
+	errFlush := table.Flush()
+	if errFlush != nil {
+		return errFlush
+	}
+
+	fmt.Fprintln(out)
+	storage := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(storage, "store\tevents\tbytes\tbytes/event\t")
+	for _, result := range results {
+		if len(result.Measurements) == 0 {
+			continue
+		}
+		if result.BytesPerEvent() < 0 {
+			fmt.Fprintf(storage, "%v\t%v\t-\t-\t\n", result.Store, result.Events)
+			continue
+		}
+		fmt.Fprintf(storage, "%v\t%v\t%v\t%.1f\t\n", result.Store, result.Events, result.StorageBytes, result.BytesPerEvent())
+	}
+	return storage.Flush()
+}
+
+// formatLatency rounds a latency for display.
+func formatLatency(latency time.Duration) string {
+	switch {
+	case latency >= time.Millisecond:
+		return latency.Round(10 * time.Microsecond).String()
+	case latency >= time.Microsecond:
+		return latency.Round(time.Microsecond).String()
+	}
+	return latency.String()
+}
+
+// jsonMeasurement is a measurement as written in a JSON report.
+type jsonMeasurement struct {
+	Measurement
+	Throughput float64 `json:"ops_per_second"`
+	P50        int64   `json:"p50_ns"`
+	P95        int64   `json:"p95_ns"`
+	P99        int64   `json:"p99_ns"`
+	FaultRate  float64 `json:"fault_rate"`
+}
+
+// jsonResult is a result as written in a JSON report.
+type jsonResult struct {
+	Result
+	Measurements  []jsonMeasurement `json:"measurements"`
+	BytesPerEvent float64           `json:"bytes_per_event"`
+}
+
+// writeJSON writes the results as JSON, for comparison by other tools.
+func writeJSON(out io.Writer, results []Result) error {
+	report := make([]jsonResult, len(results))
+	for index, result := range results {
+		report[index] = jsonResult{
+			Result:        result,
+			Measurements:  make([]jsonMeasurement, len(result.Measurements)),
+			BytesPerEvent: result.BytesPerEvent(),
+		}
+		for position, measurement := range result.Measurements {
+			report[index].Measurements[position] = jsonMeasurement{
+				Measurement: measurement,
+				Throughput:  measurement.Throughput(),
+				P50:         int64(measurement.Percentile(0.50)),
+				P95:         int64(measurement.Percentile(0.95)),
+				P99:         int64(measurement.Percentile(0.99)),
+				FaultRate:   measurement.FaultRate(),
+			}
+		}
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.mongodb.org/mongo-driver/bson"
+	mongodriver "go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/cockroach"
+	"github.com/go-gadgets/eventsourcing/stores/dynamo"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/stores/mongo"
+	"github.com/go-gadgets/eventsourcing/utilities/mongodoc"
+)
+
+// Target is a store that the workloads can be run against.
+type Target struct {
+	Name    string                                   // Name of the store in the report
+	Open    func() (eventsourcing.EventStore, error) // Opens the store
+	Size    func() (int64, error)                    // Bytes used by the events written, nil if unknown
+	Cleanup func() error                             // Removes the events written, nil if not required
+}
+
+// Config holds the connection details of the stores.
+type Config struct {
+	MongoURL       string // MongoDB connection string
+	MongoDatabase  string // Database to create the benchmark collection in
+	DynamoTable    string // Existing table, with an "aggregate_key" hash key and "seq" range key
+	DynamoEndpoint string // Endpoint override, i.e. for DynamoDB Local
+	DynamoRegion   string // Region of the table
+	PostgresDriver string // database/sql driver, which must be linked in (see driver_pq.go)
+	PostgresDSN    string // Connection string
+	Keep           bool   // Keep the collections and tables written
+}
+
+// newTarget creates the target for a named store. Collections and tables are
+// created with a unique name for each run, so storage can be measured in isolation.
+func newTarget(name string, config Config) (Target, error) {
+	suffix := time.Now().UTC().Format("20060102150405")
+
+	switch name {
+	case "memory":
+		return Target{
+			Name: name,
+			Open: func() (eventsourcing.EventStore, error) {
+				return memory.NewStore(), nil
+			},
+		}, nil
+	case "mongo":
+		return mongoTarget(config, "es_bench_"+suffix), nil
+	case "dynamo":
+		if config.DynamoTable == "" {
+			return Target{}, fmt.Errorf("a table is required to benchmark DynamoDB")
+		}
+		return dynamoTarget(config), nil
+	case "postgres":
+		if config.PostgresDSN == "" {
+			return Target{}, fmt.Errorf("a connection string is required to benchmark Postgres")
+		}
+		return postgresTarget(config, "es_bench_"+suffix), nil
+	}
+
+	return Target{}, fmt.Errorf("unknown store %q", name)
+}
+
+// mongoTarget benchmarks a new collection, measured by its data and index sizes.
+func mongoTarget(config Config, name string) Target {
+	var connection *mongodriver.Client
+	collection := func() *mongodriver.Collection {
+		return mongodoc.Collection(connection.Database(config.MongoDatabase), name)
+	}
+
+	return Target{
+		Name: "mongo",
+		Open: func() (eventsourcing.EventStore, error) {
+			dialed, errDial := mongodoc.Dial(config.MongoURL, 0)
+			if errDial != nil {
+				return nil, errDial
+			}
+			connection = dialed
+			return mongo.NewStoreWithConnection(connection, collection())
+		},
+		Size: func() (int64, error) {
+			stats := struct {
+				Size           int64 `bson:"size"`
+				TotalIndexSize int64 `bson:"totalIndexSize"`
+			}{}
+			errStats := connection.Database(config.MongoDatabase).RunCommand(context.Background(), bson.D{{Key: "collStats", Value: name}}).Decode(&stats)
+			return stats.Size + stats.TotalIndexSize, errStats
+		},
+		Cleanup: func() error {
+			if config.Keep {
+				return nil
+			}
+			return collection().Drop(context.Background())
+		},
+	}
+}
+
+// dynamoTarget benchmarks an existing table. Table sizes are only refreshed by
+// DynamoDB every few hours, so storage is not measured.
+func dynamoTarget(config Config) Target {
+	return Target{
+		Name: "dynamo",
+		Open: func() (eventsourcing.EventStore, error) {
+			if config.DynamoEndpoint != "" && os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+				return dynamo.NewStore(dynamo.LocalConfig(config.DynamoEndpoint, config.DynamoRegion), config.DynamoTable)
+			}
+
+			awsConfig := aws.Config{
+				Region:      config.DynamoRegion,
+				Credentials: aws.CredentialsProviderFunc(environmentCredentials),
+			}
+			if config.DynamoEndpoint != "" {
+				awsConfig.BaseEndpoint = aws.String(config.DynamoEndpoint)
+			}
+			return dynamo.NewStore(awsConfig, config.DynamoTable)
+		},
+	}
+}
+
+// environmentCredentials reads AWS credentials from the standard environment
+// variables, which is all the benchmark supports.
+func environmentCredentials(ctx context.Context) (aws.Credentials, error) {
+	credentials := aws.Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Source:          "Environment",
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return aws.Credentials{}, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to benchmark DynamoDB")
+	}
+	return credentials, nil
+}
+
+// postgresTarget benchmarks a new table with the CockroachDB store, which uses the
+// Postgres wire protocol, measured by the size of the table and its indexes.
+func postgresTarget(config Config, name string) Target {
+	var db *sql.DB
+	return Target{
+		Name: "postgres",
+		Open: func() (eventsourcing.EventStore, error) {
+			opened, errOpen := sql.Open(config.PostgresDriver, config.PostgresDSN)
+			if errOpen != nil {
+				return nil, errOpen
+			}
+			db = opened
+			return cockroach.NewStoreWithConnection(db, name, 0)
+		},
+		Size: func() (int64, error) {
+			size := int64(0)
+			errSize := db.QueryRow("SELECT pg_total_relation_size($1)", name).Scan(&size)
+			return size, errSize
+		},
+		Cleanup: func() error {
+			if config.Keep {
+				return nil
+			}
+			_, errDrop := db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", name))
+			return errDrop
+		},
+	}
+}
@@ -0,0 +1,140 @@
+package eventsourcing
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// Codec is an interface for reviving the untyped data of events and snapshots, as
+// read from a store or bus, into typed values.
+type Codec interface {
+	// Decode the input into the target, which is a pointer.
+	Decode(input interface{}, target interface{}) error
+}
+
+// CodecRegistry is an interface implemented by registries that allow the codec
+// used to revive their events to be replaced.
+type CodecRegistry interface {
+	// UseCodec sets the codec used to revive events.
+	UseCodec(codec Codec)
+
+	// Codec gets the codec used to revive events, or nil for the default.
+	Codec() Codec
+}
+
+// CodecFor gets the codec to use when reviving events or snapshots for a
+// registry. Registries use a mapstructure codec, with any custom type adapters
+// they support, unless another codec has been chosen.
+func CodecFor(registry interface{}) Codec {
+	chosen, ok := registry.(CodecRegistry)
+	if ok && chosen.Codec() != nil {
+		return chosen.Codec()
+	}
+
+	return NewMapCodec(DecodeHookFor(registry))
+}
+
+// mapCodec is a codec that revives values with mapstructure.
+type mapCodec struct {
+	hook mapstructure.DecodeHookFunc
+}
+
+// NewMapCodec creates the default codec, which revives values with mapstructure,
+// using the json tags of the target and weakly-typed conversions.
+func NewMapCodec(hook mapstructure.DecodeHookFunc) Codec {
+	return &mapCodec{
+		hook: hook,
+	}
+}
+
+// Decode the input into the target
+func (codec *mapCodec) Decode(input interface{}, target interface{}) error {
+	config := &mapstructure.DecoderConfig{
+		DecodeHook:       codec.hook,
+		TagName:          "json",
+		Result:           target,
+		WeaklyTypedInput: true,
+	}
+	decoder, errDecoder := mapstructure.NewDecoder(config)
+	if errDecoder != nil {
+		return errDecoder
+	}
+
+	return decoder.Decode(input)
+}
+
+// strictMapCodec is a codec that revives values with mapstructure, rejecting
+// conversions and unknown fields.
+type strictMapCodec struct {
+	hook mapstructure.DecodeHookFunc
+}
+
+// NewStrictMapCodec creates a codec that revives values with mapstructure, using
+// the json tags of the target, but without weakly-typed conversions: a value of
+// the wrong type fails the decode, as does a field the target doesn't have, other
+// than bookkeeping fields whose names start with an underscore (such as the schema
+// version of a snapshot).
+func NewStrictMapCodec(hook mapstructure.DecodeHookFunc) Codec {
+	return &strictMapCodec{
+		hook: hook,
+	}
+}
+
+// Decode the input into the target
+func (codec *strictMapCodec) Decode(input interface{}, target interface{}) error {
+	metadata := &mapstructure.Metadata{}
+	config := &mapstructure.DecoderConfig{
+		DecodeHook: codec.hook,
+		TagName:    "json",
+		Result:     target,
+		Metadata:   metadata,
+	}
+	decoder, errDecoder := mapstructure.NewDecoder(config)
+	if errDecoder != nil {
+		return errDecoder
+	}
+
+	errDecode := decoder.Decode(input)
+	if errDecode != nil {
+		return errDecode
+	}
+
+	unknown := make([]string, 0)
+	for _, key := range metadata.Unused {
+		if !strings.HasPrefix(key, "_") {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("Decode error: Unknown fields %v", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// JSONCodec is a codec that revives values by round-tripping them through
+// encoding/json, so that mapstructure is kept out of the hot path of constrained
+// builds. Input is not weakly typed, and custom identifier types must implement
+// json.Unmarshaler rather than relying on registered type adapters.
+type JSONCodec struct{}
+
+// Decode the input into the target
+func (JSONCodec) Decode(input interface{}, target interface{}) error {
+	var body []byte
+	switch typed := input.(type) {
+	case json.RawMessage:
+		body = typed
+	case []byte:
+		body = typed
+	default:
+		encoded, errEncode := json.Marshal(input)
+		if errEncode != nil {
+			return errEncode
+		}
+		body = encoded
+	}
+
+	return json.Unmarshal(body, target)
+}
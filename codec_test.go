@@ -0,0 +1,77 @@
+package eventsourcing
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// codecEvent is an event used to check codecs.
+type codecEvent struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// TestMapCodecWeaklyTyped checks the default codec accepts weakly-typed input.
+func TestMapCodecWeaklyTyped(t *testing.T) {
+	result := codecEvent{}
+	err := CodecFor(NewStandardEventRegistry("codec")).Decode(map[string]interface{}{
+		"name":  "widget",
+		"count": "3",
+	}, &result)
+
+	assert.Nil(t, err)
+	assert.Equal(t, codecEvent{Name: "widget", Count: 3}, result)
+}
+
+// TestJSONCodecRoundTrip checks the JSON codec revives maps, values and raw JSON.
+func TestJSONCodecRoundTrip(t *testing.T) {
+	inputs := []interface{}{
+		map[string]interface{}{"name": "widget", "count": json.Number("3")},
+		codecEvent{Name: "widget", Count: 3},
+		json.RawMessage(`{"name":"widget","count":3}`),
+	}
+
+	for _, input := range inputs {
+		result := codecEvent{}
+		err := JSONCodec{}.Decode(input, &result)
+		assert.Nil(t, err)
+		assert.Equal(t, codecEvent{Name: "widget", Count: 3}, result)
+	}
+}
+
+// TestJSONCodecStrict checks the JSON codec rejects weakly-typed input.
+func TestJSONCodecStrict(t *testing.T) {
+	result := codecEvent{}
+	err := JSONCodec{}.Decode(map[string]interface{}{"count": "3"}, &result)
+	assert.NotNil(t, err)
+}
+
+// TestRegistryCodec checks a registry's chosen codec is used.
+func TestRegistryCodec(t *testing.T) {
+	registry := NewStandardEventRegistry("codec")
+	_, isDefault := CodecFor(registry).(*mapCodec)
+	assert.True(t, isDefault)
+
+	registry.(CodecRegistry).UseCodec(JSONCodec{})
+	assert.Equal(t, JSONCodec{}, CodecFor(registry))
+}
+
+// TestStrictMapCodec checks the strict codec rejects conversions and unknown
+// fields, but not bookkeeping fields.
+func TestStrictMapCodec(t *testing.T) {
+	codec := NewStrictMapCodec(DecodeHookFor(NewStandardEventRegistry("codec")))
+
+	result := codecEvent{}
+	err := codec.Decode(map[string]interface{}{
+		"name":              "widget",
+		"count":             json.Number("3"),
+		"_snapshot_version": "v1",
+	}, &result)
+	assert.Nil(t, err)
+	assert.Equal(t, codecEvent{Name: "widget", Count: 3}, result)
+
+	assert.NotNil(t, codec.Decode(map[string]interface{}{"count": "3"}, &codecEvent{}), "Strings should not convert to numbers")
+	assert.NotNil(t, codec.Decode(map[string]interface{}{"label": "widget"}, &codecEvent{}), "Unknown fields should be rejected")
+}
@@ -2,6 +2,10 @@ package eventsourcing
 
 import (
 	"reflect"
+	"sort"
+
+	"github.com/go-gadgets/eventsourcing/utilities/mapping"
+	"github.com/mitchellh/mapstructure"
 )
 
 // The standardCommandRegistry is the default implementation of CommandRegistry that stores
@@ -9,6 +13,7 @@ import (
 type standardCommandRegistry struct {
 	domain   string                       // Name of the domain
 	commands map[CommandType]reflect.Type // commands to type mapping
+	adapters mapping.TypeAdapters         // custom type adapters
 }
 
 // NewStandardCommandRegistry creates an instance of a plain CommandRegistry that
@@ -18,6 +23,7 @@ func NewStandardCommandRegistry(domain string) CommandRegistry {
 	return &standardCommandRegistry{
 		domain:   domain,
 		commands: make(map[CommandType]reflect.Type),
+		adapters: make(mapping.TypeAdapters),
 	}
 }
 
@@ -58,3 +64,25 @@ func (reg standardCommandRegistry) GetCommandType(command interface{}) (CommandT
 	_, found := reg.commands[commandType]
 	return commandType, found
 }
+
+// CommandTypes gets the registered command types, in name order.
+func (reg standardCommandRegistry) CommandTypes() []CommandType {
+	result := make([]CommandType, 0, len(reg.commands))
+	for commandType := range reg.commands {
+		result = append(result, commandType)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// RegisterTypeAdapter registers an adapter that revives values of the same type
+// as the example value, allowing custom identifier types to be used in commands.
+func (reg standardCommandRegistry) RegisterTypeAdapter(example interface{}, adapter mapping.TypeAdapter) {
+	reg.adapters.Register(example, adapter)
+}
+
+// DecodeHook gets the decoder hook to use when reviving commands.
+func (reg standardCommandRegistry) DecodeHook() mapstructure.DecodeHookFunc {
+	return reg.adapters.DecodeHook()
+}
@@ -0,0 +1,11 @@
+package eventsourcing
+
+// MetadataCommitID is the event metadata entry that records the client-generated
+// ID of the commit that wrote the events (see AggregateBase.CommitWithID).
+const MetadataCommitID = "commit_id"
+
+// CommitIDOf gets the commit ID recorded in event metadata, if any.
+func CommitIDOf(metadata map[string]interface{}) string {
+	id, _ := metadata[MetadataCommitID].(string)
+	return id
+}
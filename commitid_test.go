@@ -0,0 +1,23 @@
+package eventsourcing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCommitWithID checks the commit ID is recorded in the metadata of a single
+// commit only
+func TestCommitWithID(t *testing.T) {
+	store := &metadataStore{}
+	instance := &SimpleAggregate{}
+	instance.Initialize("dummy-key", counterRegistry, store)
+	instance.ApplyEvent(IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, instance.CommitWithID("request-1"))
+	assert.Equal(t, "request-1", CommitIDOf(store.metadata))
+
+	instance.ApplyEvent(IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, instance.Commit())
+	assert.Nil(t, store.metadata)
+	assert.Equal(t, "", CommitIDOf(store.metadata))
+}
@@ -0,0 +1,27 @@
+package eventsourcing
+
+import "fmt"
+
+// Compactor is an interface implemented by stores that can replace the history of
+// a stream with a baseline of its state, for aggregates with unbounded event
+// counts whose full history isn't needed. Once compacted, a stream is replayed by
+// restoring the baseline as if it were a snapshot, and then applying the events
+// that follow it.
+type Compactor interface {
+	// Compact replaces the events of a stream up to and including the specified
+	// sequence with a baseline holding the state of the aggregate at that
+	// sequence, returning the number of events removed.
+	Compact(key string, sequence int64, state interface{}) (int64, error)
+}
+
+// Compact replaces the events of a stream up to and including the specified
+// sequence with a baseline of the state of the aggregate at that sequence, if the
+// store supports it.
+func Compact(store EventStore, key string, sequence int64, state interface{}) (int64, error) {
+	compactor, ok := store.(Compactor)
+	if !ok {
+		return 0, fmt.Errorf("StoreError: Store %T does not support compaction", store)
+	}
+
+	return compactor.Compact(key, sequence, state)
+}
@@ -0,0 +1,142 @@
+package eventsourcing
+
+import (
+	"bufio"
+	"go/build"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	// rootPackage is the import path of the core package
+	rootPackage = "github.com/go-gadgets/eventsourcing"
+)
+
+// corePackages are the packages that make up the constrained-build profile,
+// which must compile without the heavy driver dependencies.
+var corePackages = []string{
+	rootPackage,
+	rootPackage + "/distribution/inproc",
+	rootPackage + "/stores/key-value",
+	rootPackage + "/stores/memory",
+	rootPackage + "/utilities/mapping",
+}
+
+// allowedThirdParty are the only non-standard-library packages the core
+// packages may depend upon.
+var allowedThirdParty = []string{
+	"github.com/mitchellh/mapstructure",
+}
+
+// allowedModules are the only modules the root module may require directly. The
+// drivers are modules of their own, so that their SDKs are only inherited by the
+// users of each driver.
+var allowedModules = []string{
+	"github.com/google/go-cmp",
+	"github.com/klauspost/compress",
+	"github.com/mitchellh/mapstructure",
+	"github.com/satori/go.uuid",
+	"github.com/sirupsen/logrus",
+	"github.com/stretchr/testify",
+}
+
+// TestCoreDependencies checks that the core packages do not depend on any store
+// or distribution drivers (mongo, aws, sarama, redis), so that they can be used
+// in wasm and other dependency-sensitive environments.
+func TestCoreDependencies(t *testing.T) {
+	visited := make(map[string]bool)
+	for _, name := range corePackages {
+		checkDependencies(t, name, ".", visited)
+	}
+}
+
+// checkDependencies walks the import graph of a package and reports any import
+// that is not part of the standard library, the core or the allowed list.
+func checkDependencies(t *testing.T, name string, srcDir string, visited map[string]bool) {
+	pkg, errImport := build.Import(name, srcDir, 0)
+	if errImport != nil {
+		t.Errorf("Could not load package %v: %v", name, errImport)
+		return
+	}
+
+	if visited[pkg.ImportPath] || pkg.Goroot {
+		return
+	}
+	visited[pkg.ImportPath] = true
+
+	if !isAllowedDependency(pkg.ImportPath) {
+		t.Errorf("Core package imports disallowed dependency: %v", pkg.ImportPath)
+		return
+	}
+
+	for _, imported := range pkg.Imports {
+		checkDependencies(t, imported, pkg.Dir, visited)
+	}
+}
+
+// isAllowedDependency checks if an import path is permitted for the core.
+func isAllowedDependency(importPath string) bool {
+	for _, name := range corePackages {
+		if importPath == name {
+			return true
+		}
+	}
+
+	for _, name := range allowedThirdParty {
+		if importPath == name || strings.HasPrefix(importPath, name+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TestModuleDependencies checks the root module doesn't require any driver SDKs,
+// which belong in the module of the driver that uses them.
+func TestModuleDependencies(t *testing.T) {
+	file, errOpen := os.Open("go.mod")
+	if errOpen != nil {
+		t.Fatalf("Could not open go.mod: %v", errOpen)
+	}
+	defer file.Close()
+
+	inBlock := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "require (":
+			inBlock = true
+			continue
+		case inBlock && line == ")":
+			inBlock = false
+			continue
+		case strings.HasPrefix(line, "require "):
+			line = strings.TrimPrefix(line, "require ")
+		case !inBlock:
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasSuffix(line, "// indirect") {
+			continue
+		}
+		if !isAllowedModule(fields[0]) {
+			t.Errorf("Root module requires disallowed module: %v", fields[0])
+		}
+	}
+	if errScan := scanner.Err(); errScan != nil {
+		t.Fatalf("Could not read go.mod: %v", errScan)
+	}
+}
+
+// isAllowedModule checks if a module may be required by the root module.
+func isAllowedModule(path string) bool {
+	for _, name := range allowedModules {
+		if path == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package eventsourcing
+
+// DeprecationRegistry is an interface implemented by registries that can mark
+// event types as deprecated. A deprecated event type remains registered, so that
+// existing streams still replay, but should no longer be raised; the replacement
+// is the event type that new code should raise instead.
+type DeprecationRegistry interface {
+	// DeprecateEvent marks an event type as deprecated in favour of a replacement,
+	// which may be empty if the event type is simply being retired.
+	DeprecateEvent(eventType EventType, replacement EventType)
+
+	// GetDeprecation gets the replacement for an event type, and whether the
+	// event type is deprecated.
+	GetDeprecation(eventType EventType) (EventType, bool)
+
+	// DeprecatedEvents gets all deprecated event types, mapped to their replacements.
+	DeprecatedEvents() map[EventType]EventType
+}
+
+// DeprecationsFor gets the deprecated event types of a registry, mapped to their
+// replacements. Registries that do not support deprecation have none.
+func DeprecationsFor(registry interface{}) map[EventType]EventType {
+	deprecating, ok := registry.(DeprecationRegistry)
+	if !ok {
+		return map[EventType]EventType{}
+	}
+
+	return deprecating.DeprecatedEvents()
+}
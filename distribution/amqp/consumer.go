@@ -0,0 +1,316 @@
+package amqp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/distribution"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultPrefetch is the number of messages delivered ahead of those being
+	// acknowledged.
+	DefaultPrefetch = 100
+
+	// DefaultInterval is the time waited before retrying, once handling fails or
+	// the channel is lost.
+	DefaultInterval = time.Second
+)
+
+// Options contains the options for consuming events.
+type Options struct {
+	Queue    string                  // Durable queue, declared and bound to every event of the exchange
+	Start    eventsourcing.StartMode // Where the queue begins (see below)
+	Prefetch int                     // Messages delivered ahead of those acknowledged, DefaultPrefetch by default
+	Interval time.Duration           // Wait before retrying once handling fails, DefaultInterval by default
+	OnError  func(error)             // Called when consuming or handling fails, logs by default
+}
+
+// consumer reads a durable queue bound to the exchange.
+type consumer struct {
+	connect  func() (*amqp.Connection, error) // Connects to the broker
+	owned    bool                             // Whether the connection is closed on stop
+	exchange string                           // Exchange the queue is bound to
+	options  Options                          // Options
+	handlers distribution.Handlers            // Event handlers, and the event types each receives
+	lock     sync.Mutex                       // Guards the loop state
+	stop     chan struct{}                    // Stops the consuming loop
+	done     chan struct{}                    // Closed once the consuming loop exits
+	errStop  error                            // Error closing the session, set before done is closed
+}
+
+// session is an open channel consuming the queue
+type session struct {
+	conn       *amqp.Connection     // Connection, closed with the session if owned
+	channel    *amqp.Channel        // Channel
+	deliveries <-chan amqp.Delivery // Deliveries, closed once the channel is
+}
+
+// CreateConsumer creates a consumer of a queue, connecting to the broker when
+// started and disconnecting when stopped.
+//
+// The queue is declared and bound to every event of the exchange when the consumer
+// starts. A queue only holds the messages routed to it, so only FromCheckpoint and
+// FromLatest are supported. With FromCheckpoint the consumer handles the messages
+// the queue kept while it was stopped, while FromLatest purges them first.
+//
+// Messages are acknowledged once every handler that subscribes to them succeeds.
+// Messages that fail are requeued after the interval, and messages whose event
+// can't be decoded are reported and rejected, so they go to the queue's dead-letter
+// exchange if it has one. Channels that are lost are reopened after the interval.
+func CreateConsumer(endpoint Endpoint, options Options) (eventsourcing.EventConsumer, error) {
+	return newConsumer(func() (*amqp.Connection, error) {
+		return amqp.Dial(endpoint.URL)
+	}, true, endpoint.Exchange, options)
+}
+
+// CreateConsumerWithConnection creates a consumer of a queue with a connection
+// that's already been established (BYO-instance), opening a channel of its own.
+// The connection is not closed when the consumer stops.
+func CreateConsumerWithConnection(conn *amqp.Connection, exchange string, options Options) (eventsourcing.EventConsumer, error) {
+	return newConsumer(func() (*amqp.Connection, error) {
+		return conn, nil
+	}, false, exchange, options)
+}
+
+// newConsumer validates the options, and applies their defaults
+func newConsumer(connect func() (*amqp.Connection, error), owned bool, exchange string, options Options) (eventsourcing.EventConsumer, error) {
+	if exchange == "" || options.Queue == "" {
+		return nil, fmt.Errorf("amqp: an exchange and queue name are required")
+	}
+	if options.Start.Kind != eventsourcing.StartCheckpoint && options.Start.Kind != eventsourcing.StartLatest {
+		return nil, fmt.Errorf("amqp: unsupported start mode %v", options.Start)
+	}
+
+	if options.Prefetch <= 0 {
+		options.Prefetch = DefaultPrefetch
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
+	if options.OnError == nil {
+		options.OnError = func(err error) {
+			logrus.WithError(err).Error("amqp_consumer_error")
+		}
+	}
+
+	return &consumer{
+		connect:  connect,
+		owned:    owned,
+		exchange: exchange,
+		options:  options,
+	}, nil
+}
+
+// AddHandler appends a new handler to the set of handlers for this consumer. The
+// handler's subscriptions are read when it is added, so it must be initialized.
+func (consumer *consumer) AddHandler(handler eventsourcing.EventHandler) {
+	consumer.handlers.Add(handler)
+}
+
+// Start handling the events from the consumer
+func (consumer *consumer) Start() error {
+	consumer.lock.Lock()
+	defer consumer.lock.Unlock()
+	if consumer.stop != nil {
+		return nil
+	}
+
+	current, errOpen := consumer.open(consumer.options.Start.Kind == eventsourcing.StartLatest)
+	if errOpen != nil {
+		return errOpen
+	}
+
+	consumer.errStop = nil
+	consumer.stop = make(chan struct{})
+	consumer.done = make(chan struct{})
+	go consumer.run(current, consumer.stop, consumer.done)
+	return nil
+}
+
+// Stop handling events from the consumer, waiting for the message being handled
+// to finish. Messages delivered but not handled yet are requeued as the channel
+// closes.
+func (consumer *consumer) Stop() error {
+	consumer.lock.Lock()
+	stop, done := consumer.stop, consumer.done
+	consumer.stop, consumer.done = nil, nil
+	consumer.lock.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+
+	close(stop)
+	<-done
+	return consumer.errStop
+}
+
+// OrderingGuarantee reports that events are ordered per key when only one message
+// is delivered at a time, since a message that fails is then requeued at the head
+// of the queue and handled again before the next is delivered. Otherwise messages
+// are delivered ahead of those being retried, so events may be delivered in any
+// order, as they may when several consumers share a queue.
+func (consumer *consumer) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	if consumer.options.Prefetch == 1 {
+		return eventsourcing.OrderingPerKey
+	}
+	return eventsourcing.OrderingUnordered
+}
+
+// open opens a channel, declares the exchange and queue (purging the queue if
+// requested), and begins consuming it.
+func (consumer *consumer) open(purge bool) (*session, error) {
+	conn, errConnect := consumer.connect()
+	if errConnect != nil {
+		return nil, errConnect
+	}
+
+	channel, errChannel := conn.Channel()
+	if errChannel != nil {
+		if consumer.owned {
+			conn.Close()
+		}
+		return nil, errChannel
+	}
+
+	current := &session{conn: conn, channel: channel}
+	errDeclare := consumer.declare(channel, purge)
+	if errDeclare != nil {
+		consumer.close(current)
+		return nil, errDeclare
+	}
+
+	deliveries, errConsume := channel.Consume(consumer.options.Queue, "", false, false, false, false, nil)
+	if errConsume != nil {
+		consumer.close(current)
+		return nil, errConsume
+	}
+
+	current.deliveries = deliveries
+	return current, nil
+}
+
+// declare declares the exchange, and a durable queue bound to all of its events
+func (consumer *consumer) declare(channel *amqp.Channel, purge bool) error {
+	errExchange := declareExchange(channel, consumer.exchange)
+	if errExchange != nil {
+		return errExchange
+	}
+
+	_, errQueue := channel.QueueDeclare(consumer.options.Queue, true, false, false, false, nil)
+	if errQueue != nil {
+		return errQueue
+	}
+
+	errBind := channel.QueueBind(consumer.options.Queue, "#", consumer.exchange, false, nil)
+	if errBind != nil {
+		return errBind
+	}
+
+	if purge {
+		_, errPurge := channel.QueuePurge(consumer.options.Queue, false)
+		if errPurge != nil {
+			return errPurge
+		}
+	}
+
+	return channel.Qos(consumer.options.Prefetch, 0, false)
+}
+
+// close closes a session, and its connection if owned. Either may already have
+// been closed by the broker.
+func (consumer *consumer) close(current *session) error {
+	errClose := current.channel.Close()
+	if consumer.owned {
+		errConn := current.conn.Close()
+		if errClose == nil || errClose == amqp.ErrClosed {
+			errClose = errConn
+		}
+	}
+
+	if errClose == amqp.ErrClosed {
+		return nil
+	}
+	return errClose
+}
+
+// run handles deliveries until stopped, reopening the session after the interval
+// whenever it's lost.
+func (consumer *consumer) run(current *session, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	for current != nil {
+		select {
+		case <-stop:
+			consumer.errStop = consumer.close(current)
+			return
+		case delivery, ok := <-current.deliveries:
+			if ok {
+				consumer.handle(delivery, stop)
+				continue
+			}
+		}
+
+		consumer.options.OnError(fmt.Errorf("amqp: channel consuming %v was closed", consumer.options.Queue))
+		consumer.close(current)
+		current = consumer.reopen(stop)
+	}
+}
+
+// reopen opens a new session, waiting the interval before each attempt, and
+// returns nil if the consumer stops first.
+func (consumer *consumer) reopen(stop chan struct{}) *session {
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(consumer.options.Interval):
+		}
+
+		current, errOpen := consumer.open(false)
+		if errOpen == nil {
+			return current
+		}
+		consumer.options.OnError(errOpen)
+	}
+}
+
+// handle dispatches a delivery, and acknowledges it once handled. A delivery that
+// fails is requeued after the interval, unless the consumer stops first, in which
+// case closing the channel requeues it.
+func (consumer *consumer) handle(delivery amqp.Delivery, stop chan struct{}) {
+	event, wanted, errDecode := consumer.handlers.Decode(delivery.Body)
+	if errDecode != nil {
+		consumer.options.OnError(fmt.Errorf("amqp: rejecting message %v: %v", delivery.MessageId, errDecode))
+		consumer.acknowledge(delivery.Reject(false))
+		return
+	}
+
+	if wanted {
+		errDispatch := consumer.handlers.Dispatch(event)
+		if errDispatch != nil {
+			consumer.options.OnError(errDispatch)
+			select {
+			case <-stop:
+			case <-time.After(consumer.options.Interval):
+				consumer.acknowledge(delivery.Nack(false, true))
+			}
+			return
+		}
+	}
+
+	consumer.acknowledge(delivery.Ack(false))
+}
+
+// acknowledge reports a failure to acknowledge a delivery. The channel closing is
+// noticed by the consuming loop, and the broker redelivers the message.
+func (consumer *consumer) acknowledge(errAck error) {
+	if errAck != nil {
+		consumer.options.OnError(errAck)
+	}
+}
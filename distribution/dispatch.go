@@ -0,0 +1,74 @@
+/*
+Package distribution contains what the consumers of published events have in
+common, while its sub-packages distribute events over particular transports.
+*/
+package distribution
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// envelope is a published event whose payload has not been decoded yet
+type envelope struct {
+	eventsourcing.PublishedEvent
+	Data json.RawMessage `json:"data"`
+}
+
+// Handlers are the handlers of a consumer, with the event types each of them
+// subscribes to. The zero value has no handlers.
+type Handlers struct {
+	handlers []eventsourcing.EventHandler     // Event handlers
+	filter   eventsourcing.SubscriptionFilter // Event types each handler receives
+}
+
+// Add appends a handler. Handlers must be initialized before they are added, as
+// their subscriptions are read once.
+func (set *Handlers) Add(handler eventsourcing.EventHandler) {
+	set.handlers = append(set.handlers, handler)
+	set.filter = eventsourcing.NewSubscriptionFilter(set.handlers)
+}
+
+// Decode reads a published event from the JSON it was published as. The payload
+// is only decoded, with numbers kept as json.Number, if a handler subscribes to
+// the event type, and false is returned otherwise.
+func (set *Handlers) Decode(body []byte) (eventsourcing.PublishedEvent, bool, error) {
+	message := envelope{}
+	errUnmarshal := json.Unmarshal(body, &message)
+	if errUnmarshal != nil {
+		return eventsourcing.PublishedEvent{}, false, errUnmarshal
+	}
+
+	event := message.PublishedEvent
+	if !set.filter.Wanted(event.Type) {
+		return event, false, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(message.Data))
+	decoder.UseNumber()
+	errData := decoder.Decode(&event.Data)
+	if errData != nil {
+		return event, false, errData
+	}
+
+	return event, true, nil
+}
+
+// Dispatch runs an event through all handlers that subscribe to it, stopping at
+// the first that fails.
+func (set *Handlers) Dispatch(event eventsourcing.PublishedEvent) error {
+	for index, handler := range set.handlers {
+		if !set.filter.Handles(index, event.Type) {
+			continue
+		}
+
+		errHandler := handler.Handle(event)
+		if errHandler != nil {
+			return errHandler
+		}
+	}
+
+	return nil
+}
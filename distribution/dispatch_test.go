@@ -0,0 +1,65 @@
+package distribution
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/stretchr/testify/assert"
+)
+
+// subscribedHandler records the increment events it handles
+type subscribedHandler struct {
+	handled []eventsourcing.PublishedEvent
+	err     error
+}
+
+// Handle records an event
+func (handler *subscribedHandler) Handle(event eventsourcing.PublishedEvent) error {
+	handler.handled = append(handler.handled, event)
+	return handler.err
+}
+
+// Subscriptions gets the types the handler subscribes to
+func (handler *subscribedHandler) Subscriptions() []eventsourcing.EventType {
+	return []eventsourcing.EventType{"IncrementEvent"}
+}
+
+// TestDecodeSubscriptions checks payloads are only decoded when a handler wants them
+func TestDecodeSubscriptions(t *testing.T) {
+	handlers := Handlers{}
+	handlers.Add(&subscribedHandler{})
+
+	event, wanted, errDecode := handlers.Decode([]byte(`{"domain":"Testing","event_type":"IncrementEvent","key":"a","sequence":2,"data":{"increment_by":3}}`))
+	assert.Nil(t, errDecode)
+	assert.True(t, wanted)
+	assert.Equal(t, int64(2), event.Sequence)
+	assert.Equal(t, map[string]interface{}{"increment_by": json.Number("3")}, event.Data)
+
+	event, wanted, errDecode = handlers.Decode([]byte(`{"domain":"Testing","event_type":"InitializeEvent","key":"a","sequence":1,"data":{"target_value":3}}`))
+	assert.Nil(t, errDecode)
+	assert.False(t, wanted)
+	assert.Nil(t, event.Data, "Unwanted payloads should not be decoded")
+
+	_, _, errDecode = handlers.Decode([]byte("not json"))
+	assert.NotNil(t, errDecode)
+}
+
+// TestDispatch checks events reach the handlers that subscribe to them, stopping
+// at the first failure
+func TestDispatch(t *testing.T) {
+	first, second := &subscribedHandler{}, &subscribedHandler{}
+	handlers := Handlers{}
+	handlers.Add(first)
+	handlers.Add(second)
+
+	assert.Nil(t, handlers.Dispatch(eventsourcing.PublishedEvent{Type: "IncrementEvent"}))
+	assert.Nil(t, handlers.Dispatch(eventsourcing.PublishedEvent{Type: "InitializeEvent"}))
+	assert.Len(t, first.handled, 1)
+	assert.Len(t, second.handled, 1)
+
+	first.err = errors.New("failed")
+	assert.Equal(t, first.err, handlers.Dispatch(eventsourcing.PublishedEvent{Type: "IncrementEvent"}))
+	assert.Len(t, second.handled, 1, "Dispatch should stop at the first failure")
+}
@@ -0,0 +1,396 @@
+package eventhubs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-event-hubs-go/v3/persist"
+	"github.com/Shopify/sarama"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/distribution"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultConsumerGroup is the consumer group every event hub has.
+	DefaultConsumerGroup = "$Default"
+
+	// DefaultCheckpointInterval is the time between checkpoints of a partition, while
+	// events are being handled.
+	DefaultCheckpointInterval = 5 * time.Second
+
+	// DefaultInterval is the time waited before retrying, once handling fails.
+	DefaultInterval = time.Second
+)
+
+// Options contains the options for consuming an event hub.
+type Options struct {
+	Checkpoints        persist.CheckpointPersister // Stores the progress through each partition, required
+	ConsumerGroup      string                      // Consumer group the checkpoints belong to, DefaultConsumerGroup by default
+	Start              eventsourcing.StartMode     // Where partitions are read from when the consumer starts (see below)
+	CheckpointInterval time.Duration               // Time between checkpoints, DefaultCheckpointInterval by default
+	Interval           time.Duration               // Wait before retrying once handling fails, DefaultInterval by default
+	OnError            func(error)                 // Called when reading, handling or checkpointing fails, logs by default
+}
+
+// offsetLookup finds the offset of a partition at a time, or at sarama.OffsetOldest
+// or sarama.OffsetNewest
+type offsetLookup func(topic string, partition int32, time int64) (int64, error)
+
+// connection is what a consumer reads an event hub through while it's started
+type connection struct {
+	partitions sarama.Consumer // Reads the partitions
+	lookup     offsetLookup    // Finds the offsets of start positions
+	close      func() error    // Closes what the consumer owns
+}
+
+// consumer reads every partition of an event hub.
+type consumer struct {
+	connect   func() (connection, error) // Connects to the Kafka endpoint
+	namespace string                     // Namespace of the hub, that checkpoints are kept under
+	hub       string                     // Event hub to read
+	options   Options                    // Options
+	handlers  distribution.Handlers      // Event handlers, and the event types each receives
+	dispatch  sync.Mutex                 // Serializes handling across partitions
+	lock      sync.Mutex                 // Guards the loop state
+	stop      context.CancelFunc         // Stops the partition readers
+	done      chan struct{}              // Closed once every partition reader exits
+}
+
+// CreateConsumer creates a consumer of an event hub, in the manner of the Event
+// Processor Host: every partition is read by a reader of its own, and the progress
+// through each partition is checkpointed with the checkpoint persister, under the
+// hub's namespace, name and consumer group, so that consumers resume where they
+// left off. Persisters from the persist package can be used, such as the file
+// persister, or one of your own that writes to durable storage.
+//
+// The start mode applies to every partition when the consumer starts. Partitions
+// without a checkpoint are read from the start of the stream when resuming from
+// a checkpoint, and other modes ignore the checkpoints (and overwrite them as
+// events are handled). Positions are offsets, applied to every partition.
+//
+// Events are handled one at a time across the hub, in order within each partition.
+// An event that fails is retried after the interval, holding back the rest of its
+// partition, while events that can't be decoded are reported and skipped.
+func CreateConsumer(endpoint Endpoint, options Options) (eventsourcing.EventConsumer, error) {
+	brokers, hub, config, errConfig := endpoint.Config()
+	if errConfig != nil {
+		return nil, errConfig
+	}
+	namespace, _ := endpoint.Namespace()
+	config.Consumer.Return.Errors = true
+
+	return newConsumer(func() (connection, error) {
+		client, errClient := sarama.NewClient(brokers, config)
+		if errClient != nil {
+			return connection{}, errClient
+		}
+
+		partitions, errConsumer := sarama.NewConsumerFromClient(client)
+		if errConsumer != nil {
+			client.Close()
+			return connection{}, errConsumer
+		}
+
+		return connection{
+			partitions: partitions,
+			lookup:     client.GetOffset,
+			close: func() error {
+				partitions.Close()
+				return client.Close()
+			},
+		}, nil
+	}, namespace, hub, options)
+}
+
+// CreateConsumerWithClient creates a consumer of an event hub with a client that's
+// already been established (BYO-instance), which must return errors from its
+// consumers (Consumer.Return.Errors). The client is not closed when the consumer
+// stops. Checkpoints are kept under the namespace given.
+func CreateConsumerWithClient(client sarama.Client, namespace string, hub string, options Options) (eventsourcing.EventConsumer, error) {
+	return newConsumer(func() (connection, error) {
+		partitions, errConsumer := sarama.NewConsumerFromClient(client)
+		if errConsumer != nil {
+			return connection{}, errConsumer
+		}
+
+		return connection{
+			partitions: partitions,
+			lookup:     client.GetOffset,
+			close:      partitions.Close,
+		}, nil
+	}, namespace, hub, options)
+}
+
+// newConsumer creates a consumer, applying the default options
+func newConsumer(connect func() (connection, error), namespace string, hub string, options Options) (eventsourcing.EventConsumer, error) {
+	if hub == "" || options.Checkpoints == nil {
+		return nil, fmt.Errorf("eventhubs: an event hub and a checkpoint persister are required")
+	}
+
+	switch options.Start.Kind {
+	case eventsourcing.StartCheckpoint, eventsourcing.StartBeginning, eventsourcing.StartLatest, eventsourcing.StartTimestamp, eventsourcing.StartPosition:
+	default:
+		return nil, fmt.Errorf("eventhubs: unsupported start mode %v", options.Start)
+	}
+
+	if options.ConsumerGroup == "" {
+		options.ConsumerGroup = DefaultConsumerGroup
+	}
+	if options.CheckpointInterval <= 0 {
+		options.CheckpointInterval = DefaultCheckpointInterval
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
+	if options.OnError == nil {
+		options.OnError = func(err error) {
+			logrus.WithError(err).Error("eventhubs_consumer_error")
+		}
+	}
+
+	return &consumer{
+		connect:   connect,
+		namespace: namespace,
+		hub:       hub,
+		options:   options,
+	}, nil
+}
+
+// AddHandler appends a new handler to the set of handlers for this consumer. The
+// handler's subscriptions are read when it is added, so it must be initialized.
+func (consumer *consumer) AddHandler(handler eventsourcing.EventHandler) {
+	consumer.handlers.Add(handler)
+}
+
+// Start handling the events from the consumer, once connected and the partitions
+// of the hub have been listed.
+func (consumer *consumer) Start() error {
+	consumer.lock.Lock()
+	defer consumer.lock.Unlock()
+	if consumer.stop != nil {
+		return nil
+	}
+
+	conn, errConnect := consumer.connect()
+	if errConnect != nil {
+		return errConnect
+	}
+
+	partitions, errPartitions := conn.partitions.Partitions(consumer.hub)
+	if errPartitions != nil {
+		conn.close()
+		return errPartitions
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	consumer.stop = stop
+	consumer.done = make(chan struct{})
+	go consumer.run(ctx, conn, partitions, consumer.done)
+	return nil
+}
+
+// Stop handling events from the consumer, waiting for the events being handled to
+// finish and checkpointing every partition.
+func (consumer *consumer) Stop() error {
+	consumer.lock.Lock()
+	stop, done := consumer.stop, consumer.done
+	consumer.stop, consumer.done = nil, nil
+	consumer.lock.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+
+	stop()
+	<-done
+	return nil
+}
+
+// OrderingGuarantee reports that events are ordered per key, since the events of a
+// key are in one partition, and each partition is read in order.
+func (consumer *consumer) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return eventsourcing.OrderingPerKey
+}
+
+// run reads every partition until stopped, then closes the connection.
+func (consumer *consumer) run(ctx context.Context, conn connection, partitions []int32, done chan struct{}) {
+	defer close(done)
+
+	readers := sync.WaitGroup{}
+	for _, partition := range partitions {
+		readers.Add(1)
+		go func(partition int32) {
+			defer readers.Done()
+			consumer.readPartition(ctx, conn, partition)
+		}(partition)
+	}
+	readers.Wait()
+
+	errClose := conn.close()
+	if errClose != nil {
+		consumer.options.OnError(errClose)
+	}
+}
+
+// readPartition opens a partition at its start offset, retrying until it opens or
+// the consumer stops, and handles its events.
+func (consumer *consumer) readPartition(ctx context.Context, conn connection, partition int32) {
+	for ctx.Err() == nil {
+		reader, errOpen := consumer.openPartition(conn, partition)
+		if errOpen == nil {
+			consumer.handlePartition(ctx, reader, partition)
+			return
+		}
+		consumer.options.OnError(errOpen)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(consumer.options.Interval):
+		}
+	}
+}
+
+// openPartition starts reading a partition from the offset the start mode refers
+// to.
+func (consumer *consumer) openPartition(conn connection, partition int32) (sarama.PartitionConsumer, error) {
+	offset, errOffset := consumer.startOffset(conn.lookup, partition)
+	if errOffset != nil {
+		return nil, errOffset
+	}
+
+	return conn.partitions.ConsumePartition(consumer.hub, partition, offset)
+}
+
+// startOffset finds the offset within a partition that reading starts from
+func (consumer *consumer) startOffset(lookup offsetLookup, partition int32) (int64, error) {
+	start := consumer.options.Start
+	switch start.Kind {
+	case eventsourcing.StartBeginning:
+		return sarama.OffsetOldest, nil
+	case eventsourcing.StartLatest:
+		return sarama.OffsetNewest, nil
+	case eventsourcing.StartPosition:
+		return start.Position, nil
+	case eventsourcing.StartTimestamp:
+		offset, errOffset := lookup(consumer.hub, partition, start.Timestamp.UnixNano()/int64(time.Millisecond))
+		if errOffset != nil {
+			return 0, errOffset
+		}
+
+		// Nothing has been published since the timestamp
+		if offset < 0 {
+			return sarama.OffsetNewest, nil
+		}
+		return offset, nil
+	}
+
+	checkpoint, errRead := consumer.options.Checkpoints.Read(consumer.namespace, consumer.hub, consumer.options.ConsumerGroup, partitionID(partition))
+	if errRead != nil {
+		// Persisters fail to read partitions without a checkpoint, answering with the
+		// start of the stream, as the Event Processor Host expects
+		if checkpoint.Offset == persist.StartOfStream {
+			return sarama.OffsetOldest, nil
+		}
+		return 0, errRead
+	}
+
+	switch checkpoint.Offset {
+	case persist.StartOfStream:
+		return sarama.OffsetOldest, nil
+	case persist.EndOfStream:
+		return sarama.OffsetNewest, nil
+	}
+
+	offset, errParse := strconv.ParseInt(checkpoint.Offset, 10, 64)
+	if errParse != nil {
+		return 0, fmt.Errorf("eventhubs: invalid checkpoint offset %q for partition %v: %v", checkpoint.Offset, partition, errParse)
+	}
+	return offset + 1, nil
+}
+
+// handlePartition handles the events of a partition in order until the consumer
+// stops, checkpointing the last event handled every checkpoint interval and when
+// the consumer stops.
+func (consumer *consumer) handlePartition(ctx context.Context, reader sarama.PartitionConsumer, partition int32) {
+	defer reader.Close()
+
+	ticker := time.NewTicker(consumer.options.CheckpointInterval)
+	defer ticker.Stop()
+
+	var last *sarama.ConsumerMessage
+	checkpoint := func() {
+		if last == nil {
+			return
+		}
+
+		errWrite := consumer.options.Checkpoints.Write(consumer.namespace, consumer.hub, consumer.options.ConsumerGroup, partitionID(partition),
+			persist.NewCheckpoint(strconv.FormatInt(last.Offset, 10), last.Offset, last.Timestamp))
+		if errWrite != nil {
+			consumer.options.OnError(errWrite)
+			return
+		}
+		last = nil
+	}
+	defer checkpoint()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkpoint()
+		case errRead, ok := <-reader.Errors():
+			if !ok {
+				return
+			}
+			consumer.options.OnError(errRead)
+		case msg, ok := <-reader.Messages():
+			if !ok {
+				return
+			}
+			if !consumer.handle(ctx, msg) {
+				return
+			}
+			last = msg
+		}
+	}
+}
+
+// handle dispatches an event, retrying after the interval until it succeeds, and
+// returns false if the consumer stopped first. Events that can't be decoded are
+// reported and skipped.
+func (consumer *consumer) handle(ctx context.Context, msg *sarama.ConsumerMessage) bool {
+	event, wanted, errDecode := consumer.handlers.Decode(msg.Value)
+	if errDecode != nil {
+		consumer.options.OnError(fmt.Errorf("eventhubs: skipping offset %v of partition %v: %v", msg.Offset, msg.Partition, errDecode))
+		return true
+	}
+	if !wanted {
+		return true
+	}
+
+	for {
+		consumer.dispatch.Lock()
+		errDispatch := consumer.handlers.Dispatch(event)
+		consumer.dispatch.Unlock()
+		if errDispatch == nil {
+			return true
+		}
+		consumer.options.OnError(errDispatch)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(consumer.options.Interval):
+		}
+	}
+}
+
+// partitionID gets the ID of a partition, as Event Hubs names it
+func partitionID(partition int32) string {
+	return strconv.FormatInt(int64(partition), 10)
+}
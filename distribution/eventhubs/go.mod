@@ -0,0 +1,41 @@
+module github.com/go-gadgets/eventsourcing/distribution/eventhubs
+
+go 1.24.0
+
+require (
+	github.com/Azure/azure-event-hubs-go/v3 v3.2.0
+	github.com/Shopify/sarama v1.16.0
+	github.com/go-gadgets/eventsourcing v0.0.0-00010101000000-000000000000
+	github.com/go-gadgets/eventsourcing/distribution/kafka v0.0.0-00010101000000-000000000000
+	github.com/sirupsen/logrus v1.2.0
+	github.com/stretchr/testify v1.5.1
+)
+
+require (
+	github.com/bsm/sarama-cluster v2.1.13+incompatible // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/eapache/go-resiliency v1.0.0 // indirect
+	github.com/eapache/go-xerial-snappy v0.0.0-20160609142408-bb955e01b934 // indirect
+	github.com/eapache/queue v1.1.0 // indirect
+	github.com/golang/snappy v0.0.0-20170215233205-553a64147049 // indirect
+	github.com/google/go-cmp v0.5.9 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/mitchellh/mapstructure v1.1.2 // indirect
+	github.com/nxadm/tail v1.4.8 // indirect
+	github.com/pierrec/lz4 v1.0.2-0.20171218195038-2fcda4cb7018 // indirect
+	github.com/pierrec/xxHash v0.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/rcrowley/go-metrics v0.0.0-20250401214520-65e299d6c5c9 // indirect
+	github.com/satori/go.uuid v1.2.0 // indirect
+	golang.org/x/crypto v0.42.0 // indirect
+	golang.org/x/sys v0.36.0 // indirect
+	golang.org/x/term v0.35.0 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	gopkg.in/yaml.v2 v2.3.0 // indirect
+)
+
+replace (
+	github.com/go-gadgets/eventsourcing => ../..
+	github.com/go-gadgets/eventsourcing/distribution/kafka => ../../distribution/kafka
+)
@@ -0,0 +1,124 @@
+/*
+Package eventhubs distributes events through an Azure Event Hub, with a publisher
+sending each event to the hub with its aggregate key as the partition key, and
+consumers reading every partition of the hub, checkpointing their progress through
+each partition with an Event Hubs checkpoint persister (persist.CheckpointPersister).
+
+Since every event of an aggregate lands in the same partition, and partitions are
+read in order, the events of each aggregate are delivered in order.
+
+Publishers and consumers talk to the hub through the Kafka endpoint of its
+namespace, which the Standard tier and above expose on port 9093, authenticating
+with a connection string from the portal.
+*/
+package eventhubs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/distribution/kafka"
+)
+
+// KafkaPort is the port of the Kafka endpoint of an Event Hubs namespace.
+const KafkaPort = 9093
+
+// Endpoint identifies an event hub, and the connection string used to reach it.
+type Endpoint struct {
+	ConnectionString string `json:"connection_string"` // Connection string of the namespace or the hub
+	EventHub         string `json:"event_hub"`         // Name of the hub, if the connection string has no EntityPath
+}
+
+// Namespace gets the name of the Event Hubs namespace the connection string is for,
+// the first label of its host name.
+func (endpoint Endpoint) Namespace() (string, error) {
+	host, _, errParse := endpoint.parse()
+	if errParse != nil {
+		return "", errParse
+	}
+	return strings.Split(host, ".")[0], nil
+}
+
+// Config gets the Kafka brokers, hub name and sarama configuration that reach the
+// event hub, authenticating with SASL PLAIN over TLS as Event Hubs requires.
+func (endpoint Endpoint) Config() ([]string, string, *sarama.Config, error) {
+	host, hub, errParse := endpoint.parse()
+	if errParse != nil {
+		return nil, "", nil, errParse
+	}
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V1_0_0_0
+	config.Net.TLS.Enable = true
+	config.Net.TLS.Config = &tls.Config{ServerName: host}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.User = "$ConnectionString"
+	config.Net.SASL.Password = endpoint.ConnectionString
+
+	return []string{fmt.Sprintf("%v:%d", host, KafkaPort)}, hub, config, nil
+}
+
+// parse reads the host name and hub name from the connection string, which is
+// made of Key=Value pairs separated by semicolons.
+func (endpoint Endpoint) parse() (string, string, error) {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(endpoint.ConnectionString, ";") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) == 2 {
+			values[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	address, errAddress := url.Parse(values["endpoint"])
+	if errAddress != nil || address.Hostname() == "" {
+		return "", "", fmt.Errorf("eventhubs: the connection string has no valid Endpoint")
+	}
+
+	hub := endpoint.EventHub
+	if hub == "" {
+		hub = values["entitypath"]
+	}
+	if hub == "" {
+		return "", "", fmt.Errorf("eventhubs: an event hub is required")
+	}
+
+	return address.Hostname(), hub, nil
+}
+
+// CreatePublisher creates a new publisher sending events to an event hub. Events
+// are routed by their aggregate key, so all the events of an aggregate are stored
+// in order in one partition.
+func CreatePublisher(endpoint Endpoint, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	brokers, hub, config, errConfig := endpoint.Config()
+	if errConfig != nil {
+		return nil, errConfig
+	}
+
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+
+	prod, errProd := sarama.NewSyncProducer(brokers, config)
+	if errProd != nil {
+		return nil, errProd
+	}
+
+	return CreatePublisherWithProducer(prod, hub, registry)
+}
+
+// CreatePublisherWithProducer creates a publisher sending events to an event hub
+// with a producer that's already been established (BYO-instance), which should
+// partition messages by their key.
+func CreatePublisherWithProducer(prod sarama.SyncProducer, hub string, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	if hub == "" {
+		return nil, fmt.Errorf("eventhubs: an event hub is required")
+	}
+
+	// The Kafka endpoint takes the message key as the event's partition key, so the
+	// hub is published to as a Kafka topic
+	return kafka.CreatePublisherWithProducer(prod, hub, registry)
+}
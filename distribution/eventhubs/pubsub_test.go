@@ -0,0 +1,368 @@
+package eventhubs
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-event-hubs-go/v3/persist"
+	"github.com/Shopify/sarama"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHub is an in-memory event hub, with a producer partitioning messages by their
+// key and a consumer reading its partitions.
+type fakeHub struct {
+	lock        sync.Mutex
+	partitions  [][]*sarama.ConsumerMessage
+	partitioner sarama.Partitioner
+	opened      map[int32]int64
+	closed      bool
+}
+
+// newFakeHub creates a fake hub with a number of partitions
+func newFakeHub(partitions int) *fakeHub {
+	return &fakeHub{
+		partitions:  make([][]*sarama.ConsumerMessage, partitions),
+		partitioner: sarama.NewHashPartitioner("hub"),
+		opened:      make(map[int32]int64),
+	}
+}
+
+// SendMessage appends a message to the partition its key hashes to
+func (hub *fakeHub) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	partition, errPartition := hub.partitioner.Partition(msg, int32(len(hub.partitions)))
+	if errPartition != nil {
+		return 0, 0, errPartition
+	}
+
+	key, _ := msg.Key.Encode()
+	value, _ := msg.Value.Encode()
+	offset := int64(len(hub.partitions[partition]))
+	hub.partitions[partition] = append(hub.partitions[partition], &sarama.ConsumerMessage{
+		Topic:     msg.Topic,
+		Partition: partition,
+		Offset:    offset,
+		Key:       key,
+		Value:     value,
+		Timestamp: time.Unix(1500000000+offset, 0),
+	})
+	return partition, offset, nil
+}
+
+// SendMessages sends each message
+func (hub *fakeHub) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		_, _, errSend := hub.SendMessage(msg)
+		if errSend != nil {
+			return errSend
+		}
+	}
+	return nil
+}
+
+// Close does nothing, as the hub is shared with consumers
+func (hub *fakeHub) Close() error {
+	return nil
+}
+
+// Keys gets the keys of the messages in a partition
+func (hub *fakeHub) Keys(partition int32) []string {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	keys := []string{}
+	for _, msg := range hub.partitions[partition] {
+		keys = append(keys, string(msg.Key))
+	}
+	return keys
+}
+
+// Opened gets the offset a partition was last opened at
+func (hub *fakeHub) Opened(partition int32) int64 {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	return hub.opened[partition]
+}
+
+// connect gets a connection reading the hub
+func (hub *fakeHub) connect() (connection, error) {
+	reader := &fakeConsumer{hub: hub}
+	return connection{
+		partitions: reader,
+		lookup: func(topic string, partition int32, time int64) (int64, error) {
+			return time % 10, nil
+		},
+		close: func() error {
+			hub.lock.Lock()
+			defer hub.lock.Unlock()
+			hub.closed = true
+			return nil
+		},
+	}, nil
+}
+
+// fakeConsumer reads the partitions of a fake hub
+type fakeConsumer struct {
+	sarama.Consumer
+	hub *fakeHub
+}
+
+// Partitions lists the partitions of the hub
+func (reader *fakeConsumer) Partitions(topic string) ([]int32, error) {
+	reader.hub.lock.Lock()
+	defer reader.hub.lock.Unlock()
+	partitions := []int32{}
+	for partition := range reader.hub.partitions {
+		partitions = append(partitions, int32(partition))
+	}
+	return partitions, nil
+}
+
+// ConsumePartition starts delivering the messages of a partition from an offset
+func (reader *fakeConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	hub := reader.hub
+	hub.lock.Lock()
+	switch offset {
+	case sarama.OffsetOldest:
+		offset = 0
+	case sarama.OffsetNewest:
+		offset = int64(len(hub.partitions[partition]))
+	}
+	hub.opened[partition] = offset
+	hub.lock.Unlock()
+
+	consumer := &fakePartitionConsumer{
+		messages: make(chan *sarama.ConsumerMessage),
+		errors:   make(chan *sarama.ConsumerError),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go consumer.deliver(hub, partition, offset)
+	return consumer, nil
+}
+
+// fakePartitionConsumer delivers the messages of a partition of a fake hub
+type fakePartitionConsumer struct {
+	sarama.PartitionConsumer
+	messages chan *sarama.ConsumerMessage
+	errors   chan *sarama.ConsumerError
+	closing  chan struct{}
+	done     chan struct{}
+}
+
+// deliver sends the messages of the partition as they arrive, until closed
+func (consumer *fakePartitionConsumer) deliver(hub *fakeHub, partition int32, offset int64) {
+	defer close(consumer.done)
+	for {
+		hub.lock.Lock()
+		var next *sarama.ConsumerMessage
+		if offset < int64(len(hub.partitions[partition])) {
+			next = hub.partitions[partition][offset]
+		}
+		hub.lock.Unlock()
+
+		if next == nil {
+			select {
+			case <-consumer.closing:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			continue
+		}
+
+		select {
+		case <-consumer.closing:
+			return
+		case consumer.messages <- next:
+			offset++
+		}
+	}
+}
+
+// Messages gets the messages delivered
+func (consumer *fakePartitionConsumer) Messages() <-chan *sarama.ConsumerMessage {
+	return consumer.messages
+}
+
+// Errors gets the errors reading the partition
+func (consumer *fakePartitionConsumer) Errors() <-chan *sarama.ConsumerError {
+	return consumer.errors
+}
+
+// Close stops delivering messages
+func (consumer *fakePartitionConsumer) Close() error {
+	close(consumer.closing)
+	<-consumer.done
+	return nil
+}
+
+// failingPersister is a checkpoint persister that can't be read
+type failingPersister struct {
+	persist.MemoryPersister
+}
+
+// Read fails
+func (persister *failingPersister) Read(namespace, name, consumerGroup, partitionID string) (persist.Checkpoint, error) {
+	return persist.Checkpoint{}, errors.New("unreachable")
+}
+
+// consume starts a consumer of a fake hub with a recording handler
+func consume(t *testing.T, hub *fakeHub, handler *test.RecordingHandler, options Options) eventsourcing.EventConsumer {
+	options.Interval = 10 * time.Millisecond
+	options.OnError = func(error) {}
+	consumer, errCreate := newConsumer(hub.connect, "testing", "hub", options)
+	require.Nil(t, errCreate)
+
+	consumer.AddHandler(handler)
+	assert.Nil(t, consumer.Start())
+	return consumer
+}
+
+// TestPublishConsume checks the events of a key are routed to one partition, and
+// delivered in order with failures retried, and that consumers resume from the
+// checkpoints of each partition
+func TestPublishConsume(t *testing.T) {
+	hub := newFakeHub(4)
+	pub, errPub := CreatePublisherWithProducer(hub, "hub", test.GetTestRegistry())
+	require.Nil(t, errPub)
+	assert.Equal(t, eventsourcing.OrderingPerKey, eventsourcing.OrderingOf(pub))
+	test.PublishIncrements(t, pub, "a", 1, 3)
+
+	routed := 0
+	for partition := int32(0); partition < 4; partition++ {
+		keys := hub.Keys(partition)
+		if len(keys) > 0 {
+			routed++
+			assert.Equal(t, []string{"a", "a", "a"}, keys)
+		}
+	}
+	assert.Equal(t, 1, routed)
+
+	checkpoints := persist.NewMemoryPersister()
+	handler := test.CreateRecordingHandler(true)
+	consumer := consume(t, hub, handler, Options{Checkpoints: checkpoints})
+	assert.Equal(t, eventsourcing.OrderingPerKey, eventsourcing.OrderingOf(consumer))
+
+	test.PublishIncrements(t, pub, "a", 4, 2)
+	assert.True(t, test.WaitFor(func() bool { return handler.Count() == 5 }))
+	assert.Nil(t, consumer.Stop())
+	assert.True(t, hub.closed)
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, handler.Seen())
+	assert.Equal(t, 1, handler.Fails())
+
+	// Stopping checkpointed the partition at the last event handled
+	partition, _, _ := hub.SendMessage(&sarama.ProducerMessage{Key: sarama.StringEncoder("a"), Value: sarama.StringEncoder("not json")})
+	checkpoint, errRead := checkpoints.Read("testing", "hub", DefaultConsumerGroup, partitionID(partition))
+	assert.Nil(t, errRead)
+	assert.Equal(t, "4", checkpoint.Offset)
+	assert.Equal(t, int64(4), checkpoint.SequenceNumber)
+
+	// Resuming skips what was handled, and events that can't be decoded
+	test.PublishIncrements(t, pub, "a", 6, 1)
+	resumed := test.CreateRecordingHandler(false)
+	consumer = consume(t, hub, resumed, Options{Checkpoints: checkpoints, CheckpointInterval: 10 * time.Millisecond})
+	defer consumer.Stop()
+	assert.True(t, test.WaitFor(func() bool { return resumed.Count() == 1 }))
+	assert.Equal(t, int64(5), hub.Opened(partition))
+	assert.True(t, test.WaitFor(func() bool {
+		checkpoint, _ := checkpoints.Read("testing", "hub", DefaultConsumerGroup, partitionID(partition))
+		return checkpoint.Offset == "6"
+	}))
+}
+
+// TestStartOffset checks the offset each start mode and checkpoint reads from
+func TestStartOffset(t *testing.T) {
+	lookup := func(topic string, partition int32, time int64) (int64, error) {
+		if time == 0 {
+			return -1, nil
+		}
+		return 7, nil
+	}
+	offset := func(start eventsourcing.StartMode, checkpoints persist.CheckpointPersister) (int64, error) {
+		created, errCreate := newConsumer(newFakeHub(1).connect, "testing", "hub", Options{Start: start, Checkpoints: checkpoints})
+		require.Nil(t, errCreate)
+		return created.(*consumer).startOffset(lookup, 0)
+	}
+
+	checkpoints := persist.NewMemoryPersister()
+	found, _ := offset(eventsourcing.FromCheckpoint(), checkpoints)
+	assert.Equal(t, sarama.OffsetOldest, found)
+
+	checkpoints.Write("testing", "hub", DefaultConsumerGroup, "0", persist.NewCheckpointFromEndOfStream())
+	found, _ = offset(eventsourcing.FromCheckpoint(), checkpoints)
+	assert.Equal(t, sarama.OffsetNewest, found)
+
+	checkpoints.Write("testing", "hub", DefaultConsumerGroup, "0", persist.NewCheckpoint("41", 41, time.Now()))
+	found, _ = offset(eventsourcing.FromCheckpoint(), checkpoints)
+	assert.Equal(t, int64(42), found)
+
+	checkpoints.Write("testing", "hub", DefaultConsumerGroup, "0", persist.NewCheckpoint("latest", 0, time.Now()))
+	_, errOffset := offset(eventsourcing.FromCheckpoint(), checkpoints)
+	assert.NotNil(t, errOffset)
+
+	_, errOffset = offset(eventsourcing.FromCheckpoint(), &failingPersister{})
+	assert.NotNil(t, errOffset)
+
+	files, _ := persist.NewFilePersister(t.TempDir())
+	found, _ = offset(eventsourcing.FromCheckpoint(), files)
+	assert.Equal(t, sarama.OffsetOldest, found)
+
+	found, _ = offset(eventsourcing.FromBeginning(), checkpoints)
+	assert.Equal(t, sarama.OffsetOldest, found)
+	found, _ = offset(eventsourcing.FromLatest(), checkpoints)
+	assert.Equal(t, sarama.OffsetNewest, found)
+	found, _ = offset(eventsourcing.FromPosition(12), checkpoints)
+	assert.Equal(t, int64(12), found)
+	found, _ = offset(eventsourcing.FromTimestamp(time.Unix(1500000000, 0)), checkpoints)
+	assert.Equal(t, int64(7), found)
+	found, _ = offset(eventsourcing.FromTimestamp(time.Unix(0, 0)), checkpoints)
+	assert.Equal(t, sarama.OffsetNewest, found)
+}
+
+// TestEndpoint checks connection strings are read into the Kafka configuration
+func TestEndpoint(t *testing.T) {
+	endpoint := Endpoint{
+		ConnectionString: "Endpoint=sb://testing.servicebus.windows.net/;SharedAccessKeyName=send;SharedAccessKey=c2VjcmV0=;EntityPath=events",
+	}
+	brokers, hub, config, errConfig := endpoint.Config()
+	assert.Nil(t, errConfig)
+	assert.Equal(t, []string{"testing.servicebus.windows.net:9093"}, brokers)
+	assert.Equal(t, "events", hub)
+	assert.True(t, config.Net.TLS.Enable)
+	assert.Equal(t, "$ConnectionString", config.Net.SASL.User)
+	assert.Equal(t, endpoint.ConnectionString, config.Net.SASL.Password)
+	assert.Nil(t, config.Validate())
+
+	namespace, _ := endpoint.Namespace()
+	assert.Equal(t, "testing", namespace)
+
+	endpoint.EventHub = "other"
+	_, hub, _, _ = endpoint.Config()
+	assert.Equal(t, "other", hub)
+
+	_, _, _, errConfig = Endpoint{ConnectionString: "Endpoint=sb://testing.servicebus.windows.net/"}.Config()
+	assert.NotNil(t, errConfig)
+	_, _, _, errConfig = Endpoint{ConnectionString: "SharedAccessKey=secret", EventHub: "events"}.Config()
+	assert.NotNil(t, errConfig)
+}
+
+// TestCreate checks invalid options are rejected
+func TestCreate(t *testing.T) {
+	_, errCreate := CreatePublisherWithProducer(newFakeHub(1), "", test.GetTestRegistry())
+	assert.NotNil(t, errCreate)
+	_, errCreate = newConsumer(newFakeHub(1).connect, "testing", "hub", Options{})
+	assert.NotNil(t, errCreate)
+	_, errCreate = newConsumer(newFakeHub(1).connect, "testing", "", Options{Checkpoints: persist.NewMemoryPersister()})
+	assert.NotNil(t, errCreate)
+	_, errCreate = newConsumer(newFakeHub(1).connect, "testing", "hub", Options{
+		Checkpoints: persist.NewMemoryPersister(),
+		Start:       eventsourcing.StartMode{Kind: eventsourcing.StartKind(99)},
+	})
+	assert.NotNil(t, errCreate)
+}
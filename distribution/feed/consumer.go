@@ -0,0 +1,207 @@
+/*
+Package feed contains a consumer that polls the global feed of a store (see
+eventsourcing.GlobalReader), allowing projections to consume every event in the
+store without a distribution bus such as Kafka.
+*/
+package feed
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultBatchSize is the number of events read from the feed at a time.
+const DefaultBatchSize = 100
+
+// DefaultInterval is the time waited before polling again, once the end of the
+// feed is reached.
+const DefaultInterval = time.Second
+
+// Options contains the options for consuming a feed.
+type Options struct {
+	Domain     string              // Domain to set on consumed events, since stores don't record it
+	Category   string              // Category to consume (see eventsourcing.CategoryReader), empty for every event
+	From       string              // Position to resume after, empty to read from the start of the feed
+	BatchSize  int                 // Events read at a time, DefaultBatchSize by default
+	Interval   time.Duration       // Wait between polls at the end of the feed, DefaultInterval by default
+	OnPosition func(string) error  // Called with the position once a batch is handled, for checkpoints
+	OnError    func(error)         // Called when reading or handling fails, logs by default
+	Clock      eventsourcing.Clock // Source of time for the interval, the system clock by default
+}
+
+// readFunc reads a batch of events from a feed.
+type readFunc func(from string, limit int) ([]eventsourcing.GlobalEvent, error)
+
+// consumer polls the global feed of a store.
+type consumer struct {
+	store    eventsourcing.EventStore         // Store whose feed is read
+	read     readFunc                         // Feed to read
+	options  Options                          // Options
+	handlers []eventsourcing.EventHandler     // Event handlers
+	filter   eventsourcing.SubscriptionFilter // Event types each handler receives
+	lock     sync.Mutex                       // Guards the position and loop state
+	position string                           // Position of the last handled event
+	stop     chan struct{}                    // Stops the poll loop
+	done     chan struct{}                    // Closed once the poll loop exits
+}
+
+// CreateConsumer creates a consumer of the global feed of a store, or of a single
+// category within it. Batches are handled in feed order, and a batch whose
+// handling fails is retried from the failed event once the interval has passed.
+func CreateConsumer(store eventsourcing.EventStore, options Options) (eventsourcing.EventConsumer, error) {
+	var read readFunc
+	if options.Category != "" {
+		reader, ok := store.(eventsourcing.CategoryReader)
+		if !ok {
+			return nil, fmt.Errorf("feed: store %T cannot read categories", store)
+		}
+		read = func(from string, limit int) ([]eventsourcing.GlobalEvent, error) {
+			return reader.ReadCategory(options.Category, from, limit)
+		}
+	} else {
+		reader, ok := store.(eventsourcing.GlobalReader)
+		if !ok {
+			return nil, fmt.Errorf("feed: store %T cannot read all events", store)
+		}
+		read = reader.ReadAll
+	}
+
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBatchSize
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
+	if options.OnError == nil {
+		options.OnError = func(err error) {
+			logrus.WithError(err).Error("feed_consumer_error")
+		}
+	}
+	if options.Clock == nil {
+		options.Clock = eventsourcing.SystemClock
+	}
+
+	return &consumer{
+		store:    store,
+		read:     read,
+		options:  options,
+		handlers: make([]eventsourcing.EventHandler, 0),
+		position: options.From,
+	}, nil
+}
+
+// AddHandler appends a new handler to the set of handlers for this consumer
+func (consumer *consumer) AddHandler(handler eventsourcing.EventHandler) {
+	consumer.handlers = append(consumer.handlers, handler)
+	consumer.filter = eventsourcing.NewSubscriptionFilter(consumer.handlers)
+}
+
+// Start polling the feed
+func (consumer *consumer) Start() error {
+	consumer.lock.Lock()
+	defer consumer.lock.Unlock()
+	if consumer.stop != nil {
+		return nil
+	}
+
+	consumer.stop = make(chan struct{})
+	consumer.done = make(chan struct{})
+	go consumer.run(consumer.stop, consumer.done)
+	return nil
+}
+
+// Stop polling the feed, waiting for the batch being handled to finish
+func (consumer *consumer) Stop() error {
+	consumer.lock.Lock()
+	stop, done := consumer.stop, consumer.done
+	consumer.stop, consumer.done = nil, nil
+	consumer.lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return nil
+}
+
+// OrderingGuarantee reports the ordering of the feed of the store (see
+// eventsourcing.FeedOrdering), which batches keep since a failed batch is retried
+// from the failed event.
+func (consumer *consumer) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return eventsourcing.FeedOrdering(consumer.store)
+}
+
+// run polls the feed until stopped, waiting between polls once caught up.
+func (consumer *consumer) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	for {
+		caughtUp, errPoll := consumer.poll()
+		if errPoll != nil {
+			consumer.options.OnError(errPoll)
+		}
+
+		wait := time.Duration(0)
+		if caughtUp || errPoll != nil {
+			wait = consumer.options.Interval
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-consumer.options.Clock.After(wait):
+		}
+	}
+}
+
+// poll reads and handles a batch of events, reporting whether the end of the feed
+// has been reached.
+func (consumer *consumer) poll() (bool, error) {
+	consumer.lock.Lock()
+	from := consumer.position
+	consumer.lock.Unlock()
+
+	events, errRead := consumer.read(from, consumer.options.BatchSize)
+	if errRead != nil {
+		return false, errRead
+	}
+
+	for _, event := range events {
+		event.Domain = consumer.options.Domain
+		for index, handler := range consumer.handlers {
+			if !consumer.filter.Handles(index, event.Type) {
+				continue
+			}
+			errHandle := handler.Handle(event.PublishedEvent)
+			if errHandle != nil {
+				consumer.advance(from)
+				return false, errHandle
+			}
+		}
+		from = event.Position
+	}
+
+	errAdvance := consumer.advance(from)
+	if errAdvance != nil {
+		return false, errAdvance
+	}
+
+	return len(events) < consumer.options.BatchSize, nil
+}
+
+// advance moves the consumer on to a position, recording it with OnPosition.
+func (consumer *consumer) advance(position string) error {
+	consumer.lock.Lock()
+	changed := consumer.position != position
+	consumer.position = position
+	consumer.lock.Unlock()
+
+	if changed && consumer.options.OnPosition != nil {
+		return consumer.options.OnPosition(position)
+	}
+	return nil
+}
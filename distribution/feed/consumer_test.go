@@ -0,0 +1,187 @@
+package feed
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/simclock"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingHandler records events, optionally failing once.
+type recordingHandler struct {
+	lock   sync.Mutex
+	events []eventsourcing.PublishedEvent
+	fail   bool
+}
+
+func (handler *recordingHandler) Handle(event eventsourcing.PublishedEvent) error {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if handler.fail {
+		handler.fail = false
+		return errors.New("failed")
+	}
+	handler.events = append(handler.events, event)
+	return nil
+}
+
+func (handler *recordingHandler) count() int {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	return len(handler.events)
+}
+
+func commit(t *testing.T, store eventsourcing.EventStore, key string, count int) {
+	agg := test.SimpleAggregate{}
+	agg.Initialize(key, test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	for i := 0; i < count; i++ {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	}
+	assert.Nil(t, agg.Commit())
+}
+
+// TestCreateConsumer checks the store must support reading all events.
+func TestCreateConsumer(t *testing.T) {
+	_, errCreate := CreateConsumer(eventsourcing.NewMiddlewareWrapper(memory.NewStore()), Options{})
+	assert.NotNil(t, errCreate)
+}
+
+// orderedStore is a store whose feed is ordered globally
+type orderedStore struct {
+	eventsourcing.EventStore
+	eventsourcing.GlobalReader
+}
+
+// OrderingGuarantee reports the feed is ordered globally
+func (store orderedStore) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return eventsourcing.OrderingGlobal
+}
+
+// TestFeedOrdering checks the consumer reports the ordering of the store's feed
+func TestFeedOrdering(t *testing.T) {
+	store := memory.NewStore()
+	ordered, errCreate := CreateConsumer(orderedStore{store, store.(eventsourcing.GlobalReader)}, Options{})
+	assert.Nil(t, errCreate)
+	assert.Equal(t, eventsourcing.OrderingGlobal, eventsourcing.OrderingOf(ordered))
+}
+
+// TestConsumeFeed checks every event is delivered in order, with positions
+// recorded as batches are handled.
+func TestConsumeFeed(t *testing.T) {
+	store := memory.NewStore()
+	commit(t, store, "a", 3)
+	commit(t, store, "b", 2)
+
+	positions := make(chan string, 100)
+	consumer, errCreate := CreateConsumer(store, Options{
+		Domain:    "Testing",
+		BatchSize: 2,
+		Interval:  10 * time.Millisecond,
+		OnPosition: func(position string) error {
+			positions <- position
+			return nil
+		},
+		OnError: func(error) {},
+	})
+	require.Nil(t, errCreate)
+	assert.Equal(t, eventsourcing.OrderingPerKey, eventsourcing.OrderingOf(consumer))
+
+	handler := &recordingHandler{fail: true}
+	consumer.AddHandler(handler)
+	assert.Nil(t, consumer.Start())
+	defer consumer.Stop()
+
+	assert.True(t, test.WaitFor(func() bool { return handler.count() == 5 }))
+
+	// Later commits are picked up by polling
+	commit(t, store, "a", 1)
+	assert.True(t, test.WaitFor(func() bool { return handler.count() == 6 }))
+	assert.Nil(t, consumer.Stop())
+
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	assert.Equal(t, "a", handler.events[0].Key)
+	assert.Equal(t, int64(1), handler.events[0].Sequence)
+	assert.Equal(t, "Testing", handler.events[0].Domain)
+	assert.Equal(t, "b", handler.events[4].Key)
+	assert.Equal(t, int64(4), handler.events[5].Sequence)
+
+	last := ""
+	for len(positions) > 0 {
+		last = <-positions
+	}
+	assert.Equal(t, "6", last)
+}
+
+// TestResumeFeed checks consumption resumes after a position.
+func TestResumeFeed(t *testing.T) {
+	store := memory.NewStore()
+	commit(t, store, "a", 4)
+
+	consumer, _ := CreateConsumer(store, Options{From: "3", Interval: 10 * time.Millisecond})
+	handler := &recordingHandler{}
+	consumer.AddHandler(handler)
+	consumer.Start()
+	assert.True(t, test.WaitFor(func() bool { return handler.count() == 1 }))
+	consumer.Stop()
+
+	assert.Equal(t, int64(4), handler.events[0].Sequence)
+}
+
+// TestConsumeCategory checks only the events of a category are consumed.
+func TestConsumeCategory(t *testing.T) {
+	store := memory.NewStore()
+	for _, key := range []string{"a", "b"} {
+		agg := test.SimpleAggregate{}
+		agg.Initialize(key, test.GetTestRegistry(), store)
+		if key == "b" {
+			agg.UseCategory("Counter")
+		}
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+		assert.Nil(t, agg.Commit())
+	}
+
+	consumer, errCreate := CreateConsumer(store, Options{Category: "Counter", Interval: 10 * time.Millisecond})
+	require.Nil(t, errCreate)
+	handler := &recordingHandler{}
+	consumer.AddHandler(handler)
+	consumer.Start()
+	assert.True(t, test.WaitFor(func() bool { return handler.count() == 1 }))
+	consumer.Stop()
+
+	assert.Equal(t, "b", handler.events[0].Key)
+}
+
+// TestPollInterval checks the feed is only polled again once the interval has
+// passed after catching up.
+func TestPollInterval(t *testing.T) {
+	store := memory.NewStore()
+	commit(t, store, "a", 1)
+
+	clock := simclock.New(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	consumer, _ := CreateConsumer(store, Options{Interval: time.Minute, Clock: clock})
+	handler := &recordingHandler{}
+	consumer.AddHandler(handler)
+	assert.Nil(t, consumer.Start())
+	defer consumer.Stop()
+
+	// Once caught up, the consumer waits on the clock
+	clock.BlockUntil(1)
+	assert.Equal(t, 1, handler.count())
+
+	commit(t, store, "a", 1)
+	clock.Advance(59 * time.Second)
+	assert.Equal(t, 1, handler.count())
+
+	clock.Advance(time.Second)
+	clock.BlockUntil(1)
+	assert.Equal(t, 2, handler.count())
+}
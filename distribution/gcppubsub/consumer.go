@@ -0,0 +1,417 @@
+package gcppubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/distribution"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+const (
+	// DefaultBatchSize is the number of messages pulled at a time.
+	DefaultBatchSize = 100
+
+	// DefaultAckDeadline is the acknowledgement deadline of the messages being
+	// handled, which is also Pub/Sub's default for a subscription.
+	DefaultAckDeadline = 10 * time.Second
+
+	// MaxAckDeadline is the longest acknowledgement deadline Pub/Sub allows.
+	MaxAckDeadline = 600 * time.Second
+
+	// DefaultMaxExtension is the longest the deadline of a message being handled is
+	// extended for, after which it's left to be redelivered.
+	DefaultMaxExtension = time.Hour
+
+	// DefaultMaxDeliveryAttempts is the number of times a message is delivered before
+	// it's forwarded to the dead-letter topic.
+	DefaultMaxDeliveryAttempts = 5
+
+	// DefaultInterval is the time waited before retrying, once handling fails.
+	DefaultInterval = time.Second
+)
+
+// Options contains the options for consuming a subscription.
+type Options struct {
+	Topic               string        // Topic to create the subscription on if it doesn't exist, none by default
+	Ordered             bool          // Whether the subscription has message ordering enabled, as those created by the consumer do
+	DeadLetterTopic     string        // Topic that messages failing MaxDeliveryAttempts times are forwarded to, none by default
+	MaxDeliveryAttempts int           // Deliveries before a message is dead-lettered, DefaultMaxDeliveryAttempts by default
+	BatchSize           int           // Messages pulled at a time, DefaultBatchSize by default
+	AckDeadline         time.Duration // Deadline of the messages being handled, DefaultAckDeadline by default
+	MaxExtension        time.Duration // Longest a message's deadline is extended for, DefaultMaxExtension by default
+	Interval            time.Duration // Wait before retrying once handling fails, DefaultInterval by default
+	OnError             func(error)   // Called when pulling or handling fails, logs by default
+}
+
+// SubscriberAPI is the part of the Pub/Sub subscriber client that consumers use,
+// which is implemented by pubsubpb.SubscriberClient.
+type SubscriberAPI interface {
+	CreateSubscription(ctx context.Context, in *pubsubpb.Subscription, opts ...grpc.CallOption) (*pubsubpb.Subscription, error)
+	UpdateSubscription(ctx context.Context, in *pubsubpb.UpdateSubscriptionRequest, opts ...grpc.CallOption) (*pubsubpb.Subscription, error)
+	Pull(ctx context.Context, in *pubsubpb.PullRequest, opts ...grpc.CallOption) (*pubsubpb.PullResponse, error)
+	Acknowledge(ctx context.Context, in *pubsubpb.AcknowledgeRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	ModifyAckDeadline(ctx context.Context, in *pubsubpb.ModifyAckDeadlineRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+}
+
+// consumer pulls events from a Pub/Sub subscription.
+type consumer struct {
+	client       SubscriberAPI         // Pub/Sub subscriber client
+	subscription string                // Subscription to pull from
+	options      Options               // Options
+	handlers     distribution.Handlers // Event handlers, and the event types each receives
+	lock         sync.Mutex            // Guards the loop state
+	stop         context.CancelFunc    // Stops the pull loop
+	done         chan struct{}         // Closed once the pull loop exits
+}
+
+// CreateConsumer creates a consumer of a subscription, named in full as
+// projects/<project>/subscriptions/<subscription>.
+//
+// The subscription keeps the consumer's position, so there are no start modes, and
+// every consumer of the subscription shares its messages. When a topic is given,
+// the subscription is created on it when the consumer starts if it doesn't exist,
+// with message ordering enabled. When a dead-letter topic is given, the
+// subscription's dead-letter policy is set when the consumer starts, and Pub/Sub's
+// service account must be allowed to publish to the topic and to acknowledge the
+// subscription's messages.
+//
+// Messages are acknowledged once every handler that subscribes to them succeeds,
+// and their deadline is extended while they're being handled. When a message fails,
+// it and the messages of its key that follow it are handed back to be redelivered,
+// until it's dead-lettered. Messages whose event can't be decoded are reported, and
+// are either handed back to be dead-lettered or acknowledged so they aren't
+// delivered again.
+func CreateConsumer(conn grpc.ClientConnInterface, subscription string, options Options) (eventsourcing.EventConsumer, error) {
+	return CreateConsumerWithClient(pubsubpb.NewSubscriberClient(conn), subscription, options)
+}
+
+// CreateConsumerWithClient creates a consumer of a subscription with a client that's
+// already been created (BYO-instance).
+func CreateConsumerWithClient(client SubscriberAPI, subscription string, options Options) (eventsourcing.EventConsumer, error) {
+	if subscription == "" {
+		return nil, fmt.Errorf("gcppubsub: a subscription is required")
+	}
+
+	if options.MaxDeliveryAttempts <= 0 {
+		options.MaxDeliveryAttempts = DefaultMaxDeliveryAttempts
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBatchSize
+	}
+	if options.AckDeadline <= 0 {
+		options.AckDeadline = DefaultAckDeadline
+	}
+	if options.AckDeadline > MaxAckDeadline {
+		options.AckDeadline = MaxAckDeadline
+	}
+	if options.MaxExtension <= 0 {
+		options.MaxExtension = DefaultMaxExtension
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
+	if options.OnError == nil {
+		options.OnError = func(err error) {
+			logrus.WithError(err).Error("gcppubsub_consumer_error")
+		}
+	}
+
+	return &consumer{
+		client:       client,
+		subscription: subscription,
+		options:      options,
+	}, nil
+}
+
+// AddHandler appends a new handler to the set of handlers for this consumer. The
+// handler's subscriptions are read when it is added, so it must be initialized.
+func (consumer *consumer) AddHandler(handler eventsourcing.EventHandler) {
+	consumer.handlers.Add(handler)
+}
+
+// Start handling the events from the consumer, once the subscription has been
+// created or its dead-letter policy set, if the options call for it.
+func (consumer *consumer) Start() error {
+	consumer.lock.Lock()
+	defer consumer.lock.Unlock()
+	if consumer.stop != nil {
+		return nil
+	}
+
+	errPrepare := consumer.prepare(context.Background())
+	if errPrepare != nil {
+		return errPrepare
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	consumer.stop = stop
+	consumer.done = make(chan struct{})
+	go consumer.run(ctx, consumer.done)
+	return nil
+}
+
+// Stop handling events from the consumer, abandoning the pull in progress and
+// waiting for the batch being handled to finish.
+func (consumer *consumer) Stop() error {
+	consumer.lock.Lock()
+	stop, done := consumer.stop, consumer.done
+	consumer.stop, consumer.done = nil, nil
+	consumer.lock.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+
+	stop()
+	<-done
+	return nil
+}
+
+// OrderingGuarantee reports that events are ordered per key when the subscription
+// has message ordering enabled, since the events of a key are then delivered in
+// order, and those following a message that's handed back are redelivered after it.
+// Otherwise messages are delivered in any order.
+func (consumer *consumer) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	if consumer.options.Ordered {
+		return eventsourcing.OrderingPerKey
+	}
+	return eventsourcing.OrderingUnordered
+}
+
+// deadLetterPolicy gets the dead-letter policy called for by the options, if any
+func (consumer *consumer) deadLetterPolicy() *pubsubpb.DeadLetterPolicy {
+	if consumer.options.DeadLetterTopic == "" {
+		return nil
+	}
+
+	return &pubsubpb.DeadLetterPolicy{
+		DeadLetterTopic:     consumer.options.DeadLetterTopic,
+		MaxDeliveryAttempts: int32(consumer.options.MaxDeliveryAttempts),
+	}
+}
+
+// prepare creates the subscription if a topic is given and it doesn't exist, and
+// sets the dead-letter policy of a subscription that already exists.
+func (consumer *consumer) prepare(ctx context.Context) error {
+	if consumer.options.Topic != "" {
+		_, errCreate := consumer.client.CreateSubscription(ctx, &pubsubpb.Subscription{
+			Name:                  consumer.subscription,
+			Topic:                 consumer.options.Topic,
+			AckDeadlineSeconds:    seconds(consumer.options.AckDeadline),
+			EnableMessageOrdering: true,
+			DeadLetterPolicy:      consumer.deadLetterPolicy(),
+		})
+		if errCreate == nil {
+			return nil
+		}
+		if status.Code(errCreate) != codes.AlreadyExists {
+			return errCreate
+		}
+	}
+
+	policy := consumer.deadLetterPolicy()
+	if policy == nil {
+		return nil
+	}
+
+	_, errUpdate := consumer.client.UpdateSubscription(ctx, &pubsubpb.UpdateSubscriptionRequest{
+		Subscription: &pubsubpb.Subscription{
+			Name:             consumer.subscription,
+			DeadLetterPolicy: policy,
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"dead_letter_policy"}},
+	})
+	return errUpdate
+}
+
+// run pulls from the subscription until stopped, waiting before retrying once
+// handling fails.
+func (consumer *consumer) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	for ctx.Err() == nil {
+		errPoll := consumer.poll(ctx)
+		if errPoll == nil {
+			continue
+		}
+		consumer.options.OnError(errPoll)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(consumer.options.Interval):
+		}
+	}
+}
+
+// poll pulls a batch of messages, waiting for them if there are none, and handles
+// them.
+func (consumer *consumer) poll(ctx context.Context) error {
+	output, errPull := consumer.client.Pull(ctx, &pubsubpb.PullRequest{
+		Subscription: consumer.subscription,
+		MaxMessages:  int32(consumer.options.BatchSize),
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	if errPull != nil {
+		return errPull
+	}
+	if len(output.ReceivedMessages) == 0 {
+		return nil
+	}
+
+	return consumer.handle(output.ReceivedMessages)
+}
+
+// handle dispatches a batch of messages in order, extending their deadline while
+// they're being handled. Handled messages are acknowledged once the batch is done,
+// while a message that fails is handed back to be redelivered, along with the
+// messages of its ordering key that follow it in the batch, since Pub/Sub redelivers
+// those after it anyway. The first failure is returned and the others reported.
+func (consumer *consumer) handle(msgs []*pubsubpb.ReceivedMessage) error {
+	ackIDs := make([]string, len(msgs))
+	for index, msg := range msgs {
+		ackIDs[index] = msg.AckId
+	}
+
+	stopExtending := consumer.extend(ackIDs)
+	defer stopExtending()
+
+	handled := []string{}
+	handBack := []string{}
+	failedKeys := make(map[string]bool)
+	var errFirst error
+	for _, msg := range msgs {
+		key := msg.GetMessage().GetOrderingKey()
+		if key != "" && failedKeys[key] {
+			handBack = append(handBack, msg.AckId)
+			continue
+		}
+
+		errHandle := consumer.dispatch(msg)
+		if errHandle == nil {
+			handled = append(handled, msg.AckId)
+			continue
+		}
+
+		handBack = append(handBack, msg.AckId)
+		if key != "" {
+			failedKeys[key] = true
+		}
+		if errFirst == nil {
+			errFirst = errHandle
+		} else {
+			consumer.options.OnError(errHandle)
+		}
+	}
+
+	// Failing to hand messages back only delays their redelivery until their
+	// deadline passes
+	consumer.modify(handBack, 0)
+
+	errAck := consumer.acknowledge(handled)
+	if errAck != nil {
+		return errAck
+	}
+	return errFirst
+}
+
+// dispatch runs a message's event through the handlers that subscribe to it. A
+// message whose event can't be decoded fails if it can be dead-lettered, and is
+// otherwise reported and treated as handled so it isn't delivered again.
+func (consumer *consumer) dispatch(msg *pubsubpb.ReceivedMessage) error {
+	event, wanted, errDecode := consumer.handlers.Decode(msg.GetMessage().GetData())
+	if errDecode != nil {
+		if consumer.options.DeadLetterTopic != "" {
+			return fmt.Errorf("gcppubsub: handing back message %v to be dead-lettered: %v", msg.GetMessage().GetMessageId(), errDecode)
+		}
+		consumer.options.OnError(fmt.Errorf("gcppubsub: discarding message %v: %v", msg.GetMessage().GetMessageId(), errDecode))
+		return nil
+	}
+
+	if !wanted {
+		return nil
+	}
+	return consumer.handlers.Dispatch(event)
+}
+
+// extend keeps extending the deadline of a batch of messages until the returned
+// function is called or the maximum extension is reached.
+func (consumer *consumer) extend(ackIDs []string) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		// Extending halfway through the deadline leaves the extension time to arrive
+		ticker := time.NewTicker(consumer.options.AckDeadline / 2)
+		defer ticker.Stop()
+		limit := time.NewTimer(consumer.options.MaxExtension)
+		defer limit.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-limit.C:
+				return
+			case <-ticker.C:
+				errModify := consumer.modify(ackIDs, consumer.options.AckDeadline)
+				if errModify != nil {
+					consumer.options.OnError(errModify)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// acknowledge acknowledges handled messages, so they aren't delivered again
+func (consumer *consumer) acknowledge(ackIDs []string) error {
+	if len(ackIDs) == 0 {
+		return nil
+	}
+
+	_, errAck := consumer.client.Acknowledge(context.Background(), &pubsubpb.AcknowledgeRequest{
+		Subscription: consumer.subscription,
+		AckIds:       ackIDs,
+	})
+	return errAck
+}
+
+// modify sets the deadline of messages, with a deadline of zero handing them back
+// to be redelivered.
+func (consumer *consumer) modify(ackIDs []string, deadline time.Duration) error {
+	if len(ackIDs) == 0 {
+		return nil
+	}
+
+	_, errModify := consumer.client.ModifyAckDeadline(context.Background(), &pubsubpb.ModifyAckDeadlineRequest{
+		Subscription:       consumer.subscription,
+		AckIds:             ackIDs,
+		AckDeadlineSeconds: seconds(deadline),
+	})
+	return errModify
+}
+
+// seconds gets a deadline in whole seconds, rounded up so that deadlines shorter
+// than a second aren't taken as handing the message back.
+func seconds(deadline time.Duration) int32 {
+	return int32((deadline + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,142 @@
+/*
+Package gcppubsub distributes events through a Google Cloud Pub/Sub topic, with a
+publisher sending each event to the topic with its aggregate key as the ordering
+key, and consumers pulling the events from a subscription of the topic.
+
+Subscriptions with message ordering enabled deliver the events of each aggregate
+in the order they were published, and redeliver the events that follow one that
+failed, so the events of each aggregate are handled in order. While a batch is
+being handled, the acknowledgement deadline of its messages is extended, so slow
+handlers don't have their messages redelivered to another consumer, and messages
+that keep failing can be forwarded to a dead-letter topic.
+
+Clients talk to the Pub/Sub gRPC API over a connection made with Dial, which
+connects to the emulator when PUBSUB_EMULATOR_HOST is set.
+*/
+package gcppubsub
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"github.com/go-gadgets/eventsourcing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	// DefaultEndpoint is the address of the Pub/Sub API.
+	DefaultEndpoint = "pubsub.googleapis.com:443"
+
+	// EmulatorHostVariable is the environment variable holding the address of the
+	// Pub/Sub emulator, when one is used.
+	EmulatorHostVariable = "PUBSUB_EMULATOR_HOST"
+
+	// DomainAttribute is the message attribute holding the domain of an event.
+	DomainAttribute = "domain"
+
+	// TypeAttribute is the message attribute holding the type of an event.
+	TypeAttribute = "event_type"
+)
+
+// PublisherAPI is the part of the Pub/Sub publisher client that publishers use,
+// which is implemented by pubsubpb.PublisherClient.
+type PublisherAPI interface {
+	Publish(ctx context.Context, in *pubsubpb.PublishRequest, opts ...grpc.CallOption) (*pubsubpb.PublishResponse, error)
+}
+
+// Dial connects to Pub/Sub at an endpoint, DefaultEndpoint if it's empty, over TLS.
+// The options should carry the credentials to call the API with, such as
+// grpc.WithPerRPCCredentials. When PUBSUB_EMULATOR_HOST is set, the emulator is
+// connected to instead, without TLS or credentials.
+func Dial(endpoint string, options ...grpc.DialOption) (*grpc.ClientConn, error) {
+	emulator := os.Getenv(EmulatorHostVariable)
+	if emulator != "" {
+		return grpc.NewClient(emulator, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	options = append([]grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))}, options...)
+	return grpc.NewClient(endpoint, options...)
+}
+
+// publisher is a structure implementing EventPublisher and publishing events to a
+// Pub/Sub topic.
+type publisher struct {
+	client   PublisherAPI                // Pub/Sub publisher client
+	topic    string                      // Topic to publish to
+	registry eventsourcing.EventRegistry // Registry
+}
+
+// CreatePublisher creates a new publisher sending events to a topic, named in full
+// as projects/<project>/topics/<topic>.
+func CreatePublisher(conn grpc.ClientConnInterface, topic string, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	return CreatePublisherWithClient(pubsubpb.NewPublisherClient(conn), topic, registry)
+}
+
+// CreatePublisherWithClient creates a publisher sending events to a topic with a
+// client that's already been created (BYO-instance).
+func CreatePublisherWithClient(client PublisherAPI, topic string, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("gcppubsub: a topic is required")
+	}
+
+	return &publisher{
+		client:   client,
+		topic:    topic,
+		registry: registry,
+	}, nil
+}
+
+// Publish an event. When the method returns the event should be committed/guaranteed
+// to have been distributed.
+func (pub *publisher) Publish(key string, sequence int64, event eventsourcing.Event) error {
+	eventType, found := pub.registry.GetEventType(event)
+	if !found {
+		return fmt.Errorf("Could not find event type: %v", event)
+	}
+
+	toPublish := eventsourcing.PublishedEvent{
+		Domain:   pub.registry.Domain(),
+		Type:     eventType,
+		Key:      key,
+		Sequence: sequence,
+		Data:     event,
+	}
+
+	buff, errBuff := json.Marshal(&toPublish)
+	if errBuff != nil {
+		return errBuff
+	}
+
+	// Each publish waits for the topic to store the message, so a failed publish
+	// never has later events of its key stored ahead of it, and the next publish of
+	// the key carries on where it failed without having to be resumed
+	_, errPublish := pub.client.Publish(context.Background(), &pubsubpb.PublishRequest{
+		Topic: pub.topic,
+		Messages: []*pubsubpb.PubsubMessage{
+			{
+				Data:        buff,
+				OrderingKey: key,
+				Attributes: map[string]string{
+					DomainAttribute: toPublish.Domain,
+					TypeAttribute:   string(eventType),
+				},
+			},
+		},
+	})
+	return errPublish
+}
+
+// OrderingGuarantee reports that events are ordered per key, since the events of a
+// key are published in order under the key as their ordering key.
+func (pub *publisher) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return eventsourcing.OrderingPerKey
+}
@@ -0,0 +1,371 @@
+package gcppubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// fakeMessage is a message held by a fake subscription
+type fakeMessage struct {
+	message  *pubsubpb.PubsubMessage
+	attempts int  // Number of times the message has been delivered
+	inFlight bool // Whether the message has been delivered and not handed back
+}
+
+// ackID gets the acknowledgement ID of the message's latest delivery
+func (msg *fakeMessage) ackID() string {
+	return fmt.Sprintf("%v-%d", msg.message.MessageId, msg.attempts)
+}
+
+// fakePubSub is an in-memory topic with a single subscription that behaves like
+// Pub/Sub, holding back the messages of an ordering key while one is in flight when
+// ordered, and dead-lettering messages handed back too often.
+type fakePubSub struct {
+	lock         sync.Mutex
+	ordered      bool
+	exists       bool
+	messages     []*fakeMessage
+	published    []*pubsubpb.PublishRequest
+	created      []*pubsubpb.Subscription
+	updated      []*pubsubpb.UpdateSubscriptionRequest
+	policy       *pubsubpb.DeadLetterPolicy
+	deadLettered []*pubsubpb.PubsubMessage
+	extensions   int
+	counter      int
+}
+
+// push adds a message to the subscription
+func (fake *fakePubSub) push(msg *pubsubpb.PubsubMessage) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.counter++
+	msg.MessageId = fmt.Sprintf("m%d", fake.counter)
+	fake.messages = append(fake.messages, &fakeMessage{message: msg})
+}
+
+// Publish adds the messages to the subscription
+func (fake *fakePubSub) Publish(ctx context.Context, in *pubsubpb.PublishRequest, opts ...grpc.CallOption) (*pubsubpb.PublishResponse, error) {
+	fake.lock.Lock()
+	fake.published = append(fake.published, in)
+	fake.lock.Unlock()
+
+	for _, msg := range in.Messages {
+		fake.push(msg)
+	}
+	return &pubsubpb.PublishResponse{}, nil
+}
+
+// CreateSubscription records the subscription, unless it already exists
+func (fake *fakePubSub) CreateSubscription(ctx context.Context, in *pubsubpb.Subscription, opts ...grpc.CallOption) (*pubsubpb.Subscription, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	if fake.exists {
+		return nil, status.Error(codes.AlreadyExists, "subscription exists")
+	}
+	fake.exists = true
+	fake.ordered = in.EnableMessageOrdering
+	fake.policy = in.DeadLetterPolicy
+	fake.created = append(fake.created, in)
+	return in, nil
+}
+
+// UpdateSubscription sets the dead-letter policy
+func (fake *fakePubSub) UpdateSubscription(ctx context.Context, in *pubsubpb.UpdateSubscriptionRequest, opts ...grpc.CallOption) (*pubsubpb.Subscription, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.updated = append(fake.updated, in)
+	fake.policy = in.Subscription.DeadLetterPolicy
+	return in.Subscription, nil
+}
+
+// Pull delivers the messages that aren't in flight, skipping those of ordering keys
+// with a message in flight from an earlier pull when ordered, or waits for the
+// context to end if there are none.
+func (fake *fakePubSub) Pull(ctx context.Context, in *pubsubpb.PullRequest, opts ...grpc.CallOption) (*pubsubpb.PullResponse, error) {
+	fake.lock.Lock()
+	blocked := make(map[string]bool)
+	received := []*pubsubpb.ReceivedMessage{}
+	for _, msg := range fake.messages {
+		key := msg.message.OrderingKey
+		if fake.ordered && blocked[key] {
+			continue
+		}
+		if msg.inFlight {
+			blocked[key] = true
+			continue
+		}
+		if len(received) < int(in.MaxMessages) {
+			msg.inFlight = true
+			msg.attempts++
+			received = append(received, &pubsubpb.ReceivedMessage{
+				AckId:           msg.ackID(),
+				Message:         msg.message,
+				DeliveryAttempt: int32(msg.attempts),
+			})
+		}
+	}
+	fake.lock.Unlock()
+
+	if len(received) == 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return &pubsubpb.PullResponse{ReceivedMessages: received}, nil
+}
+
+// Acknowledge removes the messages delivered with the acknowledgement IDs
+func (fake *fakePubSub) Acknowledge(ctx context.Context, in *pubsubpb.AcknowledgeRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	for _, ackID := range in.AckIds {
+		fake.remove(ackID)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// ModifyAckDeadline counts the extensions, and hands back the messages given a
+// deadline of zero, dead-lettering those out of attempts.
+func (fake *fakePubSub) ModifyAckDeadline(ctx context.Context, in *pubsubpb.ModifyAckDeadlineRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	if in.AckDeadlineSeconds > 0 {
+		fake.extensions++
+		return &emptypb.Empty{}, nil
+	}
+
+	for _, ackID := range in.AckIds {
+		for _, msg := range fake.messages {
+			if msg.ackID() != ackID {
+				continue
+			}
+			msg.inFlight = false
+			if fake.policy != nil && msg.attempts >= int(fake.policy.MaxDeliveryAttempts) {
+				fake.remove(ackID)
+				fake.deadLettered = append(fake.deadLettered, msg.message)
+			}
+			break
+		}
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// remove deletes the message delivered with an acknowledgement ID
+func (fake *fakePubSub) remove(ackID string) {
+	for index, msg := range fake.messages {
+		if msg.ackID() == ackID {
+			fake.messages = append(fake.messages[:index], fake.messages[index+1:]...)
+			return
+		}
+	}
+}
+
+// Len gets the number of messages in the subscription
+func (fake *fakePubSub) Len() int {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return len(fake.messages)
+}
+
+// Extensions gets the number of deadline extensions made
+func (fake *fakePubSub) Extensions() int {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return fake.extensions
+}
+
+// DeadLettered gets the number of messages forwarded to the dead-letter topic
+func (fake *fakePubSub) DeadLettered() int {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return len(fake.deadLettered)
+}
+
+// slowHandler takes a while to handle each event
+type slowHandler struct {
+	delay time.Duration
+	lock  sync.Mutex
+	count int
+}
+
+// Handle waits, then counts the event
+func (handler *slowHandler) Handle(event eventsourcing.PublishedEvent) error {
+	time.Sleep(handler.delay)
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	handler.count++
+	return nil
+}
+
+// Count gets the number of events handled
+func (handler *slowHandler) Count() int {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	return handler.count
+}
+
+const (
+	topicName        = "projects/testing/topics/events"
+	deadLetterName   = "projects/testing/topics/dead-letters"
+	subscriptionName = "projects/testing/subscriptions/events"
+)
+
+// consume starts a consumer with a handler
+func consume(t *testing.T, fake *fakePubSub, handler eventsourcing.EventHandler, options Options) eventsourcing.EventConsumer {
+	options.BatchSize = 3
+	options.Interval = 10 * time.Millisecond
+	consumer, errCreate := CreateConsumerWithClient(fake, subscriptionName, options)
+	require.Nil(t, errCreate)
+
+	consumer.AddHandler(handler)
+	assert.Nil(t, consumer.Start())
+	return consumer
+}
+
+// TestPublishConsume checks events are published under their key as the ordering
+// key, and delivered in order from the subscription the consumer creates, with
+// failures retried before later events of the key
+func TestPublishConsume(t *testing.T) {
+	fake := &fakePubSub{}
+	pub, errPub := CreatePublisherWithClient(fake, topicName, test.GetTestRegistry())
+	require.Nil(t, errPub)
+	assert.Equal(t, eventsourcing.OrderingPerKey, eventsourcing.OrderingOf(pub))
+
+	handler := test.CreateRecordingHandler(true)
+	consumer := consume(t, fake, handler, Options{Topic: topicName, Ordered: true, OnError: func(error) {}})
+	defer consumer.Stop()
+	assert.Equal(t, eventsourcing.OrderingPerKey, eventsourcing.OrderingOf(consumer))
+
+	assert.Equal(t, 1, len(fake.created))
+	assert.Equal(t, topicName, fake.created[0].Topic)
+	assert.True(t, fake.created[0].EnableMessageOrdering)
+	assert.Nil(t, fake.created[0].DeadLetterPolicy)
+
+	test.PublishIncrements(t, pub, "a", 1, 5)
+	published := fake.published[0].Messages[0]
+	assert.Equal(t, "a", published.OrderingKey)
+	assert.Equal(t, "IncrementEvent", published.Attributes[TypeAttribute])
+	assert.Equal(t, "Testing", published.Attributes[DomainAttribute])
+
+	assert.True(t, test.WaitFor(func() bool { return handler.Count() == 5 && fake.Len() == 0 }))
+	assert.Nil(t, consumer.Stop())
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, handler.Seen())
+	assert.Equal(t, 1, handler.Fails())
+}
+
+// TestDeadLetter checks the dead-letter policy is set on an existing subscription,
+// and that messages that can't be decoded are handed back until they're
+// dead-lettered, without holding up the others
+func TestDeadLetter(t *testing.T) {
+	fake := &fakePubSub{exists: true}
+	pub, _ := CreatePublisherWithClient(fake, topicName, test.GetTestRegistry())
+	fake.push(&pubsubpb.PubsubMessage{Data: []byte("not json"), OrderingKey: "bad"})
+	test.PublishIncrements(t, pub, "a", 1, 3)
+
+	failures := make(chan error, 10)
+	handler := test.CreateRecordingHandler(false)
+	consumer := consume(t, fake, handler, Options{
+		Topic:           topicName,
+		DeadLetterTopic: deadLetterName,
+		OnError:         func(err error) { failures <- err },
+	})
+	defer consumer.Stop()
+	assert.Equal(t, eventsourcing.OrderingUnordered, eventsourcing.OrderingOf(consumer))
+
+	assert.Equal(t, 1, len(fake.updated))
+	assert.Equal(t, []string{"dead_letter_policy"}, fake.updated[0].UpdateMask.Paths)
+	assert.Equal(t, deadLetterName, fake.updated[0].Subscription.DeadLetterPolicy.DeadLetterTopic)
+	assert.Equal(t, int32(DefaultMaxDeliveryAttempts), fake.updated[0].Subscription.DeadLetterPolicy.MaxDeliveryAttempts)
+
+	assert.True(t, test.WaitFor(func() bool { return fake.DeadLettered() == 1 && fake.Len() == 0 }))
+	assert.Equal(t, []int64{1, 2, 3}, handler.Seen())
+	assert.Contains(t, (<-failures).Error(), "handing back message m1")
+}
+
+// TestDiscard checks that messages that can't be decoded are reported and
+// acknowledged when there's no dead-letter topic
+func TestDiscard(t *testing.T) {
+	fake := &fakePubSub{exists: true, ordered: true}
+	fake.push(&pubsubpb.PubsubMessage{Data: []byte("not json"), OrderingKey: "a"})
+	pub, _ := CreatePublisherWithClient(fake, topicName, test.GetTestRegistry())
+	test.PublishIncrements(t, pub, "a", 1, 2)
+
+	failures := make(chan error, 10)
+	handler := test.CreateRecordingHandler(false)
+	consumer := consume(t, fake, handler, Options{OnError: func(err error) { failures <- err }})
+	defer consumer.Stop()
+
+	assert.True(t, test.WaitFor(func() bool { return handler.Count() == 2 && fake.Len() == 0 }))
+	assert.Contains(t, (<-failures).Error(), "discarding message m1")
+	assert.Equal(t, 0, len(fake.created))
+	assert.Equal(t, 0, len(fake.updated))
+}
+
+// TestAckExtension checks the deadline of messages is extended while a slow handler
+// works through them, up to the maximum extension
+func TestAckExtension(t *testing.T) {
+	fake := &fakePubSub{exists: true}
+	pub, _ := CreatePublisherWithClient(fake, topicName, test.GetTestRegistry())
+	test.PublishIncrements(t, pub, "a", 1, 1)
+
+	handler := &slowHandler{delay: 300 * time.Millisecond}
+	consumer := consume(t, fake, handler, Options{
+		AckDeadline:  40 * time.Millisecond,
+		MaxExtension: 100 * time.Millisecond,
+	})
+	defer consumer.Stop()
+
+	assert.True(t, test.WaitFor(func() bool { return handler.Count() == 1 && fake.Len() == 0 }))
+	assert.True(t, fake.Extensions() >= 2)
+	assert.True(t, fake.Extensions() <= 5)
+}
+
+// TestCreate checks invalid options are rejected, defaults are applied, and a
+// subscription that can't be created stops the consumer from starting
+func TestCreate(t *testing.T) {
+	_, errCreate := CreatePublisherWithClient(&fakePubSub{}, "", test.GetTestRegistry())
+	assert.NotNil(t, errCreate)
+	_, errCreate = CreateConsumerWithClient(&fakePubSub{}, "", Options{})
+	assert.NotNil(t, errCreate)
+
+	created, errCreate := CreateConsumerWithClient(&fakePubSub{}, subscriptionName, Options{AckDeadline: time.Hour})
+	require.Nil(t, errCreate)
+	assert.Equal(t, MaxAckDeadline, created.(*consumer).options.AckDeadline)
+	assert.Equal(t, DefaultBatchSize, created.(*consumer).options.BatchSize)
+	assert.Equal(t, DefaultMaxExtension, created.(*consumer).options.MaxExtension)
+
+	denied, _ := CreateConsumerWithClient(&deniedPubSub{}, subscriptionName, Options{Topic: topicName})
+	assert.NotNil(t, denied.Start())
+	assert.Nil(t, denied.Stop())
+
+	t.Setenv(EmulatorHostVariable, "localhost:8085")
+	conn, errDial := Dial("")
+	require.Nil(t, errDial)
+	assert.Equal(t, "localhost:8085", conn.Target())
+	assert.Nil(t, conn.Close())
+}
+
+// deniedPubSub is a subscriber that isn't allowed to create subscriptions
+type deniedPubSub struct {
+	fakePubSub
+}
+
+// CreateSubscription fails
+func (fake *deniedPubSub) CreateSubscription(ctx context.Context, in *pubsubpb.Subscription, opts ...grpc.CallOption) (*pubsubpb.Subscription, error) {
+	return nil, status.Error(codes.PermissionDenied, "denied")
+}
@@ -16,9 +16,10 @@ type Distributor interface {
 // distributor is an in-process event distributor that propegates events
 // post-store, acting as both a Consumer and Publisher API instance.
 type distributor struct {
-	enabled  bool                         // Enabled?
-	handlers []eventsourcing.EventHandler // Event handlers
-	registry eventsourcing.EventRegistry  // Event registry
+	enabled  bool                             // Enabled?
+	handlers []eventsourcing.EventHandler     // Event handlers
+	filter   eventsourcing.SubscriptionFilter // Event types each handler receives
+	registry eventsourcing.EventRegistry      // Event registry
 }
 
 // Create an instance of the Distributor interface
@@ -32,6 +33,7 @@ func Create(registry eventsourcing.EventRegistry) Distributor {
 // AddHandler appends a new handler to the set of handlers for this consumer
 func (distributor *distributor) AddHandler(handler eventsourcing.EventHandler) {
 	distributor.handlers = append(distributor.handlers, handler)
+	distributor.filter = eventsourcing.NewSubscriptionFilter(distributor.handlers)
 }
 
 // Start handling the events from the consumer
@@ -65,7 +67,10 @@ func (distributor *distributor) Publish(key string, sequence int64, event events
 		Data:     event,
 	}
 
-	for _, handler := range distributor.handlers {
+	for index, handler := range distributor.handlers {
+		if !distributor.filter.Handles(index, eventType) {
+			continue
+		}
 		errHandle := handler.Handle(toPublish)
 		if errHandle != nil {
 			return errHandle
@@ -74,3 +79,9 @@ func (distributor *distributor) Publish(key string, sequence int64, event events
 
 	return nil
 }
+
+// OrderingGuarantee reports that events are delivered synchronously, in the
+// order they are published.
+func (distributor *distributor) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return eventsourcing.OrderingGlobal
+}
@@ -3,6 +3,7 @@ package inproc
 import (
 	"testing"
 
+	"github.com/go-gadgets/eventsourcing"
 	"github.com/go-gadgets/eventsourcing/utilities/test"
 	"github.com/stretchr/testify/assert"
 )
@@ -63,3 +64,37 @@ func TestPublishInvalidEvent(t *testing.T) {
 	assert.Equal(t, 0, len(handler.Events))
 	assert.NotNil(t, errPublish)
 }
+
+// TestOrderingGuarantee checks the distributor reports global ordering
+func TestOrderingGuarantee(t *testing.T) {
+	dist := Create(test.GetTestRegistry())
+	assert.Equal(t, eventsourcing.OrderingGlobal, eventsourcing.OrderingOf(dist))
+}
+
+// subscribedHandler is a logging handler that subscribes to increments only
+type subscribedHandler struct {
+	test.LoggingHandler
+}
+
+// Subscriptions gets the event types of the handler
+func (handler *subscribedHandler) Subscriptions() []eventsourcing.EventType {
+	return []eventsourcing.EventType{"IncrementEvent"}
+}
+
+// TestSubscriptions checks handlers only receive the event types they subscribe to
+func TestSubscriptions(t *testing.T) {
+	dist := Create(test.GetTestRegistry())
+	subscribed := &subscribedHandler{LoggingHandler: test.CreateLoggingHandler()}
+	everything := test.CreateLoggingHandler()
+	dist.AddHandler(subscribed)
+	dist.AddHandler(&everything)
+	dist.Start()
+	defer dist.Stop()
+
+	assert.Nil(t, dist.Publish("dummy", 1, test.InitializeEvent{TargetValue: 5}))
+	assert.Nil(t, dist.Publish("dummy", 2, test.IncrementEvent{IncrementBy: 1}))
+
+	assert.Equal(t, 1, len(subscribed.Events))
+	assert.Equal(t, eventsourcing.EventType("IncrementEvent"), subscribed.Events[0].Type)
+	assert.Equal(t, 2, len(everything.Events))
+}
@@ -1,39 +1,62 @@
 package kafka
 
 import (
-	"bytes"
-	"encoding/json"
+	"fmt"
 
+	"github.com/Shopify/sarama"
 	cluster "github.com/bsm/sarama-cluster"
 	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/distribution"
 	"github.com/sirupsen/logrus"
 )
 
 type consumer struct {
-	brokers         []string                     // Broker list
-	groupID         string                       // Consumer group ID
-	topic           string                       // Topic to listen to
-	defaultOffset   int64                        // Default offset to listen to (sarama.OffsetOldest/sarama.OffsetNewest)
-	closeChannel    chan bool                    // Close signal
-	clusterConsumer *cluster.Consumer            // Kafka consumer
-	handlers        []eventsourcing.EventHandler // Event handlers
+	brokers         []string                // Broker list
+	groupID         string                  // Consumer group ID
+	topic           string                  // Topic to listen to
+	defaultOffset   int64                   // Default offset to listen to (sarama.OffsetOldest/sarama.OffsetNewest)
+	start           eventsourcing.StartMode // Where to start reading
+	closeChannel    chan bool               // Close signal
+	clusterConsumer *cluster.Consumer       // Kafka consumer
+	handlers        distribution.Handlers   // Event handlers, and the event types each receives
 }
 
-// CreateConsumer creates a new consumer of kafka messages.
+// CreateConsumer creates a new consumer of kafka messages, which resumes from the
+// group's committed offsets, or the default offset for partitions without one.
+//
+// Deprecated: Use CreateConsumerWithStart, which supports explicit start modes.
 func CreateConsumer(brokers []string, topic string, groupID string, defaultOffset int64) (eventsourcing.EventConsumer, error) {
 	return &consumer{
 		brokers:       brokers,
 		topic:         topic,
 		groupID:       groupID,
 		defaultOffset: defaultOffset,
+		start:         eventsourcing.FromCheckpoint(),
 		closeChannel:  make(chan bool, 1),
-		handlers:      make([]eventsourcing.EventHandler, 0),
 	}, nil
 }
 
-// AddHandler appends a new handler to the set of handlers for this consumer
+// CreateConsumerWithStart creates a new consumer of kafka messages, which begins
+// reading according to the start mode. Partitions without a committed offset are
+// read from the beginning when resuming from a checkpoint. Other modes overwrite
+// the group's committed offsets before joining the group, so all members of the
+// group should be stopped while a backfill is started. Positions are offsets,
+// applied to every partition of the topic.
+func CreateConsumerWithStart(brokers []string, topic string, groupID string, start eventsourcing.StartMode) (eventsourcing.EventConsumer, error) {
+	return &consumer{
+		brokers:       brokers,
+		topic:         topic,
+		groupID:       groupID,
+		defaultOffset: sarama.OffsetOldest,
+		start:         start,
+		closeChannel:  make(chan bool, 1),
+	}, nil
+}
+
+// AddHandler appends a new handler to the set of handlers for this consumer. The
+// handler's subscriptions are read when it is added, so it must be initialized.
 func (consumer *consumer) AddHandler(handler eventsourcing.EventHandler) {
-	consumer.handlers = append(consumer.handlers, handler)
+	consumer.handlers.Add(handler)
 }
 
 // Start handling the events from the consumer
@@ -44,6 +67,14 @@ func (consumer *consumer) Start() error {
 	config.Consumer.Offsets.Initial = consumer.defaultOffset // Start at right place
 	config.Group.Return.Notifications = true                 // For logging
 
+	// Move the group to the start position, if we aren't resuming
+	if consumer.start.Kind != eventsourcing.StartCheckpoint {
+		errSeek := consumer.seek(&config.Config)
+		if errSeek != nil {
+			return errSeek
+		}
+	}
+
 	// Build the cluster listener
 	topics := []string{consumer.topic}
 	clusterConsumer, err := cluster.NewConsumer(consumer.brokers, consumer.groupID, topics, config)
@@ -70,18 +101,87 @@ func (consumer *consumer) Stop() error {
 	return nil
 }
 
-// dispatch runs an event through all available handlers
-func (consumer *consumer) dispatch(event eventsourcing.PublishedEvent) error {
-	for _, handler := range consumer.handlers {
-		errHandler := handler.Handle(event)
-		if errHandler != nil {
-			return errHandler
+// seek commits the start position as the group's offset for every partition
+func (consumer *consumer) seek(config *sarama.Config) error {
+	// Timestamp lookups need the v1 offset API
+	seekConfig := *config
+	if !seekConfig.Version.IsAtLeast(sarama.V0_10_1_0) {
+		seekConfig.Version = sarama.V0_10_1_0
+	}
+
+	client, errClient := sarama.NewClient(consumer.brokers, &seekConfig)
+	if errClient != nil {
+		return errClient
+	}
+	defer client.Close()
+
+	return seekGroup(client, consumer.groupID, consumer.topic, consumer.start)
+}
+
+// seekGroup commits offsets for a consumer group, so that it begins reading each
+// partition of a topic from a start position.
+func seekGroup(client sarama.Client, groupID string, topic string, start eventsourcing.StartMode) error {
+	partitions, errPartitions := client.Partitions(topic)
+	if errPartitions != nil {
+		return errPartitions
+	}
+
+	manager, errManager := sarama.NewOffsetManagerFromClient(groupID, client)
+	if errManager != nil {
+		return errManager
+	}
+	defer manager.Close()
+
+	for _, partition := range partitions {
+		offset, errOffset := startOffset(client, topic, partition, start)
+		if errOffset != nil {
+			return errOffset
+		}
+
+		partitionManager, errPartition := manager.ManagePartition(topic, partition)
+		if errPartition != nil {
+			return errPartition
+		}
+
+		// Marking only moves forward, and resetting only moves back
+		partitionManager.MarkOffset(offset, "")
+		partitionManager.ResetOffset(offset, "")
+
+		errClose := partitionManager.Close()
+		if errClose != nil {
+			return errClose
 		}
 	}
 
 	return nil
 }
 
+// startOffset finds the offset within a partition that a start mode refers to
+func startOffset(client sarama.Client, topic string, partition int32, start eventsourcing.StartMode) (int64, error) {
+	switch start.Kind {
+	case eventsourcing.StartBeginning:
+		return client.GetOffset(topic, partition, sarama.OffsetOldest)
+	case eventsourcing.StartLatest:
+		return client.GetOffset(topic, partition, sarama.OffsetNewest)
+	case eventsourcing.StartTimestamp:
+		millis := start.Timestamp.UnixNano() / 1000000
+		offset, errOffset := client.GetOffset(topic, partition, millis)
+		if errOffset != nil {
+			return 0, errOffset
+		}
+
+		// Nothing has been published since the timestamp
+		if offset < 0 {
+			return client.GetOffset(topic, partition, sarama.OffsetNewest)
+		}
+		return offset, nil
+	case eventsourcing.StartPosition:
+		return start.Position, nil
+	}
+
+	return 0, fmt.Errorf("kafka: unsupported start mode %v", start)
+}
+
 // handleInternal runs the kafka consumers internal behaviours.
 func (consumer *consumer) handleInternal() {
 	instance := consumer.clusterConsumer
@@ -107,17 +207,18 @@ func (consumer *consumer) handleInternal() {
 				continue
 			}
 
-			// Unmarshal the published event
-			event := eventsourcing.PublishedEvent{}
-			decoder := json.NewDecoder(bytes.NewReader(msg.Value))
-			decoder.UseNumber()
-			errUnmarshal := decoder.Decode(&event)
+			// Unmarshal the published event, skipping those no handler wants
+			event, wanted, errUnmarshal := consumer.handlers.Decode(msg.Value)
 			if errUnmarshal != nil {
 				logrus.Error(errUnmarshal)
 				continue
 			}
+			if !wanted {
+				instance.MarkOffset(msg, "")
+				continue
+			}
 
-			errConsume := consumer.dispatch(event)
+			errConsume := consumer.handlers.Dispatch(event)
 			if errConsume != nil {
 				logrus.Error(errConsume)
 				continue
@@ -130,3 +231,9 @@ func (consumer *consumer) handleInternal() {
 		}
 	}
 }
+
+// OrderingGuarantee reports that events are ordered per aggregate key, since
+// each partition is consumed in order and keys are partitioned consistently.
+func (consumer *consumer) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return eventsourcing.OrderingPerKey
+}
@@ -0,0 +1,87 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// seekBroker creates a mock broker with a single-partition topic, which
+// also coordinates the consumer group.
+func seekBroker(t *testing.T) (*sarama.MockBroker, sarama.Client) {
+	broker := sarama.NewMockBroker(t, 1)
+	at := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("events", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetVersion(1).
+			SetOffset("events", 0, sarama.OffsetOldest, 10).
+			SetOffset("events", 0, sarama.OffsetNewest, 50).
+			SetOffset("events", 0, at.UnixNano()/1000000, 25).
+			SetOffset("events", 0, at.Add(time.Hour).UnixNano()/1000000, -1),
+		"ConsumerMetadataRequest": sarama.NewMockConsumerMetadataResponse(t).
+			SetCoordinator("group", broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("group", "events", 0, 40, "", sarama.ErrNoError),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+	})
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_10_1_0
+	config.Consumer.Offsets.CommitInterval = 10 * time.Millisecond
+	client, errClient := sarama.NewClient([]string{broker.Addr()}, config)
+	require.Nil(t, errClient)
+
+	return broker, client
+}
+
+// TestStartOffset checks each start mode resolves to the right offset
+func TestStartOffset(t *testing.T) {
+	broker, client := seekBroker(t)
+	defer broker.Close()
+	defer client.Close()
+
+	at := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	cases := map[string]struct {
+		start    eventsourcing.StartMode
+		expected int64
+	}{
+		"beginning": {eventsourcing.FromBeginning(), 10},
+		"latest":    {eventsourcing.FromLatest(), 50},
+		"timestamp": {eventsourcing.FromTimestamp(at), 25},
+		"future":    {eventsourcing.FromTimestamp(at.Add(time.Hour)), 50},
+		"position":  {eventsourcing.FromPosition(33), 33},
+	}
+
+	for name, c := range cases {
+		offset, errOffset := startOffset(client, "events", 0, c.start)
+		assert.Nil(t, errOffset, name)
+		assert.Equal(t, c.expected, offset, name)
+	}
+
+	_, errCheckpoint := startOffset(client, "events", 0, eventsourcing.FromCheckpoint())
+	assert.NotNil(t, errCheckpoint, "Checkpoints are resolved by the consumer group")
+}
+
+// TestSeekGroup checks the start position is committed for the group
+func TestSeekGroup(t *testing.T) {
+	broker, client := seekBroker(t)
+	defer broker.Close()
+	defer client.Close()
+
+	assert.Nil(t, seekGroup(client, "group", "events", eventsourcing.FromBeginning()))
+
+	committed := false
+	for _, exchange := range broker.History() {
+		if _, ok := exchange.Request.(*sarama.OffsetCommitRequest); ok {
+			committed = true
+		}
+	}
+	assert.True(t, committed, "The start offset should be committed for the group")
+}
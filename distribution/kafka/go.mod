@@ -0,0 +1,40 @@
+module github.com/go-gadgets/eventsourcing/distribution/kafka
+
+go 1.24.0
+
+require (
+	github.com/Shopify/sarama v1.16.0
+	github.com/bsm/sarama-cluster v2.1.13+incompatible
+	github.com/go-gadgets/eventsourcing v0.0.0-00010101000000-000000000000
+	github.com/satori/go.uuid v1.2.0
+	github.com/sirupsen/logrus v1.0.5
+	github.com/stretchr/testify v1.5.1
+)
+
+require (
+	github.com/Shopify/toxiproxy v2.1.4+incompatible // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/eapache/go-resiliency v1.0.0 // indirect
+	github.com/eapache/go-xerial-snappy v0.0.0-20160609142408-bb955e01b934 // indirect
+	github.com/eapache/queue v1.1.0 // indirect
+	github.com/golang/snappy v0.0.0-20170215233205-553a64147049 // indirect
+	github.com/google/go-cmp v0.5.9 // indirect
+	github.com/kr/pretty v0.3.1 // indirect
+	github.com/mitchellh/mapstructure v0.0.0-20180220230111-00c29f56e238 // indirect
+	github.com/onsi/ginkgo v1.16.5 // indirect
+	github.com/onsi/gomega v1.10.1 // indirect
+	github.com/pierrec/lz4 v1.0.2-0.20171218195038-2fcda4cb7018 // indirect
+	github.com/pierrec/xxHash v0.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/rcrowley/go-metrics v0.0.0-20250401214520-65e299d6c5c9 // indirect
+	golang.org/x/crypto v0.42.0 // indirect
+	golang.org/x/net v0.44.0 // indirect
+	golang.org/x/sys v0.36.0 // indirect
+	golang.org/x/term v0.35.0 // indirect
+	gopkg.in/airbrake/gobrake.v2 v2.0.9 // indirect
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
+	gopkg.in/gemnasium/logrus-airbrake-hook.v2 v2.1.2 // indirect
+	gopkg.in/yaml.v2 v2.3.0 // indirect
+)
+
+replace github.com/go-gadgets/eventsourcing => ../..
@@ -70,3 +70,9 @@ func (pub *publisher) Publish(key string, sequence int64, event eventsourcing.Ev
 	_, _, errPublish := pub.prod.SendMessage(msg)
 	return errPublish
 }
+
+// OrderingGuarantee reports that events are ordered per aggregate key, since
+// messages are partitioned by the aggregate key.
+func (pub *publisher) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return eventsourcing.OrderingPerKey
+}
@@ -0,0 +1,156 @@
+package kafka
+
+import (
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// StateRecord is the latest state of an aggregate, as published to a
+// log-compacted topic.
+type StateRecord struct {
+	Domain   string      `json:"domain"`   // Domain the aggregate belongs to
+	Key      string      `json:"key"`      // Aggregate key
+	Sequence int64       `json:"sequence"` // Sequence number the state reflects
+	State    interface{} `json:"state"`    // Aggregate state
+}
+
+// CreateStatePublisher creates a middleware that publishes the state of each
+// aggregate to a topic after every successful commit, keyed by the aggregate
+// key. The topic should be created with cleanup.policy=compact, so that Kafka
+// retains the latest state of every aggregate and downstream services can
+// bootstrap from it rather than querying the store.
+func CreateStatePublisher(brokers []string, topic string, domain string) (eventsourcing.MiddlewareFactory, error) {
+	config := sarama.NewConfig()
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+
+	prod, errProd := sarama.NewSyncProducer(brokers, config)
+	if errProd != nil {
+		return nil, errProd
+	}
+
+	factory := CreateStatePublisherWithProducer(prod, topic, domain)
+	return func() (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, eventsourcing.CloseMiddleware) {
+		commit, refresh, _ := factory()
+		return commit, refresh, prod.Close
+	}, nil
+}
+
+// CreateStatePublisherWithProducer creates a state publishing middleware with a
+// producer that's already been established (BYO-instance).
+func CreateStatePublisherWithProducer(prod sarama.SyncProducer, topic string, domain string) eventsourcing.MiddlewareFactory {
+	return func() (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, eventsourcing.CloseMiddleware) {
+		return func(writer eventsourcing.StoreWriterAdapter, next eventsourcing.NextHandler) error {
+				// The state hasn't changed, so there's nothing to publish
+				if eventsourcing.IsNoOp(writer) {
+					return next()
+				}
+
+				seq, events := writer.GetUncommittedEvents()
+
+				// Run the upstream, and abort if we don't succeed.
+				errNext := next()
+				if errNext != nil {
+					return errNext
+				}
+
+				record := StateRecord{
+					Domain:   domain,
+					Key:      writer.GetKey(),
+					Sequence: seq + int64(len(events)),
+					State:    writer.GetState(),
+				}
+
+				buff, errBuff := json.Marshal(&record)
+				if errBuff != nil {
+					return errBuff
+				}
+
+				_, _, errPublish := prod.SendMessage(&sarama.ProducerMessage{
+					Topic: topic,
+					Key:   sarama.StringEncoder(record.Key),
+					Value: sarama.ByteEncoder(buff),
+				})
+				return errPublish
+			}, func(reader eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+				return next()
+			}, func() error {
+				return nil
+			}
+	}
+}
+
+// LoadState reads a state topic from the beginning up to the current end of
+// each partition, calling the handler with every record. Records are delivered
+// in order per aggregate key, so the last record seen for a key is its current
+// state.
+func LoadState(client sarama.Client, topic string, handler func(record StateRecord) error) error {
+	partitions, errPartitions := client.Partitions(topic)
+	if errPartitions != nil {
+		return errPartitions
+	}
+
+	consumer, errConsumer := sarama.NewConsumerFromClient(client)
+	if errConsumer != nil {
+		return errConsumer
+	}
+	defer consumer.Close()
+
+	for _, partition := range partitions {
+		errPartition := loadPartition(client, consumer, topic, partition, handler)
+		if errPartition != nil {
+			return errPartition
+		}
+	}
+
+	return nil
+}
+
+// loadPartition reads a single partition up to its high water mark.
+func loadPartition(client sarama.Client, consumer sarama.Consumer, topic string, partition int32, handler func(record StateRecord) error) error {
+	newest, errNewest := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if errNewest != nil {
+		return errNewest
+	}
+	oldest, errOldest := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if errOldest != nil {
+		return errOldest
+	}
+	if newest <= oldest {
+		return nil
+	}
+
+	partitionConsumer, errConsume := consumer.ConsumePartition(topic, partition, oldest)
+	if errConsume != nil {
+		return errConsume
+	}
+	defer partitionConsumer.Close()
+
+	for {
+		select {
+		case errConsumer := <-partitionConsumer.Errors():
+			return errConsumer
+		case msg := <-partitionConsumer.Messages():
+			// Tombstones carry no value, and mark removed aggregates.
+			if msg.Value != nil {
+				record := StateRecord{}
+				errDecode := json.Unmarshal(msg.Value, &record)
+				if errDecode != nil {
+					return errDecode
+				}
+
+				errHandle := handler(record)
+				if errHandle != nil {
+					return errHandle
+				}
+			}
+
+			if msg.Offset >= newest-1 {
+				return nil
+			}
+		}
+	}
+}
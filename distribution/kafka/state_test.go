@@ -0,0 +1,85 @@
+package kafka
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingProducer is a SyncProducer that captures the messages sent to it.
+type recordingProducer struct {
+	messages []*sarama.ProducerMessage
+}
+
+func (prod *recordingProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	prod.messages = append(prod.messages, msg)
+	return 0, int64(len(prod.messages)), nil
+}
+
+func (prod *recordingProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	prod.messages = append(prod.messages, msgs...)
+	return nil
+}
+
+func (prod *recordingProducer) Close() error {
+	return nil
+}
+
+// TestStatePublisher checks the aggregate state is published after commits,
+// keyed by the aggregate key.
+func TestStatePublisher(t *testing.T) {
+	prod := &recordingProducer{}
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(CreateStatePublisherWithProducer(prod, "state", "counters")())
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("state-key", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.InitializeEvent{TargetValue: 3})
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 2})
+	assert.Nil(t, agg.Commit())
+
+	assert.Equal(t, 1, len(prod.messages))
+	msg := prod.messages[0]
+	assert.Equal(t, "state", msg.Topic)
+	assert.Equal(t, sarama.StringEncoder("state-key"), msg.Key)
+
+	buff, _ := msg.Value.Encode()
+	record := StateRecord{}
+	assert.Nil(t, json.Unmarshal(buff, &record))
+	assert.Equal(t, "counters", record.Domain)
+	assert.Equal(t, "state-key", record.Key)
+	assert.Equal(t, int64(2), record.Sequence)
+	assert.NotNil(t, record.State)
+}
+
+// TestStatePublisherFailedCommit checks nothing is published when the
+// commit fails.
+func TestStatePublisherFailedCommit(t *testing.T) {
+	prod := &recordingProducer{}
+	store := eventsourcing.NewMiddlewareWrapper(test.CreateErrorStore(assert.AnError))
+	store.Use(CreateStatePublisherWithProducer(prod, "state", "counters")())
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("state-key", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 2})
+	assert.NotNil(t, agg.Commit())
+	assert.Equal(t, 0, len(prod.messages))
+}
+
+// TestStatePublisherEmptyCommit checks nothing is published for a commit
+// without events.
+func TestStatePublisherEmptyCommit(t *testing.T) {
+	prod := &recordingProducer{}
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(CreateStatePublisherWithProducer(prod, "state", "counters")())
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("state-key", test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Commit())
+	assert.Equal(t, 0, len(prod.messages))
+}
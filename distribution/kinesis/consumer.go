@@ -0,0 +1,522 @@
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awskinesis "github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/distribution"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultBatchSize is the number of records read from a shard at a time.
+	DefaultBatchSize = 1000
+
+	// DefaultInterval is the time waited before reading a shard again, once its
+	// latest record has been read or handling fails. Kinesis allows five reads a
+	// second from each shard, shared by every consumer of the stream.
+	DefaultInterval = time.Second
+
+	// DefaultShardSync is the time between listings of the stream's shards, which
+	// notice shards created by resharding.
+	DefaultShardSync = 30 * time.Second
+
+	// InitialPositionTrimHorizon is the position of a tracker that starts from the
+	// oldest record of its shard, as for mongo.InitialPositionTrimHorizon.
+	InitialPositionTrimHorizon = int64(-2)
+
+	// InitialPositionEdge is the position of a tracker that starts after the latest
+	// record of its shard, as for mongo.InitialPositionEdge.
+	InitialPositionEdge = int64(-1)
+)
+
+// Tracker stores the progress of a consumer through a shard, as the arrival time
+// (in milliseconds since the epoch) of the last record handled. A
+// mongo.ProgressTracker can be used, created with InitialPositionTrimHorizon or
+// InitialPositionEdge as its initial position.
+//
+// Records that arrived within the same millisecond as the last one handled are
+// delivered again when resuming from a position, since Kinesis can only start
+// reading from a time. Trackers that implement SequenceTracker resume exactly.
+type Tracker interface {
+	// StartPosition gets the arrival time of the last record handled, or the initial
+	// position if none has been handled
+	StartPosition() (int64, error)
+
+	// UpdatePosition records the arrival time of the last record handled
+	UpdatePosition(int64) error
+}
+
+// SequenceTracker is an interface implemented by trackers that can also store the
+// sequence number of the last record handled, which resumes a shard right after it.
+type SequenceTracker interface {
+	Tracker
+
+	// SequenceNumber gets the sequence number of the last record handled, or an
+	// empty string if none has been handled
+	SequenceNumber() (string, error)
+
+	// UpdateSequenceNumber records the sequence number of the last record handled,
+	// and its arrival time as the position
+	UpdateSequenceNumber(sequenceNumber string, position int64) error
+}
+
+// Options contains the options for consuming a stream.
+type Options struct {
+	Trackers  func(shardID string) (Tracker, error) // Gets the tracker of a shard, required
+	Start     eventsourcing.StartMode               // Where shards open when the consumer starts are read from (see below)
+	BatchSize int                                   // Records read from a shard at a time, DefaultBatchSize by default
+	Interval  time.Duration                         // Wait between reads at the end of a shard, DefaultInterval by default
+	ShardSync time.Duration                         // Time between listings of shards, DefaultShardSync by default
+	OnError   func(error)                           // Called when reading, handling or checkpointing fails, logs by default
+}
+
+// consumer reads every shard of a Kinesis stream.
+type consumer struct {
+	client   StreamAPI             // Kinesis client
+	stream   string                // Stream to read
+	options  Options               // Options
+	handlers distribution.Handlers // Event handlers, and the event types each receives
+	dispatch sync.Mutex            // Serializes handling across shards
+	lock     sync.Mutex            // Guards the loop state
+	stop     context.CancelFunc    // Stops the shard readers
+	done     chan struct{}         // Closed once every shard reader exits
+}
+
+// CreateConsumer creates a consumer of a Kinesis stream, in the manner of the
+// Kinesis Client Library: every shard is read by a reader of its own, the shards
+// a shard is split or merged into are read once it has been read to its end, and
+// the progress through each shard is checkpointed with the tracker the Trackers
+// option returns for it, once each batch is handled.
+//
+// The start mode applies to the shards open when the consumer starts, and shards
+// created while it runs are read from their oldest record. Positions are arrival
+// times, in milliseconds since the epoch, so FromPosition works as FromTimestamp.
+//
+// Records are handled one at a time across the stream, in order within each shard.
+// A record that fails is retried after the interval, holding back the rest of its
+// shard, while records whose event can't be decoded are reported and skipped.
+func CreateConsumer(config aws.Config, stream string, options Options) (eventsourcing.EventConsumer, error) {
+	return CreateConsumerWithClient(awskinesis.NewFromConfig(config), stream, options)
+}
+
+// CreateConsumerWithClient creates a consumer of a Kinesis stream with a client
+// that's already been created (BYO-instance).
+func CreateConsumerWithClient(client StreamAPI, stream string, options Options) (eventsourcing.EventConsumer, error) {
+	if stream == "" || options.Trackers == nil {
+		return nil, fmt.Errorf("kinesis: a stream name and trackers are required")
+	}
+
+	switch options.Start.Kind {
+	case eventsourcing.StartCheckpoint, eventsourcing.StartBeginning, eventsourcing.StartLatest, eventsourcing.StartTimestamp, eventsourcing.StartPosition:
+	default:
+		return nil, fmt.Errorf("kinesis: unsupported start mode %v", options.Start)
+	}
+
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBatchSize
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
+	if options.ShardSync <= 0 {
+		options.ShardSync = DefaultShardSync
+	}
+	if options.OnError == nil {
+		options.OnError = func(err error) {
+			logrus.WithError(err).Error("kinesis_consumer_error")
+		}
+	}
+
+	return &consumer{
+		client:  client,
+		stream:  stream,
+		options: options,
+	}, nil
+}
+
+// AddHandler appends a new handler to the set of handlers for this consumer. The
+// handler's subscriptions are read when it is added, so it must be initialized.
+func (consumer *consumer) AddHandler(handler eventsourcing.EventHandler) {
+	consumer.handlers.Add(handler)
+}
+
+// Start handling the events from the consumer
+func (consumer *consumer) Start() error {
+	consumer.lock.Lock()
+	defer consumer.lock.Unlock()
+	if consumer.stop != nil {
+		return nil
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	consumer.stop = stop
+	consumer.done = make(chan struct{})
+	go consumer.run(ctx, consumer.done)
+	return nil
+}
+
+// Stop handling events from the consumer, waiting for the records being handled
+// to finish.
+func (consumer *consumer) Stop() error {
+	consumer.lock.Lock()
+	stop, done := consumer.stop, consumer.done
+	consumer.stop, consumer.done = nil, nil
+	consumer.lock.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+
+	stop()
+	<-done
+	return nil
+}
+
+// OrderingGuarantee reports that events are ordered per key, since the events of a
+// key are in one shard, each shard is read in order, and child shards are only
+// read once their parents are finished.
+func (consumer *consumer) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return eventsourcing.OrderingPerKey
+}
+
+// run lists the shards of the stream until stopped, starting a reader for each
+// shard whose parents have been read to their end.
+func (consumer *consumer) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	readers := sync.WaitGroup{}
+	defer readers.Wait()
+
+	running := make(map[string]bool)
+	finished := make(map[string]bool)
+	ended := make(chan string)
+	initial := true
+
+	listing := time.NewTicker(consumer.options.ShardSync)
+	defer listing.Stop()
+
+	for {
+		shards, errList := consumer.listShards(ctx)
+		if errList != nil && ctx.Err() == nil {
+			consumer.options.OnError(errList)
+		}
+
+		for _, shard := range ready(shards, running, finished) {
+			shardID := aws.ToString(shard.ShardId)
+			running[shardID] = true
+			readers.Add(1)
+			go func(initial bool) {
+				defer readers.Done()
+				if consumer.readShard(ctx, shardID, initial) {
+					select {
+					case ended <- shardID:
+					case <-ctx.Done():
+					}
+				}
+			}(initial)
+		}
+		// Listings that fail are retried sooner than the next sync
+		var retry <-chan time.Time
+		if errList == nil {
+			initial = false
+		} else {
+			retry = time.After(consumer.options.Interval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case shardID := <-ended:
+			delete(running, shardID)
+			finished[shardID] = true
+		case <-listing.C:
+		case <-retry:
+		}
+	}
+}
+
+// listShards lists every shard of the stream
+func (consumer *consumer) listShards(ctx context.Context) ([]types.Shard, error) {
+	shards := []types.Shard{}
+	input := &awskinesis.ListShardsInput{
+		StreamName: aws.String(consumer.stream),
+	}
+	for {
+		output, errList := consumer.client.ListShards(ctx, input)
+		if errList != nil {
+			return nil, errList
+		}
+		shards = append(shards, output.Shards...)
+		if output.NextToken == nil {
+			return shards, nil
+		}
+
+		// The stream name can't be given with a token
+		input = &awskinesis.ListShardsInput{
+			NextToken: output.NextToken,
+		}
+	}
+}
+
+// ready gets the shards that should start being read, which are those not being
+// read or finished, whose parents are finished or have expired from the stream.
+func ready(shards []types.Shard, running map[string]bool, finished map[string]bool) []types.Shard {
+	listed := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		listed[aws.ToString(shard.ShardId)] = true
+	}
+
+	waiting := func(parent *string) bool {
+		return parent != nil && listed[*parent] && !finished[*parent]
+	}
+
+	result := []types.Shard{}
+	for _, shard := range shards {
+		shardID := aws.ToString(shard.ShardId)
+		if running[shardID] || finished[shardID] || waiting(shard.ParentShardId) || waiting(shard.AdjacentParentShardId) {
+			continue
+		}
+		result = append(result, shard)
+	}
+	return result
+}
+
+// readShard reads a shard until stopped, returning true once the shard has been read
+// to its end. Failures are reported, and retried after the interval.
+func (consumer *consumer) readShard(ctx context.Context, shardID string, initial bool) bool {
+	var reader *shardReader
+	for ctx.Err() == nil {
+		var errRead error
+		if reader == nil {
+			reader, errRead = consumer.openShard(ctx, shardID, initial)
+		}
+		if errRead == nil {
+			var finished bool
+			finished, errRead = reader.read(ctx)
+			if finished {
+				return true
+			}
+			if errRead == nil {
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		consumer.options.OnError(fmt.Errorf("kinesis: reading shard %v: %v", shardID, errRead))
+
+		// Iterators that expire before anything is handled are opened again from
+		// the tracker
+		var expired *types.ExpiredIteratorException
+		if errors.As(errRead, &expired) {
+			reader = nil
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(consumer.options.Interval):
+		}
+	}
+	return false
+}
+
+// shardReader reads a shard from an iterator, handling its records in order.
+type shardReader struct {
+	consumer *consumer      // Consumer the shard is read by
+	shardID  string         // Shard being read
+	tracker  Tracker        // Tracker of the shard
+	iterator *string        // Iterator of the next records to read
+	pending  []types.Record // Records read, and not yet handled
+	last     *string        // Sequence number of the last record handled
+}
+
+// openShard gets the tracker of a shard, and an iterator starting where the shard
+// should be read from.
+func (consumer *consumer) openShard(ctx context.Context, shardID string, initial bool) (*shardReader, error) {
+	tracker, errTracker := consumer.options.Trackers(shardID)
+	if errTracker != nil {
+		return nil, errTracker
+	}
+
+	start := consumer.options.Start
+	if !initial {
+		start = eventsourcing.FromCheckpoint()
+	}
+	input, errStart := shardStart(start, tracker, initial)
+	if errStart != nil {
+		return nil, errStart
+	}
+	input.StreamName = aws.String(consumer.stream)
+	input.ShardId = aws.String(shardID)
+
+	output, errIterator := consumer.client.GetShardIterator(ctx, input)
+	if errIterator != nil {
+		return nil, errIterator
+	}
+
+	return &shardReader{
+		consumer: consumer,
+		shardID:  shardID,
+		tracker:  tracker,
+		iterator: output.ShardIterator,
+	}, nil
+}
+
+// shardStart determines where a shard is read from. Shards created after the
+// consumer started are read from their oldest record unless they've been
+// checkpointed, since their parents were read up to the point they split.
+func shardStart(start eventsourcing.StartMode, tracker Tracker, initial bool) (*awskinesis.GetShardIteratorInput, error) {
+	switch start.Kind {
+	case eventsourcing.StartCheckpoint:
+		if sequences, ok := tracker.(SequenceTracker); ok {
+			sequenceNumber, errSequence := sequences.SequenceNumber()
+			if errSequence != nil {
+				return nil, errSequence
+			}
+			if sequenceNumber != "" {
+				return &awskinesis.GetShardIteratorInput{
+					ShardIteratorType:      types.ShardIteratorTypeAfterSequenceNumber,
+					StartingSequenceNumber: aws.String(sequenceNumber),
+				}, nil
+			}
+		}
+
+		position, errPosition := tracker.StartPosition()
+		if errPosition != nil {
+			return nil, errPosition
+		}
+		if position == InitialPositionEdge && initial {
+			return &awskinesis.GetShardIteratorInput{ShardIteratorType: types.ShardIteratorTypeLatest}, nil
+		}
+		if position < 0 {
+			return &awskinesis.GetShardIteratorInput{ShardIteratorType: types.ShardIteratorTypeTrimHorizon}, nil
+		}
+		return atTimestamp(time.Unix(0, position*int64(time.Millisecond))), nil
+	case eventsourcing.StartBeginning:
+		return &awskinesis.GetShardIteratorInput{ShardIteratorType: types.ShardIteratorTypeTrimHorizon}, nil
+	case eventsourcing.StartLatest:
+		return &awskinesis.GetShardIteratorInput{ShardIteratorType: types.ShardIteratorTypeLatest}, nil
+	case eventsourcing.StartTimestamp:
+		return atTimestamp(start.Timestamp), nil
+	case eventsourcing.StartPosition:
+		return atTimestamp(time.Unix(0, start.Position*int64(time.Millisecond))), nil
+	}
+
+	return nil, fmt.Errorf("kinesis: unsupported start mode %v", start)
+}
+
+// atTimestamp gets the start of an iterator at the first record arriving at or
+// after a time
+func atTimestamp(at time.Time) *awskinesis.GetShardIteratorInput {
+	return &awskinesis.GetShardIteratorInput{
+		ShardIteratorType: types.ShardIteratorTypeAtTimestamp,
+		Timestamp:         aws.Time(at),
+	}
+}
+
+// read handles the records read and not yet handled, or reads the next batch of
+// records and handles them, checkpointing once they're handled. True is returned
+// once the shard has been read to its end.
+func (reader *shardReader) read(ctx context.Context) (bool, error) {
+	consumer := reader.consumer
+	if len(reader.pending) == 0 {
+		if reader.iterator == nil {
+			return true, nil
+		}
+
+		output, errRead := consumer.client.GetRecords(ctx, &awskinesis.GetRecordsInput{
+			ShardIterator: reader.iterator,
+			Limit:         aws.Int32(int32(consumer.options.BatchSize)),
+		})
+		var expired *types.ExpiredIteratorException
+		if errors.As(errRead, &expired) && reader.last != nil {
+			// Iterators expire after five minutes, so carry on after the last record
+			return false, reader.reopen(ctx)
+		}
+		if errRead != nil {
+			return false, errRead
+		}
+		reader.pending = output.Records
+		reader.iterator = output.NextShardIterator
+
+		if len(reader.pending) == 0 {
+			if reader.iterator == nil {
+				return true, nil
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(consumer.options.Interval):
+			}
+			return false, nil
+		}
+	}
+
+	handled, errHandle := reader.handle(ctx)
+	if handled != nil {
+		errCheckpoint := reader.checkpoint(*handled)
+		if errCheckpoint != nil {
+			consumer.options.OnError(fmt.Errorf("kinesis: checkpointing shard %v: %v", reader.shardID, errCheckpoint))
+		}
+	}
+	return false, errHandle
+}
+
+// reopen gets a new iterator after the last record handled
+func (reader *shardReader) reopen(ctx context.Context) error {
+	output, errIterator := reader.consumer.client.GetShardIterator(ctx, &awskinesis.GetShardIteratorInput{
+		StreamName:             aws.String(reader.consumer.stream),
+		ShardId:                aws.String(reader.shardID),
+		ShardIteratorType:      types.ShardIteratorTypeAfterSequenceNumber,
+		StartingSequenceNumber: reader.last,
+	})
+	if errIterator != nil {
+		return errIterator
+	}
+	reader.iterator = output.ShardIterator
+	reader.pending = nil
+	return nil
+}
+
+// handle dispatches the pending records in order, until one fails or the consumer
+// stops, returning the last record handled.
+func (reader *shardReader) handle(ctx context.Context) (*types.Record, error) {
+	consumer := reader.consumer
+	consumer.dispatch.Lock()
+	defer consumer.dispatch.Unlock()
+
+	var handled *types.Record
+	for len(reader.pending) > 0 && ctx.Err() == nil {
+		record := reader.pending[0]
+		event, wanted, errDecode := consumer.handlers.Decode(record.Data)
+		if errDecode != nil {
+			consumer.options.OnError(fmt.Errorf("kinesis: discarding record %v of shard %v: %v", aws.ToString(record.SequenceNumber), reader.shardID, errDecode))
+		} else if wanted {
+			errDispatch := consumer.handlers.Dispatch(event)
+			if errDispatch != nil {
+				return handled, errDispatch
+			}
+		}
+
+		reader.pending = reader.pending[1:]
+		reader.last = record.SequenceNumber
+		handled = &record
+	}
+	return handled, nil
+}
+
+// checkpoint records the last record handled with the shard's tracker
+func (reader *shardReader) checkpoint(record types.Record) error {
+	position := aws.ToTime(record.ApproximateArrivalTimestamp).UnixNano() / int64(time.Millisecond)
+	if sequences, ok := reader.tracker.(SequenceTracker); ok {
+		return sequences.UpdateSequenceNumber(aws.ToString(record.SequenceNumber), position)
+	}
+	return reader.tracker.UpdatePosition(position)
+}
@@ -0,0 +1,98 @@
+/*
+Package kinesis distributes events through an AWS Kinesis data stream, with a
+publisher putting each event into the stream using its aggregate key as the
+partition key, and consumers reading every shard of the stream, checkpointing
+their progress through each shard with a tracker of its own.
+
+Since every event of an aggregate lands on the same shard, and shards are read in
+order, the events of each aggregate are delivered in order. When the stream is
+resharded, the shards it's split or merged into are only read once the shards they
+came from have been read to their end, so resharding doesn't reorder them either.
+
+Clients are created from an aws.Config, whose BaseEndpoint can point them at
+LocalStack or kinesalite.
+*/
+package kinesis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awskinesis "github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// StreamAPI is the part of the Kinesis client that publishers and consumers use,
+// which is implemented by *kinesis.Client.
+type StreamAPI interface {
+	PutRecord(ctx context.Context, params *awskinesis.PutRecordInput, optFns ...func(*awskinesis.Options)) (*awskinesis.PutRecordOutput, error)
+	ListShards(ctx context.Context, params *awskinesis.ListShardsInput, optFns ...func(*awskinesis.Options)) (*awskinesis.ListShardsOutput, error)
+	GetShardIterator(ctx context.Context, params *awskinesis.GetShardIteratorInput, optFns ...func(*awskinesis.Options)) (*awskinesis.GetShardIteratorOutput, error)
+	GetRecords(ctx context.Context, params *awskinesis.GetRecordsInput, optFns ...func(*awskinesis.Options)) (*awskinesis.GetRecordsOutput, error)
+}
+
+// publisher is a structure implementing EventPublisher and putting events into a
+// Kinesis stream.
+type publisher struct {
+	client   StreamAPI                   // Kinesis client
+	stream   string                      // Stream to publish to
+	registry eventsourcing.EventRegistry // Registry
+}
+
+// CreatePublisher creates a new publisher putting events into a Kinesis stream.
+func CreatePublisher(config aws.Config, stream string, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	return CreatePublisherWithClient(awskinesis.NewFromConfig(config), stream, registry)
+}
+
+// CreatePublisherWithClient creates a publisher putting events into a Kinesis stream
+// with a client that's already been created (BYO-instance).
+func CreatePublisherWithClient(client StreamAPI, stream string, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	if stream == "" {
+		return nil, fmt.Errorf("kinesis: a stream name is required")
+	}
+
+	return &publisher{
+		client:   client,
+		stream:   stream,
+		registry: registry,
+	}, nil
+}
+
+// Publish an event. When the method returns the event should be committed/guaranteed
+// to have been distributed.
+func (pub *publisher) Publish(key string, sequence int64, event eventsourcing.Event) error {
+	eventType, found := pub.registry.GetEventType(event)
+	if !found {
+		return fmt.Errorf("Could not find event type: %v", event)
+	}
+
+	toPublish := eventsourcing.PublishedEvent{
+		Domain:   pub.registry.Domain(),
+		Type:     eventType,
+		Key:      key,
+		Sequence: sequence,
+		Data:     event,
+	}
+
+	buff, errBuff := json.Marshal(&toPublish)
+	if errBuff != nil {
+		return errBuff
+	}
+
+	// PutRecord waits for the record to be stored, so the events of a key are stored
+	// in the order they're published
+	_, errPut := pub.client.PutRecord(context.Background(), &awskinesis.PutRecordInput{
+		StreamName:   aws.String(pub.stream),
+		PartitionKey: aws.String(key),
+		Data:         buff,
+	})
+	return errPut
+}
+
+// OrderingGuarantee reports that events are ordered per key, since the events of a
+// key are stored in order in the shard their partition key maps to.
+func (pub *publisher) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return eventsourcing.OrderingPerKey
+}
@@ -0,0 +1,350 @@
+package kinesis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awskinesis "github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeShard is a shard of a fake stream
+type fakeShard struct {
+	id      string
+	parent  *string
+	records []types.Record
+	closed  bool
+}
+
+// fakeStream is an in-memory stream that behaves like Kinesis, putting every record
+// into its last shard, and giving each record an arrival time a second after the
+// previous one.
+type fakeStream struct {
+	lock      sync.Mutex
+	shards    []*fakeShard
+	counter   int64
+	puts      []*awskinesis.PutRecordInput
+	iterators int
+}
+
+// newFakeStream creates a fake stream with one open shard
+func newFakeStream() *fakeStream {
+	return &fakeStream{
+		shards: []*fakeShard{{id: "shard-0"}},
+	}
+}
+
+// split closes the open shard, and opens a child of it
+func (stream *fakeStream) split() {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	parent := stream.shards[len(stream.shards)-1]
+	parent.closed = true
+	stream.shards = append(stream.shards, &fakeShard{
+		id:     fmt.Sprintf("shard-%d", len(stream.shards)),
+		parent: aws.String(parent.id),
+	})
+}
+
+// shard finds a shard by its ID
+func (stream *fakeStream) shard(shardID string) *fakeShard {
+	for _, shard := range stream.shards {
+		if shard.id == shardID {
+			return shard
+		}
+	}
+	return nil
+}
+
+// PutRecord adds a record to the open shard
+func (stream *fakeStream) PutRecord(ctx context.Context, params *awskinesis.PutRecordInput, optFns ...func(*awskinesis.Options)) (*awskinesis.PutRecordOutput, error) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	stream.puts = append(stream.puts, params)
+	stream.counter++
+	shard := stream.shards[len(stream.shards)-1]
+	shard.records = append(shard.records, types.Record{
+		Data:                        params.Data,
+		PartitionKey:                params.PartitionKey,
+		SequenceNumber:              aws.String(fmt.Sprintf("%056d", stream.counter)),
+		ApproximateArrivalTimestamp: aws.Time(time.Unix(1000+stream.counter, 0)),
+	})
+	return &awskinesis.PutRecordOutput{ShardId: aws.String(shard.id)}, nil
+}
+
+// Iterators gets the number of iterators got
+func (stream *fakeStream) Iterators() int {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	return stream.iterators
+}
+
+// ListShards lists the shards, parents first
+func (stream *fakeStream) ListShards(ctx context.Context, params *awskinesis.ListShardsInput, optFns ...func(*awskinesis.Options)) (*awskinesis.ListShardsOutput, error) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	output := &awskinesis.ListShardsOutput{}
+	for _, shard := range stream.shards {
+		output.Shards = append(output.Shards, types.Shard{
+			ShardId:       aws.String(shard.id),
+			ParentShardId: shard.parent,
+		})
+	}
+	return output, nil
+}
+
+// GetShardIterator gets an iterator, which is the shard ID and the index of the
+// next record
+func (stream *fakeStream) GetShardIterator(ctx context.Context, params *awskinesis.GetShardIteratorInput, optFns ...func(*awskinesis.Options)) (*awskinesis.GetShardIteratorOutput, error) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	stream.iterators++
+	shard := stream.shard(aws.ToString(params.ShardId))
+	index := 0
+	switch params.ShardIteratorType {
+	case types.ShardIteratorTypeLatest:
+		index = len(shard.records)
+	case types.ShardIteratorTypeAtTimestamp:
+		for index < len(shard.records) && shard.records[index].ApproximateArrivalTimestamp.Before(*params.Timestamp) {
+			index++
+		}
+	case types.ShardIteratorTypeAfterSequenceNumber:
+		for index < len(shard.records) && aws.ToString(shard.records[index].SequenceNumber) <= aws.ToString(params.StartingSequenceNumber) {
+			index++
+		}
+	}
+	return &awskinesis.GetShardIteratorOutput{ShardIterator: aws.String(fmt.Sprintf("%s/%d", shard.id, index))}, nil
+}
+
+// GetRecords reads the records after an iterator, with no next iterator once a
+// closed shard has been read to its end
+func (stream *fakeStream) GetRecords(ctx context.Context, params *awskinesis.GetRecordsInput, optFns ...func(*awskinesis.Options)) (*awskinesis.GetRecordsOutput, error) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	parts := strings.Split(aws.ToString(params.ShardIterator), "/")
+	shard := stream.shard(parts[0])
+	index, _ := strconv.Atoi(parts[1])
+
+	end := index + int(aws.ToInt32(params.Limit))
+	if end > len(shard.records) {
+		end = len(shard.records)
+	}
+	output := &awskinesis.GetRecordsOutput{
+		Records: append([]types.Record{}, shard.records[index:end]...),
+	}
+	if !shard.closed || end < len(shard.records) {
+		output.NextShardIterator = aws.String(fmt.Sprintf("%s/%d", shard.id, end))
+	}
+	return output, nil
+}
+
+// memoryTracker is a tracker held in memory
+type memoryTracker struct {
+	lock           sync.Mutex
+	position       int64
+	sequenceNumber string
+}
+
+// StartPosition gets the position
+func (tracker *memoryTracker) StartPosition() (int64, error) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	return tracker.position, nil
+}
+
+// UpdatePosition stores the position
+func (tracker *memoryTracker) UpdatePosition(position int64) error {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	tracker.position = position
+	return nil
+}
+
+// sequenceTracker is a tracker held in memory that also stores sequence numbers
+type sequenceTracker struct {
+	memoryTracker
+}
+
+// SequenceNumber gets the sequence number
+func (tracker *sequenceTracker) SequenceNumber() (string, error) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	return tracker.sequenceNumber, nil
+}
+
+// UpdateSequenceNumber stores the sequence number and position
+func (tracker *sequenceTracker) UpdateSequenceNumber(sequenceNumber string, position int64) error {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	tracker.sequenceNumber = sequenceNumber
+	tracker.position = position
+	return nil
+}
+
+// trackers gets the trackers of shards, creating them as they're asked for
+func trackers(create func() Tracker) func(string) (Tracker, error) {
+	lock := sync.Mutex{}
+	byShard := make(map[string]Tracker)
+	return func(shardID string) (Tracker, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if byShard[shardID] == nil {
+			byShard[shardID] = create()
+		}
+		return byShard[shardID], nil
+	}
+}
+
+// consume starts a consumer with a recording handler
+func consume(t *testing.T, stream *fakeStream, options Options, handler *test.RecordingHandler) eventsourcing.EventConsumer {
+	options.Interval = 10 * time.Millisecond
+	options.ShardSync = 10 * time.Millisecond
+	options.OnError = func(error) {}
+	consumer, errCreate := CreateConsumerWithClient(stream, "events", options)
+	require.Nil(t, errCreate)
+
+	consumer.AddHandler(handler)
+	assert.Nil(t, consumer.Start())
+	return consumer
+}
+
+// TestPublishConsume checks events are delivered in order, failures retried before
+// later records, and that a restarted consumer resumes after its checkpoint
+func TestPublishConsume(t *testing.T) {
+	stream := newFakeStream()
+	pub, errPub := CreatePublisherWithClient(stream, "events", test.GetTestRegistry())
+	require.Nil(t, errPub)
+	assert.Equal(t, eventsourcing.OrderingPerKey, eventsourcing.OrderingOf(pub))
+	test.PublishIncrements(t, pub, "a", 1, 3)
+	assert.Equal(t, "a", aws.ToString(stream.puts[0].PartitionKey))
+	assert.Equal(t, "events", aws.ToString(stream.puts[0].StreamName))
+
+	shards := trackers(func() Tracker { return &sequenceTracker{memoryTracker{position: InitialPositionTrimHorizon}} })
+	handler := test.CreateRecordingHandler(true)
+	consumer := consume(t, stream, Options{Trackers: shards}, handler)
+	defer consumer.Stop()
+	assert.Equal(t, eventsourcing.OrderingPerKey, eventsourcing.OrderingOf(consumer))
+
+	test.PublishIncrements(t, pub, "a", 4, 2)
+	assert.True(t, test.WaitFor(func() bool { return handler.Count() == 5 }))
+	assert.Nil(t, consumer.Stop())
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, handler.Seen())
+	assert.Equal(t, 1, handler.Fails())
+
+	tracker, _ := shards("shard-0")
+	sequenceNumber, _ := tracker.(SequenceTracker).SequenceNumber()
+	assert.Equal(t, fmt.Sprintf("%056d", 5), sequenceNumber)
+
+	resumed := test.CreateRecordingHandler(false)
+	consumer = consume(t, stream, Options{Trackers: shards}, resumed)
+	defer consumer.Stop()
+	test.PublishIncrements(t, pub, "a", 6, 1)
+	assert.True(t, test.WaitFor(func() bool { return resumed.Count() == 1 }))
+	assert.Equal(t, []int64{6}, resumed.Seen())
+}
+
+// TestPositionTracker checks trackers that only store positions resume from the
+// arrival time of the last record handled, delivering it again
+func TestPositionTracker(t *testing.T) {
+	stream := newFakeStream()
+	pub, _ := CreatePublisherWithClient(stream, "events", test.GetTestRegistry())
+	test.PublishIncrements(t, pub, "a", 1, 2)
+
+	shards := trackers(func() Tracker { return &memoryTracker{position: InitialPositionTrimHorizon} })
+	handler := test.CreateRecordingHandler(false)
+	consumer := consume(t, stream, Options{Trackers: shards}, handler)
+	assert.True(t, test.WaitFor(func() bool { return handler.Count() == 2 }))
+	assert.Nil(t, consumer.Stop())
+
+	tracker, _ := shards("shard-0")
+	position, _ := tracker.StartPosition()
+	assert.Equal(t, int64(1002000), position)
+
+	resumed := test.CreateRecordingHandler(false)
+	consumer = consume(t, stream, Options{Trackers: shards}, resumed)
+	defer consumer.Stop()
+	test.PublishIncrements(t, pub, "a", 3, 1)
+	assert.True(t, test.WaitFor(func() bool { return resumed.Count() == 2 }))
+	assert.Equal(t, []int64{2, 3}, resumed.Seen())
+}
+
+// TestResharding checks a child shard is only read once its parent has been read
+// to its end, and from its oldest record when it appears while consuming
+func TestResharding(t *testing.T) {
+	stream := newFakeStream()
+	pub, _ := CreatePublisherWithClient(stream, "events", test.GetTestRegistry())
+	test.PublishIncrements(t, pub, "a", 1, 2)
+	stream.split()
+	test.PublishIncrements(t, pub, "a", 3, 2)
+
+	handler := test.CreateRecordingHandler(true)
+	consumer := consume(t, stream, Options{Trackers: trackers(func() Tracker { return &sequenceTracker{memoryTracker{position: InitialPositionTrimHorizon}} })}, handler)
+	defer consumer.Stop()
+	assert.True(t, test.WaitFor(func() bool { return handler.Count() == 4 }))
+	assert.Equal(t, []int64{1, 2, 3, 4}, handler.Seen())
+
+	// Shards split while consuming are read in full, even when started from the edge
+	edge := newFakeStream()
+	pub, _ = CreatePublisherWithClient(edge, "events", test.GetTestRegistry())
+	test.PublishIncrements(t, pub, "b", 1, 1)
+	latest := test.CreateRecordingHandler(false)
+	consumer = consume(t, edge, Options{Trackers: trackers(func() Tracker { return &sequenceTracker{memoryTracker{position: InitialPositionEdge}} })}, latest)
+	defer consumer.Stop()
+	assert.True(t, test.WaitFor(func() bool { return edge.Iterators() == 1 }))
+	test.PublishIncrements(t, pub, "b", 2, 1)
+	edge.split()
+	test.PublishIncrements(t, pub, "b", 3, 1)
+	assert.True(t, test.WaitFor(func() bool { return latest.Count() == 2 }))
+	assert.Equal(t, []int64{2, 3}, latest.Seen())
+}
+
+// TestShardStart checks start modes and tracker positions map onto shard iterators
+func TestShardStart(t *testing.T) {
+	at := time.Unix(1000, 0)
+	tracked := &sequenceTracker{memoryTracker{position: 5000, sequenceNumber: "42"}}
+	cases := []struct {
+		start    eventsourcing.StartMode
+		tracker  Tracker
+		initial  bool
+		iterator types.ShardIteratorType
+	}{
+		{eventsourcing.FromCheckpoint(), &memoryTracker{position: InitialPositionTrimHorizon}, true, types.ShardIteratorTypeTrimHorizon},
+		{eventsourcing.FromCheckpoint(), &memoryTracker{position: InitialPositionEdge}, true, types.ShardIteratorTypeLatest},
+		{eventsourcing.FromCheckpoint(), &memoryTracker{position: InitialPositionEdge}, false, types.ShardIteratorTypeTrimHorizon},
+		{eventsourcing.FromCheckpoint(), &memoryTracker{position: 5000}, true, types.ShardIteratorTypeAtTimestamp},
+		{eventsourcing.FromCheckpoint(), tracked, true, types.ShardIteratorTypeAfterSequenceNumber},
+		{eventsourcing.FromBeginning(), tracked, true, types.ShardIteratorTypeTrimHorizon},
+		{eventsourcing.FromLatest(), tracked, true, types.ShardIteratorTypeLatest},
+		{eventsourcing.FromTimestamp(at), tracked, true, types.ShardIteratorTypeAtTimestamp},
+		{eventsourcing.FromPosition(5000), tracked, true, types.ShardIteratorTypeAtTimestamp},
+	}
+	for _, c := range cases {
+		input, errStart := shardStart(c.start, c.tracker, c.initial)
+		assert.Nil(t, errStart)
+		assert.Equal(t, c.iterator, input.ShardIteratorType, "%v", c.start)
+	}
+
+	input, _ := shardStart(eventsourcing.FromCheckpoint(), tracked, true)
+	assert.Equal(t, "42", aws.ToString(input.StartingSequenceNumber))
+	input, _ = shardStart(eventsourcing.FromCheckpoint(), &memoryTracker{position: 5000}, true)
+	assert.Equal(t, time.Unix(5, 0), *input.Timestamp)
+	input, _ = shardStart(eventsourcing.FromTimestamp(at), tracked, true)
+	assert.Equal(t, at, *input.Timestamp)
+
+	_, errCreate := CreateConsumerWithClient(newFakeStream(), "events", Options{})
+	assert.NotNil(t, errCreate)
+	_, errCreate = CreateConsumerWithClient(newFakeStream(), "events", Options{Trackers: trackers(nil), Start: eventsourcing.StartMode{Kind: -1}})
+	assert.NotNil(t, errCreate)
+	_, errCreate = CreatePublisherWithClient(newFakeStream(), "", test.GetTestRegistry())
+	assert.NotNil(t, errCreate)
+}
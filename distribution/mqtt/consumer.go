@@ -0,0 +1,256 @@
+package mqtt
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/distribution"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultBuffer is the number of messages received ahead of those being handled.
+	DefaultBuffer = 100
+
+	// DefaultInterval is the time waited before retrying, once handling fails.
+	DefaultInterval = time.Second
+)
+
+// Options contains the options for consuming events.
+type Options struct {
+	ClientID string                  // Client ID of the persistent session, unique to this consumer
+	QoS      byte                    // Quality of service of the subscription (0, 1 or 2)
+	Start    eventsourcing.StartMode // Where the session begins (see below)
+	Buffer   int                     // Messages received ahead of those being handled, DefaultBuffer by default
+	Interval time.Duration           // Wait before retrying once handling fails, DefaultInterval by default
+	OnError  func(error)             // Called when handling fails, logs by default
+}
+
+// consumer subscribes to the event topics through a persistent session.
+type consumer struct {
+	connect  func(clean bool, handler paho.MessageHandler) (paho.Client, error) // Connects to the broker, discarding the session if clean
+	owned    bool                                                               // Whether the connection is closed on stop
+	prefix   string                                                             // First level of every topic
+	options  Options                                                            // Options
+	handlers distribution.Handlers                                              // Event handlers, and the event types each receives
+	lock     sync.Mutex                                                         // Guards the loop state
+	client   paho.Client                                                        // MQTT connection, while started
+	stop     chan struct{}                                                      // Stops the handling loop
+	done     chan struct{}                                                      // Closed once the handling loop exits
+}
+
+// CreateConsumer creates a consumer of the events published under a prefix,
+// connecting to the broker when started and disconnecting when stopped.
+//
+// MQTT has no history to replay, so only FromCheckpoint and FromLatest are
+// supported. With FromCheckpoint the consumer resumes its persistent session, and
+// receives the QoS 1 and 2 messages the broker kept while it was stopped (a session
+// that doesn't exist yet starts with the next message published). FromLatest
+// discards the session first, so only messages published from then on are received.
+//
+// Messages are acknowledged once every handler that subscribes to them succeeds.
+// Messages that fail are retried after the interval, before any later messages
+// are handled, while messages whose event can't be decoded are reported and
+// acknowledged.
+func CreateConsumer(endpoint Endpoint, options Options) (eventsourcing.EventConsumer, error) {
+	return newConsumer(func(clean bool, handler paho.MessageHandler) (paho.Client, error) {
+		client := paho.NewClient(clientOptions(endpoint.Broker, options.ClientID, clean, handler))
+		errConnect := wait(client.Connect())
+		if errConnect != nil {
+			return nil, errConnect
+		}
+		return client, nil
+	}, true, endpoint.Prefix, options)
+}
+
+// CreateConsumerWithClient creates a consumer with a client that's already been
+// established (BYO-instance), which must be connected with a persistent session,
+// automatic acknowledgements disabled and ordered handling (see clientOptions).
+// Messages the broker sends as the client connects, before the consumer
+// subscribes, aren't handled until the session is next resumed. The session can't
+// be discarded, so only FromCheckpoint is supported, and the client is not
+// disconnected when the consumer stops.
+func CreateConsumerWithClient(client paho.Client, prefix string, options Options) (eventsourcing.EventConsumer, error) {
+	if options.Start.Kind != eventsourcing.StartCheckpoint {
+		return nil, fmt.Errorf("mqtt: unsupported start mode %v for a client that's already connected", options.Start)
+	}
+
+	return newConsumer(func(bool, paho.MessageHandler) (paho.Client, error) {
+		return client, nil
+	}, false, prefix, options)
+}
+
+// newConsumer validates the options, and applies their defaults
+func newConsumer(connect func(clean bool, handler paho.MessageHandler) (paho.Client, error), owned bool, prefix string, options Options) (eventsourcing.EventConsumer, error) {
+	if prefix == "" || (owned && options.ClientID == "") {
+		return nil, fmt.Errorf("mqtt: a topic prefix and client ID are required")
+	}
+	if options.QoS > 2 {
+		return nil, fmt.Errorf("mqtt: unsupported quality of service %v", options.QoS)
+	}
+	if options.Start.Kind != eventsourcing.StartCheckpoint && options.Start.Kind != eventsourcing.StartLatest {
+		return nil, fmt.Errorf("mqtt: unsupported start mode %v", options.Start)
+	}
+
+	if options.Buffer <= 0 {
+		options.Buffer = DefaultBuffer
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
+	if options.OnError == nil {
+		options.OnError = func(err error) {
+			logrus.WithError(err).Error("mqtt_consumer_error")
+		}
+	}
+
+	return &consumer{
+		connect: connect,
+		owned:   owned,
+		prefix:  prefix,
+		options: options,
+	}, nil
+}
+
+// clientOptions gets the options of a client for a consumer: a persistent session
+// (unless clean), with messages handed to the consumer in order and acknowledged
+// once handled. A resumed session's messages can arrive as soon as the client
+// connects, before it subscribes again, so they go to the handler by default.
+func clientOptions(broker string, clientID string, clean bool, handler paho.MessageHandler) *paho.ClientOptions {
+	return paho.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetCleanSession(clean).
+		SetAutoAckDisabled(true).
+		SetOrderMatters(true).
+		SetAutoReconnect(true).
+		SetDefaultPublishHandler(handler)
+}
+
+// AddHandler appends a new handler to the set of handlers for this consumer. The
+// handler's subscriptions are read when it is added, so it must be initialized.
+func (consumer *consumer) AddHandler(handler eventsourcing.EventHandler) {
+	consumer.handlers.Add(handler)
+}
+
+// Start handling the events from the consumer
+func (consumer *consumer) Start() error {
+	consumer.lock.Lock()
+	defer consumer.lock.Unlock()
+	if consumer.stop != nil {
+		return nil
+	}
+
+	// Connecting with a clean session discards the one the broker kept, after which
+	// the consumer reconnects to begin a persistent session from here
+	if consumer.options.Start.Kind == eventsourcing.StartLatest {
+		discard, errDiscard := consumer.connect(true, nil)
+		if errDiscard != nil {
+			return errDiscard
+		}
+		discard.Disconnect(0)
+	}
+
+	messages := make(chan paho.Message, consumer.options.Buffer)
+	stop := make(chan struct{})
+	receive := func(_ paho.Client, msg paho.Message) {
+		select {
+		case messages <- msg:
+		case <-stop:
+		}
+	}
+
+	client, errConnect := consumer.connect(false, receive)
+	if errConnect != nil {
+		return errConnect
+	}
+
+	errSubscribe := wait(client.Subscribe(consumer.prefix+"/#", consumer.options.QoS, receive))
+	if errSubscribe != nil {
+		if consumer.owned {
+			client.Disconnect(0)
+		}
+		return errSubscribe
+	}
+
+	consumer.client = client
+	consumer.stop = stop
+	consumer.done = make(chan struct{})
+	go consumer.run(messages, consumer.stop, consumer.done)
+	return nil
+}
+
+// Stop handling events from the consumer, waiting for the message being handled
+// to finish. Messages received but not handled yet aren't acknowledged, so the
+// broker delivers them again when the session is resumed.
+func (consumer *consumer) Stop() error {
+	consumer.lock.Lock()
+	stop, done, client := consumer.stop, consumer.done, consumer.client
+	consumer.stop, consumer.done, consumer.client = nil, nil, nil
+	consumer.lock.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+
+	close(stop)
+	<-done
+	if consumer.owned {
+		client.Disconnect(uint(DefaultTimeout / time.Millisecond))
+		return nil
+	}
+	return wait(client.Unsubscribe(consumer.prefix + "/#"))
+}
+
+// OrderingGuarantee reports that events are ordered per key at QoS 1 or 2, since
+// messages are handled in the order the broker sends them, and a message that
+// fails is retried before any later messages (see the publisher). At QoS 0 events
+// may be delivered in any order.
+func (consumer *consumer) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return ordering(consumer.options.QoS)
+}
+
+// run handles messages in the order they were received until stopped.
+func (consumer *consumer) run(messages chan paho.Message, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case msg := <-messages:
+			if !consumer.handle(msg, stop) {
+				return
+			}
+		}
+	}
+}
+
+// handle dispatches a message until it succeeds, waiting before each retry, and
+// acknowledges it. False is returned if the consumer stops before it succeeds.
+func (consumer *consumer) handle(msg paho.Message, stop chan struct{}) bool {
+	event, wanted, errDecode := consumer.handlers.Decode(msg.Payload())
+	if errDecode != nil {
+		consumer.options.OnError(fmt.Errorf("mqtt: discarding message on %v: %v", msg.Topic(), errDecode))
+	}
+
+	for wanted {
+		errDispatch := consumer.handlers.Dispatch(event)
+		if errDispatch == nil {
+			break
+		}
+		consumer.options.OnError(errDispatch)
+
+		select {
+		case <-stop:
+			return false
+		case <-time.After(consumer.options.Interval):
+		}
+	}
+
+	msg.Ack()
+	return true
+}
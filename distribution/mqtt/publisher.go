@@ -0,0 +1,150 @@
+/*
+Package mqtt distributes events through an MQTT broker, with a publisher sending
+each event to a topic of its own aggregate and consumers subscribing to every
+event topic through a persistent session. Messages are acknowledged once every
+handler that subscribes to them succeeds, and the broker keeps the messages
+published while a consumer is stopped, so long as they were published at QoS 1
+or 2. This suits deployments that already run a broker for devices, and want
+events to reach the same clients.
+
+Events are published to the topic <prefix>/<domain>/<type>/<key>, so consumers
+(or other clients) can subscribe to a single domain, type or aggregate with the
+usual wildcards. Characters with a meaning in topics are percent-encoded in each
+level (see Level).
+*/
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// DefaultTimeout is how long connecting, publishing and subscribing wait for the
+// broker.
+const DefaultTimeout = 10 * time.Second
+
+// Endpoint identifies the MQTT broker and the topics that events are distributed
+// through.
+type Endpoint struct {
+	Broker string `json:"broker"` // URL of the broker, i.e. tcp://localhost:1883
+	Prefix string `json:"prefix"` // First level of every event topic
+}
+
+// publisher is a structure implementing EventPublisher and sending events to an
+// MQTT broker.
+type publisher struct {
+	client   paho.Client                 // MQTT connection
+	prefix   string                      // First level of every topic
+	qos      byte                        // Quality of service
+	registry eventsourcing.EventRegistry // Registry
+}
+
+// CreatePublisher creates a new publisher sending events to a broker at a quality
+// of service (0, 1 or 2), connecting with a client ID of its own.
+func CreatePublisher(endpoint Endpoint, clientID string, qos byte, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	options := paho.NewClientOptions().
+		AddBroker(endpoint.Broker).
+		SetClientID(clientID).
+		SetAutoReconnect(true)
+
+	client := paho.NewClient(options)
+	errConnect := wait(client.Connect())
+	if errConnect != nil {
+		return nil, errConnect
+	}
+
+	return CreatePublisherWithClient(client, endpoint.Prefix, qos, registry)
+}
+
+// CreatePublisherWithClient creates a publisher with a client that's already been
+// established (BYO-instance)
+func CreatePublisherWithClient(client paho.Client, prefix string, qos byte, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	if prefix == "" {
+		return nil, fmt.Errorf("mqtt: a topic prefix is required")
+	}
+	if qos > 2 {
+		return nil, fmt.Errorf("mqtt: unsupported quality of service %v", qos)
+	}
+
+	return &publisher{
+		client:   client,
+		prefix:   prefix,
+		qos:      qos,
+		registry: registry,
+	}, nil
+}
+
+// Publish an event. When the method returns the event should be committed/guaranteed
+// to have been distributed, which at QoS 0 only means it has been sent.
+func (pub *publisher) Publish(key string, sequence int64, event eventsourcing.Event) error {
+	eventType, found := pub.registry.GetEventType(event)
+	if !found {
+		return fmt.Errorf("Could not find event type: %v", event)
+	}
+
+	toPublish := eventsourcing.PublishedEvent{
+		Domain:   pub.registry.Domain(),
+		Type:     eventType,
+		Key:      key,
+		Sequence: sequence,
+		Data:     event,
+	}
+
+	buff, errBuff := json.Marshal(&toPublish)
+	if errBuff != nil {
+		return errBuff
+	}
+
+	return wait(pub.client.Publish(Topic(pub.prefix, toPublish.Domain, string(eventType), key), pub.qos, false, buff))
+}
+
+// OrderingGuarantee reports that events are ordered per key at QoS 1 or 2, since
+// each publish waits for the broker to acknowledge it before the next is sent, and
+// brokers forward messages to a subscriber in the order they were received. The
+// MQTT specification only requires this within a topic, which most brokers extend
+// across the topics of a wildcard subscription. At QoS 0 nothing is acknowledged,
+// so events may be delivered in any order.
+func (pub *publisher) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return ordering(pub.qos)
+}
+
+// ordering gets the ordering guarantee of messages at a quality of service
+func ordering(qos byte) eventsourcing.OrderingGuarantee {
+	if qos == 0 {
+		return eventsourcing.OrderingUnordered
+	}
+	return eventsourcing.OrderingPerKey
+}
+
+// Topic gets the topic the event of an aggregate is published to.
+func Topic(prefix string, domain string, eventType string, key string) string {
+	return strings.Join([]string{prefix, Level(domain), Level(eventType), Level(key)}, "/")
+}
+
+// Level percent-encodes a topic level, so that separators and wildcards in names
+// and keys don't change the topic structure.
+func Level(name string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(name) {
+		switch b {
+		case '%', '/', '+', '#', 0:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		default:
+			escaped.WriteByte(b)
+		}
+	}
+	return escaped.String()
+}
+
+// wait waits for the broker to complete an operation, for up to DefaultTimeout
+func wait(token paho.Token) error {
+	if !token.WaitTimeout(DefaultTimeout) {
+		return fmt.Errorf("mqtt: timed out waiting for the broker")
+	}
+	return token.Error()
+}
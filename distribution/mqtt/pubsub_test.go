@@ -0,0 +1,112 @@
+package mqtt
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testEndpoint gets fresh topics on the test broker
+func testEndpoint() Endpoint {
+	broker := os.Getenv("MQTT_TEST_HOST")
+	if broker == "" {
+		broker = "tcp://localhost:1883"
+	}
+
+	return Endpoint{
+		Broker: broker,
+		Prefix: fmt.Sprintf("test-%s", uuid.NewV4()),
+	}
+}
+
+// consume starts a consumer with a recording handler
+func consume(t *testing.T, endpoint Endpoint, options Options, handler *test.RecordingHandler) eventsourcing.EventConsumer {
+	options.Interval = 10 * time.Millisecond
+	options.OnError = func(error) {}
+	consumer, errCreate := CreateConsumer(endpoint, options)
+	require.Nil(t, errCreate)
+
+	consumer.AddHandler(handler)
+	assert.Nil(t, consumer.Start())
+	return consumer
+}
+
+// TestPublishConsume checks events are delivered in order, failures retried before
+// later messages, and that events published while a consumer is stopped are
+// received once its session resumes
+func TestPublishConsume(t *testing.T) {
+	endpoint := testEndpoint()
+	pub, errPub := CreatePublisher(endpoint, fmt.Sprintf("pub-%s", uuid.NewV4()), 1, test.GetTestRegistry())
+	require.Nil(t, errPub)
+	assert.Equal(t, eventsourcing.OrderingPerKey, eventsourcing.OrderingOf(pub))
+
+	clientID := fmt.Sprintf("sub-%s", uuid.NewV4())
+	handler := test.CreateRecordingHandler(true)
+	consumer := consume(t, endpoint, Options{ClientID: clientID, QoS: 1}, handler)
+	defer consumer.Stop()
+	assert.Equal(t, eventsourcing.OrderingPerKey, eventsourcing.OrderingOf(consumer))
+
+	test.PublishIncrements(t, pub, "a", 1, 3)
+	assert.True(t, test.WaitFor(func() bool { return handler.Count() == 3 }))
+	assert.Nil(t, consumer.Stop())
+	assert.Equal(t, []int64{1, 2, 3}, handler.Seen())
+	assert.Equal(t, 1, handler.Fails())
+
+	test.PublishIncrements(t, pub, "a", 4, 2)
+	resumed := test.CreateRecordingHandler(false)
+	consumer = consume(t, endpoint, Options{ClientID: clientID, QoS: 1}, resumed)
+	defer consumer.Stop()
+	assert.True(t, test.WaitFor(func() bool { return resumed.Count() == 2 }))
+	assert.Equal(t, []int64{4, 5}, resumed.Seen())
+	assert.Nil(t, consumer.Stop())
+
+	// Starting from the latest discards what the session kept meanwhile
+	test.PublishIncrements(t, pub, "a", 6, 1)
+	latest := test.CreateRecordingHandler(false)
+	consumer = consume(t, endpoint, Options{ClientID: clientID, QoS: 1, Start: eventsourcing.FromLatest()}, latest)
+	defer consumer.Stop()
+	test.PublishIncrements(t, pub, "a", 7, 1)
+	assert.True(t, test.WaitFor(func() bool { return latest.Count() == 1 }))
+	assert.Equal(t, []int64{7}, latest.Seen())
+}
+
+// TestOptions checks unsupported start modes and qualities of service are rejected,
+// and the ordering reported at each quality of service
+func TestOptions(t *testing.T) {
+	endpoint := Endpoint{Broker: "tcp://localhost:1883", Prefix: "p"}
+	_, errCreate := CreateConsumer(endpoint, Options{})
+	assert.NotNil(t, errCreate)
+	_, errCreate = CreateConsumer(endpoint, Options{ClientID: "c", QoS: 3})
+	assert.NotNil(t, errCreate)
+	_, errCreate = CreateConsumer(endpoint, Options{ClientID: "c", Start: eventsourcing.FromBeginning()})
+	assert.NotNil(t, errCreate)
+	_, errCreate = CreateConsumerWithClient(nil, "p", Options{Start: eventsourcing.FromLatest()})
+	assert.NotNil(t, errCreate)
+
+	unordered, errCreate := CreateConsumer(endpoint, Options{ClientID: "c", Start: eventsourcing.FromLatest()})
+	require.Nil(t, errCreate)
+	assert.Equal(t, eventsourcing.OrderingUnordered, eventsourcing.OrderingOf(unordered))
+
+	_, errPub := CreatePublisherWithClient(nil, "", 1, test.GetTestRegistry())
+	assert.NotNil(t, errPub)
+	_, errPub = CreatePublisherWithClient(nil, "p", 3, test.GetTestRegistry())
+	assert.NotNil(t, errPub)
+	pub, errPub := CreatePublisherWithClient(nil, "p", 0, test.GetTestRegistry())
+	require.Nil(t, errPub)
+	assert.Equal(t, eventsourcing.OrderingUnordered, eventsourcing.OrderingOf(pub))
+}
+
+// TestTopic checks events are published to a topic per aggregate, with separators
+// and wildcards in each level encoded
+func TestTopic(t *testing.T) {
+	assert.Equal(t, "p/Counter/IncrementEvent/a", Topic("p", "Counter", "IncrementEvent", "a"))
+	assert.Equal(t, "p/Counter/IncrementEvent/tenant%2Fa%2B%23%25", Topic("p", "Counter", "IncrementEvent", "tenant/a+#%"))
+	assert.Equal(t, "p//e/%00", Topic("p", "", "e", "\x00"))
+}
@@ -0,0 +1,334 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/distribution"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultBatchSize is the number of messages fetched from the stream at a time.
+	DefaultBatchSize = 100
+
+	// DefaultMaxWait is how long a fetch waits for new messages.
+	DefaultMaxWait = time.Second
+
+	// DefaultInterval is the time waited before retrying, once handling fails.
+	DefaultInterval = time.Second
+)
+
+// Options contains the options for consuming a stream.
+type Options struct {
+	Durable       string                  // Durable consumer, created at the start position if it doesn't exist
+	Start         eventsourcing.StartMode // Where the durable consumer begins reading (see below)
+	BatchSize     int                     // Messages fetched at a time, DefaultBatchSize by default
+	MaxWait       time.Duration           // Wait for new messages, DefaultMaxWait by default
+	MaxAckPending int                     // Messages delivered but not acknowledged at a time, the server's limit by default
+	AckWait       time.Duration           // Time before unacknowledged messages are redelivered, the server's by default
+	Interval      time.Duration           // Wait before retrying once handling fails, DefaultInterval by default
+	OnError       func(error)             // Called when fetching or handling fails, logs by default
+}
+
+// consumer reads a stream through a durable pull consumer.
+type consumer struct {
+	connect  func() (nats.JetStreamContext, *nats.Conn, error) // Connects to NATS, with the connection to close if owned
+	stream   string                                            // Stream to read
+	options  Options                                           // Options
+	handlers distribution.Handlers                             // Event handlers, and the event types each receives
+	lock     sync.Mutex                                        // Guards the loop state
+	conn     *nats.Conn                                        // Connection to close, while started
+	sub      *nats.Subscription                                // Pull subscription, while started
+	stop     chan struct{}                                     // Stops the fetch loop
+	done     chan struct{}                                     // Closed once the fetch loop exits
+}
+
+// CreateConsumer creates a consumer of a stream, connecting to NATS when started
+// and disconnecting when stopped.
+//
+// The durable consumer is created when the consumer starts, if it doesn't exist. A
+// durable created with FromCheckpoint reads the stream from the beginning, while
+// other start modes recreate an existing durable at the start position, so every
+// process sharing the durable should be stopped while a backfill is started.
+// Positions are stream sequence numbers.
+//
+// Messages are acknowledged once every handler that subscribes to them succeeds.
+// Messages that fail are redelivered, while messages whose event can't be decoded
+// are reported and terminated so they aren't delivered again.
+func CreateConsumer(endpoint Endpoint, options Options) (eventsourcing.EventConsumer, error) {
+	return newConsumer(func() (nats.JetStreamContext, *nats.Conn, error) {
+		conn, errConn := nats.Connect(endpoint.URL)
+		if errConn != nil {
+			return nil, nil, errConn
+		}
+
+		js, errJs := conn.JetStream()
+		if errJs != nil {
+			conn.Close()
+			return nil, nil, errJs
+		}
+		return js, conn, nil
+	}, endpoint.Stream, options)
+}
+
+// CreateConsumerWithContext creates a consumer of a stream with a JetStream context
+// that's already been established (BYO-instance). The connection is not closed when
+// the consumer stops.
+func CreateConsumerWithContext(js nats.JetStreamContext, stream string, options Options) (eventsourcing.EventConsumer, error) {
+	return newConsumer(func() (nats.JetStreamContext, *nats.Conn, error) {
+		return js, nil, nil
+	}, stream, options)
+}
+
+// newConsumer validates the options, and applies their defaults
+func newConsumer(connect func() (nats.JetStreamContext, *nats.Conn, error), stream string, options Options) (eventsourcing.EventConsumer, error) {
+	if stream == "" || options.Durable == "" {
+		return nil, fmt.Errorf("nats: a stream and durable name are required")
+	}
+
+	_, errStart := consumerConfig(stream, options)
+	if errStart != nil {
+		return nil, errStart
+	}
+
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBatchSize
+	}
+	if options.MaxWait <= 0 {
+		options.MaxWait = DefaultMaxWait
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
+	if options.OnError == nil {
+		options.OnError = func(err error) {
+			logrus.WithError(err).Error("nats_consumer_error")
+		}
+	}
+
+	return &consumer{
+		connect: connect,
+		stream:  stream,
+		options: options,
+	}, nil
+}
+
+// AddHandler appends a new handler to the set of handlers for this consumer. The
+// handler's subscriptions are read when it is added, so it must be initialized.
+func (consumer *consumer) AddHandler(handler eventsourcing.EventHandler) {
+	consumer.handlers.Add(handler)
+}
+
+// Start handling the events from the consumer
+func (consumer *consumer) Start() error {
+	consumer.lock.Lock()
+	defer consumer.lock.Unlock()
+	if consumer.stop != nil {
+		return nil
+	}
+
+	js, conn, errConnect := consumer.connect()
+	if errConnect != nil {
+		return errConnect
+	}
+
+	sub, errJoin := consumer.join(js)
+	if errJoin != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return errJoin
+	}
+
+	consumer.conn = conn
+	consumer.sub = sub
+	consumer.stop = make(chan struct{})
+	consumer.done = make(chan struct{})
+	go consumer.run(sub, consumer.stop, consumer.done)
+	return nil
+}
+
+// Stop handling events from the consumer, waiting for the batch being handled
+// to finish. The durable consumer is kept, so the next start resumes from it.
+func (consumer *consumer) Stop() error {
+	consumer.lock.Lock()
+	stop, done, conn, sub := consumer.stop, consumer.done, consumer.conn, consumer.sub
+	consumer.stop, consumer.done, consumer.conn, consumer.sub = nil, nil, nil, nil
+	consumer.lock.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+
+	close(stop)
+	<-done
+	if conn != nil {
+		conn.Close()
+		return nil
+	}
+
+	// The subscription is bound to a durable it didn't create, so unsubscribing
+	// doesn't delete it
+	return sub.Unsubscribe()
+}
+
+// OrderingGuarantee reports that events are ordered per key when only one message
+// may be pending acknowledgement at a time, since each must then be handled before
+// the next is delivered. Otherwise messages are fetched ahead of those being
+// retried, so events may be delivered in any order.
+func (consumer *consumer) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	if consumer.options.MaxAckPending == 1 {
+		return eventsourcing.OrderingPerKey
+	}
+	return eventsourcing.OrderingUnordered
+}
+
+// join creates the durable consumer, or recreates it at the start position if it
+// already exists and we aren't resuming, then binds a pull subscription to it.
+func (consumer *consumer) join(js nats.JetStreamContext) (*nats.Subscription, error) {
+	errStream := ensureStream(js, consumer.stream)
+	if errStream != nil {
+		return nil, errStream
+	}
+
+	config, errConfig := consumerConfig(consumer.stream, consumer.options)
+	if errConfig != nil {
+		return nil, errConfig
+	}
+
+	_, errInfo := js.ConsumerInfo(consumer.stream, consumer.options.Durable)
+	if errInfo != nil && !errors.Is(errInfo, nats.ErrConsumerNotFound) {
+		return nil, errInfo
+	}
+	exists := errInfo == nil
+
+	if exists && consumer.options.Start.Kind != eventsourcing.StartCheckpoint {
+		errDelete := js.DeleteConsumer(consumer.stream, consumer.options.Durable)
+		if errDelete != nil {
+			return nil, errDelete
+		}
+		exists = false
+	}
+	if !exists {
+		_, errAdd := js.AddConsumer(consumer.stream, config)
+		if errAdd != nil {
+			return nil, errAdd
+		}
+	}
+
+	return js.PullSubscribe(config.FilterSubject, consumer.options.Durable, nats.Bind(consumer.stream, consumer.options.Durable))
+}
+
+// consumerConfig gets the configuration of a durable consumer reading the subjects
+// events are published to, from a start position
+func consumerConfig(stream string, options Options) (*nats.ConsumerConfig, error) {
+	config := &nats.ConsumerConfig{
+		Durable:       options.Durable,
+		FilterSubject: stream + ".>",
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       options.AckWait,
+		MaxAckPending: options.MaxAckPending,
+	}
+
+	start := options.Start
+	switch start.Kind {
+	case eventsourcing.StartCheckpoint, eventsourcing.StartBeginning:
+		config.DeliverPolicy = nats.DeliverAllPolicy
+	case eventsourcing.StartLatest:
+		config.DeliverPolicy = nats.DeliverNewPolicy
+	case eventsourcing.StartTimestamp:
+		at := start.Timestamp
+		config.DeliverPolicy = nats.DeliverByStartTimePolicy
+		config.OptStartTime = &at
+	case eventsourcing.StartPosition:
+		if start.Position <= 1 {
+			config.DeliverPolicy = nats.DeliverAllPolicy
+			break
+		}
+		config.DeliverPolicy = nats.DeliverByStartSequencePolicy
+		config.OptStartSeq = uint64(start.Position)
+	default:
+		return nil, fmt.Errorf("nats: unsupported start mode %v", start)
+	}
+
+	return config, nil
+}
+
+// run fetches from the stream until stopped, waiting before retrying once handling
+// fails.
+func (consumer *consumer) run(sub *nats.Subscription, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		errPoll := consumer.poll(sub)
+		if errPoll == nil {
+			continue
+		}
+		consumer.options.OnError(errPoll)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(consumer.options.Interval):
+		}
+	}
+}
+
+// poll fetches a batch of messages, waiting for them if there are none, and
+// handles them.
+func (consumer *consumer) poll(sub *nats.Subscription) error {
+	msgs, errFetch := sub.Fetch(consumer.options.BatchSize, nats.MaxWait(consumer.options.MaxWait))
+	if errors.Is(errFetch, nats.ErrTimeout) {
+		return nil
+	}
+	if errFetch != nil {
+		return errFetch
+	}
+
+	return consumer.handle(msgs)
+}
+
+// handle dispatches a batch of messages in order, acknowledging each once it has
+// been handled. Once a message fails it and the rest of the batch are handed back
+// to be redelivered.
+func (consumer *consumer) handle(msgs []*nats.Msg) error {
+	for index, msg := range msgs {
+		event, wanted, errDecode := consumer.handlers.Decode(msg.Data)
+		if errDecode != nil {
+			consumer.options.OnError(fmt.Errorf("nats: discarding message on %v: %v", msg.Subject, errDecode))
+			errTerm := msg.Term()
+			if errTerm != nil {
+				return errTerm
+			}
+			continue
+		}
+
+		if wanted {
+			errDispatch := consumer.handlers.Dispatch(event)
+			if errDispatch != nil {
+				for _, rest := range msgs[index:] {
+					rest.Nak()
+				}
+				return errDispatch
+			}
+		}
+
+		errAck := msg.Ack()
+		if errAck != nil {
+			return errAck
+		}
+	}
+
+	return nil
+}
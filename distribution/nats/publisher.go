@@ -0,0 +1,155 @@
+/*
+Package nats distributes events through a NATS JetStream stream, with a publisher
+sending each event to a subject of the stream and waiting for the server to
+store it, and consumers reading the stream through a durable pull consumer.
+Messages are acknowledged once every handler that subscribes to them succeeds,
+and the durable consumer keeps its position while the process is stopped.
+
+Events are published to the subject <stream>.<domain>.<type>, so the stream must
+capture <stream>.> (it's created that way if it doesn't exist), and each event
+carries a message ID made from its key and sequence, so an event published twice
+within the stream's duplicate window is only stored once.
+*/
+package nats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/nats-io/nats.go"
+)
+
+// Endpoint identifies the NATS server and the stream that events are distributed
+// through.
+type Endpoint struct {
+	URL    string `json:"url"`    // URL of the NATS server, i.e. nats://localhost:4222
+	Stream string `json:"stream"` // Name of the stream
+}
+
+// publisher is a structure implementing EventPublisher and sending events to a
+// JetStream stream.
+type publisher struct {
+	js       nats.JetStreamContext       // JetStream context
+	stream   string                      // Stream to publish to
+	registry eventsourcing.EventRegistry // Registry
+}
+
+// CreatePublisher creates a new publisher sending events to a stream, creating the
+// stream if it doesn't exist.
+func CreatePublisher(endpoint Endpoint, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	conn, errConn := nats.Connect(endpoint.URL)
+	if errConn != nil {
+		return nil, errConn
+	}
+
+	js, errJs := conn.JetStream()
+	if errJs != nil {
+		conn.Close()
+		return nil, errJs
+	}
+
+	pub, errPub := CreatePublisherWithContext(js, endpoint.Stream, registry)
+	if errPub != nil {
+		conn.Close()
+	}
+	return pub, errPub
+}
+
+// CreatePublisherWithContext creates a publisher with a JetStream context that's
+// already been established (BYO-instance), creating the stream if it doesn't exist.
+func CreatePublisherWithContext(js nats.JetStreamContext, stream string, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	if stream == "" {
+		return nil, fmt.Errorf("nats: a stream name is required")
+	}
+
+	errStream := ensureStream(js, stream)
+	if errStream != nil {
+		return nil, errStream
+	}
+
+	return &publisher{
+		js:       js,
+		stream:   stream,
+		registry: registry,
+	}, nil
+}
+
+// Publish an event. When the method returns the event should be committed/guaranteed
+// to have been distributed.
+func (pub *publisher) Publish(key string, sequence int64, event eventsourcing.Event) error {
+	eventType, found := pub.registry.GetEventType(event)
+	if !found {
+		return fmt.Errorf("Could not find event type: %v", event)
+	}
+
+	toPublish := eventsourcing.PublishedEvent{
+		Domain:   pub.registry.Domain(),
+		Type:     eventType,
+		Key:      key,
+		Sequence: sequence,
+		Data:     event,
+	}
+
+	buff, errBuff := json.Marshal(&toPublish)
+	if errBuff != nil {
+		return errBuff
+	}
+
+	msg := nats.NewMsg(subject(pub.stream, toPublish.Domain, string(eventType)))
+	msg.Data = buff
+	msg.Header.Set(nats.MsgIdHdr, messageID(toPublish))
+
+	// PublishMsg waits for the server to acknowledge the message has been stored
+	_, errPublish := pub.js.PublishMsg(msg)
+	return errPublish
+}
+
+// OrderingGuarantee reports that events are ordered globally, since every event
+// is stored in a single stream, and each is stored before the next is published.
+func (pub *publisher) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return eventsourcing.OrderingGlobal
+}
+
+// ensureStream creates a stream capturing the subjects events are published to, if
+// it doesn't exist.
+func ensureStream(js nats.JetStreamContext, stream string) error {
+	_, errInfo := js.StreamInfo(stream)
+	if errInfo == nil || !errors.Is(errInfo, nats.ErrStreamNotFound) {
+		return errInfo
+	}
+
+	_, errAdd := js.AddStream(&nats.StreamConfig{
+		Name:     stream,
+		Subjects: []string{stream + ".>"},
+	})
+	return errAdd
+}
+
+// subject gets the subject an event is published to. Each part is a single token of
+// the subject, so characters with a meaning in subjects are replaced.
+func subject(stream string, domain string, eventType string) string {
+	return fmt.Sprintf("%s.%s.%s", stream, token(domain), token(eventType))
+}
+
+// token replaces the characters that separate tokens or act as wildcards
+func token(name string) string {
+	if name == "" {
+		return "_"
+	}
+
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// messageID gets the ID the stream de-duplicates an event by
+func messageID(event eventsourcing.PublishedEvent) string {
+	return fmt.Sprintf("%s/%s/%d", event.Domain, event.Key, event.Sequence)
+}
@@ -0,0 +1,142 @@
+package nats
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/nats-io/nats.go"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testEndpoint gets a fresh stream on the test server, which must have JetStream
+// enabled
+func testEndpoint() Endpoint {
+	url := os.Getenv("NATS_TEST_HOST")
+	if url == "" {
+		url = nats.DefaultURL
+	}
+
+	return Endpoint{
+		URL:    url,
+		Stream: fmt.Sprintf("test-%s", uuid.NewV4()),
+	}
+}
+
+// consume starts a consumer with a recording handler
+func consume(t *testing.T, endpoint Endpoint, options Options, handler *test.RecordingHandler) eventsourcing.EventConsumer {
+	options.MaxWait = 100 * time.Millisecond
+	options.Interval = 10 * time.Millisecond
+	options.OnError = func(error) {}
+	consumer, errCreate := CreateConsumer(endpoint, options)
+	require.Nil(t, errCreate)
+
+	consumer.AddHandler(handler)
+	assert.Nil(t, consumer.Start())
+	return consumer
+}
+
+// TestPublishConsume checks events are delivered in order, failures retried before
+// later messages, and that a restarted consumer resumes from its durable
+func TestPublishConsume(t *testing.T) {
+	endpoint := testEndpoint()
+	pub, errPub := CreatePublisher(endpoint, test.GetTestRegistry())
+	require.Nil(t, errPub)
+	assert.Equal(t, eventsourcing.OrderingGlobal, eventsourcing.OrderingOf(pub))
+	test.PublishIncrements(t, pub, "a", 1, 3)
+
+	// Publishing an event again is de-duplicated by the stream
+	test.PublishIncrements(t, pub, "a", 3, 1)
+
+	handler := test.CreateRecordingHandler(true)
+	consumer := consume(t, endpoint, Options{Durable: "d", MaxAckPending: 1}, handler)
+	defer consumer.Stop()
+	assert.Equal(t, eventsourcing.OrderingPerKey, eventsourcing.OrderingOf(consumer))
+
+	test.PublishIncrements(t, pub, "a", 4, 2)
+	assert.True(t, test.WaitFor(func() bool { return handler.Count() == 5 }))
+	assert.Nil(t, consumer.Stop())
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, handler.Seen())
+	assert.Equal(t, 1, handler.Fails())
+
+	resumed := test.CreateRecordingHandler(false)
+	consumer = consume(t, endpoint, Options{Durable: "d"}, resumed)
+	defer consumer.Stop()
+	test.PublishIncrements(t, pub, "a", 6, 1)
+	assert.True(t, test.WaitFor(func() bool { return resumed.Count() == 1 }))
+	assert.Equal(t, []int64{6}, resumed.Seen())
+}
+
+// TestStartModes checks durables can be moved to the start of the stream, or past
+// everything published so far
+func TestStartModes(t *testing.T) {
+	endpoint := testEndpoint()
+	pub, errPub := CreatePublisher(endpoint, test.GetTestRegistry())
+	require.Nil(t, errPub)
+	test.PublishIncrements(t, pub, "a", 1, 2)
+
+	latest := test.CreateRecordingHandler(false)
+	consumer := consume(t, endpoint, Options{Durable: "d", Start: eventsourcing.FromLatest()}, latest)
+	test.PublishIncrements(t, pub, "a", 3, 1)
+	assert.True(t, test.WaitFor(func() bool { return latest.Count() == 1 }))
+	assert.Nil(t, consumer.Stop())
+	assert.Equal(t, []int64{3}, latest.Seen())
+
+	replay := test.CreateRecordingHandler(false)
+	consumer = consume(t, endpoint, Options{Durable: "d", Start: eventsourcing.FromPosition(2)}, replay)
+	defer consumer.Stop()
+	assert.True(t, test.WaitFor(func() bool { return replay.Count() == 2 }))
+	assert.Equal(t, []int64{2, 3}, replay.Seen())
+}
+
+// TestConsumerConfig checks start modes map onto deliver policies, and that
+// invalid options are rejected
+func TestConsumerConfig(t *testing.T) {
+	at := time.Unix(1000, 0)
+	cases := []struct {
+		start  eventsourcing.StartMode
+		policy nats.DeliverPolicy
+	}{
+		{eventsourcing.FromCheckpoint(), nats.DeliverAllPolicy},
+		{eventsourcing.FromBeginning(), nats.DeliverAllPolicy},
+		{eventsourcing.FromLatest(), nats.DeliverNewPolicy},
+		{eventsourcing.FromTimestamp(at), nats.DeliverByStartTimePolicy},
+		{eventsourcing.FromPosition(1), nats.DeliverAllPolicy},
+		{eventsourcing.FromPosition(5), nats.DeliverByStartSequencePolicy},
+	}
+	for _, c := range cases {
+		config, errConfig := consumerConfig("s", Options{Durable: "d", Start: c.start})
+		assert.Nil(t, errConfig)
+		assert.Equal(t, c.policy, config.DeliverPolicy, "%v", c.start)
+		assert.Equal(t, "s.>", config.FilterSubject)
+		assert.Equal(t, nats.AckExplicitPolicy, config.AckPolicy)
+	}
+
+	config, _ := consumerConfig("s", Options{Durable: "d", Start: eventsourcing.FromTimestamp(at)})
+	assert.Equal(t, at, *config.OptStartTime)
+	config, _ = consumerConfig("s", Options{Durable: "d", Start: eventsourcing.FromPosition(5)})
+	assert.Equal(t, uint64(5), config.OptStartSeq)
+
+	_, errCreate := CreateConsumer(Endpoint{URL: nats.DefaultURL, Stream: "s"}, Options{})
+	assert.NotNil(t, errCreate)
+	_, errCreate = CreateConsumer(Endpoint{URL: nats.DefaultURL, Stream: "s"}, Options{Durable: "d", Start: eventsourcing.StartMode{Kind: -1}})
+	assert.NotNil(t, errCreate)
+
+	unordered, errCreate := CreateConsumer(Endpoint{URL: nats.DefaultURL, Stream: "s"}, Options{Durable: "d"})
+	require.Nil(t, errCreate)
+	assert.Equal(t, eventsourcing.OrderingUnordered, eventsourcing.OrderingOf(unordered))
+}
+
+// TestSubject checks events are published to a subject of the stream, with the
+// characters that have a meaning in subjects replaced
+func TestSubject(t *testing.T) {
+	assert.Equal(t, "s.Counter.IncrementEvent", subject("s", "Counter", "IncrementEvent"))
+	assert.Equal(t, "s.a_b.c_d_e_", subject("s", "a.b", "c*d>e "))
+	assert.Equal(t, "s._.e", subject("s", "", "e"))
+	assert.Equal(t, "Counter/a/3", messageID(eventsourcing.PublishedEvent{Domain: "Counter", Key: "a", Sequence: 3}))
+}
@@ -0,0 +1,502 @@
+package redisstream
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/distribution"
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultBatchSize is the number of entries read from the stream at a time.
+	DefaultBatchSize = 100
+
+	// DefaultBlock is how long a read waits for new entries. It must be shorter
+	// than the client's read timeout, which is 3 seconds by default.
+	DefaultBlock = time.Second
+
+	// DefaultClaimAfter is how long an entry stays pending with another consumer
+	// before it is claimed.
+	DefaultClaimAfter = time.Minute
+
+	// DefaultInterval is the time waited before retrying, once handling fails.
+	DefaultInterval = time.Second
+)
+
+// Options contains the options for consuming a stream.
+type Options struct {
+	Group      string                  // Consumer group, created at the start position if it doesn't exist
+	Consumer   string                  // Name of this consumer, unique within the group
+	Start      eventsourcing.StartMode // Where the group begins reading (see below)
+	BatchSize  int                     // Entries read at a time, DefaultBatchSize by default
+	Block      time.Duration           // Wait for new entries, DefaultBlock by default
+	ClaimAfter time.Duration           // Idle time before entries pending with other consumers are claimed, DefaultClaimAfter by default
+	Interval   time.Duration           // Wait before retrying once handling fails, DefaultInterval by default
+	OnError    func(error)             // Called when reading or handling fails, logs by default
+}
+
+// consumer reads a stream as a member of a consumer group.
+type consumer struct {
+	connect  func() redis.UniversalClient // Connects to Redis
+	owned    bool                         // Whether the connection is closed on stop
+	client   redis.UniversalClient        // Redis connection, while started
+	stream   string                       // Stream to read
+	options  Options                      // Options
+	handlers distribution.Handlers        // Event handlers, and the event types each receives
+	lock     sync.Mutex                   // Guards the loop state
+	stop     chan struct{}                // Stops the read loop
+	done     chan struct{}                // Closed once the read loop exits
+
+	// claimFrom is where the next window of pending entries to claim starts, and
+	// legacy is set once the server turns out not to support XAUTOCLAIM. Both
+	// are only used by the read loop.
+	claimFrom string
+	legacy    bool
+}
+
+// streamEntry is a single entry read from a stream. Entries deleted from the
+// stream (i.e. trimmed) while pending have no fields.
+type streamEntry struct {
+	id     string
+	fields map[string]string
+}
+
+// CreateConsumer creates a consumer of a stream, connecting to Redis when started
+// and disconnecting when stopped.
+//
+// The consumer group is created when the consumer starts, if it doesn't exist. A
+// group created with FromCheckpoint reads the stream from the beginning, while
+// other start modes recreate an existing group at the start position, so all
+// members of the group should be stopped while a backfill is started. Timestamps
+// and positions are both milliseconds, the time part of stream entry IDs.
+//
+// Entries are acknowledged once every handler that subscribes to them succeeds.
+// Entries that fail are retried after the interval, before any new entries are
+// read, while entries whose event can't be decoded are reported and acknowledged.
+func CreateConsumer(endpoint Endpoint, options Options) (eventsourcing.EventConsumer, error) {
+	return newConsumer(func() redis.UniversalClient {
+		return redis.NewClient(&redis.Options{
+			Addr: endpoint.Address,
+		})
+	}, true, endpoint.Stream, options)
+}
+
+// CreateConsumerWithClient creates a consumer of a stream with a client that's
+// already been established (BYO-instance). The client is not closed when the
+// consumer stops.
+func CreateConsumerWithClient(client redis.UniversalClient, stream string, options Options) (eventsourcing.EventConsumer, error) {
+	return newConsumer(func() redis.UniversalClient {
+		return client
+	}, false, stream, options)
+}
+
+// newConsumer validates the options, and applies their defaults
+func newConsumer(connect func() redis.UniversalClient, owned bool, stream string, options Options) (eventsourcing.EventConsumer, error) {
+	if stream == "" || options.Group == "" || options.Consumer == "" {
+		return nil, fmt.Errorf("redisstream: a stream, group and consumer name are required")
+	}
+
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBatchSize
+	}
+	if options.Block <= 0 {
+		options.Block = DefaultBlock
+	}
+	if options.ClaimAfter <= 0 {
+		options.ClaimAfter = DefaultClaimAfter
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
+	if options.OnError == nil {
+		options.OnError = func(err error) {
+			logrus.WithError(err).Error("redisstream_consumer_error")
+		}
+	}
+
+	return &consumer{
+		connect: connect,
+		owned:   owned,
+		stream:  stream,
+		options: options,
+	}, nil
+}
+
+// AddHandler appends a new handler to the set of handlers for this consumer. The
+// handler's subscriptions are read when it is added, so it must be initialized.
+func (consumer *consumer) AddHandler(handler eventsourcing.EventHandler) {
+	consumer.handlers.Add(handler)
+}
+
+// Start handling the events from the consumer
+func (consumer *consumer) Start() error {
+	consumer.lock.Lock()
+	defer consumer.lock.Unlock()
+	if consumer.stop != nil {
+		return nil
+	}
+
+	client := consumer.connect()
+	errGroup := consumer.join(client)
+	if errGroup != nil {
+		if consumer.owned {
+			client.Close()
+		}
+		return errGroup
+	}
+
+	consumer.client = client
+	consumer.claimFrom = "0-0"
+	if consumer.legacy {
+		consumer.claimFrom = "-"
+	}
+	consumer.stop = make(chan struct{})
+	consumer.done = make(chan struct{})
+	go consumer.run(client, consumer.stop, consumer.done)
+	return nil
+}
+
+// Stop handling events from the consumer, waiting for the batch being handled
+// to finish
+func (consumer *consumer) Stop() error {
+	consumer.lock.Lock()
+	stop, done, client := consumer.stop, consumer.done, consumer.client
+	consumer.stop, consumer.done, consumer.client = nil, nil, nil
+	consumer.lock.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+
+	close(stop)
+	<-done
+	if consumer.owned {
+		return client.Close()
+	}
+	return nil
+}
+
+// OrderingGuarantee reports that events may be delivered in any order, since
+// the members of a group share the entries of the stream, and entries claimed
+// from other members are handled after those read since. A group with a single
+// member handles the stream in order.
+func (consumer *consumer) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return eventsourcing.OrderingUnordered
+}
+
+// join creates the consumer group, or recreates it at the start position if it
+// already exists and we aren't resuming.
+func (consumer *consumer) join(client redis.UniversalClient) error {
+	id, errStart := startID(consumer.options.Start)
+	if errStart != nil {
+		return errStart
+	}
+
+	errCreate := client.Process(redis.NewCmd("XGROUP", "CREATE", consumer.stream, consumer.options.Group, id, "MKSTREAM"))
+	if errCreate == nil || !strings.HasPrefix(errCreate.Error(), "BUSYGROUP") {
+		return errCreate
+	}
+	if consumer.options.Start.Kind == eventsourcing.StartCheckpoint {
+		return nil
+	}
+
+	// Recreating the group also drops the entries pending with its members, which
+	// would otherwise be claimed and handled again
+	errDestroy := client.Process(redis.NewCmd("XGROUP", "DESTROY", consumer.stream, consumer.options.Group))
+	if errDestroy != nil {
+		return errDestroy
+	}
+	return client.Process(redis.NewCmd("XGROUP", "CREATE", consumer.stream, consumer.options.Group, id))
+}
+
+// startID finds the ID a group should last have read, to begin reading from a
+// start position
+func startID(start eventsourcing.StartMode) (string, error) {
+	switch start.Kind {
+	case eventsourcing.StartCheckpoint, eventsourcing.StartBeginning:
+		return "0", nil
+	case eventsourcing.StartLatest:
+		return "$", nil
+	case eventsourcing.StartTimestamp:
+		return afterMillis(start.Timestamp.UnixNano() / int64(time.Millisecond)), nil
+	case eventsourcing.StartPosition:
+		return afterMillis(start.Position), nil
+	}
+
+	return "", fmt.Errorf("redisstream: unsupported start mode %v", start)
+}
+
+// afterMillis gets the last ID before the entries added at a time in milliseconds
+func afterMillis(millis int64) string {
+	if millis <= 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%d-18446744073709551615", millis-1)
+}
+
+// run reads the stream until stopped, waiting before retrying once handling fails.
+func (consumer *consumer) run(client redis.UniversalClient, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		errPoll := consumer.poll(client)
+		if errPoll == nil {
+			continue
+		}
+		consumer.options.OnError(errPoll)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(consumer.options.Interval):
+		}
+	}
+}
+
+// poll claims entries abandoned by other consumers, then handles the entries
+// pending with this consumer, or waits for new entries if there are none.
+func (consumer *consumer) poll(client redis.UniversalClient) error {
+	errClaim := consumer.claim(client)
+	if errClaim != nil {
+		return errClaim
+	}
+
+	pending, errPending := consumer.read(client, "0", false)
+	if errPending != nil {
+		return errPending
+	}
+	if len(pending) > 0 {
+		return consumer.handle(client, pending)
+	}
+
+	fresh, errFresh := consumer.read(client, ">", true)
+	if errFresh != nil {
+		return errFresh
+	}
+	return consumer.handle(client, fresh)
+}
+
+// claim takes over the entries that have been pending with other consumers for
+// longer than ClaimAfter, so they are handled by this consumer's next poll. Each
+// poll claims the next window of up to BatchSize pending entries, continuing from
+// where the last poll left off, so that entries deep in the pending list are
+// reached even while earlier ones are still being handled.
+func (consumer *consumer) claim(client redis.UniversalClient) error {
+	if !consumer.legacy {
+		errClaim := consumer.autoClaim(client)
+		if errClaim == nil || !strings.HasPrefix(errClaim.Error(), "ERR unknown command") {
+			return errClaim
+		}
+
+		// Servers before Redis 6.2 don't have XAUTOCLAIM
+		consumer.legacy = true
+		consumer.claimFrom = "-"
+	}
+
+	return consumer.pendingClaim(client)
+}
+
+// autoClaim claims a window of idle entries with XAUTOCLAIM, which returns the
+// cursor the next window starts from ("0-0" once the end has been reached).
+func (consumer *consumer) autoClaim(client redis.UniversalClient) error {
+	idle := consumer.options.ClaimAfter.Nanoseconds() / int64(time.Millisecond)
+	cmd := redis.NewCmd("XAUTOCLAIM", consumer.stream, consumer.options.Group, consumer.options.Consumer, idle, consumer.claimFrom, "COUNT", consumer.options.BatchSize, "JUSTID")
+	errClaim := client.Process(cmd)
+	if errClaim != nil {
+		return errClaim
+	}
+
+	reply, _ := cmd.Val().([]interface{})
+	if len(reply) < 2 {
+		return fmt.Errorf("Unexpected XAUTOCLAIM reply: %v", cmd.Val())
+	}
+	next, ok := reply[0].(string)
+	if !ok {
+		return fmt.Errorf("Unexpected XAUTOCLAIM reply: %v", cmd.Val())
+	}
+	consumer.claimFrom = next
+	return nil
+}
+
+// pendingClaim claims a window of idle entries by paging through XPENDING, and
+// claiming those idle with other consumers.
+func (consumer *consumer) pendingClaim(client redis.UniversalClient) error {
+	cmd := redis.NewCmd("XPENDING", consumer.stream, consumer.options.Group, consumer.claimFrom, "+", consumer.options.BatchSize)
+	errPending := client.Process(cmd)
+	if errPending != nil {
+		return errPending
+	}
+
+	rows, _ := cmd.Val().([]interface{})
+	idle := consumer.options.ClaimAfter.Nanoseconds() / int64(time.Millisecond)
+	claim := []interface{}{"XCLAIM", consumer.stream, consumer.options.Group, consumer.options.Consumer, idle}
+	last := ""
+	for _, row := range rows {
+		fields, ok := row.([]interface{})
+		if !ok || len(fields) != 4 {
+			return fmt.Errorf("Unexpected XPENDING reply: %v", row)
+		}
+		last, _ = fields[0].(string)
+		elapsed, _ := fields[2].(int64)
+		if fields[1] != consumer.options.Consumer && elapsed >= idle {
+			claim = append(claim, fields[0])
+		}
+	}
+
+	// The next window starts after the last entry seen, or from the start once
+	// the end has been reached
+	consumer.claimFrom = "-"
+	if len(rows) == consumer.options.BatchSize {
+		next, errNext := nextID(last)
+		if errNext != nil {
+			return errNext
+		}
+		consumer.claimFrom = next
+	}
+	if len(claim) == 5 {
+		return nil
+	}
+
+	// Entries that have been claimed by another consumer meanwhile are skipped
+	return client.Process(redis.NewCmd(append(claim, "JUSTID")...))
+}
+
+// nextID gets the smallest stream entry ID after another
+func nextID(id string) (string, error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Unexpected stream entry ID: %v", id)
+	}
+	millis, errMillis := strconv.ParseUint(parts[0], 10, 64)
+	seq, errSeq := strconv.ParseUint(parts[1], 10, 64)
+	if errMillis != nil || errSeq != nil {
+		return "", fmt.Errorf("Unexpected stream entry ID: %v", id)
+	}
+
+	if seq == math.MaxUint64 {
+		return fmt.Sprintf("%d-0", millis+1), nil
+	}
+	return fmt.Sprintf("%d-%d", millis, seq+1), nil
+}
+
+// read reads a batch of entries as this consumer, either those already delivered
+// to it (from "0") or new entries (from ">"), optionally waiting for them.
+func (consumer *consumer) read(client redis.UniversalClient, from string, block bool) ([]streamEntry, error) {
+	args := []interface{}{"XREADGROUP", "GROUP", consumer.options.Group, consumer.options.Consumer, "COUNT", consumer.options.BatchSize}
+	if block {
+		args = append(args, "BLOCK", consumer.options.Block.Nanoseconds()/int64(time.Millisecond))
+	}
+	args = append(args, "STREAMS", consumer.stream, from)
+
+	cmd := redis.NewCmd(args...)
+	errRead := client.Process(cmd)
+	if errRead == redis.Nil {
+		return nil, nil
+	}
+	if errRead != nil {
+		return nil, errRead
+	}
+
+	streams, ok := cmd.Val().([]interface{})
+	if !ok || len(streams) != 1 {
+		return nil, fmt.Errorf("Unexpected XREADGROUP reply: %v", cmd.Val())
+	}
+	stream, ok := streams[0].([]interface{})
+	if !ok || len(stream) != 2 {
+		return nil, fmt.Errorf("Unexpected XREADGROUP stream: %v", streams[0])
+	}
+	return parseEntries(stream[1])
+}
+
+// handle dispatches a batch of entries in order, acknowledging each once it has
+// been handled, and stopping at the first that fails.
+func (consumer *consumer) handle(client redis.UniversalClient, entries []streamEntry) error {
+	for _, entry := range entries {
+		event, wanted, errDecode := consumer.decode(entry)
+		if errDecode != nil {
+			consumer.options.OnError(fmt.Errorf("redisstream: discarding entry %v: %v", entry.id, errDecode))
+		}
+
+		if wanted {
+			errDispatch := consumer.handlers.Dispatch(event)
+			if errDispatch != nil {
+				return errDispatch
+			}
+		}
+
+		errAck := client.Process(redis.NewCmd("XACK", consumer.stream, consumer.options.Group, entry.id))
+		if errAck != nil {
+			return errAck
+		}
+	}
+
+	return nil
+}
+
+// decode reads a published event from an entry. The payload is only decoded if a
+// handler subscribes to the event type, and false is returned otherwise.
+func (consumer *consumer) decode(entry streamEntry) (eventsourcing.PublishedEvent, bool, error) {
+	// Entries trimmed from the stream while pending have nothing to handle
+	if entry.fields == nil {
+		return eventsourcing.PublishedEvent{}, false, nil
+	}
+
+	value, found := entry.fields[eventField]
+	if !found {
+		return eventsourcing.PublishedEvent{}, false, fmt.Errorf("no %v field", eventField)
+	}
+
+	return consumer.handlers.Decode([]byte(value))
+}
+
+// parseEntries converts a raw list of stream entries, as returned by XRANGE or
+// XREADGROUP.
+func parseEntries(raw interface{}) ([]streamEntry, error) {
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected stream entries: %v", raw)
+	}
+
+	entries := make([]streamEntry, len(items))
+	for index, item := range items {
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("Unexpected stream entry: %v", item)
+		}
+
+		id, ok := pair[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected stream entry ID: %v", pair[0])
+		}
+		entries[index].id = id
+
+		// Deleted entries have no fields
+		if pair[1] == nil {
+			continue
+		}
+		values, ok := pair[1].([]interface{})
+		if !ok || len(values)%2 != 0 {
+			return nil, fmt.Errorf("Unexpected stream entry fields: %v", pair[1])
+		}
+
+		entries[index].fields = make(map[string]string)
+		for field := 0; field < len(values); field += 2 {
+			entries[index].fields[fmt.Sprintf("%v", values[field])] = fmt.Sprintf("%v", values[field+1])
+		}
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,100 @@
+/*
+Package redisstream distributes events through a Redis stream, with a publisher
+appending each event to the stream (XADD) and consumers reading it as members of
+a consumer group (XREADGROUP). Entries are acknowledged once every handler that
+subscribes to them succeeds, and entries left pending by consumers that have
+gone away are claimed by the rest of the group. This suits small deployments
+that already run Redis (i.e. for snapshots) and don't want to operate Kafka.
+*/
+package redisstream
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-redis/redis"
+)
+
+// eventField is the stream entry field holding the published event
+const eventField = "event"
+
+// Endpoint identifies the Redis server and the stream that events are
+// distributed through.
+type Endpoint struct {
+	Address string `json:"address"` // Address of the Redis server
+	Stream  string `json:"stream"`  // Name of the stream
+}
+
+// publisher is a structure implementing EventPublisher and appending events to
+// a Redis stream.
+type publisher struct {
+	client    redis.UniversalClient       // Redis connection
+	stream    string                      // Stream to publish to
+	maxLength int64                       // Approximate number of entries to retain, 0 for all
+	registry  eventsourcing.EventRegistry // Registry
+}
+
+// CreatePublisher creates a new publisher appending events to a stream. Once the
+// stream holds more than maxLength entries the oldest are trimmed (approximately,
+// so trimming stays cheap), while a maxLength of 0 retains every entry.
+func CreatePublisher(endpoint Endpoint, maxLength int64, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr: endpoint.Address,
+	})
+
+	return CreatePublisherWithClient(client, endpoint.Stream, maxLength, registry)
+}
+
+// CreatePublisherWithClient creates a publisher with a client that's already been
+// established (BYO-instance)
+func CreatePublisherWithClient(client redis.UniversalClient, stream string, maxLength int64, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	if stream == "" {
+		return nil, fmt.Errorf("redisstream: a stream name is required")
+	}
+
+	return &publisher{
+		client:    client,
+		stream:    stream,
+		maxLength: maxLength,
+		registry:  registry,
+	}, nil
+}
+
+// Publish an event. When the method returns the event should be committed/guaranteed
+// to have been distributed.
+func (pub *publisher) Publish(key string, sequence int64, event eventsourcing.Event) error {
+	eventType, found := pub.registry.GetEventType(event)
+	if !found {
+		return fmt.Errorf("Could not find event type: %v", event)
+	}
+
+	toPublish := eventsourcing.PublishedEvent{
+		Domain:   pub.registry.Domain(),
+		Type:     eventType,
+		Key:      key,
+		Sequence: sequence,
+		Data:     event,
+	}
+
+	buff, errBuff := json.Marshal(&toPublish)
+	if errBuff != nil {
+		return errBuff
+	}
+
+	// The go-redis v6 client does not have native stream support, so the command is
+	// issued directly.
+	args := []interface{}{"XADD", pub.stream}
+	if pub.maxLength > 0 {
+		args = append(args, "MAXLEN", "~", pub.maxLength)
+	}
+	args = append(args, "*", eventField, string(buff))
+
+	return pub.client.Process(redis.NewCmd(args...))
+}
+
+// OrderingGuarantee reports that events are ordered globally, since every event
+// is appended to a single stream.
+func (pub *publisher) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return eventsourcing.OrderingGlobal
+}
@@ -0,0 +1,175 @@
+package redisstream
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/go-redis/redis"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testEndpoint gets a fresh stream on the test server
+func testEndpoint() Endpoint {
+	address := os.Getenv("REDIS_TEST_HOST")
+	if address == "" {
+		address = "localhost:6379"
+	}
+
+	return Endpoint{
+		Address: address,
+		Stream:  fmt.Sprintf("test-%s", uuid.NewV4()),
+	}
+}
+
+// consume starts a consumer with a recording handler
+func consume(t *testing.T, endpoint Endpoint, options Options, handler *test.RecordingHandler) eventsourcing.EventConsumer {
+	options.Block = 100 * time.Millisecond
+	options.Interval = 10 * time.Millisecond
+	options.OnError = func(error) {}
+	consumer, errCreate := CreateConsumer(endpoint, options)
+	require.Nil(t, errCreate)
+
+	consumer.AddHandler(handler)
+	assert.Nil(t, consumer.Start())
+	return consumer
+}
+
+// TestPublishConsume checks events are delivered in order, and failures retried
+// before later entries
+func TestPublishConsume(t *testing.T) {
+	endpoint := testEndpoint()
+	pub, errPub := CreatePublisher(endpoint, 0, test.GetTestRegistry())
+	require.Nil(t, errPub)
+	assert.Equal(t, eventsourcing.OrderingGlobal, eventsourcing.OrderingOf(pub))
+	test.PublishIncrements(t, pub, "a", 1, 3)
+
+	handler := test.CreateRecordingHandler(true)
+	consumer := consume(t, endpoint, Options{Group: "g", Consumer: "one"}, handler)
+	defer consumer.Stop()
+	assert.Equal(t, eventsourcing.OrderingUnordered, eventsourcing.OrderingOf(consumer))
+
+	test.PublishIncrements(t, pub, "a", 4, 2)
+	assert.True(t, test.WaitFor(func() bool { return handler.Count() == 5 }))
+	assert.Nil(t, consumer.Stop())
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, handler.Seen())
+	assert.Equal(t, 1, handler.Fails())
+
+	// Everything has been acknowledged, so restarting resumes from the checkpoint
+	client := redis.NewClient(&redis.Options{Addr: endpoint.Address})
+	defer client.Close()
+	pending := redis.NewCmd("XPENDING", endpoint.Stream, "g")
+	assert.Nil(t, client.Process(pending))
+	assert.Equal(t, int64(0), pending.Val().([]interface{})[0])
+
+	resumed := test.CreateRecordingHandler(false)
+	consumer = consume(t, endpoint, Options{Group: "g", Consumer: "one"}, resumed)
+	defer consumer.Stop()
+	test.PublishIncrements(t, pub, "a", 6, 1)
+	assert.True(t, test.WaitFor(func() bool { return resumed.Count() == 1 }))
+	assert.Equal(t, []int64{6}, resumed.Seen())
+}
+
+// TestClaimAbandoned checks entries left pending by a consumer that went away are
+// claimed by the rest of the group
+func TestClaimAbandoned(t *testing.T) {
+	endpoint := testEndpoint()
+	pub, errPub := CreatePublisher(endpoint, 0, test.GetTestRegistry())
+	require.Nil(t, errPub)
+
+	// A consumer reads two entries, and never acknowledges them
+	client := redis.NewClient(&redis.Options{Addr: endpoint.Address})
+	defer client.Close()
+	assert.Nil(t, client.Process(redis.NewCmd("XGROUP", "CREATE", endpoint.Stream, "g", "0", "MKSTREAM")))
+	test.PublishIncrements(t, pub, "a", 1, 2)
+	assert.Nil(t, client.Process(redis.NewCmd("XREADGROUP", "GROUP", "g", "gone", "STREAMS", endpoint.Stream, ">")))
+	test.PublishIncrements(t, pub, "a", 3, 1)
+
+	handler := test.CreateRecordingHandler(false)
+	consumer := consume(t, endpoint, Options{Group: "g", Consumer: "two", ClaimAfter: 200 * time.Millisecond}, handler)
+	defer consumer.Stop()
+	assert.True(t, test.WaitFor(func() bool { return handler.Count() == 3 }))
+	assert.Equal(t, []int64{3, 1, 2}, handler.Seen())
+}
+
+// TestClaimBeyondFirstWindow checks abandoned entries are claimed however far down
+// the pending list they are, with and without XAUTOCLAIM
+func TestClaimBeyondFirstWindow(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		endpoint := testEndpoint()
+		pub, errPub := CreatePublisher(endpoint, 0, test.GetTestRegistry())
+		require.Nil(t, errPub)
+
+		// This consumer holds the first window of the pending list, and a consumer
+		// that went away holds the rest
+		client := redis.NewClient(&redis.Options{Addr: endpoint.Address})
+		defer client.Close()
+		assert.Nil(t, client.Process(redis.NewCmd("XGROUP", "CREATE", endpoint.Stream, "g", "0", "MKSTREAM")))
+		test.PublishIncrements(t, pub, "a", 1, 5)
+		assert.Nil(t, client.Process(redis.NewCmd("XREADGROUP", "GROUP", "g", "two", "COUNT", 2, "STREAMS", endpoint.Stream, ">")))
+		assert.Nil(t, client.Process(redis.NewCmd("XREADGROUP", "GROUP", "g", "gone", "STREAMS", endpoint.Stream, ">")))
+		time.Sleep(20 * time.Millisecond)
+
+		created, errCreate := CreateConsumerWithClient(client, endpoint.Stream, Options{
+			Group:      "g",
+			Consumer:   "two",
+			BatchSize:  2,
+			ClaimAfter: 10 * time.Millisecond,
+		})
+		require.Nil(t, errCreate)
+		claiming := created.(*consumer)
+		claiming.legacy = legacy
+		claiming.claimFrom = "0-0"
+		if legacy {
+			claiming.claimFrom = "-"
+		}
+		for window := 0; window < 3; window++ {
+			assert.Nil(t, claiming.claim(client))
+		}
+
+		summary := redis.NewCmd("XPENDING", endpoint.Stream, "g")
+		assert.Nil(t, client.Process(summary))
+		owners := summary.Val().([]interface{})[3].([]interface{})
+		assert.Len(t, owners, 1, "legacy: %v", legacy)
+		assert.Equal(t, []interface{}{"two", "5"}, owners[0], "legacy: %v", legacy)
+	}
+
+	next, errNext := nextID("1234-5")
+	assert.Nil(t, errNext)
+	assert.Equal(t, "1234-6", next)
+	next, _ = nextID("1234-18446744073709551615")
+	assert.Equal(t, "1235-0", next)
+	_, errNext = nextID("1234")
+	assert.NotNil(t, errNext)
+}
+
+// TestStartModes checks groups can be moved to the start of the stream, or past
+// everything published so far
+func TestStartModes(t *testing.T) {
+	endpoint := testEndpoint()
+	pub, errPub := CreatePublisher(endpoint, 0, test.GetTestRegistry())
+	require.Nil(t, errPub)
+	test.PublishIncrements(t, pub, "a", 1, 2)
+
+	latest := test.CreateRecordingHandler(false)
+	consumer := consume(t, endpoint, Options{Group: "g", Consumer: "one", Start: eventsourcing.FromLatest()}, latest)
+	test.PublishIncrements(t, pub, "a", 3, 1)
+	assert.True(t, test.WaitFor(func() bool { return latest.Count() == 1 }))
+	assert.Nil(t, consumer.Stop())
+	assert.Equal(t, []int64{3}, latest.Seen())
+
+	replay := test.CreateRecordingHandler(false)
+	consumer = consume(t, endpoint, Options{Group: "g", Consumer: "one", Start: eventsourcing.FromBeginning()}, replay)
+	defer consumer.Stop()
+	assert.True(t, test.WaitFor(func() bool { return replay.Count() == 3 }))
+	assert.Equal(t, []int64{1, 2, 3}, replay.Seen())
+
+	_, errCreate := CreateConsumer(endpoint, Options{Group: "g"})
+	assert.NotNil(t, errCreate)
+	assert.Equal(t, "1234-18446744073709551615", afterMillis(1235))
+}
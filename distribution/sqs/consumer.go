@@ -0,0 +1,254 @@
+package sqs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/distribution"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxBatchSize is the most messages SQS returns from a receive.
+	MaxBatchSize = 10
+
+	// DefaultWaitTime is how long a receive waits for new messages, which is the
+	// longest SQS allows.
+	DefaultWaitTime = 20 * time.Second
+
+	// DefaultInterval is the time waited before retrying, once handling fails.
+	DefaultInterval = time.Second
+)
+
+// Options contains the options for consuming a queue.
+type Options struct {
+	BatchSize         int           // Messages received at a time, at most (and by default) MaxBatchSize
+	WaitTime          time.Duration // Wait for new messages, DefaultWaitTime by default
+	VisibilityTimeout time.Duration // Time received messages are hidden from other consumers, the queue's by default
+	Interval          time.Duration // Wait before retrying once handling fails, DefaultInterval by default
+	OnError           func(error)   // Called when receiving or handling fails, logs by default
+}
+
+// consumer long-polls an SQS queue.
+type consumer struct {
+	client   QueueAPI              // SQS client
+	queueURL string                // Queue to read
+	fifo     bool                  // Whether the queue is FIFO
+	options  Options               // Options
+	handlers distribution.Handlers // Event handlers, and the event types each receives
+	lock     sync.Mutex            // Guards the loop state
+	stop     context.CancelFunc    // Stops the receive loop
+	done     chan struct{}         // Closed once the receive loop exits
+}
+
+// CreateConsumer creates a consumer of an SQS queue.
+//
+// The queue keeps the consumer's position, so there are no start modes: a queue
+// subscribed to a topic holds the events published since it was subscribed, and
+// every consumer of the queue shares them. Messages may hold the event itself, or
+// the SNS notification carrying it when raw message delivery is off.
+//
+// Messages are deleted once every handler that subscribes to them succeeds. When a
+// message fails, it and the rest of its batch are made visible again to be
+// redelivered, while messages whose event can't be decoded are reported and
+// deleted so they aren't delivered again.
+func CreateConsumer(config aws.Config, queueURL string, options Options) (eventsourcing.EventConsumer, error) {
+	return CreateConsumerWithClient(awssqs.NewFromConfig(config), queueURL, options)
+}
+
+// CreateConsumerWithClient creates a consumer of an SQS queue with a client that's
+// already been created (BYO-instance).
+func CreateConsumerWithClient(client QueueAPI, queueURL string, options Options) (eventsourcing.EventConsumer, error) {
+	if queueURL == "" {
+		return nil, fmt.Errorf("sqs: a queue URL is required")
+	}
+
+	if options.BatchSize <= 0 || options.BatchSize > MaxBatchSize {
+		options.BatchSize = MaxBatchSize
+	}
+	if options.WaitTime <= 0 {
+		options.WaitTime = DefaultWaitTime
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
+	if options.OnError == nil {
+		options.OnError = func(err error) {
+			logrus.WithError(err).Error("sqs_consumer_error")
+		}
+	}
+
+	return &consumer{
+		client:   client,
+		queueURL: queueURL,
+		fifo:     isFIFO(queueURL),
+		options:  options,
+	}, nil
+}
+
+// AddHandler appends a new handler to the set of handlers for this consumer. The
+// handler's subscriptions are read when it is added, so it must be initialized.
+func (consumer *consumer) AddHandler(handler eventsourcing.EventHandler) {
+	consumer.handlers.Add(handler)
+}
+
+// Start handling the events from the consumer
+func (consumer *consumer) Start() error {
+	consumer.lock.Lock()
+	defer consumer.lock.Unlock()
+	if consumer.stop != nil {
+		return nil
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	consumer.stop = stop
+	consumer.done = make(chan struct{})
+	go consumer.run(ctx, consumer.done)
+	return nil
+}
+
+// Stop handling events from the consumer, abandoning the receive in progress and
+// waiting for the batch being handled to finish.
+func (consumer *consumer) Stop() error {
+	consumer.lock.Lock()
+	stop, done := consumer.stop, consumer.done
+	consumer.stop, consumer.done = nil, nil
+	consumer.lock.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+
+	stop()
+	<-done
+	return nil
+}
+
+// OrderingGuarantee reports that events are ordered per key on FIFO queues, since
+// each aggregate is a message group, and a group isn't delivered past a message
+// that's still being handled. Standard queues deliver in any order.
+func (consumer *consumer) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	if consumer.fifo {
+		return eventsourcing.OrderingPerKey
+	}
+	return eventsourcing.OrderingUnordered
+}
+
+// run receives from the queue until stopped, waiting before retrying once handling
+// fails.
+func (consumer *consumer) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	for ctx.Err() == nil {
+		errPoll := consumer.poll(ctx)
+		if errPoll == nil {
+			continue
+		}
+		consumer.options.OnError(errPoll)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(consumer.options.Interval):
+		}
+	}
+}
+
+// poll receives a batch of messages, waiting for them if there are none, and
+// handles them.
+func (consumer *consumer) poll(ctx context.Context) error {
+	output, errReceive := consumer.client.ReceiveMessage(ctx, &awssqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(consumer.queueURL),
+		MaxNumberOfMessages: int32(consumer.options.BatchSize),
+		WaitTimeSeconds:     int32(consumer.options.WaitTime / time.Second),
+		VisibilityTimeout:   int32(consumer.options.VisibilityTimeout / time.Second),
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	if errReceive != nil {
+		return errReceive
+	}
+
+	return consumer.handle(output.Messages)
+}
+
+// handle dispatches a batch of messages in order, deleting each once it has been
+// handled. Once a message fails it and the rest of the batch are handed back to be
+// redelivered.
+func (consumer *consumer) handle(msgs []sqstypes.Message) error {
+	for index, msg := range msgs {
+		event, wanted, errDecode := consumer.handlers.Decode(unwrap(aws.ToString(msg.Body)))
+		if errDecode != nil {
+			consumer.options.OnError(fmt.Errorf("sqs: discarding message %v: %v", aws.ToString(msg.MessageId), errDecode))
+			errDelete := consumer.delete(msg)
+			if errDelete != nil {
+				return errDelete
+			}
+			continue
+		}
+
+		if wanted {
+			errDispatch := consumer.handlers.Dispatch(event)
+			if errDispatch != nil {
+				for _, rest := range msgs[index:] {
+					consumer.release(rest)
+				}
+				return errDispatch
+			}
+		}
+
+		errDelete := consumer.delete(msg)
+		if errDelete != nil {
+			return errDelete
+		}
+	}
+
+	return nil
+}
+
+// delete removes a handled message from the queue
+func (consumer *consumer) delete(msg sqstypes.Message) error {
+	_, errDelete := consumer.client.DeleteMessage(context.Background(), &awssqs.DeleteMessageInput{
+		QueueUrl:      aws.String(consumer.queueURL),
+		ReceiptHandle: msg.ReceiptHandle,
+	})
+	return errDelete
+}
+
+// release makes a message visible again, so it's redelivered without waiting for
+// its visibility timeout. Failures are ignored, since the message is redelivered
+// once the timeout passes anyway.
+func (consumer *consumer) release(msg sqstypes.Message) {
+	consumer.client.ChangeMessageVisibility(context.Background(), &awssqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(consumer.queueURL),
+		ReceiptHandle:     msg.ReceiptHandle,
+		VisibilityTimeout: 0,
+	})
+}
+
+// notification is the envelope SNS wraps messages in when delivering them to a
+// queue without raw message delivery
+type notification struct {
+	Type     string `json:"Type"`
+	TopicArn string `json:"TopicArn"`
+	Message  string `json:"Message"`
+}
+
+// unwrap gets the published event from a message body, taking it out of its SNS
+// notification if it has one.
+func unwrap(body string) []byte {
+	envelope := notification{}
+	errUnmarshal := json.Unmarshal([]byte(body), &envelope)
+	if errUnmarshal == nil && envelope.Type == "Notification" && envelope.TopicArn != "" {
+		return []byte(envelope.Message)
+	}
+	return []byte(body)
+}
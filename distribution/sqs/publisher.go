@@ -0,0 +1,251 @@
+/*
+Package sqs distributes events through AWS, with publishers sending each event to
+an SNS topic or straight to an SQS queue, and consumers long-polling an SQS queue
+(subscribed to the topic, when publishing through SNS). Messages are deleted once
+every handler that subscribes to them succeeds, and are otherwise left for the
+queue to deliver again, so a redrive policy on the queue moves events that keep
+failing to its dead-letter queue.
+
+Topics and queues whose names end in .fifo are FIFO. Events sent to them carry the
+aggregate key as their message group, so the events of each aggregate are
+delivered in order, and a de-duplication ID made from the key and sequence, so an
+event published twice within the de-duplication window is only delivered once.
+
+The domain and type of each event are sent as the domain and event_type message
+attributes, so that SNS subscriptions can filter on them. Clients are created from
+an aws.Config, whose BaseEndpoint can point them at LocalStack or ElasticMQ.
+*/
+package sqs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssns "github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/go-gadgets/eventsourcing"
+)
+
+const (
+	// DomainAttribute is the message attribute holding the domain of an event.
+	DomainAttribute = "domain"
+
+	// TypeAttribute is the message attribute holding the type of an event.
+	TypeAttribute = "event_type"
+)
+
+// TopicAPI is the part of the SNS client that publishers use, which is
+// implemented by *sns.Client.
+type TopicAPI interface {
+	Publish(ctx context.Context, params *awssns.PublishInput, optFns ...func(*awssns.Options)) (*awssns.PublishOutput, error)
+}
+
+// QueueAPI is the part of the SQS client that publishers and consumers use, which
+// is implemented by *sqs.Client.
+type QueueAPI interface {
+	SendMessage(ctx context.Context, params *awssqs.SendMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.SendMessageOutput, error)
+	ReceiveMessage(ctx context.Context, params *awssqs.ReceiveMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *awssqs.DeleteMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.DeleteMessageOutput, error)
+	ChangeMessageVisibility(ctx context.Context, params *awssqs.ChangeMessageVisibilityInput, optFns ...func(*awssqs.Options)) (*awssqs.ChangeMessageVisibilityOutput, error)
+}
+
+// message is an event encoded to be sent to a topic or queue
+type message struct {
+	body            string            // JSON of the published event
+	attributes      map[string]string // Message attributes
+	groupID         *string           // Message group, for FIFO topics and queues
+	deduplicationID *string           // De-duplication ID, for FIFO topics and queues
+}
+
+// encoder encodes the events of a registry into messages
+type encoder struct {
+	registry eventsourcing.EventRegistry // Registry
+	fifo     bool                        // Whether the destination is FIFO
+}
+
+// encode builds the message an event is sent as
+func (enc encoder) encode(key string, sequence int64, event eventsourcing.Event) (message, error) {
+	eventType, found := enc.registry.GetEventType(event)
+	if !found {
+		return message{}, fmt.Errorf("Could not find event type: %v", event)
+	}
+
+	toPublish := eventsourcing.PublishedEvent{
+		Domain:   enc.registry.Domain(),
+		Type:     eventType,
+		Key:      key,
+		Sequence: sequence,
+		Data:     event,
+	}
+
+	buff, errBuff := json.Marshal(&toPublish)
+	if errBuff != nil {
+		return message{}, errBuff
+	}
+
+	// Attributes can't be empty, so an empty domain is left out
+	result := message{
+		body: string(buff),
+		attributes: map[string]string{
+			TypeAttribute: string(eventType),
+		},
+	}
+	if toPublish.Domain != "" {
+		result.attributes[DomainAttribute] = toPublish.Domain
+	}
+	if enc.fifo {
+		result.groupID = aws.String(key)
+		result.deduplicationID = aws.String(messageID(toPublish))
+	}
+	return result, nil
+}
+
+// orderingGuarantee reports that events are ordered per key when sent to a FIFO
+// topic or queue, since each aggregate is a message group. Otherwise messages may
+// be delivered in any order.
+func (enc encoder) orderingGuarantee() eventsourcing.OrderingGuarantee {
+	if enc.fifo {
+		return eventsourcing.OrderingPerKey
+	}
+	return eventsourcing.OrderingUnordered
+}
+
+// topicPublisher is a structure implementing EventPublisher and sending events to
+// an SNS topic.
+type topicPublisher struct {
+	encoder
+	client   TopicAPI // SNS client
+	topicARN string   // Topic to publish to
+}
+
+// CreatePublisher creates a new publisher sending events to an SNS topic.
+func CreatePublisher(config aws.Config, topicARN string, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	return CreatePublisherWithClient(awssns.NewFromConfig(config), topicARN, registry)
+}
+
+// CreatePublisherWithClient creates a publisher sending events to an SNS topic with
+// a client that's already been created (BYO-instance).
+func CreatePublisherWithClient(client TopicAPI, topicARN string, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	if topicARN == "" {
+		return nil, fmt.Errorf("sqs: a topic ARN is required")
+	}
+
+	return &topicPublisher{
+		encoder: encoder{
+			registry: registry,
+			fifo:     isFIFO(topicARN),
+		},
+		client:   client,
+		topicARN: topicARN,
+	}, nil
+}
+
+// Publish an event. When the method returns the event should be committed/guaranteed
+// to have been distributed.
+func (pub *topicPublisher) Publish(key string, sequence int64, event eventsourcing.Event) error {
+	msg, errEncode := pub.encode(key, sequence, event)
+	if errEncode != nil {
+		return errEncode
+	}
+
+	attributes := make(map[string]snstypes.MessageAttributeValue, len(msg.attributes))
+	for name, value := range msg.attributes {
+		attributes[name] = snstypes.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+
+	_, errPublish := pub.client.Publish(context.Background(), &awssns.PublishInput{
+		TopicArn:               aws.String(pub.topicARN),
+		Message:                aws.String(msg.body),
+		MessageAttributes:      attributes,
+		MessageGroupId:         msg.groupID,
+		MessageDeduplicationId: msg.deduplicationID,
+	})
+	return errPublish
+}
+
+// OrderingGuarantee reports that events are ordered per key on FIFO topics, and
+// unordered otherwise.
+func (pub *topicPublisher) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return pub.orderingGuarantee()
+}
+
+// queuePublisher is a structure implementing EventPublisher and sending events
+// straight to an SQS queue.
+type queuePublisher struct {
+	encoder
+	client   QueueAPI // SQS client
+	queueURL string   // Queue to send to
+}
+
+// CreateQueuePublisher creates a new publisher sending events straight to an SQS
+// queue, for deployments with a single consuming service.
+func CreateQueuePublisher(config aws.Config, queueURL string, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	return CreateQueuePublisherWithClient(awssqs.NewFromConfig(config), queueURL, registry)
+}
+
+// CreateQueuePublisherWithClient creates a publisher sending events to an SQS queue
+// with a client that's already been created (BYO-instance).
+func CreateQueuePublisherWithClient(client QueueAPI, queueURL string, registry eventsourcing.EventRegistry) (eventsourcing.EventPublisher, error) {
+	if queueURL == "" {
+		return nil, fmt.Errorf("sqs: a queue URL is required")
+	}
+
+	return &queuePublisher{
+		encoder: encoder{
+			registry: registry,
+			fifo:     isFIFO(queueURL),
+		},
+		client:   client,
+		queueURL: queueURL,
+	}, nil
+}
+
+// Publish an event. When the method returns the event should be committed/guaranteed
+// to have been distributed.
+func (pub *queuePublisher) Publish(key string, sequence int64, event eventsourcing.Event) error {
+	msg, errEncode := pub.encode(key, sequence, event)
+	if errEncode != nil {
+		return errEncode
+	}
+
+	attributes := make(map[string]sqstypes.MessageAttributeValue, len(msg.attributes))
+	for name, value := range msg.attributes {
+		attributes[name] = sqstypes.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+
+	_, errSend := pub.client.SendMessage(context.Background(), &awssqs.SendMessageInput{
+		QueueUrl:               aws.String(pub.queueURL),
+		MessageBody:            aws.String(msg.body),
+		MessageAttributes:      attributes,
+		MessageGroupId:         msg.groupID,
+		MessageDeduplicationId: msg.deduplicationID,
+	})
+	return errSend
+}
+
+// OrderingGuarantee reports that events are ordered per key on FIFO queues, and
+// unordered otherwise.
+func (pub *queuePublisher) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return pub.orderingGuarantee()
+}
+
+// isFIFO checks whether a topic ARN or queue URL names a FIFO topic or queue
+func isFIFO(name string) bool {
+	return strings.HasSuffix(name, ".fifo")
+}
+
+// messageID gets the ID a FIFO topic or queue de-duplicates an event by
+func messageID(event eventsourcing.PublishedEvent) string {
+	return fmt.Sprintf("%s/%s/%d", event.Domain, event.Key, event.Sequence)
+}
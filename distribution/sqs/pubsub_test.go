@@ -0,0 +1,257 @@
+package sqs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssns "github.com/aws/aws-sdk-go-v2/service/sns"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// queued is a message held by a fake queue
+type queued struct {
+	sqstypes.Message
+	group    string // Message group, for FIFO queues
+	inFlight bool   // Whether the message has been received and not released
+}
+
+// fakeQueue is an in-memory queue that behaves like SQS, delivering the messages of
+// a FIFO queue's groups one batch at a time, in order.
+type fakeQueue struct {
+	lock     sync.Mutex
+	fifo     bool
+	messages []*queued
+	sent     []*awssqs.SendMessageInput
+	dedup    map[string]bool
+	counter  int
+}
+
+// newFakeQueue creates a fake queue
+func newFakeQueue(fifo bool) *fakeQueue {
+	return &fakeQueue{
+		fifo:  fifo,
+		dedup: make(map[string]bool),
+	}
+}
+
+// push adds a message to the queue
+func (queue *fakeQueue) push(body string, group *string, deduplicationID *string) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if deduplicationID != nil {
+		if queue.dedup[*deduplicationID] {
+			return
+		}
+		queue.dedup[*deduplicationID] = true
+	}
+
+	queue.counter++
+	queue.messages = append(queue.messages, &queued{
+		Message: sqstypes.Message{
+			MessageId:     aws.String(fmt.Sprintf("m-%d", queue.counter)),
+			ReceiptHandle: aws.String(fmt.Sprintf("r-%d", queue.counter)),
+			Body:          aws.String(body),
+		},
+		group: aws.ToString(group),
+	})
+}
+
+// SendMessage adds a message to the queue
+func (queue *fakeQueue) SendMessage(ctx context.Context, params *awssqs.SendMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.SendMessageOutput, error) {
+	queue.lock.Lock()
+	queue.sent = append(queue.sent, params)
+	queue.lock.Unlock()
+
+	queue.push(aws.ToString(params.MessageBody), params.MessageGroupId, params.MessageDeduplicationId)
+	return &awssqs.SendMessageOutput{}, nil
+}
+
+// ReceiveMessage gets the visible messages, skipping those of FIFO groups that have
+// a message in flight, or waits for the context to end if there are none.
+func (queue *fakeQueue) ReceiveMessage(ctx context.Context, params *awssqs.ReceiveMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.ReceiveMessageOutput, error) {
+	queue.lock.Lock()
+	blocked := make(map[string]bool)
+	received := []sqstypes.Message{}
+	for _, msg := range queue.messages {
+		if queue.fifo && blocked[msg.group] {
+			continue
+		}
+		if msg.inFlight {
+			blocked[msg.group] = true
+			continue
+		}
+		if len(received) < int(params.MaxNumberOfMessages) {
+			msg.inFlight = true
+			received = append(received, msg.Message)
+		}
+	}
+	queue.lock.Unlock()
+
+	if len(received) == 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return &awssqs.ReceiveMessageOutput{Messages: received}, nil
+}
+
+// DeleteMessage removes a message from the queue
+func (queue *fakeQueue) DeleteMessage(ctx context.Context, params *awssqs.DeleteMessageInput, optFns ...func(*awssqs.Options)) (*awssqs.DeleteMessageOutput, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for index, msg := range queue.messages {
+		if aws.ToString(msg.ReceiptHandle) == aws.ToString(params.ReceiptHandle) {
+			queue.messages = append(queue.messages[:index], queue.messages[index+1:]...)
+			return &awssqs.DeleteMessageOutput{}, nil
+		}
+	}
+	return nil, errors.New("unknown receipt handle")
+}
+
+// ChangeMessageVisibility makes a message visible again
+func (queue *fakeQueue) ChangeMessageVisibility(ctx context.Context, params *awssqs.ChangeMessageVisibilityInput, optFns ...func(*awssqs.Options)) (*awssqs.ChangeMessageVisibilityOutput, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for _, msg := range queue.messages {
+		if aws.ToString(msg.ReceiptHandle) == aws.ToString(params.ReceiptHandle) {
+			msg.inFlight = params.VisibilityTimeout > 0
+		}
+	}
+	return &awssqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+// Len gets the number of messages in the queue
+func (queue *fakeQueue) Len() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return len(queue.messages)
+}
+
+// fakeTopic is a topic delivering notifications to a queue, as SNS does without raw
+// message delivery.
+type fakeTopic struct {
+	arn       string
+	queue     *fakeQueue
+	published []*awssns.PublishInput
+}
+
+// Publish delivers a notification to the subscribed queue
+func (topic *fakeTopic) Publish(ctx context.Context, params *awssns.PublishInput, optFns ...func(*awssns.Options)) (*awssns.PublishOutput, error) {
+	topic.published = append(topic.published, params)
+	body, _ := json.Marshal(notification{
+		Type:     "Notification",
+		TopicArn: topic.arn,
+		Message:  aws.ToString(params.Message),
+	})
+	topic.queue.push(string(body), params.MessageGroupId, params.MessageDeduplicationId)
+	return &awssns.PublishOutput{}, nil
+}
+
+// consume starts a consumer with a recording handler
+func consume(t *testing.T, queue *fakeQueue, queueURL string, handler *test.RecordingHandler, onError func(error)) eventsourcing.EventConsumer {
+	consumer, errCreate := CreateConsumerWithClient(queue, queueURL, Options{
+		BatchSize: 3,
+		Interval:  10 * time.Millisecond,
+		OnError:   onError,
+	})
+	require.Nil(t, errCreate)
+
+	consumer.AddHandler(handler)
+	assert.Nil(t, consumer.Start())
+	return consumer
+}
+
+// TestPublishConsume checks events published to a FIFO topic are delivered from its
+// queue in order, with failures retried before later messages
+func TestPublishConsume(t *testing.T) {
+	queue := newFakeQueue(true)
+	topic := &fakeTopic{arn: "arn:aws:sns:eu-west-1:123456789012:events.fifo", queue: queue}
+	pub, errPub := CreatePublisherWithClient(topic, topic.arn, test.GetTestRegistry())
+	require.Nil(t, errPub)
+	assert.Equal(t, eventsourcing.OrderingPerKey, eventsourcing.OrderingOf(pub))
+	test.PublishIncrements(t, pub, "a", 1, 3)
+
+	// Publishing an event again is de-duplicated by the topic
+	test.PublishIncrements(t, pub, "a", 3, 1)
+
+	published := topic.published[0]
+	assert.Equal(t, "a", aws.ToString(published.MessageGroupId))
+	assert.Equal(t, "Testing/a/1", aws.ToString(published.MessageDeduplicationId))
+	assert.Equal(t, "IncrementEvent", aws.ToString(published.MessageAttributes[TypeAttribute].StringValue))
+	assert.Equal(t, "Testing", aws.ToString(published.MessageAttributes[DomainAttribute].StringValue))
+
+	handler := test.CreateRecordingHandler(true)
+	consumer := consume(t, queue, "https://sqs.eu-west-1.amazonaws.com/123456789012/events.fifo", handler, func(error) {})
+	defer consumer.Stop()
+	assert.Equal(t, eventsourcing.OrderingPerKey, eventsourcing.OrderingOf(consumer))
+
+	test.PublishIncrements(t, pub, "a", 4, 2)
+	assert.True(t, test.WaitFor(func() bool { return handler.Count() == 5 }))
+	assert.Nil(t, consumer.Stop())
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, handler.Seen())
+	assert.Equal(t, 1, handler.Fails())
+	assert.Equal(t, 0, queue.Len())
+}
+
+// TestQueuePublisher checks events can be sent straight to a standard queue, and
+// that messages that can't be decoded are discarded
+func TestQueuePublisher(t *testing.T) {
+	queue := newFakeQueue(false)
+	pub, errPub := CreateQueuePublisherWithClient(queue, "https://sqs.eu-west-1.amazonaws.com/123456789012/events", test.GetTestRegistry())
+	require.Nil(t, errPub)
+	assert.Equal(t, eventsourcing.OrderingUnordered, eventsourcing.OrderingOf(pub))
+	test.PublishIncrements(t, pub, "a", 1, 2)
+	queue.push("not json", nil, nil)
+
+	sent := queue.sent[0]
+	assert.Nil(t, sent.MessageGroupId)
+	assert.Nil(t, sent.MessageDeduplicationId)
+	assert.Equal(t, "IncrementEvent", aws.ToString(sent.MessageAttributes[TypeAttribute].StringValue))
+
+	failures := make(chan error, 10)
+	handler := test.CreateRecordingHandler(false)
+	consumer := consume(t, queue, "https://sqs.eu-west-1.amazonaws.com/123456789012/events", handler, func(err error) { failures <- err })
+	defer consumer.Stop()
+	assert.Equal(t, eventsourcing.OrderingUnordered, eventsourcing.OrderingOf(consumer))
+
+	assert.True(t, test.WaitFor(func() bool { return handler.Count() == 2 && queue.Len() == 0 }))
+	assert.Contains(t, (<-failures).Error(), "discarding message m-3")
+}
+
+// TestCreate checks invalid options are rejected
+func TestCreate(t *testing.T) {
+	_, errCreate := CreatePublisherWithClient(&fakeTopic{}, "", test.GetTestRegistry())
+	assert.NotNil(t, errCreate)
+	_, errCreate = CreateQueuePublisherWithClient(newFakeQueue(false), "", test.GetTestRegistry())
+	assert.NotNil(t, errCreate)
+	_, errCreate = CreateConsumerWithClient(newFakeQueue(false), "", Options{})
+	assert.NotNil(t, errCreate)
+
+	created, errCreate := CreateConsumer(aws.Config{Region: "eu-west-1"}, "https://sqs.eu-west-1.amazonaws.com/123456789012/events", Options{BatchSize: 50})
+	require.Nil(t, errCreate)
+	assert.Equal(t, MaxBatchSize, created.(*consumer).options.BatchSize)
+	assert.Equal(t, DefaultWaitTime, created.(*consumer).options.WaitTime)
+}
+
+// TestUnwrap checks events are taken out of SNS notifications, and raw messages are
+// left as they are
+func TestUnwrap(t *testing.T) {
+	raw := `{"domain":"Testing","event_type":"IncrementEvent","key":"a","sequence":1,"data":{}}`
+	wrapped, _ := json.Marshal(notification{Type: "Notification", TopicArn: "arn", Message: raw})
+	assert.Equal(t, raw, string(unwrap(string(wrapped))))
+	assert.Equal(t, raw, string(unwrap(raw)))
+	assert.Equal(t, "not json", string(unwrap("not json")))
+}
@@ -0,0 +1,278 @@
+/*
+Package sse fans published events out to clients connected with Server-Sent
+Events or WebSockets, so that user interfaces can show live updates straight from
+the event pipeline. The broadcaster is both an EventPublisher, attached to the
+store with the publish middleware or to a consumer through a handler, and an HTTP
+endpoint for each kind of client:
+
+	live := sse.Create(registry, sse.Options{})
+	store.Use(publish.Create(live))
+	router.GET("/events", live.Handler())
+	router.GET("/events/ws", live.WebSocketHandler())
+
+Each client receives the events that match its filter, as a data line (Server-Sent
+Events) or a text message (WebSockets) holding the JSON of the published event. By default the filter is read from the query
+string, with any number of prefix (aggregate key prefix) and type (event type)
+parameters, i.e. /events?prefix=orders-&type=OrderShipped. Delivery is best
+effort: clients that fall behind are disconnected rather than slowing down
+publishing, and should reconnect and reload what they display.
+*/
+package sse
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-gadgets/eventsourcing"
+)
+
+const (
+	// DefaultBuffer is the number of events queued for a client, before it is
+	// disconnected for falling behind.
+	DefaultBuffer = 64
+
+	// DefaultKeepAlive is the interval between comments sent to idle clients, so
+	// that proxies don't close their connections.
+	DefaultKeepAlive = 15 * time.Second
+)
+
+// Filter selects the events a client receives. Empty lists match everything.
+type Filter struct {
+	Prefixes []string                  // Aggregate key prefixes, any of which must match
+	Types    []eventsourcing.EventType // Event types, any of which must match
+}
+
+// Options contains the options for a broadcaster.
+type Options struct {
+	Buffer      int                                   // Events queued per client, DefaultBuffer by default
+	KeepAlive   time.Duration                         // Interval between keep-alive comments, DefaultKeepAlive by default
+	Filter      func(r *http.Request) (Filter, error) // Filter for a request, FilterFromQuery by default (errors are Forbidden)
+	CheckOrigin func(r *http.Request) bool            // Accepts the origin of a WebSocket upgrade, same origin only by default
+}
+
+// client is a connected client
+type client struct {
+	filter Filter      // Events the client receives
+	events chan []byte // Events queued for the client
+	closed bool        // Set once the client has been disconnected
+}
+
+// Broadcaster publishes events to connected clients.
+type Broadcaster struct {
+	registry eventsourcing.EventRegistry // Registry
+	options  Options                     // Options
+	lock     sync.Mutex                  // Guards the clients
+	clients  map[*client]struct{}        // Connected clients
+}
+
+// Create creates a broadcaster with no connected clients.
+func Create(registry eventsourcing.EventRegistry, options Options) *Broadcaster {
+	if options.Buffer <= 0 {
+		options.Buffer = DefaultBuffer
+	}
+	if options.KeepAlive <= 0 {
+		options.KeepAlive = DefaultKeepAlive
+	}
+	if options.Filter == nil {
+		options.Filter = FilterFromQuery
+	}
+
+	return &Broadcaster{
+		registry: registry,
+		options:  options,
+		clients:  make(map[*client]struct{}),
+	}
+}
+
+// FilterFromQuery reads a filter from the prefix and type parameters of the query
+// string.
+func FilterFromQuery(r *http.Request) (Filter, error) {
+	query := r.URL.Query()
+	filter := Filter{
+		Prefixes: query["prefix"],
+	}
+	for _, eventType := range query["type"] {
+		filter.Types = append(filter.Types, eventsourcing.EventType(eventType))
+	}
+	return filter, nil
+}
+
+// Matches checks if an event passes the filter
+func (filter Filter) Matches(event eventsourcing.PublishedEvent) bool {
+	return matchesPrefix(filter.Prefixes, event.Key) && matchesType(filter.Types, event.Type)
+}
+
+// matchesPrefix checks if a key has one of a set of prefixes
+func matchesPrefix(prefixes []string, key string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesType checks if an event type is one of a set of types
+func matchesType(types []eventsourcing.EventType, eventType eventsourcing.EventType) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, wanted := range types {
+		if wanted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Clients gets the number of connected clients
+func (broadcaster *Broadcaster) Clients() int {
+	broadcaster.lock.Lock()
+	defer broadcaster.lock.Unlock()
+	return len(broadcaster.clients)
+}
+
+// Publish an event to every connected client whose filter it matches. Clients
+// whose queues are full are disconnected, so publishing never waits for them.
+func (broadcaster *Broadcaster) Publish(key string, sequence int64, event eventsourcing.Event) error {
+	eventType, found := broadcaster.registry.GetEventType(event)
+	if !found {
+		return fmt.Errorf("Could not find event type: %v", event)
+	}
+
+	toPublish := eventsourcing.PublishedEvent{
+		Domain:   broadcaster.registry.Domain(),
+		Type:     eventType,
+		Key:      key,
+		Sequence: sequence,
+		Data:     event,
+	}
+
+	broadcaster.lock.Lock()
+	defer broadcaster.lock.Unlock()
+
+	var buff []byte
+	for current := range broadcaster.clients {
+		if !current.filter.Matches(toPublish) {
+			continue
+		}
+
+		// Encode once, and only if somebody is listening
+		if buff == nil {
+			var errBuff error
+			buff, errBuff = json.Marshal(&toPublish)
+			if errBuff != nil {
+				return errBuff
+			}
+		}
+
+		select {
+		case current.events <- buff:
+		default:
+			broadcaster.disconnect(current)
+		}
+	}
+
+	return nil
+}
+
+// OrderingGuarantee reports that events are delivered to each client in the order
+// they are published.
+func (broadcaster *Broadcaster) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return eventsourcing.OrderingGlobal
+}
+
+// Handler gets a gin handler that streams events to a client.
+func (broadcaster *Broadcaster) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		broadcaster.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// ServeHTTP streams events to a client until it disconnects, for use without gin.
+func (broadcaster *Broadcaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	filter, errFilter := broadcaster.options.Filter(r)
+	if errFilter != nil {
+		http.Error(w, errFilter.Error(), http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	current := broadcaster.connect(filter)
+	defer broadcaster.release(current)
+
+	keepAlive := time.NewTicker(broadcaster.options.KeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case buff, open := <-current.events:
+			if !open {
+				return
+			}
+			_, errWrite := fmt.Fprintf(w, "data: %s\n\n", buff)
+			if errWrite != nil {
+				return
+			}
+		case <-keepAlive.C:
+			_, errWrite := fmt.Fprint(w, ": keep-alive\n\n")
+			if errWrite != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// connect registers a client
+func (broadcaster *Broadcaster) connect(filter Filter) *client {
+	current := &client{
+		filter: filter,
+		events: make(chan []byte, broadcaster.options.Buffer),
+	}
+
+	broadcaster.lock.Lock()
+	broadcaster.clients[current] = struct{}{}
+	broadcaster.lock.Unlock()
+	return current
+}
+
+// release removes a client once its connection has ended
+func (broadcaster *Broadcaster) release(current *client) {
+	broadcaster.lock.Lock()
+	broadcaster.disconnect(current)
+	broadcaster.lock.Unlock()
+}
+
+// disconnect removes a client, closing its queue so its connection ends. The lock
+// must be held.
+func (broadcaster *Broadcaster) disconnect(current *client) {
+	if current.closed {
+		return
+	}
+	current.closed = true
+	delete(broadcaster.clients, current)
+	close(current.events)
+}
@@ -0,0 +1,232 @@
+package sse
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// listen connects to a server, sending the events it receives to a channel
+func listen(t *testing.T, url string) chan eventsourcing.PublishedEvent {
+	response, errGet := http.Get(url)
+	if !assert.Nil(t, errGet) {
+		return nil
+	}
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+
+	received := make(chan eventsourcing.PublishedEvent, 10)
+	go func() {
+		defer response.Body.Close()
+		defer close(received)
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			if !strings.HasPrefix(scanner.Text(), "data: ") {
+				continue
+			}
+			event := eventsourcing.PublishedEvent{}
+			json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), &event)
+			received <- event
+		}
+	}()
+	return received
+}
+
+// TestBroadcast checks clients receive the events matching their filters, in order
+func TestBroadcast(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	live := Create(test.GetTestRegistry(), Options{})
+	assert.Equal(t, eventsourcing.OrderingGlobal, eventsourcing.OrderingOf(live))
+	router := gin.New()
+	router.GET("/events", live.Handler())
+
+	for _, handler := range []http.Handler{router, live} {
+		server := httptest.NewServer(handler)
+		everything := listen(t, server.URL+"/events")
+		orders := listen(t, server.URL+"/events?prefix=orders-&prefix=invoices-")
+		nothing := listen(t, server.URL+"/events?type=Unknown")
+		assert.True(t, test.WaitFor(func() bool { return live.Clients() == 3 }))
+
+		assert.Nil(t, live.Publish("orders-1", 1, test.IncrementEvent{IncrementBy: 1}))
+		assert.Nil(t, live.Publish("users-1", 1, test.IncrementEvent{IncrementBy: 2}))
+		assert.Nil(t, live.Publish("orders-1", 2, test.IncrementEvent{IncrementBy: 3}))
+
+		for _, expected := range []string{"orders-1/1", "users-1/1", "orders-1/2"} {
+			event := <-everything
+			assert.Equal(t, expected, fmt.Sprintf("%v/%v", event.Key, event.Sequence))
+		}
+		for _, expected := range []int64{1, 2} {
+			event := <-orders
+			assert.Equal(t, "orders-1", event.Key)
+			assert.Equal(t, expected, event.Sequence)
+			assert.Equal(t, eventsourcing.EventType("IncrementEvent"), event.Type)
+		}
+
+		// Clients that disconnect are forgotten
+		server.CloseClientConnections()
+		server.Close()
+		_, open := <-nothing
+		assert.False(t, open)
+		assert.True(t, test.WaitFor(func() bool { return live.Clients() == 0 }))
+	}
+}
+
+// TestSlowClient checks clients that fall behind are disconnected, rather than
+// holding up publishing
+func TestSlowClient(t *testing.T) {
+	live := Create(test.GetTestRegistry(), Options{Buffer: 2})
+	slow := live.connect(Filter{})
+	for seq := int64(1); seq <= 3; seq++ {
+		assert.Nil(t, live.Publish("a", seq, test.IncrementEvent{IncrementBy: 1}))
+	}
+	assert.Equal(t, 0, live.Clients())
+	assert.Len(t, slow.events, 2)
+	live.release(slow)
+
+	assert.NotNil(t, live.Publish("a", 4, "not registered"))
+}
+
+// TestFilterRejected checks requests whose filter can't be built are refused
+func TestFilterRejected(t *testing.T) {
+	live := Create(test.GetTestRegistry(), Options{
+		Filter: func(r *http.Request) (Filter, error) {
+			return Filter{}, errors.New("not allowed")
+		},
+	})
+
+	recorder := httptest.NewRecorder()
+	live.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/events", nil))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, 0, live.Clients())
+}
+
+// dial connects a WebSocket client to a server, sending the events it receives to
+// a channel
+func dial(t *testing.T, url string) (*websocket.Conn, chan eventsourcing.PublishedEvent) {
+	conn, response, errDial := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http"), nil)
+	if !assert.Nil(t, errDial) {
+		return nil, nil
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+
+	received := make(chan eventsourcing.PublishedEvent, 10)
+	go func() {
+		defer close(received)
+		for {
+			event := eventsourcing.PublishedEvent{}
+			if errRead := conn.ReadJSON(&event); errRead != nil {
+				return
+			}
+			received <- event
+		}
+	}()
+	return conn, received
+}
+
+// TestWebSocket checks WebSocket clients receive the events matching their
+// filters, in order, alongside Server-Sent Events clients
+func TestWebSocket(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	live := Create(test.GetTestRegistry(), Options{})
+	router := gin.New()
+	router.GET("/events", live.Handler())
+	router.GET("/events/ws", live.WebSocketHandler())
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	all, everything := dial(t, server.URL+"/events/ws")
+	filtered, orders := dial(t, server.URL+"/events/ws?prefix=orders-&type=IncrementEvent")
+	streamed := listen(t, server.URL+"/events?prefix=orders-")
+	assert.True(t, test.WaitFor(func() bool { return live.Clients() == 3 }))
+
+	assert.Nil(t, live.Publish("orders-1", 1, test.IncrementEvent{IncrementBy: 1}))
+	assert.Nil(t, live.Publish("users-1", 1, test.IncrementEvent{IncrementBy: 2}))
+	assert.Nil(t, live.Publish("orders-1", 2, test.IncrementEvent{IncrementBy: 3}))
+
+	for _, expected := range []string{"orders-1/1", "users-1/1", "orders-1/2"} {
+		event := <-everything
+		assert.Equal(t, expected, fmt.Sprintf("%v/%v", event.Key, event.Sequence))
+		assert.Equal(t, eventsourcing.EventType("IncrementEvent"), event.Type)
+	}
+	for _, expected := range []int64{1, 2} {
+		event := <-orders
+		assert.Equal(t, "orders-1", event.Key)
+		assert.Equal(t, expected, event.Sequence)
+		event = <-streamed
+		assert.Equal(t, "orders-1", event.Key)
+		assert.Equal(t, expected, event.Sequence)
+	}
+
+	// Clients that disconnect are forgotten
+	all.Close()
+	filtered.Close()
+	_, open := <-orders
+	assert.False(t, open)
+	assert.True(t, test.WaitFor(func() bool { return live.Clients() == 1 }))
+	server.CloseClientConnections()
+}
+
+// TestWebSocketSlowClient checks WebSocket clients that fall behind are closed
+func TestWebSocketSlowClient(t *testing.T) {
+	live := Create(test.GetTestRegistry(), Options{Buffer: 1})
+	server := httptest.NewServer(http.HandlerFunc(live.ServeWebSocket))
+	defer server.Close()
+
+	conn, _, errDial := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.Nil(t, errDial) {
+		return
+	}
+	defer conn.Close()
+	assert.True(t, test.WaitFor(func() bool { return live.Clients() == 1 }))
+
+	// Publish while the client isn't reading, until the connection's buffers fill
+	// and it's disconnected
+	for seq := int64(1); live.Clients() > 0 && seq < 10000000; seq++ {
+		assert.Nil(t, live.Publish("a", seq, test.IncrementEvent{IncrementBy: 1}))
+	}
+	assert.Equal(t, 0, live.Clients())
+
+	var errRead error
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for errRead == nil {
+		_, _, errRead = conn.ReadMessage()
+	}
+	assert.True(t, websocket.IsCloseError(errRead, websocket.CloseGoingAway), errRead.Error())
+}
+
+// TestWebSocketRejected checks upgrades whose filter can't be built, or from other
+// origins, are refused
+func TestWebSocketRejected(t *testing.T) {
+	live := Create(test.GetTestRegistry(), Options{
+		Filter: func(r *http.Request) (Filter, error) {
+			return Filter{}, errors.New("not allowed")
+		},
+	})
+	server := httptest.NewServer(http.HandlerFunc(live.ServeWebSocket))
+	defer server.Close()
+
+	_, response, errDial := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.NotNil(t, errDial)
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+
+	open := Create(test.GetTestRegistry(), Options{})
+	foreign := httptest.NewServer(http.HandlerFunc(open.ServeWebSocket))
+	defer foreign.Close()
+	_, response, errDial = websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(foreign.URL, "http"), http.Header{
+		"Origin": []string{"http://elsewhere.example"},
+	})
+	assert.NotNil(t, errDial)
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	assert.Equal(t, 0, open.Clients())
+}
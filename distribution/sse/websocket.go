@@ -0,0 +1,82 @@
+package sse
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// writeWait is the longest a write to a WebSocket client may take.
+const writeWait = 10 * time.Second
+
+// WebSocketHandler gets a gin handler that upgrades the connection to a WebSocket,
+// and sends events to the client over it.
+func (broadcaster *Broadcaster) WebSocketHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		broadcaster.ServeWebSocket(c.Writer, c.Request)
+	}
+}
+
+// ServeWebSocket upgrades a connection to a WebSocket, and sends each event that
+// matches the client's filter as a text message holding the JSON of the published
+// event, until the client disconnects. The filter is taken from the request, as for
+// ServeHTTP, and idle clients are pinged every keep-alive interval. Messages from
+// the client are read only to notice it going away, and are otherwise ignored.
+func (broadcaster *Broadcaster) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	filter, errFilter := broadcaster.options.Filter(r)
+	if errFilter != nil {
+		http.Error(w, errFilter.Error(), http.StatusForbidden)
+		return
+	}
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: broadcaster.options.CheckOrigin,
+	}
+	conn, errUpgrade := upgrader.Upgrade(w, r, nil)
+	if errUpgrade != nil {
+		// The upgrader has already responded
+		return
+	}
+	defer conn.Close()
+
+	current := broadcaster.connect(filter)
+	defer broadcaster.release(current)
+
+	// Control frames are handled while reading, and reads fail once the client goes
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, errRead := conn.NextReader(); errRead != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(broadcaster.options.KeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case buff, open := <-current.events:
+			if !open {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "fell behind"), time.Now().Add(writeWait))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if errWrite := conn.WriteMessage(websocket.TextMessage, buff); errWrite != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if errPing := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); errPing != nil {
+				return
+			}
+		case <-gone:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
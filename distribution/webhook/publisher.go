@@ -0,0 +1,418 @@
+/*
+Package webhook contains a publisher that posts published events to HTTP
+endpoints, so that third-party integrations can subscribe to the events of a
+domain. Each post is signed with a secret shared with the endpoint (see Sign and
+Verify). Publishing an event only puts a delivery for each endpoint into a queue,
+so a slow endpoint doesn't hold up commits, and the publisher posts deliveries
+from the queue in the background once started, retrying those that fail with
+exponential backoff until they succeed or run out of attempts:
+
+	hooks, errHooks := webhook.Create(registry, webhook.Options{
+		Endpoints: []webhook.Endpoint{{URL: "https://example.com/hooks", Secret: secret}},
+		Queue:     redisqueue.NewQueue(client, "webhooks:"),
+	})
+	store.Use(publish.Create(hooks))
+	hooks.Start()
+
+Deliveries are made at least once, and survive the process as long as the queue
+does. Retries are made after later events have been posted, so endpoints may
+receive an event twice, or after later events of the same aggregate. Endpoints
+should use the delivery ID to discard duplicates, and the key and sequence of the
+event to order them.
+*/
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/logadapter"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// DefaultTimeout is the time allowed for an endpoint to respond.
+	DefaultTimeout = 10 * time.Second
+
+	// DefaultMaxAttempts is the number of attempts made to deliver an event,
+	// before giving up on it.
+	DefaultMaxAttempts = 15
+
+	// DefaultBackoff is the wait before the first retry, which doubles with
+	// every attempt after it.
+	DefaultBackoff = time.Second
+
+	// DefaultMaxBackoff is the longest wait between attempts.
+	DefaultMaxBackoff = time.Hour
+
+	// DefaultInterval is the time waited between checks for deliveries that are
+	// due, other than those just published.
+	DefaultInterval = time.Second
+
+	// DefaultBatchSize is the number of deliveries attempted at a time.
+	DefaultBatchSize = 100
+)
+
+const (
+	// HeaderID is the header carrying the ID of a delivery, which is the same for
+	// every attempt.
+	HeaderID = "X-Webhook-Id"
+
+	// HeaderTimestamp is the header carrying the time of an attempt, in seconds
+	// since the epoch.
+	HeaderTimestamp = "X-Webhook-Timestamp"
+
+	// HeaderSignature is the header carrying the signature of an attempt (see Sign).
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Endpoint is an HTTP endpoint that events are posted to.
+type Endpoint struct {
+	URL    string `json:"url"`    // URL events are posted to
+	Secret string `json:"secret"` // Secret to sign posts with, unsigned if empty
+}
+
+// Options contains the options for posting events.
+type Options struct {
+	Endpoints   []Endpoint           // Endpoints to post every event to
+	Queue       Queue                // Deliveries waiting to be attempted, in memory by default
+	Client      *http.Client         // Client to post with, with DefaultTimeout by default
+	MaxAttempts int                  // Attempts per delivery, DefaultMaxAttempts by default
+	Backoff     time.Duration        // Wait before the first retry, DefaultBackoff by default
+	MaxBackoff  time.Duration        // Longest wait between attempts, DefaultMaxBackoff by default
+	Interval    time.Duration        // Wait between checks for due deliveries, DefaultInterval by default
+	BatchSize   int                  // Deliveries attempted at a time, DefaultBatchSize by default
+	OnGiveUp    func(Delivery)       // Called with deliveries that ran out of attempts, logs by default
+	OnError     func(error)          // Called when the queue fails or sets deliveries aside, logs by default
+	Clock       eventsourcing.Clock  // Source of time, the system clock by default
+	Logger      eventsourcing.Logger // Logger for the default OnGiveUp and OnError, logrus by default
+}
+
+// Publisher posts events to endpoints, retrying the posts that fail.
+type Publisher struct {
+	registry eventsourcing.EventRegistry // Registry
+	options  Options                     // Options
+	secrets  map[string]string           // Secrets of the endpoints, by URL
+	wake     chan struct{}               // Wakes the delivery loop once deliveries are queued
+	lock     sync.Mutex                  // Guards the delivery loop state
+	stop     chan struct{}               // Stops the delivery loop
+	done     chan struct{}               // Closed once the delivery loop exits
+}
+
+// Create creates a publisher posting events to a set of endpoints. Deliveries are
+// only attempted once the publisher is started, until then they wait in the queue.
+func Create(registry eventsourcing.EventRegistry, options Options) (*Publisher, error) {
+	if len(options.Endpoints) == 0 {
+		return nil, fmt.Errorf("webhook: at least one endpoint is required")
+	}
+
+	secrets := make(map[string]string)
+	for _, endpoint := range options.Endpoints {
+		secrets[endpoint.URL] = endpoint.Secret
+	}
+
+	if options.Queue == nil {
+		options.Queue = NewMemoryQueue()
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: DefaultTimeout}
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = DefaultMaxAttempts
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = DefaultBackoff
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = DefaultMaxBackoff
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBatchSize
+	}
+	if options.Logger == nil {
+		options.Logger = logadapter.NewLogrusLogger(nil)
+	}
+	logger := options.Logger
+	if options.OnGiveUp == nil {
+		options.OnGiveUp = func(delivery Delivery) {
+			logger.Error("webhook_delivery_abandoned", eventsourcing.LogFields{
+				"id":       delivery.ID,
+				"url":      delivery.URL,
+				"key":      delivery.Key,
+				"sequence": delivery.Sequence,
+				"attempts": delivery.Attempts,
+				"error":    delivery.LastError,
+			})
+		}
+	}
+	if options.OnError == nil {
+		options.OnError = func(err error) {
+			logger.Error("webhook_delivery_error", eventsourcing.LogFields{
+				"error": err,
+			})
+		}
+	}
+	if options.Clock == nil {
+		options.Clock = eventsourcing.SystemClock
+	}
+
+	return &Publisher{
+		registry: registry,
+		options:  options,
+		secrets:  secrets,
+		wake:     make(chan struct{}, 1),
+	}, nil
+}
+
+// Publish an event, queueing a delivery of it to every endpoint, which the delivery
+// loop then attempts. The event is only reported as unpublished if it can't be
+// queued, and no endpoint is posted to before it has been.
+func (pub *Publisher) Publish(key string, sequence int64, event eventsourcing.Event) error {
+	eventType, found := pub.registry.GetEventType(event)
+	if !found {
+		return fmt.Errorf("Could not find event type: %v", event)
+	}
+
+	toPublish := eventsourcing.PublishedEvent{
+		Domain:   pub.registry.Domain(),
+		Type:     eventType,
+		Key:      key,
+		Sequence: sequence,
+		Data:     event,
+	}
+
+	buff, errBuff := json.Marshal(&toPublish)
+	if errBuff != nil {
+		return errBuff
+	}
+
+	now := pub.options.Clock.Now()
+	deliveries := make([]Delivery, 0, len(pub.options.Endpoints))
+	for _, endpoint := range pub.options.Endpoints {
+		deliveries = append(deliveries, Delivery{
+			ID:       fmt.Sprintf("%v", uuid.NewV4()),
+			URL:      endpoint.URL,
+			Key:      key,
+			Sequence: sequence,
+			Body:     buff,
+			Due:      now,
+		})
+	}
+
+	errPut := pub.options.Queue.Put(deliveries)
+	if errPut != nil {
+		return errPut
+	}
+
+	select {
+	case pub.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// OrderingGuarantee reports that events may be delivered in any order, since
+// posts that fail are retried after later events have been posted.
+func (pub *Publisher) OrderingGuarantee() eventsourcing.OrderingGuarantee {
+	return eventsourcing.OrderingUnordered
+}
+
+// Start attempting queued deliveries in the background
+func (pub *Publisher) Start() error {
+	pub.lock.Lock()
+	defer pub.lock.Unlock()
+	if pub.stop != nil {
+		return nil
+	}
+
+	pub.stop = make(chan struct{})
+	pub.done = make(chan struct{})
+	go pub.run(pub.stop, pub.done)
+	return nil
+}
+
+// Stop attempting deliveries, waiting for the batch in progress to finish
+func (pub *Publisher) Stop() error {
+	pub.lock.Lock()
+	stop, done := pub.stop, pub.done
+	pub.stop, pub.done = nil, nil
+	pub.lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return nil
+}
+
+// run attempts due deliveries every interval, and as soon as deliveries are
+// published, until stopped.
+func (pub *Publisher) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := pub.options.Clock.NewTicker(pub.options.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-pub.wake:
+		case <-ticker.C():
+		}
+
+		for {
+			attempted, errDeliver := pub.Deliver()
+			if errDeliver != nil {
+				pub.options.OnError(errDeliver)
+			}
+			if errDeliver != nil || attempted < pub.options.BatchSize {
+				break
+			}
+		}
+	}
+}
+
+// Deliver makes an attempt at a batch of due deliveries, returning the number
+// attempted. Deliveries that fail are queued for a later retry, unless they have
+// run out of attempts or their endpoint is no longer configured, in which case
+// they are given up on.
+func (pub *Publisher) Deliver() (int, error) {
+	due, errDue := pub.options.Queue.Due(pub.options.Clock.Now(), pub.options.BatchSize)
+	if quarantined, ok := errDue.(*QuarantineError); ok {
+		pub.options.OnError(quarantined)
+		errDue = nil
+	}
+	if errDue != nil {
+		return 0, errDue
+	}
+
+	delivered := make([]string, 0)
+	failed := make([]Delivery, 0)
+	for _, delivery := range due {
+		if !pub.attempt(&delivery) {
+			delivered = append(delivered, delivery.ID)
+			continue
+		}
+		failed = append(failed, delivery)
+	}
+
+	errPut := pub.options.Queue.Put(failed)
+	if errPut != nil {
+		return len(due), errPut
+	}
+	return len(due), pub.options.Queue.Remove(delivered)
+}
+
+// attempt posts a delivery, returning true if it should be retried. Deliveries
+// that won't be retried have either succeeded or been given up on.
+func (pub *Publisher) attempt(delivery *Delivery) bool {
+	secret, known := pub.secrets[delivery.URL]
+	errPost := fmt.Errorf("webhook: endpoint %v is no longer configured", delivery.URL)
+	if known {
+		errPost = pub.post(*delivery, secret)
+	}
+	delivery.Attempts++
+	if errPost == nil {
+		return false
+	}
+
+	delivery.LastError = errPost.Error()
+	if !known || delivery.Attempts >= pub.options.MaxAttempts {
+		pub.options.OnGiveUp(*delivery)
+		return false
+	}
+
+	delivery.Due = pub.options.Clock.Now().Add(pub.backoff(delivery.Attempts))
+	return true
+}
+
+// backoff gets the wait before the retry that follows an attempt
+func (pub *Publisher) backoff(attempts int) time.Duration {
+	wait := pub.options.Backoff
+	for attempt := 1; attempt < attempts && wait < pub.options.MaxBackoff; attempt++ {
+		wait *= 2
+	}
+	if wait > pub.options.MaxBackoff {
+		return pub.options.MaxBackoff
+	}
+	return wait
+}
+
+// post posts a delivery to its endpoint, failing unless the endpoint responds
+// with a 2xx status.
+func (pub *Publisher) post(delivery Delivery, secret string) error {
+	request, errRequest := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Body))
+	if errRequest != nil {
+		return errRequest
+	}
+
+	timestamp := pub.options.Clock.Now().Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(HeaderID, delivery.ID)
+	request.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	if secret != "" {
+		request.Header.Set(HeaderSignature, Sign(secret, timestamp, delivery.Body))
+	}
+
+	response, errPost := pub.options.Client.Do(request)
+	if errPost != nil {
+		return errPost
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook: %v responded %v", delivery.URL, response.Status)
+	}
+	return nil
+}
+
+// Sign gets the signature of a post made at a time: sha256= followed by the hex
+// HMAC-SHA256, keyed by the secret, of the timestamp, a period and the body.
+// Signing the timestamp stops a captured post from being replayed later.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a post received by an endpoint, given its body,
+// and that it was signed within the tolerance of the current time (unless the
+// tolerance is 0).
+func Verify(request *http.Request, body []byte, secret string, tolerance time.Duration) error {
+	return VerifyWithClock(request, body, secret, tolerance, eventsourcing.SystemClock)
+}
+
+// VerifyWithClock checks the signature of a post as Verify does, reading the
+// current time from a clock.
+func VerifyWithClock(request *http.Request, body []byte, secret string, tolerance time.Duration, clock eventsourcing.Clock) error {
+	timestamp, errTimestamp := strconv.ParseInt(request.Header.Get(HeaderTimestamp), 10, 64)
+	if errTimestamp != nil {
+		return fmt.Errorf("webhook: invalid timestamp: %v", errTimestamp)
+	}
+
+	expected := Sign(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(request.Header.Get(HeaderSignature))) {
+		return fmt.Errorf("webhook: signature mismatch")
+	}
+
+	age := clock.Now().Sub(time.Unix(timestamp, 0))
+	if tolerance > 0 && (age > tolerance || age < -tolerance) {
+		return fmt.Errorf("webhook: signed %v ago, outside the tolerance of %v", age, tolerance)
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package webhook
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/simclock"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// endpoint is a test endpoint that fails a number of posts, then records the rest
+type endpoint struct {
+	lock     sync.Mutex
+	failures int
+	ids      []string
+	errors   []error
+}
+
+// ServeHTTP receives a post
+func (receiver *endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	receiver.ids = append(receiver.ids, r.Header.Get(HeaderID))
+	receiver.errors = append(receiver.errors, Verify(r, body, "secret", 0))
+	if receiver.failures > 0 {
+		receiver.failures--
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// posts gets the IDs of the posts received so far
+func (receiver *endpoint) posts() []string {
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	return append([]string{}, receiver.ids...)
+}
+
+// TestPublishSigned checks events are queued for every endpoint, and posted signed
+// with its secret
+func TestPublishSigned(t *testing.T) {
+	receiver := &endpoint{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	queue := NewMemoryQueue()
+	hooks, errCreate := Create(test.GetTestRegistry(), Options{
+		Endpoints: []Endpoint{{URL: server.URL, Secret: "secret"}, {URL: server.URL + "/other", Secret: "secret"}},
+		Queue:     queue,
+	})
+	require.Nil(t, errCreate)
+	assert.Equal(t, eventsourcing.OrderingUnordered, eventsourcing.OrderingOf(hooks))
+
+	// Publishing only queues the deliveries
+	assert.Nil(t, hooks.Publish("a", 1, test.IncrementEvent{IncrementBy: 1}))
+	assert.Len(t, receiver.posts(), 0)
+	pending, _ := queue.Due(time.Now(), 10)
+	assert.Len(t, pending, 2)
+
+	attempted, errDeliver := hooks.Deliver()
+	assert.Nil(t, errDeliver)
+	assert.Equal(t, 2, attempted)
+	assert.Len(t, receiver.posts(), 2)
+	assert.NotEqual(t, receiver.posts()[0], receiver.posts()[1])
+	assert.Equal(t, []error{nil, nil}, receiver.errors)
+
+	pending, _ = queue.Due(time.Now().Add(time.Hour), 10)
+	assert.Len(t, pending, 0)
+
+	_, errEmpty := Create(test.GetTestRegistry(), Options{})
+	assert.NotNil(t, errEmpty)
+}
+
+// TestVerify checks tampered, mis-signed and stale posts are rejected
+func TestVerify(t *testing.T) {
+	body := []byte(`{"key":"a"}`)
+	signed := func(secret string, at time.Time) *http.Request {
+		request := httptest.NewRequest(http.MethodPost, "/", nil)
+		if !at.IsZero() {
+			request.Header.Set(HeaderTimestamp, strconv.FormatInt(at.Unix(), 10))
+			request.Header.Set(HeaderSignature, Sign(secret, at.Unix(), body))
+		}
+		return request
+	}
+
+	assert.Nil(t, Verify(signed("secret", time.Now()), body, "secret", time.Minute))
+	assert.NotNil(t, Verify(signed("secret", time.Now()), []byte(`{"key":"b"}`), "secret", time.Minute))
+	assert.NotNil(t, Verify(signed("wrong", time.Now()), body, "secret", time.Minute))
+	assert.NotNil(t, Verify(signed("secret", time.Now().Add(-time.Hour)), body, "secret", time.Minute))
+	assert.Nil(t, Verify(signed("secret", time.Now().Add(-time.Hour)), body, "secret", 0))
+	assert.NotNil(t, Verify(signed("secret", time.Time{}), body, "secret", 0))
+
+	clock := simclock.New(time.Unix(1000, 0))
+	assert.Nil(t, VerifyWithClock(signed("secret", clock.Now()), body, "secret", time.Minute, clock))
+	stale := signed("secret", clock.Now())
+	clock.Advance(time.Hour)
+	assert.NotNil(t, VerifyWithClock(stale, body, "secret", time.Minute, clock))
+}
+
+// TestRetryBackoff checks failed posts are retried with the same ID, waiting twice
+// as long after every attempt
+func TestRetryBackoff(t *testing.T) {
+	receiver := &endpoint{failures: 3}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	clock := simclock.New(time.Unix(1000, 0))
+	queue := NewMemoryQueue()
+	hooks, errCreate := Create(test.GetTestRegistry(), Options{
+		Endpoints: []Endpoint{{URL: server.URL, Secret: "secret"}},
+		Queue:     queue,
+		Clock:     clock,
+	})
+	require.Nil(t, errCreate)
+	assert.Nil(t, hooks.Publish("a", 1, test.IncrementEvent{IncrementBy: 1}))
+	attempted, errDeliver := hooks.Deliver()
+	assert.Nil(t, errDeliver)
+	assert.Equal(t, 1, attempted)
+
+	for _, wait := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		pending, _ := queue.Due(clock.Now().Add(time.Hour), 10)
+		assert.Len(t, pending, 1)
+		assert.Equal(t, clock.Now().Add(wait), pending[0].Due)
+		assert.Contains(t, pending[0].LastError, "502")
+
+		// Nothing is retried before it's due
+		clock.Advance(wait - time.Millisecond)
+		attempted, errDeliver = hooks.Deliver()
+		assert.Nil(t, errDeliver)
+		assert.Equal(t, 0, attempted)
+
+		clock.Advance(time.Millisecond)
+		attempted, errDeliver = hooks.Deliver()
+		assert.Nil(t, errDeliver)
+		assert.Equal(t, 1, attempted)
+	}
+
+	posts := receiver.posts()
+	assert.Len(t, posts, 4)
+	for _, id := range posts {
+		assert.Equal(t, posts[0], id)
+	}
+	pending, _ := queue.Due(clock.Now().Add(time.Hour), 10)
+	assert.Len(t, pending, 0)
+}
+
+// TestGiveUp checks deliveries are abandoned once out of attempts, or once their
+// endpoint is no longer configured
+func TestGiveUp(t *testing.T) {
+	receiver := &endpoint{failures: 100}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	clock := simclock.New(time.Unix(1000, 0))
+	queue := NewMemoryQueue()
+	abandoned := make([]Delivery, 0)
+	hooks, errCreate := Create(test.GetTestRegistry(), Options{
+		Endpoints:   []Endpoint{{URL: server.URL}},
+		Queue:       queue,
+		MaxAttempts: 2,
+		OnGiveUp: func(delivery Delivery) {
+			abandoned = append(abandoned, delivery)
+		},
+		Clock: clock,
+	})
+	require.Nil(t, errCreate)
+
+	assert.Nil(t, hooks.Publish("a", 1, test.IncrementEvent{IncrementBy: 1}))
+	assert.Nil(t, queue.Put([]Delivery{{ID: "removed", URL: "http://localhost/removed"}}))
+	attempted, errDeliver := hooks.Deliver()
+	assert.Nil(t, errDeliver)
+	assert.Equal(t, 2, attempted)
+
+	clock.Advance(time.Minute)
+	attempted, errDeliver = hooks.Deliver()
+	assert.Nil(t, errDeliver)
+	assert.Equal(t, 1, attempted)
+
+	assert.Len(t, receiver.posts(), 2)
+	assert.Len(t, abandoned, 2)
+	assert.Equal(t, "removed", abandoned[0].ID)
+	assert.Contains(t, abandoned[0].LastError, "no longer configured")
+	assert.Equal(t, 2, abandoned[1].Attempts)
+	pending, _ := queue.Due(clock.Now().Add(time.Hour), 10)
+	assert.Len(t, pending, 0)
+}
+
+// quarantiningQueue is a memory queue that reports a delivery it couldn't read
+type quarantiningQueue struct {
+	Queue
+}
+
+// Due gets the due deliveries, reporting one that was set aside
+func (queue quarantiningQueue) Due(by time.Time, limit int) ([]Delivery, error) {
+	due, _ := queue.Queue.Due(by, limit)
+	return due, &QuarantineError{IDs: []string{"bad"}, Reason: errors.New("not json")}
+}
+
+// TestQuarantine checks deliveries set aside by the queue are reported, and the
+// rest of the batch still delivered
+func TestQuarantine(t *testing.T) {
+	receiver := &endpoint{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	reported := make([]error, 0)
+	hooks, errCreate := Create(test.GetTestRegistry(), Options{
+		Endpoints: []Endpoint{{URL: server.URL, Secret: "secret"}},
+		Queue:     quarantiningQueue{NewMemoryQueue()},
+		OnError: func(err error) {
+			reported = append(reported, err)
+		},
+	})
+	require.Nil(t, errCreate)
+
+	assert.Nil(t, hooks.Publish("a", 1, test.IncrementEvent{IncrementBy: 1}))
+	attempted, errDeliver := hooks.Deliver()
+	assert.Nil(t, errDeliver)
+	assert.Equal(t, 1, attempted)
+	assert.Len(t, receiver.posts(), 1)
+	if assert.Len(t, reported, 1) {
+		assert.Contains(t, reported[0].Error(), "bad")
+	}
+}
+
+// TestStartDelivers checks published events are posted in the background once
+// started, without waiting for the interval, and failed posts retried once due
+func TestStartDelivers(t *testing.T) {
+	receiver := &endpoint{failures: 1}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	clock := simclock.New(time.Unix(1000, 0))
+	queue := NewMemoryQueue()
+	hooks, errCreate := Create(test.GetTestRegistry(), Options{
+		Endpoints: []Endpoint{{URL: server.URL}},
+		Queue:     queue,
+		Interval:  time.Minute,
+		Clock:     clock,
+	})
+	require.Nil(t, errCreate)
+	assert.Nil(t, hooks.Start())
+	defer hooks.Stop()
+
+	assert.Nil(t, hooks.Publish("a", 1, test.IncrementEvent{IncrementBy: 1}))
+	assert.True(t, test.WaitFor(func() bool {
+		pending, _ := queue.Due(clock.Now().Add(time.Hour), 10)
+		return len(pending) == 1 && pending[0].Attempts == 1
+	}))
+	assert.Len(t, receiver.posts(), 1)
+
+	clock.Advance(time.Minute)
+	assert.True(t, test.WaitFor(func() bool { return len(receiver.posts()) == 2 }))
+	assert.Nil(t, hooks.Stop())
+	pending, _ := queue.Due(clock.Now().Add(time.Hour), 10)
+	assert.Len(t, pending, 0)
+}
@@ -0,0 +1,108 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Delivery is a post of an event to an endpoint that is waiting to be attempted.
+type Delivery struct {
+	ID        string          `json:"id"`         // Unique ID of the delivery, sent to the endpoint
+	URL       string          `json:"url"`        // URL of the endpoint
+	Key       string          `json:"key"`        // Key of the aggregate
+	Sequence  int64           `json:"sequence"`   // Sequence of the event
+	Body      json.RawMessage `json:"body"`       // Published event, as posted
+	Attempts  int             `json:"attempts"`   // Attempts made so far
+	Due       time.Time       `json:"due"`        // Time of the next attempt
+	LastError string          `json:"last_error"` // Why the last attempt failed
+}
+
+// Queue is an interface that describes storage for deliveries waiting to be
+// attempted. For deliveries to survive the process the queue should be durable (see
+// the redisqueue module). Deliveries are made at least once, so several publishers may
+// share a queue, at the cost of an endpoint occasionally receiving a delivery twice.
+type Queue interface {
+	// Put adds deliveries, replacing any with the same ID.
+	Put(deliveries []Delivery) error
+
+	// Due gets up to limit deliveries due by a time, earliest first. Deliveries
+	// that can't be read are set aside rather than returned, so that they don't
+	// hold up the rest of the queue, and reported with a QuarantineError alongside
+	// the deliveries that could be read.
+	Due(by time.Time, limit int) ([]Delivery, error)
+
+	// Remove removes deliveries by ID, ignoring those that don't exist.
+	Remove(ids []string) error
+}
+
+// QuarantineError reports deliveries that were set aside by a queue, since they
+// couldn't be read.
+type QuarantineError struct {
+	IDs    []string // IDs of the deliveries set aside
+	Reason error    // Why the first of them couldn't be read
+}
+
+// Error describes the deliveries set aside
+func (err *QuarantineError) Error() string {
+	return fmt.Sprintf("webhook: quarantined deliveries %v: %v", err.IDs, err.Reason)
+}
+
+// memoryQueue is a queue held in memory.
+type memoryQueue struct {
+	lock       sync.Mutex
+	deliveries map[string]Delivery
+}
+
+// NewMemoryQueue creates a queue held in memory. It doesn't survive the process, so
+// deliveries that haven't been made are lost on restart.
+func NewMemoryQueue() Queue {
+	return &memoryQueue{
+		deliveries: make(map[string]Delivery),
+	}
+}
+
+// Put adds deliveries
+func (queue *memoryQueue) Put(deliveries []Delivery) error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for _, delivery := range deliveries {
+		queue.deliveries[delivery.ID] = delivery
+	}
+	return nil
+}
+
+// Due gets the earliest deliveries due by a time
+func (queue *memoryQueue) Due(by time.Time, limit int) ([]Delivery, error) {
+	queue.lock.Lock()
+	result := make([]Delivery, 0)
+	for _, delivery := range queue.deliveries {
+		if !delivery.Due.After(by) {
+			result = append(result, delivery)
+		}
+	}
+	queue.lock.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Due.Equal(result[j].Due) {
+			return result[i].Due.Before(result[j].Due)
+		}
+		return result[i].ID < result[j].ID
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// Remove removes deliveries by ID
+func (queue *memoryQueue) Remove(ids []string) error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for _, id := range ids {
+		delete(queue.deliveries, id)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package webhook_test
+
+import (
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing/distribution/webhook"
+	"github.com/go-gadgets/eventsourcing/distribution/webhook/queuetest"
+)
+
+// TestMemoryQueue checks the in-memory queue
+func TestMemoryQueue(t *testing.T) {
+	queuetest.CheckQueue(t, webhook.NewMemoryQueue())
+}
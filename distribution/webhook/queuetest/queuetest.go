@@ -0,0 +1,50 @@
+// Package queuetest holds the checks every webhook.Queue is expected to pass, so
+// that queues kept elsewhere are tested the same way as the built-in ones.
+package queuetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing/distribution/webhook"
+	"github.com/stretchr/testify/assert"
+)
+
+// CheckQueue checks a queue returns due deliveries in order, and replaces and
+// removes them by ID
+func CheckQueue(t *testing.T, queue webhook.Queue) {
+	start := time.Unix(1000, 0).UTC()
+	deliveries := []webhook.Delivery{
+		{ID: "late", URL: "http://late", Body: []byte(`{"key":"a"}`), Due: start.Add(2 * time.Second)},
+		{ID: "early", URL: "http://early", Body: []byte(`{"key":"b"}`), Due: start.Add(time.Second)},
+		{ID: "later", URL: "http://later", Body: []byte(`{"key":"c"}`), Due: start.Add(time.Minute)},
+	}
+	assert.Nil(t, queue.Put(deliveries))
+
+	due, errDue := queue.Due(start.Add(time.Minute-time.Millisecond), 10)
+	assert.Nil(t, errDue)
+	if assert.Len(t, due, 2) {
+		assert.Equal(t, "early", due[0].ID)
+		assert.Equal(t, "late", due[1].ID)
+		assert.Equal(t, `{"key":"a"}`, string(due[1].Body))
+		assert.True(t, start.Add(2*time.Second).Equal(due[1].Due))
+	}
+	limited, _ := queue.Due(start.Add(time.Hour), 1)
+	assert.Len(t, limited, 1)
+	exact, _ := queue.Due(start.Add(time.Second), 10)
+	assert.Len(t, exact, 1, "Deliveries due at the time should be included")
+
+	// Deliveries are replaced by ID
+	deliveries[1].Attempts = 2
+	deliveries[1].Due = start.Add(time.Hour)
+	assert.Nil(t, queue.Put(deliveries[1:2]))
+	due, _ = queue.Due(start.Add(time.Minute-time.Millisecond), 10)
+	assert.Len(t, due, 1)
+
+	assert.Nil(t, queue.Remove([]string{"late", "missing"}))
+	due, _ = queue.Due(start.Add(2*time.Hour), 10)
+	if assert.Len(t, due, 2) {
+		assert.Equal(t, "later", due[0].ID)
+		assert.Equal(t, 2, due[1].Attempts)
+	}
+}
@@ -0,0 +1,144 @@
+// Package redisqueue holds a webhook.Queue kept in Redis. It is a module of its own,
+// so that only users of the queue depend on the Redis client.
+package redisqueue
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing/distribution/webhook"
+	"github.com/go-redis/redis"
+)
+
+// redisQueue is a queue kept in Redis, as a hash of deliveries by ID and a sorted
+// set of IDs by due time.
+type redisQueue struct {
+	client     redis.UniversalClient
+	deliveries string // Hash of deliveries
+	due        string // Sorted set of delivery IDs, scored by due time in milliseconds
+	quarantine string // Hash of deliveries that couldn't be read, by ID
+}
+
+// NewQueue creates a queue kept in Redis, under keys starting with a prefix.
+// Deliveries that can't be read are moved to the <prefix>quarantine hash, where
+// they can be inspected, repaired or removed by hand.
+func NewQueue(client redis.UniversalClient, prefix string) webhook.Queue {
+	return &redisQueue{
+		client:     client,
+		deliveries: prefix + "deliveries",
+		due:        prefix + "due",
+		quarantine: prefix + "quarantine",
+	}
+}
+
+// Put adds deliveries
+func (queue *redisQueue) Put(deliveries []webhook.Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	_, errTx := queue.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, delivery := range deliveries {
+			buff, errBuff := json.Marshal(&delivery)
+			if errBuff != nil {
+				return errBuff
+			}
+			pipe.HSet(queue.deliveries, delivery.ID, buff)
+			pipe.ZAdd(queue.due, redis.Z{
+				Score:  float64(millis(delivery.Due)),
+				Member: delivery.ID,
+			})
+		}
+		return nil
+	})
+	return errTx
+}
+
+// Due gets the earliest deliveries due by a time
+func (queue *redisQueue) Due(by time.Time, limit int) ([]webhook.Delivery, error) {
+	ids, errRange := queue.client.ZRangeByScore(queue.due, redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(millis(by), 10),
+		Count: int64(limit),
+	}).Result()
+	if errRange != nil || len(ids) == 0 {
+		return nil, errRange
+	}
+
+	values, errGet := queue.client.HMGet(queue.deliveries, ids...).Result()
+	if errGet != nil {
+		return nil, errGet
+	}
+
+	result := make([]webhook.Delivery, 0, len(values))
+	unreadable := make(map[string]string)
+	var quarantined *webhook.QuarantineError
+	for index, value := range values {
+		// Removed since the range was read
+		buff, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		delivery := webhook.Delivery{}
+		errDecode := json.Unmarshal([]byte(buff), &delivery)
+		if errDecode != nil {
+			if quarantined == nil {
+				quarantined = &webhook.QuarantineError{Reason: errDecode}
+			}
+			quarantined.IDs = append(quarantined.IDs, ids[index])
+			unreadable[ids[index]] = buff
+			continue
+		}
+		result = append(result, delivery)
+	}
+
+	if quarantined == nil {
+		return result, nil
+	}
+
+	errQuarantine := queue.setAside(unreadable)
+	if errQuarantine != nil {
+		return nil, errQuarantine
+	}
+	return result, quarantined
+}
+
+// setAside moves deliveries that can't be read out of the queue, and into the
+// quarantine hash.
+func (queue *redisQueue) setAside(unreadable map[string]string) error {
+	_, errTx := queue.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for id, buff := range unreadable {
+			pipe.HSet(queue.quarantine, id, buff)
+			pipe.HDel(queue.deliveries, id)
+			pipe.ZRem(queue.due, id)
+		}
+		return nil
+	})
+	return errTx
+}
+
+// Remove removes deliveries by ID
+func (queue *redisQueue) Remove(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	members := make([]interface{}, len(ids))
+	for index, id := range ids {
+		members[index] = id
+	}
+
+	_, errTx := queue.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HDel(queue.deliveries, ids...)
+		pipe.ZRem(queue.due, members...)
+		return nil
+	})
+	return errTx
+}
+
+// millis gets a time in milliseconds since the epoch
+func millis(at time.Time) int64 {
+	return at.UnixNano() / int64(time.Millisecond)
+}
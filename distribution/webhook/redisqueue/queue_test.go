@@ -0,0 +1,62 @@
+package redisqueue
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing/distribution/webhook"
+	"github.com/go-gadgets/eventsourcing/distribution/webhook/queuetest"
+	"github.com/go-redis/redis"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRedisQueue checks the Redis queue
+func TestRedisQueue(t *testing.T) {
+	address := os.Getenv("REDIS_TEST_HOST")
+	if address == "" {
+		address = "localhost:6379"
+	}
+	client := redis.NewClient(&redis.Options{Addr: address})
+	defer client.Close()
+
+	queuetest.CheckQueue(t, NewQueue(client, fmt.Sprintf("test-%s:", uuid.NewV4())))
+}
+
+// TestRedisQueueQuarantine checks deliveries that can't be read are set aside and
+// reported, without holding up those that can
+func TestRedisQueueQuarantine(t *testing.T) {
+	address := os.Getenv("REDIS_TEST_HOST")
+	if address == "" {
+		address = "localhost:6379"
+	}
+	client := redis.NewClient(&redis.Options{Addr: address})
+	defer client.Close()
+
+	prefix := fmt.Sprintf("test-%s:", uuid.NewV4())
+	queue := NewQueue(client, prefix)
+	start := time.Unix(1000, 0).UTC()
+	assert.Nil(t, queue.Put([]webhook.Delivery{{ID: "good", URL: "http://good", Body: []byte(`{}`), Due: start.Add(time.Second)}}))
+	assert.Nil(t, client.HSet(prefix+"deliveries", "bad", "not json").Err())
+	assert.Nil(t, client.ZAdd(prefix+"due", redis.Z{Score: float64(millis(start)), Member: "bad"}).Err())
+
+	due, errDue := queue.Due(start.Add(time.Minute), 10)
+	quarantined, ok := errDue.(*webhook.QuarantineError)
+	if assert.True(t, ok) {
+		assert.Equal(t, []string{"bad"}, quarantined.IDs)
+	}
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, "good", due[0].ID)
+	}
+
+	// Later reads are no longer held up
+	due, errDue = queue.Due(start.Add(time.Minute), 10)
+	assert.Nil(t, errDue)
+	assert.Len(t, due, 1)
+
+	kept, errKept := client.HGet(prefix+"quarantine", "bad").Result()
+	assert.Nil(t, errKept)
+	assert.Equal(t, "not json", kept)
+}
@@ -2,10 +2,8 @@ package eventsourcing
 
 import (
 	"reflect"
+	"sort"
 	"strings"
-
-	"github.com/go-gadgets/eventsourcing/utilities/mapping"
-	"github.com/mitchellh/mapstructure"
 )
 
 const (
@@ -14,10 +12,13 @@ const (
 )
 
 // EventHandlerBase is a common base type for an event handler that takes events
-// from a publishing source and handles them.
+// from a publishing source and handles them. Handlers that keep state in memory
+// can declare it with UseState, so that it is checkpointed and restored on
+// startup (see utilities/projection) rather than rebuilt from every event.
 type EventHandlerBase struct {
 	eventConsumers map[EventType]consumerFunc // event consumer methods
 	registry       EventRegistry              // Registry for summoning events
+	state          interface{}                // Pointer to the state of the handler, if declared
 }
 
 // Initialize the EventHandlerBase
@@ -31,6 +32,18 @@ func (base *EventHandlerBase) AutomaticWireup(subject interface{}) {
 	base.eventConsumers = buildConsumeMappings(subject)
 }
 
+// UseState declares the state of the handler, as a pointer that is serialized as
+// JSON when checkpointing and decoded into when restoring.
+func (base *EventHandlerBase) UseState(state interface{}) {
+	base.state = state
+}
+
+// State gets the state of the handler declared with UseState, or nil if the
+// handler has none.
+func (base *EventHandlerBase) State() interface{} {
+	return base.state
+}
+
 // Handle processes an event
 func (base *EventHandlerBase) Handle(event PublishedEvent) error {
 	// If we've got a consumer
@@ -39,19 +52,7 @@ func (base *EventHandlerBase) Handle(event PublishedEvent) error {
 		return nil
 	}
 
-	summoned := base.registry.CreateEvent(event.Type)
-	config := &mapstructure.DecoderConfig{
-		DecodeHook:       mapping.MapTimeFromJSON,
-		TagName:          "json",
-		Result:           summoned,
-		WeaklyTypedInput: true,
-	}
-	decoder, errDecoder := mapstructure.NewDecoder(config)
-	if errDecoder != nil {
-		return errDecoder
-	}
-
-	errDecode := decoder.Decode(event.Data)
+	summoned, errDecode := DecodeEvent(base.registry, event.Type, event.Data)
 	if errDecode != nil {
 		return errDecode
 	}
@@ -59,6 +60,18 @@ func (base *EventHandlerBase) Handle(event PublishedEvent) error {
 	return call(event.Key, event.Sequence, summoned)
 }
 
+// Subscriptions gets the event types that have consumer methods, so consumers can
+// skip decoding and dispatching any others.
+func (base *EventHandlerBase) Subscriptions() []EventType {
+	types := make([]EventType, 0, len(base.eventConsumers))
+	for eventType := range base.eventConsumers {
+		types = append(types, eventType)
+	}
+
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
 // consumerFunc is a function that consumes an event from a distribution bus.
 type consumerFunc func(key string, seq int64, evt Event) error
 
@@ -7,6 +7,7 @@ import (
 	"github.com/go-gadgets/eventsourcing/stores/middleware/memorysnap"
 	"github.com/go-gadgets/eventsourcing/stores/middleware/mongosnap"
 	"github.com/go-gadgets/eventsourcing/stores/mongo"
+	"github.com/go-gadgets/eventsourcing/utilities/httpfault"
 	"github.com/sirupsen/logrus"
 )
 
@@ -27,7 +28,7 @@ func main() {
 	store := eventsourcing.NewMiddlewareWrapper(mongoStore)
 
 	// Snapshotting to MongoDB
-	mongoSnap, errSnap := mongosnap.Create(mongosnap.Parameters{
+	mongoSnap, errSnap := mongosnap.CreateMiddleware(mongosnap.Parameters{
 		SnapInterval: 10,
 	}, mongosnap.Endpoint{
 		DialURL:        "mongodb://mongodb-test:27017",
@@ -37,16 +38,24 @@ func main() {
 	if errSnap != nil {
 		panic(errSnap)
 	}
-	store.Use(mongoSnap())
+	if errUse := eventsourcing.UseMiddleware(store, mongoSnap); errUse != nil {
+		panic(errUse)
+	}
 
 	// Create a lazy in-memory snapshot
-	store.Use(memorysnap.Create(memorysnap.Parameters{
+	errCache := eventsourcing.UseMiddleware(store, memorysnap.CreateMiddleware(memorysnap.Parameters{
 		Lazy:         true,
 		SnapInterval: 1,
 	}))
+	if errCache != nil {
+		panic(errCache)
+	}
 
 	// Logging
 	store.Use(logging.Create())
+	if errOrder := eventsourcing.ValidateMiddleware(store, nil); errOrder != nil {
+		panic(errOrder)
+	}
 
 	r := gin.Default()
 	r.GET("/:name/increment", func(c *gin.Context) {
@@ -67,7 +76,7 @@ func main() {
 		})
 
 		if errRun != nil {
-			c.JSON(500, errRun.Error())
+			httpfault.WriteFault(c.Writer, c.Request, errRun)
 			return
 		}
 
@@ -97,7 +106,7 @@ func main() {
 		})
 
 		if errCommand != nil {
-			c.JSON(500, errCommand.Error())
+			httpfault.WriteFault(c.Writer, c.Request, errCommand)
 			return
 		}
 	})
@@ -0,0 +1,62 @@
+module github.com/go-gadgets/eventsourcing/examples
+
+go 1.24.0
+
+require (
+	github.com/gin-gonic/gin v1.1.5-0.20170702092826-d459835d2b07
+	github.com/go-gadgets/eventsourcing v0.0.0-00010101000000-000000000000
+	github.com/go-gadgets/eventsourcing/distribution/kafka v0.0.0-00010101000000-000000000000
+	github.com/go-gadgets/eventsourcing/stores/middleware/mongosnap v0.0.0-00010101000000-000000000000
+	github.com/go-gadgets/eventsourcing/stores/mongo v0.0.0-00010101000000-000000000000
+	github.com/go-gadgets/eventsourcing/utilities/mongodoc v0.0.0-00010101000000-000000000000
+	github.com/satori/go.uuid v1.2.0
+	github.com/sirupsen/logrus v1.0.5
+)
+
+require (
+	github.com/Shopify/sarama v1.16.0 // indirect
+	github.com/bsm/sarama-cluster v2.1.13+incompatible // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/eapache/go-resiliency v1.0.0 // indirect
+	github.com/eapache/go-xerial-snappy v0.0.0-20160609142408-bb955e01b934 // indirect
+	github.com/eapache/queue v1.1.0 // indirect
+	github.com/gin-contrib/sse v0.0.0-20170109093832-22d885f9ecc7 // indirect
+	github.com/golang/protobuf v1.5.4 // indirect
+	github.com/golang/snappy v0.0.4 // indirect
+	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/mattn/go-isatty v0.0.3 // indirect
+	github.com/mitchellh/mapstructure v0.0.0-20180220230111-00c29f56e238 // indirect
+	github.com/montanaflynn/stats v0.7.1 // indirect
+	github.com/nxadm/tail v1.4.8 // indirect
+	github.com/pierrec/lz4 v1.0.2-0.20171218195038-2fcda4cb7018 // indirect
+	github.com/pierrec/xxHash v0.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/rcrowley/go-metrics v0.0.0-20250401214520-65e299d6c5c9 // indirect
+	github.com/stretchr/testify v1.5.1 // indirect
+	github.com/ugorji/go v0.0.0-20180112141927-9831f2c3ac10 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/scram v1.1.2 // indirect
+	github.com/xdg-go/stringprep v1.0.4 // indirect
+	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
+	go.mongodb.org/mongo-driver v1.17.6 // indirect
+	golang.org/x/crypto v0.42.0 // indirect
+	golang.org/x/sync v0.17.0 // indirect
+	golang.org/x/sys v0.36.0 // indirect
+	golang.org/x/term v0.35.0 // indirect
+	golang.org/x/text v0.29.0 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
+	gopkg.in/go-playground/validator.v8 v8.18.2 // indirect
+	gopkg.in/yaml.v2 v2.3.0 // indirect
+)
+
+replace (
+	github.com/go-gadgets/eventsourcing => ..
+	github.com/go-gadgets/eventsourcing/distribution/kafka => ../distribution/kafka
+	github.com/go-gadgets/eventsourcing/stores/middleware/mongosnap => ../stores/middleware/mongosnap
+	github.com/go-gadgets/eventsourcing/stores/mongo => ../stores/mongo
+	github.com/go-gadgets/eventsourcing/utilities/mongodoc => ../utilities/mongodoc
+)
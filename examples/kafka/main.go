@@ -6,7 +6,6 @@ import (
 	"os/signal"
 	"time"
 
-	"github.com/Shopify/sarama"
 	"github.com/gin-gonic/gin"
 	"github.com/go-gadgets/eventsourcing"
 	"github.com/go-gadgets/eventsourcing/distribution/kafka"
@@ -50,7 +49,7 @@ func runClient(group string) {
 	signal.Notify(signals, os.Interrupt)
 
 	brokers := []string{broker}
-	consumer, errConsumer := kafka.CreateConsumer(brokers, topic, group, sarama.OffsetOldest)
+	consumer, errConsumer := kafka.CreateConsumerWithStart(brokers, topic, group, eventsourcing.FromCheckpoint())
 	if errConsumer != nil {
 		panic(errConsumer)
 	}
@@ -91,10 +90,12 @@ func runPublisher() {
 	if errPublisher != nil {
 		panic(errPublisher)
 	}
-	store.Use(publish.Create(pub))
+	if errUse := eventsourcing.UseMiddleware(store, publish.CreateMiddleware(pub)); errUse != nil {
+		panic(errUse)
+	}
 
 	// Snapshotting to MongoDB
-	mongoSnap, errSnap := mongosnap.Create(mongosnap.Parameters{
+	mongoSnap, errSnap := mongosnap.CreateMiddleware(mongosnap.Parameters{
 		SnapInterval: 10,
 	}, mongosnap.Endpoint{
 		DialURL:        dataHost,
@@ -104,15 +105,23 @@ func runPublisher() {
 	if errSnap != nil {
 		panic(errSnap)
 	}
-	store.Use(mongoSnap())
+	if errUse := eventsourcing.UseMiddleware(store, mongoSnap); errUse != nil {
+		panic(errUse)
+	}
 
 	// Create a lazy in-memory snapshot
-	store.Use(memorysnap.Create(memorysnap.Parameters{
+	errCache := eventsourcing.UseMiddleware(store, memorysnap.CreateMiddleware(memorysnap.Parameters{
 		Lazy:         true,
 		SnapInterval: 1,
 	}))
+	if errCache != nil {
+		panic(errCache)
+	}
 	// Logging
 	store.Use(logging.Create())
+	if errOrder := eventsourcing.ValidateMiddleware(store, nil); errOrder != nil {
+		panic(errOrder)
+	}
 
 	// Just publish every second to Kafka
 	for {
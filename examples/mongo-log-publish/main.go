@@ -1,25 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
 	"time"
 
-	"github.com/globalsign/mgo"
-	"github.com/globalsign/mgo/bson"
 	"github.com/go-gadgets/eventsourcing"
 	"github.com/go-gadgets/eventsourcing/distribution/inproc"
 	keyvalue "github.com/go-gadgets/eventsourcing/stores/key-value"
 	"github.com/go-gadgets/eventsourcing/stores/mongo"
+	"github.com/go-gadgets/eventsourcing/utilities/mongodoc"
 	"github.com/go-gadgets/eventsourcing/utilities/test"
 	uuid "github.com/satori/go.uuid"
 )
 
-func init() {
-	bson.SetJSONTagFallback(true)
-}
-
 func main() {
 	dialURL := "mongodb://localhost:27017"
 	database := "ExampleDatabase"
@@ -89,14 +85,13 @@ func (handler *exampleHandler) HandleIncrementEvent(key string, seq int64, event
 // have something to look at.
 func produceDummyEvents(dialURL string, databaseName string, collectionName string) {
 	// Connect to the MongoDB services
-	session, errSession := mgo.Dial(dialURL)
-	if errSession != nil {
-		panic(errSession)
+	client, errDial := mongodoc.Dial(dialURL, 0)
+	if errDial != nil {
+		panic(errDial)
 	}
-	defer session.Close()
+	defer client.Disconnect(context.Background())
 
-	database := session.DB(databaseName)
-	collection := database.C(collectionName)
+	collection := mongodoc.Collection(client.Database(databaseName), collectionName)
 	seq := int64(0)
 
 	key := fmt.Sprintf("%v", uuid.NewV4())
@@ -113,7 +108,7 @@ func produceDummyEvents(dialURL string, databaseName string, collectionName stri
 		}
 
 		fmt.Println("Producer: Inserting dummy event....")
-		collection.Insert(&event)
+		collection.InsertOne(context.Background(), &event)
 
 		// Run again in a second
 		time.Sleep(time.Second)
@@ -1,6 +1,10 @@
 package eventsourcing
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+	"time"
+)
 
 // ConcurrencyFault represents an error that occurred when updating an aggregate:
 // specifically that we have tried to insert events at an index that is already
@@ -66,3 +70,143 @@ func IsDomainFault(err error) (bool, *DomainFault) {
 	}
 	return false, nil
 }
+
+// EventValidationFault represents an error that arose because an event failed
+// validation before being committed, meaning it was never written to the store.
+type EventValidationFault struct {
+	// AggregateKey the event belongs to
+	AggregateKey string `json:"aggregate_key"`
+
+	// EventSequence the event would have been written at
+	EventSequence int64 `json:"event_sequence"`
+
+	// EventType of the invalid event
+	EventType EventType `json:"event_type"`
+
+	// Violations describes each failed rule
+	Violations []string `json:"violations"`
+}
+
+// Error returns the EventValidationFault formatted as a string to meet the Error interface.
+func (curr EventValidationFault) Error() string {
+	return fmt.Sprintf("EventValidationFault: %v at %v on %v: %v", curr.EventType, curr.EventSequence, curr.AggregateKey, strings.Join(curr.Violations, "; "))
+}
+
+// NewEventValidationFault creates an error for an event that failed validation
+func NewEventValidationFault(aggregateKey string, eventSequence int64, eventType EventType, violations []string) error {
+	return EventValidationFault{
+		AggregateKey:  aggregateKey,
+		EventSequence: eventSequence,
+		EventType:     eventType,
+		Violations:    violations,
+	}
+}
+
+// IsEventValidationFault determines if the specified error is an EventValidationFault
+func IsEventValidationFault(err error) (bool, *EventValidationFault) {
+	instance, ok := err.(EventValidationFault)
+	if ok {
+		return true, &instance
+	}
+	return false, nil
+}
+
+// SnapshotTooLargeFault represents an error that arose because a stored snapshot
+// exceeded the configured size limit, and was not restored.
+type SnapshotTooLargeFault struct {
+	// AggregateKey the snapshot belongs to
+	AggregateKey string `json:"aggregate_key"`
+
+	// Sequence the snapshot was taken at
+	Sequence int64 `json:"sequence"`
+
+	// Size is the estimated size of the snapshot in bytes. Measurement stops
+	// once the limit is exceeded, so the snapshot may be larger.
+	Size int64 `json:"size"`
+
+	// Limit is the configured maximum size in bytes
+	Limit int64 `json:"limit"`
+}
+
+// Error returns the SnapshotTooLargeFault formatted as a string to meet the Error interface.
+func (curr SnapshotTooLargeFault) Error() string {
+	return fmt.Sprintf("SnapshotTooLargeFault: %v at %v is over %v bytes (limit %v)", curr.AggregateKey, curr.Sequence, curr.Size, curr.Limit)
+}
+
+// NewSnapshotTooLargeFault creates an error for a snapshot over the size limit
+func NewSnapshotTooLargeFault(aggregateKey string, sequence int64, size int64, limit int64) error {
+	return SnapshotTooLargeFault{
+		AggregateKey: aggregateKey,
+		Sequence:     sequence,
+		Size:         size,
+		Limit:        limit,
+	}
+}
+
+// IsSnapshotTooLargeFault determines if the specified error is a SnapshotTooLargeFault
+func IsSnapshotTooLargeFault(err error) (bool, *SnapshotTooLargeFault) {
+	instance, ok := err.(SnapshotTooLargeFault)
+	if ok {
+		return true, &instance
+	}
+	return false, nil
+}
+
+// StoreUnavailableFault represents an error that arose because a store was
+// considered unavailable (i.e. by a circuit breaker after repeated failures), and
+// the operation was rejected without being attempted.
+type StoreUnavailableFault struct {
+	// Reason the store is unavailable, i.e. the last failure seen
+	Reason string `json:"reason"`
+
+	// RetryAfter is the time until the store will be tried again
+	RetryAfter time.Duration `json:"retry_after"`
+}
+
+// Error returns the StoreUnavailableFault formatted as a string to meet the Error interface.
+func (curr StoreUnavailableFault) Error() string {
+	return fmt.Sprintf("StoreUnavailableFault: retry after %v: %v", curr.RetryAfter, curr.Reason)
+}
+
+// NewStoreUnavailableFault creates an error for an operation rejected because the
+// store is unavailable
+func NewStoreUnavailableFault(reason string, retryAfter time.Duration) error {
+	return StoreUnavailableFault{
+		Reason:     reason,
+		RetryAfter: retryAfter,
+	}
+}
+
+// IsStoreUnavailableFault determines if the specified error is a StoreUnavailableFault
+func IsStoreUnavailableFault(err error) (bool, *StoreUnavailableFault) {
+	instance, ok := err.(StoreUnavailableFault)
+	if ok {
+		return true, &instance
+	}
+	return false, nil
+}
+
+// MiddlewareOrderingFault represents an error that arose because middleware was
+// registered in an order that breaks correctness (see ValidateMiddleware).
+type MiddlewareOrderingFault struct {
+	// Problems are the severe ordering problems found
+	Problems []OrderingProblem `json:"problems"`
+}
+
+// Error returns the MiddlewareOrderingFault formatted as a string to meet the Error interface.
+func (curr MiddlewareOrderingFault) Error() string {
+	described := make([]string, 0, len(curr.Problems))
+	for _, problem := range curr.Problems {
+		described = append(described, fmt.Sprintf("%v wraps %v: %v", problem.Outer, problem.Inner, problem.Reason))
+	}
+	return fmt.Sprintf("MiddlewareOrderingFault: %v", strings.Join(described, "; "))
+}
+
+// IsMiddlewareOrderingFault determines if the specified error is a MiddlewareOrderingFault
+func IsMiddlewareOrderingFault(err error) (bool, *MiddlewareOrderingFault) {
+	instance, ok := err.(MiddlewareOrderingFault)
+	if ok {
+		return true, &instance
+	}
+	return false, nil
+}
@@ -2,6 +2,7 @@ package eventsourcing
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -26,3 +27,35 @@ func TestDomainFault(t *testing.T) {
 	isDomainFault, _ := IsDomainFault(fault)
 	assert.True(t, isDomainFault, "Should be a DomainFault")
 }
+
+// TestEventValidationFault checks that an event validation fault is correct.
+func TestEventValidationFault(t *testing.T) {
+	fault := NewEventValidationFault("foo-key", 3, "IncrementEvent", []string{"a", "b"})
+	assert.Equal(t, fault.Error(), "EventValidationFault: IncrementEvent at 3 on foo-key: a; b", "The EventValidationFault message should be correct.")
+	isDomainFault, _ := IsDomainFault(fault)
+	assert.False(t, isDomainFault, "Should not be a DomainFault")
+	isValidationFault, details := IsEventValidationFault(fault)
+	assert.True(t, isValidationFault, "Should be an EventValidationFault")
+	assert.Equal(t, []string{"a", "b"}, details.Violations)
+}
+
+func TestSnapshotTooLargeFault(t *testing.T) {
+	fault := NewSnapshotTooLargeFault("foo-key", 20, 2048, 1024)
+	assert.Equal(t, fault.Error(), "SnapshotTooLargeFault: foo-key at 20 is over 2048 bytes (limit 1024)", "The SnapshotTooLargeFault message should be correct.")
+	isConcurrencyFault, _ := IsConcurrencyFault(fault)
+	assert.False(t, isConcurrencyFault, "Should not be a ConcurrencyFault")
+	isTooLarge, details := IsSnapshotTooLargeFault(fault)
+	assert.True(t, isTooLarge, "Should be a SnapshotTooLargeFault")
+	assert.Equal(t, int64(1024), details.Limit)
+}
+
+// TestStoreUnavailableFault checks that a store unavailable fault is correct.
+func TestStoreUnavailableFault(t *testing.T) {
+	fault := NewStoreUnavailableFault("no reachable servers", 5*time.Second)
+	assert.Equal(t, fault.Error(), "StoreUnavailableFault: retry after 5s: no reachable servers", "The StoreUnavailableFault message should be correct.")
+	isConcurrencyFault, _ := IsConcurrencyFault(fault)
+	assert.False(t, isConcurrencyFault, "Should not be a ConcurrencyFault")
+	isUnavailable, details := IsStoreUnavailableFault(fault)
+	assert.True(t, isUnavailable, "Should be a StoreUnavailableFault")
+	assert.Equal(t, 5*time.Second, details.RetryAfter)
+}
@@ -0,0 +1,67 @@
+package eventsourcing
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// MetadataFeatureFlags is the event metadata entry that records the feature
+// flags evaluated while producing the events.
+const MetadataFeatureFlags = "features"
+
+// FeatureFlagProvider is an interface for a source of feature flags, which
+// command handlers can consult to control the rollout of new behaviour.
+type FeatureFlagProvider interface {
+	// FeatureEnabled determines if a flag is enabled for the specified aggregate.
+	FeatureEnabled(flag string, aggregateKey string) (bool, error)
+}
+
+// MetadataAdapter is implemented by store writer adapters that have metadata
+// to record alongside the events being committed.
+type MetadataAdapter interface {
+	// GetEventMetadata returns metadata for the uncommitted events, or nil.
+	GetEventMetadata() map[string]interface{}
+}
+
+// StaticFeatureFlags is a fixed set of feature flags. Flags that are not
+// present are disabled.
+type StaticFeatureFlags map[string]bool
+
+// FeatureEnabled determines if a flag is enabled
+func (flags StaticFeatureFlags) FeatureEnabled(flag string, aggregateKey string) (bool, error) {
+	return flags[flag], nil
+}
+
+// environmentFeatureFlags reads feature flags from environment variables.
+type environmentFeatureFlags struct {
+	prefix string
+}
+
+// NewEnvironmentFeatureFlags creates a provider that reads flags from environment
+// variables. The variable for a flag is the prefix followed by the flag name in
+// upper-case, with non-alphanumeric characters replaced by underscores - i.e. with
+// the prefix FEATURE_, the flag "new-pricing" is read from FEATURE_NEW_PRICING.
+func NewEnvironmentFeatureFlags(prefix string) FeatureFlagProvider {
+	return &environmentFeatureFlags{
+		prefix: prefix,
+	}
+}
+
+// FeatureEnabled determines if a flag is enabled
+func (provider *environmentFeatureFlags) FeatureEnabled(flag string, aggregateKey string) (bool, error) {
+	name := provider.prefix + strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, flag)
+
+	value, found := os.LookupEnv(name)
+	if !found || value == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(value)
+}
@@ -0,0 +1,72 @@
+package eventsourcing
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// metadataStore captures the metadata offered by the writer on commit.
+type metadataStore struct {
+	NullStore
+	metadata map[string]interface{}
+}
+
+func (store *metadataStore) CommitEvents(adapter StoreWriterAdapter) error {
+	store.metadata = adapter.(MetadataAdapter).GetEventMetadata()
+	return nil
+}
+
+// TestStaticFeatureFlags checks static flags default to disabled.
+func TestStaticFeatureFlags(t *testing.T) {
+	flags := StaticFeatureFlags{"enabled": true}
+	enabled, _ := flags.FeatureEnabled("enabled", "key")
+	assert.True(t, enabled)
+	enabled, _ = flags.FeatureEnabled("missing", "key")
+	assert.False(t, enabled)
+}
+
+// TestEnvironmentFeatureFlags checks flag names are mapped to variables.
+func TestEnvironmentFeatureFlags(t *testing.T) {
+	os.Setenv("TEST_FEATURE_NEW_PRICING", "true")
+	os.Setenv("TEST_FEATURE_BROKEN", "maybe")
+	defer os.Unsetenv("TEST_FEATURE_NEW_PRICING")
+	defer os.Unsetenv("TEST_FEATURE_BROKEN")
+
+	flags := NewEnvironmentFeatureFlags("TEST_FEATURE_")
+	enabled, errFlag := flags.FeatureEnabled("new-pricing", "key")
+	assert.Nil(t, errFlag)
+	assert.True(t, enabled)
+
+	enabled, errFlag = flags.FeatureEnabled("missing", "key")
+	assert.Nil(t, errFlag)
+	assert.False(t, enabled)
+
+	_, errFlag = flags.FeatureEnabled("broken", "key")
+	assert.NotNil(t, errFlag, "Unparseable values should be reported")
+}
+
+// TestAggregateFeatureFlags checks evaluated flags are recorded as metadata
+// for the next commit only.
+func TestAggregateFeatureFlags(t *testing.T) {
+	store := &metadataStore{}
+	instance := &SimpleAggregate{}
+	instance.Initialize("dummy-key", counterRegistry, store)
+
+	enabled, _ := instance.FeatureEnabled("new-pricing")
+	assert.False(t, enabled, "Flags should be disabled without a provider")
+
+	instance.UseFeatureFlags(StaticFeatureFlags{"new-pricing": true})
+	enabled, _ = instance.FeatureEnabled("new-pricing")
+	assert.True(t, enabled)
+	instance.ApplyEvent(InitializeEvent{TargetValue: 3})
+	assert.Nil(t, instance.Commit())
+	assert.Equal(t, map[string]interface{}{
+		MetadataFeatureFlags: map[string]interface{}{"new-pricing": true},
+	}, store.metadata)
+
+	instance.ApplyEvent(IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, instance.Commit())
+	assert.Nil(t, store.metadata, "Evaluations should be cleared after commit")
+}
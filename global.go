@@ -0,0 +1,48 @@
+package eventsourcing
+
+// GlobalEvent is an event read from the global feed of a store, which contains
+// the events of every aggregate in the store.
+type GlobalEvent struct {
+	PublishedEvent
+
+	// Position of the event within the feed. Positions are specific to the store,
+	// and reading can resume after any position that has been read.
+	Position string `json:"position"`
+
+	// Metadata recorded with the event when it was committed, such as its category
+	// and lineage, if the store keeps it.
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// GlobalReader is an interface implemented by stores that can read every event
+// they contain as a single feed, allowing projections to consume the full
+// firehose directly from the store rather than through a distribution bus.
+// Events of an aggregate are always read in sequence order, but the ordering of
+// events between aggregates is specific to the store. Events are read without an
+// event registry, so their data is undecoded and their domain is unset.
+type GlobalReader interface {
+	// ReadAll reads up to limit events that follow a position in the feed, in feed
+	// order. The empty position reads from the start of the feed.
+	ReadAll(from string, limit int) ([]GlobalEvent, error)
+}
+
+// MetadataCategory is the event metadata entry that records the category of the
+// aggregate that committed the events (see AggregateBase.UseCategory).
+const MetadataCategory = "category"
+
+// CategoryOf gets the category recorded in event metadata, if any.
+func CategoryOf(metadata map[string]interface{}) string {
+	category, _ := metadata[MetadataCategory].(string)
+	return category
+}
+
+// CategoryReader is an interface implemented by stores that can read the events of
+// every aggregate in a category as a single feed, allowing projections of a single
+// aggregate type to be built without reading every stream. Positions are those of
+// the store's global feed (see GlobalReader), and only events committed with a
+// category are included.
+type CategoryReader interface {
+	// ReadCategory reads up to limit events of a category that follow a position in
+	// the feed, in feed order. The empty position reads from the start of the feed.
+	ReadCategory(category string, from string, limit int) ([]GlobalEvent, error)
+}
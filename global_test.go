@@ -0,0 +1,31 @@
+package eventsourcing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAggregateCategory checks the category is recorded in the metadata of every
+// commit, alongside any feature flags.
+func TestAggregateCategory(t *testing.T) {
+	store := &metadataStore{}
+	instance := &SimpleAggregate{}
+	instance.Initialize("dummy-key", counterRegistry, store)
+	instance.ApplyEvent(IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, instance.Commit())
+	assert.Nil(t, store.metadata)
+	assert.Equal(t, "", CategoryOf(store.metadata))
+
+	instance.UseCategory("Counter")
+	instance.UseFeatureFlags(StaticFeatureFlags{"new-pricing": true})
+	instance.FeatureEnabled("new-pricing")
+	instance.ApplyEvent(IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, instance.Commit())
+	assert.Equal(t, "Counter", CategoryOf(store.metadata))
+	assert.NotNil(t, store.metadata[MetadataFeatureFlags])
+
+	instance.ApplyEvent(IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, instance.Commit())
+	assert.Equal(t, map[string]interface{}{MetadataCategory: "Counter"}, store.metadata)
+}
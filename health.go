@@ -0,0 +1,38 @@
+package eventsourcing
+
+import "context"
+
+// HealthChecker is an interface implemented by stores (and other components) that
+// can check their connection to a backend, so that services can report it in
+// readiness probes rather than discovering a broken connection on first commit.
+type HealthChecker interface {
+	// Ping checks that the backend can be reached, within the deadline of the
+	// context if it has one.
+	Ping(ctx context.Context) error
+}
+
+// Ping checks the health of a component. Components that can't check their
+// health are assumed to be healthy.
+func Ping(ctx context.Context, component interface{}) error {
+	checker, ok := component.(HealthChecker)
+	if !ok {
+		return nil
+	}
+	return checker.Ping(ctx)
+}
+
+// PingFunc runs a blocking check that doesn't accept a context, giving up when the
+// context is done. The check carries on in the background if it is abandoned.
+func PingFunc(ctx context.Context, check func() error) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- check()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
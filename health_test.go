@@ -0,0 +1,46 @@
+package eventsourcing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pingingStore is a store that checks its health
+type pingingStore struct {
+	EventStore
+	err error
+}
+
+func (store *pingingStore) Ping(ctx context.Context) error {
+	return store.err
+}
+
+// TestPing checks components without health checks are healthy, and middleware
+// passes health checks to the underlying store
+func TestPing(t *testing.T) {
+	assert.Nil(t, Ping(context.Background(), NewNullStore()))
+
+	inner := &pingingStore{EventStore: NewNullStore(), err: errors.New("Connection refused")}
+	wrapped := NewMiddlewareWrapper(inner)
+	assert.Equal(t, inner.err, Ping(context.Background(), wrapped))
+
+	inner.err = nil
+	assert.Nil(t, Ping(context.Background(), wrapped))
+}
+
+// TestPingFunc checks blocking checks give up with the context
+func TestPingFunc(t *testing.T) {
+	assert.Nil(t, PingFunc(context.Background(), func() error { return nil }))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	errPing := PingFunc(ctx, func() error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, errPing)
+}
@@ -1,6 +1,14 @@
 package eventsourcing
 
-import "strings"
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-gadgets/eventsourcing/utilities/mapping"
+	"github.com/mitchellh/mapstructure"
+)
 
 // Retry retries a block of code, until it hits a limit or the concurrency fault does not occur.
 func Retry(limit int, body func() error) error {
@@ -34,3 +42,37 @@ func NormalizeTypeName(name string) string {
 	segments := strings.Split(name, ".")
 	return segments[len(segments)-1]
 }
+
+// DecodeHookFor gets the decoder hook to use when reviving events or commands
+// for a registry, including any custom type adapters the registry supports.
+func DecodeHookFor(registry interface{}) mapstructure.DecodeHookFunc {
+	adapted, ok := registry.(TypeAdapterRegistry)
+	if ok {
+		return adapted.DecodeHook()
+	}
+
+	return mapping.DefaultDecodeHook()
+}
+
+// FormatKey converts a value-object identifier (typed string, UUID wrapper,
+// integer etc.) into the string form used as an aggregate key.
+func FormatKey(id interface{}) string {
+	switch typed := id.(type) {
+	case string:
+		return typed
+	case fmt.Stringer:
+		return typed.String()
+	case encoding.TextMarshaler:
+		text, errText := typed.MarshalText()
+		if errText == nil {
+			return string(text)
+		}
+	}
+
+	value := reflect.ValueOf(id)
+	if value.Kind() == reflect.String {
+		return value.String()
+	}
+
+	return fmt.Sprintf("%v", id)
+}
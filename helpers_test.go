@@ -3,6 +3,7 @@ package eventsourcing
 import (
 	"testing"
 
+	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -48,3 +49,14 @@ func TestNonRetryableBailout(t *testing.T) {
 	assert.NotNil(t, errOutcome, "The retry should return an error.")
 	assert.Equal(t, 1, count, "The count should be 1 at the end of the test.")
 }
+
+// TestFormatKey checks that identifier types are converted into aggregate keys.
+func TestFormatKey(t *testing.T) {
+	type accountID string
+	id := uuid.NewV4()
+
+	assert.Equal(t, "plain", FormatKey("plain"))
+	assert.Equal(t, "typed", FormatKey(accountID("typed")))
+	assert.Equal(t, "1234", FormatKey(1234))
+	assert.Equal(t, id.String(), FormatKey(id))
+}
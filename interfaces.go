@@ -1,5 +1,10 @@
 package eventsourcing
 
+import (
+	"github.com/go-gadgets/eventsourcing/utilities/mapping"
+	"github.com/mitchellh/mapstructure"
+)
+
 // Aggregate is the interface for an event-sourced aggregate root.
 // All common behaviours of an aggregate expected by the runtime are
 // defined here.
@@ -132,6 +137,28 @@ type EventStoreWithMiddleware interface {
 	HandleRefresh(middleware RefreshMiddleware)
 }
 
+// SnapshotAdminHandler is an optional interface of stores with middleware, that
+// administer the snapshot middleware registered with them (see HandleSnapshots).
+type SnapshotAdminHandler interface {
+	// HandleSnapshots registers snapshot middleware for administration, so that
+	// PurgeSnapshot and RebuildSnapshot reach it through the store
+	HandleSnapshots(admin SnapshotAdmin)
+}
+
+// MiddlewareValidator is an optional interface of stores with middleware, that
+// check their middleware is registered in a sensible order (see UseMiddleware).
+type MiddlewareValidator interface {
+	// UseMiddleware registers a middleware that describes itself, failing if it
+	// can't sensibly wrap the middleware registered before it
+	UseMiddleware(middleware Middleware) error
+
+	// Declare the capabilities of the middleware registered last, by name
+	Declare(name string, capabilities Capability)
+
+	// Validate checks the declared middleware is registered in a sensible order
+	Validate(logger Logger) error
+}
+
 // EventConsumer is an interface that describes a consumer that allows multiple
 // handlers to be attached, allowing events to be multiplexed to the handlers
 // without needing to consume the same stream multiple times.
@@ -170,5 +197,26 @@ type PublishedEvent struct {
 	Data     interface{} `json:"data"`       // Data
 }
 
+// TypeAdapterRegistry is an interface implemented by registries that support
+// custom value-object types (typed strings, UUID wrappers, integers) within
+// events and commands.
+type TypeAdapterRegistry interface {
+	// RegisterTypeAdapter registers an adapter that revives values of the same
+	// type as the example value.
+	RegisterTypeAdapter(example interface{}, adapter mapping.TypeAdapter)
+
+	// DecodeHook gets the decoder hook to use when reviving values.
+	DecodeHook() mapstructure.DecodeHookFunc
+}
+
 // StateFetchFunc is a function that returns the state-value.
 type StateFetchFunc func() interface{}
+
+// SnapshotRestorer is implemented by aggregate states that decode snapshots
+// themselves, rather than having the snapshot decoded over them by a codec (i.e.
+// to migrate older snapshot layouts, or to restore unexported fields).
+type SnapshotRestorer interface {
+	// RestoreSnapshot restores the state from the untyped snapshot, as read from
+	// the snapshot storage.
+	RestoreSnapshot(snapshot interface{}) error
+}
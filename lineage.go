@@ -0,0 +1,73 @@
+package eventsourcing
+
+import "fmt"
+
+// MetadataCorrelationID is the event metadata entry that records the ID of the
+// business transaction the events belong to (see AggregateBase.UseLineage).
+const MetadataCorrelationID = "correlation_id"
+
+// MetadataCausationID is the event metadata entry that records the ID of the
+// command or event that caused the events (see AggregateBase.UseLineage).
+const MetadataCausationID = "causation_id"
+
+// CorrelationIDOf gets the correlation ID recorded in event metadata, if any.
+func CorrelationIDOf(metadata map[string]interface{}) string {
+	id, _ := metadata[MetadataCorrelationID].(string)
+	return id
+}
+
+// CausationIDOf gets the causation ID recorded in event metadata, if any.
+func CausationIDOf(metadata map[string]interface{}) string {
+	id, _ := metadata[MetadataCausationID].(string)
+	return id
+}
+
+// EventID gets the ID an event is referred to by as the cause of other events,
+// i.e. by a saga that reacts to it.
+func EventID(key string, sequence int64) string {
+	return fmt.Sprintf("%v@%v", key, sequence)
+}
+
+// CorrelationReader is an interface implemented by stores that can read the events
+// of a business transaction, across every aggregate that took part in it, as a
+// single feed. Positions are those of the store's global feed (see GlobalReader),
+// and only events committed with a correlation ID are included. The memory and
+// MongoDB stores implement it, as does the DynamoDB store with its global feed
+// enabled.
+type CorrelationReader interface {
+	// ReadCorrelation reads up to limit events with a correlation ID that follow a
+	// position in the feed, in feed order. The empty position reads from the start
+	// of the feed.
+	ReadCorrelation(correlationID string, from string, limit int) ([]GlobalEvent, error)
+}
+
+// LineageNode is an event within the causal tree of a business transaction, with
+// the events that were caused by it.
+type LineageNode struct {
+	Event    GlobalEvent    // The event
+	Children []*LineageNode // Events caused by the event, in feed order
+}
+
+// BuildLineage arranges the events of a business transaction (see
+// CorrelationReader) into their causal tree. Events caused by another of the
+// events are its children, while events caused by a command, or by nothing
+// recorded, are the roots of the tree.
+func BuildLineage(events []GlobalEvent) []*LineageNode {
+	nodes := make(map[string]*LineageNode, len(events))
+	for _, event := range events {
+		nodes[EventID(event.Key, event.Sequence)] = &LineageNode{Event: event}
+	}
+
+	roots := make([]*LineageNode, 0)
+	for _, event := range events {
+		node := nodes[EventID(event.Key, event.Sequence)]
+		parent, found := nodes[CausationIDOf(event.Metadata)]
+		if !found || parent == node {
+			roots = append(roots, node)
+			continue
+		}
+		parent.Children = append(parent.Children, node)
+	}
+
+	return roots
+}
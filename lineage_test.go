@@ -0,0 +1,67 @@
+package eventsourcing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAggregateLineage checks the lineage is recorded in the metadata of the next
+// commit only, and that reacting to an event continues its transaction.
+func TestAggregateLineage(t *testing.T) {
+	store := &metadataStore{}
+	instance := &SimpleAggregate{}
+	instance.Initialize("dummy-key", counterRegistry, store)
+	instance.UseLineage("order-1", "command-1")
+	instance.ApplyEvent(IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, instance.Commit())
+	assert.Equal(t, "order-1", CorrelationIDOf(store.metadata))
+	assert.Equal(t, "command-1", CausationIDOf(store.metadata))
+
+	instance.ApplyEvent(IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, instance.Commit())
+	assert.Nil(t, store.metadata)
+
+	instance.ContinueLineage(GlobalEvent{
+		PublishedEvent: PublishedEvent{Key: "other", Sequence: 3},
+		Metadata:       map[string]interface{}{MetadataCorrelationID: "order-1"},
+	})
+	instance.ApplyEvent(IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, instance.Commit())
+	assert.Equal(t, "order-1", CorrelationIDOf(store.metadata))
+	assert.Equal(t, "other@3", CausationIDOf(store.metadata))
+
+	// An event outside of a transaction starts one
+	instance.ContinueLineage(GlobalEvent{PublishedEvent: PublishedEvent{Key: "other", Sequence: 4}})
+	instance.ApplyEvent(IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, instance.Commit())
+	assert.Equal(t, "other@4", CorrelationIDOf(store.metadata))
+}
+
+// TestBuildLineage checks events are arranged under the events that caused them
+func TestBuildLineage(t *testing.T) {
+	event := func(key string, sequence int64, cause string) GlobalEvent {
+		return GlobalEvent{
+			PublishedEvent: PublishedEvent{Key: key, Sequence: sequence},
+			Metadata:       map[string]interface{}{MetadataCausationID: cause},
+		}
+	}
+
+	roots := BuildLineage([]GlobalEvent{
+		event("order", 1, "place-order"),
+		event("order", 2, "place-order"),
+		event("stock", 1, "order@1"),
+		event("payment", 1, "order@2"),
+		event("order", 3, "payment@1"),
+		event("order", 4, "cancel-order"),
+	})
+
+	assert.Equal(t, 3, len(roots))
+	assert.Equal(t, "order", roots[0].Event.Key)
+	assert.Equal(t, 1, len(roots[0].Children))
+	assert.Equal(t, "stock", roots[0].Children[0].Event.Key)
+	assert.Equal(t, "payment", roots[1].Children[0].Event.Key)
+	assert.Equal(t, int64(3), roots[1].Children[0].Children[0].Event.Sequence)
+	assert.Equal(t, int64(4), roots[2].Event.Sequence)
+	assert.Equal(t, 0, len(roots[2].Children))
+}
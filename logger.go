@@ -0,0 +1,133 @@
+package eventsourcing
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync/atomic"
+)
+
+// LogFields are the structured values attached to a log message.
+type LogFields map[string]interface{}
+
+// Logger is an interface for structured logging, allowing components to log
+// without depending upon a particular logging library.
+type Logger interface {
+	// Debug logs a diagnostic message.
+	Debug(message string, fields LogFields)
+
+	// Info logs an informational message.
+	Info(message string, fields LogFields)
+
+	// Warn logs a message about a recoverable problem.
+	Warn(message string, fields LogFields)
+
+	// Error logs a message about a failure.
+	Error(message string, fields LogFields)
+}
+
+// defaultLogger holds the Logger used by components that aren't given one.
+var defaultLogger atomic.Value
+
+// heldLogger wraps a Logger, since an atomic.Value always holds the same type.
+type heldLogger struct {
+	logger Logger
+}
+
+func init() {
+	defaultLogger.Store(heldLogger{logger: NewSlogLogger(nil)})
+}
+
+// DefaultLogger gets the Logger used by components that aren't given one, such as
+// the snapshot and store middleware. This writes to the default log/slog logger,
+// unless replaced with SetDefaultLogger.
+func DefaultLogger() Logger {
+	return defaultLogger.Load().(heldLogger).logger
+}
+
+// SetDefaultLogger replaces the Logger used by components that aren't given one,
+// i.e. with logadapter.NewLogrusLogger to log through logrus. A nil logger restores
+// the log/slog default.
+func SetDefaultLogger(logger Logger) {
+	if logger == nil {
+		logger = NewSlogLogger(nil)
+	}
+	defaultLogger.Store(heldLogger{logger: logger})
+}
+
+// NoOpLogger is a Logger that discards all messages.
+type NoOpLogger struct{}
+
+// Debug discards the message
+func (NoOpLogger) Debug(message string, fields LogFields) {}
+
+// Info discards the message
+func (NoOpLogger) Info(message string, fields LogFields) {}
+
+// Warn discards the message
+func (NoOpLogger) Warn(message string, fields LogFields) {}
+
+// Error discards the message
+func (NoOpLogger) Error(message string, fields LogFields) {}
+
+// slogLogger is a Logger that writes to the standard library's log/slog.
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger creates a Logger that writes to a log/slog logger, or to the
+// default slog logger if nil. This needs nothing outside the standard library.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return &slogLogger{
+		logger: logger,
+	}
+}
+
+// Debug logs a diagnostic message
+func (wrapped *slogLogger) Debug(message string, fields LogFields) {
+	wrapped.log(slog.LevelDebug, message, fields)
+}
+
+// Info logs an informational message
+func (wrapped *slogLogger) Info(message string, fields LogFields) {
+	wrapped.log(slog.LevelInfo, message, fields)
+}
+
+// Warn logs a message about a recoverable problem
+func (wrapped *slogLogger) Warn(message string, fields LogFields) {
+	wrapped.log(slog.LevelWarn, message, fields)
+}
+
+// Error logs a message about a failure
+func (wrapped *slogLogger) Error(message string, fields LogFields) {
+	wrapped.log(slog.LevelError, message, fields)
+}
+
+// log writes a message at a level, with the fields as attributes.
+func (wrapped *slogLogger) log(level slog.Level, message string, fields LogFields) {
+	logger := wrapped.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	ctx := context.Background()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	attributes := make([]slog.Attr, 0, len(fields))
+	for _, name := range names {
+		value := fields[name]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		attributes = append(attributes, slog.Any(name, value))
+	}
+	logger.LogAttrs(ctx, level, message, attributes...)
+}
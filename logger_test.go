@@ -0,0 +1,49 @@
+package eventsourcing
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSlogLogger checks messages are written with their fields, above the level
+// of the handler.
+func TestSlogLogger(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(buffer, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	})))
+
+	logger.Debug("hidden", nil)
+	logger.Info("started", LogFields{"key": "abc", "seq": 2})
+	logger.Error("failed", LogFields{"error": errors.New("boom")})
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "level=INFO msg=started key=abc seq=2")
+	assert.Contains(t, lines[1], "level=ERROR msg=failed error=boom")
+}
+
+// TestNoOpLogger checks the no-op logger accepts messages.
+func TestNoOpLogger(t *testing.T) {
+	var logger Logger = NoOpLogger{}
+	logger.Debug("debug", nil)
+	logger.Info("info", nil)
+	logger.Warn("warn", nil)
+	logger.Error("error", LogFields{"a": 1})
+}
+
+// TestDefaultLogger checks the default logger can be replaced, and restored.
+func TestDefaultLogger(t *testing.T) {
+	assert.IsType(t, &slogLogger{}, DefaultLogger())
+
+	SetDefaultLogger(NoOpLogger{})
+	assert.Equal(t, NoOpLogger{}, DefaultLogger())
+
+	SetDefaultLogger(nil)
+	assert.IsType(t, &slogLogger{}, DefaultLogger())
+}
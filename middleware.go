@@ -1,5 +1,10 @@
 package eventsourcing
 
+import (
+	"context"
+	"fmt"
+)
+
 // NextHandler is a callback function that runs the next handler in a middleware
 // chain.
 type NextHandler func() error
@@ -18,12 +23,91 @@ type CloseMiddleware func() error
 // MiddlewareFactory is a middleware callback that provides all 3 items.
 type MiddlewareFactory func() (CommitMiddleware, RefreshMiddleware, CloseMiddleware)
 
+// Middleware is a middleware that describes itself, so that the store it is used
+// with can check it is registered in a sensible place in the chain (see
+// UseMiddleware).
+type Middleware struct {
+	Name         string            // Name of the middleware, as reported in ordering problems
+	Capabilities Capability        // What the middleware does
+	Commit       CommitMiddleware  // Commit middleware, if any
+	Refresh      RefreshMiddleware // Refresh middleware, if any
+	Close        func() error      // Cleanup function, if any
+}
+
+// Describe creates a middleware from its commit, refresh and cleanup functions.
+func Describe(name string, capabilities Capability, commit CommitMiddleware, refresh RefreshMiddleware, cleanup func() error) Middleware {
+	return Middleware{
+		Name:         name,
+		Capabilities: capabilities,
+		Commit:       commit,
+		Refresh:      refresh,
+		Close:        cleanup,
+	}
+}
+
+// IsNoOp returns true if a commit has no events to write. Stores accept such
+// commits without writing anything, and middleware should skip any side-effects
+// (snapshots, publishing) for them.
+func IsNoOp(writer StoreWriterAdapter) bool {
+	_, events := writer.GetUncommittedEvents()
+	return len(events) == 0
+}
+
+// UseMiddleware registers a middleware that describes itself with a store. Stores
+// that check the order of their middleware (see MiddlewareValidator) fail with a
+// MiddlewareOrderingFault if it can't sensibly wrap the middleware registered
+// before it, while other stores register it unchecked.
+func UseMiddleware(store EventStoreWithMiddleware, middleware Middleware) error {
+	validator, ok := store.(MiddlewareValidator)
+	if !ok {
+		store.Use(middleware.Commit, middleware.Refresh, middleware.Close)
+		return nil
+	}
+
+	return validator.UseMiddleware(middleware)
+}
+
+// DeclareMiddleware declares the capabilities of the middleware registered last
+// with a store, if the store checks the order of its middleware.
+func DeclareMiddleware(store EventStoreWithMiddleware, name string, capabilities Capability) {
+	validator, ok := store.(MiddlewareValidator)
+	if ok {
+		validator.Declare(name, capabilities)
+	}
+}
+
+// ValidateMiddleware checks the middleware of a store is registered in a sensible
+// order, if the store checks the order of its middleware.
+func ValidateMiddleware(store EventStoreWithMiddleware, logger Logger) error {
+	validator, ok := store.(MiddlewareValidator)
+	if !ok {
+		return nil
+	}
+
+	return validator.Validate(logger)
+}
+
+// HandleSnapshots registers snapshot middleware for administration with a store,
+// so that PurgeSnapshot and RebuildSnapshot reach it, failing if the store
+// doesn't administer snapshots (see SnapshotAdminHandler).
+func HandleSnapshots(store EventStoreWithMiddleware, admin SnapshotAdmin) error {
+	handler, ok := store.(SnapshotAdminHandler)
+	if !ok {
+		return fmt.Errorf("StoreError: Store %T does not administer snapshots", store)
+	}
+
+	handler.HandleSnapshots(admin)
+	return nil
+}
+
 // wrapper is our wrapper type that creates a middleware enabled-store
 type wrapper struct {
-	commit  []CommitMiddleware  // Commit middlewares
-	refresh []RefreshMiddleware // Refresh middlewares
-	cleanup []func() error      // Cleanup functions
-	inner   EventStore          // Event store we are wrapping
+	commit    []CommitMiddleware  // Commit middlewares
+	refresh   []RefreshMiddleware // Refresh middlewares
+	cleanup   []func() error      // Cleanup functions
+	snapshots []SnapshotAdmin     // Snapshot middleware to administer
+	declared  []declared          // Middleware whose capabilities are declared, in registration order
+	inner     EventStore          // Event store we are wrapping
 }
 
 // NewMiddlewareWrapper is an event-store wrapper that provides the ability to
@@ -71,6 +155,74 @@ func (store *wrapper) HandleRefresh(middleware RefreshMiddleware) {
 	store.refresh = append(store.refresh, middleware)
 }
 
+// HandleSnapshots registers snapshot middleware for administration
+func (store *wrapper) HandleSnapshots(admin SnapshotAdmin) {
+	if admin == nil {
+		return
+	}
+
+	store.snapshots = append(store.snapshots, admin)
+}
+
+// UseMiddleware registers a middleware that describes itself, declaring its
+// capabilities. Middleware that would wrap the middleware before it in a way that
+// breaks correctness is not registered, and fails with a MiddlewareOrderingFault.
+func (store *wrapper) UseMiddleware(middleware Middleware) error {
+	layer := declared{
+		name:         middleware.Name,
+		capabilities: middleware.Capabilities,
+	}
+
+	severe := make([]OrderingProblem, 0)
+	for _, problem := range orderingProblems(append(append([]declared{}, store.declared...), layer)) {
+		if problem.Severe && problem.Outer == layer.name {
+			severe = append(severe, problem)
+		}
+	}
+	if len(severe) > 0 {
+		return MiddlewareOrderingFault{Problems: severe}
+	}
+
+	store.Use(middleware.Commit, middleware.Refresh, middleware.Close)
+	store.declared = append(store.declared, layer)
+	return nil
+}
+
+// Declare the capabilities of the middleware registered last, so that Validate
+// can check it is in a sensible place in the chain
+func (store *wrapper) Declare(name string, capabilities Capability) {
+	store.declared = append(store.declared, declared{
+		name:         name,
+		capabilities: capabilities,
+	})
+}
+
+// Validate checks the order of the declared middleware, including the middleware
+// registered through UseMiddleware. Problems that break
+// correctness fail with a MiddlewareOrderingFault, while others are logged as
+// warnings to the logger, if there is one.
+func (store *wrapper) Validate(logger Logger) error {
+	severe := make([]OrderingProblem, 0)
+	for _, problem := range orderingProblems(store.declared) {
+		if problem.Severe {
+			severe = append(severe, problem)
+			continue
+		}
+		if logger != nil {
+			logger.Warn("Middleware ordering problem", LogFields{
+				"outer":  problem.Outer,
+				"inner":  problem.Inner,
+				"reason": problem.Reason,
+			})
+		}
+	}
+
+	if len(severe) > 0 {
+		return MiddlewareOrderingFault{Problems: severe}
+	}
+	return nil
+}
+
 // CommitEvents stores any events for the specified aggregate that are uncommitted
 // at this point in time.
 func (store *wrapper) CommitEvents(writer StoreWriterAdapter) error {
@@ -108,6 +260,56 @@ func (store *wrapper) Refresh(reader StoreLoaderAdapter) error {
 	return chain()
 }
 
+// Version gets the version of an aggregate from the underlying store. Version
+// queries bypass the middleware.
+func (store *wrapper) Version(key string) (int64, error) {
+	return Version(store.inner, key)
+}
+
+// Compact compacts a stream of the underlying store. Compaction bypasses the
+// middleware.
+func (store *wrapper) Compact(key string, sequence int64, state interface{}) (int64, error) {
+	return Compact(store.inner, key, sequence, state)
+}
+
+// PurgeSnapshot deletes the snapshot of an aggregate from every registered
+// snapshot middleware, or from the underlying store if none are registered.
+func (store *wrapper) PurgeSnapshot(key string) error {
+	if len(store.snapshots) == 0 {
+		return PurgeSnapshot(store.inner, key)
+	}
+
+	for _, admin := range store.snapshots {
+		errPurge := admin.PurgeSnapshot(key)
+		if errPurge != nil {
+			return errPurge
+		}
+	}
+	return nil
+}
+
+// RebuildSnapshot has every registered snapshot middleware, or the underlying
+// store if none are registered, rebuild the snapshot of an aggregate.
+func (store *wrapper) RebuildSnapshot(key string) error {
+	if len(store.snapshots) == 0 {
+		return RebuildSnapshot(store.inner, key)
+	}
+
+	for _, admin := range store.snapshots {
+		errRebuild := admin.RebuildSnapshot(key)
+		if errRebuild != nil {
+			return errRebuild
+		}
+	}
+	return nil
+}
+
+// Ping checks the health of the underlying store. Health checks bypass the
+// middleware.
+func (store *wrapper) Ping(ctx context.Context) error {
+	return Ping(ctx, store.inner)
+}
+
 // Close shuts down the the store driver
 func (store *wrapper) Close() error {
 	for _, c := range store.cleanup {
@@ -0,0 +1,202 @@
+package eventsourcing
+
+import "fmt"
+
+// OrderingGuarantee describes the ordering semantics that a publisher, consumer
+// or composite of them provides when delivering events.
+type OrderingGuarantee int
+
+const (
+	// OrderingUnordered indicates that events may be delivered in any order.
+	OrderingUnordered OrderingGuarantee = iota
+
+	// OrderingPerKey indicates that events for a single aggregate key are
+	// delivered in sequence order, but events for different keys may interleave.
+	OrderingPerKey
+
+	// OrderingGlobal indicates that all events are delivered in the order
+	// they were published.
+	OrderingGlobal
+)
+
+// String returns a human readable name for the guarantee.
+func (guarantee OrderingGuarantee) String() string {
+	switch guarantee {
+	case OrderingUnordered:
+		return "unordered"
+	case OrderingPerKey:
+		return "per-key"
+	case OrderingGlobal:
+		return "global"
+	}
+
+	return fmt.Sprintf("OrderingGuarantee(%d)", int(guarantee))
+}
+
+// OrderingGuarantee returns the guarantee itself, so that a fixed guarantee can be
+// combined with those of components (see CombineOrdering).
+func (guarantee OrderingGuarantee) OrderingGuarantee() OrderingGuarantee {
+	return guarantee
+}
+
+// Satisfies checks if this guarantee is at least as strong as the required one.
+func (guarantee OrderingGuarantee) Satisfies(required OrderingGuarantee) bool {
+	return guarantee >= required
+}
+
+// OrderedComponent is implemented by publishers, consumers and composites that
+// can report the ordering guarantee they provide.
+type OrderedComponent interface {
+	// OrderingGuarantee reports the ordering semantics of the component.
+	OrderingGuarantee() OrderingGuarantee
+}
+
+// OrderingOf determines the ordering guarantee of a component. Components that
+// do not report a guarantee are assumed to be unordered.
+func OrderingOf(component interface{}) OrderingGuarantee {
+	ordered, ok := component.(OrderedComponent)
+	if !ok {
+		return OrderingUnordered
+	}
+
+	return ordered.OrderingGuarantee()
+}
+
+// CombineOrdering computes the guarantee of a pipeline built from several
+// components, which is the weakest guarantee of any of its parts.
+func CombineOrdering(components ...interface{}) OrderingGuarantee {
+	result := OrderingGlobal
+	for _, component := range components {
+		current := OrderingOf(component)
+		if current < result {
+			result = current
+		}
+	}
+
+	return result
+}
+
+// FeedOrdering determines the ordering guarantee of the global feed of a store
+// (see GlobalReader). Stores can report the ordering of their feed by implementing
+// OrderedComponent, and are otherwise assumed to order events per aggregate key,
+// as every feed must.
+func FeedOrdering(store interface{}) OrderingGuarantee {
+	if _, ok := store.(OrderedComponent); !ok {
+		return OrderingPerKey
+	}
+
+	return CombineOrdering(store)
+}
+
+// RequireOrdering checks that a pipeline built from the components provides at
+// least the required guarantee, allowing integrators to assert the semantics
+// they depend upon at startup.
+func RequireOrdering(required OrderingGuarantee, components ...interface{}) error {
+	actual := CombineOrdering(components...)
+	if !actual.Satisfies(required) {
+		return fmt.Errorf("Ordering requirement not met: required %v, pipeline provides %v", required, actual)
+	}
+
+	return nil
+}
+
+// fanOutPublisher is a publisher that distributes each event to a set of
+// inner publishers, in order.
+type fanOutPublisher struct {
+	publishers []EventPublisher
+}
+
+// NewFanOutPublisher creates a publisher that publishes every event to each
+// of the specified publishers in turn, stopping at the first failure.
+func NewFanOutPublisher(publishers ...EventPublisher) EventPublisher {
+	return &fanOutPublisher{
+		publishers: publishers,
+	}
+}
+
+// Publish an event to all of the inner publishers.
+func (fanOut *fanOutPublisher) Publish(key string, sequence int64, event Event) error {
+	for _, publisher := range fanOut.publishers {
+		errPublish := publisher.Publish(key, sequence, event)
+		if errPublish != nil {
+			return errPublish
+		}
+	}
+
+	return nil
+}
+
+// OrderingGuarantee is the weakest guarantee of the inner publishers.
+func (fanOut *fanOutPublisher) OrderingGuarantee() OrderingGuarantee {
+	components := make([]interface{}, len(fanOut.publishers))
+	for index, publisher := range fanOut.publishers {
+		components[index] = publisher
+	}
+
+	return CombineOrdering(components...)
+}
+
+// multiplexConsumer is a consumer that delivers the events of a set of inner
+// consumers to the same handlers.
+type multiplexConsumer struct {
+	consumers []EventConsumer
+}
+
+// NewMultiplexConsumer creates a consumer that multiplexes the events of several
+// consumers (i.e. of different topics or domains) into the same handlers. Handlers
+// are added to every consumer, and the consumers are started and stopped together.
+func NewMultiplexConsumer(consumers ...EventConsumer) EventConsumer {
+	return &multiplexConsumer{
+		consumers: consumers,
+	}
+}
+
+// AddHandler adds a handler to every inner consumer.
+func (multiplex *multiplexConsumer) AddHandler(handler EventHandler) {
+	for _, consumer := range multiplex.consumers {
+		consumer.AddHandler(handler)
+	}
+}
+
+// Start every inner consumer, stopping those already started if one fails.
+func (multiplex *multiplexConsumer) Start() error {
+	for index, consumer := range multiplex.consumers {
+		errStart := consumer.Start()
+		if errStart != nil {
+			for _, started := range multiplex.consumers[:index] {
+				started.Stop()
+			}
+			return errStart
+		}
+	}
+
+	return nil
+}
+
+// Stop every inner consumer, returning the first failure.
+func (multiplex *multiplexConsumer) Stop() error {
+	var result error
+	for _, consumer := range multiplex.consumers {
+		errStop := consumer.Stop()
+		if errStop != nil && result == nil {
+			result = errStop
+		}
+	}
+
+	return result
+}
+
+// OrderingGuarantee is the weakest guarantee of the inner consumers. Events of
+// different consumers interleave, so several consumers are ordered per key at best,
+// as long as the events of an aggregate arrive through a single consumer.
+func (multiplex *multiplexConsumer) OrderingGuarantee() OrderingGuarantee {
+	components := make([]interface{}, 0, len(multiplex.consumers)+1)
+	for _, consumer := range multiplex.consumers {
+		components = append(components, consumer)
+	}
+	if len(multiplex.consumers) > 1 {
+		components = append(components, OrderingPerKey)
+	}
+
+	return CombineOrdering(components...)
+}
@@ -0,0 +1,123 @@
+package eventsourcing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// orderedPublisher is a publisher with a fixed ordering guarantee
+type orderedPublisher struct {
+	guarantee OrderingGuarantee
+	published int
+}
+
+// Publish counts the published event
+func (pub *orderedPublisher) Publish(key string, sequence int64, event Event) error {
+	pub.published++
+	return nil
+}
+
+// OrderingGuarantee returns the configured guarantee
+func (pub *orderedPublisher) OrderingGuarantee() OrderingGuarantee {
+	return pub.guarantee
+}
+
+// TestCombineOrdering checks that composites report the weakest guarantee.
+func TestCombineOrdering(t *testing.T) {
+	global := &orderedPublisher{guarantee: OrderingGlobal}
+	perKey := &orderedPublisher{guarantee: OrderingPerKey}
+
+	assert.Equal(t, OrderingGlobal, CombineOrdering(global))
+	assert.Equal(t, OrderingPerKey, CombineOrdering(global, perKey))
+	assert.Equal(t, OrderingUnordered, CombineOrdering(global, NewNullStore()))
+	assert.Equal(t, "per-key", OrderingPerKey.String())
+}
+
+// TestRequireOrdering checks that requirements are validated.
+func TestRequireOrdering(t *testing.T) {
+	global := &orderedPublisher{guarantee: OrderingGlobal}
+	perKey := &orderedPublisher{guarantee: OrderingPerKey}
+
+	assert.Nil(t, RequireOrdering(OrderingPerKey, global, perKey))
+	assert.NotNil(t, RequireOrdering(OrderingGlobal, global, perKey))
+}
+
+// TestFanOutPublisher checks the fan-out publishes to all targets and reports
+// the combined guarantee.
+func TestFanOutPublisher(t *testing.T) {
+	global := &orderedPublisher{guarantee: OrderingGlobal}
+	perKey := &orderedPublisher{guarantee: OrderingPerKey}
+	fanOut := NewFanOutPublisher(global, perKey)
+
+	errPublish := fanOut.Publish("dummy-key", 1, IncrementEvent{IncrementBy: 1})
+
+	assert.Nil(t, errPublish)
+	assert.Equal(t, 1, global.published)
+	assert.Equal(t, 1, perKey.published)
+	assert.Equal(t, OrderingPerKey, OrderingOf(fanOut))
+}
+
+// orderedConsumer is a consumer with a fixed ordering guarantee
+type orderedConsumer struct {
+	guarantee OrderingGuarantee
+	handlers  []EventHandler
+	running   bool
+	failStart bool
+}
+
+// Start starts the consumer, unless it's set to fail
+func (consumer *orderedConsumer) Start() error {
+	if consumer.failStart {
+		return assert.AnError
+	}
+	consumer.running = true
+	return nil
+}
+
+// Stop stops the consumer
+func (consumer *orderedConsumer) Stop() error {
+	consumer.running = false
+	return nil
+}
+
+// AddHandler records the handler
+func (consumer *orderedConsumer) AddHandler(handler EventHandler) {
+	consumer.handlers = append(consumer.handlers, handler)
+}
+
+// OrderingGuarantee returns the configured guarantee
+func (consumer *orderedConsumer) OrderingGuarantee() OrderingGuarantee {
+	return consumer.guarantee
+}
+
+// TestMultiplexConsumer checks handlers reach every consumer, consumers start and
+// stop together, and several consumers are ordered per key at best.
+func TestMultiplexConsumer(t *testing.T) {
+	first := &orderedConsumer{guarantee: OrderingGlobal}
+	second := &orderedConsumer{guarantee: OrderingGlobal}
+	multiplex := NewMultiplexConsumer(first, second)
+	multiplex.AddHandler(nil)
+	assert.Len(t, first.handlers, 1)
+	assert.Len(t, second.handlers, 1)
+	assert.Equal(t, OrderingPerKey, OrderingOf(multiplex))
+	assert.Equal(t, OrderingGlobal, OrderingOf(NewMultiplexConsumer(first)))
+	assert.Equal(t, OrderingUnordered, OrderingOf(NewMultiplexConsumer(first, &orderedConsumer{})))
+
+	assert.Nil(t, multiplex.Start())
+	assert.True(t, first.running && second.running)
+	assert.Nil(t, multiplex.Stop())
+	assert.False(t, first.running || second.running)
+
+	failing := NewMultiplexConsumer(first, &orderedConsumer{failStart: true})
+	assert.NotNil(t, failing.Start())
+	assert.False(t, first.running)
+}
+
+// TestFeedOrdering checks feeds are ordered per key unless the store reports
+// otherwise.
+func TestFeedOrdering(t *testing.T) {
+	assert.Equal(t, OrderingPerKey, FeedOrdering(NewNullStore()))
+	assert.Equal(t, OrderingGlobal, FeedOrdering(&orderedPublisher{guarantee: OrderingGlobal}))
+	assert.Equal(t, OrderingPerKey, CombineOrdering(OrderingGlobal, OrderingPerKey))
+}
@@ -1,5 +1,16 @@
 /*
 Package eventsourcing contains the core implementation of an event-sourcing framework
 written in Golang.
+
+Constrained builds (i.e. cold-start sensitive functions) are opt-in. By default,
+registries revive events and snapshots with mapstructure (see CodecFor), and the
+drivers' default loggers write through logrus. Choosing encoding/json and log/slog
+keeps both libraries out of the hot path:
+
+	registry.(eventsourcing.CodecRegistry).UseCodec(eventsourcing.JSONCodec{})
+	eventsourcing.SetDefaultLogger(eventsourcing.NewSlogLogger(nil))
+
+The snapshot and store middleware log through DefaultLogger, which is a log/slog
+logger unless replaced, or through the Logger of their options.
 */
 package eventsourcing
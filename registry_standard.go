@@ -2,13 +2,21 @@ package eventsourcing
 
 import (
 	"reflect"
+	"sort"
+
+	"github.com/go-gadgets/eventsourcing/utilities/mapping"
+	"github.com/mitchellh/mapstructure"
 )
 
 // The standardEventRegistry is the default implementation of EventRegistry that stores
 // event information for an aggregate in an internally managed structure.
 type standardEventRegistry struct {
-	domain string                     // Name of the domain
-	events map[EventType]reflect.Type // events to type mapping
+	domain     string                     // Name of the domain
+	events     map[EventType]reflect.Type // events to type mapping
+	adapters   mapping.TypeAdapters       // custom type adapters
+	deprecated map[EventType]EventType    // deprecated events to replacement mapping
+	codec      *Codec                     // codec used to revive events, nil for default
+	revisions  *revisionSet               // previous revisions of event types
 }
 
 // NewStandardEventRegistry creates an instance of a plain EventRegistry that
@@ -16,8 +24,12 @@ type standardEventRegistry struct {
 // is the name of the domain/bounded-context in which our events live.
 func NewStandardEventRegistry(domain string) EventRegistry {
 	return &standardEventRegistry{
-		domain: domain,
-		events: make(map[EventType]reflect.Type),
+		domain:     domain,
+		events:     make(map[EventType]reflect.Type),
+		adapters:   make(mapping.TypeAdapters),
+		deprecated: make(map[EventType]EventType),
+		codec:      new(Codec),
+		revisions:  newRevisionSet(),
 	}
 }
 
@@ -58,3 +70,77 @@ func (reg standardEventRegistry) GetEventType(event interface{}) (EventType, boo
 	_, found := reg.events[eventType]
 	return eventType, found
 }
+
+// EventTypes gets the registered event types, in name order.
+func (reg standardEventRegistry) EventTypes() []EventType {
+	result := make([]EventType, 0, len(reg.events))
+	for eventType := range reg.events {
+		result = append(result, eventType)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// RegisterTypeAdapter registers an adapter that revives values of the same type
+// as the example value, allowing custom identifier types to be used in events.
+func (reg standardEventRegistry) RegisterTypeAdapter(example interface{}, adapter mapping.TypeAdapter) {
+	reg.adapters.Register(example, adapter)
+}
+
+// DecodeHook gets the decoder hook to use when reviving events.
+func (reg standardEventRegistry) DecodeHook() mapstructure.DecodeHookFunc {
+	return reg.adapters.DecodeHook()
+}
+
+// UseCodec sets the codec used to revive events, i.e. JSONCodec to keep
+// mapstructure out of the hot path.
+func (reg standardEventRegistry) UseCodec(codec Codec) {
+	*reg.codec = codec
+}
+
+// Codec gets the codec used to revive events, or nil for the default.
+func (reg standardEventRegistry) Codec() Codec {
+	return *reg.codec
+}
+
+// DeprecateEvent marks an event type as deprecated in favour of a replacement.
+func (reg standardEventRegistry) DeprecateEvent(eventType EventType, replacement EventType) {
+	reg.deprecated[eventType] = replacement
+}
+
+// GetDeprecation gets the replacement for a deprecated event type.
+func (reg standardEventRegistry) GetDeprecation(eventType EventType) (EventType, bool) {
+	replacement, deprecated := reg.deprecated[eventType]
+	return replacement, deprecated
+}
+
+// DeprecatedEvents gets all deprecated event types, mapped to their replacements.
+func (reg standardEventRegistry) DeprecatedEvents() map[EventType]EventType {
+	result := make(map[EventType]EventType, len(reg.deprecated))
+	for eventType, replacement := range reg.deprecated {
+		result[eventType] = replacement
+	}
+	return result
+}
+
+// RegisterRevision registers a previous revision of an event type, with the
+// upgrade to the current revision.
+func (reg standardEventRegistry) RegisterRevision(eventType EventType, previous Event, upgrade UpgradeFunc) {
+	reg.revisions.register(eventType, previous, upgrade)
+}
+
+// Revisions gets the previous revisions of an event type, newest first.
+func (reg standardEventRegistry) Revisions(eventType EventType) []Revision {
+	return reg.revisions.get(eventType)
+}
+
+// RecordFallback counts an event that was decoded as a previous revision.
+func (reg standardEventRegistry) RecordFallback(eventType EventType) {
+	reg.revisions.record(eventType)
+}
+
+// Fallbacks gets the number of events of each type decoded as a previous revision.
+func (reg standardEventRegistry) Fallbacks() map[EventType]int64 {
+	return reg.revisions.counts()
+}
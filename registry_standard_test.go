@@ -1,7 +1,15 @@
 package eventsourcing
 
-import "testing"
-import "github.com/stretchr/testify/assert"
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/mitchellh/mapstructure"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
 
 // Notes: The remainder of the testing of this registry is more than amply covered by other tests, for now.
 
@@ -14,3 +22,84 @@ func TestRegistryStandardCreateUnmappedEvent(t *testing.T) {
 	_, ok := instance.(map[string]interface{})
 	assert.True(t, ok, "The instance should a map[string]interface{}")
 }
+
+// OrderID is a value-object identifier used for testing type adapters.
+type OrderID struct {
+	Value int
+}
+
+// CustomerID is a typed-string identifier.
+type CustomerID string
+
+// OrderPlacedEvent is an event with custom identifier fields.
+type OrderPlacedEvent struct {
+	Order    OrderID    `json:"order"`
+	Customer CustomerID `json:"customer"`
+	Tracking uuid.UUID  `json:"tracking"`
+}
+
+// TestRegistryStandardTypeAdapters checks that custom identifier types can be revived
+// from their serialized forms using registry type adapters.
+func TestRegistryStandardTypeAdapters(t *testing.T) {
+	registry := NewStandardEventRegistry("Testing")
+	eventType := registry.RegisterEvent(OrderPlacedEvent{})
+	registry.(TypeAdapterRegistry).RegisterTypeAdapter(OrderID{}, func(data interface{}) (interface{}, error) {
+		value, errConvert := strconv.Atoi(fmt.Sprintf("%v", data))
+		return OrderID{Value: value}, errConvert
+	})
+
+	tracking := uuid.NewV4()
+	summoned := registry.CreateEvent(eventType)
+	decoder, errDecoder := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       DecodeHookFor(registry),
+		TagName:          "json",
+		Result:           summoned,
+		WeaklyTypedInput: true,
+	})
+	assert.Nil(t, errDecoder)
+
+	errDecode := decoder.Decode(map[string]interface{}{
+		"order":    json.Number("1234"),
+		"customer": "customer-1",
+		"tracking": tracking.String(),
+	})
+	assert.Nil(t, errDecode)
+
+	event := summoned.(*OrderPlacedEvent)
+	assert.Equal(t, OrderID{Value: 1234}, event.Order)
+	assert.Equal(t, CustomerID("customer-1"), event.Customer)
+	assert.Equal(t, tracking, event.Tracking)
+}
+
+// TestRegistryStandardDeprecation checks deprecated events keep replaying, and
+// report their replacement.
+func TestRegistryStandardDeprecation(t *testing.T) {
+	registry := NewStandardEventRegistry("Testing")
+	oldType := registry.RegisterEvent(OrderPlacedEvent{})
+	registry.(DeprecationRegistry).DeprecateEvent(oldType, EventType("OrderSubmittedEvent"))
+
+	replacement, deprecated := registry.(DeprecationRegistry).GetDeprecation(oldType)
+	assert.True(t, deprecated)
+	assert.Equal(t, EventType("OrderSubmittedEvent"), replacement)
+
+	_, deprecated = registry.(DeprecationRegistry).GetDeprecation(EventType("OrderSubmittedEvent"))
+	assert.False(t, deprecated)
+
+	_, ok := registry.CreateEvent(oldType).(*OrderPlacedEvent)
+	assert.True(t, ok, "Deprecated events should still be created")
+
+	assert.Equal(t, map[EventType]EventType{oldType: "OrderSubmittedEvent"}, DeprecationsFor(registry))
+	assert.Empty(t, DeprecationsFor(struct{}{}))
+}
+
+// TestRegistryStandardCatalog checks registries list their types in name order.
+func TestRegistryStandardCatalog(t *testing.T) {
+	events := NewStandardEventRegistry("Testing")
+	events.RegisterEvent(OrderPlacedEvent{})
+	events.RegisterEvent(OrderID{})
+	assert.Equal(t, []EventType{"OrderID", "OrderPlacedEvent"}, events.(EventCatalog).EventTypes())
+
+	commands := NewStandardCommandRegistry("Testing")
+	commands.RegisterCommand(CustomerID(""))
+	assert.Equal(t, []CommandType{"CustomerID"}, commands.(CommandCatalog).CommandTypes())
+}
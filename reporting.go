@@ -0,0 +1,139 @@
+package eventsourcing
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Operations that faults are reported from.
+const (
+	OperationCommand = "command" // Handling a command against an aggregate
+	OperationConsume = "consume" // Handling a published event
+	OperationCommit  = "commit"  // Committing events to a store
+	OperationRefresh = "refresh" // Refreshing an aggregate from a store
+)
+
+// ErrorReport describes a fault, and where it arose, for an error-tracking tool.
+type ErrorReport struct {
+	Err         error       // Error that occurred, or that a panic was converted into
+	Panic       interface{} // Value passed to panic, if the fault was a panic
+	Stack       []byte      // Stack trace of a panic
+	Operation   string      // Operation that failed, i.e. OperationCommand
+	Domain      string      // Domain of the aggregate or event, if known
+	Key         string      // Aggregate key, if known
+	Sequence    int64       // Sequence of the aggregate or event, if known
+	EventType   EventType   // Type of the event being handled or committed, if known
+	CommandType CommandType // Type of the command being handled, if known
+}
+
+// Reporter is an interface for a sink of faults, such as Sentry or Rollbar,
+// allowing production faults to reach error-tracking tools automatically.
+// Reporters must be safe for use from multiple goroutines, and shouldn't block
+// for long, since they're called on the path of the failing operation.
+type Reporter interface {
+	// Report a fault.
+	Report(report ErrorReport)
+}
+
+// ReporterFunc adapts a function into a Reporter.
+type ReporterFunc func(report ErrorReport)
+
+// Report calls the underlying function
+func (fn ReporterFunc) Report(report ErrorReport) {
+	fn(report)
+}
+
+// NoOpReporter is a Reporter that discards all faults.
+type NoOpReporter struct{}
+
+// Report discards the fault
+func (NoOpReporter) Report(report ErrorReport) {}
+
+// RecoverPanics runs a function, converting any panic into an error that is
+// reported with the context of the report. Without a reporter, panics are not
+// recovered.
+func RecoverPanics(reporter Reporter, report ErrorReport, body func() error) (err error) {
+	if reporter == nil {
+		return body()
+	}
+
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+
+		report.Panic = recovered
+		report.Stack = debug.Stack()
+		report.Err = fmt.Errorf("Panic during %v: %v", report.Operation, recovered)
+		reporter.Report(report)
+		err = report.Err
+	}()
+
+	return body()
+}
+
+// IsExpectedFault determines if an error is one that arises during normal
+// operation, such as a concurrency conflict or a rejected command, and so
+// shouldn't be reported as a fault.
+func IsExpectedFault(err error) bool {
+	if ok, _ := IsConcurrencyFault(err); ok {
+		return true
+	}
+	if ok, _ := IsDomainFault(err); ok {
+		return true
+	}
+	if ok, _ := IsEventValidationFault(err); ok {
+		return true
+	}
+	return false
+}
+
+// reportingHandler is an event handler that reports the faults of another.
+type reportingHandler struct {
+	handler  EventHandler
+	reporter Reporter
+}
+
+// ReportingHandler wraps an event handler so that the errors it returns, and any
+// panics, are reported with the context of the event being handled. Panics are
+// returned as errors, so that consumers treat them as failed deliveries. Wrap
+// handlers before adding them to a consumer.
+func ReportingHandler(handler EventHandler, reporter Reporter) EventHandler {
+	return &reportingHandler{
+		handler:  handler,
+		reporter: reporter,
+	}
+}
+
+// Subscriptions gets the event types of the wrapped handler, if it has any
+func (wrapped *reportingHandler) Subscriptions() []EventType {
+	types, _ := SubscriptionsFor(wrapped.handler)
+	return types
+}
+
+// Handle the event, reporting any fault
+func (wrapped *reportingHandler) Handle(event PublishedEvent) error {
+	report := ErrorReport{
+		Operation: OperationConsume,
+		Domain:    event.Domain,
+		Key:       event.Key,
+		Sequence:  event.Sequence,
+		EventType: event.Type,
+	}
+
+	panicked := false
+	errHandle := RecoverPanics(ReporterFunc(func(report ErrorReport) {
+		panicked = true
+		wrapped.reporter.Report(report)
+	}), report, func() error {
+		return wrapped.handler.Handle(event)
+	})
+
+	if errHandle != nil && !panicked && !IsExpectedFault(errHandle) {
+		report.Err = errHandle
+		wrapped.reporter.Report(report)
+	}
+
+	return errHandle
+}
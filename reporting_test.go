@@ -0,0 +1,125 @@
+package eventsourcing
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// PanickingAggregate is an aggregate whose command handler panics.
+type PanickingAggregate struct {
+	AggregateBase
+}
+
+// HandleInitializeCommand panics.
+func (agg *PanickingAggregate) HandleInitializeCommand(command InitializeCommand) ([]Event, error) {
+	panic("handler failed")
+}
+
+// recordingReporter collects the reports it receives.
+type recordingReporter struct {
+	reports []ErrorReport
+}
+
+func (reporter *recordingReporter) Report(report ErrorReport) {
+	reporter.reports = append(reporter.reports, report)
+}
+
+// handlerFunc adapts a function into an event handler.
+type handlerFunc func(event PublishedEvent) error
+
+func (fn handlerFunc) Handle(event PublishedEvent) error {
+	return fn(event)
+}
+
+// TestCommandPanicReported checks that panics while handling a command are
+// reported and returned as errors, once a reporter is set.
+func TestCommandPanicReported(t *testing.T) {
+	instance := &PanickingAggregate{}
+	instance.Initialize("panic-key", counterRegistry, NewNullStore(), func() interface{} { return instance })
+	instance.AutomaticWireup(instance)
+
+	assert.Panics(t, func() {
+		instance.Handle(InitializeCommand{TargetValue: 3})
+	}, "Panics aren't recovered without a reporter")
+
+	reporter := &recordingReporter{}
+	instance.UseReporter(reporter)
+	errHandle := instance.Handle(InitializeCommand{TargetValue: 3})
+	assert.NotNil(t, errHandle)
+	assert.Equal(t, 1, len(reporter.reports))
+
+	report := reporter.reports[0]
+	assert.Equal(t, OperationCommand, report.Operation)
+	assert.Equal(t, "Testing", report.Domain)
+	assert.Equal(t, "panic-key", report.Key)
+	assert.Equal(t, CommandType("eventsourcing.InitializeCommand"), report.CommandType)
+	assert.Equal(t, "handler failed", report.Panic)
+	assert.Equal(t, errHandle, report.Err)
+	assert.NotEmpty(t, report.Stack)
+}
+
+// TestCommandErrorsNotReported checks that errors returned by command handlers
+// are left to the caller.
+func TestCommandErrorsNotReported(t *testing.T) {
+	reporter := &recordingReporter{}
+	instance := &SimpleAggregate{}
+	instance.Initialize("dummy-key", counterRegistry, CreateErrorStore(errors.New("failed")))
+	instance.UseReporter(reporter)
+
+	assert.NotNil(t, instance.Handle(InitializeCommand{TargetValue: 3}))
+	assert.Empty(t, reporter.reports)
+}
+
+// TestReportingHandler checks that handler faults are reported with the context
+// of the event.
+func TestReportingHandler(t *testing.T) {
+	reporter := &recordingReporter{}
+	var result error
+	handler := ReportingHandler(handlerFunc(func(event PublishedEvent) error {
+		if result == nil {
+			panic("consumer failed")
+		}
+		return result
+	}), reporter)
+
+	event := PublishedEvent{
+		Domain:   "Testing",
+		Type:     "InitializeEvent",
+		Key:      "consume-key",
+		Sequence: 4,
+	}
+
+	// Panics are returned as errors
+	errPanic := handler.Handle(event)
+	assert.NotNil(t, errPanic)
+	assert.Equal(t, 1, len(reporter.reports))
+	assert.Equal(t, "consumer failed", reporter.reports[0].Panic)
+
+	// Errors are reported
+	result = errors.New("handler failed")
+	assert.Equal(t, result, handler.Handle(event))
+	assert.Equal(t, 2, len(reporter.reports))
+	report := reporter.reports[1]
+	assert.Equal(t, result, report.Err)
+	assert.Nil(t, report.Panic)
+	assert.Equal(t, OperationConsume, report.Operation)
+	assert.Equal(t, "Testing", report.Domain)
+	assert.Equal(t, "consume-key", report.Key)
+	assert.Equal(t, int64(4), report.Sequence)
+	assert.Equal(t, EventType("InitializeEvent"), report.EventType)
+
+	// Expected faults aren't
+	result = NewConcurrencyFault("consume-key", 4)
+	assert.NotNil(t, handler.Handle(event))
+	assert.Equal(t, 2, len(reporter.reports))
+}
+
+// TestNoOpReporter checks the no-op reporter discards faults.
+func TestNoOpReporter(t *testing.T) {
+	errRun := RecoverPanics(NoOpReporter{}, ErrorReport{Operation: OperationCommit}, func() error {
+		panic("discarded")
+	})
+	assert.NotNil(t, errRun)
+}
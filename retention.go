@@ -0,0 +1,44 @@
+package eventsourcing
+
+import "time"
+
+// RetentionPolicy describes the events of a stream that must be kept, allowing the
+// growth of streams for high-churn aggregates to be bounded. Only events that are
+// covered by a snapshot may be removed, since the stream could not be replayed
+// without them, and the event at the snapshot's sequence is always kept so that
+// the next commit can follow on from it. Of the remaining events, those kept by
+// any rule of the policy are retained, and the rest may be removed.
+type RetentionPolicy struct {
+	KeepEvents int64         `json:"keep_events"` // Most recent events always kept, zero for no count rule
+	KeepFor    time.Duration `json:"keep_for"`    // Events younger than this are always kept, zero for no age rule
+}
+
+// Horizon gets the highest sequence of a stream that the policy allows to be
+// removed, based on the sequence of its latest snapshot and latest event. Events up
+// to the horizon may still be kept by the age rule. Zero means that no events can
+// be removed.
+func (policy RetentionPolicy) Horizon(snapshot int64, latest int64) int64 {
+	horizon := snapshot - 1
+	if policy.KeepEvents > 0 && latest-policy.KeepEvents < horizon {
+		horizon = latest - policy.KeepEvents
+	}
+	if horizon < 0 {
+		return 0
+	}
+	return horizon
+}
+
+// Expired reports whether an event committed at the specified time is too old to
+// be kept by the age rule of the policy.
+func (policy RetentionPolicy) Expired(committed time.Time, now time.Time) bool {
+	return policy.KeepFor <= 0 || now.Sub(committed) >= policy.KeepFor
+}
+
+// RetentionStore is an interface implemented by stores that can remove events that
+// a retention policy no longer keeps.
+type RetentionStore interface {
+	// Prune removes the events of a stream that are covered by a snapshot at the
+	// specified sequence and that the policy does not keep, returning the number
+	// of events removed.
+	Prune(key string, snapshot int64, policy RetentionPolicy) (int64, error)
+}
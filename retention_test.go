@@ -0,0 +1,26 @@
+package eventsourcing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRetentionHorizon checks only snapshotted events beyond the count rule can be removed.
+func TestRetentionHorizon(t *testing.T) {
+	assert.Equal(t, int64(0), RetentionPolicy{}.Horizon(0, 10), "Nothing is removable without a snapshot")
+	assert.Equal(t, int64(0), RetentionPolicy{}.Horizon(1, 10))
+	assert.Equal(t, int64(7), RetentionPolicy{}.Horizon(8, 10), "The snapshotted event is kept")
+	assert.Equal(t, int64(5), RetentionPolicy{KeepEvents: 5}.Horizon(8, 10))
+	assert.Equal(t, int64(7), RetentionPolicy{KeepEvents: 2}.Horizon(8, 10))
+	assert.Equal(t, int64(0), RetentionPolicy{KeepEvents: 20}.Horizon(8, 10))
+}
+
+// TestRetentionExpired checks the age rule.
+func TestRetentionExpired(t *testing.T) {
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	assert.True(t, RetentionPolicy{}.Expired(now, now), "Without an age rule, age doesn't keep events")
+	assert.False(t, RetentionPolicy{KeepFor: time.Hour}.Expired(now.Add(-time.Minute), now))
+	assert.True(t, RetentionPolicy{KeepFor: time.Hour}.Expired(now.Add(-time.Hour), now))
+}
@@ -0,0 +1,144 @@
+package eventsourcing
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// UpgradeFunc converts an event of a previous revision (the value, not a pointer)
+// into the current revision of its type.
+type UpgradeFunc func(previous Event) (Event, error)
+
+// Revision is a previous shape of an event type, which can still be decoded and
+// upgraded to the current shape.
+type Revision struct {
+	Factory EventFactory // Creates an instance of the previous revision to decode into
+	Upgrade UpgradeFunc  // Converts the previous revision into the current one
+}
+
+// RevisionRegistry is an interface implemented by registries that keep previous
+// revisions of event types. While the shape of an event changes, a mixed-version
+// fleet publishes both shapes under the same type: events that can't be decoded
+// into the current shape are decoded as a previous revision and upgraded instead
+// (see DecodeEvent), and the fallbacks are counted so that it is clear when the
+// previous revision is no longer seen and can be removed.
+type RevisionRegistry interface {
+	// RegisterRevision registers a previous revision of an event type, with the
+	// upgrade to the current revision. Revisions are tried newest first, so they
+	// should be registered oldest first.
+	RegisterRevision(eventType EventType, previous Event, upgrade UpgradeFunc)
+
+	// Revisions gets the previous revisions of an event type, newest first.
+	Revisions(eventType EventType) []Revision
+
+	// RecordFallback counts an event that was decoded as a previous revision.
+	RecordFallback(eventType EventType)
+
+	// Fallbacks gets the number of events of each type decoded as a previous revision.
+	Fallbacks() map[EventType]int64
+}
+
+// DecodeEvent revives the data of an event into a new instance of its type, as
+// created by the registry. If the data can't be decoded, and the registry keeps
+// previous revisions of the type, each revision is tried in turn and the first
+// that decodes is upgraded to the current type.
+func DecodeEvent(registry EventRegistry, eventType EventType, data interface{}) (Event, error) {
+	codec := CodecFor(registry)
+	current := registry.CreateEvent(eventType)
+	errDecode := codec.Decode(data, current)
+	if errDecode == nil {
+		return current, nil
+	}
+
+	revisions, ok := registry.(RevisionRegistry)
+	if !ok {
+		return nil, errDecode
+	}
+
+	for _, revision := range revisions.Revisions(eventType) {
+		previous := revision.Factory()
+		if codec.Decode(data, previous) != nil {
+			continue
+		}
+
+		upgraded, errUpgrade := revision.Upgrade(reflect.ValueOf(previous).Elem().Interface())
+		if errUpgrade != nil {
+			return nil, errUpgrade
+		}
+
+		revisions.RecordFallback(eventType)
+		return asPointer(upgraded, current)
+	}
+
+	return nil, errDecode
+}
+
+// asPointer converts an upgraded event to a pointer of the current type.
+func asPointer(upgraded Event, current Event) (Event, error) {
+	target := reflect.TypeOf(current)
+	value := reflect.ValueOf(upgraded)
+	if value.Type() == target {
+		return upgraded, nil
+	}
+	if target.Kind() != reflect.Ptr || value.Type() != target.Elem() {
+		return nil, fmt.Errorf("Revision upgrade returned %v, expected %v", value.Type(), target.Elem())
+	}
+
+	pointer := reflect.New(target.Elem())
+	pointer.Elem().Set(value)
+	return pointer.Interface(), nil
+}
+
+// revisionSet holds the previous revisions of event types, and counts fallbacks.
+type revisionSet struct {
+	lock      sync.Mutex
+	revisions map[EventType][]Revision
+	fallbacks map[EventType]int64
+}
+
+// newRevisionSet creates an empty set of revisions
+func newRevisionSet() *revisionSet {
+	return &revisionSet{
+		revisions: make(map[EventType][]Revision),
+		fallbacks: make(map[EventType]int64),
+	}
+}
+
+// register adds a previous revision of an event type
+func (set *revisionSet) register(eventType EventType, previous Event, upgrade UpgradeFunc) {
+	previousType := reflect.TypeOf(previous)
+	revision := Revision{
+		Factory: func() Event { return reflect.New(previousType).Interface() },
+		Upgrade: upgrade,
+	}
+
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	set.revisions[eventType] = append([]Revision{revision}, set.revisions[eventType]...)
+}
+
+// get gets the revisions of an event type, newest first
+func (set *revisionSet) get(eventType EventType) []Revision {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	return append([]Revision{}, set.revisions[eventType]...)
+}
+
+// record counts a fallback
+func (set *revisionSet) record(eventType EventType) {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	set.fallbacks[eventType]++
+}
+
+// counts gets a copy of the fallback counts
+func (set *revisionSet) counts() map[EventType]int64 {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	result := make(map[EventType]int64, len(set.fallbacks))
+	for eventType, count := range set.fallbacks {
+		result[eventType] = count
+	}
+	return result
+}
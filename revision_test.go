@@ -0,0 +1,91 @@
+package eventsourcing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// PaymentEvent is the current revision of a payment, in cents
+type PaymentEvent struct {
+	Cents int `json:"amount"`
+}
+
+// paymentEventV1 is the previous revision of a payment, in dollars
+type paymentEventV1 struct {
+	Dollars float64 `json:"amount"`
+}
+
+// upgradePayment converts dollars into cents
+func upgradePayment(previous Event) (Event, error) {
+	return PaymentEvent{Cents: int(previous.(paymentEventV1).Dollars*100 + 0.5)}, nil
+}
+
+// paymentHandler totals payments
+type paymentHandler struct {
+	EventHandlerBase
+	total int
+}
+
+// HandlePaymentEvent adds to the total
+func (handler *paymentHandler) HandlePaymentEvent(key string, seq int64, event PaymentEvent) error {
+	handler.total += event.Cents
+	return nil
+}
+
+// paymentRegistry creates a registry with the payment event
+func paymentRegistry() EventRegistry {
+	registry := NewStandardEventRegistry("Payments")
+	registry.RegisterEvent(PaymentEvent{})
+	return registry
+}
+
+// TestDecodeEventFallback checks events that don't decode are upgraded from a
+// previous revision
+func TestDecodeEventFallback(t *testing.T) {
+	registry := paymentRegistry()
+	revisions := registry.(RevisionRegistry)
+	revisions.RegisterRevision("PaymentEvent", paymentEventV1{}, upgradePayment)
+
+	current, errCurrent := DecodeEvent(registry, "PaymentEvent", map[string]interface{}{"amount": 1250})
+	assert.Nil(t, errCurrent)
+	assert.Equal(t, &PaymentEvent{Cents: 1250}, current)
+	assert.Empty(t, revisions.Fallbacks())
+
+	upgraded, errUpgraded := DecodeEvent(registry, "PaymentEvent", map[string]interface{}{"amount": "12.50"})
+	assert.Nil(t, errUpgraded)
+	assert.Equal(t, &PaymentEvent{Cents: 1250}, upgraded)
+	assert.Equal(t, map[EventType]int64{"PaymentEvent": 1}, revisions.Fallbacks())
+
+	_, errInvalid := DecodeEvent(registry, "PaymentEvent", map[string]interface{}{"amount": "twelve"})
+	assert.NotNil(t, errInvalid, "Data matching no revision should fail")
+}
+
+// TestDecodeEventWithoutRevisions checks decode failures are returned
+func TestDecodeEventWithoutRevisions(t *testing.T) {
+	_, errDecode := DecodeEvent(paymentRegistry(), "PaymentEvent", map[string]interface{}{"amount": "12.50"})
+	assert.NotNil(t, errDecode)
+}
+
+// TestDecodeEventBadUpgrade checks upgrades must produce the current type
+func TestDecodeEventBadUpgrade(t *testing.T) {
+	registry := paymentRegistry()
+	registry.(RevisionRegistry).RegisterRevision("PaymentEvent", paymentEventV1{}, func(previous Event) (Event, error) {
+		return previous, nil
+	})
+
+	_, errDecode := DecodeEvent(registry, "PaymentEvent", map[string]interface{}{"amount": "12.50"})
+	assert.NotNil(t, errDecode)
+}
+
+// TestHandlerDualDecode checks handlers receive upgraded events
+func TestHandlerDualDecode(t *testing.T) {
+	registry := paymentRegistry()
+	registry.(RevisionRegistry).RegisterRevision("PaymentEvent", paymentEventV1{}, upgradePayment)
+	handler := &paymentHandler{}
+	handler.Initialize(registry, handler)
+
+	assert.Nil(t, handler.Handle(PublishedEvent{Type: "PaymentEvent", Key: "a", Sequence: 1, Data: map[string]interface{}{"amount": 500}}))
+	assert.Nil(t, handler.Handle(PublishedEvent{Type: "PaymentEvent", Key: "a", Sequence: 2, Data: map[string]interface{}{"amount": "2.25"}}))
+	assert.Equal(t, 725, handler.total)
+}
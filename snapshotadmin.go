@@ -0,0 +1,39 @@
+package eventsourcing
+
+import "fmt"
+
+// SnapshotAdmin is implemented by snapshot middleware, and by stores that use it,
+// so that operators can invalidate snapshots (i.e. corrupt snapshots written by a
+// bad deploy) without editing the snapshot storage by hand.
+type SnapshotAdmin interface {
+	// PurgeSnapshot deletes the snapshot of an aggregate, so that it is next loaded
+	// by replaying its events.
+	PurgeSnapshot(key string) error
+
+	// RebuildSnapshot purges the snapshot of an aggregate, and writes a fresh
+	// snapshot of its full history the next time it is loaded. To rebuild a
+	// snapshot straight away, use AggregateBase.RebuildSnapshot.
+	RebuildSnapshot(key string) error
+}
+
+// PurgeSnapshot deletes the snapshot of an aggregate, if the store keeps
+// snapshots.
+func PurgeSnapshot(store EventStore, key string) error {
+	admin, ok := store.(SnapshotAdmin)
+	if !ok {
+		return fmt.Errorf("StoreError: Store %T does not keep snapshots", store)
+	}
+
+	return admin.PurgeSnapshot(key)
+}
+
+// RebuildSnapshot purges the snapshot of an aggregate, and has a fresh snapshot
+// written the next time it is loaded, if the store keeps snapshots.
+func RebuildSnapshot(store EventStore, key string) error {
+	admin, ok := store.(SnapshotAdmin)
+	if !ok {
+		return fmt.Errorf("StoreError: Store %T does not keep snapshots", store)
+	}
+
+	return admin.RebuildSnapshot(key)
+}
@@ -0,0 +1,70 @@
+package eventsourcing
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingAdmin records the snapshot operations it is asked to perform
+type recordingAdmin struct {
+	purged  []string
+	rebuilt []string
+	err     error
+}
+
+func (admin *recordingAdmin) PurgeSnapshot(key string) error {
+	admin.purged = append(admin.purged, key)
+	return admin.err
+}
+
+func (admin *recordingAdmin) RebuildSnapshot(key string) error {
+	admin.rebuilt = append(admin.rebuilt, key)
+	return admin.err
+}
+
+// adminStore is a store that keeps snapshots itself
+type adminStore struct {
+	NullStore
+	recordingAdmin
+}
+
+// TestSnapshotAdminUnsupported checks stores without snapshots are rejected
+func TestSnapshotAdminUnsupported(t *testing.T) {
+	assert.NotNil(t, PurgeSnapshot(&NullStore{}, "key"))
+	assert.NotNil(t, RebuildSnapshot(&NullStore{}, "key"))
+	assert.NotNil(t, PurgeSnapshot(NewMiddlewareWrapper(&NullStore{}), "key"))
+}
+
+// TestSnapshotAdminWrapper checks operations reach every registered middleware
+func TestSnapshotAdminWrapper(t *testing.T) {
+	first, second := &recordingAdmin{}, &recordingAdmin{}
+	store := NewMiddlewareWrapper(&NullStore{})
+	assert.Nil(t, HandleSnapshots(store, first))
+	assert.Nil(t, HandleSnapshots(store, nil))
+	assert.Nil(t, HandleSnapshots(store, second))
+
+	assert.Nil(t, PurgeSnapshot(store, "purged"))
+	assert.Nil(t, RebuildSnapshot(store, "rebuilt"))
+	assert.Equal(t, []string{"purged"}, first.purged)
+	assert.Equal(t, []string{"purged"}, second.purged)
+	assert.Equal(t, []string{"rebuilt"}, first.rebuilt)
+	assert.Equal(t, []string{"rebuilt"}, second.rebuilt)
+
+	first.err = errors.New("unavailable")
+	assert.Equal(t, first.err, PurgeSnapshot(store, "failed"))
+	assert.Equal(t, []string{"purged"}, second.purged, "Operations should stop at the first failure")
+}
+
+// TestSnapshotAdminInner checks wrappers without snapshot middleware defer to
+// the store they wrap
+func TestSnapshotAdminInner(t *testing.T) {
+	inner := &adminStore{}
+	store := NewMiddlewareWrapper(inner)
+
+	assert.Nil(t, PurgeSnapshot(store, "purged"))
+	assert.Nil(t, RebuildSnapshot(store, "rebuilt"))
+	assert.Equal(t, []string{"purged"}, inner.purged)
+	assert.Equal(t, []string{"rebuilt"}, inner.rebuilt)
+}
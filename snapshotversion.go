@@ -0,0 +1,90 @@
+package eventsourcing
+
+import (
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// stateVersions caches the hashed snapshot versions of state types
+var stateVersions sync.Map
+
+// SnapshotVersioner is implemented by aggregate states that declare the version of
+// their snapshot schema. Bump the version whenever a change to the state would
+// restore incorrectly from an older snapshot, such as renaming or retyping a field.
+// States that don't declare a version are versioned by a hash of their field set.
+type SnapshotVersioner interface {
+	// SnapshotVersion gets the version of the snapshot schema
+	SnapshotVersion() string
+}
+
+// StateVersion gets the snapshot schema version of an aggregate state: the declared
+// version if the state implements SnapshotVersioner, or otherwise a hash of the
+// names, json tags and types of its fields (including those of nested structs).
+func StateVersion(state interface{}) string {
+	if versioner, ok := state.(SnapshotVersioner); ok {
+		return versioner.SnapshotVersion()
+	}
+	if state == nil {
+		return ""
+	}
+
+	stateType := reflect.TypeOf(state)
+	if cached, ok := stateVersions.Load(stateType); ok {
+		return cached.(string)
+	}
+
+	digest := fnv.New64a()
+	hashFields(stateType, digest, make(map[reflect.Type]bool))
+	version := fmt.Sprintf("fields:%016x", digest.Sum64())
+	stateVersions.Store(stateType, version)
+	return version
+}
+
+// SnapshotVersionOf gets the snapshot schema version of the aggregate behind an
+// adapter, or an empty string if the adapter can't tell.
+func SnapshotVersionOf(adapter interface{}) string {
+	versioner, ok := adapter.(SnapshotVersioner)
+	if !ok {
+		return ""
+	}
+	return versioner.SnapshotVersion()
+}
+
+// hashFields writes the shape of a type to the hash
+func hashFields(subject reflect.Type, digest hash.Hash, seen map[reflect.Type]bool) {
+	for subject.Kind() == reflect.Ptr || subject.Kind() == reflect.Slice || subject.Kind() == reflect.Array || subject.Kind() == reflect.Map {
+		if subject.Kind() == reflect.Map {
+			digest.Write([]byte("map[" + subject.Key().String() + "]"))
+		}
+		subject = subject.Elem()
+	}
+	if subject.Kind() != reflect.Struct || seen[subject] {
+		digest.Write([]byte(subject.String() + ";"))
+		return
+	}
+	seen[subject] = true
+
+	digest.Write([]byte("{"))
+	for index := 0; index < subject.NumField(); index++ {
+		field := subject.Field(index)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		digest.Write([]byte(name + ":"))
+		hashFields(field.Type, digest, seen)
+	}
+	digest.Write([]byte("}"))
+}
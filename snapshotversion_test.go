@@ -0,0 +1,65 @@
+package eventsourcing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// counterState is a snapshot state
+type counterState struct {
+	AggregateBase
+	Count int `json:"count"`
+	Notes []struct {
+		Text string `json:"text"`
+	} `json:"notes"`
+	cache int
+}
+
+// renamedState renames a nested field of counterState
+type renamedState struct {
+	AggregateBase
+	Count int `json:"count"`
+	Notes []struct {
+		Body string `json:"body"`
+	} `json:"notes"`
+	cache int
+}
+
+// sameShapeState has the same fields as counterState, ignoring unserialized ones
+type sameShapeState struct {
+	AggregateBase
+	Count int `json:"count"`
+	Notes []struct {
+		Text string `json:"text"`
+	} `json:"notes"`
+	Scratch string `json:"-"`
+}
+
+// declaredState declares its snapshot version
+type declaredState struct {
+	counterState
+}
+
+// SnapshotVersion gets the declared version
+func (state *declaredState) SnapshotVersion() string {
+	return "2"
+}
+
+// TestStateVersion checks versions follow the serialized field set, unless declared
+func TestStateVersion(t *testing.T) {
+	counter := StateVersion(&counterState{})
+	assert.NotEmpty(t, counter)
+	assert.Equal(t, counter, StateVersion(&counterState{Count: 5}))
+	assert.Equal(t, counter, StateVersion(&sameShapeState{}))
+	assert.NotEqual(t, counter, StateVersion(&renamedState{}))
+	assert.Equal(t, "2", StateVersion(&declaredState{}))
+	assert.Equal(t, "", StateVersion(nil))
+}
+
+// TestSnapshotVersionOf checks aggregate adapters report the version of their state
+func TestSnapshotVersionOf(t *testing.T) {
+	state := &declaredState{}
+	assert.Equal(t, "2", SnapshotVersionOf(&aggregateBaseLoaderAdapter{aggregate: &state.AggregateBase, state: state}))
+	assert.Equal(t, "", SnapshotVersionOf(struct{}{}))
+}
@@ -0,0 +1,83 @@
+package eventsourcing
+
+import (
+	"fmt"
+	"time"
+)
+
+// StartKind identifies where a consumer begins reading events.
+type StartKind int
+
+const (
+	// StartCheckpoint resumes from the consumer's stored checkpoint. Consumers
+	// without a checkpoint fall back to their configured default.
+	StartCheckpoint StartKind = iota
+
+	// StartBeginning reads from the oldest retained event, ignoring any checkpoint.
+	StartBeginning
+
+	// StartLatest reads only events published after the consumer starts,
+	// ignoring any checkpoint.
+	StartLatest
+
+	// StartTimestamp reads from the first event published at or after a
+	// point in time, ignoring any checkpoint.
+	StartTimestamp
+
+	// StartPosition reads from a transport-specific position (i.e. a Kafka
+	// offset or MongoDB oplog timestamp), ignoring any checkpoint.
+	StartPosition
+)
+
+// StartMode describes where a consumer begins reading events. Every mode other
+// than FromCheckpoint replaces the consumer's checkpoint when it starts, and is
+// intended for backfills and reprocessing - once started, progress is
+// checkpointed as normal. The zero value is FromCheckpoint.
+type StartMode struct {
+	Kind      StartKind // Kind of start position
+	Timestamp time.Time // Time to start from, for StartTimestamp
+	Position  int64     // Position to start from, for StartPosition
+}
+
+// FromCheckpoint resumes from the consumer's stored checkpoint.
+func FromCheckpoint() StartMode {
+	return StartMode{Kind: StartCheckpoint}
+}
+
+// FromBeginning reads from the oldest retained event.
+func FromBeginning() StartMode {
+	return StartMode{Kind: StartBeginning}
+}
+
+// FromLatest reads only events published after the consumer starts.
+func FromLatest() StartMode {
+	return StartMode{Kind: StartLatest}
+}
+
+// FromTimestamp reads from the first event published at or after a time.
+func FromTimestamp(timestamp time.Time) StartMode {
+	return StartMode{Kind: StartTimestamp, Timestamp: timestamp}
+}
+
+// FromPosition reads from a transport-specific position.
+func FromPosition(position int64) StartMode {
+	return StartMode{Kind: StartPosition, Position: position}
+}
+
+// String returns a human readable description of the mode.
+func (mode StartMode) String() string {
+	switch mode.Kind {
+	case StartCheckpoint:
+		return "checkpoint"
+	case StartBeginning:
+		return "beginning"
+	case StartLatest:
+		return "latest"
+	case StartTimestamp:
+		return fmt.Sprintf("timestamp(%v)", mode.Timestamp.Format(time.RFC3339Nano))
+	case StartPosition:
+		return fmt.Sprintf("position(%d)", mode.Position)
+	}
+
+	return fmt.Sprintf("StartMode(%d)", int(mode.Kind))
+}
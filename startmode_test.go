@@ -0,0 +1,24 @@
+package eventsourcing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestStartModes checks the constructors and their descriptions
+func TestStartModes(t *testing.T) {
+	at := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, FromCheckpoint(), StartMode{}, "The zero value should resume from the checkpoint")
+	assert.Equal(t, "checkpoint", FromCheckpoint().String())
+	assert.Equal(t, "beginning", FromBeginning().String())
+	assert.Equal(t, "latest", FromLatest().String())
+	assert.Equal(t, "timestamp(2018-03-01T12:00:00Z)", FromTimestamp(at).String())
+	assert.Equal(t, "position(42)", FromPosition(42).String())
+	assert.Equal(t, "StartMode(99)", StartMode{Kind: 99}.String())
+
+	assert.Equal(t, at, FromTimestamp(at).Timestamp)
+	assert.Equal(t, int64(42), FromPosition(42).Position)
+}
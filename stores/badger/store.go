@@ -0,0 +1,301 @@
+/*
+Package badger is an embedded event store on BadgerDB, for workloads with a high rate of
+writes on a single node. Each event is a key of its own, agg/<key>/<sequence>, with the
+sequence zero-padded so that a stream is a contiguous, ordered range of keys that is read
+with a prefix scan, and the event as a small JSON value alongside it.
+
+Commits are written in a single transaction that checks none of their keys exist, so a
+commit racing another for the same sequence either finds its event, or fails to commit
+with a conflict, and in both cases fails with a ConcurrencyFault without writing anything.
+*/
+package badger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	badgerdb "github.com/dgraph-io/badger"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+)
+
+// keyPrefix is the prefix of every event key
+const keyPrefix = "agg/"
+
+// Options are the optional behaviours of a Badger event store.
+type Options struct {
+	TTL time.Duration // Time events are kept for once committed, zero to keep forever
+}
+
+// badgerEventStore is a type that represents a Badger backed EventStore
+// implementation
+type badgerEventStore struct {
+	db       *badgerdb.DB
+	ttl      time.Duration
+	pageSize int
+}
+
+// record is the value an event is stored as
+type record struct {
+	EventType eventsourcing.EventType `json:"type"`
+	EventData json.RawMessage         `json:"data"`
+	Metadata  map[string]interface{}  `json:"metadata,omitempty"`
+}
+
+// NewStore creates a new Badger backed event store in the specified directory, which
+// is created if it does not exist. The database is closed when the store is.
+func NewStore(directory string) (eventsourcing.EventStore, error) {
+	db, errOpen := badgerdb.Open(badgerdb.DefaultOptions(directory))
+	if errOpen != nil {
+		return nil, errOpen
+	}
+
+	return newStore(db, Options{}, db.Close), nil
+}
+
+// NewStoreWithDB creates a new Badger event store with a database that's already
+// been opened (BYO-instance). The database is not closed when the store is.
+func NewStoreWithDB(db *badgerdb.DB) eventsourcing.EventStore {
+	return NewStoreWithOptions(db, Options{})
+}
+
+// NewStoreWithOptions creates a new Badger event store with a database that's already
+// been opened, and optional behaviours.
+//
+// With a TTL set, events are written with a time-to-live, and Badger stops returning
+// them once it has passed, removing them as the database is compacted. Expiry isn't
+// aware of snapshots, so aggregates must be snapshotted well within the time-to-live:
+// a stream whose unsnapshotted events expire can no longer be replayed. Since the
+// event preceding a commit may have expired, commits rely on their transaction alone
+// to detect conflicts.
+func NewStoreWithOptions(db *badgerdb.DB, options Options) eventsourcing.EventStore {
+	return newStore(db, options, func() error {
+		return nil
+	})
+}
+
+// newStore creates the store around a database
+func newStore(db *badgerdb.DB, options Options, close keyvalue.CloseCallback) eventsourcing.EventStore {
+	engine := &badgerEventStore{
+		db:       db,
+		ttl:      options.TTL,
+		pageSize: keyvalue.DefaultPageSize,
+	}
+
+	kvOptions := keyvalue.Options{
+		CheckSequence:  engine.checkExists,
+		FetchPages:     engine.fetchPages,
+		PutEvents:      engine.putEvents,
+		LatestSequence: engine.latestSequence,
+		Ping:           engine.ping,
+		Close:          close,
+	}
+	if engine.ttl > 0 {
+		kvOptions.CheckSequence = nil
+	}
+
+	return keyvalue.NewStore(kvOptions)
+}
+
+// ping checks that the database can be read.
+func (store *badgerEventStore) ping(ctx context.Context) error {
+	return store.db.View(func(txn *badgerdb.Txn) error {
+		return nil
+	})
+}
+
+// checkExists checks that a particular sequence number exists in the store.
+func (store *badgerEventStore) checkExists(key string, seq int64) (bool, error) {
+	found := false
+	errView := store.db.View(func(txn *badgerdb.Txn) error {
+		_, errGet := txn.Get(eventKey(key, seq))
+		if errGet == badgerdb.ErrKeyNotFound {
+			return nil
+		}
+		found = errGet == nil
+		return errGet
+	})
+
+	return found, errView
+}
+
+// latestSequence gets the sequence of the latest event for a key, by seeking to the
+// end of the stream's keys in reverse.
+func (store *badgerEventStore) latestSequence(key string) (int64, error) {
+	var seq int64
+	errView := store.db.View(func(txn *badgerdb.Txn) error {
+		prefix := streamPrefix(key)
+		options := badgerdb.DefaultIteratorOptions
+		options.PrefetchValues = false
+		options.Reverse = true
+		options.Prefix = prefix
+
+		iterator := txn.NewIterator(options)
+		defer iterator.Close()
+
+		iterator.Seek(append(prefix, 0xFF))
+		if !iterator.ValidForPrefix(prefix) {
+			return nil
+		}
+
+		var errParse error
+		seq, errParse = parseSequence(iterator.Item().Key(), prefix)
+		return errParse
+	})
+
+	return seq, errView
+}
+
+// putEvents writes events to the backing store in a single transaction, which fails
+// if any of their keys exist, or another transaction writes them first.
+func (store *badgerEventStore) putEvents(events []keyvalue.KeyedEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	errUpdate := store.db.Update(func(txn *badgerdb.Txn) error {
+		for _, event := range events {
+			key := eventKey(event.Key, event.Sequence)
+			_, errGet := txn.Get(key)
+			if errGet == nil {
+				return eventsourcing.NewConcurrencyFault(event.Key, event.Sequence)
+			}
+			if errGet != badgerdb.ErrKeyNotFound {
+				return errGet
+			}
+
+			value, errEncode := encodeEvent(event)
+			if errEncode != nil {
+				return errEncode
+			}
+
+			entry := badgerdb.NewEntry(key, value)
+			if store.ttl > 0 {
+				entry = entry.WithTTL(store.ttl)
+			}
+			errSet := txn.SetEntry(entry)
+			if errSet != nil {
+				return errSet
+			}
+		}
+
+		return nil
+	})
+
+	// The conflicting key isn't reported, so blame the first of the commit
+	if errUpdate == badgerdb.ErrConflict {
+		return eventsourcing.NewConcurrencyFault(events[0].Key, events[0].Sequence)
+	}
+
+	return errUpdate
+}
+
+// fetchPages loads the events beyond the specified sequence number, passing them on
+// a page at a time as the stream's keys are scanned.
+func (store *badgerEventStore) fetchPages(key string, seq int64, page keyvalue.PageCallback) error {
+	return store.db.View(func(txn *badgerdb.Txn) error {
+		prefix := streamPrefix(key)
+		options := badgerdb.DefaultIteratorOptions
+		options.PrefetchSize = store.pageSize
+		options.Prefix = prefix
+
+		iterator := txn.NewIterator(options)
+		defer iterator.Close()
+
+		loaded := make([]keyvalue.KeyedEvent, 0, store.pageSize)
+		for iterator.Seek(eventKey(key, seq+1)); iterator.ValidForPrefix(prefix); iterator.Next() {
+			item := iterator.Item()
+			sequence, errParse := parseSequence(item.Key(), prefix)
+			if errParse != nil {
+				return errParse
+			}
+
+			value, errValue := item.ValueCopy(nil)
+			if errValue != nil {
+				return errValue
+			}
+
+			event, errDecode := decodeEvent(key, sequence, value)
+			if errDecode != nil {
+				return errDecode
+			}
+
+			loaded = append(loaded, event)
+			if len(loaded) < store.pageSize {
+				continue
+			}
+
+			errPage := page(loaded)
+			if errPage != nil {
+				return errPage
+			}
+			loaded = make([]keyvalue.KeyedEvent, 0, store.pageSize)
+		}
+
+		if len(loaded) == 0 {
+			return nil
+		}
+		return page(loaded)
+	})
+}
+
+// streamPrefix gets the prefix of the keys of a stream's events. The aggregate key is
+// escaped, so that the prefix of one stream can't be the prefix of another.
+func streamPrefix(key string) []byte {
+	return []byte(keyPrefix + url.PathEscape(key) + "/")
+}
+
+// eventKey gets the key of an event, agg/<key>/<sequence>, with the sequence padded
+// to 20 digits so that keys sort in the order of their sequences.
+func eventKey(key string, seq int64) []byte {
+	return append(streamPrefix(key), fmt.Sprintf("%020d", seq)...)
+}
+
+// parseSequence reads the sequence from the key of an event
+func parseSequence(key []byte, prefix []byte) (int64, error) {
+	return strconv.ParseInt(string(key[len(prefix):]), 10, 64)
+}
+
+// encodeEvent gets the value an event is stored as
+func encodeEvent(event keyvalue.KeyedEvent) ([]byte, error) {
+	data, errData := json.Marshal(event.EventData)
+	if errData != nil {
+		return nil, errData
+	}
+
+	return json.Marshal(record{
+		EventType: event.EventType,
+		EventData: data,
+		Metadata:  event.Metadata,
+	})
+}
+
+// decodeEvent rehydrates an event from its value
+func decodeEvent(key string, sequence int64, value []byte) (keyvalue.KeyedEvent, error) {
+	stored := record{}
+	errRecord := json.Unmarshal(value, &stored)
+	if errRecord != nil {
+		return keyvalue.KeyedEvent{}, errRecord
+	}
+
+	target := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(stored.EventData))
+	decoder.UseNumber()
+	errUnmarshal := decoder.Decode(&target)
+	if errUnmarshal != nil {
+		return keyvalue.KeyedEvent{}, errUnmarshal
+	}
+
+	return keyvalue.KeyedEvent{
+		Key:       key,
+		Sequence:  sequence,
+		EventType: stored.EventType,
+		EventData: target,
+		Metadata:  stored.Metadata,
+	}, nil
+}
@@ -0,0 +1,113 @@
+package badger
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	badgerdb "github.com/dgraph-io/badger"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openDB opens a database in a temporary directory, without logging
+func openDB() (*badgerdb.DB, func(), error) {
+	directory, errTemp := ioutil.TempDir("", "eventstore")
+	if errTemp != nil {
+		return nil, nil, errTemp
+	}
+
+	db, errOpen := badgerdb.Open(badgerdb.DefaultOptions(directory).WithLogger(nil))
+	if errOpen != nil {
+		os.RemoveAll(directory)
+		return nil, nil, errOpen
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(directory)
+	}, nil
+}
+
+func provider() (eventsourcing.EventStore, func(), error) {
+	db, cleanup, errOpen := openDB()
+	if errOpen != nil {
+		return nil, nil, errOpen
+	}
+
+	return NewStoreWithDB(db), cleanup, nil
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Badger", provider)
+}
+
+// TestRandomInterleavings checks the store under concurrent, random use
+func TestRandomInterleavings(t *testing.T) {
+	test.CheckRandomInterleavings(t, provider, test.FuzzOptions{})
+}
+
+// TestEventKeys checks keys sort in the order of their sequences, and that a stream's
+// prefix doesn't cover the keys of another stream
+func TestEventKeys(t *testing.T) {
+	assert.Equal(t, "agg/a/00000000000000000002", string(eventKey("a", 2)))
+	assert.Equal(t, "agg/a%2Fb/", string(streamPrefix("a/b")))
+	assert.True(t, string(eventKey("a", 9)) < string(eventKey("a", 10)))
+
+	seq, errParse := parseSequence(eventKey("a/b", 12), streamPrefix("a/b"))
+	assert.Nil(t, errParse)
+	assert.Equal(t, int64(12), seq)
+}
+
+// TestEventValues checks events are read back with their data and metadata
+func TestEventValues(t *testing.T) {
+	event := keyvalue.KeyedEvent{
+		Key:       "a",
+		Sequence:  2,
+		EventType: "IncrementEvent",
+		EventData: map[string]interface{}{"increment_by": 3},
+		Metadata:  map[string]interface{}{"commit_id": "x"},
+	}
+
+	value, errEncode := encodeEvent(event)
+	assert.Nil(t, errEncode)
+
+	decoded, errDecode := decodeEvent("a", 2, value)
+	assert.Nil(t, errDecode)
+	assert.Equal(t, json.Number("3"), decoded.EventData.(map[string]interface{})["increment_by"])
+	assert.Equal(t, event.Metadata, decoded.Metadata)
+	assert.Equal(t, eventsourcing.EventType("IncrementEvent"), decoded.EventType)
+
+	_, errDecode = decodeEvent("a", 2, []byte("not json"))
+	assert.NotNil(t, errDecode)
+}
+
+// TestTTL checks events written with a time-to-live can no longer be read once it
+// has passed
+func TestTTL(t *testing.T) {
+	db, cleanup, errOpen := openDB()
+	require.Nil(t, errOpen)
+	defer cleanup()
+
+	store := NewStoreWithOptions(db, Options{TTL: time.Second})
+	agg := test.SimpleAggregate{}
+	agg.Initialize("ttl", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+
+	exists, errExists := (&badgerEventStore{db: db}).checkExists("ttl", 1)
+	assert.Nil(t, errExists)
+	assert.True(t, exists)
+
+	// Badger expires keys at a granularity of seconds
+	time.Sleep(2 * time.Second)
+	exists, errExists = (&badgerEventStore{db: db}).checkExists("ttl", 1)
+	assert.Nil(t, errExists)
+	assert.False(t, exists)
+}
@@ -0,0 +1,303 @@
+/*
+Package cassandra is an event store for Apache Cassandra and ScyllaDB, keeping the events
+of each aggregate in a single wide row: the aggregate key is the partition key, and the
+sequence is the clustering key, so a stream is read with a range scan of one partition.
+
+Commits are written with lightweight transactions (INSERT ... IF NOT EXISTS), in a single
+conditional batch when a commit has several events, so that a commit racing another for
+the same sequence is either applied in full or fails with a ConcurrencyFault. Reads are
+made at QUORUM (see Endpoint.Consistency), which sees every committed transaction, and are
+routed to the replicas of the partition (token-aware), a page at a time.
+*/
+package cassandra
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/gocql/gocql"
+)
+
+// tableNamePattern restricts table names to safe identifiers, optionally qualified
+// with a keyspace, since they cannot be passed as query parameters.
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// Endpoint are parameters for the Cassandra event store to use when initializing.
+type Endpoint struct {
+	Hosts       []string `json:"hosts"`       // Hosts are the contact points of the cluster
+	Keyspace    string   `json:"keyspace"`    // Keyspace holding the table, which must exist
+	TableName   string   `json:"table_name"`  // TableName is the table to create/store events in
+	Consistency string   `json:"consistency"` // Consistency of reads and writes (i.e. LOCAL_QUORUM), QUORUM if empty
+}
+
+// cassandraEventStore is a type that represents a Cassandra backed EventStore
+// implementation
+type cassandraEventStore struct {
+	session   *gocql.Session
+	tableName string
+	pageSize  int
+}
+
+// NewStore creates a new Cassandra backed event store for an application to use,
+// connecting to the cluster with token-aware routing. The table is created if it
+// does not already exist.
+func NewStore(endpoint Endpoint) (eventsourcing.EventStore, error) {
+	cluster := gocql.NewCluster(endpoint.Hosts...)
+	cluster.Keyspace = endpoint.Keyspace
+	cluster.Consistency = gocql.Quorum
+	if endpoint.Consistency != "" {
+		consistency, errConsistency := gocql.ParseConsistencyWrapper(endpoint.Consistency)
+		if errConsistency != nil {
+			return nil, errConsistency
+		}
+		cluster.Consistency = consistency
+	}
+	cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.RoundRobinHostPolicy())
+
+	session, errSession := cluster.CreateSession()
+	if errSession != nil {
+		return nil, errSession
+	}
+
+	store, errStore := NewStoreWithSession(session, endpoint.TableName)
+	if errStore != nil {
+		session.Close()
+		return nil, errStore
+	}
+
+	return store, nil
+}
+
+// NewStoreWithSession creates a new Cassandra store with an existing session, which
+// should read at a consistency that sees committed lightweight transactions (QUORUM,
+// LOCAL_QUORUM in a single datacenter, or SERIAL). The table is created if it does not
+// already exist.
+func NewStoreWithSession(session *gocql.Session, tableName string) (eventsourcing.EventStore, error) {
+	if !tableNamePattern.MatchString(tableName) {
+		return nil, fmt.Errorf("Invalid table name for Cassandra store: %q", tableName)
+	}
+
+	// Ensure the table exists
+	errCreate := session.Query(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		aggregate_key text,
+		seq bigint,
+		event_type text,
+		data text,
+		metadata text,
+		PRIMARY KEY ((aggregate_key), seq)
+	) WITH CLUSTERING ORDER BY (seq ASC)`, tableName)).Exec()
+	if errCreate != nil {
+		return nil, errCreate
+	}
+
+	engine := &cassandraEventStore{
+		session:   session,
+		tableName: tableName,
+		pageSize:  keyvalue.DefaultPageSize,
+	}
+
+	store := keyvalue.NewStore(keyvalue.Options{
+		CheckSequence:  engine.checkExists,
+		FetchPages:     engine.fetchPages,
+		PutEvents:      engine.putEvents,
+		LatestSequence: engine.latestSequence,
+		Ping:           engine.ping,
+		Close: func() error {
+			session.Close()
+			return nil
+		},
+	})
+
+	return store, nil
+}
+
+// ping checks that the table can be queried.
+func (store *cassandraEventStore) ping(ctx context.Context) error {
+	var key string
+	errQuery := store.session.Query(fmt.Sprintf("SELECT aggregate_key FROM %s LIMIT 1", store.tableName)).WithContext(ctx).Scan(&key)
+	if errQuery == gocql.ErrNotFound {
+		return nil
+	}
+	return errQuery
+}
+
+// checkExists checks that a particular sequence number exists in the store.
+func (store *cassandraEventStore) checkExists(key string, seq int64) (bool, error) {
+	var found int64
+	errQuery := store.session.Query(
+		fmt.Sprintf("SELECT seq FROM %s WHERE aggregate_key = ? AND seq = ?", store.tableName),
+		key,
+		seq,
+	).Scan(&found)
+	if errQuery == gocql.ErrNotFound {
+		return false, nil
+	}
+	if errQuery != nil {
+		return false, errQuery
+	}
+
+	return true, nil
+}
+
+// latestSequence gets the sequence of the latest event for a key, by reading the
+// partition in descending order for a single row.
+func (store *cassandraEventStore) latestSequence(key string) (int64, error) {
+	var seq int64
+	errQuery := store.session.Query(
+		fmt.Sprintf("SELECT seq FROM %s WHERE aggregate_key = ? ORDER BY seq DESC LIMIT 1", store.tableName),
+		key,
+	).Scan(&seq)
+	if errQuery == gocql.ErrNotFound {
+		return 0, nil
+	}
+
+	return seq, errQuery
+}
+
+// putEvents writes events to the backing store. A single event is written with a
+// conditional insert, while larger commits are written as a conditional batch,
+// which Cassandra applies atomically since every event shares a partition.
+func (store *cassandraEventStore) putEvents(events []keyvalue.KeyedEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	statement := fmt.Sprintf(
+		"INSERT INTO %s (aggregate_key, seq, event_type, data, metadata) VALUES (?, ?, ?, ?, ?) IF NOT EXISTS",
+		store.tableName,
+	)
+
+	rows := make([][]interface{}, len(events))
+	for index, event := range events {
+		values, errValues := eventValues(event)
+		if errValues != nil {
+			return errValues
+		}
+		rows[index] = values
+	}
+
+	applied, errPut := store.insert(statement, rows)
+	if errPut != nil {
+		return errPut
+	}
+
+	// The conflicting row isn't reported, so blame the first of the commit
+	if !applied {
+		return eventsourcing.NewConcurrencyFault(events[0].Key, events[0].Sequence)
+	}
+
+	return nil
+}
+
+// insert runs a conditional insert for each row, as a batch if there are several,
+// and reports whether they were applied.
+func (store *cassandraEventStore) insert(statement string, rows [][]interface{}) (bool, error) {
+	existing := make(map[string]interface{})
+	if len(rows) == 1 {
+		return store.session.Query(statement, rows[0]...).MapScanCAS(existing)
+	}
+
+	batch := store.session.NewBatch(gocql.LoggedBatch)
+	for _, values := range rows {
+		batch.Query(statement, values...)
+	}
+
+	applied, iter, errBatch := store.session.MapExecuteBatchCAS(batch, existing)
+	if iter != nil {
+		iter.Close()
+	}
+	return applied, errBatch
+}
+
+// eventValues gets the column values of an event, with its data and metadata as
+// JSON.
+func eventValues(event keyvalue.KeyedEvent) ([]interface{}, error) {
+	data, errData := json.Marshal(event.EventData)
+	if errData != nil {
+		return nil, errData
+	}
+
+	metadata := ""
+	if len(event.Metadata) > 0 {
+		buff, errMetadata := json.Marshal(event.Metadata)
+		if errMetadata != nil {
+			return nil, errMetadata
+		}
+		metadata = string(buff)
+	}
+
+	return []interface{}{event.Key, event.Sequence, string(event.EventType), string(data), metadata}, nil
+}
+
+// fetchPages loads the events beyond the specified sequence number, passing them on
+// a page at a time as the driver pages through the partition.
+func (store *cassandraEventStore) fetchPages(key string, seq int64, page keyvalue.PageCallback) error {
+	iter := store.session.Query(
+		fmt.Sprintf("SELECT seq, event_type, data, metadata FROM %s WHERE aggregate_key = ? AND seq > ?", store.tableName),
+		key,
+		seq,
+	).PageSize(store.pageSize).Iter()
+
+	loaded := make([]keyvalue.KeyedEvent, 0, store.pageSize)
+	var sequence int64
+	var eventType, data, metadata string
+	for iter.Scan(&sequence, &eventType, &data, &metadata) {
+		event, errDecode := decodeEvent(key, sequence, eventType, data, metadata)
+		if errDecode != nil {
+			iter.Close()
+			return errDecode
+		}
+
+		loaded = append(loaded, event)
+		if len(loaded) < store.pageSize {
+			continue
+		}
+
+		errPage := page(loaded)
+		if errPage != nil {
+			iter.Close()
+			return errPage
+		}
+		loaded = make([]keyvalue.KeyedEvent, 0, store.pageSize)
+	}
+
+	errIter := iter.Close()
+	if errIter != nil {
+		return errIter
+	}
+	if len(loaded) == 0 {
+		return nil
+	}
+	return page(loaded)
+}
+
+// decodeEvent rehydrates an event from its columns
+func decodeEvent(key string, sequence int64, eventType string, data string, metadata string) (keyvalue.KeyedEvent, error) {
+	target := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader([]byte(data)))
+	decoder.UseNumber()
+	errUnmarshal := decoder.Decode(&target)
+	if errUnmarshal != nil {
+		return keyvalue.KeyedEvent{}, errUnmarshal
+	}
+
+	event := keyvalue.KeyedEvent{
+		Key:       key,
+		Sequence:  sequence,
+		EventType: eventsourcing.EventType(eventType),
+		EventData: target,
+	}
+	if metadata != "" {
+		errMetadata := json.Unmarshal([]byte(metadata), &event.Metadata)
+		if errMetadata != nil {
+			return keyvalue.KeyedEvent{}, errMetadata
+		}
+	}
+
+	return event, nil
+}
@@ -0,0 +1,104 @@
+package cassandra
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/gocql/gocql"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// testKeyspace is the keyspace the test tables are created in
+const testKeyspace = "eventsourcing_test"
+
+// testHost gets the contact point of the test cluster
+func testHost() string {
+	host := os.Getenv("CASSANDRA_TEST_HOST")
+	if host == "" {
+		host = "localhost:9042"
+	}
+	return host
+}
+
+func provider() (eventsourcing.EventStore, func(), error) {
+	cluster := gocql.NewCluster(testHost())
+	admin, errAdmin := cluster.CreateSession()
+	if errAdmin != nil {
+		return nil, func() {}, errAdmin
+	}
+	errKeyspace := admin.Query(fmt.Sprintf(
+		"CREATE KEYSPACE IF NOT EXISTS %s WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 1}",
+		testKeyspace,
+	)).Exec()
+	if errKeyspace != nil {
+		admin.Close()
+		return nil, func() {}, errKeyspace
+	}
+
+	tableName := "events_" + strings.Replace(fmt.Sprintf("%s", uuid.NewV4()), "-", "", -1)
+	result, err := NewStore(Endpoint{
+		Hosts:     []string{testHost()},
+		Keyspace:  testKeyspace,
+		TableName: tableName,
+	})
+
+	return result, func() {
+		admin.Query(fmt.Sprintf("DROP TABLE IF EXISTS %s.%s", testKeyspace, tableName)).Exec()
+		admin.Close()
+	}, err
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Cassandra", provider)
+}
+
+// TestEventColumns checks events are written as columns and read back with their
+// data and metadata
+func TestEventColumns(t *testing.T) {
+	event := keyvalue.KeyedEvent{
+		Key:       "a",
+		Sequence:  2,
+		EventType: "IncrementEvent",
+		EventData: map[string]interface{}{"increment_by": 3},
+		Metadata:  map[string]interface{}{"commit_id": "x"},
+	}
+
+	values, errValues := eventValues(event)
+	assert.Nil(t, errValues)
+	assert.Equal(t, []interface{}{"a", int64(2), "IncrementEvent", `{"increment_by":3}`, `{"commit_id":"x"}`}, values)
+
+	decoded, errDecode := decodeEvent("a", 2, values[2].(string), values[3].(string), values[4].(string))
+	assert.Nil(t, errDecode)
+	assert.Equal(t, json.Number("3"), decoded.EventData.(map[string]interface{})["increment_by"])
+	assert.Equal(t, event.Metadata, decoded.Metadata)
+	assert.Equal(t, eventsourcing.EventType("IncrementEvent"), decoded.EventType)
+
+	// Events without metadata leave the column empty
+	event.Metadata = nil
+	values, _ = eventValues(event)
+	assert.Equal(t, "", values[4])
+	decoded, errDecode = decodeEvent("a", 2, values[2].(string), values[3].(string), values[4].(string))
+	assert.Nil(t, errDecode)
+	assert.Nil(t, decoded.Metadata)
+
+	_, errDecode = decodeEvent("a", 2, "IncrementEvent", "not json", "")
+	assert.NotNil(t, errDecode)
+}
+
+// TestTableName checks table names that can't be used as identifiers are rejected
+func TestTableName(t *testing.T) {
+	_, errStore := NewStoreWithSession(nil, "events; DROP TABLE x")
+	assert.NotNil(t, errStore)
+	_, errStore = NewStoreWithSession(nil, "a.b.c")
+	assert.NotNil(t, errStore)
+	assert.True(t, tableNamePattern.MatchString("keyspace.events_1"))
+	assert.True(t, tableNamePattern.MatchString("events"))
+}
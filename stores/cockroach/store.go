@@ -0,0 +1,329 @@
+package cockroach
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	keyvalue "github.com/go-gadgets/eventsourcing/stores/key-value"
+
+	// Registers the postgres driver, the default
+	_ "github.com/lib/pq"
+)
+
+const (
+	// DefaultRetryLimit is the number of times a transaction that fails with a
+	// retryable (40001) error is attempted before giving up.
+	DefaultRetryLimit = 10
+
+	// DefaultRetryBackoff is the wait before the first retry of a transaction,
+	// which doubles for each later retry up to maxRetryBackoff.
+	DefaultRetryBackoff = 10 * time.Millisecond
+
+	// maxRetryBackoff is the longest wait between attempts of a transaction.
+	maxRetryBackoff = time.Second
+
+	// DefaultDriverName is the database/sql driver used when an endpoint doesn't
+	// name one, which is lib/pq.
+	DefaultDriverName = "postgres"
+
+	// sqlStateSerializationFailure is the SQLSTATE CockroachDB uses to indicate
+	// that a transaction must be retried by the client.
+	sqlStateSerializationFailure = "40001"
+
+	// sqlStateUniqueViolation is the SQLSTATE raised when a primary key or
+	// unique constraint is violated.
+	sqlStateUniqueViolation = "23505"
+)
+
+// tableNamePattern restricts table names to safe identifiers, since they
+// cannot be passed as query parameters.
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_\.]*$`)
+
+// Endpoint are parameters for the CockroachDB event store to use when
+// initializing.
+type Endpoint struct {
+	DriverName     string `json:"driver_name"`      // DriverName is the database/sql driver to use, DefaultDriverName if empty
+	DataSourceName string `json:"data_source_name"` // DataSourceName is the connection string for the cluster
+	TableName      string `json:"table_name"`       // TableName is the table to create/store events in
+	RetryLimit     int    `json:"retry_limit"`      // RetryLimit is the number of attempts for retryable transactions
+}
+
+// cockroachEventStore is a type that represents a CockroachDB backed
+// EventStore implementation
+type cockroachEventStore struct {
+	db         *sql.DB
+	tableName  string
+	retryLimit int
+}
+
+// NewStore creates a new CockroachDB backed event store for an application
+// to use. Connections are made with lib/pq, unless the endpoint names another
+// Postgres wire-protocol driver (i.e. pgx) that the caller has imported.
+func NewStore(endpoint Endpoint) (eventsourcing.EventStore, error) {
+	driverName := endpoint.DriverName
+	if driverName == "" {
+		driverName = DefaultDriverName
+	}
+
+	db, errOpen := sql.Open(driverName, endpoint.DataSourceName)
+	if errOpen != nil {
+		return nil, errOpen
+	}
+
+	store, errStore := NewStoreWithConnection(db, endpoint.TableName, endpoint.RetryLimit)
+	if errStore != nil {
+		db.Close()
+		return nil, errStore
+	}
+
+	return store, nil
+}
+
+// NewStoreWithConnection creates a new CockroachDB store with an existing
+// database handle. The table is created if it does not already exist. A
+// retryLimit of zero or less uses DefaultRetryLimit.
+func NewStoreWithConnection(db *sql.DB, tableName string, retryLimit int) (eventsourcing.EventStore, error) {
+	if !tableNamePattern.MatchString(tableName) {
+		return nil, fmt.Errorf("Invalid table name for CockroachDB store: %q", tableName)
+	}
+
+	if retryLimit <= 0 {
+		retryLimit = DefaultRetryLimit
+	}
+
+	// Ensure the table exists
+	_, errCreate := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		aggregate_key STRING NOT NULL,
+		seq INT8 NOT NULL,
+		event_type STRING NOT NULL,
+		data JSONB NOT NULL,
+		metadata JSONB,
+		PRIMARY KEY (aggregate_key, seq)
+	)`, tableName))
+	if errCreate != nil {
+		return nil, errCreate
+	}
+
+	// Tables created before events carried metadata don't have the column
+	_, errAlter := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS metadata JSONB", tableName))
+	if errAlter != nil {
+		return nil, errAlter
+	}
+
+	engine := &cockroachEventStore{
+		db:         db,
+		tableName:  tableName,
+		retryLimit: retryLimit,
+	}
+
+	store := keyvalue.NewStore(keyvalue.Options{
+		CheckSequence: engine.checkExists,
+		FetchEvents:   engine.fetchEvents,
+		PutEvents:     engine.putEvents,
+		Ping: func(ctx context.Context) error {
+			return db.PingContext(ctx)
+		},
+		Close: func() error {
+			return db.Close()
+		},
+	})
+
+	return store, nil
+}
+
+// checkExists checks that a particular sequence number exists in the store.
+func (store *cockroachEventStore) checkExists(key string, seq int64) (bool, error) {
+	var count int
+	errQuery := store.db.QueryRow(
+		fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE aggregate_key = $1 AND seq = $2", store.tableName),
+		key,
+		seq,
+	).Scan(&count)
+	if errQuery != nil {
+		return false, errQuery
+	}
+
+	return count == 1, nil
+}
+
+// putEvents writes events to the backing store inside a single transaction,
+// retrying the whole transaction when CockroachDB requests it.
+func (store *cockroachEventStore) putEvents(events []keyvalue.KeyedEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	statement := fmt.Sprintf(
+		"INSERT INTO %s (aggregate_key, seq, event_type, data, metadata) VALUES ($1, $2, $3, $4, $5)",
+		store.tableName,
+	)
+
+	// Marshal up-front, so retries don't repeat the work.
+	bodies := make([][]byte, len(events))
+	metadata := make([]interface{}, len(events))
+	for index, event := range events {
+		buff, errMarshal := json.Marshal(event.EventData)
+		if errMarshal != nil {
+			return errMarshal
+		}
+		bodies[index] = buff
+
+		if len(event.Metadata) > 0 {
+			encoded, errMetadata := json.Marshal(event.Metadata)
+			if errMetadata != nil {
+				return errMetadata
+			}
+			metadata[index] = string(encoded)
+		}
+	}
+
+	errTx := retryTransaction(store.retryLimit, DefaultRetryBackoff, func() error {
+		tx, errBegin := store.db.Begin()
+		if errBegin != nil {
+			return errBegin
+		}
+
+		for index, event := range events {
+			_, errInsert := tx.Exec(statement, event.Key, event.Sequence, string(event.EventType), string(bodies[index]), metadata[index])
+			if errInsert != nil {
+				tx.Rollback()
+				return errInsert
+			}
+		}
+
+		return tx.Commit()
+	})
+
+	if errTx != nil && isUniqueViolation(errTx) {
+		firstEvent := events[0]
+		return eventsourcing.NewConcurrencyFault(firstEvent.Key, firstEvent.Sequence)
+	}
+
+	return errTx
+}
+
+// fetchEvents loads all events beyond the specified sequence number.
+func (store *cockroachEventStore) fetchEvents(key string, seq int64) ([]keyvalue.KeyedEvent, error) {
+	rows, errQuery := store.db.Query(
+		fmt.Sprintf("SELECT seq, event_type, data, metadata FROM %s WHERE aggregate_key = $1 AND seq > $2 ORDER BY seq", store.tableName),
+		key,
+		seq,
+	)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	loaded := make([]keyvalue.KeyedEvent, 0)
+	for rows.Next() {
+		var sequence int64
+		var eventType string
+		var body, metadata []byte
+		errScan := rows.Scan(&sequence, &eventType, &body, &metadata)
+		if errScan != nil {
+			return nil, errScan
+		}
+
+		// Rehydrate the JSON
+		target := make(map[string]interface{})
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		errUnmarshal := decoder.Decode(&target)
+		if errUnmarshal != nil {
+			return nil, errUnmarshal
+		}
+
+		event := keyvalue.KeyedEvent{
+			Key:       key,
+			Sequence:  sequence,
+			EventType: eventsourcing.EventType(eventType),
+			EventData: target,
+		}
+		if metadata != nil {
+			errMetadata := json.Unmarshal(metadata, &event.Metadata)
+			if errMetadata != nil {
+				return nil, errMetadata
+			}
+		}
+
+		loaded = append(loaded, event)
+	}
+
+	return loaded, rows.Err()
+}
+
+// retryTransaction runs a transaction body until it succeeds, fails with
+// a non-retryable error or the limit is reached. Retries wait for a backoff
+// that doubles with each attempt, jittered so that transactions that
+// conflicted together don't retry together.
+func retryTransaction(limit int, backoff time.Duration, body func() error) error {
+	var lastError error
+	for attempt := 0; attempt < limit; attempt++ {
+		if attempt > 0 {
+			time.Sleep(jitter(backoff))
+			backoff *= 2
+			if backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+		}
+
+		lastError = body()
+		if lastError == nil || !isRetryable(lastError) {
+			return lastError
+		}
+	}
+
+	return lastError
+}
+
+// jitter randomizes a backoff between 50% and 150% of its value.
+func jitter(backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return 0
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// sqlStateError is implemented by the errors of most Postgres wire-protocol
+// drivers (lib/pq, pgx), allowing us to inspect codes without importing one.
+type sqlStateError interface {
+	SQLState() string
+}
+
+// sqlState extracts the SQLSTATE code from an error, if it can be determined.
+func sqlState(err error) string {
+	var stateful sqlStateError
+	if errors.As(err, &stateful) {
+		return stateful.SQLState()
+	}
+
+	// Fall back to sniffing the message, since some drivers only embed it.
+	message := err.Error()
+	for _, code := range []string{sqlStateSerializationFailure, sqlStateUniqueViolation} {
+		if strings.Contains(message, "SQLSTATE "+code) || strings.Contains(message, "("+code+")") {
+			return code
+		}
+	}
+
+	return ""
+}
+
+// isRetryable determines if an error is a CockroachDB transaction retry error.
+func isRetryable(err error) bool {
+	return sqlState(err) == sqlStateSerializationFailure
+}
+
+// isUniqueViolation determines if an error represents a duplicate key/sequence.
+func isUniqueViolation(err error) bool {
+	return sqlState(err) == sqlStateUniqueViolation
+}
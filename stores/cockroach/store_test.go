@@ -0,0 +1,135 @@
+package cockroach
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/lib/pq"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// dataSource gets the connection string of the test cluster
+func dataSource() string {
+	source := os.Getenv("COCKROACH_TEST_HOST")
+	if source == "" {
+		source = "postgresql://root@localhost:26257/defaultdb?sslmode=disable"
+	}
+	return source
+}
+
+func provider() (eventsourcing.EventStore, func(), error) {
+	tableName := "events_" + strings.Replace(fmt.Sprintf("%s", uuid.NewV4()), "-", "", -1)
+	result, err := NewStore(Endpoint{
+		DataSourceName: dataSource(),
+		TableName:      tableName,
+	})
+
+	return result, func() {
+		db, errOpen := sql.Open(DefaultDriverName, dataSource())
+		if errOpen != nil {
+			return
+		}
+		defer db.Close()
+		db.Exec("DROP TABLE IF EXISTS " + tableName)
+	}, err
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "CockroachDB", provider)
+}
+
+// fakeDriverError mimics the error types of Postgres wire-protocol drivers.
+type fakeDriverError struct {
+	code string
+}
+
+// Error returns the error text
+func (err fakeDriverError) Error() string {
+	return "driver error " + err.code
+}
+
+// SQLState returns the SQLSTATE code of the error
+func (err fakeDriverError) SQLState() string {
+	return err.code
+}
+
+// TestErrorClassification checks we can detect retryable and duplicate errors.
+func TestErrorClassification(t *testing.T) {
+	assert.True(t, isRetryable(fakeDriverError{code: "40001"}))
+	assert.False(t, isRetryable(fakeDriverError{code: "23505"}))
+	assert.True(t, isUniqueViolation(fakeDriverError{code: "23505"}))
+	assert.False(t, isUniqueViolation(fakeDriverError{code: "40001"}))
+
+	assert.True(t, isRetryable(errors.New("ERROR: restart transaction (SQLSTATE 40001)")))
+	assert.True(t, isUniqueViolation(errors.New("pq: duplicate key value (23505)")))
+	assert.False(t, isRetryable(errors.New("connection refused")))
+
+	// Errors are classified when wrapped, and from lib/pq
+	assert.True(t, isRetryable(fmt.Errorf("commit: %w", fakeDriverError{code: "40001"})))
+	assert.True(t, isUniqueViolation(fmt.Errorf("insert: %w", &pq.Error{Code: "23505"})))
+}
+
+// TestRetryTransaction checks that retryable errors are retried up to the limit.
+func TestRetryTransaction(t *testing.T) {
+	count := 0
+	errOutcome := retryTransaction(5, time.Millisecond, func() error {
+		count++
+		if count < 3 {
+			return fakeDriverError{code: "40001"}
+		}
+		return nil
+	})
+	assert.Nil(t, errOutcome)
+	assert.Equal(t, 3, count)
+
+	count = 0
+	errOutcome = retryTransaction(5, time.Millisecond, func() error {
+		count++
+		return fakeDriverError{code: "40001"}
+	})
+	assert.NotNil(t, errOutcome)
+	assert.Equal(t, 5, count)
+
+	count = 0
+	errOutcome = retryTransaction(5, time.Millisecond, func() error {
+		count++
+		return fakeDriverError{code: "23505"}
+	})
+	assert.NotNil(t, errOutcome)
+	assert.Equal(t, 1, count)
+}
+
+// TestRetryBackoff checks retries wait for a growing, jittered backoff
+func TestRetryBackoff(t *testing.T) {
+	attempts := make([]time.Time, 0)
+	retryTransaction(4, 10*time.Millisecond, func() error {
+		attempts = append(attempts, time.Now())
+		return fakeDriverError{code: "40001"}
+	})
+	assert.Equal(t, 4, len(attempts))
+
+	// Waits are at least half of 10ms, 20ms and 40ms
+	assert.True(t, attempts[1].Sub(attempts[0]) >= 5*time.Millisecond)
+	assert.True(t, attempts[3].Sub(attempts[2]) >= 20*time.Millisecond)
+
+	for attempt := 0; attempt < 100; attempt++ {
+		wait := jitter(10 * time.Millisecond)
+		assert.True(t, wait >= 5*time.Millisecond && wait < 15*time.Millisecond)
+	}
+}
+
+// TestInvalidTableName checks that unsafe table names are rejected.
+func TestInvalidTableName(t *testing.T) {
+	store, errStore := NewStoreWithConnection(nil, "events; DROP TABLE users", 0)
+	assert.Nil(t, store)
+	assert.NotNil(t, errStore)
+}
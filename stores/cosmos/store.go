@@ -0,0 +1,296 @@
+/*
+Package cosmos is an event store on the SQL (NoSQL) API of Azure Cosmos DB. Events are
+documents in a container partitioned by /aggregate_key, so the stream of an aggregate
+is a single logical partition, and the id of each document is its sequence, zero-padded,
+which Cosmos DB keeps unique within the partition.
+
+Commits are written as a transactional batch of inserts, so a commit racing another for
+the same sequence fails with a conflict on the id of its first event, writes nothing, and
+is returned as a ConcurrencyFault. A transactional batch holds at most MaxBatchItems
+operations, so larger commits are rejected.
+*/
+package cosmos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+)
+
+// MaxBatchItems is the most operations Cosmos DB allows in a transactional batch,
+// and so the most events in a commit.
+const MaxBatchItems = 100
+
+// partitionKeyPath is the path of the partition key of the container
+const partitionKeyPath = "/aggregate_key"
+
+// Endpoint are parameters for the Cosmos DB event store to use when initializing.
+type Endpoint struct {
+	ConnectionString string `json:"connection_string"` // ConnectionString is the AccountEndpoint=...;AccountKey=... string of the account
+	Database         string `json:"database"`          // Database is the database to create/store events in
+	Container        string `json:"container"`         // Container is the container to create/store events in
+}
+
+// cosmosEventStore is a type that represents a Cosmos DB backed EventStore
+// implementation
+type cosmosEventStore struct {
+	container *azcosmos.ContainerClient
+	pageSize  int32
+}
+
+// document is the form an event is stored in
+type document struct {
+	ID        string                  `json:"id"`
+	Key       string                  `json:"aggregate_key"`
+	Sequence  int64                   `json:"seq"`
+	EventType eventsourcing.EventType `json:"type"`
+	EventData json.RawMessage         `json:"data"`
+	Metadata  map[string]interface{}  `json:"metadata,omitempty"`
+}
+
+// NewStore creates a new Cosmos DB backed event store for an application to use. The
+// database and container are created if they do not already exist.
+func NewStore(endpoint Endpoint) (eventsourcing.EventStore, error) {
+	client, errClient := azcosmos.NewClientFromConnectionString(endpoint.ConnectionString, nil)
+	if errClient != nil {
+		return nil, errClient
+	}
+
+	ctx := context.Background()
+	_, errDatabase := client.CreateDatabase(ctx, azcosmos.DatabaseProperties{ID: endpoint.Database}, nil)
+	if errDatabase != nil && !hasStatus(errDatabase, http.StatusConflict) {
+		return nil, errDatabase
+	}
+
+	database, errNew := client.NewDatabase(endpoint.Database)
+	if errNew != nil {
+		return nil, errNew
+	}
+	_, errContainer := database.CreateContainer(ctx, azcosmos.ContainerProperties{
+		ID: endpoint.Container,
+		PartitionKeyDefinition: azcosmos.PartitionKeyDefinition{
+			Paths: []string{partitionKeyPath},
+		},
+	}, nil)
+	if errContainer != nil && !hasStatus(errContainer, http.StatusConflict) {
+		return nil, errContainer
+	}
+
+	container, errOpen := database.NewContainer(endpoint.Container)
+	if errOpen != nil {
+		return nil, errOpen
+	}
+
+	return NewStoreWithContainer(container), nil
+}
+
+// NewStoreWithContainer creates a new Cosmos DB backed event store with an existing
+// container, which must be partitioned by /aggregate_key.
+func NewStoreWithContainer(container *azcosmos.ContainerClient) eventsourcing.EventStore {
+	engine := &cosmosEventStore{
+		container: container,
+		pageSize:  keyvalue.DefaultPageSize,
+	}
+
+	return keyvalue.NewStore(keyvalue.Options{
+		CheckSequence:  engine.checkExists,
+		FetchPages:     engine.fetchPages,
+		PutEvents:      engine.putEvents,
+		LatestSequence: engine.latestSequence,
+		Ping:           engine.ping,
+	})
+}
+
+// ping checks that the container can be read.
+func (store *cosmosEventStore) ping(ctx context.Context) error {
+	_, errRead := store.container.Read(ctx, nil)
+	return errRead
+}
+
+// checkExists checks that a particular sequence number exists in the store, with
+// a point read of its document.
+func (store *cosmosEventStore) checkExists(key string, seq int64) (bool, error) {
+	_, errRead := store.container.ReadItem(context.Background(), azcosmos.NewPartitionKeyString(key), documentID(seq), nil)
+	if hasStatus(errRead, http.StatusNotFound) {
+		return false, nil
+	}
+
+	return errRead == nil, errRead
+}
+
+// latestSequence gets the sequence of the last event of a stream, or zero if there
+// are none.
+func (store *cosmosEventStore) latestSequence(key string) (int64, error) {
+	pager := store.container.NewQueryItemsPager(
+		"SELECT TOP 1 VALUE c.seq FROM c ORDER BY c.seq DESC",
+		azcosmos.NewPartitionKeyString(key),
+		nil,
+	)
+
+	for pager.More() {
+		page, errPage := pager.NextPage(context.Background())
+		if errPage != nil {
+			return 0, errPage
+		}
+
+		if len(page.Items) > 0 {
+			var latest int64
+			errDecode := json.Unmarshal(page.Items[0], &latest)
+			return latest, errDecode
+		}
+	}
+
+	return 0, nil
+}
+
+// putEvents writes the events of a commit in a single transactional batch, which
+// fails as a whole if any of their sequences have already been written.
+func (store *cosmosEventStore) putEvents(events []keyvalue.KeyedEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	if len(events) > MaxBatchItems {
+		return fmt.Errorf("StoreError: A commit of %v events exceeds the Cosmos DB limit of %v per transactional batch", len(events), MaxBatchItems)
+	}
+
+	first := events[0]
+	batch := store.container.NewTransactionalBatch(azcosmos.NewPartitionKeyString(first.Key))
+	for _, event := range events {
+		buff, errEncode := encodeEvent(event)
+		if errEncode != nil {
+			return errEncode
+		}
+		batch.CreateItem(buff, nil)
+	}
+
+	response, errBatch := store.container.ExecuteTransactionalBatch(context.Background(), batch, nil)
+	if hasStatus(errBatch, http.StatusConflict) || batchStatus(response) == http.StatusConflict {
+		return eventsourcing.NewConcurrencyFault(first.Key, first.Sequence)
+	}
+	if errBatch != nil {
+		return errBatch
+	}
+	if !response.Success {
+		return fmt.Errorf("StoreError: Cosmos DB rejected the commit of %v at %v with status %v", first.Key, first.Sequence, batchStatus(response))
+	}
+
+	return nil
+}
+
+// fetchPages loads the events beyond the specified sequence number a page at a time.
+func (store *cosmosEventStore) fetchPages(key string, seq int64, page keyvalue.PageCallback) error {
+	pager := store.container.NewQueryItemsPager(
+		"SELECT * FROM c WHERE c.seq > @seq ORDER BY c.seq",
+		azcosmos.NewPartitionKeyString(key),
+		&azcosmos.QueryOptions{
+			PageSizeHint:    store.pageSize,
+			QueryParameters: []azcosmos.QueryParameter{{Name: "@seq", Value: seq}},
+		},
+	)
+
+	for pager.More() {
+		response, errPage := pager.NextPage(context.Background())
+		if errPage != nil {
+			return errPage
+		}
+		if len(response.Items) == 0 {
+			continue
+		}
+
+		loaded := make([]keyvalue.KeyedEvent, len(response.Items))
+		for index, item := range response.Items {
+			event, errDecode := decodeEvent(item)
+			if errDecode != nil {
+				return errDecode
+			}
+			loaded[index] = event
+		}
+
+		errCallback := page(loaded)
+		if errCallback != nil {
+			return errCallback
+		}
+	}
+
+	return nil
+}
+
+// documentID gets the id of the document of an event, zero-padded so that ids sort
+// in sequence order
+func documentID(sequence int64) string {
+	return fmt.Sprintf("%020d", sequence)
+}
+
+// encodeEvent converts an event into its document
+func encodeEvent(event keyvalue.KeyedEvent) ([]byte, error) {
+	body, errBody := json.Marshal(event.EventData)
+	if errBody != nil {
+		return nil, errBody
+	}
+
+	return json.Marshal(document{
+		ID:        documentID(event.Sequence),
+		Key:       event.Key,
+		Sequence:  event.Sequence,
+		EventType: event.EventType,
+		EventData: body,
+		Metadata:  event.Metadata,
+	})
+}
+
+// decodeEvent converts a document back into an event
+func decodeEvent(item []byte) (keyvalue.KeyedEvent, error) {
+	stored := document{}
+	errDocument := json.Unmarshal(item, &stored)
+	if errDocument != nil {
+		return keyvalue.KeyedEvent{}, errDocument
+	}
+
+	// Rehydrate the JSON
+	target := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(stored.EventData))
+	decoder.UseNumber()
+	errDecode := decoder.Decode(&target)
+	if errDecode != nil {
+		return keyvalue.KeyedEvent{}, fmt.Errorf("Could not decode event %v of %v: %v", stored.Sequence, stored.Key, errDecode)
+	}
+
+	return keyvalue.KeyedEvent{
+		Key:       stored.Key,
+		Sequence:  stored.Sequence,
+		EventType: stored.EventType,
+		EventData: target,
+		Metadata:  stored.Metadata,
+	}, nil
+}
+
+// hasStatus determines if an error is a response from Cosmos DB with a status code.
+func hasStatus(err error, status int) bool {
+	var response *azcore.ResponseError
+	return errors.As(err, &response) && response.StatusCode == status
+}
+
+// batchStatus gets the status of the operation that caused a transactional batch to
+// fail, which is the first that didn't fail only because another did, or zero if the
+// batch succeeded.
+func batchStatus(response azcosmos.TransactionalBatchResponse) int {
+	if response.Success {
+		return 0
+	}
+
+	for _, result := range response.OperationResults {
+		if result.StatusCode != http.StatusFailedDependency {
+			return int(result.StatusCode)
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,155 @@
+package cosmos
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testEndpoint gets an endpoint with a fresh container on the test account,
+// skipping the test unless COSMOS_TEST_HOST is set to its connection string
+func testEndpoint(t *testing.T) Endpoint {
+	connection := os.Getenv("COSMOS_TEST_HOST")
+	if connection == "" {
+		t.Skip("COSMOS_TEST_HOST is not set")
+	}
+
+	return Endpoint{
+		ConnectionString: connection,
+		Database:         "TestDatabase",
+		Container:        fmt.Sprintf("events-%s", uuid.NewV4()),
+	}
+}
+
+// dropContainer removes the container of a test endpoint
+func dropContainer(endpoint Endpoint) {
+	client, errClient := azcosmos.NewClientFromConnectionString(endpoint.ConnectionString, nil)
+	if errClient != nil {
+		return
+	}
+	container, errContainer := client.NewContainer(endpoint.Database, endpoint.Container)
+	if errContainer != nil {
+		return
+	}
+	container.Delete(context.Background(), nil)
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	testEndpoint(t)
+	test.CheckStandardSuite(t, "Cosmos DB", func() (eventsourcing.EventStore, func(), error) {
+		endpoint := testEndpoint(t)
+		store, errStore := NewStore(endpoint)
+		return store, func() {
+			dropContainer(endpoint)
+		}, errStore
+	})
+}
+
+// TestConcurrentCommit checks a commit written at a sequence that has already been
+// written fails with a ConcurrencyFault, and writes none of its events
+func TestConcurrentCommit(t *testing.T) {
+	endpoint := testEndpoint(t)
+	store, errStore := NewStore(endpoint)
+	require.Nil(t, errStore)
+	defer dropContainer(endpoint)
+
+	client, _ := azcosmos.NewClientFromConnectionString(endpoint.ConnectionString, nil)
+	container, _ := client.NewContainer(endpoint.Database, endpoint.Container)
+	engine := &cosmosEventStore{container: container, pageSize: keyvalue.DefaultPageSize}
+	first := keyvalue.KeyedEvent{Key: "a", Sequence: 1, EventType: "IncrementEvent", EventData: map[string]interface{}{"increment_by": 1}}
+	assert.Nil(t, engine.putEvents([]keyvalue.KeyedEvent{first}))
+
+	second := first
+	second.Sequence = 2
+	errAgain := engine.putEvents([]keyvalue.KeyedEvent{first, second})
+	conflict, fault := eventsourcing.IsConcurrencyFault(errAgain)
+	assert.True(t, conflict, "Expected a ConcurrencyFault, got %v", errAgain)
+	if conflict {
+		assert.Equal(t, "a", fault.AggregateKey)
+	}
+
+	written, errExists := engine.checkExists("a", 2)
+	assert.Nil(t, errExists)
+	assert.False(t, written, "Events of a rejected batch shouldn't be written")
+	latest, errLatest := engine.latestSequence("a")
+	assert.Nil(t, errLatest)
+	assert.Equal(t, int64(1), latest)
+	assert.Nil(t, store.Close())
+}
+
+// TestOversizedCommit checks commits too large for a transactional batch are
+// rejected before they're sent
+func TestOversizedCommit(t *testing.T) {
+	engine := &cosmosEventStore{}
+	events := make([]keyvalue.KeyedEvent, MaxBatchItems+1)
+	for index := range events {
+		events[index] = keyvalue.KeyedEvent{Key: "a", Sequence: int64(index + 1), EventType: "IncrementEvent"}
+	}
+	assert.NotNil(t, engine.putEvents(events))
+}
+
+// TestDocumentRoundTrip checks events are decoded as they were encoded, under ids
+// that sort in sequence order
+func TestDocumentRoundTrip(t *testing.T) {
+	assert.Equal(t, "00000000000000000042", documentID(42))
+	assert.True(t, documentID(9) < documentID(10))
+
+	buff, errEncode := encodeEvent(keyvalue.KeyedEvent{
+		Key:       "a",
+		Sequence:  42,
+		EventType: "IncrementEvent",
+		EventData: map[string]interface{}{"increment_by": 2},
+		Metadata:  map[string]interface{}{"correlation_id": "c-1"},
+	})
+	require.Nil(t, errEncode)
+
+	stored := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(buff, &stored))
+	assert.Equal(t, "00000000000000000042", stored["id"])
+	assert.Equal(t, "a", stored["aggregate_key"])
+
+	decoded, errDecode := decodeEvent(buff)
+	require.Nil(t, errDecode)
+	assert.Equal(t, "a", decoded.Key)
+	assert.Equal(t, int64(42), decoded.Sequence)
+	assert.Equal(t, eventsourcing.EventType("IncrementEvent"), decoded.EventType)
+	assert.Equal(t, json.Number("2"), decoded.EventData.(map[string]interface{})["increment_by"])
+	assert.Equal(t, "c-1", decoded.Metadata["correlation_id"])
+}
+
+// TestConflictDetection checks conflicts are found in failed batches and errors,
+// and other failures aren't taken for them
+func TestConflictDetection(t *testing.T) {
+	assert.Equal(t, 0, batchStatus(azcosmos.TransactionalBatchResponse{Success: true}))
+	assert.Equal(t, http.StatusConflict, batchStatus(azcosmos.TransactionalBatchResponse{
+		OperationResults: []azcosmos.TransactionalBatchResult{
+			{StatusCode: http.StatusFailedDependency},
+			{StatusCode: http.StatusConflict},
+			{StatusCode: http.StatusFailedDependency},
+		},
+	}))
+	assert.Equal(t, http.StatusTooManyRequests, batchStatus(azcosmos.TransactionalBatchResponse{
+		OperationResults: []azcosmos.TransactionalBatchResult{{StatusCode: http.StatusTooManyRequests}},
+	}))
+
+	conflict := &azcore.ResponseError{StatusCode: http.StatusConflict}
+	assert.True(t, hasStatus(conflict, http.StatusConflict))
+	assert.True(t, hasStatus(fmt.Errorf("batch: %w", conflict), http.StatusConflict))
+	assert.False(t, hasStatus(&azcore.ResponseError{StatusCode: http.StatusNotFound}, http.StatusConflict))
+	assert.False(t, hasStatus(errors.New("connection refused"), http.StatusConflict))
+	assert.False(t, hasStatus(nil, http.StatusConflict))
+}
@@ -0,0 +1,197 @@
+package dynamo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/utilities/dynamoattr"
+)
+
+const (
+	// FeedIndex is the global secondary index the global feed is read from.
+	FeedIndex = "global-feed"
+
+	// FeedPartitionAttribute is the hash key of the feed index, which holds
+	// FeedPartition for every event.
+	FeedPartitionAttribute = "feed_partition"
+
+	// FeedPositionAttribute is the range key of the feed index, which holds the
+	// position of an event in the feed.
+	FeedPositionAttribute = "feed_position"
+
+	// FeedPartition is the value of the feed partition attribute.
+	FeedPartition = "all"
+
+	// CategoryIndex is the global secondary index categories are read from.
+	CategoryIndex = "category-feed"
+
+	// CategoryAttribute is the hash key of the category index, which holds the
+	// category of events committed with one. The range key is the feed position.
+	CategoryAttribute = "category"
+
+	// CorrelationIndex is the global secondary index business transactions are
+	// read from.
+	CorrelationIndex = "correlation-feed"
+
+	// CorrelationAttribute is the hash key of the correlation index, which holds the
+	// correlation ID of events committed with one. The range key is the feed position.
+	CorrelationAttribute = "correlation_id"
+)
+
+// CreateFeedIndex adds the FeedIndex global secondary index to a table, with the
+// specified provisioned throughput. Only events written once the store has the
+// GlobalFeed option set appear in the index.
+func CreateFeedIndex(ctx context.Context, client *dynamodb.Client, tableName string, readCapacity int64, writeCapacity int64) error {
+	return createIndex(ctx, client, tableName, FeedIndex, FeedPartitionAttribute, readCapacity, writeCapacity)
+}
+
+// CreateCategoryIndex adds the CategoryIndex global secondary index to a table, with
+// the specified provisioned throughput. Only events written once the store has the
+// GlobalFeed option set appear in the index.
+func CreateCategoryIndex(ctx context.Context, client *dynamodb.Client, tableName string, readCapacity int64, writeCapacity int64) error {
+	return createIndex(ctx, client, tableName, CategoryIndex, CategoryAttribute, readCapacity, writeCapacity)
+}
+
+// CreateCorrelationIndex adds the CorrelationIndex global secondary index to a
+// table, with the specified provisioned throughput. Only events written once the
+// store has the GlobalFeed option set appear in the index.
+func CreateCorrelationIndex(ctx context.Context, client *dynamodb.Client, tableName string, readCapacity int64, writeCapacity int64) error {
+	return createIndex(ctx, client, tableName, CorrelationIndex, CorrelationAttribute, readCapacity, writeCapacity)
+}
+
+// createIndex adds a global secondary index to a table, ranged by feed position.
+func createIndex(ctx context.Context, client *dynamodb.Client, tableName string, indexName string, hashAttribute string, readCapacity int64, writeCapacity int64) error {
+	_, errUpdate := client.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String(hashAttribute),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String(FeedPositionAttribute),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+			{
+				Create: &types.CreateGlobalSecondaryIndexAction{
+					IndexName: aws.String(indexName),
+					KeySchema: []types.KeySchemaElement{
+						{
+							AttributeName: aws.String(hashAttribute),
+							KeyType:       types.KeyTypeHash,
+						},
+						{
+							AttributeName: aws.String(FeedPositionAttribute),
+							KeyType:       types.KeyTypeRange,
+						},
+					},
+					Projection: &types.Projection{
+						ProjectionType: types.ProjectionTypeAll,
+					},
+					ProvisionedThroughput: &types.ProvisionedThroughput{
+						ReadCapacityUnits:  aws.Int64(readCapacity),
+						WriteCapacityUnits: aws.Int64(writeCapacity),
+					},
+				},
+			},
+		},
+	})
+	return errUpdate
+}
+
+// feedPosition builds the position of an event in the feed, which orders events by
+// commit time, and then by key and sequence for events committed together.
+func feedPosition(committed time.Time, key string, seq int64) string {
+	return fmt.Sprintf("%020d/%v/%020d", committed.UnixNano(), key, seq)
+}
+
+// readAll reads events from the global feed.
+func (store *eventStore) readAll(from string, limit int) ([]keyvalue.PositionedEvent, error) {
+	return store.queryFeed(FeedIndex, FeedPartitionAttribute, FeedPartition, from, limit)
+}
+
+// readCategory reads the events of a category from the global feed.
+func (store *eventStore) readCategory(category string, from string, limit int) ([]keyvalue.PositionedEvent, error) {
+	return store.queryFeed(CategoryIndex, CategoryAttribute, category, from, limit)
+}
+
+// readCorrelation reads the events of a business transaction from the global feed.
+func (store *eventStore) readCorrelation(correlationID string, from string, limit int) ([]keyvalue.PositionedEvent, error) {
+	return store.queryFeed(CorrelationIndex, CorrelationAttribute, correlationID, from, limit)
+}
+
+// queryFeed reads events from an index partition in feed order, following query
+// pages until enough events are read or the partition ends. Events committed within
+// the skew window aren't read yet, since events from writers with slower clocks may
+// still be committed before them.
+func (store *eventStore) queryFeed(indexName string, hashAttribute string, hashValue string, from string, limit int) ([]keyvalue.PositionedEvent, error) {
+	ctx, cancel := store.context()
+	defer cancel()
+
+	input := &dynamodb.QueryInput{
+		IndexName:              aws.String(indexName),
+		KeyConditionExpression: aws.String("#partition = :partition"),
+		ExpressionAttributeNames: map[string]string{
+			"#partition": hashAttribute,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":partition": &types.AttributeValueMemberS{Value: hashValue},
+		},
+		Limit:     aws.Int32(int32(limit)),
+		TableName: aws.String(store.tableName),
+	}
+	if from != "" {
+		input.KeyConditionExpression = aws.String("#partition = :partition AND #position > :from")
+		input.ExpressionAttributeNames["#position"] = FeedPositionAttribute
+		input.ExpressionAttributeValues[":from"] = &types.AttributeValueMemberS{Value: from}
+	}
+
+	// Positions start with their commit time, so those at or after the cutoff sort
+	// after its padded time
+	cutoff := fmt.Sprintf("%020d", store.clock.Now().Add(-store.skew).UnixNano())
+
+	result := make([]keyvalue.PositionedEvent, 0, limit)
+	pages := dynamodb.NewQueryPaginator(store.service, input)
+
+	// Pages may be cut short by size, so keep going until we have enough
+	for len(result) < limit && pages.HasMorePages() {
+		output, errQuery := pages.NextPage(ctx)
+		if errQuery != nil {
+			return nil, errQuery
+		}
+
+		for _, item := range output.Items {
+			position := dynamoattr.String(item[FeedPositionAttribute])
+			if position >= cutoff {
+				return truncate(result, limit), nil
+			}
+
+			target, errUnmarshal := unmarshalEvent(item)
+			if errUnmarshal != nil {
+				return nil, errUnmarshal
+			}
+
+			result = append(result, keyvalue.PositionedEvent{
+				KeyedEvent: target,
+				Position:   position,
+			})
+		}
+	}
+
+	return truncate(result, limit), nil
+}
+
+// truncate cuts the events read from the feed down to the limit.
+func truncate(events []keyvalue.PositionedEvent, limit int) []keyvalue.PositionedEvent {
+	if len(events) > limit {
+		return events[:limit]
+	}
+	return events
+}
@@ -0,0 +1,198 @@
+package dynamo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/simclock"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConfig gets the configuration of a client of a fake DynamoDB, which doesn't
+// retry failed requests
+func fakeConfig(server *httptest.Server) aws.Config {
+	config := LocalConfig(server.URL, "ap-southeast-2")
+	config.RetryMaxAttempts = 1
+	return config
+}
+
+// position gets a feed position for a commit made well before the tests run
+func position(seq int64) string {
+	return feedPosition(time.Unix(1000, 0), "x", seq)
+}
+
+// TestFeedAttributes checks events carry their feed position when the global feed
+// is enabled.
+func TestFeedAttributes(t *testing.T) {
+	operations := make([]string, 0)
+	requests := make([]map[string]interface{}, 0)
+	server := fakeDynamo(t, http.StatusOK, `{}`, &operations, &requests)
+	defer server.Close()
+
+	plain, _ := NewStore(fakeConfig(server), "test-store")
+	_, supported := plain.(eventsourcing.GlobalReader).ReadAll("", 10)
+	assert.NotNil(t, supported, "The feed must be enabled")
+
+	store, errStore := NewStoreWithOptions(fakeConfig(server), "test-store", Options{GlobalFeed: true})
+	require.Nil(t, errStore)
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("feed", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+
+	item := requests[len(requests)-1]["Item"].(map[string]interface{})
+	assert.Equal(t, FeedPartition, item[FeedPartitionAttribute].(map[string]interface{})["S"])
+	position := item[FeedPositionAttribute].(map[string]interface{})["S"].(string)
+	assert.True(t, strings.HasSuffix(position, "/feed/00000000000000000001"))
+	assert.Nil(t, item[CategoryAttribute], "Events without a category aren't indexed by category")
+	assert.Nil(t, item[CorrelationAttribute], "Events without a correlation ID aren't indexed by correlation")
+
+	// Events with a category carry it for the category index
+	categorized := test.SimpleAggregate{}
+	categorized.Initialize("categorized", test.GetTestRegistry(), store)
+	categorized.UseCategory("Counter")
+	categorized.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, categorized.Commit())
+
+	item = requests[len(requests)-1]["Item"].(map[string]interface{})
+	assert.Equal(t, "Counter", item[CategoryAttribute].(map[string]interface{})["S"])
+
+	// Events with a correlation ID carry it for the correlation index
+	correlated := test.SimpleAggregate{}
+	correlated.Initialize("correlated", test.GetTestRegistry(), store)
+	correlated.UseLineage("order-1", "command-1")
+	correlated.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, correlated.Commit())
+
+	item = requests[len(requests)-1]["Item"].(map[string]interface{})
+	assert.Equal(t, "order-1", item[CorrelationAttribute].(map[string]interface{})["S"])
+}
+
+// TestReadAll checks the feed is read from the index, following pages until the
+// limit is reached.
+func TestReadAll(t *testing.T) {
+	item := `{"aggregate_key":{"S":"%v"},"seq":{"N":"%v"},"type":{"S":"IncrementEvent"},"data":{"M":{"increment_by":{"N":"1"}}},"feed_partition":{"S":"all"},"feed_position":{"S":"%v"}}`
+	p0, p1, p2, p3 := position(0), position(1), position(2), position(3)
+	first := `{"Items":[` + fmt.Sprintf(item, "a", 1, p1) + `],"LastEvaluatedKey":{"feed_partition":{"S":"all"},"feed_position":{"S":"` + p1 + `"}}}`
+	second := `{"Items":[` + fmt.Sprintf(item, "b", 1, p2) + `,` + fmt.Sprintf(item, "a", 2, p3) + `]}`
+
+	requests := make([]map[string]interface{}, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decoded := make(map[string]interface{})
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&decoded))
+		assert.Equal(t, "DynamoDB_20120810.Query", r.Header.Get("X-Amz-Target"))
+		requests = append(requests, decoded)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		if decoded["ExclusiveStartKey"] == nil {
+			w.Write([]byte(first))
+			return
+		}
+		w.Write([]byte(second))
+	}))
+	defer server.Close()
+
+	store, _ := NewStoreWithOptions(fakeConfig(server), "test-store", Options{GlobalFeed: true})
+	events, errRead := store.(eventsourcing.GlobalReader).ReadAll(p0, 2)
+	assert.Nil(t, errRead)
+
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "a", events[0].Key)
+	assert.Equal(t, p1, events[0].Position)
+	assert.Equal(t, "b", events[1].Key)
+	assert.Equal(t, p2, events[1].Position)
+
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, FeedIndex, requests[0]["IndexName"])
+	assert.Equal(t, "#partition = :partition AND #position > :from", requests[0]["KeyConditionExpression"])
+	assert.Equal(t, p0, requests[0]["ExpressionAttributeValues"].(map[string]interface{})[":from"].(map[string]interface{})["S"])
+}
+
+// TestReadCategory checks categories are read from their own index partition.
+func TestReadCategory(t *testing.T) {
+	item := `{"aggregate_key":{"S":"a"},"seq":{"N":"1"},"type":{"S":"IncrementEvent"},"data":{"M":{}},"category":{"S":"Counter"},"feed_position":{"S":"` + position(1) + `"}}`
+	operations := make([]string, 0)
+	requests := make([]map[string]interface{}, 0)
+	server := fakeDynamo(t, http.StatusOK, `{"Items":[`+item+`]}`, &operations, &requests)
+	defer server.Close()
+
+	store, _ := NewStoreWithOptions(fakeConfig(server), "test-store", Options{GlobalFeed: true})
+	events, errRead := store.(eventsourcing.CategoryReader).ReadCategory("Counter", "", 10)
+	assert.Nil(t, errRead)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, position(1), events[0].Position)
+
+	assert.Equal(t, CategoryIndex, requests[0]["IndexName"])
+	assert.Equal(t, "#partition = :partition", requests[0]["KeyConditionExpression"])
+	assert.Equal(t, CategoryAttribute, requests[0]["ExpressionAttributeNames"].(map[string]interface{})["#partition"])
+	assert.Equal(t, "Counter", requests[0]["ExpressionAttributeValues"].(map[string]interface{})[":partition"].(map[string]interface{})["S"])
+}
+
+// TestReadCorrelation checks business transactions are read from their own index
+// partition.
+func TestReadCorrelation(t *testing.T) {
+	item := `{"aggregate_key":{"S":"a"},"seq":{"N":"1"},"type":{"S":"IncrementEvent"},"data":{"M":{}},"correlation_id":{"S":"order-1"},"feed_position":{"S":"` + position(1) + `"}}`
+	operations := make([]string, 0)
+	requests := make([]map[string]interface{}, 0)
+	server := fakeDynamo(t, http.StatusOK, `{"Items":[`+item+`]}`, &operations, &requests)
+	defer server.Close()
+
+	store, _ := NewStoreWithOptions(fakeConfig(server), "test-store", Options{GlobalFeed: true})
+	events, errRead := store.(eventsourcing.CorrelationReader).ReadCorrelation("order-1", "", 10)
+	assert.Nil(t, errRead)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, position(1), events[0].Position)
+
+	assert.Equal(t, CorrelationIndex, requests[0]["IndexName"])
+	assert.Equal(t, CorrelationAttribute, requests[0]["ExpressionAttributeNames"].(map[string]interface{})["#partition"])
+	assert.Equal(t, "order-1", requests[0]["ExpressionAttributeValues"].(map[string]interface{})[":partition"].(map[string]interface{})["S"])
+}
+
+// TestFeedSkewWindow checks positions are taken from the clock, and reads stop at
+// events committed within the skew window
+func TestFeedSkewWindow(t *testing.T) {
+	clock := simclock.New(time.Unix(2000, 0))
+	settled := feedPosition(clock.Now().Add(-time.Minute), "a", 1)
+	recent := feedPosition(clock.Now().Add(-time.Second), "b", 1)
+	item := `{"aggregate_key":{"S":"%v"},"seq":{"N":"1"},"type":{"S":"IncrementEvent"},"data":{"M":{}},"feed_partition":{"S":"all"},"feed_position":{"S":"%v"}}`
+	response := `{"Items":[` + fmt.Sprintf(item, "a", settled) + `,` + fmt.Sprintf(item, "b", recent) + `]}`
+
+	operations := make([]string, 0)
+	requests := make([]map[string]interface{}, 0)
+	server := fakeDynamo(t, http.StatusOK, response, &operations, &requests)
+	defer server.Close()
+
+	store, _ := NewStoreWithOptions(fakeConfig(server), "test-store", Options{
+		GlobalFeed: true,
+		Clock:      clock,
+		SkewWindow: 5 * time.Second,
+	})
+	events, errRead := store.(eventsourcing.GlobalReader).ReadAll("", 10)
+	assert.Nil(t, errRead)
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, settled, events[0].Position)
+	}
+
+	// Once the window has passed, the later event is read
+	clock.Advance(5 * time.Second)
+	events, _ = store.(eventsourcing.GlobalReader).ReadAll("", 10)
+	assert.Equal(t, 2, len(events))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("clocked", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+	stored := requests[len(requests)-1]["Item"].(map[string]interface{})
+	written := stored[FeedPositionAttribute].(map[string]interface{})["S"].(string)
+	assert.Equal(t, feedPosition(clock.Now(), "clocked", 1), written)
+}
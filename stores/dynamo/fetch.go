@@ -0,0 +1,189 @@
+package dynamo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+)
+
+// ParallelSegmentSize is the fewest events fetched by each query when a stream is
+// fetched in parallel, so that short streams aren't split into tiny queries.
+const ParallelSegmentSize = int64(1000)
+
+// ParallelBufferPages is the most pages the query of a range fetches ahead, while
+// waiting for the ranges before it to be applied.
+const ParallelBufferPages = 4
+
+// eventProjection is the projection of the attributes needed to replay an event,
+// leaving out the feed and time-to-live attributes.
+const eventProjection = "#key, #seq, #type, #data, #metadata"
+
+// fetchPages fetches events from the store, passing on each page of query results.
+// Long streams are fetched with parallel queries if the store allows it.
+func (store *eventStore) fetchPages(key string, seq int64, page keyvalue.PageCallback) error {
+	if store.parallel <= 1 {
+		ctx, cancel := store.context()
+		defer cancel()
+		return store.queryRange(ctx, key, seq, 0, page)
+	}
+
+	latest, errLatest := store.latestSequence(key)
+	if errLatest != nil {
+		return errLatest
+	}
+
+	ctx, cancel := store.context()
+	defer cancel()
+
+	segments := segmentRanges(seq, latest, store.parallel)
+	if len(segments) <= 1 {
+		return store.queryRange(ctx, key, seq, 0, page)
+	}
+
+	return store.fetchParallel(ctx, key, segments, page)
+}
+
+// segmentRange is a range of sequence numbers, after from and up to and including
+// to, or with no end if to is zero.
+type segmentRange struct {
+	from int64
+	to   int64
+}
+
+// segmentRanges splits the events after seq, up to latest, into at most parallel
+// ranges of at least ParallelSegmentSize events. The last range has no end, so that
+// it picks up events committed since latest was read.
+func segmentRanges(seq int64, latest int64, parallel int) []segmentRange {
+	remaining := latest - seq
+	count := remaining / ParallelSegmentSize
+	if count > int64(parallel) {
+		count = int64(parallel)
+	}
+	if count <= 1 {
+		return []segmentRange{{from: seq}}
+	}
+
+	size := (remaining + count - 1) / count
+	ranges := make([]segmentRange, 0, count)
+	for from := seq; from < latest; from += size {
+		ranges = append(ranges, segmentRange{from: from, to: from + size})
+	}
+	ranges[len(ranges)-1].to = 0
+	return ranges
+}
+
+// fetchParallel queries each range concurrently, and applies the pages of each
+// range in order. Pages of the first range are applied as they are fetched, while
+// the queries of later ranges fetch ahead by at most ParallelBufferPages pages,
+// waiting until the ranges before them have been applied. If a range fails the
+// other queries are abandoned, by cancelling their context.
+func (store *eventStore) fetchParallel(ctx context.Context, key string, segments []segmentRange, page keyvalue.PageCallback) error {
+	type segmentPage struct {
+		events []keyvalue.KeyedEvent
+		err    error
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	buffers := make([]chan segmentPage, len(segments))
+	for index, segment := range segments[1:] {
+		buffer := make(chan segmentPage, ParallelBufferPages)
+		buffers[index+1] = buffer
+		go func(segment segmentRange) {
+			defer close(buffer)
+			errQuery := store.queryRange(ctx, key, segment.from, segment.to, func(events []keyvalue.KeyedEvent) error {
+				select {
+				case buffer <- segmentPage{events: events}:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if errQuery != nil && ctx.Err() == nil {
+				select {
+				case buffer <- segmentPage{err: errQuery}:
+				case <-ctx.Done():
+				}
+			}
+		}(segment)
+	}
+
+	errFirst := store.queryRange(ctx, key, segments[0].from, segments[0].to, page)
+	if errFirst != nil {
+		return errFirst
+	}
+
+	for _, buffer := range buffers[1:] {
+		for fetched := range buffer {
+			if fetched.err != nil {
+				return fetched.err
+			}
+
+			errPage := page(fetched.events)
+			if errPage != nil {
+				return errPage
+			}
+		}
+	}
+
+	// A range that was cut short by the store closing delivers no error of its own
+	return ctx.Err()
+}
+
+// queryRange fetches the events of a stream after from, up to and including to (or
+// to the end of the stream if to is zero), passing on each page of query results.
+func (store *eventStore) queryRange(ctx context.Context, key string, from int64, to int64, page keyvalue.PageCallback) error {
+	input := &dynamodb.QueryInput{
+		ConsistentRead:         aws.Bool(true),
+		KeyConditionExpression: aws.String("#key = :key AND #seq > :from"),
+		ProjectionExpression:   aws.String(eventProjection),
+		ExpressionAttributeNames: map[string]string{
+			"#key":      "aggregate_key",
+			"#seq":      "seq",
+			"#type":     "type",
+			"#data":     "data",
+			"#metadata": "metadata",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":key":  &types.AttributeValueMemberS{Value: key},
+			":from": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", from)},
+		},
+		Limit:     aws.Int32(keyvalue.DefaultPageSize),
+		TableName: aws.String(store.tableName),
+	}
+	if to > 0 {
+		input.KeyConditionExpression = aws.String("#key = :key AND #seq BETWEEN :from AND :to")
+		input.ExpressionAttributeValues[":from"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", from+1)}
+		input.ExpressionAttributeValues[":to"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", to)}
+	}
+
+	pages := dynamodb.NewQueryPaginator(store.service, input)
+	for pages.HasMorePages() {
+		output, errQuery := pages.NextPage(ctx)
+		if errQuery != nil {
+			return errQuery
+		}
+
+		loaded := make([]keyvalue.KeyedEvent, 0, len(output.Items))
+		for _, item := range output.Items {
+			target, errUnmarshal := unmarshalEvent(item)
+			if errUnmarshal != nil {
+				return errUnmarshal
+			}
+			loaded = append(loaded, target)
+		}
+
+		// Apply the page before fetching the next, stopping if it fails
+		errPage := page(loaded)
+		if errPage != nil {
+			return errPage
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package dynamo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	keyvalue "github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSegmentRanges checks long streams are split into ranges of at least
+// ParallelSegmentSize events, capped by the parallelism
+func TestSegmentRanges(t *testing.T) {
+	assert.Equal(t, []segmentRange{{from: 0}}, segmentRanges(0, 900, 4), "Short streams aren't split")
+	assert.Equal(t, []segmentRange{{from: 5000}}, segmentRanges(5000, 5000, 4), "Up to date streams aren't split")
+	assert.Equal(t, []segmentRange{{from: 0, to: 1250}, {from: 1250}}, segmentRanges(0, 2500, 4))
+	assert.Equal(t, []segmentRange{
+		{from: 100, to: 3434},
+		{from: 3434, to: 6768},
+		{from: 6768},
+	}, segmentRanges(100, 10100, 3))
+}
+
+// fakeStream responds to queries for a stream of increments, recording the key
+// conditions of the queries for events
+func fakeStream(t *testing.T, length int64, conditions *[]string) *httptest.Server {
+	item := `{"aggregate_key":{"S":"long"},"seq":{"N":"%v"},"type":{"S":"IncrementEvent"},"data":{"M":{"increment_by":{"N":"1"}}}}`
+	lock := sync.Mutex{}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decoded := make(map[string]interface{})
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&decoded))
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+
+		// Latest sequence lookups
+		if decoded["ScanIndexForward"] == false {
+			fmt.Fprintf(w, `{"Items":[{"seq":{"N":"%v"}}]}`, length)
+			return
+		}
+
+		values := decoded["ExpressionAttributeValues"].(map[string]interface{})
+		bound := func(name string) int64 {
+			value, ok := values[name].(map[string]interface{})
+			if !ok {
+				return length
+			}
+			parsed, _ := strconv.ParseInt(value["N"].(string), 10, 64)
+			return parsed
+		}
+
+		condition := decoded["KeyConditionExpression"].(string)
+		from, to := bound(":from"), bound(":to")
+		if !strings.Contains(condition, "BETWEEN") {
+			from++
+		}
+
+		lock.Lock()
+		*conditions = append(*conditions, fmt.Sprintf("%v..%v", from, to))
+		lock.Unlock()
+
+		items := make([]string, 0)
+		for seq := from; seq <= to; seq++ {
+			items = append(items, fmt.Sprintf(item, seq))
+		}
+		fmt.Fprintf(w, `{"Items":[%v]}`, strings.Join(items, ","))
+	}))
+}
+
+// TestParallelFetch checks long streams are fetched with a query per range, and
+// replayed in order
+func TestParallelFetch(t *testing.T) {
+	conditions := make([]string, 0)
+	server := fakeStream(t, 2500, &conditions)
+	defer server.Close()
+
+	store, errStore := NewStoreWithOptions(fakeConfig(server), "test-store", Options{Parallel: 4})
+	require.Nil(t, errStore)
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("long", test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	assert.Equal(t, 2500, agg.CurrentCount)
+	assert.Equal(t, int64(2500), agg.SequenceNumber())
+	assert.ElementsMatch(t, []string{"1..1250", "1251..2500"}, conditions)
+}
+
+// TestParallelFetchStreamsFirstRange checks the pages of the first range are
+// applied while the queries of later ranges are still running
+func TestParallelFetchStreamsFirstRange(t *testing.T) {
+	conditions := make([]string, 0)
+	stream := fakeStream(t, 2500, &conditions)
+	defer stream.Close()
+
+	// The query of the last range is held until the first range has been applied
+	release := make(chan struct{})
+	released := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), "#seq > :from") && !strings.Contains(string(body), "ScanIndexForward") {
+			select {
+			case <-release:
+				released = true
+			case <-time.After(5 * time.Second):
+			}
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		stream.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	store := &eventStore{
+		service:   dynamodb.NewFromConfig(fakeConfig(server)),
+		tableName: "test-store",
+	}
+
+	applied := int64(0)
+	errFetch := store.fetchParallel(context.Background(), "long", segmentRanges(0, 2500, 4), func(events []keyvalue.KeyedEvent) error {
+		if applied == 0 {
+			close(release)
+		}
+		applied += int64(len(events))
+		return nil
+	})
+	assert.Nil(t, errFetch)
+	assert.Equal(t, int64(2500), applied)
+	assert.True(t, released, "The first range should be applied before the last is fetched")
+}
+
+// TestSequentialFetch checks streams are fetched with a single query by default
+func TestSequentialFetch(t *testing.T) {
+	conditions := make([]string, 0)
+	server := fakeStream(t, 2500, &conditions)
+	defer server.Close()
+
+	store, errStore := NewStoreWithOptions(fakeConfig(server), "test-store", Options{})
+	require.Nil(t, errStore)
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("long", test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	assert.Equal(t, 2500, agg.CurrentCount)
+	assert.Equal(t, []string{"1..2500"}, conditions)
+}
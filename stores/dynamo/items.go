@@ -0,0 +1,65 @@
+package dynamo
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/utilities/dynamoattr"
+)
+
+// marshalEvent converts an event to an item, with the attributes earlier versions
+// of the store wrote (see dynamoattr). The key and sequence are held in the
+// aggregate_key and seq attributes, which are the keys of the table.
+func marshalEvent(event keyvalue.KeyedEvent) (map[string]types.AttributeValue, error) {
+	data, errData := dynamoattr.Marshal(event.EventData)
+	if errData != nil {
+		return nil, errData
+	}
+
+	item := map[string]types.AttributeValue{
+		"aggregate_key": &types.AttributeValueMemberS{Value: event.Key},
+		"seq":           &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", event.Sequence)},
+		"type":          &types.AttributeValueMemberS{Value: string(event.EventType)},
+		"data":          data,
+	}
+	if len(event.Metadata) > 0 {
+		metadata, errMetadata := dynamoattr.Marshal(event.Metadata)
+		if errMetadata != nil {
+			return nil, errMetadata
+		}
+		item["metadata"] = metadata
+	}
+
+	return item, nil
+}
+
+// unmarshalEvent converts an item to an event.
+func unmarshalEvent(item map[string]types.AttributeValue) (keyvalue.KeyedEvent, error) {
+	seq, errSeq := dynamoattr.Int64(item["seq"])
+	if errSeq != nil {
+		return keyvalue.KeyedEvent{}, errSeq
+	}
+
+	data, errData := dynamoattr.Unmarshal(item["data"])
+	if errData != nil {
+		return keyvalue.KeyedEvent{}, errData
+	}
+
+	event := keyvalue.KeyedEvent{
+		Key:       dynamoattr.String(item["aggregate_key"]),
+		Sequence:  seq,
+		EventType: eventsourcing.EventType(dynamoattr.String(item["type"])),
+		EventData: data,
+	}
+
+	if metadata, ok := item["metadata"].(*types.AttributeValueMemberM); ok {
+		event.Metadata, errData = dynamoattr.UnmarshalMap(metadata.Value)
+		if errData != nil {
+			return keyvalue.KeyedEvent{}, errData
+		}
+	}
+
+	return event, nil
+}
@@ -1,74 +1,225 @@
 package dynamo
 
 import (
+	"context"
 	"fmt"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/go-gadgets/eventsourcing"
 	"github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/utilities/dynamoattr"
 )
 
+// API is the part of the DynamoDB client that the store uses, which *dynamodb.Client
+// implements.
+type API interface {
+	DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+}
+
 // eventStore is a type that represents a DynamoDB backed
 // EventStore implementation
 type eventStore struct {
-	session   *session.Session
-	service   *dynamodb.DynamoDB
+	service   API
 	tableName string
+	ttl       time.Duration       // Time events are kept for, zero to keep forever
+	feed      bool                // Write feed attributes for the global feed
+	parallel  int                 // Most queries used to fetch a long stream
+	clock     eventsourcing.Clock // Source of commit times
+	skew      time.Duration       // Longest clock skew between writers to the feed
+	timeout   time.Duration       // Longest a request may take, zero for no limit
+	ctx       context.Context     // Context of requests, cancelled when the store is closed
+	cancel    context.CancelFunc  // Cancels the context of requests
 }
 
-// NewStore creates a new DynamoDB backed event-store to use, using the default
-// contextual session from the application.
-func NewStore(tableName string) (eventsourcing.EventStore, error) {
-	session, errSession := session.NewSession()
-	if errSession != nil {
-		return nil, errSession
+// TTLAttribute is the attribute that holds the expiry time of events, as seconds
+// since the epoch, when events are written with a time-to-live.
+const TTLAttribute = "expires_at"
+
+// DefaultSkewWindow is the longest difference between the clocks of writers to
+// the global feed that readers allow for, unless set in Options.
+const DefaultSkewWindow = 5 * time.Second
+
+// LocalConfig gets the configuration for a DynamoDB-compatible endpoint other than
+// AWS, such as DynamoDB Local or LocalStack, which accept any credentials. Configs
+// for AWS itself are usually loaded with config.LoadDefaultConfig, and can also be
+// pointed at another endpoint by setting their BaseEndpoint.
+func LocalConfig(endpoint string, region string) aws.Config {
+	return aws.Config{
+		Region:       region,
+		BaseEndpoint: aws.String(endpoint),
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "local", SecretAccessKey: "local", Source: "LocalConfig"}, nil
+		}),
 	}
+}
 
-	return NewStoreWithSession(session, tableName)
+// NewStore creates a new DynamoDB backed event-store to use, with a client created
+// from the AWS configuration.
+func NewStore(config aws.Config, tableName string) (eventsourcing.EventStore, error) {
+	return NewStoreWithOptions(config, tableName, Options{})
 }
 
-// NewStoreWithSession creates a new DynamoDB event store, using the specified session.
-func NewStoreWithSession(session *session.Session, tableName string) (eventsourcing.EventStore, error) {
-	svc := dynamodb.New(session)
+// NewStoreWithRetention creates a new DynamoDB event store, whose events are written
+// with a time-to-live of policy.KeepFor in the TTLAttribute attribute. DynamoDB then
+// removes events once they expire, if TTL is enabled on the table (see EnableTTL).
+//
+// Expiry isn't aware of snapshots, so aggregates must be snapshotted well within the
+// time-to-live: a stream whose unsnapshotted events expire can no longer be replayed.
+// Since the event preceding a commit may have expired, commits rely on conditional
+// writes alone to detect conflicts. Count rules can't be expressed as a time-to-live,
+// so policies with KeepEvents are rejected.
+func NewStoreWithRetention(config aws.Config, tableName string, policy eventsourcing.RetentionPolicy) (eventsourcing.EventStore, error) {
+	return NewStoreWithOptions(config, tableName, Options{
+		Retention: policy,
+	})
+}
+
+// Options are the optional behaviours of a DynamoDB event store.
+type Options struct {
+	Retention     eventsourcing.RetentionPolicy // Retention by age, see NewStoreWithRetention
+	GlobalFeed    bool                          // Write feed attributes, so the global feed can be read
+	Parallel      int                           // Most concurrent queries used to fetch a long stream, see NewStoreWithOptions
+	Codec         keyvalue.Codec                // Encodes event data (see keyvalue.Codec), nil to store events as attributes
+	Codecs        []keyvalue.Codec              // Further codecs that events may have been encoded with
+	Clock         eventsourcing.Clock           // Source of commit times, the system clock by default
+	SkewWindow    time.Duration                 // Longest clock skew between writers, DefaultSkewWindow by default
+	Timeout       time.Duration                 // Longest a request to DynamoDB may take, zero for no limit
+	ClientOptions []func(*dynamodb.Options)     // Applied to the client NewStoreWithOptions creates, i.e. to set its BaseEndpoint
+}
+
+// NewStoreWithOptions creates a new DynamoDB event store with optional behaviours,
+// with a client created from the AWS configuration and Options.ClientOptions.
+//
+// With GlobalFeed set, events are written with the FeedPartitionAttribute and
+// FeedPositionAttribute attributes, and the store can read every event in the table
+// (see eventsourcing.GlobalReader) by querying the FeedIndex global secondary index
+// (see CreateFeedIndex). Events committed with a category also carry the
+// CategoryAttribute attribute, so that categories can be read (see
+// eventsourcing.CategoryReader) from the CategoryIndex index (see
+// CreateCategoryIndex). Events committed with a correlation ID likewise carry the
+// CorrelationAttribute attribute, so that business transactions can be read (see
+// eventsourcing.CorrelationReader) from the CorrelationIndex index (see
+// CreateCorrelationIndex). Every event is written to a single index partition, which
+// limits the write throughput of the table.
+//
+// Positions in the feed are ordered by commit time, as read from the Clock of the
+// writer. The clocks of writers drift apart, so a writer whose clock is behind can
+// commit an event at a position before events that have already been read. Reads
+// of the feed only return events committed at least SkewWindow ago, so that the
+// feed lags behind commits by that long, but doesn't skip events from writers whose
+// clocks are skewed by less. The lag also covers the index being only eventually
+// consistent. Writers should keep their clocks synchronised well within SkewWindow.
+//
+// With Parallel set above one, streams with more than ParallelSegmentSize events
+// to fetch are split into ranges of sequence numbers that are queried concurrently,
+// up to Parallel at a time, and applied in order. This costs an extra query on each
+// refresh to find the end of the stream, so is worth it only for long streams.
+//
+// Requests are made with a context that is cancelled when the store is closed, and
+// that expires after Timeout if one is set.
+func NewStoreWithOptions(config aws.Config, tableName string, options Options) (eventsourcing.EventStore, error) {
+	return NewStoreWithClient(dynamodb.NewFromConfig(config, options.ClientOptions...), tableName, options)
+}
+
+// NewStoreWithClient creates a new DynamoDB event store with a client that's already
+// been established (BYO-instance), ignoring Options.ClientOptions.
+func NewStoreWithClient(client API, tableName string, options Options) (eventsourcing.EventStore, error) {
+	if options.Retention.KeepEvents > 0 {
+		return nil, fmt.Errorf("DynamoDB stores can only retain events by age, not count")
+	}
 
 	engine := &eventStore{
-		session:   session,
-		service:   svc,
+		service:   client,
 		tableName: tableName,
+		ttl:       options.Retention.KeepFor,
+		feed:      options.GlobalFeed,
+		parallel:  options.Parallel,
+		clock:     options.Clock,
+		skew:      options.SkewWindow,
+		timeout:   options.Timeout,
+	}
+	if engine.clock == nil {
+		engine.clock = eventsourcing.SystemClock
+	}
+	if engine.skew <= 0 {
+		engine.skew = DefaultSkewWindow
 	}
+	engine.ctx, engine.cancel = context.WithCancel(context.Background())
 
-	store := keyvalue.NewStore(keyvalue.Options{
-		CheckSequence: engine.checkExists,
-		FetchEvents:   engine.fetchEvents,
-		PutEvents:     engine.putEvents,
+	kvOptions := keyvalue.Options{
+		CheckSequence:  engine.checkExists,
+		FetchPages:     engine.fetchPages,
+		PutEvents:      engine.putEvents,
+		LatestSequence: engine.latestSequence,
+		Ping:           engine.ping,
 		Close: func() error {
+			engine.cancel()
 			return nil
 		},
+		Codec:  options.Codec,
+		Codecs: options.Codecs,
+	}
+	if engine.ttl > 0 {
+		kvOptions.CheckSequence = nil
+	}
+	if engine.feed {
+		kvOptions.ReadAll = engine.readAll
+		kvOptions.ReadCategory = engine.readCategory
+		kvOptions.ReadCorrelation = engine.readCorrelation
+	}
+
+	return keyvalue.NewStore(kvOptions), nil
+}
+
+// EnableTTL enables time-to-live on a table, using the TTLAttribute attribute.
+func EnableTTL(ctx context.Context, client *dynamodb.Client, tableName string) error {
+	_, errUpdate := client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(TTLAttribute),
+			Enabled:       aws.Bool(true),
+		},
 	})
+	return errUpdate
+}
 
-	return store, nil
+// context gets the context of a request, which is cancelled when the store closes
+// or the timeout passes.
+func (store *eventStore) context() (context.Context, context.CancelFunc) {
+	if store.timeout > 0 {
+		return context.WithTimeout(store.ctx, store.timeout)
+	}
+	return context.WithCancel(store.ctx)
+}
+
+// ping checks that the table can be described.
+func (store *eventStore) ping(ctx context.Context) error {
+	_, errDescribe := store.service.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(store.tableName),
+	})
+	return errDescribe
 }
 
 // checkExists checks that a particular sequence number exists in the store.
 func (store *eventStore) checkExists(key string, seq int64) (bool, error) {
-	input := &dynamodb.GetItemInput{
+	ctx, cancel := store.context()
+	defer cancel()
+
+	result, errResult := store.service.GetItem(ctx, &dynamodb.GetItemInput{
 		ConsistentRead: aws.Bool(true),
-		Key: map[string]*dynamodb.AttributeValue{
-			"aggregate_key": {
-				S: aws.String(key),
-			},
-			"seq": {
-				N: aws.String(fmt.Sprintf("%d", seq)),
-			},
+		Key: map[string]types.AttributeValue{
+			"aggregate_key": &types.AttributeValueMemberS{Value: key},
+			"seq":           &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", seq)},
 		},
 		TableName: aws.String(store.tableName),
-	}
-
-	result, errResult := store.service.GetItem(input)
+	})
 	if errResult != nil {
 		return false, errResult
 	}
@@ -76,105 +227,123 @@ func (store *eventStore) checkExists(key string, seq int64) (bool, error) {
 	return result.Item != nil, nil
 }
 
-// putEvents writes events to the backing store.
+// latestSequence gets the sequence of the latest event for a key, by querying the
+// stream in descending order for a single item.
+func (store *eventStore) latestSequence(key string) (int64, error) {
+	ctx, cancel := store.context()
+	defer cancel()
+
+	output, errQuery := store.service.Query(ctx, &dynamodb.QueryInput{
+		ConsistentRead:         aws.Bool(true),
+		KeyConditionExpression: aws.String("#key = :key"),
+		ExpressionAttributeNames: map[string]string{
+			"#key": "aggregate_key",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":key": &types.AttributeValueMemberS{Value: key},
+		},
+		ProjectionExpression: aws.String("seq"),
+		ScanIndexForward:     aws.Bool(false),
+		Limit:                aws.Int32(1),
+		TableName:            aws.String(store.tableName),
+	})
+	if errQuery != nil {
+		return 0, errQuery
+	}
+	if len(output.Items) == 0 || output.Items[0]["seq"] == nil {
+		return 0, nil
+	}
+
+	return dynamoattr.Int64(output.Items[0]["seq"])
+}
+
+// putEvents writes events to the backing store. A single event is written with a
+// conditional PutItem, while larger commits are written with TransactWriteItems so
+// that a commit cannot be partially applied. Commits that a single transaction
+// can't hold (more than MaxTransactionItems events, or MaxTransactionBytes in all)
+// are rejected before anything is written.
 func (store *eventStore) putEvents(events []keyvalue.KeyedEvent) error {
+	if len(events) > MaxTransactionItems {
+		return fmt.Errorf("StoreError: A commit of %v events exceeds the DynamoDB limit of %v per transaction", len(events), MaxTransactionItems)
+	}
+
+	items := make([]map[string]types.AttributeValue, 0, len(events))
+	size := 0
+	committed := store.clock.Now()
+	expires := committed.Add(store.ttl)
 	for _, v := range events {
-		// Marshal the items
-		av, errMarshal := dynamodbattribute.MarshalMap(v)
+		av, errMarshal := marshalEvent(v)
 		if errMarshal != nil {
 			return errMarshal
 		}
 
-		// Deal with Dynamo API limits around field names
-		av["aggregate_key"] = av["key"]
-		av["seq"] = av["sequence"]
-		delete(av, "key")
-		delete(av, "sequence")
-
-		// Store the item: Need to do 1 at a time, since we don't have
-		// ConditionExpression on a batch
-		_, errPut := store.service.PutItem(&dynamodb.PutItemInput{
-			Item:                av,
-			ConditionExpression: aws.String("attribute_not_exists(aggregate_key) AND attribute_not_exists(seq)"),
-			TableName:           aws.String(store.tableName),
-		})
-
-		// No error? Spin on
-		if errPut == nil {
-			continue
+		// Events with a time-to-live carry their expiry time
+		if store.ttl > 0 {
+			av[TTLAttribute] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", expires.Unix())}
 		}
 
-		// If it's an AWS error, validate
-		errAWS, ok := errPut.(awserr.Error)
-		if ok {
-			// AWS error?
-			if errAWS.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
-				return eventsourcing.NewConcurrencyFault(v.Key, v.Sequence)
+		// Events in the global feed carry their position
+		if store.feed {
+			av[FeedPartitionAttribute] = &types.AttributeValueMemberS{Value: FeedPartition}
+			av[FeedPositionAttribute] = &types.AttributeValueMemberS{Value: feedPosition(committed, v.Key, v.Sequence)}
+			if category := eventsourcing.CategoryOf(v.Metadata); category != "" {
+				av[CategoryAttribute] = &types.AttributeValueMemberS{Value: category}
+			}
+			if correlationID := eventsourcing.CorrelationIDOf(v.Metadata); correlationID != "" {
+				av[CorrelationAttribute] = &types.AttributeValueMemberS{Value: correlationID}
 			}
 		}
 
-		return errPut
+		items = append(items, av)
+		size += itemSize(av)
+	}
+	if size > MaxTransactionBytes {
+		return fmt.Errorf("StoreError: A commit of %v bytes exceeds the DynamoDB limit of %v per transaction", size, MaxTransactionBytes)
 	}
 
-	return nil
-}
-
-// Fetch events from the store
-func (store *eventStore) fetchEvents(key string, seq int64) ([]keyvalue.KeyedEvent, error) {
-	loaded := make([]keyvalue.KeyedEvent, 0)
-	var failure error
-
-	errQuery := store.service.QueryPages(&dynamodb.QueryInput{
-		ConsistentRead: aws.Bool(true),
-
-		KeyConditions: map[string]*dynamodb.Condition{
-			"aggregate_key": {
-				ComparisonOperator: aws.String("EQ"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String(key),
-					},
-				},
-			},
-			"seq": {
-				ComparisonOperator: aws.String("GT"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						N: aws.String(fmt.Sprintf("%d", seq)),
-					},
-				},
-			},
-		},
-		TableName: aws.String(store.tableName),
-	}, func(output *dynamodb.QueryOutput, last bool) bool {
-		// Iterate through items
-		for _, item := range output.Items {
-			target := keyvalue.KeyedEvent{}
+	errPut := store.putItems(items)
+	if errPut == nil {
+		return nil
+	}
 
-			// Deal with Dynamo API limits around field names
-			item["key"] = item["aggregate_key"]
-			item["sequence"] = item["seq"]
+	// The conflicting item isn't reported, so blame the first of the commit
+	if isConflict(errPut) {
+		return eventsourcing.NewConcurrencyFault(events[0].Key, events[0].Sequence)
+	}
 
-			errUnmarshal := dynamodbattribute.UnmarshalMap(item, &target)
+	return errPut
+}
 
-			// If there was an error loading an event, stop
-			if errUnmarshal != nil {
-				failure = errUnmarshal
-				return false
-			}
+// putItems writes a set of items atomically, failing if any already exist.
+func (store *eventStore) putItems(items []map[string]types.AttributeValue) error {
+	ctx, cancel := store.context()
+	defer cancel()
 
-			loaded = append(loaded, target)
-		}
+	condition := aws.String("attribute_not_exists(aggregate_key) AND attribute_not_exists(seq)")
 
-		// Continue if we have a LastEvaluatedKey
-		return output.LastEvaluatedKey != nil && len(output.LastEvaluatedKey) != 0
-	})
+	// A transaction costs twice the capacity of a put, so avoid it where we can
+	if len(items) == 1 {
+		_, errPut := store.service.PutItem(ctx, &dynamodb.PutItemInput{
+			Item:                items[0],
+			ConditionExpression: condition,
+			TableName:           aws.String(store.tableName),
+		})
+		return errPut
+	}
 
-	// If there was an error, prevent people seeing the outcome
-	if failure != nil {
-		loaded = nil
-		errQuery = failure
+	input := &dynamodb.TransactWriteItemsInput{
+		TransactItems: make([]types.TransactWriteItem, 0, len(items)),
+	}
+	for _, item := range items {
+		input.TransactItems = append(input.TransactItems, types.TransactWriteItem{
+			Put: &types.Put{
+				Item:                item,
+				ConditionExpression: condition,
+				TableName:           aws.String(store.tableName),
+			},
+		})
 	}
 
-	return loaded, errQuery
+	_, errTransact := store.service.TransactWriteItems(ctx, input)
+	return errTransact
 }
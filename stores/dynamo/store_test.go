@@ -1,24 +1,24 @@
 package dynamo
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/go-gadgets/eventsourcing"
 	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func provider() (eventsourcing.EventStore, func(), error) {
-	session, errSession := session.NewSession(&aws.Config{
-		Endpoint: aws.String("http://localhost:8000"),
-		Region:   aws.String("ap-southeast-2"),
-	})
-	if errSession != nil {
-		return nil, nil, errSession
-	}
-
-	store, errStore := NewStoreWithSession(session, "test-store")
+	store, errStore := NewStore(LocalConfig("http://localhost:8000", "ap-southeast-2"), "test-store")
 	return store, func() {
 		// Intentiomnally blank
 	}, errStore
@@ -39,3 +39,53 @@ func BenchmarkIndividualCommmits(b *testing.B) {
 func BenchmarkBulkInsertAndLoad(b *testing.B) {
 	test.MeasureBulkInsertAndReload(b, provider)
 }
+
+// TestRequestContext checks requests time out, and are cancelled once the store
+// is closed.
+func TestRequestContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	store, errStore := NewStoreWithOptions(fakeConfig(server), "test-store", Options{Timeout: 50 * time.Millisecond})
+	require.Nil(t, errStore)
+
+	started := time.Now()
+	agg := test.SimpleAggregate{}
+	agg.Initialize("slow", test.GetTestRegistry(), store)
+	errRefresh := agg.Refresh()
+	assert.NotNil(t, errRefresh)
+	assert.True(t, errors.Is(errRefresh, context.DeadlineExceeded))
+	assert.True(t, time.Since(started) < time.Second)
+
+	assert.Nil(t, store.Close())
+	errRefresh = agg.Refresh()
+	assert.True(t, errors.Is(errRefresh, context.Canceled))
+}
+
+// TestClientOptions checks the client options are applied to the client the
+// store creates, i.e. to point it at another endpoint.
+func TestClientOptions(t *testing.T) {
+	operations := make([]string, 0)
+	requests := make([]map[string]interface{}, 0)
+	server := fakeDynamo(t, http.StatusOK, `{}`, &operations, &requests)
+	defer server.Close()
+
+	store, errStore := NewStoreWithOptions(LocalConfig("http://127.0.0.1:1", "ap-southeast-2"), "test-store", Options{
+		ClientOptions: []func(*dynamodb.Options){
+			func(options *dynamodb.Options) {
+				options.BaseEndpoint = aws.String(server.URL)
+			},
+		},
+	})
+	require.Nil(t, errStore)
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("redirected", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+	assert.Equal(t, []string{"DynamoDB_20120810.PutItem"}, operations)
+}
@@ -0,0 +1,110 @@
+package dynamo
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// MaxTransactionItems is the most items DynamoDB accepts in one TransactWriteItems
+// call, and so the most events a single commit can hold.
+const MaxTransactionItems = 100
+
+// MaxTransactionBytes is the largest total size of the items DynamoDB accepts in
+// one TransactWriteItems call, and so the largest a single commit can be.
+const MaxTransactionBytes = 4 * 1024 * 1024
+
+// conditionalCheckFailed is the cancellation reason of an item in a transaction
+// whose condition failed
+const conditionalCheckFailed = "ConditionalCheckFailed"
+
+// transactionConflict is the cancellation reason of an item in a transaction that
+// another transaction was writing at the same time
+const transactionConflict = "TransactionConflict"
+
+// transactionConflictException is the code of the error raised when an item is
+// written while a transaction on it is in progress
+const transactionConflictException = "TransactionConflictException"
+
+// itemSize estimates the size DynamoDB counts an item as, which is the length of
+// its attribute names and values. Numbers are counted by their digits, so the
+// estimate errs on the large side.
+func itemSize(item map[string]types.AttributeValue) int {
+	size := 0
+	for name, value := range item {
+		size += len(name) + attributeSize(value)
+	}
+	return size
+}
+
+// attributeSize estimates the size of an attribute value
+func attributeSize(value types.AttributeValue) int {
+	size := 1
+	switch typed := value.(type) {
+	case nil:
+		size = 0
+	case *types.AttributeValueMemberS:
+		size = len(typed.Value)
+	case *types.AttributeValueMemberN:
+		size = len(typed.Value)
+	case *types.AttributeValueMemberB:
+		size = len(typed.Value)
+	case *types.AttributeValueMemberM:
+		size = 3 + itemSize(typed.Value)
+	case *types.AttributeValueMemberL:
+		size = 3
+		for _, element := range typed.Value {
+			size += 1 + attributeSize(element)
+		}
+	case *types.AttributeValueMemberSS:
+		size = 0
+		for _, element := range typed.Value {
+			size += len(element)
+		}
+	case *types.AttributeValueMemberNS:
+		size = 0
+		for _, element := range typed.Value {
+			size += len(element)
+		}
+	case *types.AttributeValueMemberBS:
+		size = 0
+		for _, element := range typed.Value {
+			size += len(element)
+		}
+	}
+	return size
+}
+
+// isConflict checks if an error was caused by a concurrent writer: a failed
+// condition expression, either on a single put or within a transaction, or a
+// transaction that collided with another writing the same items.
+func isConflict(err error) bool {
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		return true
+	}
+
+	// Operations that don't model the exception report it by its code alone
+	var collided smithy.APIError
+	if errors.As(err, &collided) && collided.ErrorCode() == transactionConflictException {
+		return true
+	}
+
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return false
+	}
+	for _, reason := range canceled.CancellationReasons {
+		code := aws.ToString(reason.Code)
+		if code == conditionalCheckFailed || code == transactionConflict {
+			return true
+		}
+	}
+
+	// Without the reasons, they are listed in the message, one per item
+	message := canceled.ErrorMessage()
+	return strings.Contains(message, conditionalCheckFailed) || strings.Contains(message, transactionConflict)
+}
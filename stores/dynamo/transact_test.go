@@ -0,0 +1,235 @@
+package dynamo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDynamo records the operations sent to it, and responds with a canned body.
+func fakeDynamo(t *testing.T, status int, body string, operations *[]string, requests *[]map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, errRead := ioutil.ReadAll(r.Body)
+		assert.Nil(t, errRead)
+
+		decoded := make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal(raw, &decoded))
+
+		*operations = append(*operations, r.Header.Get("X-Amz-Target"))
+		*requests = append(*requests, decoded)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func fakeStore(t *testing.T, server *httptest.Server) eventsourcing.EventStore {
+	store, errStore := NewStore(fakeConfig(server), "test-store")
+	require.Nil(t, errStore)
+	return store
+}
+
+// TestTransactionalCommit checks multi-event commits are sent as one transaction.
+func TestTransactionalCommit(t *testing.T) {
+	operations := make([]string, 0)
+	requests := make([]map[string]interface{}, 0)
+	server := fakeDynamo(t, http.StatusOK, `{}`, &operations, &requests)
+	defer server.Close()
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("transact", test.GetTestRegistry(), fakeStore(t, server))
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 2})
+	assert.Nil(t, agg.Commit())
+
+	assert.Equal(t, []string{"DynamoDB_20120810.TransactWriteItems"}, operations)
+	items := requests[0]["TransactItems"].([]interface{})
+	assert.Equal(t, 2, len(items))
+
+	put := items[1].(map[string]interface{})["Put"].(map[string]interface{})
+	assert.Equal(t, "test-store", put["TableName"])
+	assert.Equal(t, "attribute_not_exists(aggregate_key) AND attribute_not_exists(seq)", put["ConditionExpression"])
+	item := put["Item"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"S": "transact"}, item["aggregate_key"])
+	assert.Equal(t, map[string]interface{}{"N": "2"}, item["seq"])
+}
+
+// TestSingleEventCommit checks single events avoid the cost of a transaction.
+func TestSingleEventCommit(t *testing.T) {
+	operations := make([]string, 0)
+	requests := make([]map[string]interface{}, 0)
+	server := fakeDynamo(t, http.StatusOK, `{}`, &operations, &requests)
+	defer server.Close()
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("single", test.GetTestRegistry(), fakeStore(t, server))
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+
+	assert.Equal(t, []string{"DynamoDB_20120810.PutItem"}, operations)
+}
+
+// TestOversizedCommit checks commits a single transaction can't hold are rejected
+// before anything is written.
+func TestOversizedCommit(t *testing.T) {
+	operations := make([]string, 0)
+	requests := make([]map[string]interface{}, 0)
+	server := fakeDynamo(t, http.StatusOK, `{}`, &operations, &requests)
+	defer server.Close()
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("oversized", test.GetTestRegistry(), fakeStore(t, server))
+	for index := 0; index < MaxTransactionItems+1; index++ {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	}
+	errCommit := agg.Commit()
+	assert.NotNil(t, errCommit)
+	assert.Contains(t, errCommit.Error(), "StoreError")
+	assert.Empty(t, operations, "Nothing should be written")
+
+	// Twenty events of 300KB each fit in 100 items, but not in 4MB
+	events := make([]keyvalue.KeyedEvent, 0)
+	for index := int64(1); index <= 20; index++ {
+		events = append(events, keyvalue.KeyedEvent{
+			Key:       "large",
+			Sequence:  index,
+			EventType: "Blob",
+			EventData: strings.Repeat("x", 300*1024),
+		})
+	}
+	store := &eventStore{tableName: "test-store", clock: eventsourcing.SystemClock}
+	errPut := store.putEvents(events)
+	assert.NotNil(t, errPut)
+	assert.Contains(t, errPut.Error(), "bytes")
+	assert.Empty(t, operations, "Nothing should be written")
+}
+
+// TestTransactionConflict checks a cancelled transaction is a concurrency fault.
+func TestTransactionConflict(t *testing.T) {
+	bodies := map[string]string{
+		"condition":   `{"__type":"com.amazonaws.dynamodb.v20120810#TransactionCanceledException","message":"Transaction cancelled, please refer cancellation reasons for specific reasons [ConditionalCheckFailed, None]"}`,
+		"concurrent":  `{"__type":"com.amazonaws.dynamodb.v20120810#TransactionCanceledException","message":"Transaction cancelled, please refer cancellation reasons for specific reasons [TransactionConflict, None]"}`,
+		"in progress": `{"__type":"com.amazonaws.dynamodb.v20120810#TransactionConflictException","message":"Transaction is ongoing for the item"}`,
+	}
+
+	for name, body := range bodies {
+		operations := make([]string, 0)
+		requests := make([]map[string]interface{}, 0)
+		server := fakeDynamo(t, http.StatusBadRequest, body, &operations, &requests)
+
+		agg := test.SimpleAggregate{}
+		agg.Initialize("conflict", test.GetTestRegistry(), fakeStore(t, server))
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 2})
+		errCommit := agg.Commit()
+		server.Close()
+
+		isConcurrency, fault := eventsourcing.IsConcurrencyFault(errCommit)
+		assert.True(t, isConcurrency, "%v: expected a ConcurrencyFault, got %v", name, errCommit)
+		if isConcurrency {
+			assert.Equal(t, "conflict", fault.AggregateKey, name)
+			assert.Equal(t, int64(1), fault.EventSequence, name)
+		}
+	}
+}
+
+// TestPagedRefresh checks that refreshes follow query pages, applying each in turn.
+func TestPagedRefresh(t *testing.T) {
+	item := `{"aggregate_key":{"S":"paged"},"seq":{"N":"%v"},"type":{"S":"IncrementEvent"},"data":{"M":{"increment_by":{"N":"%v"}}}}`
+	first := `{"Items":[` + fmt.Sprintf(item, 1, 1) + `,` + fmt.Sprintf(item, 2, 2) + `],"LastEvaluatedKey":{"aggregate_key":{"S":"paged"},"seq":{"N":"2"}}}`
+	second := `{"Items":[` + fmt.Sprintf(item, 3, 4) + `]}`
+
+	starts := make([]interface{}, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decoded := make(map[string]interface{})
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&decoded))
+		assert.Equal(t, "DynamoDB_20120810.Query", r.Header.Get("X-Amz-Target"))
+		assert.Equal(t, float64(keyvalue.DefaultPageSize), decoded["Limit"])
+		starts = append(starts, decoded["ExclusiveStartKey"])
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		if decoded["ExclusiveStartKey"] == nil {
+			w.Write([]byte(first))
+			return
+		}
+		w.Write([]byte(second))
+	}))
+	defer server.Close()
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("paged", test.GetTestRegistry(), fakeStore(t, server))
+	assert.Nil(t, agg.Refresh())
+
+	assert.Equal(t, int64(3), agg.SequenceNumber())
+	assert.Equal(t, 7, agg.CurrentCount)
+	assert.Equal(t, 2, len(starts))
+	assert.NotNil(t, starts[1])
+}
+
+// TestRetentionTTL checks events carry an expiry time, and commits don't check for
+// events that may have expired.
+func TestRetentionTTL(t *testing.T) {
+	operations := make([]string, 0)
+	requests := make([]map[string]interface{}, 0)
+	server := fakeDynamo(t, http.StatusOK, `{}`, &operations, &requests)
+	defer server.Close()
+
+	_, errCount := NewStoreWithRetention(fakeConfig(server), "test-store", eventsourcing.RetentionPolicy{KeepEvents: 10})
+	assert.NotNil(t, errCount, "Count rules can't be a time-to-live")
+
+	store, errStore := NewStoreWithRetention(fakeConfig(server), "test-store", eventsourcing.RetentionPolicy{KeepFor: time.Hour})
+	require.Nil(t, errStore)
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("expiring", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+
+	assert.Equal(t, []string{"DynamoDB_20120810.PutItem", "DynamoDB_20120810.PutItem"}, operations)
+	item := requests[1]["Item"].(map[string]interface{})
+	expires, errParse := strconv.ParseInt(item[TTLAttribute].(map[string]interface{})["N"].(string), 10, 64)
+	assert.Nil(t, errParse)
+	assert.InDelta(t, time.Now().Add(time.Hour).Unix(), expires, 5)
+}
+
+// TestVersion checks versions are read with a descending query for a single item.
+func TestVersion(t *testing.T) {
+	body := `{"Items":[{"seq":{"N":"42"}}]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decoded := make(map[string]interface{})
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&decoded))
+		assert.Equal(t, "DynamoDB_20120810.Query", r.Header.Get("X-Amz-Target"))
+		assert.Equal(t, float64(1), decoded["Limit"])
+		assert.Equal(t, false, decoded["ScanIndexForward"])
+		assert.Equal(t, "seq", decoded["ProjectionExpression"])
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	store := fakeStore(t, server)
+	version, errVersion := eventsourcing.Version(store, "versioned")
+	assert.Nil(t, errVersion)
+	assert.Equal(t, int64(42), version)
+
+	body = `{"Items":[]}`
+	version, errVersion = eventsourcing.Version(store, "missing")
+	assert.Nil(t, errVersion)
+	assert.Equal(t, int64(0), version)
+}
@@ -0,0 +1,28 @@
+module github.com/go-gadgets/eventsourcing/stores/eventstoredb
+
+go 1.24.0
+
+require (
+	github.com/EventStore/EventStore-Client-Go/v4 v4.1.0
+	github.com/go-gadgets/eventsourcing v0.0.0-00010101000000-000000000000
+	github.com/google/uuid v1.6.0
+	github.com/satori/go.uuid v1.2.0
+	github.com/stretchr/testify v1.9.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/kr/pretty v0.3.1 // indirect
+	github.com/mitchellh/mapstructure v0.0.0-20180220230111-00c29f56e238 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/net v0.44.0 // indirect
+	golang.org/x/sys v0.36.0 // indirect
+	golang.org/x/text v0.29.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240401170217-c3f982113cda // indirect
+	google.golang.org/grpc v1.63.2 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/go-gadgets/eventsourcing => ../..
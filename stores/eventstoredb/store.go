@@ -0,0 +1,290 @@
+/*
+Package eventstoredb is an event store on EventStoreDB, through its gRPC API. Each
+aggregate is a stream of its own, named by the aggregate key (after an optional
+prefix), and the sequence of an event is its revision in the stream plus one, so the
+first event of an aggregate is revision 0.
+
+Commits are appended with the revision of the event before them as the expected
+revision (or no stream, for the first commit of an aggregate), so a commit racing
+another for the same sequence is rejected by the server with a wrong expected version,
+which is returned as a ConcurrencyFault.
+
+Streams in EventStoreDB have no gaps, so gap records (keyvalue.NewGapRecord) can't be
+stored here: the event after one would be appended at the wrong revision.
+*/
+package eventstoredb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/EventStore/EventStore-Client-Go/v4/esdb"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/google/uuid"
+)
+
+// Endpoint are parameters for the EventStoreDB event store to use when
+// initializing.
+type Endpoint struct {
+	ConnectionString string `json:"connection_string"` // ConnectionString is the esdb:// URL of the node or cluster
+	StreamPrefix     string `json:"stream_prefix"`     // StreamPrefix is put before aggregate keys to name their streams
+}
+
+// esdbEventStore is a type that represents an EventStoreDB backed EventStore
+// implementation
+type esdbEventStore struct {
+	client   *esdb.Client
+	prefix   string
+	pageSize uint64
+}
+
+// NewStore creates a new EventStoreDB backed event store for an application to use.
+// The client is closed when the store is.
+func NewStore(endpoint Endpoint) (eventsourcing.EventStore, error) {
+	settings, errParse := esdb.ParseConnectionString(endpoint.ConnectionString)
+	if errParse != nil {
+		return nil, errParse
+	}
+
+	client, errClient := esdb.NewClient(settings)
+	if errClient != nil {
+		return nil, errClient
+	}
+
+	return NewStoreWithClient(client, endpoint.StreamPrefix), nil
+}
+
+// NewStoreWithClient creates a new EventStoreDB backed event store with an existing
+// client, naming the stream of each aggregate by its key after the prefix. The
+// client is closed when the store is.
+func NewStoreWithClient(client *esdb.Client, prefix string) eventsourcing.EventStore {
+	engine := &esdbEventStore{
+		client:   client,
+		prefix:   prefix,
+		pageSize: keyvalue.DefaultPageSize,
+	}
+
+	return keyvalue.NewStore(keyvalue.Options{
+		CheckSequence:  engine.checkExists,
+		FetchPages:     engine.fetchPages,
+		PutEvents:      engine.putEvents,
+		LatestSequence: engine.latestSequence,
+		Close:          client.Close,
+	})
+}
+
+// stream gets the name of the stream of an aggregate
+func (store *esdbEventStore) stream(key string) string {
+	return store.prefix + key
+}
+
+// checkExists checks that a particular sequence number exists in the store.
+func (store *esdbEventStore) checkExists(key string, seq int64) (bool, error) {
+	if seq < 1 {
+		return false, nil
+	}
+
+	found := false
+	errRead := store.read(key, esdb.ReadStreamOptions{
+		Direction: esdb.Forwards,
+		From:      esdb.Revision(uint64(seq - 1)),
+	}, 1, func(event *esdb.RecordedEvent) error {
+		found = event.EventNumber == uint64(seq-1)
+		return nil
+	})
+
+	return found, errRead
+}
+
+// latestSequence gets the sequence of the last event of a stream, or zero if there
+// are none, by reading the stream backwards from its end.
+func (store *esdbEventStore) latestSequence(key string) (int64, error) {
+	var latest int64
+	errRead := store.read(key, esdb.ReadStreamOptions{
+		Direction: esdb.Backwards,
+		From:      esdb.End{},
+	}, 1, func(event *esdb.RecordedEvent) error {
+		latest = int64(event.EventNumber) + 1
+		return nil
+	})
+
+	return latest, errRead
+}
+
+// putEvents appends the events of a commit to the stream of their aggregate,
+// expecting the stream to end just before the first of them.
+func (store *esdbEventStore) putEvents(events []keyvalue.KeyedEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	proposed := make([]esdb.EventData, len(events))
+	for index, event := range events {
+		data, errEncode := encodeEvent(event)
+		if errEncode != nil {
+			return errEncode
+		}
+		proposed[index] = data
+	}
+
+	first := events[0]
+	_, errAppend := store.client.AppendToStream(context.Background(), store.stream(first.Key), esdb.AppendToStreamOptions{
+		ExpectedRevision: expectedRevision(first.Sequence),
+	}, proposed...)
+	if isWrongExpectedVersion(errAppend) {
+		return eventsourcing.NewConcurrencyFault(first.Key, first.Sequence)
+	}
+
+	return errAppend
+}
+
+// fetchPages loads the events beyond the specified sequence number a page at a time.
+func (store *esdbEventStore) fetchPages(key string, seq int64, page keyvalue.PageCallback) error {
+	next := uint64(seq)
+	for {
+		loaded := make([]keyvalue.KeyedEvent, 0, store.pageSize)
+		errRead := store.read(key, esdb.ReadStreamOptions{
+			Direction: esdb.Forwards,
+			From:      esdb.Revision(next),
+		}, store.pageSize, func(recorded *esdb.RecordedEvent) error {
+			event, errDecode := decodeEvent(key, recorded)
+			if errDecode != nil {
+				return errDecode
+			}
+			loaded = append(loaded, event)
+			return nil
+		})
+		if errRead != nil {
+			return errRead
+		}
+
+		if len(loaded) == 0 {
+			return nil
+		}
+		errPage := page(loaded)
+		if errPage != nil {
+			return errPage
+		}
+		if uint64(len(loaded)) < store.pageSize {
+			return nil
+		}
+		next += uint64(len(loaded))
+	}
+}
+
+// read reads up to count events of the stream of an aggregate, passing each to the
+// visit function. Streams that don't exist are read as having no events.
+func (store *esdbEventStore) read(key string, options esdb.ReadStreamOptions, count uint64, visit func(event *esdb.RecordedEvent) error) error {
+	stream, errRead := store.client.ReadStream(context.Background(), store.stream(key), options, count)
+	if errRead != nil {
+		if isStreamNotFound(errRead) {
+			return nil
+		}
+		return errRead
+	}
+	defer stream.Close()
+
+	for {
+		resolved, errRecv := stream.Recv()
+		if errors.Is(errRecv, io.EOF) || isStreamNotFound(errRecv) {
+			return nil
+		}
+		if errRecv != nil {
+			return errRecv
+		}
+
+		errVisit := visit(resolved.OriginalEvent())
+		if errVisit != nil {
+			return errVisit
+		}
+	}
+}
+
+// expectedRevision gets the revision a stream is expected to be at when an event of
+// a sequence is appended to it.
+func expectedRevision(sequence int64) esdb.ExpectedRevision {
+	if sequence <= 1 {
+		return esdb.NoStream{}
+	}
+
+	return esdb.Revision(uint64(sequence - 2))
+}
+
+// encodeEvent converts an event into the data appended to a stream, as JSON
+func encodeEvent(event keyvalue.KeyedEvent) (esdb.EventData, error) {
+	body, errBody := json.Marshal(event.EventData)
+	if errBody != nil {
+		return esdb.EventData{}, errBody
+	}
+
+	var metadata []byte
+	if len(event.Metadata) > 0 {
+		encoded, errMetadata := json.Marshal(event.Metadata)
+		if errMetadata != nil {
+			return esdb.EventData{}, errMetadata
+		}
+		metadata = encoded
+	}
+
+	return esdb.EventData{
+		EventID:     uuid.New(),
+		EventType:   string(event.EventType),
+		ContentType: esdb.ContentTypeJson,
+		Data:        body,
+		Metadata:    metadata,
+	}, nil
+}
+
+// decodeEvent converts an event read from a stream back into a keyed event
+func decodeEvent(key string, recorded *esdb.RecordedEvent) (keyvalue.KeyedEvent, error) {
+	target := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(recorded.Data))
+	decoder.UseNumber()
+	errDecode := decoder.Decode(&target)
+	if errDecode != nil {
+		return keyvalue.KeyedEvent{}, fmt.Errorf("Could not decode event %v of %v: %v", recorded.EventNumber, recorded.StreamID, errDecode)
+	}
+
+	event := keyvalue.KeyedEvent{
+		Key:       key,
+		Sequence:  int64(recorded.EventNumber) + 1,
+		EventType: eventsourcing.EventType(recorded.EventType),
+		EventData: target,
+	}
+	if len(recorded.UserMetadata) > 0 {
+		errMetadata := json.Unmarshal(recorded.UserMetadata, &event.Metadata)
+		if errMetadata != nil {
+			return keyvalue.KeyedEvent{}, errMetadata
+		}
+	}
+
+	return event, nil
+}
+
+// codedError is implemented by the errors of the EventStoreDB client, allowing us
+// to classify errors wherever they're wrapped.
+type codedError interface {
+	IsErrorCode(code esdb.ErrorCode) bool
+}
+
+// hasErrorCode checks if an error is an EventStoreDB error with a code
+func hasErrorCode(err error, code esdb.ErrorCode) bool {
+	var coded codedError
+	return errors.As(err, &coded) && coded.IsErrorCode(code)
+}
+
+// isWrongExpectedVersion determines if an error is an append rejected for not being
+// made at the expected revision.
+func isWrongExpectedVersion(err error) bool {
+	return hasErrorCode(err, esdb.ErrorCodeWrongExpectedVersion)
+}
+
+// isStreamNotFound determines if an error is a read of a stream that doesn't exist.
+func isStreamNotFound(err error) bool {
+	return hasErrorCode(err, esdb.ErrorCodeResourceNotFound)
+}
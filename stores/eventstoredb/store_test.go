@@ -0,0 +1,138 @@
+package eventstoredb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/EventStore/EventStore-Client-Go/v4/esdb"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectionString gets the connection string of the test node, skipping the test
+// unless ESDB_TEST_HOST is set (i.e. esdb://localhost:2113?tls=false)
+func connectionString(t *testing.T) string {
+	connection := os.Getenv("ESDB_TEST_HOST")
+	if connection == "" {
+		t.Skip("ESDB_TEST_HOST is not set")
+	}
+	return connection
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	connection := connectionString(t)
+	test.CheckStandardSuite(t, "EventStoreDB", func() (eventsourcing.EventStore, func(), error) {
+		// Each store has streams of its own, under a prefix that is never reused
+		store, errStore := NewStore(Endpoint{
+			ConnectionString: connection,
+			StreamPrefix:     fmt.Sprintf("test-%s-", uuid.NewV4()),
+		})
+		return store, func() {}, errStore
+	})
+}
+
+// TestConcurrentAppend checks a commit appended at a sequence that has already been
+// written fails with a ConcurrencyFault
+func TestConcurrentAppend(t *testing.T) {
+	settings, errParse := esdb.ParseConnectionString(connectionString(t))
+	require.Nil(t, errParse)
+	client, errClient := esdb.NewClient(settings)
+	require.Nil(t, errClient)
+	defer client.Close()
+
+	engine := &esdbEventStore{
+		client:   client,
+		prefix:   fmt.Sprintf("test-%s-", uuid.NewV4()),
+		pageSize: keyvalue.DefaultPageSize,
+	}
+	events := []keyvalue.KeyedEvent{{Key: "a", Sequence: 1, EventType: "IncrementEvent", EventData: map[string]interface{}{"increment_by": 1}}}
+	assert.Nil(t, engine.putEvents(events))
+
+	errAgain := engine.putEvents(events)
+	conflict, fault := eventsourcing.IsConcurrencyFault(errAgain)
+	assert.True(t, conflict, "Expected a ConcurrencyFault, got %v", errAgain)
+	if conflict {
+		assert.Equal(t, "a", fault.AggregateKey)
+	}
+
+	latest, errLatest := engine.latestSequence("a")
+	assert.Nil(t, errLatest)
+	assert.Equal(t, int64(1), latest)
+	missing, _ := engine.latestSequence("missing")
+	assert.Equal(t, int64(0), missing)
+}
+
+// TestExpectedRevision checks commits expect the stream to end before their first
+// event, and the first commit of an aggregate expects no stream
+func TestExpectedRevision(t *testing.T) {
+	assert.Equal(t, esdb.NoStream{}, expectedRevision(1))
+	assert.Equal(t, esdb.Revision(0), expectedRevision(2))
+	assert.Equal(t, esdb.Revision(9), expectedRevision(11))
+}
+
+// TestEventRoundTrip checks events are decoded as they were encoded, with their
+// sequence from the revision they were recorded at
+func TestEventRoundTrip(t *testing.T) {
+	event := keyvalue.KeyedEvent{
+		Key:       "a",
+		Sequence:  3,
+		EventType: "IncrementEvent",
+		EventData: map[string]interface{}{"increment_by": 2},
+		Metadata:  map[string]interface{}{"correlation_id": "c-1"},
+	}
+	data, errEncode := encodeEvent(event)
+	require.Nil(t, errEncode)
+	assert.Equal(t, "IncrementEvent", data.EventType)
+	assert.Equal(t, esdb.ContentTypeJson, data.ContentType)
+
+	decoded, errDecode := decodeEvent("a", &esdb.RecordedEvent{
+		EventType:    data.EventType,
+		EventNumber:  2,
+		Data:         data.Data,
+		UserMetadata: data.Metadata,
+	})
+	require.Nil(t, errDecode)
+	assert.Equal(t, int64(3), decoded.Sequence)
+	assert.Equal(t, eventsourcing.EventType("IncrementEvent"), decoded.EventType)
+	assert.Equal(t, json.Number("2"), decoded.EventData.(map[string]interface{})["increment_by"])
+	assert.Equal(t, "c-1", decoded.Metadata["correlation_id"])
+
+	_, errCorrupt := decodeEvent("a", &esdb.RecordedEvent{EventNumber: 0, Data: []byte("not json")})
+	assert.NotNil(t, errCorrupt)
+}
+
+// fakeClientError mimics the errors of the EventStoreDB client
+type fakeClientError struct {
+	code esdb.ErrorCode
+}
+
+// Error returns the error text
+func (err fakeClientError) Error() string {
+	return fmt.Sprintf("client error %v", err.code)
+}
+
+// IsErrorCode checks the code of the error
+func (err fakeClientError) IsErrorCode(code esdb.ErrorCode) bool {
+	return err.code == code
+}
+
+// TestErrorClassification checks wrong expected versions and missing streams are
+// detected, including when wrapped
+func TestErrorClassification(t *testing.T) {
+	assert.True(t, isWrongExpectedVersion(fakeClientError{code: esdb.ErrorCodeWrongExpectedVersion}))
+	assert.True(t, isWrongExpectedVersion(fmt.Errorf("append: %w", fakeClientError{code: esdb.ErrorCodeWrongExpectedVersion})))
+	assert.False(t, isWrongExpectedVersion(fakeClientError{code: esdb.ErrorCodeResourceNotFound}))
+	assert.False(t, isWrongExpectedVersion(errors.New("connection refused")))
+	assert.False(t, isWrongExpectedVersion(nil))
+
+	assert.True(t, isStreamNotFound(fakeClientError{code: esdb.ErrorCodeResourceNotFound}))
+	assert.False(t, isStreamNotFound(fakeClientError{code: esdb.ErrorCodeStreamDeleted}))
+}
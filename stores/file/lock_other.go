@@ -0,0 +1,17 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package file
+
+import "os"
+
+// lockFile is a no-op on platforms without flock. Writers within the process
+// are still serialized, but other processes must not share the directory.
+func lockFile(file *os.File, exclusive bool) error {
+	return nil
+}
+
+// unlockFile is a no-op on platforms without flock.
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,254 @@
+/*
+Package file contains an event store that keeps each aggregate's events as JSON lines
+in a file of its own, within a directory. Appends are flushed with fsync before a commit
+returns, and concurrent writers (including other processes) are serialized with an
+advisory lock on the aggregate's file.
+
+The store is intended for demos, air-gapped environments and debugging dumps, where the
+events need to be inspectable with standard tools - it is not designed for high volumes.
+*/
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-gadgets/eventsourcing"
+	keyvalue "github.com/go-gadgets/eventsourcing/stores/key-value"
+)
+
+// fileExtension is the extension of aggregate files
+const fileExtension = ".jsonl"
+
+// fileStore is an event store that writes to a directory
+type fileStore struct {
+	directory string     // Directory that aggregate files are written to
+	lock      sync.Mutex // Guards the per-key locks
+	keyLocks  map[string]*sync.RWMutex
+}
+
+// NewStore creates a new file-backed event store in the specified directory,
+// which is created if it does not exist.
+func NewStore(directory string) (eventsourcing.EventStore, error) {
+	errDir := os.MkdirAll(directory, 0755)
+	if errDir != nil {
+		return nil, errDir
+	}
+
+	engine := &fileStore{
+		directory: directory,
+		keyLocks:  make(map[string]*sync.RWMutex),
+	}
+
+	store := keyvalue.NewStore(keyvalue.Options{
+		CheckSequence: engine.checkExists,
+		FetchEvents:   engine.fetchEvents,
+		PutEvents:     engine.putEvents,
+		Ping:          engine.ping,
+		Close: func() error {
+			return nil
+		},
+	})
+
+	return store, nil
+}
+
+// ping checks that the directory still exists.
+func (store *fileStore) ping(ctx context.Context) error {
+	info, errStat := os.Stat(store.directory)
+	if errStat != nil {
+		return errStat
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("StoreError: %v is not a directory", store.directory)
+	}
+	return nil
+}
+
+// path gets the file an aggregate's events are stored in
+func (store *fileStore) path(key string) string {
+	return filepath.Join(store.directory, url.QueryEscape(key)+fileExtension)
+}
+
+// keyLock gets the in-process lock for an aggregate key. File locks are held
+// per open file, so this also serializes goroutines within the process.
+func (store *fileStore) keyLock(key string) *sync.RWMutex {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	lock, found := store.keyLocks[key]
+	if !found {
+		lock = &sync.RWMutex{}
+		store.keyLocks[key] = lock
+	}
+
+	return lock
+}
+
+// checkExists checks that a particular sequence number exists in the store.
+func (store *fileStore) checkExists(key string, seq int64) (bool, error) {
+	events, errRead := store.read(key)
+	if errRead != nil {
+		return false, errRead
+	}
+
+	return lastSequence(events) >= seq, nil
+}
+
+// fetchEvents gets all events beyond the specified sequence number.
+func (store *fileStore) fetchEvents(key string, seq int64) ([]keyvalue.KeyedEvent, error) {
+	events, errRead := store.read(key)
+	if errRead != nil {
+		return nil, errRead
+	}
+
+	result := make([]keyvalue.KeyedEvent, 0)
+	for _, event := range events {
+		if event.Sequence > seq {
+			result = append(result, event)
+		}
+	}
+
+	return result, nil
+}
+
+// lastSequence gets the sequence of the last event in a stream
+func lastSequence(events []keyvalue.KeyedEvent) int64 {
+	if len(events) == 0 {
+		return 0
+	}
+
+	return events[len(events)-1].Sequence
+}
+
+// read loads all events for an aggregate, under a shared lock.
+func (store *fileStore) read(key string) ([]keyvalue.KeyedEvent, error) {
+	lock := store.keyLock(key)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	file, errOpen := os.Open(store.path(key))
+	if os.IsNotExist(errOpen) {
+		return []keyvalue.KeyedEvent{}, nil
+	}
+	if errOpen != nil {
+		return nil, errOpen
+	}
+	defer file.Close()
+
+	errLock := lockFile(file, false)
+	if errLock != nil {
+		return nil, errLock
+	}
+	defer unlockFile(file)
+
+	events, _, errDecode := decodeEvents(file)
+	return events, errDecode
+}
+
+// putEvents appends events to the aggregate files, under an exclusive lock.
+func (store *fileStore) putEvents(events []keyvalue.KeyedEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	key := events[0].Key
+	for _, event := range events {
+		if event.Key != key {
+			return fmt.Errorf("file: cannot write events for %v and %v in one commit", key, event.Key)
+		}
+	}
+
+	lock := store.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	file, errOpen := os.OpenFile(store.path(key), os.O_RDWR|os.O_CREATE, 0644)
+	if errOpen != nil {
+		return errOpen
+	}
+	defer file.Close()
+
+	errLock := lockFile(file, true)
+	if errLock != nil {
+		return errLock
+	}
+	defer unlockFile(file)
+
+	existing, committedLength, errDecode := decodeEvents(file)
+	if errDecode != nil {
+		return errDecode
+	}
+
+	// Concurrency check (are we inserting over the top of an event?)
+	last := lastSequence(existing)
+	if events[0].Sequence <= last {
+		return eventsourcing.NewConcurrencyFault(key, events[0].Sequence)
+	}
+	if events[0].Sequence != last+1 {
+		return fmt.Errorf("file: cannot write %v at %v, stream ends at %v", key, events[0].Sequence, last)
+	}
+
+	buff := bytes.Buffer{}
+	encoder := json.NewEncoder(&buff)
+	for _, event := range events {
+		errEncode := encoder.Encode(event)
+		if errEncode != nil {
+			return errEncode
+		}
+	}
+
+	// Discard any partial line left by an interrupted write, then append
+	errTruncate := file.Truncate(committedLength)
+	if errTruncate != nil {
+		return errTruncate
+	}
+	_, errWrite := file.WriteAt(buff.Bytes(), committedLength)
+	if errWrite != nil {
+		return errWrite
+	}
+
+	return file.Sync()
+}
+
+// decodeEvents reads the events within a file, returning them with the length
+// of the file that contains complete lines. A trailing line without a newline
+// was not completely written, and is ignored.
+func decodeEvents(file *os.File) ([]keyvalue.KeyedEvent, int64, error) {
+	_, errSeek := file.Seek(0, io.SeekStart)
+	if errSeek != nil {
+		return nil, 0, errSeek
+	}
+
+	result := make([]keyvalue.KeyedEvent, 0)
+	reader := bufio.NewReader(file)
+	length := int64(0)
+	for {
+		line, errLine := reader.ReadBytes('\n')
+		if errLine == io.EOF {
+			return result, length, nil
+		}
+		if errLine != nil {
+			return nil, 0, errLine
+		}
+
+		event := keyvalue.KeyedEvent{}
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.UseNumber()
+		errDecode := decoder.Decode(&event)
+		if errDecode != nil {
+			return nil, 0, fmt.Errorf("file: %v is corrupt at offset %v: %v", file.Name(), length, errDecode)
+		}
+
+		result = append(result, event)
+		length += int64(len(line))
+	}
+}
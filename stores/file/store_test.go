@@ -0,0 +1,86 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func provider() (eventsourcing.EventStore, func(), error) {
+	directory, errTemp := ioutil.TempDir("", "eventstore")
+	if errTemp != nil {
+		return nil, nil, errTemp
+	}
+
+	store, errStore := NewStore(directory)
+	if errStore != nil {
+		return nil, nil, errStore
+	}
+
+	return store, func() {
+		store.Close()
+		os.RemoveAll(directory)
+	}, nil
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "File", provider)
+}
+
+// TestRandomInterleavings checks the store under concurrent, random use
+func TestRandomInterleavings(t *testing.T) {
+	test.CheckRandomInterleavings(t, provider, test.FuzzOptions{})
+}
+
+// TestPartialLineIgnored checks that an interrupted write does not corrupt
+// the stream, and is replaced by the next commit.
+func TestPartialLineIgnored(t *testing.T) {
+	directory, errTemp := ioutil.TempDir("", "eventstore")
+	assert.Nil(t, errTemp)
+	defer os.RemoveAll(directory)
+
+	store, errStore := NewStore(directory)
+	require.Nil(t, errStore)
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("partial/key", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+
+	path := filepath.Join(directory, "partial%2Fkey.jsonl")
+	file, errOpen := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	require.Nil(t, errOpen)
+	file.WriteString(`{"key":"partial/key","sequence":2,"ty`)
+	file.Close()
+
+	reloaded := test.SimpleAggregate{}
+	reloaded.Initialize("partial/key", test.GetTestRegistry(), store)
+	assert.Nil(t, reloaded.Refresh())
+	assert.Equal(t, int64(1), reloaded.SequenceNumber())
+
+	reloaded.ApplyEvent(test.IncrementEvent{IncrementBy: 2})
+	assert.Nil(t, reloaded.Commit())
+
+	final := test.SimpleAggregate{}
+	final.Initialize("partial/key", test.GetTestRegistry(), store)
+	assert.Nil(t, final.Refresh())
+	assert.Equal(t, 3, final.CurrentCount)
+}
+
+// BenchmarkIndividualCommmits tests how fast we can apply events to an aggregate
+func BenchmarkIndividualCommmits(b *testing.B) {
+	test.MeasureIndividualCommits(b, provider)
+}
+
+// BenchmarkBulkInsertAndLoad tests how fast we can write
+// and then load/refresh 1000 events from an aggregate
+func BenchmarkBulkInsertAndLoad(b *testing.B) {
+	test.MeasureBulkInsertAndReload(b, provider)
+}
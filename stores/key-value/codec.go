@@ -0,0 +1,152 @@
+package keyvalue
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// Codec is an interface for encoding the data of events for storage, and decoding
+// it back into events. Each codec has a content type, which is stored with every
+// event it encodes, so that a store can change codec while still reading the events
+// written with the previous one.
+type Codec interface {
+	// ContentType identifies the encoding, i.e. "application/msgpack".
+	ContentType() string
+
+	// Encode an event.
+	Encode(event interface{}) ([]byte, error)
+
+	// Decode data into the target, which is a pointer.
+	Decode(data []byte, target interface{}) error
+}
+
+// ContentTypeJSON is the content type of the JSON codec. Codecs for binary
+// encodings, which need further dependencies, are in the codecs package.
+const ContentTypeJSON = "application/json"
+
+// Envelope is the data of an event encoded by a codec, as it is stored. Envelopes
+// are plain documents, so every driver can store them in place of event data.
+type Envelope struct {
+	ContentType string `json:"_content_type"` // Content type of the codec
+	Payload     string `json:"_payload"`      // Encoded event, in base64
+}
+
+// DecodeData revives the data of an event read from a store into a new instance of
+// its type. Data that was encoded by a codec is decoded by the codec of its content
+// type, chosen from codecs (or JSONCodec, which is always known), and other data is decoded with
+// eventsourcing.DecodeEvent.
+func DecodeData(registry eventsourcing.EventRegistry, eventType eventsourcing.EventType, data interface{}, codecs []Codec) (eventsourcing.Event, error) {
+	envelope, sealed := openEnvelope(data)
+	if !sealed {
+		return eventsourcing.DecodeEvent(registry, eventType, data)
+	}
+
+	chosen, payload, errOpen := envelope.open(codecs)
+	if errOpen != nil {
+		return nil, errOpen
+	}
+
+	// Unknown types are decoded into maps, which aren't pointers
+	target := registry.CreateEvent(eventType)
+	if reflect.TypeOf(target).Kind() != reflect.Ptr {
+		holder := reflect.New(reflect.TypeOf(target))
+		holder.Elem().Set(reflect.ValueOf(target))
+		errDecode := chosen.Decode(payload, holder.Interface())
+		return holder.Elem().Interface(), errDecode
+	}
+
+	errDecode := chosen.Decode(payload, target)
+	if errDecode != nil {
+		return nil, errDecode
+	}
+	return target, nil
+}
+
+// sealEnvelope encodes an event with a codec.
+func sealEnvelope(chosen Codec, event interface{}) (Envelope, error) {
+	payload, errEncode := chosen.Encode(event)
+	if errEncode != nil {
+		return Envelope{}, errEncode
+	}
+
+	return Envelope{
+		ContentType: chosen.ContentType(),
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+	}, nil
+}
+
+// openEnvelope checks whether event data is an envelope, as written by the store
+// or as read back by a driver (a map).
+func openEnvelope(data interface{}) (Envelope, bool) {
+	if envelope, ok := data.(Envelope); ok {
+		return envelope, true
+	}
+
+	value := reflect.ValueOf(data)
+	if !value.IsValid() || value.Kind() != reflect.Map || value.Type().Key().Kind() != reflect.String {
+		return Envelope{}, false
+	}
+
+	field := func(name string) (string, bool) {
+		entry := value.MapIndex(reflect.ValueOf(name).Convert(value.Type().Key()))
+		if !entry.IsValid() {
+			return "", false
+		}
+		text, ok := entry.Interface().(string)
+		return text, ok
+	}
+
+	contentType, typed := field("_content_type")
+	payload, carried := field("_payload")
+	if !typed || !carried {
+		return Envelope{}, false
+	}
+	return Envelope{ContentType: contentType, Payload: payload}, true
+}
+
+// open finds the codec of an envelope, and decodes its payload from base64.
+func (envelope Envelope) open(codecs []Codec) (Codec, []byte, error) {
+	var chosen Codec
+	for _, candidate := range append(append([]Codec{}, codecs...), JSONCodec()) {
+		if candidate != nil && candidate.ContentType() == envelope.ContentType {
+			chosen = candidate
+			break
+		}
+	}
+	if chosen == nil {
+		return nil, nil, fmt.Errorf("StoreError: No codec for content type %v", envelope.ContentType)
+	}
+
+	payload, errPayload := base64.StdEncoding.DecodeString(envelope.Payload)
+	if errPayload != nil {
+		return nil, nil, errPayload
+	}
+	return chosen, payload, nil
+}
+
+// jsonCodec encodes events as JSON.
+type jsonCodec struct{}
+
+// JSONCodec creates a codec that encodes events as JSON.
+func JSONCodec() Codec {
+	return jsonCodec{}
+}
+
+// ContentType is application/json
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+// Encode an event as JSON
+func (jsonCodec) Encode(event interface{}) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+// Decode JSON into the target
+func (jsonCodec) Decode(data []byte, target interface{}) error {
+	return json.Unmarshal(data, target)
+}
@@ -0,0 +1,114 @@
+package keyvalue
+
+import (
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCodecCompliance checks stores pass the standard suite with a codec
+func TestCodecCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Key-Value JSON", func() (eventsourcing.EventStore, func(), error) {
+		options := newSparseStore().options()
+		options.Codec = JSONCodec()
+		store := NewStore(options)
+		return store, func() {
+			store.Close()
+		}, nil
+	})
+}
+
+// TestCodecEnvelopes checks events are stored in envelopes tagged with the content
+// type of the codec
+func TestCodecEnvelopes(t *testing.T) {
+	data := newSparseStore()
+	options := data.options()
+	options.Codec = JSONCodec()
+	store := NewStore(options)
+
+	agg, _ := load("sealed", store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 3})
+	assert.Nil(t, agg.Commit())
+
+	envelope, sealed := openEnvelope(data.streams["sealed"][0].EventData)
+	assert.True(t, sealed)
+	assert.Equal(t, ContentTypeJSON, envelope.ContentType)
+	assert.NotEmpty(t, envelope.Payload)
+}
+
+// customCodec is a JSON codec with its own content type
+type customCodec struct {
+	Codec
+}
+
+func (customCodec) ContentType() string {
+	return "application/x-custom"
+}
+
+// TestChangingCodec checks a stream written with several codecs, and without one,
+// still replays once the store's codec changes
+func TestChangingCodec(t *testing.T) {
+	data := newSparseStore()
+	options := data.options()
+	options.Codecs = []Codec{customCodec{JSONCodec()}}
+	commit := func(codec Codec, by int) {
+		options.Codec = codec
+		agg, errLoad := load("evolving", NewStore(options))
+		assert.Nil(t, errLoad)
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: by})
+		assert.Nil(t, agg.Commit())
+	}
+
+	commit(nil, 1)
+	commit(JSONCodec(), 2)
+	commit(customCodec{JSONCodec()}, 3)
+	commit(JSONCodec(), 4)
+
+	options.Codec = nil
+	agg, errLoad := load("evolving", NewStore(options))
+	assert.Nil(t, errLoad)
+	assert.Equal(t, 10, agg.CurrentCount)
+	assert.Equal(t, int64(4), agg.SequenceNumber())
+}
+
+// TestCustomCodec checks events written with a custom codec can only be read by
+// stores that know it
+func TestCustomCodec(t *testing.T) {
+	data := newSparseStore()
+	options := data.options()
+	options.Codec = customCodec{JSONCodec()}
+	agg, _ := load("custom", NewStore(options))
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 5})
+	assert.Nil(t, agg.Commit())
+
+	options.Codec = JSONCodec()
+	_, errUnknown := load("custom", NewStore(options))
+	assert.NotNil(t, errUnknown, "The content type is unknown")
+
+	options.Codecs = []Codec{customCodec{JSONCodec()}}
+	reloaded, errLoad := load("custom", NewStore(options))
+	assert.Nil(t, errLoad)
+	assert.Equal(t, 5, reloaded.CurrentCount)
+}
+
+// TestCodecFeed checks the global feed opens envelopes into plain documents
+func TestCodecFeed(t *testing.T) {
+	envelope, errSeal := sealEnvelope(customCodec{JSONCodec()}, test.IncrementEvent{IncrementBy: 2})
+	assert.Nil(t, errSeal)
+
+	options := newSparseStore().options()
+	options.Codecs = []Codec{customCodec{JSONCodec()}}
+	options.ReadAll = func(from string, limit int) ([]PositionedEvent, error) {
+		return []PositionedEvent{{
+			KeyedEvent: KeyedEvent{Key: "a", Sequence: 1, EventType: "IncrementEvent", EventData: envelope},
+			Position:   "1",
+		}}, nil
+	}
+
+	events, errRead := NewStore(options).(eventsourcing.GlobalReader).ReadAll("", 10)
+	assert.Nil(t, errRead)
+	assert.Equal(t, 1, len(events))
+	assert.EqualValues(t, 2, events[0].Data.(map[string]interface{})["increment_by"])
+}
@@ -0,0 +1,105 @@
+/*
+Package codecs contains codecs for binary encodings of event data (see keyvalue.Codec),
+which key-value stores can use in place of storing events as they are.
+*/
+package codecs
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/ugorji/go/codec"
+
+	keyvalue "github.com/go-gadgets/eventsourcing/stores/key-value"
+)
+
+// Content types of the codecs.
+const (
+	ContentTypeMsgpack  = "application/msgpack"
+	ContentTypeCBOR     = "application/cbor"
+	ContentTypeProtobuf = "application/protobuf"
+)
+
+// All gets every codec in the package, for stores that should read events written
+// with any of them.
+func All() []keyvalue.Codec {
+	return []keyvalue.Codec{Msgpack(), CBOR(), Protobuf()}
+}
+
+// ugorjiCodec encodes events with a ugorji codec handle.
+type ugorjiCodec struct {
+	contentType string
+	handle      codec.Handle
+}
+
+// Msgpack creates a codec that encodes events as MessagePack, using the json
+// tags of events for field names.
+func Msgpack() keyvalue.Codec {
+	handle := &codec.MsgpackHandle{RawToString: true, WriteExt: true}
+	handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return &ugorjiCodec{contentType: ContentTypeMsgpack, handle: handle}
+}
+
+// CBOR creates a codec that encodes events as CBOR, using the json tags of
+// events for field names.
+func CBOR() keyvalue.Codec {
+	handle := &codec.CborHandle{}
+	handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return &ugorjiCodec{contentType: ContentTypeCBOR, handle: handle}
+}
+
+// ContentType gets the content type of the encoding
+func (encoding *ugorjiCodec) ContentType() string {
+	return encoding.contentType
+}
+
+// Encode an event
+func (encoding *ugorjiCodec) Encode(event interface{}) ([]byte, error) {
+	var result []byte
+	errEncode := codec.NewEncoderBytes(&result, encoding.handle).Encode(event)
+	return result, errEncode
+}
+
+// Decode data into the target
+func (encoding *ugorjiCodec) Decode(data []byte, target interface{}) error {
+	return codec.NewDecoderBytes(data, encoding.handle).Decode(target)
+}
+
+// protobufCodec encodes events that are protocol buffer messages.
+type protobufCodec struct{}
+
+// Protobuf creates a codec for events that are protocol buffer messages (or
+// whose pointers are). Events of other types can't be encoded.
+func Protobuf() keyvalue.Codec {
+	return protobufCodec{}
+}
+
+// ContentType is application/protobuf
+func (protobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+// Encode a message
+func (protobufCodec) Encode(event interface{}) ([]byte, error) {
+	message, ok := event.(proto.Message)
+	if !ok {
+		// Events are usually applied as values, while messages are pointers
+		pointer := reflect.New(reflect.TypeOf(event))
+		pointer.Elem().Set(reflect.ValueOf(event))
+		message, ok = pointer.Interface().(proto.Message)
+	}
+	if !ok {
+		return nil, fmt.Errorf("codecs: %T is not a protocol buffer message", event)
+	}
+	return proto.Marshal(message)
+}
+
+// Decode a message into the target
+func (protobufCodec) Decode(data []byte, target interface{}) error {
+	message, ok := target.(proto.Message)
+	if !ok {
+		return fmt.Errorf("codecs: %T is not a protocol buffer message", target)
+	}
+	return proto.Unmarshal(data, message)
+}
@@ -0,0 +1,53 @@
+package codecs
+
+import (
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	keyvalue "github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestStoreCompliance checks stores pass the standard suite with each binary codec
+func TestStoreCompliance(t *testing.T) {
+	for _, codec := range []keyvalue.Codec{Msgpack(), CBOR()} {
+		chosen := codec
+		test.CheckStandardSuite(t, "In-Memory "+chosen.ContentType(), func() (eventsourcing.EventStore, func(), error) {
+			store := memory.NewStoreWithCodec(chosen)
+			return store, func() {
+				store.Close()
+			}, nil
+		})
+	}
+}
+
+// TestRoundTrip checks events decode back into their type
+func TestRoundTrip(t *testing.T) {
+	for _, codec := range []keyvalue.Codec{Msgpack(), CBOR()} {
+		encoded, errEncode := codec.Encode(test.IncrementEvent{IncrementBy: 7})
+		assert.Nil(t, errEncode, codec.ContentType())
+
+		decoded := &test.IncrementEvent{}
+		assert.Nil(t, codec.Decode(encoded, decoded), codec.ContentType())
+		assert.Equal(t, 7, decoded.IncrementBy, codec.ContentType())
+	}
+}
+
+// TestProtobuf checks events that aren't messages are refused
+func TestProtobuf(t *testing.T) {
+	_, errEncode := Protobuf().Encode(test.IncrementEvent{IncrementBy: 1})
+	assert.NotNil(t, errEncode)
+	assert.NotNil(t, Protobuf().Decode([]byte{}, &test.IncrementEvent{}))
+}
+
+// TestContentTypes checks every codec has its own content type
+func TestContentTypes(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, codec := range All() {
+		assert.False(t, seen[codec.ContentType()])
+		seen[codec.ContentType()] = true
+	}
+	assert.Equal(t, 3, len(seen))
+}
@@ -0,0 +1,69 @@
+package keyvalue
+
+import (
+	"fmt"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// Reducer is a function that folds an event into an accumulated state, returning
+// the new state.
+type Reducer func(state interface{}, event KeyedEvent) interface{}
+
+// Folder is an interface implemented by stores that can fold over the raw events
+// of a stream.
+type Folder interface {
+	// Fold reduces every event in a stream, in sequence order, starting from the seed.
+	Fold(key string, seed interface{}, reducer Reducer) (interface{}, error)
+}
+
+// Fold reduces every event in the stream for a key, without needing an aggregate
+// type, which is useful for ad-hoc analysis and debugging, i.e:
+//
+//	total, errFold := keyvalue.Fold(store, "account-1", 0, func(state interface{}, event keyvalue.KeyedEvent) interface{} {
+//		return state.(int) + 1
+//	})
+//
+// Events are passed as they are read from the driver, so EventData is not decoded
+// into event types (or out of codec envelopes) and gap records are skipped. Baseline records of compacted
+// streams (see BaselineEventType) are passed, since they hold the state of the
+// events they replaced. Folds read the driver directly, so
+// the store must be a key-value store rather than a middleware wrapper around one.
+func Fold(store eventsourcing.EventStore, key string, seed interface{}, reducer Reducer) (interface{}, error) {
+	folder, ok := store.(Folder)
+	if !ok {
+		return nil, fmt.Errorf("StoreError: Store %T does not support folds", store)
+	}
+
+	return folder.Fold(key, seed, reducer)
+}
+
+// Fold reduces every event in a stream, in sequence order, starting from the seed.
+func (store *store) Fold(key string, seed interface{}, reducer Reducer) (interface{}, error) {
+	state := seed
+	fold := func(events []KeyedEvent) error {
+		for _, event := range events {
+			if event.EventType == GapEventType {
+				continue
+			}
+			state = reducer(state, event)
+		}
+		return nil
+	}
+
+	if store.options.FetchPages != nil {
+		errLoad := store.options.FetchPages(key, 0, fold)
+		if errLoad != nil {
+			return nil, errLoad
+		}
+		return state, nil
+	}
+
+	loaded, errLoad := store.options.FetchEvents(key, 0)
+	if errLoad != nil {
+		return nil, errLoad
+	}
+
+	fold(loaded)
+	return state, nil
+}
@@ -0,0 +1,55 @@
+package keyvalue
+
+import (
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/stretchr/testify/assert"
+)
+
+// countEvents is a reducer that counts events by type
+func countEvents(state interface{}, event KeyedEvent) interface{} {
+	counts := state.(map[eventsourcing.EventType]int)
+	counts[event.EventType]++
+	return counts
+}
+
+// TestFold checks folds see every event in order, with or without pages.
+func TestFold(t *testing.T) {
+	data := newSparseStore()
+	assert.Nil(t, data.putEvents([]KeyedEvent{
+		increment("folded", 1),
+		increment("folded", 2),
+		NewGapRecord("folded", 3, 5, "import"),
+		increment("folded", 5),
+	}))
+
+	paged := data.options()
+	paged.FetchEvents = nil
+	paged.FetchPages = data.fetchPages(2)
+
+	for _, options := range []Options{data.options(), paged} {
+		store := NewStore(options)
+
+		sequences, errFold := Fold(store, "folded", []int64{}, func(state interface{}, event KeyedEvent) interface{} {
+			return append(state.([]int64), event.Sequence)
+		})
+		assert.Nil(t, errFold)
+		assert.Equal(t, []int64{1, 2, 5}, sequences)
+
+		counts, errCount := Fold(store, "folded", make(map[eventsourcing.EventType]int), countEvents)
+		assert.Nil(t, errCount)
+		assert.Equal(t, map[eventsourcing.EventType]int{"IncrementEvent": 3}, counts)
+
+		empty, errEmpty := Fold(store, "missing", 42, countEvents)
+		assert.Nil(t, errEmpty)
+		assert.Equal(t, 42, empty)
+	}
+}
+
+// TestFoldUnsupported checks stores that aren't key-value stores are reported.
+func TestFoldUnsupported(t *testing.T) {
+	store := eventsourcing.NewMiddlewareWrapper(NewStore(newSparseStore().options()))
+	_, errFold := Fold(store, "key", nil, countEvents)
+	assert.NotNil(t, errFold)
+}
@@ -0,0 +1,128 @@
+package keyvalue
+
+import (
+	"fmt"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// PositionedEvent is an event with its position in the global feed of a store.
+type PositionedEvent struct {
+	KeyedEvent
+	Position string // Position of the event, see eventsourcing.GlobalReader
+}
+
+// ReadAllCallback is a function that reads up to limit events that follow a position
+// in the global feed of a store, in feed order. Returning fewer than limit events
+// indicates the end of the feed.
+type ReadAllCallback func(from string, limit int) ([]PositionedEvent, error)
+
+// ReadCategoryCallback is a function that reads up to limit events of a category
+// that follow a position in the global feed of a store, in feed order. Returning
+// fewer than limit events indicates the end of the feed.
+type ReadCategoryCallback func(category string, from string, limit int) ([]PositionedEvent, error)
+
+// ReadCorrelationCallback is a function that reads up to limit events with a
+// correlation ID that follow a position in the global feed of a store, in feed
+// order. Returning fewer than limit events indicates the end of the feed.
+type ReadCorrelationCallback func(correlationID string, from string, limit int) ([]PositionedEvent, error)
+
+// ReadAll reads events from the global feed of the store, if the driver supports
+// it. Gap records are skipped.
+func (store *store) ReadAll(from string, limit int) ([]eventsourcing.GlobalEvent, error) {
+	if store.options.ReadAll == nil {
+		return nil, fmt.Errorf("StoreError: Store does not support reading all events")
+	}
+
+	return readFeed(store.options.ReadAll, store.options.codecs(), from, limit)
+}
+
+// ReadCategory reads the events of a category from the global feed of the store,
+// if the driver supports it. Gap records are skipped.
+func (store *store) ReadCategory(category string, from string, limit int) ([]eventsourcing.GlobalEvent, error) {
+	if store.options.ReadCategory == nil {
+		return nil, fmt.Errorf("StoreError: Store does not support reading categories")
+	}
+
+	return readFeed(func(from string, limit int) ([]PositionedEvent, error) {
+		return store.options.ReadCategory(category, from, limit)
+	}, store.options.codecs(), from, limit)
+}
+
+// ReadCorrelation reads the events of a business transaction from the global feed
+// of the store, if the driver supports it. Gap records are skipped.
+func (store *store) ReadCorrelation(correlationID string, from string, limit int) ([]eventsourcing.GlobalEvent, error) {
+	if store.options.ReadCorrelation == nil {
+		return nil, fmt.Errorf("StoreError: Store does not support reading correlations")
+	}
+
+	return readFeed(func(from string, limit int) ([]PositionedEvent, error) {
+		return store.options.ReadCorrelation(correlationID, from, limit)
+	}, store.options.codecs(), from, limit)
+}
+
+// readFeed reads up to limit events from a feed, skipping gap records. Events in
+// envelopes are decoded into plain documents, as consumers expect.
+func readFeed(read ReadAllCallback, codecs []Codec, from string, limit int) ([]eventsourcing.GlobalEvent, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("StoreError: Limit must be positive, not %v", limit)
+	}
+
+	result := make([]eventsourcing.GlobalEvent, 0, limit)
+	for {
+		requested := limit - len(result)
+		page, errRead := read(from, requested)
+		if errRead != nil {
+			return nil, errRead
+		}
+
+		for _, event := range page {
+			from = event.Position
+			if event.EventType == GapEventType || event.EventType == BaselineEventType {
+				continue
+			}
+
+			data, errData := openDocument(event.EventData, codecs)
+			if errData != nil {
+				return nil, errData
+			}
+
+			result = append(result, eventsourcing.GlobalEvent{
+				PublishedEvent: eventsourcing.PublishedEvent{
+					Type:     event.EventType,
+					Key:      event.Key,
+					Sequence: event.Sequence,
+					Data:     data,
+				},
+				Position: event.Position,
+				Metadata: event.Metadata,
+			})
+		}
+
+		// Keep reading past gap and baseline records, unless the feed is exhausted
+		if len(result) == limit || len(page) < requested {
+			return result, nil
+		}
+	}
+}
+
+// openDocument decodes event data in an envelope into a plain document, leaving
+// other data as it is.
+func openDocument(data interface{}, codecs []Codec) (interface{}, error) {
+	envelope, sealed := openEnvelope(data)
+	if !sealed {
+		return data, nil
+	}
+
+	chosen, payload, errOpen := envelope.open(codecs)
+	if errOpen != nil {
+		return nil, errOpen
+	}
+
+	document := make(map[string]interface{})
+	errDecode := chosen.Decode(payload, &document)
+	if errDecode != nil {
+		return nil, errDecode
+	}
+	return document, nil
+}
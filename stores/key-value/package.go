@@ -3,14 +3,58 @@ Package keyvalue contains a base implementation of much of the common logic requ
 scale-out tablestore implementation of an event store. Each store driver need only support
 four methods, which can be passed via the keyvalue.Options structure:
 
-		CheckSequence			// Check if a particular key/seq pair exists.
-		FetchEvents				// Fetch events forward from a particular sequence number
-		PutEvents				// Put a set of events into the store
-		Close					// Shut-down the driver
+	CheckSequence   // Check if a particular key/seq pair exists.
+	FetchEvents     // Fetch events forward from a particular sequence number (or FetchPages)
+	PutEvents       // Put a set of events into the store
+	Close           // Shut-down the driver
+
+Drivers may also provide optional callbacks for the features their backend supports:
+
+	FetchPages      // Fetch events forward a page at a time, instead of FetchEvents
+	PruneEvents     // Remove events a retention policy doesn't keep
+	CompactEvents   // Replace the start of a stream with a baseline record
+	LatestSequence  // Get the sequence of the latest event without fetching events
+	ReadAll         // Read the global feed of all events
+	ReadCategory    // Read the events of a category from the global feed
+	ReadCorrelation // Read the events with a correlation ID from the global feed
+	Ping            // Check the connection to the backend
 
 By abstracting store implementations down to this API, it's assumed it will be easier to
 add more providers later. Specific providers that suit this model include DynamoDB, Azure
 Tables, MongoDB, Cassandra - but the model will work for essentially any provider that has
 support for a dual-part unique key (Agg ID, Sequence) and supports range scans for these.
+
+Drivers that can read a stream incrementally (i.e. with a cursor or paged query) should
+provide FetchPages instead of FetchEvents, so that refreshing an aggregate with a long
+history only holds one page of raw events in memory at a time.
+
+Sequences are expected to be dense and to start at one. Imported streams that start at a
+later sequence can set Options.StartSequence, in which case commits from aggregates that
+haven't been refreshed up to the start fail with a ConcurrencyFault. Streams with intentional
+gaps can either declare them with gap records (see NewGapRecord) or set Options.TolerateGaps.
+
+Drivers that can remove old events (see eventsourcing.RetentionPolicy) provide PruneEvents,
+which the store's Prune method (see eventsourcing.RetentionStore) calls. Drivers whose events expire on
+their own leave CheckSequence unset, since the event preceding a commit may be gone.
+
+Drivers that can replace the start of a stream with a baseline record provide CompactEvents,
+which the store's Compact method (see eventsourcing.Compactor) calls. Baseline records are
+replayed by restoring them as snapshots, and are left out of the global feed.
+
+Drivers that can read every event in the store as a single feed provide ReadAll, which the
+store's ReadAll method (see eventsourcing.GlobalReader) calls, and those that can read the
+events of a category from that feed provide ReadCategory (see eventsourcing.CategoryReader).
+Likewise, drivers that index events by their correlation ID provide ReadCorrelation (see
+eventsourcing.CorrelationReader), so that the lineage of a business transaction can be read.
+
+Commits made with an ID (see eventsourcing.AggregateBase.CommitWithID) record it in the
+metadata of their events. If such a commit conflicts, the store reads back the events it
+would have written, and succeeds if they carry the same ID, since the commit is a retry.
+Drivers must store and return KeyedEvent.Metadata for this to work.
+
+Event data is handed to drivers as it is, for them to store natively, unless Options.Codec
+is set. Events are then encoded by the codec (JSONCodec, the binary codecs of the codecs
+package, or any other Codec) into an Envelope that records its content type, so a store can change codec
+while the events already written are still decoded by the codec they were written with.
 */
 package keyvalue
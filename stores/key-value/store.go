@@ -1,11 +1,12 @@
 package keyvalue
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
 
 	"github.com/go-gadgets/eventsourcing"
-	"github.com/go-gadgets/eventsourcing/utilities/mapping"
 	"github.com/mitchellh/mapstructure"
 )
 
@@ -13,12 +14,56 @@ import (
 // required for a simple key-value store to be used as an event storage
 // engine.
 type Options struct {
-	CheckSequence SequenceExistsCallback // Check function to see if seq exists
-	FetchEvents   FetchCallback          // Fetch events function
-	PutEvents     PutCallback            // Put events function
-	Close         CloseCallback          // Close callback
+	CheckSequence   SequenceExistsCallback  // Check function to see if seq exists, nil if events may expire
+	FetchEvents     FetchCallback           // Fetch events function
+	FetchPages      FetchPagesCallback      // Fetch events a page at a time, used instead of FetchEvents if set
+	PutEvents       PutCallback             // Put events function
+	PruneEvents     PruneCallback           // Remove events a retention policy doesn't keep, if supported
+	CompactEvents   CompactCallback         // Replace the start of a stream with a baseline record, if supported
+	LatestSequence  LatestSequenceCallback  // Get the sequence of the latest event without fetching events, if supported
+	ReadAll         ReadAllCallback         // Read the global feed of all events, if supported
+	ReadCategory    ReadCategoryCallback    // Read the events of a category from the global feed, if supported
+	ReadCorrelation ReadCorrelationCallback // Read the events of a business transaction from the global feed, if supported
+	Close           CloseCallback           // Close callback
+	Ping            PingCallback            // Check the connection to the backend, if supported
+	StartSequence   int64                   // Sequence streams start after (first event is StartSequence+1)
+	TolerateGaps    bool                    // Accept undeclared gaps in sequences during refresh
+	Codec           Codec                   // Encodes event data into envelopes, nil to store events as they are
+	Codecs          []Codec                 // Further codecs that envelopes may have been encoded with
 }
 
+// GapEventType is the event type of a gap record. A gap record stored at a
+// sequence declares that the stream resumes at a later sequence, and that the
+// sequences in between are intentionally missing. Aggregates are loaded up to the
+// sequence before the resume point, so the next commit is written at it.
+const GapEventType = eventsourcing.EventType("$gap")
+
+// Gap is the body of a gap record.
+type Gap struct {
+	Next   int64  `json:"next"`             // Sequence the stream resumes at
+	Reason string `json:"reason,omitempty"` // Reason for the gap, i.e. the import source
+}
+
+// NewGapRecord creates a gap record, which can be written alongside imported
+// events to declare that sequences between seq and next are missing.
+func NewGapRecord(key string, seq int64, next int64, reason string) KeyedEvent {
+	return KeyedEvent{
+		Key:       key,
+		Sequence:  seq,
+		EventType: GapEventType,
+		EventData: Gap{
+			Next:   next,
+			Reason: reason,
+		},
+	}
+}
+
+// BaselineEventType is the event type of a baseline record. A baseline record
+// stored at a sequence holds the state of the aggregate at that sequence, and
+// replaces the events up to it (see eventsourcing.Compactor). It is replayed by
+// restoring the state as a snapshot.
+const BaselineEventType = eventsourcing.EventType("$baseline")
+
 // Event is a raw event within a key-value store.
 type Event struct {
 	EventType eventsourcing.EventType `json:"type"`
@@ -31,6 +76,7 @@ type KeyedEvent struct {
 	Sequence  int64                   `json:"sequence"`
 	EventType eventsourcing.EventType `json:"type"`
 	EventData interface{}             `json:"data"`
+	Metadata  map[string]interface{}  `json:"metadata,omitempty" bson:"metadata,omitempty"`
 }
 
 // SequenceExistsCallback is a function that checks if  given offset exists
@@ -42,12 +88,42 @@ type SequenceExistsCallback func(key string, seq int64) (bool, error)
 // crawl forward from the specified sequence for a partitioning key.
 type FetchCallback func(key string, seq int64) ([]KeyedEvent, error)
 
+// PageCallback is a function that receives a page of events, in sequence order.
+// Returning an error stops the fetch.
+type PageCallback func(events []KeyedEvent) error
+
+// FetchPagesCallback is a function that fetches events forward from the specified
+// sequence number, passing them to the page callback a page at a time, so that
+// long streams need not be held in memory at once. Any error returned by the page
+// callback should be returned.
+type FetchPagesCallback func(key string, seq int64, page PageCallback) error
+
+// DefaultPageSize is the number of events per page, for stores that fetch pages.
+const DefaultPageSize = 1000
+
 // PutCallback is a function that puts events into the store.
 type PutCallback func(events []KeyedEvent) error
 
+// PruneCallback is a function that removes the events of a stream that are covered
+// by a snapshot at the specified sequence, and that a retention policy doesn't keep.
+type PruneCallback func(key string, snapshot int64, policy eventsourcing.RetentionPolicy) (int64, error)
+
+// CompactCallback is a function that replaces the record at the sequence of a
+// baseline record with the baseline, and then removes the records before it,
+// returning the number removed. Replacing the record first means that a stream
+// that is only partly compacted still replays correctly.
+type CompactCallback func(baseline KeyedEvent) (int64, error)
+
+// LatestSequenceCallback is a function that gets the sequence of the latest record
+// stored for a key, or zero if there are none, without fetching the events.
+type LatestSequenceCallback func(key string) (int64, error)
+
 // CloseCallback closes the KVS
 type CloseCallback func() error
 
+// PingCallback checks that the KVS can be reached, within the deadline of the context.
+type PingCallback func(ctx context.Context) error
+
 // store is the type for the key-value backed storage provider.
 type store struct {
 	options Options // Functions for callbacks, other options.
@@ -69,19 +145,48 @@ func (store *store) Close() error {
 	return nil
 }
 
+// Ping checks the connection to the backend, if the store supports it.
+func (store *store) Ping(ctx context.Context) error {
+	if store.options.Ping != nil {
+		return store.options.Ping(ctx)
+	}
+	return nil
+}
+
 // CommitEvents writes new events for an aggregate to the storage provider.
 func (store *store) CommitEvents(writer eventsourcing.StoreWriterAdapter) error {
 	key := writer.GetKey()
 	registry := writer.GetEventRegistry()
 	currentSequenceNumber, events := writer.GetUncommittedEvents()
 
-	// If we're writing beyond zero, we need to check that there's priors.
-	if currentSequenceNumber > 0 {
+	// Empty commits succeed without touching the driver
+	if len(events) == 0 {
+		return nil
+	}
+
+	// Streams have no events before the start, so an aggregate behind it hasn't been
+	// refreshed, and its events would be written where they can't be replayed from.
+	if currentSequenceNumber < store.options.StartSequence {
+		return eventsourcing.NewConcurrencyFault(key, currentSequenceNumber+1)
+	}
+
+	// If we're writing beyond the start, we need to check that there's priors,
+	// unless the driver can't tell because events expire.
+	if currentSequenceNumber > store.options.StartSequence && store.options.CheckSequence != nil {
 		exists, errExists := store.options.CheckSequence(key, currentSequenceNumber)
 		if errExists != nil {
 			return errExists
 		}
 
+		// Aggregates are loaded up to the resume point of a gap record ending the
+		// stream, which has no record before it
+		if !exists {
+			exists, errExists = store.endsWithGap(key, currentSequenceNumber+1)
+			if errExists != nil {
+				return errExists
+			}
+		}
+
 		if !exists {
 			return fmt.Errorf(
 				"StoreError: Cannot store at index %v if no value for key %v at %v",
@@ -98,11 +203,155 @@ func (store *store) CommitEvents(writer eventsourcing.StoreWriterAdapter) error
 		return errRemap
 	}
 
+	// Encode the events, if the store has a codec
+	if store.options.Codec != nil {
+		for index := range remapped {
+			envelope, errSeal := sealEnvelope(store.options.Codec, remapped[index].EventData)
+			if errSeal != nil {
+				return errSeal
+			}
+			remapped[index].EventData = envelope
+		}
+	}
+
+	// Record any metadata the aggregate has for these events
+	var metadata map[string]interface{}
+	if adapter, ok := writer.(eventsourcing.MetadataAdapter); ok {
+		metadata = adapter.GetEventMetadata()
+		for index := range remapped {
+			remapped[index].Metadata = metadata
+		}
+	}
+
 	// Perform the actual put
 	errCommit := store.options.PutEvents(remapped)
+
+	// A conflicting commit with the same ID is a retry of a commit that was written
+	commitID := eventsourcing.CommitIDOf(metadata)
+	if conflict, _ := eventsourcing.IsConcurrencyFault(errCommit); conflict && commitID != "" {
+		written, errWritten := store.writtenBy(key, currentSequenceNumber, len(remapped), commitID)
+		if errWritten != nil {
+			return errWritten
+		}
+		if written {
+			return nil
+		}
+	}
+
 	return errCommit
 }
 
+// errFetchComplete stops a fetch once enough events have been read.
+var errFetchComplete = errors.New("StoreError: Fetch complete")
+
+// writtenBy checks whether the count events following a sequence were all written
+// by the commit with the specified ID.
+func (store *store) writtenBy(key string, seq int64, count int, commitID string) (bool, error) {
+	matched := 0
+	check := func(events []KeyedEvent) error {
+		for _, event := range events {
+			if event.Sequence != seq+int64(1+matched) || eventsourcing.CommitIDOf(event.Metadata) != commitID {
+				return errFetchComplete
+			}
+
+			matched++
+			if matched == count {
+				return errFetchComplete
+			}
+		}
+		return nil
+	}
+
+	if store.options.FetchPages != nil {
+		errLoad := store.options.FetchPages(key, seq, check)
+		if errLoad != nil && errLoad != errFetchComplete {
+			return false, errLoad
+		}
+		return matched == count, nil
+	}
+
+	loaded, errLoad := store.options.FetchEvents(key, seq)
+	if errLoad != nil {
+		return false, errLoad
+	}
+	check(loaded)
+	return matched == count, nil
+}
+
+// endsWithGap checks whether the stream of a key ends with a gap record that
+// resumes at a sequence, reading only the latest record if the driver supports it.
+func (store *store) endsWithGap(key string, next int64) (bool, error) {
+	from := store.options.StartSequence
+	if store.options.LatestSequence != nil {
+		latest, errLatest := store.options.LatestSequence(key)
+		if errLatest != nil {
+			return false, errLatest
+		}
+		if latest > from {
+			from = latest - 1
+		}
+	}
+
+	var last *KeyedEvent
+	keepLast := func(events []KeyedEvent) error {
+		if len(events) > 0 {
+			tail := events[len(events)-1]
+			last = &tail
+		}
+		return nil
+	}
+	if store.options.FetchPages != nil {
+		errLoad := store.options.FetchPages(key, from, keepLast)
+		if errLoad != nil {
+			return false, errLoad
+		}
+	} else {
+		loaded, errLoad := store.options.FetchEvents(key, from)
+		if errLoad != nil {
+			return false, errLoad
+		}
+		keepLast(loaded)
+	}
+	if last == nil || last.EventType != GapEventType {
+		return false, nil
+	}
+
+	gap := Gap{}
+	errGap := mapstructure.WeakDecode(last.EventData, &gap)
+	if errGap != nil {
+		return false, errGap
+	}
+	return gap.Next == next, nil
+}
+
+// Prune removes events that a retention policy no longer keeps, if the driver
+// supports it.
+func (store *store) Prune(key string, snapshot int64, policy eventsourcing.RetentionPolicy) (int64, error) {
+	if store.options.PruneEvents == nil {
+		return 0, fmt.Errorf("StoreError: Store does not support pruning events")
+	}
+
+	return store.options.PruneEvents(key, snapshot, policy)
+}
+
+// Compact replaces the start of a stream with a baseline record, if the driver
+// supports it.
+func (store *store) Compact(key string, sequence int64, state interface{}) (int64, error) {
+	if store.options.CompactEvents == nil {
+		return 0, fmt.Errorf("StoreError: Store does not support compaction")
+	}
+	if sequence <= 0 {
+		return 0, fmt.Errorf("StoreError: Cannot compact key %v at sequence %v", key, sequence)
+	}
+
+	return store.options.CompactEvents(KeyedEvent{
+		Key:       key,
+		Sequence:  sequence,
+		EventType: BaselineEventType,
+		EventData: state,
+	})
+}
+
 // Refresh updates an aggregate with events from the store and brings it up to
 // date, allowing us to work with the data.
 func (store *store) Refresh(loader eventsourcing.StoreLoaderAdapter) error {
@@ -113,30 +362,80 @@ func (store *store) Refresh(loader eventsourcing.StoreLoaderAdapter) error {
 		return fmt.Errorf("StoreError: Aggregate %v is modified", key)
 	}
 
-	reg := loader.GetEventRegistry()
 	seq := loader.SequenceNumber()
+	replay := &replayer{
+		options:  store.options,
+		loader:   loader,
+		registry: loader.GetEventRegistry(),
+		expected: seq + 1,
+		position: seq,
+	}
+
+	// Stream pages if the driver supports it, so long streams aren't held in memory
+	if store.options.FetchPages != nil {
+		errLoad := store.options.FetchPages(key, seq, replay.page)
+		if errLoad != nil {
+			return errLoad
+		}
+		return replay.start()
+	}
 
 	loaded, errLoad := store.options.FetchEvents(key, seq)
 	if errLoad != nil {
 		return errLoad
 	}
 
+	return replay.page(loaded)
+}
+
+// replayer applies pages of events to a loader, tracking the sequence between pages.
+type replayer struct {
+	options  Options
+	loader   eventsourcing.StoreLoaderAdapter
+	registry eventsourcing.EventRegistry
+	started  bool  // Set once the start sequence has been applied
+	expected int64 // Sequence expected next
+	position int64 // Sequence the loader is at
+}
+
+// start moves the loader to the start sequence, if it's not already beyond it.
+func (replay *replayer) start() error {
+	if replay.started {
+		return nil
+	}
+	replay.started = true
+
+	// Streams that start beyond zero have no events before the start
+	if replay.position < replay.options.StartSequence {
+		errAdvance := advance(replay.loader, replay.options.StartSequence)
+		if errAdvance != nil {
+			return errAdvance
+		}
+		replay.position = replay.options.StartSequence
+		replay.expected = replay.options.StartSequence + 1
+	}
+
+	return nil
+}
+
+// page decodes a page of events, and then applies them to the loader.
+func (replay *replayer) page(loaded []KeyedEvent) error {
+	errStart := replay.start()
+	if errStart != nil {
+		return errStart
+	}
+
+	key := replay.loader.GetKey()
+	reg := replay.registry
+
 	// Rehydate events
 	toApply := make([]eventsourcing.Event, len(loaded))
 	for index, event := range loaded {
-		summoned := reg.CreateEvent(event.EventType)
-		config := &mapstructure.DecoderConfig{
-			DecodeHook:       mapping.MapTimeFromJSON,
-			TagName:          "json",
-			Result:           summoned,
-			WeaklyTypedInput: true,
-		}
-		decoder, errDecoder := mapstructure.NewDecoder(config)
-		if errDecoder != nil {
-			return errDecoder
+		if event.EventType == GapEventType || event.EventType == BaselineEventType {
+			continue
 		}
 
-		errDecode := decoder.Decode(event.EventData)
+		summoned, errDecode := DecodeData(reg, event.EventType, event.EventData, replay.options.codecs())
 		if errDecode != nil {
 			return errDecode
 		}
@@ -147,14 +446,84 @@ func (store *store) Refresh(loader eventsourcing.StoreLoaderAdapter) error {
 		target.Set(reflect.ValueOf(summoned).Elem())
 	}
 
-	// Apply
-	for _, eventTyped := range toApply {
-		loader.ReplayEvent(eventTyped)
+	// Apply, checking that sequences are dense unless a gap is declared
+	for index, eventTyped := range toApply {
+		event := loaded[index]
+
+		// Baselines replace the events before them, so may follow any sequence
+		if event.EventType == BaselineEventType {
+			if event.Sequence < replay.expected {
+				return fmt.Errorf("StoreError: Expected sequence %v for key %v, got baseline at %v", replay.expected, key, event.Sequence)
+			}
+
+			errRestore := replay.loader.RestoreSnapshot(event.Sequence, event.EventData)
+			if errRestore != nil {
+				return errRestore
+			}
+			replay.position = event.Sequence
+			replay.expected = event.Sequence + 1
+			continue
+		}
+
+		if event.Sequence != replay.expected && (event.Sequence < replay.expected || !replay.options.TolerateGaps) {
+			return fmt.Errorf("StoreError: Expected sequence %v for key %v, got %v", replay.expected, key, event.Sequence)
+		}
+
+		// Skip over any missing sequences
+		if event.Sequence-1 != replay.position {
+			errAdvance := advance(replay.loader, event.Sequence-1)
+			if errAdvance != nil {
+				return errAdvance
+			}
+		}
+		replay.position = event.Sequence
+
+		if event.EventType == GapEventType {
+			gap := Gap{}
+			errGap := mapstructure.WeakDecode(event.EventData, &gap)
+			if errGap != nil {
+				return errGap
+			}
+			if gap.Next <= event.Sequence {
+				return fmt.Errorf("StoreError: Gap record for key %v at %v does not move forward", key, event.Sequence)
+			}
+
+			// Move to just before the resume point, so that commits following a
+			// trailing gap record are written at it, not inside the gap
+			errAdvance := advance(replay.loader, gap.Next-1)
+			if errAdvance != nil {
+				return errAdvance
+			}
+			replay.position = gap.Next - 1
+			replay.expected = gap.Next
+			continue
+		}
+
+		replay.loader.ReplayEvent(eventTyped)
+		replay.expected = event.Sequence + 1
 	}
 
 	return nil
 }
 
+// codecs gets the codecs that envelopes may have been encoded with.
+func (options Options) codecs() []Codec {
+	if options.Codec == nil {
+		return options.Codecs
+	}
+	return append([]Codec{options.Codec}, options.Codecs...)
+}
+
+// advance moves a loader forward to the specified sequence, if it supports it.
+func advance(loader eventsourcing.StoreLoaderAdapter, sequence int64) error {
+	advancer, ok := loader.(eventsourcing.SequenceAdvancer)
+	if !ok {
+		return fmt.Errorf("StoreError: Aggregate %v does not support skipping to sequence %v", loader.GetKey(), sequence)
+	}
+
+	return advancer.AdvanceSequence(sequence)
+}
+
 // assignEventKeys converts keyless events into keyed store events.
 func assignEventKeys(key string, seq int64, registry eventsourcing.EventRegistry, events []eventsourcing.Event) ([]KeyedEvent, error) {
 	target := make([]KeyedEvent, len(events))
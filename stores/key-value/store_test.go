@@ -0,0 +1,408 @@
+package keyvalue
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// sparseStore is a key-value provider that stores events by their sequence,
+// allowing streams that start late or contain gaps.
+type sparseStore struct {
+	streams map[string][]KeyedEvent
+}
+
+func newSparseStore() *sparseStore {
+	return &sparseStore{
+		streams: make(map[string][]KeyedEvent),
+	}
+}
+
+func (data *sparseStore) checkExists(key string, seq int64) (bool, error) {
+	for _, event := range data.streams[key] {
+		if event.Sequence == seq {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (data *sparseStore) fetchEvents(key string, seq int64) ([]KeyedEvent, error) {
+	result := make([]KeyedEvent, 0)
+	for _, event := range data.streams[key] {
+		if event.Sequence > seq {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+// fetchPages fetches events in pages of the specified size.
+func (data *sparseStore) fetchPages(size int) FetchPagesCallback {
+	return func(key string, seq int64, page PageCallback) error {
+		loaded, _ := data.fetchEvents(key, seq)
+		for start := 0; start < len(loaded); start += size {
+			end := start + size
+			if end > len(loaded) {
+				end = len(loaded)
+			}
+
+			errPage := page(loaded[start:end])
+			if errPage != nil {
+				return errPage
+			}
+		}
+		return nil
+	}
+}
+
+func (data *sparseStore) putEvents(events []KeyedEvent) error {
+	for _, event := range events {
+		exists, _ := data.checkExists(event.Key, event.Sequence)
+		if exists {
+			return eventsourcing.NewConcurrencyFault(event.Key, event.Sequence)
+		}
+
+		// Round-trip the body, as a real store would
+		buff, errMarshal := json.Marshal(event.EventData)
+		if errMarshal != nil {
+			return errMarshal
+		}
+		body := make(map[string]interface{})
+		json.Unmarshal(buff, &body)
+		event.EventData = body
+
+		data.streams[event.Key] = append(data.streams[event.Key], event)
+	}
+	return nil
+}
+
+func (data *sparseStore) options() Options {
+	return Options{
+		CheckSequence: data.checkExists,
+		FetchEvents:   data.fetchEvents,
+		PutEvents:     data.putEvents,
+	}
+}
+
+func increment(key string, seq int64) KeyedEvent {
+	return KeyedEvent{
+		Key:       key,
+		Sequence:  seq,
+		EventType: "IncrementEvent",
+		EventData: test.IncrementEvent{IncrementBy: 1},
+	}
+}
+
+func load(key string, store eventsourcing.EventStore) (*test.SimpleAggregate, error) {
+	agg := &test.SimpleAggregate{}
+	agg.Initialize(key, test.GetTestRegistry(), store)
+	return agg, agg.Refresh()
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Key-Value", func() (eventsourcing.EventStore, func(), error) {
+		store := NewStore(newSparseStore().options())
+		return store, func() {
+			store.Close()
+		}, nil
+	})
+}
+
+// TestIdempotentCommits checks retried commits with the same ID succeed, with
+// drivers that fetch pages or whole streams
+func TestIdempotentCommits(t *testing.T) {
+	test.CheckIdempotentCommits(t, func() (eventsourcing.EventStore, func(), error) {
+		return NewStore(newSparseStore().options()), func() {}, nil
+	})
+	test.CheckIdempotentCommits(t, func() (eventsourcing.EventStore, func(), error) {
+		data := newSparseStore()
+		options := data.options()
+		options.FetchPages = data.fetchPages(1)
+		return NewStore(options), func() {}, nil
+	})
+}
+
+// TestStartSequence checks streams can begin after a configured sequence.
+func TestStartSequence(t *testing.T) {
+	data := newSparseStore()
+	options := data.options()
+	options.StartSequence = 100
+	store := NewStore(options)
+
+	assert.Nil(t, data.putEvents([]KeyedEvent{increment("legacy", 101), increment("legacy", 102)}))
+	agg, errLoad := load("legacy", store)
+	assert.Nil(t, errLoad)
+	assert.Equal(t, int64(102), agg.SequenceNumber())
+	assert.Equal(t, 2, agg.CurrentCount)
+
+	// New streams begin at the start sequence
+	fresh, errFresh := load("fresh", store)
+	assert.Nil(t, errFresh)
+	assert.Equal(t, int64(100), fresh.SequenceNumber())
+	fresh.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, fresh.Commit())
+	exists, _ := data.checkExists("fresh", 101)
+	assert.True(t, exists)
+
+	// Aggregates that haven't been refreshed are behind the start, so conflict
+	stale := &test.SimpleAggregate{}
+	stale.Initialize("stale", test.GetTestRegistry(), store)
+	stale.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	conflict, fault := eventsourcing.IsConcurrencyFault(stale.Commit())
+	assert.True(t, conflict)
+	assert.Equal(t, int64(1), fault.EventSequence)
+	assert.Equal(t, 0, len(data.streams["stale"]))
+
+	// Once refreshed, they begin at the start sequence
+	retry, errRetry := load("stale", store)
+	assert.Nil(t, errRetry)
+	retry.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, retry.Commit())
+	exists, _ = data.checkExists("stale", 101)
+	assert.True(t, exists)
+}
+
+// TestUndeclaredGap checks gaps are rejected unless tolerated.
+func TestUndeclaredGap(t *testing.T) {
+	data := newSparseStore()
+	assert.Nil(t, data.putEvents([]KeyedEvent{increment("gappy", 1), increment("gappy", 5)}))
+
+	_, errStrict := load("gappy", NewStore(data.options()))
+	assert.NotNil(t, errStrict, "Gaps should be rejected by default")
+
+	options := data.options()
+	options.TolerateGaps = true
+	agg, errTolerant := load("gappy", NewStore(options))
+	assert.Nil(t, errTolerant)
+	assert.Equal(t, int64(5), agg.SequenceNumber())
+	assert.Equal(t, 2, agg.CurrentCount)
+}
+
+// TestDeclaredGap checks gap records allow a stream to skip sequences.
+func TestDeclaredGap(t *testing.T) {
+	data := newSparseStore()
+	assert.Nil(t, data.putEvents([]KeyedEvent{
+		increment("declared", 1),
+		NewGapRecord("declared", 2, 10, "import"),
+		increment("declared", 10),
+	}))
+
+	store := NewStore(data.options())
+	agg, errLoad := load("declared", store)
+	assert.Nil(t, errLoad)
+	assert.Equal(t, int64(10), agg.SequenceNumber())
+	assert.Equal(t, 2, agg.CurrentCount)
+
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+	exists, _ := data.checkExists("declared", 11)
+	assert.True(t, exists)
+
+	// Gaps beyond the declared resume point are still rejected
+	assert.Nil(t, data.putEvents([]KeyedEvent{
+		NewGapRecord("bad", 1, 3, ""),
+		increment("bad", 4),
+	}))
+	_, errBad := load("bad", store)
+	assert.NotNil(t, errBad)
+}
+
+// TestTrailingGap checks a commit following a gap record that ends the stream is
+// written at the resume point, so the stream can still be refreshed.
+func TestTrailingGap(t *testing.T) {
+	data := newSparseStore()
+	assert.Nil(t, data.putEvents([]KeyedEvent{
+		increment("trailing", 1),
+		NewGapRecord("trailing", 2, 10, "import"),
+	}))
+
+	store := NewStore(data.options())
+	agg, errLoad := load("trailing", store)
+	assert.Nil(t, errLoad)
+	assert.Equal(t, int64(9), agg.SequenceNumber())
+
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+	exists, _ := data.checkExists("trailing", 10)
+	assert.True(t, exists)
+	inside, _ := data.checkExists("trailing", 3)
+	assert.False(t, inside, "Commits shouldn't be written inside the gap")
+
+	refreshed, errRefresh := load("trailing", store)
+	assert.Nil(t, errRefresh)
+	assert.Equal(t, int64(10), refreshed.SequenceNumber())
+	assert.Equal(t, 2, refreshed.CurrentCount)
+}
+
+// TestMetadata checks that metadata from the aggregate is stored with events.
+func TestMetadata(t *testing.T) {
+	data := newSparseStore()
+	store := NewStore(data.options())
+
+	agg, _ := load("flagged", store)
+	agg.UseFeatureFlags(eventsourcing.StaticFeatureFlags{"new-pricing": true})
+	agg.FeatureEnabled("new-pricing")
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+
+	stored := data.streams["flagged"]
+	assert.Equal(t, 1, len(stored))
+	assert.Equal(t, map[string]interface{}{"new-pricing": true}, stored[0].Metadata[eventsourcing.MetadataFeatureFlags])
+}
+
+// TestFetchPages checks streams fetched a page at a time replay as though they
+// were fetched at once, including sequence checks across page boundaries.
+func TestFetchPages(t *testing.T) {
+	data := newSparseStore()
+	assert.Nil(t, data.putEvents([]KeyedEvent{
+		increment("paged", 4),
+		increment("paged", 5),
+		NewGapRecord("paged", 6, 8, "import"),
+		increment("paged", 8),
+		increment("paged", 9),
+	}))
+	assert.Nil(t, data.putEvents([]KeyedEvent{increment("broken", 1), increment("broken", 2), increment("broken", 4)}))
+
+	options := data.options()
+	options.FetchEvents = nil
+	options.FetchPages = data.fetchPages(2)
+	options.StartSequence = 3
+	store := NewStore(options)
+
+	agg, errLoad := load("paged", store)
+	assert.Nil(t, errLoad)
+	assert.Equal(t, int64(9), agg.SequenceNumber())
+	assert.Equal(t, 4, agg.CurrentCount)
+
+	empty, errEmpty := load("empty", store)
+	assert.Nil(t, errEmpty)
+	assert.Equal(t, int64(3), empty.SequenceNumber())
+
+	options.StartSequence = 0
+	_, errBroken := load("broken", NewStore(options))
+	assert.NotNil(t, errBroken, "Gaps across pages should be rejected")
+}
+
+// TestPrune checks pruning is passed to the driver, if it supports it.
+func TestPrune(t *testing.T) {
+	data := newSparseStore()
+	options := data.options()
+	unsupported := NewStore(options)
+	_, errUnsupported := unsupported.(eventsourcing.RetentionStore).Prune("key", 5, eventsourcing.RetentionPolicy{})
+	assert.NotNil(t, errUnsupported)
+
+	options.PruneEvents = func(key string, snapshot int64, policy eventsourcing.RetentionPolicy) (int64, error) {
+		assert.Equal(t, "key", key)
+		assert.Equal(t, int64(3), policy.KeepEvents)
+		return snapshot, nil
+	}
+	removed, errPrune := NewStore(options).(eventsourcing.RetentionStore).Prune("key", 5, eventsourcing.RetentionPolicy{KeepEvents: 3})
+	assert.Nil(t, errPrune)
+	assert.Equal(t, int64(5), removed)
+}
+
+// TestExpiringEvents checks drivers without a sequence check can follow on from
+// events that have expired.
+func TestExpiringEvents(t *testing.T) {
+	data := newSparseStore()
+	options := data.options()
+	options.CheckSequence = nil
+	options.TolerateGaps = true
+	store := NewStore(options)
+
+	assert.Nil(t, data.putEvents([]KeyedEvent{increment("expiring", 5)}))
+	agg, errLoad := load("expiring", store)
+	assert.Nil(t, errLoad)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+
+	exists, _ := data.checkExists("expiring", 6)
+	assert.True(t, exists)
+}
+
+// TestReadAll checks the global feed is read from the driver, skipping gap records.
+func TestReadAll(t *testing.T) {
+	data := newSparseStore()
+	options := data.options()
+	_, errUnsupported := NewStore(options).(eventsourcing.GlobalReader).ReadAll("", 10)
+	assert.NotNil(t, errUnsupported)
+
+	feed := []PositionedEvent{
+		{KeyedEvent: increment("a", 1), Position: "1"},
+		{KeyedEvent: NewGapRecord("a", 2, 5, "import"), Position: "2"},
+		{KeyedEvent: NewGapRecord("b", 1, 3, "import"), Position: "3"},
+		{KeyedEvent: increment("a", 5), Position: "4"},
+		{KeyedEvent: increment("b", 3), Position: "5"},
+	}
+	options.ReadAll = func(from string, limit int) ([]PositionedEvent, error) {
+		start := 0
+		for index, event := range feed {
+			if event.Position == from {
+				start = index + 1
+			}
+		}
+		end := start + limit
+		if end > len(feed) {
+			end = len(feed)
+		}
+		return feed[start:end], nil
+	}
+	reader := NewStore(options).(eventsourcing.GlobalReader)
+
+	_, errLimit := reader.ReadAll("", 0)
+	assert.NotNil(t, errLimit)
+
+	first, errFirst := reader.ReadAll("", 2)
+	assert.Nil(t, errFirst)
+	assert.Equal(t, 2, len(first), "Reading continues past gap records")
+	assert.Equal(t, "a", first[0].Key)
+	assert.Equal(t, int64(5), first[1].Sequence)
+	assert.Equal(t, "4", first[1].Position)
+
+	rest, errRest := reader.ReadAll(first[1].Position, 2)
+	assert.Nil(t, errRest)
+	assert.Equal(t, 1, len(rest))
+	assert.Equal(t, "b", rest[0].Key)
+	assert.Equal(t, eventsourcing.EventType("IncrementEvent"), rest[0].Type)
+
+	end, errEnd := reader.ReadAll(rest[0].Position, 2)
+	assert.Nil(t, errEnd)
+	assert.Empty(t, end)
+}
+
+// TestVersionFallback checks versions are read from the raw events of drivers
+// without a LatestSequence callback, including streams ending in a gap record.
+func TestVersionFallback(t *testing.T) {
+	data := newSparseStore()
+	data.streams["events"] = []KeyedEvent{{Key: "events", Sequence: 1}, {Key: "events", Sequence: 2}}
+	data.streams["gap"] = []KeyedEvent{{Key: "gap", Sequence: 1}, NewGapRecord("gap", 2, 10, "import")}
+
+	for _, options := range []Options{
+		{FetchEvents: data.fetchEvents},
+		{FetchPages: data.fetchPages(1)},
+	} {
+		store := NewStore(options)
+		for key, expected := range map[string]int64{"events": 2, "gap": 2, "missing": 0} {
+			version, errVersion := eventsourcing.Version(store, key)
+			assert.Nil(t, errVersion)
+			assert.Equal(t, expected, version, key)
+		}
+	}
+}
+
+// TestVersionCallback checks drivers can answer version queries themselves.
+func TestVersionCallback(t *testing.T) {
+	store := NewStore(Options{
+		LatestSequence: func(key string) (int64, error) {
+			return 7, nil
+		},
+	})
+	version, errVersion := eventsourcing.Version(store, "any")
+	assert.Nil(t, errVersion)
+	assert.Equal(t, int64(7), version)
+}
@@ -0,0 +1,30 @@
+package keyvalue
+
+// Version gets the sequence of the latest event for a key, or zero if there are
+// none. Drivers that don't provide a LatestSequence callback fetch the raw events
+// of the stream, without decoding them.
+func (store *store) Version(key string) (int64, error) {
+	if store.options.LatestSequence != nil {
+		return store.options.LatestSequence(key)
+	}
+
+	latest := int64(0)
+	track := func(events []KeyedEvent) error {
+		if len(events) > 0 {
+			latest = events[len(events)-1].Sequence
+		}
+		return nil
+	}
+
+	if store.options.FetchPages != nil {
+		errLoad := store.options.FetchPages(key, 0, track)
+		return latest, errLoad
+	}
+
+	loaded, errLoad := store.options.FetchEvents(key, 0)
+	if errLoad != nil {
+		return 0, errLoad
+	}
+	track(loaded)
+	return latest, nil
+}
@@ -1,40 +1,119 @@
+/*
+Package memory is an event store that keeps its events in memory, for tests,
+examples and short-lived caches:
+
+	store := memory.NewStore()
+
+The store is safe for concurrent use. Streams are spread over shards by key, each
+with a lock of its own, so commits to different aggregates rarely contend, and
+the global feed has a separate lock. Events are round-tripped through JSON as they
+would be by any other store, so that aggregates don't share state with the store.
+*/
 package memory
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
 
 	"github.com/go-gadgets/eventsourcing"
 	keyvalue "github.com/go-gadgets/eventsourcing/stores/key-value"
 )
 
+// shardCount is the number of shards streams are spread over.
+const shardCount = 32
+
 // NewStore creates a new in memory event store.
 func NewStore() eventsourcing.EventStore {
-	provider := &state{
-		streams: make(map[string][]item),
-	}
+	return NewStoreWithCodec(nil)
+}
 
+// NewStoreWithCodec creates a new in memory event store, which encodes event data
+// with a codec (see keyvalue.Codec).
+func NewStoreWithCodec(codec keyvalue.Codec) eventsourcing.EventStore {
+	provider := newState()
 	store := keyvalue.NewStore(keyvalue.Options{
-		CheckSequence: provider.checkExists,
-		FetchEvents:   provider.fetchEvents,
-		PutEvents:     provider.putEvents,
-		Close: func() error {
-			provider.streams = nil
-			return nil
-		},
+		CheckSequence:   provider.checkExists,
+		FetchPages:      provider.fetchPages,
+		PutEvents:       provider.putEvents,
+		LatestSequence:  provider.latestSequence,
+		ReadAll:         provider.readAll,
+		ReadCategory:    provider.readCategory,
+		ReadCorrelation: provider.readCorrelation,
+		CompactEvents:   provider.compactEvents,
+		Ping:            provider.ping,
+		Close:           provider.close,
+		Codec:           codec,
 	})
 
 	return store
 }
 
-// state contains the current data for an in-memory store.
+// newState creates the empty state of a store.
+func newState() *state {
+	data := &state{
+		categories:   make(map[string][]int),
+		correlations: make(map[string][]int),
+	}
+	for index := range data.shards {
+		data.shards[index] = &shard{
+			streams: make(map[string][]item),
+		}
+	}
+	return data
+}
+
+// state contains the current data for an in-memory store. Locks are always taken
+// in the same order, shards (in index order) before the log, so that commits to
+// several streams can't deadlock.
 type state struct {
+	// shards hold the streams, spread by the hash of their key
+	shards [shardCount]*shard
+
+	// logLock guards the log, its indexes and closed flag
+	logLock sync.RWMutex
+
+	// log refers to every event in the store, in the order they were written,
+	// which forms the global feed. Positions in the feed are one-based indexes
+	// into the log. Entries hold a copy of their event, so that the feed can be
+	// read without locking the shards.
+	log []entry
+
+	// categories holds the indexes within the log of the events of each category,
+	// in ascending order.
+	categories map[string][]int
+
+	// correlations holds the indexes within the log of the events of each
+	// business transaction, by correlation ID, in ascending order.
+	correlations map[string][]int
+
+	// closed is set once the store is closed
+	closed bool
+}
+
+// shard holds the streams of some of the keys in the store.
+type shard struct {
+	// lock guards the streams of the shard
+	lock sync.RWMutex
+
 	// streams is a map of string-serialized event streams. This is to ensure
 	// that we are actually round-tripping to a non-native object, rather
 	// that storing instances directly or by pointers
 	streams map[string][]item
 }
 
+// entry refers to an event within a stream.
+type entry struct {
+	item
+	key   string // Key of the stream
+	index int    // Index of the event within the stream
+}
+
 // item represents an item in the store.
 type item struct {
 	// eventType is the type of event
@@ -42,11 +121,69 @@ type item struct {
 
 	// body is the body of the event being stored, using encoding/json
 	body []byte
+
+	// metadata is the metadata recorded with the event
+	metadata map[string]interface{}
+
+	// removed is set once the event has been replaced by a baseline
+	removed bool
+
+	// position is the index of the event in the log
+	position int
+}
+
+// shard gets the shard that holds the stream for a key.
+func (data *state) shard(key string) *shard {
+	return data.shards[shardIndex(key)]
+}
+
+// shardIndex gets the index of the shard for a key.
+func shardIndex(key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % shardCount)
+}
+
+// close discards the contents of the store.
+func (data *state) close() error {
+	for _, shard := range data.shards {
+		shard.lock.Lock()
+		shard.streams = make(map[string][]item)
+		shard.lock.Unlock()
+	}
+
+	data.logLock.Lock()
+	defer data.logLock.Unlock()
+	data.log = nil
+	data.categories = make(map[string][]int)
+	data.correlations = make(map[string][]int)
+	data.closed = true
+	return nil
+}
+
+// errClosed is the error for operations on a closed store.
+func errClosed() error {
+	return fmt.Errorf("StoreError: The memory store is closed")
+}
+
+// ping checks that the store hasn't been closed.
+func (data *state) ping(ctx context.Context) error {
+	data.logLock.RLock()
+	defer data.logLock.RUnlock()
+
+	if data.closed {
+		return errClosed()
+	}
+	return nil
 }
 
 // checkExists checks that a particular sequence number exists in the store.
 func (data *state) checkExists(key string, seq int64) (bool, error) {
-	stream, found := data.streams[key]
+	shard := data.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	stream, found := shard.streams[key]
 	if !found {
 		return false, nil
 	}
@@ -54,65 +191,318 @@ func (data *state) checkExists(key string, seq int64) (bool, error) {
 	return len(stream) >= int(seq), nil
 }
 
-// fetchEvents checks all events beyond the specified sequence number.
-func (data *state) fetchEvents(key string, seq int64) ([]keyvalue.KeyedEvent, error) {
-	stream, found := data.streams[key]
+// latestSequence gets the sequence of the latest event for a key.
+func (data *state) latestSequence(key string) (int64, error) {
+	shard := data.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
 
-	// If no stream, or we've only got prior events, then return an empty
-	// set of events.
-	if !found || len(stream) < int(seq) {
-		return []keyvalue.KeyedEvent{}, nil
-	}
+	return int64(len(shard.streams[key])), nil
+}
 
-	result := make([]keyvalue.KeyedEvent, 0)
-	for index := int(seq); index < len(stream); index++ {
-		// Rehydrate the JSON
-		target := make(map[string]interface{})
-		decoder := json.NewDecoder(bytes.NewReader(stream[index].body))
-		decoder.UseNumber()
-		errUnmarshal := decoder.Decode(&target)
-		if errUnmarshal != nil {
-			return nil, errUnmarshal
+// fetchPages reads all events beyond the specified sequence number, a page at a time.
+func (data *state) fetchPages(key string, seq int64, page keyvalue.PageCallback) error {
+	// Streams are appended to, or replaced when compacted, so the stream can be
+	// read outside the lock
+	shard := data.shard(key)
+	shard.lock.RLock()
+	stream := shard.streams[key]
+	shard.lock.RUnlock()
+
+	// Streams with no events beyond the sequence produce no pages
+	for start := int(seq); start < len(stream); start += keyvalue.DefaultPageSize {
+		end := start + keyvalue.DefaultPageSize
+		if end > len(stream) {
+			end = len(stream)
 		}
 
-		result = append(result, keyvalue.KeyedEvent{
-			Key:       key,
-			Sequence:  seq + int64(1+index),
-			EventType: stream[index].eventType,
-			EventData: target,
-		})
+		result := make([]keyvalue.KeyedEvent, 0, end-start)
+		for index := start; index < end; index++ {
+			if stream[index].removed {
+				continue
+			}
+
+			// Rehydrate the JSON
+			target, errUnmarshal := decode(stream[index].body)
+			if errUnmarshal != nil {
+				return errUnmarshal
+			}
+
+			result = append(result, keyvalue.KeyedEvent{
+				Key:       key,
+				Sequence:  int64(1 + index),
+				EventType: stream[index].eventType,
+				EventData: target,
+				Metadata:  stream[index].metadata,
+			})
+		}
+
+		if len(result) == 0 {
+			continue
+		}
+
+		errPage := page(result)
+		if errPage != nil {
+			return errPage
+		}
 	}
-	return result, nil
+
+	return nil
 }
 
-// putEvents writes events to the store
-func (data *state) putEvents(events []keyvalue.KeyedEvent) error {
+// lockShards write-locks the shards of the streams of a set of events, in index
+// order, returning a function that unlocks them.
+func (data *state) lockShards(events []keyvalue.KeyedEvent) func() {
+	indexes := make([]int, 0, 1)
+	seen := make(map[int]bool)
 	for _, evt := range events {
-		stream, found := data.streams[evt.Key]
-		if !found {
-			stream = make([]item, 0)
+		index := shardIndex(evt.Key)
+		if !seen[index] {
+			seen[index] = true
+			indexes = append(indexes, index)
 		}
+	}
+	sort.Ints(indexes)
 
-		// Concurrency check (are we inserting over the top of an event?)
-		// (Event Seq=1 is array index 0)
-		expectedLength := int(evt.Sequence - 1)
-		if len(stream) > expectedLength {
-			return eventsourcing.NewConcurrencyFault(evt.Key, evt.Sequence)
+	for _, index := range indexes {
+		data.shards[index].lock.Lock()
+	}
+	return func() {
+		for _, index := range indexes {
+			data.shards[index].lock.Unlock()
 		}
+	}
+}
 
+// putEvents writes events to the store. The events are checked before any are
+// written, so that a commit is either written in full or not at all.
+func (data *state) putEvents(events []keyvalue.KeyedEvent) error {
+	bodies := make([][]byte, len(events))
+	for index, evt := range events {
 		buff, errMarshal := json.Marshal(evt.EventData)
 		if errMarshal != nil {
 			return errMarshal
 		}
+		bodies[index] = buff
+	}
+
+	unlock := data.lockShards(events)
+	defer unlock()
+
+	// Concurrency check (are we inserting over the top of an event?)
+	// (Event Seq=1 is array index 0)
+	lengths := make(map[string]int)
+	for _, evt := range events {
+		length, seen := lengths[evt.Key]
+		if !seen {
+			length = len(data.shard(evt.Key).streams[evt.Key])
+		}
 
-		stream = append(stream, item{
+		expectedLength := int(evt.Sequence - 1)
+		if length > expectedLength {
+			return eventsourcing.NewConcurrencyFault(evt.Key, evt.Sequence)
+		}
+		lengths[evt.Key] = length + 1
+	}
+
+	data.logLock.Lock()
+	defer data.logLock.Unlock()
+	if data.closed {
+		return errClosed()
+	}
+
+	for index, evt := range events {
+		shard := data.shard(evt.Key)
+		stored := item{
 			eventType: evt.EventType,
-			body:      buff,
-		})
+			body:      bodies[index],
+			metadata:  evt.Metadata,
+			position:  len(data.log),
+		}
 
 		// Write back to the structure
-		data.streams[evt.Key] = stream
+		stream := append(shard.streams[evt.Key], stored)
+		shard.streams[evt.Key] = stream
+		data.log = append(data.log, entry{item: stored, key: evt.Key, index: len(stream) - 1})
+		if category := eventsourcing.CategoryOf(evt.Metadata); category != "" {
+			data.categories[category] = append(data.categories[category], stored.position)
+		}
+		if correlationID := eventsourcing.CorrelationIDOf(evt.Metadata); correlationID != "" {
+			data.correlations[correlationID] = append(data.correlations[correlationID], stored.position)
+		}
 	}
 
 	return nil
 }
+
+// compactEvents replaces the event at the sequence of a baseline with the baseline,
+// and marks the events before it as removed. Positions in the global feed are
+// indexes into the log, so removed events are skipped rather than deleted, but
+// keep only their position so that their bodies are released.
+func (data *state) compactEvents(baseline keyvalue.KeyedEvent) (int64, error) {
+	buff, errMarshal := json.Marshal(baseline.EventData)
+	if errMarshal != nil {
+		return 0, errMarshal
+	}
+
+	shard := data.shard(baseline.Key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	stream := shard.streams[baseline.Key]
+	if int(baseline.Sequence) > len(stream) {
+		return 0, fmt.Errorf("StoreError: Key %v has no event at sequence %v to compact", baseline.Key, baseline.Sequence)
+	}
+
+	data.logLock.Lock()
+	defer data.logLock.Unlock()
+
+	// Replace the stream, since readers may hold the previous one
+	compacted := make([]item, len(stream))
+	copy(compacted, stream)
+
+	removed := int64(0)
+	for index := 0; index < int(baseline.Sequence)-1; index++ {
+		if !compacted[index].removed && compacted[index].eventType != keyvalue.BaselineEventType {
+			removed++
+		}
+		compacted[index] = item{
+			removed:  true,
+			position: compacted[index].position,
+		}
+		data.log[compacted[index].position].item = compacted[index]
+	}
+
+	replaced := compacted[baseline.Sequence-1]
+	if replaced.eventType != keyvalue.BaselineEventType {
+		removed++
+	}
+	compacted[baseline.Sequence-1] = item{
+		eventType: baseline.EventType,
+		body:      buff,
+		position:  replaced.position,
+	}
+	data.log[replaced.position].item = compacted[baseline.Sequence-1]
+
+	shard.streams[baseline.Key] = compacted
+	return removed, nil
+}
+
+// readAll reads events from the global feed, in the order they were written.
+func (data *state) readAll(from string, limit int) ([]keyvalue.PositionedEvent, error) {
+	position, errPosition := parsePosition(from)
+	if errPosition != nil {
+		return nil, errPosition
+	}
+
+	data.logLock.RLock()
+	defer data.logLock.RUnlock()
+	if data.closed {
+		return nil, errClosed()
+	}
+
+	result := make([]keyvalue.PositionedEvent, 0, limit)
+	for index := position; index < len(data.log) && len(result) < limit; index++ {
+		if data.log[index].removed {
+			continue
+		}
+
+		event, errEvent := data.positioned(index)
+		if errEvent != nil {
+			return nil, errEvent
+		}
+		result = append(result, event)
+	}
+
+	return result, nil
+}
+
+// readCategory reads the events of a category from the global feed.
+func (data *state) readCategory(category string, from string, limit int) ([]keyvalue.PositionedEvent, error) {
+	return data.readIndex(func() []int {
+		return data.categories[category]
+	}, from, limit)
+}
+
+// readCorrelation reads the events of a business transaction from the global feed.
+func (data *state) readCorrelation(correlationID string, from string, limit int) ([]keyvalue.PositionedEvent, error) {
+	return data.readIndex(func() []int {
+		return data.correlations[correlationID]
+	}, from, limit)
+}
+
+// readIndex reads the events of the global feed at the indexes of the log that an
+// index holds, which is fetched once the log is locked.
+func (data *state) readIndex(index func() []int, from string, limit int) ([]keyvalue.PositionedEvent, error) {
+	position, errPosition := parsePosition(from)
+	if errPosition != nil {
+		return nil, errPosition
+	}
+
+	data.logLock.RLock()
+	defer data.logLock.RUnlock()
+	if data.closed {
+		return nil, errClosed()
+	}
+
+	indexes := index()
+	result := make([]keyvalue.PositionedEvent, 0, limit)
+	for next := sort.SearchInts(indexes, position); next < len(indexes) && len(result) < limit; next++ {
+		if data.log[indexes[next]].removed {
+			continue
+		}
+
+		event, errEvent := data.positioned(indexes[next])
+		if errEvent != nil {
+			return nil, errEvent
+		}
+		result = append(result, event)
+	}
+
+	return result, nil
+}
+
+// parsePosition gets the index in the log that follows a feed position.
+func parsePosition(from string) (int, error) {
+	if from == "" {
+		return 0, nil
+	}
+
+	position, errParse := strconv.Atoi(from)
+	if errParse != nil || position < 0 {
+		return 0, fmt.Errorf("StoreError: Invalid feed position %q", from)
+	}
+	return position, nil
+}
+
+// positioned reads the event at an index in the log.
+func (data *state) positioned(index int) (keyvalue.PositionedEvent, error) {
+	stored := data.log[index]
+	target, errUnmarshal := decode(stored.body)
+	if errUnmarshal != nil {
+		return keyvalue.PositionedEvent{}, errUnmarshal
+	}
+
+	return keyvalue.PositionedEvent{
+		KeyedEvent: keyvalue.KeyedEvent{
+			Key:       stored.key,
+			Sequence:  int64(stored.index + 1),
+			EventType: stored.eventType,
+			EventData: target,
+			Metadata:  stored.metadata,
+		},
+		Position: strconv.Itoa(index + 1),
+	}, nil
+}
+
+// decode rehydrates the JSON body of an event.
+func decode(body []byte) (map[string]interface{}, error) {
+	target := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	errUnmarshal := decoder.Decode(&target)
+	if errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+	return target, nil
+}
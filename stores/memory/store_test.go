@@ -1,9 +1,16 @@
 package memory
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+
 	"github.com/go-gadgets/eventsourcing"
+	keyvalue "github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/memorysnap"
 	"github.com/go-gadgets/eventsourcing/utilities/test"
 )
 
@@ -19,6 +26,23 @@ func TestStoreCompliance(t *testing.T) {
 	test.CheckStandardSuite(t, "In-Memory Store", provider)
 }
 
+// TestCodecCompliance checks the store with events encoded by a codec
+func TestCodecCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "In-Memory Store (JSON codec)", func() (eventsourcing.EventStore, func(), error) {
+		return NewStoreWithCodec(keyvalue.JSONCodec()), func() {}, nil
+	})
+}
+
+// TestIdempotentCommits checks retried commits with the same ID succeed
+func TestIdempotentCommits(t *testing.T) {
+	test.CheckIdempotentCommits(t, provider)
+}
+
+// TestRandomInterleavings checks the store under concurrent, random use
+func TestRandomInterleavings(t *testing.T) {
+	test.CheckRandomInterleavings(t, provider, test.FuzzOptions{})
+}
+
 // BenchmarkIndividualCommmits tests how fast we can apply events to an aggregate
 func BenchmarkIndividualCommmits(b *testing.B) {
 	test.MeasureIndividualCommits(b, provider)
@@ -29,3 +53,218 @@ func BenchmarkIndividualCommmits(b *testing.B) {
 func BenchmarkBulkInsertAndLoad(b *testing.B) {
 	test.MeasureBulkInsertAndReload(b, provider)
 }
+
+// TestGlobalFeed checks every event can be read in commit order.
+func TestGlobalFeed(t *testing.T) {
+	test.CheckGlobalFeed(t, provider)
+}
+
+// TestCategoryFeed checks the events of a category can be read in commit order.
+func TestCategoryFeed(t *testing.T) {
+	test.CheckCategoryFeed(t, provider)
+}
+
+// TestCorrelationFeed checks the events of a business transaction can be read
+// across aggregates.
+func TestCorrelationFeed(t *testing.T) {
+	test.CheckCorrelationFeed(t, provider)
+}
+
+// TestJSONCodec checks aggregates are revived by a registry using the JSON codec.
+func TestJSONCodec(t *testing.T) {
+	registry := eventsourcing.NewStandardEventRegistry("Testing")
+	registry.RegisterEvent(test.InitializeEvent{})
+	registry.RegisterEvent(test.IncrementEvent{})
+	registry.(eventsourcing.CodecRegistry).UseCodec(eventsourcing.JSONCodec{})
+
+	store := NewStore()
+	agg := test.SimpleAggregate{}
+	agg.Initialize("json-codec", registry, store)
+	agg.ApplyEvent(test.InitializeEvent{TargetValue: 3})
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 2})
+	assert.Nil(t, agg.Commit())
+
+	revived := test.SimpleAggregate{}
+	revived.Initialize("json-codec", registry, store)
+	assert.Nil(t, revived.Refresh())
+	assert.Equal(t, 3, revived.TargetValue)
+	assert.Equal(t, 2, revived.CurrentCount)
+}
+
+// TestVersion checks versions are read without fetching events.
+func TestVersion(t *testing.T) {
+	test.CheckVersion(t, provider)
+}
+
+// TestPing checks the store is unhealthy once closed.
+func TestPing(t *testing.T) {
+	store := NewStore()
+	assert.Nil(t, eventsourcing.Ping(context.Background(), store))
+
+	store.Close()
+	assert.NotNil(t, eventsourcing.Ping(context.Background(), store))
+}
+
+// TestReadAfterClose checks the feeds fail once the store is closed, rather than
+// reading indexes into the discarded log.
+func TestReadAfterClose(t *testing.T) {
+	store := NewStore()
+	agg := &test.SimpleAggregate{}
+	agg.Initialize("closed", test.GetTestRegistry(), store)
+	agg.UseCategory("Counter")
+	agg.UseLineage("order-1", "command-1")
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+
+	store.Close()
+
+	_, errAll := store.(eventsourcing.GlobalReader).ReadAll("", 10)
+	assert.NotNil(t, errAll)
+	_, errCategory := store.(eventsourcing.CategoryReader).ReadCategory("Counter", "", 10)
+	assert.NotNil(t, errCategory)
+	_, errCorrelation := store.(eventsourcing.CorrelationReader).ReadCorrelation("order-1", "", 10)
+	assert.NotNil(t, errCorrelation)
+}
+
+// load refreshes an aggregate from a store
+func load(t *testing.T, store eventsourcing.EventStore, key string) *test.SimpleAggregate {
+	agg := &test.SimpleAggregate{}
+	agg.Initialize(key, test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	return agg
+}
+
+// TestCompact checks compacted streams replay from their baseline, and carry on
+// from it
+func TestCompact(t *testing.T) {
+	store := NewStore()
+	agg := load(t, store, "compacted")
+	agg.ApplyEvent(test.InitializeEvent{TargetValue: 10})
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 2})
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 3})
+	assert.Nil(t, agg.Commit())
+
+	removed, errCompact := load(t, store, "compacted").Compact()
+	assert.Nil(t, errCompact)
+	assert.Equal(t, int64(3), removed)
+
+	revived := load(t, store, "compacted")
+	assert.Equal(t, 10, revived.TargetValue)
+	assert.Equal(t, 5, revived.CurrentCount)
+	assert.Equal(t, int64(3), revived.SequenceNumber())
+
+	revived.ApplyEvent(test.IncrementEvent{IncrementBy: 4})
+	assert.Nil(t, revived.Commit())
+	assert.Equal(t, 9, load(t, store, "compacted").CurrentCount)
+
+	removed, errCompact = load(t, store, "compacted").Compact()
+	assert.Nil(t, errCompact)
+	assert.Equal(t, int64(1), removed, "The previous baseline should not be counted")
+	assert.Equal(t, 9, load(t, store, "compacted").CurrentCount)
+
+	version, errVersion := eventsourcing.Version(store, "compacted")
+	assert.Nil(t, errVersion)
+	assert.Equal(t, int64(4), version)
+
+	events, errRead := store.(eventsourcing.GlobalReader).ReadAll("", 10)
+	assert.Nil(t, errRead)
+	assert.Empty(t, events, "Compacted events should leave the feed")
+}
+
+// TestCompactReleasesBodies checks compacted events keep nothing but their position
+func TestCompactReleasesBodies(t *testing.T) {
+	provider := newState()
+	assert.Nil(t, provider.putEvents([]keyvalue.KeyedEvent{
+		{Key: "a", Sequence: 1, EventType: "IncrementEvent", EventData: map[string]int{"increment_by": 1}, Metadata: map[string]interface{}{"user": "u"}},
+		{Key: "a", Sequence: 2, EventType: "IncrementEvent", EventData: map[string]int{"increment_by": 2}, Metadata: map[string]interface{}{"user": "u"}},
+		{Key: "a", Sequence: 3, EventType: "IncrementEvent", EventData: map[string]int{"increment_by": 3}},
+	}))
+
+	removed, errCompact := provider.compactEvents(keyvalue.KeyedEvent{Key: "a", Sequence: 2, EventType: keyvalue.BaselineEventType, EventData: map[string]int{"count": 3}})
+	assert.Nil(t, errCompact)
+	assert.Equal(t, int64(2), removed)
+
+	stream := provider.shard("a").streams["a"]
+	assert.Equal(t, item{removed: true, position: 0}, stream[0])
+	assert.Equal(t, item{removed: true, position: 0}, provider.log[0].item)
+	assert.Equal(t, keyvalue.BaselineEventType, stream[1].eventType)
+	assert.Nil(t, stream[1].metadata)
+	assert.Equal(t, stream[1], provider.log[1].item)
+	assert.NotNil(t, stream[2].body)
+}
+
+// TestCompactWithSnapshot checks snapshots taken before compaction still restore
+func TestCompactWithSnapshot(t *testing.T) {
+	store := eventsourcing.NewMiddlewareWrapper(NewStore())
+	store.Use(memorysnap.Create(memorysnap.Parameters{SnapInterval: 2}))
+
+	agg := load(t, store, "snapped")
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 2})
+	assert.Nil(t, agg.Commit())
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 3})
+	assert.Nil(t, agg.Commit())
+
+	removed, errCompact := load(t, store, "snapped").Compact()
+	assert.Nil(t, errCompact)
+	assert.Equal(t, int64(3), removed)
+	assert.Equal(t, 6, load(t, store, "snapped").CurrentCount)
+
+	dirty := load(t, store, "snapped")
+	dirty.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	_, errDirty := dirty.Compact()
+	assert.NotNil(t, errDirty)
+}
+
+// TestConcurrentCommits checks commits to many streams from many goroutines are
+// all kept, while the feed is read
+func TestConcurrentCommits(t *testing.T) {
+	store := NewStore()
+	workers := 16
+	commits := 20
+
+	wait := sync.WaitGroup{}
+	for worker := 0; worker < workers; worker++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+			key := fmt.Sprintf("concurrent-%v", worker)
+			for commit := 0; commit < commits; commit++ {
+				increment(t, store, key, 1)
+				_, errRead := store.(eventsourcing.GlobalReader).ReadAll("", 100)
+				assert.Nil(t, errRead)
+			}
+		}(worker)
+	}
+	wait.Wait()
+
+	for worker := 0; worker < workers; worker++ {
+		assert.Equal(t, commits, load(t, store, fmt.Sprintf("concurrent-%v", worker)).CurrentCount)
+	}
+	events, errRead := store.(eventsourcing.GlobalReader).ReadAll("", workers*commits+1)
+	assert.Nil(t, errRead)
+	assert.Len(t, events, workers*commits)
+}
+
+// increment commits an increment to an aggregate
+func increment(t *testing.T, store eventsourcing.EventStore, key string, by int) {
+	agg := load(t, store, key)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: by})
+	assert.Nil(t, agg.Commit())
+}
+
+// TestPutEventsAllOrNothing checks a commit that fails writes none of its events
+func TestPutEventsAllOrNothing(t *testing.T) {
+	provider := newState()
+	assert.Nil(t, provider.putEvents([]keyvalue.KeyedEvent{{Key: "b", Sequence: 1, EventType: "IncrementEvent"}}))
+	errPut := provider.putEvents([]keyvalue.KeyedEvent{
+		{Key: "a", Sequence: 1, EventType: "IncrementEvent"},
+		{Key: "b", Sequence: 1, EventType: "IncrementEvent"},
+	})
+	isConcurrency, _ := eventsourcing.IsConcurrencyFault(errPut)
+	assert.True(t, isConcurrency)
+
+	latest, _ := provider.latestSequence("a")
+	assert.Equal(t, int64(0), latest)
+	assert.Len(t, provider.log, 1)
+}
@@ -0,0 +1,245 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-gadgets/eventsourcing"
+	keyvalue "github.com/go-gadgets/eventsourcing/stores/key-value"
+)
+
+// ColdOptions is the configuration for a cold-storage store.
+type ColdOptions struct {
+	Bucket Bucket // Bucket that archived events are written to and read from
+	Prefix string // Prefix for object names, i.e. "cold/"
+}
+
+// coldStore is a store that moves the events a retention policy no longer keeps from
+// a hot store into a bucket, rather than removing them.
+type coldStore struct {
+	hot     eventsourcing.EventStore
+	options ColdOptions
+	reader  eventsourcing.EventStore
+}
+
+// NewColdStore creates a store that archives events to cheap storage, such as S3, as
+// they are pruned from a hot key-value store. Pruning the store (see
+// eventsourcing.RetentionStore) writes the events a policy would remove to the bucket
+// before removing them from the hot store, so a mongo.Reaper over the cold store
+// forms a complete archiving pipeline.
+//
+// Commits, and refreshes from a restored snapshot, go to the hot store alone. When
+// an aggregate is rebuilt from the start of its stream, the archived events are
+// replayed first, followed by those remaining in the hot store. The hot store must
+// be a key-value store that supports pruning, and streams containing gap records
+// cannot be archived.
+func NewColdStore(hot eventsourcing.EventStore, options ColdOptions) (eventsourcing.EventStore, error) {
+	if options.Bucket == nil {
+		return nil, fmt.Errorf("archive: a bucket is required for cold storage")
+	}
+	if _, ok := hot.(keyvalue.Folder); !ok {
+		return nil, fmt.Errorf("archive: store %T cannot be read for archiving", hot)
+	}
+
+	cold := &coldStore{
+		hot:     hot,
+		options: options,
+	}
+	cold.reader = keyvalue.NewStore(keyvalue.Options{
+		FetchPages: cold.fetchPages,
+		PutEvents: func(events []keyvalue.KeyedEvent) error {
+			return fmt.Errorf("archive: cold storage reader is read-only")
+		},
+	})
+
+	return cold, nil
+}
+
+// CommitEvents writes events to the hot store.
+func (cold *coldStore) CommitEvents(writer eventsourcing.StoreWriterAdapter) error {
+	return cold.hot.CommitEvents(writer)
+}
+
+// Refresh brings an aggregate up to date, replaying archived events if it is being
+// rebuilt from the start of its stream.
+func (cold *coldStore) Refresh(loader eventsourcing.StoreLoaderAdapter) error {
+	if loader.SequenceNumber() > 0 {
+		return cold.hot.Refresh(loader)
+	}
+	return cold.reader.Refresh(loader)
+}
+
+// Ping checks the health of the hot store.
+func (cold *coldStore) Ping(ctx context.Context) error {
+	return eventsourcing.Ping(ctx, cold.hot)
+}
+
+// Close shuts down the hot store.
+func (cold *coldStore) Close() error {
+	return cold.hot.Close()
+}
+
+// Prune archives the events of a stream that the policy does not keep, and then
+// removes them from the hot store.
+func (cold *coldStore) Prune(key string, snapshot int64, policy eventsourcing.RetentionPolicy) (int64, error) {
+	archived, errHead := cold.head(key)
+	if errHead != nil {
+		return 0, errHead
+	}
+
+	events, errRead := cold.hotEvents(key, archived)
+	if errRead != nil {
+		return 0, errRead
+	}
+
+	// Archive everything up to the horizon that isn't archived already. Events the
+	// age rule keeps may be archived early, which is harmless since they're skipped
+	// when replaying the hot store.
+	count := 0
+	if len(events) > 0 {
+		horizon := policy.Horizon(snapshot, events[len(events)-1].Sequence)
+		for count < len(events) && events[count].Sequence <= horizon {
+			count++
+		}
+	}
+
+	if count > 0 {
+		errArchive := cold.archive(key, archived, events[:count])
+		if errArchive != nil {
+			return 0, errArchive
+		}
+	}
+
+	return cold.hot.(eventsourcing.RetentionStore).Prune(key, snapshot, policy)
+}
+
+// archive writes a range of events as the next object of a stream, and then moves
+// the head of the stream on. If this is interrupted, the next attempt overwrites
+// the same object.
+func (cold *coldStore) archive(key string, archived int64, events []keyvalue.KeyedEvent) error {
+	buffer := bytes.Buffer{}
+	encoder := json.NewEncoder(&buffer)
+	for _, event := range events {
+		errEncode := encoder.Encode(event)
+		if errEncode != nil {
+			return errEncode
+		}
+	}
+
+	errPut := cold.options.Bucket.PutObject(cold.objectName(key, archived+1), buffer.Bytes())
+	if errPut != nil {
+		return errPut
+	}
+
+	last := strconv.FormatInt(events[len(events)-1].Sequence, 10)
+	return cold.options.Bucket.PutObject(cold.headName(key), []byte(last))
+}
+
+// head gets the highest sequence of a stream that has been archived.
+func (cold *coldStore) head(key string) (int64, error) {
+	body, errGet := cold.options.Bucket.GetObject(cold.headName(key))
+	if errGet == ErrObjectNotFound {
+		return 0, nil
+	}
+	if errGet != nil {
+		return 0, errGet
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+}
+
+// hotEvents reads the events of a stream from the hot store that are beyond the
+// specified sequence.
+func (cold *coldStore) hotEvents(key string, after int64) ([]keyvalue.KeyedEvent, error) {
+	result := []keyvalue.KeyedEvent{}
+	_, errFold := keyvalue.Fold(cold.hot, key, nil, func(state interface{}, event keyvalue.KeyedEvent) interface{} {
+		if event.Sequence > after {
+			result = append(result, event)
+		}
+		return nil
+	})
+	return result, errFold
+}
+
+// fetchPages reads the archived objects of a stream in order, followed by the
+// events remaining in the hot store.
+func (cold *coldStore) fetchPages(key string, seq int64, page keyvalue.PageCallback) error {
+	last := int64(0)
+	for {
+		body, errGet := cold.options.Bucket.GetObject(cold.objectName(key, last+1))
+		if errGet == ErrObjectNotFound {
+			break
+		}
+		if errGet != nil {
+			return errGet
+		}
+
+		events, errDecode := decodeObject(body)
+		if errDecode != nil {
+			return errDecode
+		}
+		if len(events) == 0 {
+			break
+		}
+		last = events[len(events)-1].Sequence
+
+		errPage := pageAfter(events, seq, page)
+		if errPage != nil {
+			return errPage
+		}
+	}
+
+	if seq > last {
+		last = seq
+	}
+	events, errRead := cold.hotEvents(key, last)
+	if errRead != nil {
+		return errRead
+	}
+	return pageAfter(events, seq, page)
+}
+
+// pageAfter passes the events beyond the specified sequence to the page callback.
+func pageAfter(events []keyvalue.KeyedEvent, seq int64, page keyvalue.PageCallback) error {
+	for index, event := range events {
+		if event.Sequence > seq {
+			return page(events[index:])
+		}
+	}
+	return nil
+}
+
+// decodeObject reads the events from an archived object.
+func decodeObject(body []byte) ([]keyvalue.KeyedEvent, error) {
+	result := []keyvalue.KeyedEvent{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, len(body)+1)
+	for scanner.Scan() {
+		event := keyvalue.KeyedEvent{}
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.UseNumber()
+		errDecode := decoder.Decode(&event)
+		if errDecode != nil {
+			return nil, errDecode
+		}
+		result = append(result, event)
+	}
+	return result, scanner.Err()
+}
+
+// objectName gets the name of the archived object of a stream that starts at the
+// specified sequence.
+func (cold *coldStore) objectName(key string, first int64) string {
+	return fmt.Sprintf("%v%v/%020d.jsonl", cold.options.Prefix, url.PathEscape(key), first)
+}
+
+// headName gets the name of the object recording how far a stream is archived.
+func (cold *coldStore) headName(key string) string {
+	return fmt.Sprintf("%v%v/head", cold.options.Prefix, url.PathEscape(key))
+}
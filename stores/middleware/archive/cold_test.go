@@ -0,0 +1,210 @@
+package archive
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+)
+
+// hotDriver is a key-value driver that supports pruning, standing in for a
+// hot store such as MongoDB.
+type hotDriver struct {
+	lock    sync.Mutex
+	streams map[string][]keyvalue.KeyedEvent
+}
+
+func newHotStore() (*hotDriver, eventsourcing.EventStore) {
+	driver := &hotDriver{
+		streams: make(map[string][]keyvalue.KeyedEvent),
+	}
+
+	return driver, keyvalue.NewStore(keyvalue.Options{
+		CheckSequence: driver.checkExists,
+		FetchEvents:   driver.fetchEvents,
+		PutEvents:     driver.putEvents,
+		PruneEvents:   driver.pruneEvents,
+	})
+}
+
+func (driver *hotDriver) checkExists(key string, seq int64) (bool, error) {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	for _, event := range driver.streams[key] {
+		if event.Sequence == seq {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (driver *hotDriver) fetchEvents(key string, seq int64) ([]keyvalue.KeyedEvent, error) {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	result := []keyvalue.KeyedEvent{}
+	for _, event := range driver.streams[key] {
+		if event.Sequence > seq {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+func (driver *hotDriver) putEvents(events []keyvalue.KeyedEvent) error {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	for _, event := range events {
+		stream := driver.streams[event.Key]
+		if len(stream) > 0 && stream[len(stream)-1].Sequence >= event.Sequence {
+			return eventsourcing.NewConcurrencyFault(event.Key, event.Sequence)
+		}
+		driver.streams[event.Key] = append(stream, event)
+	}
+	return nil
+}
+
+func (driver *hotDriver) pruneEvents(key string, snapshot int64, policy eventsourcing.RetentionPolicy) (int64, error) {
+	driver.lock.Lock()
+	defer driver.lock.Unlock()
+	stream := driver.streams[key]
+	if len(stream) == 0 {
+		return 0, nil
+	}
+
+	horizon := policy.Horizon(snapshot, stream[len(stream)-1].Sequence)
+	kept := []keyvalue.KeyedEvent{}
+	for _, event := range stream {
+		if event.Sequence > horizon {
+			kept = append(kept, event)
+		}
+	}
+	driver.streams[key] = kept
+	return int64(len(stream) - len(kept)), nil
+}
+
+func coldProvider() (eventsourcing.EventStore, func(), error) {
+	_, hot := newHotStore()
+	store, errStore := NewColdStore(hot, ColdOptions{
+		Bucket: &memorySink{},
+	})
+	if errStore != nil {
+		return nil, nil, errStore
+	}
+
+	return store, func() {
+		store.Close()
+	}, nil
+}
+
+// TestColdStoreCompliance
+func TestColdStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Cold Storage", coldProvider)
+}
+
+// TestColdStoreOptions checks that cold storage requires a bucket and a hot store
+// that can be read.
+func TestColdStoreOptions(t *testing.T) {
+	_, hot := newHotStore()
+	_, errBucket := NewColdStore(hot, ColdOptions{})
+	assert.NotNil(t, errBucket)
+
+	_, errFold := NewColdStore(eventsourcing.NewMiddlewareWrapper(hot), ColdOptions{Bucket: &memorySink{}})
+	assert.NotNil(t, errFold, "Wrapped stores can't be read for archiving")
+}
+
+// TestColdStoreArchive checks that pruned events are archived, and are replayed
+// when an aggregate is rebuilt from the start of its stream.
+func TestColdStoreArchive(t *testing.T) {
+	driver, hot := newHotStore()
+	bucket := &memorySink{}
+	store, errStore := NewColdStore(hot, ColdOptions{
+		Bucket: bucket,
+		Prefix: "cold/",
+	})
+	require.Nil(t, errStore)
+	retention := store.(eventsourcing.RetentionStore)
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("cold-test", test.GetTestRegistry(), store)
+	for i := 0; i < 5; i++ {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	}
+	assert.Nil(t, agg.Commit())
+
+	// Events before the snapshot at 4 move to the archive
+	removed, errPrune := retention.Prune("cold-test", 4, eventsourcing.RetentionPolicy{})
+	assert.Nil(t, errPrune)
+	assert.Equal(t, int64(3), removed)
+	assert.Equal(t, 2, len(driver.streams["cold-test"]))
+	assert.Contains(t, bucket.objects, "cold/cold-test/00000000000000000001.jsonl")
+	assert.Equal(t, "3", string(bucket.objects["cold/cold-test/head"]))
+
+	// Later events move to a second object
+	for i := 0; i < 3; i++ {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	}
+	assert.Nil(t, agg.Commit())
+	removed, errPrune = retention.Prune("cold-test", 7, eventsourcing.RetentionPolicy{KeepEvents: 2})
+	assert.Nil(t, errPrune)
+	assert.Equal(t, int64(3), removed)
+	archived, errDecode := decodeObject(bucket.objects["cold/cold-test/00000000000000000004.jsonl"])
+	assert.Nil(t, errDecode)
+	assert.Equal(t, 3, len(archived))
+	assert.Equal(t, int64(6), archived[2].Sequence)
+
+	// Nothing more to archive
+	removed, errPrune = retention.Prune("cold-test", 7, eventsourcing.RetentionPolicy{KeepEvents: 2})
+	assert.Nil(t, errPrune)
+	assert.Equal(t, int64(0), removed)
+
+	// A full rebuild replays the archive and then the hot store
+	rebuilt := test.SimpleAggregate{}
+	rebuilt.Initialize("cold-test", test.GetTestRegistry(), store)
+	assert.Nil(t, rebuilt.Refresh())
+	assert.Equal(t, int64(8), rebuilt.SequenceNumber())
+	assert.Equal(t, 8, rebuilt.CurrentCount)
+
+	// Rebuilding from the hot store alone fails, since its events are gone
+	direct := test.SimpleAggregate{}
+	direct.Initialize("cold-test", test.GetTestRegistry(), hot)
+	assert.NotNil(t, direct.Refresh())
+
+	// Commits continue on from the hot store
+	rebuilt.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, rebuilt.Commit())
+	assert.Equal(t, 3, len(driver.streams["cold-test"]))
+}
+
+// TestColdStoreInterrupted checks that archiving is retried if the hot store
+// couldn't be pruned.
+func TestColdStoreInterrupted(t *testing.T) {
+	_, hot := newHotStore()
+	bucket := &memorySink{}
+	store, _ := NewColdStore(hot, ColdOptions{Bucket: bucket})
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("cold-retry", test.GetTestRegistry(), store)
+	for i := 0; i < 4; i++ {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	}
+	assert.Nil(t, agg.Commit())
+
+	bucket.fail = true
+	_, errPrune := store.(eventsourcing.RetentionStore).Prune("cold-retry", 4, eventsourcing.RetentionPolicy{})
+	assert.NotNil(t, errPrune)
+
+	bucket.fail = false
+	removed, errPrune := store.(eventsourcing.RetentionStore).Prune("cold-retry", 4, eventsourcing.RetentionPolicy{})
+	assert.Nil(t, errPrune)
+	assert.Equal(t, int64(3), removed)
+
+	rebuilt := test.SimpleAggregate{}
+	rebuilt.Initialize("cold-retry", test.GetTestRegistry(), store)
+	assert.Nil(t, rebuilt.Refresh())
+	assert.Equal(t, 4, rebuilt.CurrentCount)
+}
@@ -0,0 +1,26 @@
+module github.com/go-gadgets/eventsourcing/stores/middleware/archive
+
+go 1.24.0
+
+require (
+	github.com/aws/aws-sdk-go v1.55.5
+	github.com/go-gadgets/eventsourcing v0.0.0-00010101000000-000000000000
+	github.com/go-gadgets/eventsourcing/utilities/s3client v0.0.0-00010101000000-000000000000
+	github.com/satori/go.uuid v1.2.0
+	github.com/stretchr/testify v1.5.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/google/go-cmp v0.5.9 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/mitchellh/mapstructure v0.0.0-20180220230111-00c29f56e238 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v2 v2.3.0 // indirect
+)
+
+replace (
+	github.com/go-gadgets/eventsourcing => ../../..
+	github.com/go-gadgets/eventsourcing/utilities/s3client => ../../../utilities/s3client
+)
@@ -0,0 +1,235 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+)
+
+// DefaultMaxBatchEvents is the number of events buffered before a batch
+// is written, if no other limit is specified.
+const DefaultMaxBatchEvents = 1000
+
+// DefaultRetryInterval is the time waited before writing a batch again, once
+// writing it has failed.
+const DefaultRetryInterval = 5 * time.Second
+
+// Options configures the archive middleware.
+type Options struct {
+	Sink              Sink                 // Where archived batches are written
+	Prefix            string               // Prefix applied to all object names
+	MaxBatchEvents    int                  // Events buffered before a batch is written
+	MaxBufferedEvents int                  // Events held while the sink is failing before more are dropped, 10 batches by default
+	FlushInterval     time.Duration        // Maximum age of a batch, zero to disable
+	RetryInterval     time.Duration        // Wait before writing a failed batch again, DefaultRetryInterval by default
+	OnError           func(error)          // Called when a batch cannot be written, or events are dropped
+	Logger            eventsourcing.Logger // Logger for the default OnError, eventsourcing.DefaultLogger() by default
+	Clock             eventsourcing.Clock  // Source of time for the interval and object names, the system clock by default
+}
+
+// archiver holds the buffered events awaiting archival.
+type archiver struct {
+	options  Options
+	lock     sync.Mutex
+	buffer   *bytes.Buffer // Events awaiting the next batch
+	count    int           // Events in the buffer
+	flushing int           // Events in the batch being written
+	wake     chan struct{} // Signals the worker that a batch is full
+	stop     chan struct{}
+	stopped  sync.Once
+	done     chan struct{}
+}
+
+// Create a new archiving middleware. Committed events are appended to a
+// JSONL buffer and written to the sink as a single object by a background
+// worker, whilst refreshes continue to be served by the primary store.
+//
+// Commits never wait for the sink. Batches that fail to be written are kept
+// and written again after the retry interval, along with the events committed
+// since, up to MaxBufferedEvents. Events committed beyond that while the sink
+// is failing are dropped from the archive (but not the store), and reported
+// through OnError.
+func Create(options Options) (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
+	if options.MaxBatchEvents <= 0 {
+		options.MaxBatchEvents = DefaultMaxBatchEvents
+	}
+	if options.MaxBufferedEvents <= 0 {
+		options.MaxBufferedEvents = 10 * options.MaxBatchEvents
+	}
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = DefaultRetryInterval
+	}
+	if options.Logger == nil {
+		options.Logger = eventsourcing.DefaultLogger()
+	}
+	if options.OnError == nil {
+		logger := options.Logger
+		options.OnError = func(err error) {
+			logger.Error("archive_flush_error", eventsourcing.LogFields{"error": err})
+		}
+	}
+	if options.Clock == nil {
+		options.Clock = eventsourcing.SystemClock
+	}
+
+	archive := &archiver{
+		options: options,
+		buffer:  &bytes.Buffer{},
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go archive.run()
+
+	return archive.commit, func(reader eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+		// Reads always come from the primary store
+		return next()
+	}, archive.close
+}
+
+// commit archives events once the underlying store has accepted them.
+func (archive *archiver) commit(writer eventsourcing.StoreWriterAdapter, next eventsourcing.NextHandler) error {
+	if eventsourcing.IsNoOp(writer) {
+		return next()
+	}
+
+	key := writer.GetKey()
+	seq, events := writer.GetUncommittedEvents()
+	registry := writer.GetEventRegistry()
+
+	var metadata map[string]interface{}
+	if adapter, ok := writer.(eventsourcing.MetadataAdapter); ok {
+		metadata = adapter.GetEventMetadata()
+	}
+
+	errNext := next()
+	if errNext != nil {
+		return errNext
+	}
+
+	records := make([]keyvalue.KeyedEvent, len(events))
+	for index, event := range events {
+		eventType, found := registry.GetEventType(event)
+		if !found {
+			return fmt.Errorf("Could not find specified event type for %v (seq=%v)", key, seq+int64(1+index))
+		}
+		records[index] = keyvalue.KeyedEvent{
+			Key:       key,
+			Sequence:  seq + int64(1+index),
+			EventType: eventType,
+			EventData: event,
+			Metadata:  metadata,
+		}
+	}
+
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	for _, record := range records {
+		errEncode := encoder.Encode(record)
+		if errEncode != nil {
+			return errEncode
+		}
+	}
+
+	archive.lock.Lock()
+	held := archive.count + archive.flushing
+	if held+len(records) > archive.options.MaxBufferedEvents {
+		archive.lock.Unlock()
+		archive.options.OnError(fmt.Errorf("archive: dropped %v events of %v at %v, %v events are already waiting to be written", len(records), key, seq+1, held))
+		return nil
+	}
+
+	archive.buffer.Write(encoded.Bytes())
+	archive.count += len(records)
+	full := archive.count >= archive.options.MaxBatchEvents
+	archive.lock.Unlock()
+
+	if full {
+		select {
+		case archive.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// run writes a batch whenever one fills, and on the configured interval,
+// waiting for the retry interval after a batch fails to be written.
+func (archive *archiver) run() {
+	defer close(archive.done)
+
+	var tick <-chan time.Time
+	if archive.options.FlushInterval > 0 {
+		ticker := archive.options.Clock.NewTicker(archive.options.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C()
+	}
+
+	retry := false
+	for {
+		if retry {
+			select {
+			case <-archive.stop:
+				return
+			case <-archive.options.Clock.After(archive.options.RetryInterval):
+			}
+		} else {
+			select {
+			case <-archive.stop:
+				return
+			case <-archive.wake:
+			case <-tick:
+			}
+		}
+
+		errFlush := archive.flush()
+		if errFlush != nil {
+			archive.options.OnError(errFlush)
+		}
+		retry = errFlush != nil
+	}
+}
+
+// flush writes the buffered events to the sink. The lock is not held while
+// writing, so commits carry on buffering events. If the write fails the batch
+// is put back ahead of the events buffered since, to be written next time.
+func (archive *archiver) flush() error {
+	archive.lock.Lock()
+	batch, count := archive.buffer, archive.count
+	if count == 0 {
+		archive.lock.Unlock()
+		return nil
+	}
+	archive.buffer, archive.count, archive.flushing = &bytes.Buffer{}, 0, count
+	archive.lock.Unlock()
+
+	now := archive.options.Clock.Now().UTC()
+	name := fmt.Sprintf("%v%v/%v-%v.jsonl", archive.options.Prefix, now.Format("2006/01/02"), now.UnixNano(), uuid.NewV4())
+	errPut := archive.options.Sink.PutObject(name, batch.Bytes())
+
+	archive.lock.Lock()
+	defer archive.lock.Unlock()
+	archive.flushing = 0
+	if errPut != nil {
+		batch.Write(archive.buffer.Bytes())
+		archive.buffer, archive.count = batch, archive.count+count
+	}
+	return errPut
+}
+
+// close stops the worker and writes any remaining events.
+func (archive *archiver) close() error {
+	archive.stopped.Do(func() {
+		close(archive.stop)
+	})
+	<-archive.done
+	return archive.flush()
+}
@@ -0,0 +1,302 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/simclock"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+)
+
+// memorySink records the objects written to it.
+type memorySink struct {
+	lock    sync.Mutex
+	objects map[string][]byte
+	fail    bool
+	hold    chan struct{} // Writes wait for this to close, if set
+}
+
+func (sink *memorySink) PutObject(name string, body []byte) error {
+	if sink.hold != nil {
+		<-sink.hold
+	}
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if sink.fail {
+		return assert.AnError
+	}
+	if sink.objects == nil {
+		sink.objects = make(map[string][]byte)
+	}
+	sink.objects[name] = append([]byte(nil), body...)
+	return nil
+}
+
+func (sink *memorySink) GetObject(name string) ([]byte, error) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	body, found := sink.objects[name]
+	if !found {
+		return nil, ErrObjectNotFound
+	}
+	return body, nil
+}
+
+// failing sets whether writes fail
+func (sink *memorySink) failing(fail bool) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.fail = fail
+}
+
+// count gets the number of objects written
+func (sink *memorySink) count() int {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	return len(sink.objects)
+}
+
+func (sink *memorySink) records(t *testing.T) []keyvalue.KeyedEvent {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	result := []keyvalue.KeyedEvent{}
+	for _, body := range sink.objects {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			record := keyvalue.KeyedEvent{}
+			assert.Nil(t, json.Unmarshal(scanner.Bytes(), &record))
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+func provider() (eventsourcing.EventStore, func(), error) {
+	base := memory.NewStore()
+	wrapped := eventsourcing.NewMiddlewareWrapper(base)
+	wrapped.Use(Create(Options{
+		Sink:              &memorySink{},
+		MaxBatchEvents:    10,
+		MaxBufferedEvents: 1000,
+	}))
+
+	return wrapped, func() {
+		wrapped.Close()
+	}, nil
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Archive Middleware", provider)
+}
+
+// TestArchiveBatches checks that committed events are written in batches,
+// and that remaining events are written on close.
+func TestArchiveBatches(t *testing.T) {
+	sink := &memorySink{}
+	wrapped := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	wrapped.Use(Create(Options{
+		Sink:           sink,
+		Prefix:         "events/",
+		MaxBatchEvents: 3,
+	}))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("archive-test", test.GetTestRegistry(), wrapped)
+	for i := 0; i < 3; i++ {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+		assert.Nil(t, agg.Commit())
+	}
+	assert.True(t, test.WaitFor(func() bool { return sink.count() == 1 }), "A single batch should have been written")
+
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+
+	assert.Nil(t, wrapped.Close())
+	assert.Equal(t, 2, sink.count(), "Remaining events should be written on close")
+
+	records := sink.records(t)
+	assert.Equal(t, 4, len(records))
+	for name, record := range sink.objects {
+		assert.True(t, strings.HasPrefix(name, "events/"))
+		assert.True(t, strings.HasSuffix(name, ".jsonl"))
+		assert.NotEmpty(t, record)
+	}
+	for _, record := range records {
+		assert.Equal(t, "archive-test", record.Key)
+		assert.Equal(t, eventsourcing.EventType("IncrementEvent"), record.EventType)
+	}
+}
+
+// TestArchiveRetry checks that failed batches are written again after the retry
+// interval, without failing the commit.
+func TestArchiveRetry(t *testing.T) {
+	sink := &memorySink{fail: true}
+	clock := simclock.New(time.Unix(1000, 0))
+	failures := make(chan error, 10)
+	wrapped := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	wrapped.Use(Create(Options{
+		Sink:           sink,
+		MaxBatchEvents: 1,
+		OnError:        func(err error) { failures <- err },
+		Clock:          clock,
+	}))
+	defer wrapped.Close()
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("archive-retry", test.GetTestRegistry(), wrapped)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit(), "Archive failures should not fail the commit")
+	assert.Equal(t, assert.AnError, <-failures)
+
+	// Commits made while waiting to retry are written with the failed batch
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+	sink.failing(false)
+	clock.BlockUntil(1)
+	clock.Advance(DefaultRetryInterval)
+	assert.True(t, test.WaitFor(func() bool { return len(sink.records(t)) == 2 }), "The failed batch should be retried")
+	assert.Equal(t, 1, sink.count())
+}
+
+// TestArchiveDoesNotBlock checks that commits don't wait for batches to be written,
+// and that events beyond the buffer limit are dropped and reported.
+func TestArchiveDoesNotBlock(t *testing.T) {
+	sink := &memorySink{hold: make(chan struct{})}
+	dropped := make(chan error, 10)
+	wrapped := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	wrapped.Use(Create(Options{
+		Sink:              sink,
+		MaxBatchEvents:    1,
+		MaxBufferedEvents: 3,
+		OnError:           func(err error) { dropped <- err },
+	}))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("archive-held", test.GetTestRegistry(), wrapped)
+	for i := 0; i < 5; i++ {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+		assert.Nil(t, agg.Commit(), "Commits should not wait for the sink")
+	}
+	assert.Len(t, dropped, 2)
+	assert.Contains(t, (<-dropped).Error(), "dropped 1 events of archive-held at 4")
+
+	close(sink.hold)
+	assert.Nil(t, wrapped.Close())
+	assert.Equal(t, 3, len(sink.records(t)))
+}
+
+// TestArchiveInterval checks that batches are written on the timer.
+func TestArchiveInterval(t *testing.T) {
+	sink := &memorySink{}
+	wrapped := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	wrapped.Use(Create(Options{
+		Sink:          sink,
+		FlushInterval: 10 * time.Millisecond,
+	}))
+	defer wrapped.Close()
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("archive-interval", test.GetTestRegistry(), wrapped)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+
+	deadline := time.Now().Add(time.Second)
+	for len(sink.records(t)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, 1, len(sink.records(t)))
+}
+
+// TestFileSink checks batches are written beneath the directory
+func TestFileSink(t *testing.T) {
+	directory, errTemp := ioutil.TempDir("", "archive")
+	assert.Nil(t, errTemp)
+	defer os.RemoveAll(directory)
+
+	sink := NewFileSink(directory)
+	assert.Nil(t, sink.PutObject("a/b/batch.jsonl", []byte("{}\n")))
+
+	data, errRead := ioutil.ReadFile(filepath.Join(directory, "a", "b", "batch.jsonl"))
+	assert.Nil(t, errRead)
+	assert.Equal(t, "{}\n", string(data))
+
+	bucket := NewFileBucket(directory)
+	data, errGet := bucket.GetObject("a/b/batch.jsonl")
+	assert.Nil(t, errGet)
+	assert.Equal(t, "{}\n", string(data))
+
+	_, errMissing := bucket.GetObject("a/b/missing.jsonl")
+	assert.Equal(t, ErrObjectNotFound, errMissing)
+}
+
+// TestS3Sink checks that objects are written as signed PUT requests
+func TestS3Sink(t *testing.T) {
+	var path, auth, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		path, auth, body = r.URL.Path, r.Header.Get("Authorization"), string(data)
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	session, errSession := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	require.Nil(t, errSession)
+
+	sink := NewS3Sink(session, "bucket")
+	assert.Nil(t, sink.PutObject("events/batch.jsonl", []byte("{}\n")))
+	assert.Equal(t, "/bucket/events/batch.jsonl", path)
+	assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=id/"))
+	assert.Equal(t, "{}\n", body)
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	assert.NotNil(t, sink.PutObject("events/batch.jsonl", []byte("{}\n")))
+
+	// Objects can be read back from a bucket
+	bucket := NewS3Bucket(session, "bucket")
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		switch {
+		case r.Method != http.MethodGet:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case strings.HasSuffix(r.URL.Path, "missing.jsonl"):
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Write([]byte("{}\n"))
+		}
+	})
+	data, errGet := bucket.GetObject("events/batch.jsonl")
+	assert.Nil(t, errGet)
+	assert.Equal(t, "/bucket/events/batch.jsonl", path)
+	assert.Equal(t, "{}\n", string(data))
+
+	_, errMissing := bucket.GetObject("events/missing.jsonl")
+	assert.Equal(t, ErrObjectNotFound, errMissing)
+}
@@ -0,0 +1,79 @@
+package archive
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/go-gadgets/eventsourcing/utilities/s3client"
+)
+
+// s3Sink writes batches to an S3 bucket using signed PUT requests.
+type s3Sink struct {
+	objects *s3client.Client
+}
+
+// NewS3Sink creates a sink that writes each batch as an object within the
+// specified bucket. Credentials, region, endpoint and HTTP client are taken
+// from the session. If the session specifies an endpoint (i.e. for a local
+// S3-compatible server) path-style addressing is used.
+func NewS3Sink(session *session.Session, bucket string) Sink {
+	return NewS3Bucket(session, bucket)
+}
+
+// NewS3Bucket creates a bucket that reads and writes objects within the
+// specified S3 bucket, configured as for NewS3Sink.
+func NewS3Bucket(session *session.Session, bucket string) Bucket {
+	return &s3Sink{
+		objects: s3client.New(session, bucket),
+	}
+}
+
+// NewS3SinkFromEnvironment creates a sink for the specified bucket, using
+// the default session configuration from the environment.
+func NewS3SinkFromEnvironment(bucket string) (Sink, error) {
+	session, errSession := session.NewSession()
+	if errSession != nil {
+		return nil, errSession
+	}
+
+	return NewS3Sink(session, bucket), nil
+}
+
+// PutObject writes the batch to the bucket.
+func (sink *s3Sink) PutObject(name string, body []byte) error {
+	response, errPut := sink.objects.Do(http.MethodPut, name, body, map[string]string{
+		"Content-Type": "application/x-ndjson",
+	})
+	if errPut != nil {
+		return errPut
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		detail, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("archive: put %v/%v failed with status %v: %s", sink.objects.Bucket(), name, response.StatusCode, detail)
+	}
+
+	return nil
+}
+
+// GetObject reads an object from the bucket.
+func (sink *s3Sink) GetObject(name string) ([]byte, error) {
+	response, errGet := sink.objects.Do(http.MethodGet, name, nil, nil)
+	if errGet != nil {
+		return nil, errGet
+	}
+	defer response.Body.Close()
+
+	body, errRead := ioutil.ReadAll(response.Body)
+	if response.StatusCode == http.StatusNotFound {
+		return nil, ErrObjectNotFound
+	}
+	if response.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("archive: get %v/%v failed with status %v: %s", sink.objects.Bucket(), name, response.StatusCode, body)
+	}
+
+	return body, errRead
+}
@@ -0,0 +1,81 @@
+package archive
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Sink is a destination that archived batches are written to.
+type Sink interface {
+	// PutObject writes a named object containing a batch of events.
+	PutObject(name string, body []byte) error
+}
+
+// Bucket is a sink that objects can also be read back from, allowing archived
+// events to be replayed.
+type Bucket interface {
+	Sink
+
+	// GetObject reads a named object, returning ErrObjectNotFound if it doesn't
+	// exist.
+	GetObject(name string) ([]byte, error)
+}
+
+// ErrObjectNotFound is returned when reading an object that doesn't exist.
+var ErrObjectNotFound = errors.New("archive: object not found")
+
+// SinkFunc adapts a function into a Sink.
+type SinkFunc func(name string, body []byte) error
+
+// PutObject calls the underlying function
+func (fn SinkFunc) PutObject(name string, body []byte) error {
+	return fn(name, body)
+}
+
+// fileSink writes batches to a local directory.
+type fileSink struct {
+	directory string
+}
+
+// NewFileSink creates a sink that writes batches beneath a local directory,
+// which is useful for development or for shipping with external tooling.
+func NewFileSink(directory string) Sink {
+	return NewFileBucket(directory)
+}
+
+// NewFileBucket creates a bucket that reads and writes objects beneath a local
+// directory.
+func NewFileBucket(directory string) Bucket {
+	return &fileSink{
+		directory: directory,
+	}
+}
+
+// PutObject writes the batch to a file, creating directories as required.
+func (sink *fileSink) PutObject(name string, body []byte) error {
+	target := filepath.Join(sink.directory, filepath.FromSlash(name))
+	errDir := os.MkdirAll(filepath.Dir(target), 0755)
+	if errDir != nil {
+		return errDir
+	}
+
+	// Write to a temporary file first, so readers never see partial batches
+	temp := target + ".tmp"
+	errWrite := ioutil.WriteFile(temp, body, 0644)
+	if errWrite != nil {
+		return errWrite
+	}
+
+	return os.Rename(temp, target)
+}
+
+// GetObject reads an object from its file.
+func (sink *fileSink) GetObject(name string) ([]byte, error) {
+	body, errRead := ioutil.ReadFile(filepath.Join(sink.directory, filepath.FromSlash(name)))
+	if os.IsNotExist(errRead) {
+		return nil, ErrObjectNotFound
+	}
+	return body, errRead
+}
@@ -0,0 +1,229 @@
+/*
+Package circuitbreaker contains a middleware that stops calling a failing store
+for a while, so that callers such as HTTP handlers fail fast with an
+eventsourcing.StoreUnavailableFault rather than piling up behind a dying backend.
+
+The breaker counts the commits and refreshes that fail over a window. Once enough
+calls have been made, and the fraction that failed reaches the failure rate, the
+breaker opens and rejects every call until the cooldown has passed. A single
+trial call is then let through: if it succeeds the breaker closes again,
+otherwise it stays open for another cooldown.
+
+	breaker := circuitbreaker.NewBreaker(circuitbreaker.Options{})
+	store.Use(breaker.Middleware())
+*/
+package circuitbreaker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// Defaults for the options of a breaker.
+const (
+	DefaultFailureRate  = 0.5              // Fraction of calls that must fail to open the breaker
+	DefaultMinimumCalls = 10               // Calls in a window before the failure rate is considered
+	DefaultWindow       = 10 * time.Second // Period that failures are counted over
+	DefaultCooldown     = 5 * time.Second  // Time the breaker stays open before a trial call
+)
+
+// State is the state of a breaker.
+type State int
+
+// States of a breaker.
+const (
+	Closed   State = iota // Calls are made, and failures are counted
+	Open                  // Calls are rejected until the cooldown passes
+	HalfOpen              // A trial call is being made
+)
+
+// String gets the name of the state.
+func (state State) String() string {
+	switch state {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// Options configures a breaker.
+type Options struct {
+	FailureRate   float64              // Fraction of failed calls that opens the breaker, DefaultFailureRate by default
+	MinimumCalls  int                  // Calls in a window before the rate is considered, DefaultMinimumCalls by default
+	Window        time.Duration        // Period failures are counted over, DefaultWindow by default
+	Cooldown      time.Duration        // Time the breaker stays open, DefaultCooldown by default
+	IsFailure     func(error) bool     // Decides which errors count as failures, unexpected faults by default
+	OnStateChange func(from, to State) // Called when the breaker changes state, if set, and must not call the breaker
+	Clock         eventsourcing.Clock  // Source of time, the system clock by default
+}
+
+// Breaker is a circuit breaker that can be shared by the middleware of several
+// stores on the same backend.
+type Breaker struct {
+	options     Options
+	lock        sync.Mutex
+	state       State
+	windowStart time.Time // Start of the current counting window
+	calls       int       // Calls completed in the window
+	failures    int       // Calls that failed in the window
+	openedAt    time.Time // Time the breaker last opened
+	reason      string    // Last failure, reported in faults
+	trial       bool      // True while a trial call is in progress
+}
+
+// NewBreaker creates a closed circuit breaker.
+func NewBreaker(options Options) *Breaker {
+	if options.FailureRate <= 0 {
+		options.FailureRate = DefaultFailureRate
+	}
+	if options.MinimumCalls <= 0 {
+		options.MinimumCalls = DefaultMinimumCalls
+	}
+	if options.Window <= 0 {
+		options.Window = DefaultWindow
+	}
+	if options.Cooldown <= 0 {
+		options.Cooldown = DefaultCooldown
+	}
+	if options.IsFailure == nil {
+		options.IsFailure = func(err error) bool {
+			return !eventsourcing.IsExpectedFault(err)
+		}
+	}
+	if options.Clock == nil {
+		options.Clock = eventsourcing.SystemClock
+	}
+
+	return &Breaker{
+		options:     options,
+		windowStart: options.Clock.Now(),
+	}
+}
+
+// Create a new circuit breaker middleware, with a breaker of its own.
+func Create(options Options) (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
+	return NewBreaker(options).Middleware()
+}
+
+// Middleware creates a middleware that guards commits and refreshes with the breaker.
+func (breaker *Breaker) Middleware() (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
+	return func(writer eventsourcing.StoreWriterAdapter, next eventsourcing.NextHandler) error {
+			return breaker.Call(next)
+		}, func(reader eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+			return breaker.Call(next)
+		}, nil
+}
+
+// State gets the current state of the breaker, i.e. for health checks.
+func (breaker *Breaker) State() State {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	return breaker.state
+}
+
+// Call runs an operation if the breaker allows it, recording the outcome. Calls
+// rejected by the breaker fail with an eventsourcing.StoreUnavailableFault.
+func (breaker *Breaker) Call(body func() error) error {
+	errAllow := breaker.allow()
+	if errAllow != nil {
+		return errAllow
+	}
+
+	err := body()
+	breaker.record(err)
+	return err
+}
+
+// allow determines if a call can be made, moving an open breaker to half-open
+// once the cooldown has passed.
+func (breaker *Breaker) allow() error {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	now := breaker.options.Clock.Now()
+	switch breaker.state {
+	case Open:
+		remaining := breaker.openedAt.Add(breaker.options.Cooldown).Sub(now)
+		if remaining > 0 {
+			return eventsourcing.NewStoreUnavailableFault(breaker.reason, remaining)
+		}
+		breaker.change(HalfOpen)
+		breaker.trial = true
+		return nil
+	case HalfOpen:
+		if breaker.trial {
+			return eventsourcing.NewStoreUnavailableFault(breaker.reason, breaker.options.Cooldown)
+		}
+		breaker.trial = true
+		return nil
+	}
+
+	if now.Sub(breaker.windowStart) >= breaker.options.Window {
+		breaker.windowStart = now
+		breaker.calls = 0
+		breaker.failures = 0
+	}
+	return nil
+}
+
+// record counts the outcome of a call, opening or closing the breaker.
+func (breaker *Breaker) record(err error) {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	failed := err != nil && breaker.options.IsFailure(err)
+	if failed {
+		breaker.reason = err.Error()
+	}
+
+	if breaker.state == HalfOpen {
+		breaker.trial = false
+		if failed {
+			breaker.open()
+			return
+		}
+		breaker.reset()
+		breaker.change(Closed)
+		return
+	}
+
+	if breaker.state != Closed {
+		return
+	}
+
+	breaker.calls++
+	if failed {
+		breaker.failures++
+	}
+	if breaker.calls >= breaker.options.MinimumCalls && float64(breaker.failures) >= breaker.options.FailureRate*float64(breaker.calls) {
+		breaker.open()
+	}
+}
+
+// open opens the breaker. The lock must be held.
+func (breaker *Breaker) open() {
+	breaker.openedAt = breaker.options.Clock.Now()
+	breaker.change(Open)
+}
+
+// reset starts a new counting window. The lock must be held.
+func (breaker *Breaker) reset() {
+	breaker.windowStart = breaker.options.Clock.Now()
+	breaker.calls = 0
+	breaker.failures = 0
+}
+
+// change moves the breaker to a new state. The lock must be held.
+func (breaker *Breaker) change(state State) {
+	from := breaker.state
+	breaker.state = state
+	if breaker.options.OnStateChange != nil && from != state {
+		breaker.options.OnStateChange(from, state)
+	}
+}
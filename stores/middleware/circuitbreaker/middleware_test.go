@@ -0,0 +1,171 @@
+package circuitbreaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/simclock"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+)
+
+func provider() (eventsourcing.EventStore, func(), error) {
+	base := memory.NewStore()
+	wrapped := eventsourcing.NewMiddlewareWrapper(base)
+	wrapped.Use(Create(Options{}))
+
+	return wrapped, func() {
+		wrapped.Close()
+	}, nil
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Circuit Breaker Middleware", provider)
+}
+
+// flakyStore is a store that fails with an error while set, counting the calls
+// that reach it.
+type flakyStore struct {
+	eventsourcing.EventStore
+	err   error
+	calls int
+}
+
+func (store *flakyStore) Refresh(loader eventsourcing.StoreLoaderAdapter) error {
+	store.calls++
+	if store.err != nil {
+		return store.err
+	}
+	return store.EventStore.Refresh(loader)
+}
+
+// setup creates a store guarded by a breaker on a virtual clock.
+func setup(options Options) (*flakyStore, *Breaker, *simclock.Clock, func() error) {
+	clock := simclock.New(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	options.Clock = clock
+	options.MinimumCalls = 4
+	breaker := NewBreaker(options)
+
+	flaky := &flakyStore{EventStore: memory.NewStore()}
+	wrapped := eventsourcing.NewMiddlewareWrapper(flaky)
+	wrapped.Use(breaker.Middleware())
+
+	refresh := func() error {
+		agg := test.SimpleAggregate{}
+		agg.Initialize("breaker-key", test.GetTestRegistry(), wrapped)
+		return agg.Refresh()
+	}
+	return flaky, breaker, clock, refresh
+}
+
+// TestTrips checks the breaker opens once the failure rate is reached, and then
+// fails fast without calling the store.
+func TestTrips(t *testing.T) {
+	changes := []State{}
+	flaky, breaker, clock, refresh := setup(Options{
+		Cooldown: time.Minute,
+		OnStateChange: func(from, to State) {
+			changes = append(changes, to)
+		},
+	})
+
+	assert.Nil(t, refresh())
+	assert.Nil(t, refresh())
+	flaky.err = errors.New("no reachable servers")
+	assert.Equal(t, flaky.err, refresh())
+	assert.Equal(t, Closed, breaker.State())
+	assert.Equal(t, flaky.err, refresh())
+	assert.Equal(t, Open, breaker.State())
+
+	clock.Advance(20 * time.Second)
+	errRefresh := refresh()
+	unavailable, fault := eventsourcing.IsStoreUnavailableFault(errRefresh)
+	assert.True(t, unavailable)
+	assert.Equal(t, "no reachable servers", fault.Reason)
+	assert.Equal(t, 40*time.Second, fault.RetryAfter)
+	assert.Equal(t, 4, flaky.calls)
+	assert.Equal(t, []State{Open}, changes)
+}
+
+// TestRecovers checks a trial call is made after the cooldown, which closes the
+// breaker if it succeeds and reopens it if not.
+func TestRecovers(t *testing.T) {
+	flaky, breaker, clock, refresh := setup(Options{Cooldown: time.Minute})
+	flaky.err = errors.New("no reachable servers")
+	for attempt := 0; attempt < 4; attempt++ {
+		refresh()
+	}
+	assert.Equal(t, Open, breaker.State())
+
+	// The trial fails, so the breaker reopens
+	clock.Advance(time.Minute)
+	assert.Equal(t, flaky.err, refresh())
+	assert.Equal(t, Open, breaker.State())
+	unavailable, _ := eventsourcing.IsStoreUnavailableFault(refresh())
+	assert.True(t, unavailable)
+
+	// The trial succeeds, so the breaker closes
+	flaky.err = nil
+	clock.Advance(time.Minute)
+	assert.Nil(t, refresh())
+	assert.Equal(t, Closed, breaker.State())
+	assert.Nil(t, refresh())
+	assert.Equal(t, 7, flaky.calls)
+}
+
+// TestHalfOpenSingleTrial checks only one trial call is made at a time.
+func TestHalfOpenSingleTrial(t *testing.T) {
+	clock := simclock.New(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	breaker := NewBreaker(Options{MinimumCalls: 1, Cooldown: time.Minute, Clock: clock})
+	assert.NotNil(t, breaker.Call(func() error { return errors.New("failed") }))
+
+	clock.Advance(time.Minute)
+	errTrial := breaker.Call(func() error {
+		assert.Equal(t, HalfOpen, breaker.State())
+		unavailable, _ := eventsourcing.IsStoreUnavailableFault(breaker.Call(func() error { return nil }))
+		assert.True(t, unavailable)
+		return nil
+	})
+	assert.Nil(t, errTrial)
+	assert.Equal(t, Closed, breaker.State())
+}
+
+// TestExpectedFaultsIgnored checks concurrency faults don't open the breaker.
+func TestExpectedFaultsIgnored(t *testing.T) {
+	flaky, breaker, _, refresh := setup(Options{})
+	flaky.err = eventsourcing.NewConcurrencyFault("breaker-key", 1)
+	for attempt := 0; attempt < 10; attempt++ {
+		refresh()
+	}
+	assert.Equal(t, Closed, breaker.State())
+}
+
+// TestWindow checks failures are only counted within a window.
+func TestWindow(t *testing.T) {
+	flaky, breaker, clock, refresh := setup(Options{Window: time.Minute})
+	flaky.err = errors.New("timeout")
+	for attempt := 0; attempt < 3; attempt++ {
+		refresh()
+	}
+	clock.Advance(time.Minute)
+	for attempt := 0; attempt < 3; attempt++ {
+		refresh()
+	}
+	assert.Equal(t, Closed, breaker.State())
+
+	refresh()
+	assert.Equal(t, Open, breaker.State())
+}
+
+// TestStateNames checks states are named.
+func TestStateNames(t *testing.T) {
+	assert.Equal(t, "closed", Closed.String())
+	assert.Equal(t, "open", Open.String())
+	assert.Equal(t, "half-open", HalfOpen.String())
+	assert.Equal(t, "unknown", State(9).String())
+}
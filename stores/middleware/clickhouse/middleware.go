@@ -0,0 +1,309 @@
+/*
+Package clickhouse contains a write-only middleware that mirrors every committed event
+into a ClickHouse table, so that event history can be analysed without querying the
+operational store. Events are inserted in batches by a background worker using the
+ClickHouse HTTP interface, into a table such as:
+
+	CREATE TABLE events (
+		domain       String,
+		key          String,
+		sequence     Int64,
+		event_type   String,
+		committed_at DateTime64(3),
+		data         String,
+		metadata     String
+	) ENGINE = MergeTree ORDER BY (domain, key, sequence)
+
+The data and metadata columns hold JSON, which can be queried with the JSONExtract
+functions. If ClickHouse falls behind or is unavailable, events are held in memory up
+to MaxPendingEvents, after which commits block until there is room: this slows down
+writers rather than losing events or exhausting memory.
+*/
+package clickhouse
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// DefaultMaxBatchEvents is the number of events inserted per batch, if no other
+// limit is specified.
+const DefaultMaxBatchEvents = 1000
+
+// DefaultFlushInterval is the longest an event waits to be inserted, if no other
+// interval is specified.
+const DefaultFlushInterval = time.Second
+
+// errClosed is returned by commits once the middleware has been closed
+var errClosed = fmt.Errorf("clickhouse: middleware is closed")
+
+// Options configures the ClickHouse middleware.
+type Options struct {
+	URL              string               // URL of the ClickHouse HTTP interface, i.e. http://localhost:8123
+	Database         string               // Database containing the table
+	Table            string               // Table to insert events into
+	Username         string               // Username, if authentication is required
+	Password         string               // Password, if authentication is required
+	MaxBatchEvents   int                  // Events per insert
+	MaxPendingEvents int                  // Events held before commits block, defaults to 10 batches
+	FlushInterval    time.Duration        // Longest time an event waits to be inserted
+	Client           *http.Client         // HTTP client, defaults to http.DefaultClient
+	OnError          func(error)          // Called when a batch cannot be inserted
+	Logger           eventsourcing.Logger // Logger for the default OnError, eventsourcing.DefaultLogger() by default
+	Clock            eventsourcing.Clock  // Source of time for the interval and commit times, the system clock by default
+}
+
+// row is a single event, as inserted into ClickHouse
+type row struct {
+	Domain      string `json:"domain"`
+	Key         string `json:"key"`
+	Sequence    int64  `json:"sequence"`
+	EventType   string `json:"event_type"`
+	CommittedAt string `json:"committed_at"`
+	Data        string `json:"data"`
+	Metadata    string `json:"metadata"`
+}
+
+// mirror holds the events awaiting insertion
+type mirror struct {
+	options Options
+	lock    sync.Mutex
+	space   *sync.Cond    // Signalled when pending events are inserted
+	pending []row         // Events awaiting insertion, oldest first
+	closed  bool          // Set once closing
+	wake    chan struct{} // Signals the worker that a batch is ready
+	stop    chan struct{} // Signals the worker to stop
+	done    chan struct{} // Closed when the worker has stopped
+	errLast error         // Last insert error from the final flush
+}
+
+// Create a new ClickHouse mirroring middleware. Events are queued once the
+// underlying store accepts them, and inserted in the background.
+func Create(options Options) (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
+	if options.MaxBatchEvents <= 0 {
+		options.MaxBatchEvents = DefaultMaxBatchEvents
+	}
+	if options.MaxPendingEvents <= 0 {
+		options.MaxPendingEvents = 10 * options.MaxBatchEvents
+	}
+	if options.MaxPendingEvents < options.MaxBatchEvents {
+		options.MaxPendingEvents = options.MaxBatchEvents
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultFlushInterval
+	}
+	if options.Client == nil {
+		options.Client = http.DefaultClient
+	}
+	if options.Logger == nil {
+		options.Logger = eventsourcing.DefaultLogger()
+	}
+	if options.OnError == nil {
+		logger := options.Logger
+		options.OnError = func(err error) {
+			logger.Error("clickhouse_insert_error", eventsourcing.LogFields{"error": err})
+		}
+	}
+	if options.Clock == nil {
+		options.Clock = eventsourcing.SystemClock
+	}
+
+	instance := &mirror{
+		options: options,
+		pending: make([]row, 0),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	instance.space = sync.NewCond(&instance.lock)
+	go instance.run()
+
+	return instance.commit, func(reader eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+		// Reads always come from the primary store
+		return next()
+	}, instance.close
+}
+
+// commit queues events once the underlying store has accepted them.
+func (instance *mirror) commit(writer eventsourcing.StoreWriterAdapter, next eventsourcing.NextHandler) error {
+	if eventsourcing.IsNoOp(writer) {
+		return next()
+	}
+
+	key := writer.GetKey()
+	seq, events := writer.GetUncommittedEvents()
+	registry := writer.GetEventRegistry()
+
+	metadata := []byte("{}")
+	if adapter, ok := writer.(eventsourcing.MetadataAdapter); ok && adapter.GetEventMetadata() != nil {
+		encoded, errMetadata := json.Marshal(adapter.GetEventMetadata())
+		if errMetadata != nil {
+			return errMetadata
+		}
+		metadata = encoded
+	}
+
+	errNext := next()
+	if errNext != nil {
+		return errNext
+	}
+
+	committedAt := instance.options.Clock.Now().UTC().Format("2006-01-02 15:04:05.000")
+	rows := make([]row, len(events))
+	for index, event := range events {
+		eventType, found := registry.GetEventType(event)
+		if !found {
+			return fmt.Errorf("Could not find specified event type for %v (seq=%v)", key, seq+int64(1+index))
+		}
+
+		data, errData := json.Marshal(event)
+		if errData != nil {
+			return errData
+		}
+
+		rows[index] = row{
+			Domain:      registry.Domain(),
+			Key:         key,
+			Sequence:    seq + int64(1+index),
+			EventType:   string(eventType),
+			CommittedAt: committedAt,
+			Data:        string(data),
+			Metadata:    string(metadata),
+		}
+	}
+
+	return instance.enqueue(rows)
+}
+
+// enqueue adds rows to the pending events, blocking while the queue is full.
+func (instance *mirror) enqueue(rows []row) error {
+	instance.lock.Lock()
+	defer instance.lock.Unlock()
+
+	for len(instance.pending) >= instance.options.MaxPendingEvents && !instance.closed {
+		instance.space.Wait()
+	}
+	if instance.closed {
+		return errClosed
+	}
+
+	instance.pending = append(instance.pending, rows...)
+	if len(instance.pending) >= instance.options.MaxBatchEvents {
+		select {
+		case instance.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// run inserts batches when they fill, or on the flush interval.
+func (instance *mirror) run() {
+	defer close(instance.done)
+	ticker := instance.options.Clock.NewTicker(instance.options.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-instance.stop:
+			instance.errLast = instance.flush()
+			return
+		case <-instance.wake:
+		case <-ticker.C():
+		}
+
+		errFlush := instance.flush()
+		if errFlush != nil {
+			instance.options.OnError(errFlush)
+		}
+	}
+}
+
+// flush inserts all pending events in batches. Events are only removed from
+// the queue once inserted, so a failed batch is retried on the next flush.
+func (instance *mirror) flush() error {
+	for {
+		instance.lock.Lock()
+		count := len(instance.pending)
+		if count > instance.options.MaxBatchEvents {
+			count = instance.options.MaxBatchEvents
+		}
+		// Commits only append, so the batch isn't modified while we insert it
+		batch := instance.pending[:count]
+		instance.lock.Unlock()
+
+		if count == 0 {
+			return nil
+		}
+
+		errInsert := instance.insert(batch)
+		if errInsert != nil {
+			return errInsert
+		}
+
+		instance.lock.Lock()
+		instance.pending = instance.pending[count:]
+		instance.space.Broadcast()
+		instance.lock.Unlock()
+	}
+}
+
+// insert writes a batch of rows to ClickHouse.
+func (instance *mirror) insert(batch []row) error {
+	body := bytes.Buffer{}
+	encoder := json.NewEncoder(&body)
+	for _, entry := range batch {
+		errEncode := encoder.Encode(entry)
+		if errEncode != nil {
+			return errEncode
+		}
+	}
+
+	query := fmt.Sprintf("INSERT INTO %v.%v FORMAT JSONEachRow", instance.options.Database, instance.options.Table)
+	req, errReq := http.NewRequest(http.MethodPost, instance.options.URL+"/?query="+url.QueryEscape(query), &body)
+	if errReq != nil {
+		return errReq
+	}
+	if instance.options.Username != "" {
+		req.Header.Set("X-ClickHouse-User", instance.options.Username)
+		req.Header.Set("X-ClickHouse-Key", instance.options.Password)
+	}
+
+	resp, errResp := instance.options.Client.Do(req)
+	if errResp != nil {
+		return errResp
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("clickhouse: insert failed with %v: %s", resp.Status, bytes.TrimSpace(message))
+	}
+
+	return nil
+}
+
+// close stops accepting events, and inserts any that are pending.
+func (instance *mirror) close() error {
+	instance.lock.Lock()
+	if instance.closed {
+		instance.lock.Unlock()
+		return nil
+	}
+	instance.closed = true
+	instance.space.Broadcast()
+	instance.lock.Unlock()
+
+	close(instance.stop)
+	<-instance.done
+	return instance.errLast
+}
@@ -0,0 +1,163 @@
+package clickhouse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClickHouse records inserted rows, failing while unavailable is set
+type fakeClickHouse struct {
+	lock        sync.Mutex
+	queries     []string
+	rows        []row
+	unavailable bool
+}
+
+func (fake *fakeClickHouse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	if fake.unavailable {
+		http.Error(w, "Code: 241, DB::Exception: Memory limit exceeded", http.StatusServiceUnavailable)
+		return
+	}
+
+	fake.queries = append(fake.queries, r.URL.Query().Get("query"))
+	body, _ := ioutil.ReadAll(r.Body)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		entry := row{}
+		json.Unmarshal(scanner.Bytes(), &entry)
+		fake.rows = append(fake.rows, entry)
+	}
+}
+
+func (fake *fakeClickHouse) count() int {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return len(fake.rows)
+}
+
+func (fake *fakeClickHouse) setUnavailable(unavailable bool) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.unavailable = unavailable
+}
+
+func provider() (eventsourcing.EventStore, func(), error) {
+	server := httptest.NewServer(&fakeClickHouse{})
+	wrapped := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	wrapped.Use(Create(Options{
+		URL:      server.URL,
+		Database: "analytics",
+		Table:    "events",
+	}))
+
+	return wrapped, func() {
+		wrapped.Close()
+		server.Close()
+	}, nil
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "ClickHouse Middleware", provider)
+}
+
+// TestMirroredRows checks committed events are inserted with their details
+func TestMirroredRows(t *testing.T) {
+	fake := &fakeClickHouse{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	wrapped := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	wrapped.Use(Create(Options{
+		URL:            server.URL,
+		Database:       "analytics",
+		Table:          "events",
+		MaxBatchEvents: 2,
+		FlushInterval:  time.Hour,
+	}))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("mirrored", test.GetTestRegistry(), wrapped)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 2})
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 3})
+	assert.Nil(t, agg.Commit())
+	assert.Nil(t, wrapped.Close())
+
+	assert.Equal(t, []string{
+		"INSERT INTO analytics.events FORMAT JSONEachRow",
+		"INSERT INTO analytics.events FORMAT JSONEachRow",
+	}, fake.queries, "Events should be inserted in batches")
+	assert.Equal(t, 3, len(fake.rows))
+	assert.Equal(t, "mirrored", fake.rows[2].Key)
+	assert.Equal(t, int64(3), fake.rows[2].Sequence)
+	assert.Equal(t, "IncrementEvent", fake.rows[2].EventType)
+	assert.Equal(t, test.GetTestRegistry().Domain(), fake.rows[2].Domain)
+	assert.JSONEq(t, `{"increment_by":3}`, fake.rows[2].Data)
+	assert.Equal(t, "{}", fake.rows[2].Metadata)
+}
+
+// TestBackpressure checks commits block while ClickHouse is unavailable and
+// the queue is full, then resume once it recovers.
+func TestBackpressure(t *testing.T) {
+	fake := &fakeClickHouse{unavailable: true}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	wrapped := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	wrapped.Use(Create(Options{
+		URL:              server.URL,
+		Database:         "analytics",
+		Table:            "events",
+		MaxBatchEvents:   1,
+		MaxPendingEvents: 2,
+		FlushInterval:    10 * time.Millisecond,
+		OnError:          func(error) {},
+	}))
+	defer wrapped.Close()
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("backpressure", test.GetTestRegistry(), wrapped)
+	for i := 0; i < 2; i++ {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+		assert.Nil(t, agg.Commit())
+	}
+
+	committed := make(chan error, 1)
+	go func() {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+		committed <- agg.Commit()
+	}()
+
+	select {
+	case <-committed:
+		t.Fatal("Commit should block while the queue is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	fake.setUnavailable(false)
+	select {
+	case errCommit := <-committed:
+		assert.Nil(t, errCommit)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Commit should resume once ClickHouse recovers")
+	}
+
+	assert.Nil(t, wrapped.Close())
+	assert.Equal(t, 3, fake.count(), "No events should be lost")
+}
@@ -1,67 +1,87 @@
 package dynamosnap
 
 import (
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	"github.com/globalsign/mgo/bson"
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/go-gadgets/eventsourcing"
 	"github.com/go-gadgets/eventsourcing/stores/middleware/snapbase"
+	"github.com/go-gadgets/eventsourcing/utilities/dynamoattr"
 )
 
-func init() {
-	bson.SetJSONTagFallback(true)
-}
-
-// Snapshot is the current snapshot for an entity, a JSON structure
-// that can be persisted to the DynamoDB table.
-type snapshot struct {
-	Key      string      `json:"aggregate_key"`
-	Sequence int64       `json:"seq"`
-	State    interface{} `json:"state"`
+// API is the part of the DynamoDB client that the middleware uses, which
+// *dynamodb.Client implements.
+type API interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
 }
 
 // Parameters describes the parameters that can be
 // used to cofigure a DynamoDB snap store.
 type Parameters struct {
-	Lazy         bool  // Lazy mode?
-	SnapInterval int64 `json:"snap_interval"` // SnapInterval is the number of events between snaps
+	Lazy             bool                      // Lazy mode?
+	SnapInterval     int64                     `json:"snap_interval"`      // SnapInterval is the number of events between snaps
+	Strategy         snapbase.SnapshotStrategy `json:"-"`                  // Strategy decides when to snap, every SnapInterval events by default
+	MaxSnapshotBytes int64                     `json:"max_snapshot_bytes"` // MaxSnapshotBytes is the largest snapshot to write or restore, zero for no limit
+	OnTooLarge       snapbase.TooLargeCallback `json:"-"`                  // OnTooLarge decides what happens to oversized snapshots on refresh
+	Compressor       snapbase.Compressor       `json:"-"`                  // Compressor compresses snapshots before they are written (snapbase.Gzip, snapbase.Zstd), nil for none
+	Keys             snapbase.KeyProvider      `json:"-"`                  // Keys encrypt snapshots before they are written (see snapbase.KeyProvider), nil for none
+	Async            bool                      `json:"async"`              // Async writes snapshots in the background, coalescing them by key
+	OnError          snapbase.ErrorCallback    `json:"-"`                  // OnError is called when a background snapshot write fails
+	SnapOnReadAfter  int64                     `json:"snap_on_read_after"` // SnapOnReadAfter snaps after a refresh that replays more events than this, zero to snap only on commit
+	Singleflight     bool                      `json:"singleflight"`       // Singleflight shares the work of concurrent refreshes of the same aggregate, so only one reads the snapshot and replays events
+	Admin            *snapbase.Admin           `json:"-"`                  // Admin administers the snapshots of the provider (see snapbase.NewAdmin), nil for none
+	Cloner           snapbase.Cloner           `json:"-"`                  // Cloner copies states into snapshots (snapbase.CloneJSON, snapbase.CloneReflect), CloneJSON by default
+	Metrics          *snapbase.Metrics         `json:"-"`                  // Metrics counts how refreshes use snapshots (see snapbase.NewMetrics), nil for none
+	Timeout          time.Duration             `json:"timeout"`            // Timeout is the longest a request to DynamoDB may take, zero for no limit
+	ClientOptions    []func(*dynamodb.Options) `json:"-"`                  // ClientOptions are applied to the client Create makes, i.e. to set its BaseEndpoint
 }
 
 // instance is our storage provider for managing snapshots in memory
 type instance struct {
-	service   *dynamodb.DynamoDB
+	service   API
 	params    Parameters
 	tableName string
 }
 
-// Create a snap provider using the default AWS session context
-func Create(params Parameters, tableName string) (eventsourcing.MiddlewareFactory, error) {
-	// Create an AWS Session
-	session, errSession := session.NewSession()
-	if errSession != nil {
-		return nil, errSession
-	}
-
-	return CreateWithSession(params, session, tableName)
+// Create a snap provider with a client created from the AWS configuration and
+// params.ClientOptions. Snapshots are kept one item per aggregate, in a table
+// whose hash key is aggregate_key, in the format earlier versions wrote.
+func Create(params Parameters, config aws.Config, tableName string) (eventsourcing.MiddlewareFactory, error) {
+	return CreateWithClient(params, dynamodb.NewFromConfig(config, params.ClientOptions...), tableName)
 }
 
-// CreateWithSession provisions a new instance of the dynamo-snap provider using
-// an existing session
-func CreateWithSession(params Parameters, session *session.Session, tableName string) (eventsourcing.MiddlewareFactory, error) {
-	service := dynamodb.New(session)
-
+// CreateWithClient provisions a new instance of the dynamo-snap provider using
+// a client that's already been established (BYO-instance).
+func CreateWithClient(params Parameters, client API, tableName string) (eventsourcing.MiddlewareFactory, error) {
 	snaps := &instance{
-		service:   service,
+		service:   client,
 		tableName: tableName,
 		params:    params,
 	}
 
 	return func() (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, eventsourcing.CloseMiddleware) {
 		return snapbase.Create(snapbase.Parameters{
-			Lazy:         params.Lazy,
-			SnapInterval: params.SnapInterval,
+			Lazy:             params.Lazy,
+			SnapInterval:     params.SnapInterval,
+			Strategy:         params.Strategy,
+			MaxSnapshotBytes: params.MaxSnapshotBytes,
+			OnTooLarge:       params.OnTooLarge,
+			Compressor:       params.Compressor,
+			Keys:             params.Keys,
+			Async:            params.Async,
+			OnError:          params.OnError,
+			SnapOnReadAfter:  params.SnapOnReadAfter,
+			Singleflight:     params.Singleflight,
+			Admin:            params.Admin,
+			Cloner:           params.Cloner,
+			Metrics:          params.Metrics,
 			Close: func() error {
 				return nil
 			},
@@ -72,72 +92,93 @@ func CreateWithSession(params Parameters, session *session.Session, tableName st
 	}, nil
 }
 
+// context gets the context of a request, which expires after the timeout
+func (mw *instance) context() (context.Context, context.CancelFunc) {
+	if mw.params.Timeout > 0 {
+		return context.WithTimeout(context.Background(), mw.params.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// itemKey gets the key of the item that holds the snapshot of an aggregate
+func itemKey(key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"aggregate_key": &types.AttributeValueMemberS{Value: key},
+	}
+}
+
 // get a key from the cache
 func (mw *instance) get(key string) (interface{}, int64, error) {
-	var loaded snapshot
-	// Build query
-	input := &dynamodb.GetItemInput{
-		ConsistentRead: aws.Bool(true),
-		Key: map[string]*dynamodb.AttributeValue{
-			"aggregate_key": {
-				S: aws.String(key),
-			},
-		},
-		TableName: aws.String(mw.tableName),
-	}
+	ctx, cancel := mw.context()
+	defer cancel()
 
-	// Fetch
-	result, errResult := mw.service.GetItem(input)
+	result, errResult := mw.service.GetItem(ctx, &dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(true),
+		Key:            itemKey(key),
+		TableName:      aws.String(mw.tableName),
+	})
 	if errResult != nil {
 		return nil, 0, errResult
 	}
 
 	if result.Item == nil {
-		return loaded.State, loaded.Sequence, nil
+		return nil, 0, nil
 	}
 
-	errSnap := dynamodbattribute.UnmarshalMap(result.Item, &loaded)
-	if errSnap != nil {
-		return nil, 0, errSnap
+	seq, errSeq := dynamoattr.Int64(result.Item["seq"])
+	if errSeq != nil {
+		return nil, 0, errSeq
+	}
+	state, errState := dynamoattr.Unmarshal(result.Item["state"])
+	if errState != nil {
+		return nil, 0, errState
 	}
 
-	return loaded.State, loaded.Sequence, nil
+	return state, seq, nil
 }
 
 // purge a key from the cache
 func (mw *instance) purge(key string) error {
-	// Build input
-	input := &dynamodb.DeleteItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"aggregate_key": {
-				S: aws.String(key),
-			},
-		},
-		TableName: aws.String(mw.tableName),
-	}
+	ctx, cancel := mw.context()
+	defer cancel()
 
-	_, errPurge := mw.service.DeleteItem(input)
+	_, errPurge := mw.service.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		Key:       itemKey(key),
+		TableName: aws.String(mw.tableName),
+	})
 	return errPurge
 }
 
 // put an item into the cache
 func (mw *instance) put(key string, seq int64, data interface{}) error {
-	snap := snapshot{
-		Key:      key,
-		Sequence: seq,
-		State:    data,
-	}
-
-	// Marshal the items
-	av, errMarshal := dynamodbattribute.MarshalMap(snap)
+	state, errMarshal := dynamoattr.Marshal(data)
 	if errMarshal != nil {
 		return errMarshal
 	}
 
-	_, errPut := mw.service.PutItem(&dynamodb.PutItemInput{
-		Item:      av,
-		TableName: aws.String(mw.tableName),
+	item := itemKey(key)
+	item["seq"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(seq, 10)}
+	item["state"] = state
+
+	ctx, cancel := mw.context()
+	defer cancel()
+
+	// Never replace a newer snapshot
+	_, errPut := mw.service.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:                item,
+		TableName:           aws.String(mw.tableName),
+		ConditionExpression: aws.String("attribute_not_exists(aggregate_key) OR #seq <= :seq"),
+		ExpressionAttributeNames: map[string]string{
+			"#seq": "seq",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":seq": &types.AttributeValueMemberN{Value: strconv.FormatInt(seq, 10)},
+		},
 	})
 
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(errPut, &failed) {
+		return nil
+	}
 	return errPut
 }
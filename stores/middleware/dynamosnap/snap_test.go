@@ -1,29 +1,35 @@
 package dynamosnap
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/dynamo"
 	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/snapbase"
 	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
 )
 
+// localConfig reaches DynamoDB Local
+var localConfig = dynamo.LocalConfig("http://localhost:8000", "ap-southeast-2")
+
 func provider() (eventsourcing.EventStore, func(), error) {
-	session, errSession := session.NewSession(&aws.Config{
-		Endpoint: aws.String("http://localhost:8000"),
-		Region:   aws.String("ap-southeast-2"),
-	})
-	if errSession != nil {
-		return nil, nil, errSession
-	}
+	return compressedProvider(nil)
+}
 
+// compressedProvider creates a store whose snapshots are compressed
+func compressedProvider(compressor snapbase.Compressor) (eventsourcing.EventStore, func(), error) {
 	base := memory.NewStore()
 	wrapped := eventsourcing.NewMiddlewareWrapper(base)
-	mw, err := CreateWithSession(Parameters{
+	mw, err := Create(Parameters{
 		SnapInterval: 5,
-	}, session, "test-snap")
+		Compressor:   compressor,
+	}, localConfig, "test-snap")
 	if err != nil {
 		return nil, nil, err
 	}
@@ -39,6 +45,13 @@ func TestStoreCompliance(t *testing.T) {
 	test.CheckStandardSuite(t, "DynamoDB Snap Middleware", provider)
 }
 
+// TestCompressedCompliance checks compressed snapshots round-trip through DynamoDB
+func TestCompressedCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "DynamoDB Snap Middleware (zstd)", func() (eventsourcing.EventStore, func(), error) {
+		return compressedProvider(snapbase.Zstd())
+	})
+}
+
 // BenchmarkIndividualCommmits tests how fast we can apply events to an aggregate
 func BenchmarkIndividualCommmits(b *testing.B) {
 	test.MeasureIndividualCommits(b, provider)
@@ -49,3 +62,73 @@ func BenchmarkIndividualCommmits(b *testing.B) {
 func BenchmarkBulkInsertAndLoad(b *testing.B) {
 	test.MeasureBulkInsertAndReload(b, provider)
 }
+
+// TestSnapshotCompliance checks DynamoDB against the snapshot suite
+func TestSnapshotCompliance(t *testing.T) {
+	test.CheckSnapshotSuite(t, "DynamoDB Snap Middleware", func(options test.SnapshotOptions) (test.SnapshotStorage, func(), error) {
+		params := Parameters{
+			Lazy:         options.Lazy,
+			SnapInterval: options.SnapInterval,
+		}
+		snaps := &instance{service: dynamodb.NewFromConfig(localConfig), tableName: "test-snap", params: params}
+		mw, err := Create(params, localConfig, "test-snap")
+		if err != nil {
+			return test.SnapshotStorage{}, nil, err
+		}
+		base := memory.NewStore()
+		wrapped := eventsourcing.NewMiddlewareWrapper(base)
+		wrapped.Use(mw())
+
+		return test.SnapshotStorage{
+			Store: wrapped,
+			Inner: base,
+			Get:   snaps.get,
+			Put:   snaps.put,
+			Purge: snaps.purge,
+		}, func() {
+			wrapped.Close()
+		}, nil
+	})
+}
+
+// TestItemFormat checks snapshots are read and written in the format earlier
+// versions used, and that snapshots newer than the one being written are kept
+func TestItemFormat(t *testing.T) {
+	requests := make([]map[string]interface{}, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decoded := make(map[string]interface{})
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&decoded))
+		requests = append(requests, decoded)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch r.Header.Get("X-Amz-Target") {
+		case "DynamoDB_20120810.GetItem":
+			w.Write([]byte(`{"Item":{"aggregate_key":{"S":"snapped"},"seq":{"N":"5"},"state":{"M":{"current_count":{"N":"7"}}}}}`))
+		case "DynamoDB_20120810.PutItem":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed"}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	config := dynamo.LocalConfig(server.URL, "ap-southeast-2")
+	config.RetryMaxAttempts = 1
+	snaps := &instance{service: dynamodb.NewFromConfig(config), tableName: "test-snap"}
+
+	state, seq, errGet := snaps.get("snapped")
+	assert.Nil(t, errGet)
+	assert.Equal(t, int64(5), seq)
+	assert.Equal(t, map[string]interface{}{"current_count": float64(7)}, state)
+
+	assert.Nil(t, snaps.put("snapped", 4, map[string]interface{}{"current_count": 6}))
+	assert.Equal(t, map[string]interface{}{
+		"aggregate_key": map[string]interface{}{"S": "snapped"},
+		"seq":           map[string]interface{}{"N": "4"},
+		"state":         map[string]interface{}{"M": map[string]interface{}{"current_count": map[string]interface{}{"N": "6"}}},
+	}, requests[1]["Item"])
+
+	assert.Nil(t, snaps.purge("snapped"))
+	assert.Equal(t, map[string]interface{}{"aggregate_key": map[string]interface{}{"S": "snapped"}}, requests[2]["Key"])
+}
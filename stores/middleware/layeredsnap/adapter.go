@@ -0,0 +1,99 @@
+package layeredsnap
+
+import (
+	"fmt"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// guardedLoader is the loader a layer refreshes through, which skips snapshots
+// that are no newer than the aggregate already is.
+type guardedLoader struct {
+	eventsourcing.StoreLoaderAdapter
+	restored int64 // Sequence of the snapshot this layer restored, if any
+	skipped  bool  // Set if this layer's snapshot was skipped
+}
+
+// guard presents a guarded loader to a layer, exposing the state of the aggregate
+// only if the aggregate exposes it.
+func guard(loader *guardedLoader) eventsourcing.StoreLoaderAdapter {
+	if _, ok := loader.StoreLoaderAdapter.(eventsourcing.StateAdapter); ok {
+		return &statefulLoader{guardedLoader: loader}
+	}
+	return loader
+}
+
+// RestoreSnapshot restores a snapshot, unless the aggregate is already as new
+func (loader *guardedLoader) RestoreSnapshot(sequence int64, snapshot interface{}) error {
+	if sequence <= loader.SequenceNumber() {
+		loader.skipped = true
+		return nil
+	}
+
+	errRestore := loader.StoreLoaderAdapter.RestoreSnapshot(sequence, snapshot)
+	if errRestore == nil {
+		loader.restored = sequence
+	}
+	return errRestore
+}
+
+// AdvanceSequence moves the aggregate forward, if it supports it
+func (loader *guardedLoader) AdvanceSequence(sequence int64) error {
+	advancer, ok := loader.StoreLoaderAdapter.(eventsourcing.SequenceAdvancer)
+	if !ok {
+		return fmt.Errorf("StoreError: Aggregate %v does not support skipping to sequence %v", loader.GetKey(), sequence)
+	}
+	return advancer.AdvanceSequence(sequence)
+}
+
+// RebuildingSnapshot returns true if the aggregate is rebuilding its snapshot
+func (loader *guardedLoader) RebuildingSnapshot() bool {
+	return eventsourcing.IsRebuildingSnapshot(loader.StoreLoaderAdapter)
+}
+
+// SnapshotVersion gets the snapshot schema version of the aggregate state
+func (loader *guardedLoader) SnapshotVersion() string {
+	return eventsourcing.SnapshotVersionOf(loader.StoreLoaderAdapter)
+}
+
+// statefulLoader is a guarded loader of an aggregate that exposes its state
+type statefulLoader struct {
+	*guardedLoader
+}
+
+// GetState returns the state of the aggregate being loaded
+func (loader *statefulLoader) GetState() interface{} {
+	return loader.StoreLoaderAdapter.(eventsourcing.StateAdapter).GetState()
+}
+
+// fillWriter presents a refreshed aggregate to a layer as a snapshot rebuild, so
+// that the layer writes a snapshot of it without any events being committed.
+type fillWriter struct {
+	eventsourcing.StoreLoaderAdapter
+	state interface{}
+}
+
+// IsDirty returns false, as the aggregate was just refreshed
+func (writer *fillWriter) IsDirty() bool {
+	return false
+}
+
+// GetUncommittedEvents gets the sequence of the aggregate, without events
+func (writer *fillWriter) GetUncommittedEvents() (int64, []eventsourcing.Event) {
+	return writer.SequenceNumber(), nil
+}
+
+// GetState gets the state of the refreshed aggregate
+func (writer *fillWriter) GetState() interface{} {
+	return writer.state
+}
+
+// RebuildingSnapshot returns true, so that the layer snaps the aggregate
+func (writer *fillWriter) RebuildingSnapshot() bool {
+	return true
+}
+
+// SnapshotVersion gets the snapshot schema version of the aggregate state
+func (writer *fillWriter) SnapshotVersion() string {
+	return eventsourcing.SnapshotVersionOf(writer.StoreLoaderAdapter)
+}
@@ -0,0 +1,195 @@
+/*
+Package layeredsnap stacks snapshot middleware into layers, fastest first, such as
+memory over Redis over MongoDB:
+
+	store.Use(layeredsnap.Create(
+		layeredsnap.Of(memorysnap.Create(memorysnap.Parameters{Lazy: true})),
+		layeredsnap.Of(redisSnap()),
+		layeredsnap.Of(mongoSnap()),
+	))
+
+Stacking snapshot middleware by hand is easy to get subtly wrong, as each layer
+restores its snapshot over whatever the layers before it restored, and a lazy layer
+stops the refresh at its own snapshot. Layers stacked here behave as one:
+
+  - Refreshes try the layers in order. A layer's snapshot is only restored if it is
+    newer than what the layers before it restored, so a slow layer never rolls the
+    aggregate back to an older snapshot, and a lazy layer whose snapshot was skipped
+    doesn't stop the rest of the refresh.
+  - When a snapshot is restored from a slower layer, the faster layers that missed
+    it (or held an older one) are filled with a snapshot of the refreshed aggregate,
+    so that the next refresh is served by the fastest layer.
+  - Commits are written through every layer, each snapping by its own strategy, so
+    a layer can snap every commit while a slower one snaps every hundred.
+
+Only the fastest layer should be lazy: a lazy layer is trusted to be current, so
+the layers after it aren't consulted when it holds a snapshot.
+
+Stacks built with CreateMiddleware from layers built with OfMiddleware carry the
+capabilities of their layers, so that the store can check the stack is placed
+sensibly among the rest of its middleware (see eventsourcing.UseMiddleware).
+*/
+package layeredsnap
+
+import (
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// Layer is a snapshot middleware to stack.
+type Layer struct {
+	Commit       eventsourcing.CommitMiddleware  // Commit middleware of the layer
+	Refresh      eventsourcing.RefreshMiddleware // Refresh middleware of the layer
+	Close        func() error                    // Close callback of the layer
+	Capabilities eventsourcing.Capability        // Capabilities of the layer, if described
+}
+
+// Of creates a layer from the middleware of a snapshot provider.
+func Of(commit eventsourcing.CommitMiddleware, refresh eventsourcing.RefreshMiddleware, close func() error) Layer {
+	return Layer{
+		Commit:  commit,
+		Refresh: refresh,
+		Close:   close,
+	}
+}
+
+// OfMiddleware creates a layer from the described middleware of a snapshot
+// provider, keeping its capabilities.
+func OfMiddleware(middleware eventsourcing.Middleware) Layer {
+	return Layer{
+		Commit:       middleware.Commit,
+		Refresh:      middleware.Refresh,
+		Close:        middleware.Close,
+		Capabilities: middleware.Capabilities,
+	}
+}
+
+// stack is a stack of snapshot layers, fastest first
+type stack struct {
+	layers []Layer
+}
+
+// Create stacks snapshot layers, fastest first, into a single middleware.
+func Create(layers ...Layer) (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
+	layered := &stack{
+		layers: layers,
+	}
+
+	return layered.commit, layered.refresh, layered.close
+}
+
+// CreateMiddleware stacks snapshot layers as Create does, described for
+// eventsourcing.UseMiddleware with the capabilities of every layer.
+// Layers stacked here are ordered correctly among themselves, so only the stack
+// as a whole is checked against the rest of the chain.
+func CreateMiddleware(layers ...Layer) eventsourcing.Middleware {
+	capabilities := eventsourcing.Capability(0)
+	for _, layer := range layers {
+		capabilities |= layer.Capabilities
+	}
+	commit, refresh, cleanup := Create(layers...)
+	return eventsourcing.Describe("layeredsnap", capabilities, commit, refresh, cleanup)
+}
+
+// commit writes the commit through every layer, fastest layer outermost
+func (layered *stack) commit(writer eventsourcing.StoreWriterAdapter, next eventsourcing.NextHandler) error {
+	chain := next
+	for index := len(layered.layers) - 1; index >= 0; index-- {
+		layer := layered.layers[index]
+		inner := chain
+		chain = func() error {
+			return layer.Commit(writer, inner)
+		}
+	}
+
+	return chain()
+}
+
+// refresh tries each layer in turn, and then fills the faster layers if a slower
+// layer held a newer snapshot
+func (layered *stack) refresh(adapter eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+	loaders := make([]*guardedLoader, len(layered.layers))
+	errRefresh := layered.refreshLayer(0, loaders, adapter, next)
+	if errRefresh != nil {
+		return errRefresh
+	}
+
+	layered.fill(adapter, loaders)
+	return nil
+}
+
+// refreshLayer refreshes the aggregate through a layer, and those after it
+func (layered *stack) refreshLayer(index int, loaders []*guardedLoader, adapter eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+	if index == len(layered.layers) {
+		return next()
+	}
+
+	loader := &guardedLoader{StoreLoaderAdapter: adapter}
+	loaders[index] = loader
+
+	called := false
+	inner := func() error {
+		called = true
+		return layered.refreshLayer(index+1, loaders, adapter, next)
+	}
+
+	errRefresh := layered.layers[index].Refresh(guard(loader), inner)
+	if errRefresh != nil {
+		return errRefresh
+	}
+
+	// A lazy layer stops at its snapshot, even if it was skipped as stale
+	if !called && loader.skipped {
+		return inner()
+	}
+	return nil
+}
+
+// fill writes the refreshed aggregate to the faster layers that missed the newest
+// snapshot. Failures are logged, rather than failing the refresh.
+func (layered *stack) fill(adapter eventsourcing.StoreLoaderAdapter, loaders []*guardedLoader) {
+	newest := -1
+	for index, loader := range loaders {
+		if loader != nil && loader.restored > 0 && (newest < 0 || loader.restored > loaders[newest].restored) {
+			newest = index
+		}
+	}
+
+	reader, ok := adapter.(eventsourcing.StateAdapter)
+	if newest <= 0 || !ok {
+		return
+	}
+
+	writer := &fillWriter{
+		StoreLoaderAdapter: adapter,
+		state:              reader.GetState(),
+	}
+	for index := 0; index < newest; index++ {
+		if loaders[index].restored >= loaders[newest].restored {
+			continue
+		}
+
+		errFill := layered.layers[index].Commit(writer, func() error { return nil })
+		if errFill != nil {
+			eventsourcing.DefaultLogger().Warn("Snapshot layer could not be filled", eventsourcing.LogFields{
+				"key":   adapter.GetKey(),
+				"layer": index,
+				"error": errFill,
+			})
+		}
+	}
+}
+
+// close closes every layer, returning the first failure
+func (layered *stack) close() error {
+	var errFirst error
+	for _, layer := range layered.layers {
+		if layer.Close == nil {
+			continue
+		}
+		errClose := layer.Close()
+		if errClose != nil && errFirst == nil {
+			errFirst = errClose
+		}
+	}
+	return errFirst
+}
@@ -0,0 +1,130 @@
+package layeredsnap
+
+import (
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/memorysnap"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/snapbase"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// fixed creates a layer that always holds one snapshot
+func fixed(lazy bool, seq int64, count int) Layer {
+	return Of(snapbase.Create(snapbase.Parameters{
+		Lazy:         lazy,
+		SnapInterval: 1000,
+		Close:        func() error { return nil },
+		Get: func(string) (interface{}, int64, error) {
+			return map[string]interface{}{"current_count": count}, seq, nil
+		},
+		Purge: func(string) error { return nil },
+		Put:   func(string, int64, interface{}) error { return nil },
+	}))
+}
+
+// populate commits increments of one to an aggregate
+func populate(t *testing.T, store eventsourcing.EventStore, key string, events int) {
+	agg := test.SimpleAggregate{}
+	agg.Initialize(key, test.GetTestRegistry(), store)
+	for i := 0; i < events; i++ {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	}
+	assert.Nil(t, agg.Commit())
+}
+
+// TestStoreCompliance checks the standard suite passes with memory layers
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Layered Snap Middleware", func() (eventsourcing.EventStore, func(), error) {
+		wrapped := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+		errUse := eventsourcing.UseMiddleware(wrapped, CreateMiddleware(
+			OfMiddleware(memorysnap.CreateMiddleware(memorysnap.Parameters{Lazy: true, MaxEntries: 64})),
+			Of(memorysnap.Create(memorysnap.Parameters{SnapInterval: 3})),
+			Of(memorysnap.Create(memorysnap.Parameters{SnapInterval: 7})),
+		))
+		return wrapped, func() {
+			wrapped.Close()
+		}, errUse
+	})
+}
+
+// TestCapabilities checks a stack is described with the capabilities of its
+// layers, so that caching layers can't be wrapped by other snapshot middleware
+func TestCapabilities(t *testing.T) {
+	described := CreateMiddleware(
+		OfMiddleware(memorysnap.CreateMiddleware(memorysnap.Parameters{Lazy: true})),
+		fixed(false, 1, 1),
+	)
+	assert.Equal(t, "layeredsnap", described.Name)
+	assert.Equal(t, eventsourcing.Caching, described.Capabilities)
+
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	assert.Nil(t, eventsourcing.UseMiddleware(store, described))
+	errOrder := eventsourcing.UseMiddleware(store, eventsourcing.Describe("mongosnap", eventsourcing.Durable, nil, nil, nil))
+	isFault, _ := eventsourcing.IsMiddlewareOrderingFault(errOrder)
+	assert.True(t, isFault)
+}
+
+// TestFill checks faster layers are filled from slower ones
+func TestFill(t *testing.T) {
+	fast := memorysnap.NewCache(memorysnap.Parameters{SnapInterval: 100})
+	slow := memorysnap.NewCache(memorysnap.Parameters{SnapInterval: 2})
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(Of(fast.Middleware()), Of(slow.Middleware())))
+	populate(t, store, "filled", 3)
+	assert.Equal(t, 0, fast.Stats().Entries)
+	assert.Equal(t, 1, slow.Stats().Entries)
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("filled", test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	assert.Equal(t, 3, agg.CurrentCount)
+	assert.Equal(t, 1, fast.Stats().Entries, "The fast layer should be filled")
+
+	again := test.SimpleAggregate{}
+	again.Initialize("filled", test.GetTestRegistry(), store)
+	assert.Nil(t, again.Refresh())
+	assert.Equal(t, 3, again.CurrentCount)
+}
+
+// TestStaleLayer checks older snapshots in slower layers don't roll the aggregate
+// back, even when the slower layer is lazy
+func TestStaleLayer(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+		populate(t, store, "stale", 6)
+		store.Use(Create(fixed(false, 4, 4), fixed(lazy, 2, 1000)))
+
+		agg := test.SimpleAggregate{}
+		agg.Initialize("stale", test.GetTestRegistry(), store)
+		assert.Nil(t, agg.Refresh())
+		assert.Equal(t, 6, agg.CurrentCount, "Lazy slow layer: %v", lazy)
+		assert.Equal(t, int64(6), agg.SequenceNumber())
+	}
+}
+
+// TestNewerLayer checks newer snapshots in slower layers are preferred
+func TestNewerLayer(t *testing.T) {
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	populate(t, store, "newer", 6)
+	store.Use(Create(fixed(false, 2, 2), fixed(false, 5, 500)))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("newer", test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	assert.Equal(t, 501, agg.CurrentCount, "The newest snapshot should be restored, and the rest replayed")
+}
+
+// TestLazyFastLayer checks a lazy fast layer serves refreshes on its own
+func TestLazyFastLayer(t *testing.T) {
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	populate(t, store, "lazy", 6)
+	store.Use(Create(fixed(true, 6, 60), fixed(false, 2, 2)))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("lazy", test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	assert.Equal(t, 60, agg.CurrentCount)
+}
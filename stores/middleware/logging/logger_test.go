@@ -1,6 +1,8 @@
 package logging
 
 import (
+	"io/ioutil"
+	"log/slog"
 	"testing"
 
 	"github.com/go-gadgets/eventsourcing"
@@ -33,3 +35,18 @@ func BenchmarkIndividualCommmits(b *testing.B) {
 func BenchmarkBulkInsertAndLoad(b *testing.B) {
 	test.MeasureBulkInsertAndReload(b, provider)
 }
+
+// TestStoreComplianceWithLogger checks the middleware with a stdlib logger.
+func TestStoreComplianceWithLogger(t *testing.T) {
+	test.CheckStandardSuite(t, "Logging Middleware (slog)", func() (eventsourcing.EventStore, func(), error) {
+		base := memory.NewStore()
+		wrapped := eventsourcing.NewMiddlewareWrapper(base)
+		wrapped.Use(CreateWithLogger(eventsourcing.NewSlogLogger(slog.New(slog.NewTextHandler(ioutil.Discard, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+		})))))
+
+		return wrapped, func() {
+			wrapped.Close()
+		}, nil
+	})
+}
@@ -1,57 +1,69 @@
 package logging
 
 import (
-	"github.com/sirupsen/logrus"
-
 	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/logadapter"
 )
 
 // Create a new logrus middleware
 func Create() (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
+	return CreateWithLogger(logadapter.NewLogrusLogger(nil))
+}
+
+// CreateWithLogger creates a new logging middleware that writes to the specified
+// logger, i.e. eventsourcing.NewSlogLogger for builds without logrus.
+func CreateWithLogger(logger eventsourcing.Logger) (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
 	call := 0
 	return func(writer eventsourcing.StoreWriterAdapter, next eventsourcing.NextHandler) error {
 			count, _ := writer.GetUncommittedEvents()
-			logger := logrus.WithFields(logrus.Fields{
+			fields := eventsourcing.LogFields{
 				"key":    writer.GetKey(),
 				"seq":    writer.SequenceNumber(),
 				"call":   call,
 				"events": count,
-			})
+			}
 			call++
 
-			logger.Debug("commit_start")
+			logger.Debug("commit_start", fields)
 			errNext := next()
 			if errNext != nil {
-				logger.WithFields(logrus.Fields{
-					"error": errNext,
-				}).Error("commit_error")
+				logger.Error("commit_error", withError(fields, errNext))
 				return errNext
 			}
 
-			logger.Debug("commit_complete")
+			logger.Debug("commit_complete", fields)
 			return nil
 		}, func(reader eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
-			logger := logrus.WithFields(logrus.Fields{
+			fields := eventsourcing.LogFields{
 				"key":  reader.GetKey(),
 				"seq":  reader.SequenceNumber(),
 				"call": call,
-			})
+			}
 			call++
 
-			logger.Debug("refresh_start")
+			logger.Debug("refresh_start", fields)
 
 			errNext := next()
 			if errNext != nil {
-				logger.WithFields(logrus.Fields{
-					"error": errNext,
-				}).Error("refresh_error")
+				logger.Error("refresh_error", withError(fields, errNext))
 				return errNext
 			}
 
-			logger.Debug("refresh_complete")
+			logger.Debug("refresh_complete", fields)
 			return nil
 		}, func() error {
-			logrus.Debug("middleware_shutdown")
+			logger.Debug("middleware_shutdown", nil)
 			return nil
 		}
 }
+
+// withError copies a set of fields, adding an error.
+func withError(fields eventsourcing.LogFields, err error) eventsourcing.LogFields {
+	result := eventsourcing.LogFields{
+		"error": err,
+	}
+	for name, value := range fields {
+		result[name] = value
+	}
+	return result
+}
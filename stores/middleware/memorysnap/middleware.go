@@ -1,7 +1,27 @@
+/*
+Package memorysnap is snapshot middleware that keeps snapshots in memory. It is
+safe for concurrent use: snapshots are spread over shards by key, each with a lock
+of its own, so aggregates rarely contend.
+
+The cache can be bounded by the number of snapshots (MaxEntries) and their
+estimated size (MaxBytes), evicting the least recently used snapshots once a limit
+is reached, so that lazy caching can be used in long-running services. Limits are
+split evenly over the shards (rounding up, so limits below the number of shards are
+approximate), and Stats reports the evictions, i.e. for metrics.
+
+Snapshots can also expire a while after they are written (TTL). When several
+instances of a service keep lazy snapshots of the same aggregates, an instance only
+learns that an aggregate was changed elsewhere when its own commit hits a
+concurrency fault: expiry bounds how long a lazy snapshot can be read stale.
+*/
 package memorysnap
 
 import (
+	"container/list"
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-gadgets/eventsourcing"
 	"github.com/go-gadgets/eventsourcing/stores/middleware/snapbase"
@@ -9,78 +29,249 @@ import (
 
 // Parameters describes the parameters that can be used to configure the snap store.
 type Parameters struct {
-	Lazy         bool  // Lazy snapshots (won't refresh if there's a cached copy in RAM)
-	SnapInterval int64 `json:"snap_interval"` // SnapInterval is the number of events between snaps
+	Lazy             bool                      // Lazy snapshots (won't refresh if there's a cached copy in RAM)
+	SnapInterval     int64                     `json:"snap_interval"`      // SnapInterval is the number of events between snaps
+	Strategy         snapbase.SnapshotStrategy `json:"-"`                  // Strategy decides when to snap, every SnapInterval events by default
+	MaxSnapshotBytes int64                     `json:"max_snapshot_bytes"` // MaxSnapshotBytes is the largest snapshot to write or restore, zero for no limit
+	OnTooLarge       snapbase.TooLargeCallback `json:"-"`                  // OnTooLarge decides what happens to oversized snapshots on refresh
+	SnapOnReadAfter  int64                     `json:"snap_on_read_after"` // SnapOnReadAfter snaps after a refresh that replays more events than this, zero to snap only on commit
+	Singleflight     bool                      `json:"singleflight"`       // Singleflight shares the work of concurrent refreshes of the same aggregate, so only one reads the snapshot and replays events
+	Admin            *snapbase.Admin           `json:"-"`                  // Admin administers the snapshots of the provider (see snapbase.NewAdmin), nil for none
+	Cloner           snapbase.Cloner           `json:"-"`                  // Cloner copies states into snapshots (snapbase.CloneJSON, snapbase.CloneReflect), CloneJSON by default
+	Metrics          *snapbase.Metrics         `json:"-"`                  // Metrics counts how refreshes use snapshots (see snapbase.NewMetrics), nil for none
+	MaxEntries       int                       `json:"max_entries"`        // MaxEntries is the most snapshots to keep, zero for no limit
+	MaxBytes         int64                     `json:"max_bytes"`          // MaxBytes is the largest estimated size of all snapshots, zero for no limit
+	TTL              time.Duration             `json:"ttl"`                // TTL is how long a snapshot is kept after it is written, zero to keep it until evicted
+	Clock            eventsourcing.Clock       `json:"-"`                  // Clock is the source of time for expiry, the system clock by default
+}
+
+// Stats describes the contents of a cache.
+type Stats struct {
+	Entries     int   // Snapshots held
+	Bytes       int64 // Estimated size of the snapshots held
+	Evictions   int64 // Snapshots evicted to stay within the limits
+	Expirations int64 // Snapshots dropped after their TTL
 }
 
 // Snapshot is the current snapshot for an entity
 type snapshot struct {
+	Key      string
 	Sequence int64
 	State    interface{}
+	Size     int64
+	Expires  time.Time
+}
+
+// shardCount is the number of shards snapshots are spread over.
+const shardCount = 32
+
+// Cache is our storage provider for managing snapshots in memory
+type Cache struct {
+	evictions   int64 // Snapshots evicted, first for atomic alignment
+	expirations int64 // Snapshots expired
+	params      Parameters
+	maxEntries  int   // Most snapshots in each shard, zero for no limit
+	maxBytes    int64 // Largest size of each shard, zero for no limit
+	shards      [shardCount]*shard
 }
 
-// instance is our storage provider for managing snapshots in memory
-type instance struct {
-	snapInterval int64
-	lazy         bool
-	snaps        map[string]snapshot
-	mutex        sync.Mutex
+// shard holds the snapshots of some of the keys, most recently used first
+type shard struct {
+	snaps map[string]*list.Element
+	order *list.List
+	bytes int64
+	mutex sync.Mutex
+}
+
+// NewCache creates an empty snapshot cache.
+func NewCache(params Parameters) *Cache {
+	if params.Clock == nil {
+		params.Clock = eventsourcing.SystemClock
+	}
+
+	snaps := &Cache{
+		params: params,
+	}
+	if params.MaxEntries > 0 {
+		snaps.maxEntries = (params.MaxEntries + shardCount - 1) / shardCount
+	}
+	if params.MaxBytes > 0 {
+		snaps.maxBytes = (params.MaxBytes + shardCount - 1) / shardCount
+	}
+	for index := range snaps.shards {
+		snaps.shards[index] = newShard()
+	}
+	return snaps
+}
+
+// newShard creates an empty shard
+func newShard() *shard {
+	return &shard{
+		snaps: make(map[string]*list.Element),
+		order: list.New(),
+	}
 }
 
 // Create provisions a new instance of the memory-snap provider.
 func Create(params Parameters) (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
-	snaps := &instance{
-		lazy:         params.Lazy,
-		snapInterval: params.SnapInterval,
-		snaps:        make(map[string]snapshot),
+	return NewCache(params).Middleware()
+}
+
+// CreateMiddleware provisions a new instance of the memory-snap provider, described
+// for eventsourcing.UseMiddleware. Lazy snapshots are Caching.
+func CreateMiddleware(params Parameters) eventsourcing.Middleware {
+	capabilities := eventsourcing.Capability(0)
+	if params.Lazy {
+		capabilities = eventsourcing.Caching
 	}
+	commit, refresh, cleanup := Create(params)
+	return eventsourcing.Describe("memorysnap", capabilities, commit, refresh, cleanup)
+}
 
+// Middleware creates a snapshot middleware that keeps snapshots in the cache.
+func (cache *Cache) Middleware() (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
 	return snapbase.Create(snapbase.Parameters{
-		Lazy:         params.Lazy,
-		SnapInterval: params.SnapInterval,
+		Lazy:             cache.params.Lazy,
+		SnapInterval:     cache.params.SnapInterval,
+		Strategy:         cache.params.Strategy,
+		MaxSnapshotBytes: cache.params.MaxSnapshotBytes,
+		OnTooLarge:       cache.params.OnTooLarge,
+		SnapOnReadAfter:  cache.params.SnapOnReadAfter,
+		Singleflight:     cache.params.Singleflight,
+		Admin:            cache.params.Admin,
+		Cloner:           cache.params.Cloner,
+		Metrics:          cache.params.Metrics,
 		Close: func() error {
-			snaps.snaps = nil
+			for _, shard := range cache.shards {
+				shard.mutex.Lock()
+				shard.snaps = make(map[string]*list.Element)
+				shard.order.Init()
+				shard.bytes = 0
+				shard.mutex.Unlock()
+			}
 			return nil
 		},
-		Get:   snaps.get,
-		Purge: snaps.purge,
-		Put:   snaps.put,
+		Get:   cache.get,
+		Purge: cache.purge,
+		Put:   cache.put,
 	})
 }
 
+// Stats gets the contents of the cache, i.e. for metrics.
+func (cache *Cache) Stats() Stats {
+	stats := Stats{
+		Evictions:   atomic.LoadInt64(&cache.evictions),
+		Expirations: atomic.LoadInt64(&cache.expirations),
+	}
+	for _, shard := range cache.shards {
+		shard.mutex.Lock()
+		stats.Entries += len(shard.snaps)
+		stats.Bytes += shard.bytes
+		shard.mutex.Unlock()
+	}
+	return stats
+}
+
+// shard gets the shard that holds the snapshot for a key
+func (cache *Cache) shard(key string) *shard {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return cache.shards[hash.Sum32()%shardCount]
+}
+
 // get a key from the cache
-func (mw *instance) get(key string) (interface{}, int64, error) {
-	mw.mutex.Lock()
-	defer mw.mutex.Unlock()
+func (cache *Cache) get(key string) (interface{}, int64, error) {
+	shard := cache.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
 
-	snap, found := mw.snaps[key]
+	element, found := shard.snaps[key]
 	if !found {
 		return nil, 0, nil
 	}
 
+	snap := element.Value.(*snapshot)
+	if cache.expired(snap) {
+		shard.remove(element)
+		atomic.AddInt64(&cache.expirations, 1)
+		return nil, 0, nil
+	}
+
+	shard.order.MoveToFront(element)
 	return snap.State, snap.Sequence, nil
 }
 
 // purge a key from the cache
-func (mw *instance) purge(key string) error {
-	mw.mutex.Lock()
-	defer mw.mutex.Unlock()
+func (cache *Cache) purge(key string) error {
+	shard := cache.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
 
-	_, found := mw.snaps[key]
+	element, found := shard.snaps[key]
 	if found {
-		delete(mw.snaps, key)
+		shard.remove(element)
 	}
 	return nil
 }
 
 // put an item into the cache
-func (mw *instance) put(key string, seq int64, data interface{}) error {
-	mw.mutex.Lock()
-	defer mw.mutex.Unlock()
+func (cache *Cache) put(key string, seq int64, data interface{}) error {
+	size := int64(0)
+	if cache.maxBytes > 0 {
+		size = snapbase.Size(data)
+	}
+
+	shard := cache.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
 
-	mw.snaps[key] = snapshot{
+	if element, found := shard.snaps[key]; found {
+		// Never replace a newer snapshot
+		if element.Value.(*snapshot).Sequence > seq {
+			return nil
+		}
+		shard.remove(element)
+	}
+	snap := &snapshot{
+		Key:      key,
 		Sequence: seq,
 		State:    data,
+		Size:     size,
+	}
+	if cache.params.TTL > 0 {
+		snap.Expires = cache.params.Clock.Now().Add(cache.params.TTL)
+	}
+	shard.snaps[key] = shard.order.PushFront(snap)
+	shard.bytes += size
+
+	// Drop expired snapshots that haven't been read since
+	for shard.order.Len() > 1 && cache.expired(shard.order.Back().Value.(*snapshot)) {
+		shard.remove(shard.order.Back())
+		atomic.AddInt64(&cache.expirations, 1)
+	}
+
+	// Evict the least recently used snapshots, but never the one just written
+	for shard.order.Len() > 1 && cache.overLimit(shard) {
+		shard.remove(shard.order.Back())
+		atomic.AddInt64(&cache.evictions, 1)
 	}
 	return nil
 }
+
+// expired checks if a snapshot has outlived its TTL
+func (cache *Cache) expired(snap *snapshot) bool {
+	return !snap.Expires.IsZero() && !cache.params.Clock.Now().Before(snap.Expires)
+}
+
+// overLimit checks if a shard holds more than its share of the limits
+func (cache *Cache) overLimit(shard *shard) bool {
+	return (cache.maxEntries > 0 && shard.order.Len() > cache.maxEntries) ||
+		(cache.maxBytes > 0 && shard.bytes > cache.maxBytes)
+}
+
+// remove a snapshot from the shard
+func (shard *shard) remove(element *list.Element) {
+	snap := shard.order.Remove(element).(*snapshot)
+	delete(shard.snaps, snap.Key)
+	shard.bytes -= snap.Size
+}
@@ -1,11 +1,17 @@
 package memorysnap
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-gadgets/eventsourcing"
 	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/snapbase"
+	"github.com/go-gadgets/eventsourcing/utilities/simclock"
 	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
 )
 
 func provider() (eventsourcing.EventStore, func(), error) {
@@ -20,11 +26,34 @@ func provider() (eventsourcing.EventStore, func(), error) {
 	}, nil
 }
 
+// describedProvider registers the middleware described, through UseMiddleware
+func describedProvider() (eventsourcing.EventStore, func(), error) {
+	base := memory.NewStore()
+	wrapped := eventsourcing.NewMiddlewareWrapper(base)
+	errUse := eventsourcing.UseMiddleware(wrapped, CreateMiddleware(Parameters{
+		SnapInterval: 5,
+	}))
+
+	return wrapped, func() {
+		wrapped.Close()
+	}, errUse
+}
+
 // TestStoreCompliance
 func TestStoreCompliance(t *testing.T) {
 	test.CheckStandardSuite(t, "In-Memory Snap Middleware", provider)
 }
 
+// TestDescribedCompliance checks the described middleware behaves the same
+func TestDescribedCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "In-Memory Snap Middleware (described)", describedProvider)
+}
+
+// TestRandomInterleavings checks the store under concurrent, random use
+func TestRandomInterleavings(t *testing.T) {
+	test.CheckRandomInterleavings(t, provider, test.FuzzOptions{})
+}
+
 // BenchmarkIndividualCommmits tests how fast we can apply events to an aggregate
 func BenchmarkIndividualCommmits(b *testing.B) {
 	test.MeasureIndividualCommits(b, provider)
@@ -35,3 +64,206 @@ func BenchmarkIndividualCommmits(b *testing.B) {
 func BenchmarkBulkInsertAndLoad(b *testing.B) {
 	test.MeasureBulkInsertAndReload(b, provider)
 }
+
+// TestEmptyCommitSkipsSnapshot checks that a commit without events doesn't
+// write a snapshot, even for a lazy provider.
+func TestEmptyCommitSkipsSnapshot(t *testing.T) {
+	base := memory.NewStore()
+	wrapped := eventsourcing.NewMiddlewareWrapper(base)
+	wrapped.Use(Create(Parameters{
+		Lazy:         true,
+		SnapInterval: 1,
+	}))
+	defer wrapped.Close()
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("empty-commit", test.GetTestRegistry(), wrapped)
+	assert.Nil(t, agg.Commit())
+
+	// Write to the base store directly: a lazy snap would hide this event
+	direct := test.SimpleAggregate{}
+	direct.Initialize("empty-commit", test.GetTestRegistry(), base)
+	direct.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, direct.Commit())
+
+	reloaded := test.SimpleAggregate{}
+	reloaded.Initialize("empty-commit", test.GetTestRegistry(), wrapped)
+	assert.Nil(t, reloaded.Refresh())
+	assert.Equal(t, int64(1), reloaded.SequenceNumber(), "No snapshot should shadow the stream")
+}
+
+// sameShard finds keys that are held by the same shard of a cache
+func sameShard(cache *Cache, count int) []string {
+	target := cache.shard("key-0")
+	keys := []string{"key-0"}
+	for index := 1; len(keys) < count; index++ {
+		key := fmt.Sprintf("key-%v", index)
+		if cache.shard(key) == target {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// TestEvictEntries checks the least recently used snapshots are evicted beyond
+// the entry limit
+func TestEvictEntries(t *testing.T) {
+	cache := NewCache(Parameters{MaxEntries: 2 * shardCount})
+	keys := sameShard(cache, 3)
+
+	assert.Nil(t, cache.put(keys[0], 1, map[string]interface{}{}))
+	assert.Nil(t, cache.put(keys[1], 1, map[string]interface{}{}))
+	_, seq, _ := cache.get(keys[0])
+	assert.Equal(t, int64(1), seq)
+	assert.Nil(t, cache.put(keys[2], 1, map[string]interface{}{}))
+
+	_, evicted, _ := cache.get(keys[1])
+	assert.Equal(t, int64(0), evicted, "The least recently used snapshot should be evicted")
+	_, kept, _ := cache.get(keys[0])
+	assert.Equal(t, int64(1), kept)
+	assert.Equal(t, Stats{Entries: 2, Evictions: 1}, cache.Stats())
+}
+
+// TestEvictBytes checks snapshots are evicted beyond the size limit, and that
+// purges and replacements are accounted for
+func TestEvictBytes(t *testing.T) {
+	state := map[string]interface{}{"padding": strings.Repeat("x", 100)}
+	size := snapbase.Size(state)
+	cache := NewCache(Parameters{MaxBytes: 2 * size * shardCount})
+	keys := sameShard(cache, 3)
+
+	assert.Nil(t, cache.put(keys[0], 1, state))
+	assert.Nil(t, cache.put(keys[0], 2, state))
+	assert.Nil(t, cache.put(keys[1], 1, state))
+	assert.Equal(t, Stats{Entries: 2, Bytes: 2 * size}, cache.Stats())
+
+	assert.Nil(t, cache.put(keys[2], 1, state))
+	assert.Equal(t, Stats{Entries: 2, Bytes: 2 * size, Evictions: 1}, cache.Stats())
+
+	assert.Nil(t, cache.purge(keys[2]))
+	assert.Equal(t, Stats{Entries: 1, Bytes: size, Evictions: 1}, cache.Stats())
+}
+
+// TestBoundedCompliance checks a bounded cache behaves as a snapshot store
+func TestBoundedCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Bounded In-Memory Snap Middleware", func() (eventsourcing.EventStore, func(), error) {
+		wrapped := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+		wrapped.Use(Create(Parameters{
+			Lazy:         true,
+			SnapInterval: 5,
+			MaxEntries:   shardCount,
+		}))
+		return wrapped, func() {
+			wrapped.Close()
+		}, nil
+	})
+}
+
+// TestReflectCompliance checks the standard suite passes with lazy snapshots
+// cloned by reflection
+func TestReflectCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Reflect-Cloned In-Memory Snap Middleware", func() (eventsourcing.EventStore, func(), error) {
+		wrapped := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+		wrapped.Use(Create(Parameters{
+			Lazy:         true,
+			SnapInterval: 5,
+			Cloner:       snapbase.CloneReflect,
+		}))
+		return wrapped, func() {
+			wrapped.Close()
+		}, nil
+	})
+}
+
+// TestSingleflightInterleavings checks shared refreshes under concurrent,
+// random use
+func TestSingleflightInterleavings(t *testing.T) {
+	test.CheckRandomInterleavings(t, func() (eventsourcing.EventStore, func(), error) {
+		wrapped := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+		wrapped.Use(Create(Parameters{
+			SnapInterval: 5,
+			Singleflight: true,
+		}))
+		return wrapped, func() {
+			wrapped.Close()
+		}, nil
+	}, test.FuzzOptions{})
+}
+
+// TestExpiry checks lazy snapshots expire after their TTL, so changes made
+// elsewhere are seen
+func TestExpiry(t *testing.T) {
+	clock := simclock.New(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	base := memory.NewStore()
+	cache := NewCache(Parameters{
+		Lazy:         true,
+		SnapInterval: 1,
+		TTL:          time.Minute,
+		Clock:        clock,
+	})
+	wrapped := eventsourcing.NewMiddlewareWrapper(base)
+	wrapped.Use(cache.Middleware())
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("expiring", test.GetTestRegistry(), wrapped)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+
+	// Another instance commits to the base store
+	direct := test.SimpleAggregate{}
+	direct.Initialize("expiring", test.GetTestRegistry(), base)
+	assert.Nil(t, direct.Refresh())
+	direct.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, direct.Commit())
+
+	load := func() int {
+		loaded := test.SimpleAggregate{}
+		loaded.Initialize("expiring", test.GetTestRegistry(), wrapped)
+		assert.Nil(t, loaded.Refresh())
+		return loaded.CurrentCount
+	}
+	clock.Advance(59 * time.Second)
+	assert.Equal(t, 1, load(), "The lazy snapshot should still be used")
+
+	clock.Advance(time.Second)
+	assert.Equal(t, 2, load(), "The expired snapshot should be dropped")
+	assert.Equal(t, int64(1), cache.Stats().Expirations)
+}
+
+// TestConditionalPut checks older snapshots never replace newer ones
+func TestConditionalPut(t *testing.T) {
+	cache := NewCache(Parameters{})
+	assert.Nil(t, cache.put("raced", 5, "five"))
+	assert.Nil(t, cache.put("raced", 3, "three"))
+
+	state, seq, _ := cache.get("raced")
+	assert.Equal(t, int64(5), seq, "The older snapshot should be skipped")
+	assert.Equal(t, "five", state)
+
+	assert.Nil(t, cache.put("raced", 5, "rebuilt"))
+	state, _, _ = cache.get("raced")
+	assert.Equal(t, "rebuilt", state, "A snapshot of the same sequence should be replaced")
+}
+
+// TestSnapshotCompliance checks the cache against the snapshot suite
+func TestSnapshotCompliance(t *testing.T) {
+	test.CheckSnapshotSuite(t, "In-Memory Snap Middleware", func(options test.SnapshotOptions) (test.SnapshotStorage, func(), error) {
+		cache := NewCache(Parameters{
+			Lazy:         options.Lazy,
+			SnapInterval: options.SnapInterval,
+		})
+		base := memory.NewStore()
+		wrapped := eventsourcing.NewMiddlewareWrapper(base)
+		wrapped.Use(cache.Middleware())
+
+		return test.SnapshotStorage{
+			Store: wrapped,
+			Inner: base,
+			Get:   cache.get,
+			Put:   cache.put,
+			Purge: cache.purge,
+		}, func() {
+			wrapped.Close()
+		}, nil
+	})
+}
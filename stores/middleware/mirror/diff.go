@@ -0,0 +1,138 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// Diff reads the full stream of an aggregate from both stores, and compares the
+// sequence, type and data of every event. It returns nil if the streams match, and
+// is intended for verifying a secondary store before cutting over to it. Neither
+// store should have snapshot middleware attached.
+func Diff(primary eventsourcing.EventStore, secondary eventsourcing.EventStore, registry eventsourcing.EventRegistry, key string) (*Mismatch, error) {
+	left := newRecorder(key, registry, 0)
+	errLeft := primary.Refresh(left)
+	if errLeft != nil {
+		return nil, errLeft
+	}
+
+	right := newRecorder(key, registry, 0)
+	errRight := secondary.Refresh(right)
+	if errRight != nil {
+		return nil, errRight
+	}
+
+	mismatch := func(detail string, args ...interface{}) *Mismatch {
+		return &Mismatch{
+			Key:               key,
+			PrimarySequence:   left.sequence,
+			SecondarySequence: right.sequence,
+			Detail:            fmt.Sprintf(detail, args...),
+		}
+	}
+	if left.snapshot || right.snapshot {
+		return nil, fmt.Errorf("mirror: cannot compare %v, a snapshot was restored", key)
+	}
+	if len(left.records) != len(right.records) {
+		return mismatch("Primary has %v events, secondary has %v", len(left.records), len(right.records)), nil
+	}
+
+	for index, expected := range left.records {
+		actual := right.records[index]
+		if expected.sequence != actual.sequence {
+			return mismatch("Event %v has sequence %v in primary, %v in secondary", index, expected.sequence, actual.sequence), nil
+		}
+		if expected.eventType != actual.eventType {
+			return mismatch("Event %v is %v in primary, %v in secondary", expected.sequence, expected.eventType, actual.eventType), nil
+		}
+		if expected.data != actual.data {
+			return mismatch("Event %v has data %v in primary, %v in secondary", expected.sequence, expected.data, actual.data), nil
+		}
+	}
+
+	if left.sequence != right.sequence {
+		return mismatch("Sequence differs"), nil
+	}
+	return nil, nil
+}
+
+// record is an event replayed by a recorder
+type record struct {
+	sequence  int64
+	eventType eventsourcing.EventType
+	data      string
+}
+
+// recorder is a loader adapter that records the events replayed, rather than
+// applying them to an aggregate.
+type recorder struct {
+	key      string
+	registry eventsourcing.EventRegistry
+	sequence int64
+	records  []record
+	snapshot bool // Set if a snapshot was restored
+}
+
+// newRecorder creates a recorder that loads from a sequence
+func newRecorder(key string, registry eventsourcing.EventRegistry, sequence int64) *recorder {
+	return &recorder{
+		key:      key,
+		registry: registry,
+		sequence: sequence,
+		records:  make([]record, 0),
+	}
+}
+
+// GetKey gets the key of the aggregate
+func (loader *recorder) GetKey() string {
+	return loader.key
+}
+
+// GetEventRegistry gets the event registry of the aggregate
+func (loader *recorder) GetEventRegistry() eventsourcing.EventRegistry {
+	return loader.registry
+}
+
+// SequenceNumber gets the sequence loaded up to
+func (loader *recorder) SequenceNumber() int64 {
+	return loader.sequence
+}
+
+// IsDirty returns false, as nothing is modified
+func (loader *recorder) IsDirty() bool {
+	return false
+}
+
+// ReplayEvent records an event
+func (loader *recorder) ReplayEvent(event eventsourcing.Event) {
+	loader.sequence++
+	eventType, _ := loader.registry.GetEventType(event)
+	data, errData := json.Marshal(event)
+	if errData != nil {
+		data = []byte(errData.Error())
+	}
+
+	loader.records = append(loader.records, record{
+		sequence:  loader.sequence,
+		eventType: eventType,
+		data:      string(data),
+	})
+}
+
+// AdvanceSequence skips forward over a gap in the stream
+func (loader *recorder) AdvanceSequence(sequence int64) error {
+	if sequence < loader.sequence {
+		return fmt.Errorf("Cannot move aggregate %v backwards from %v to %v", loader.key, loader.sequence, sequence)
+	}
+	loader.sequence = sequence
+	return nil
+}
+
+// RestoreSnapshot moves to the sequence of a snapshot
+func (loader *recorder) RestoreSnapshot(sequence int64, snapshot interface{}) error {
+	loader.sequence = sequence
+	loader.snapshot = true
+	return nil
+}
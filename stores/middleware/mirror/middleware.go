@@ -0,0 +1,287 @@
+/*
+Package mirror contains a dual-write middleware for migrating between stores without
+downtime. Commits accepted by the primary store are written to a secondary store as
+well, either before the commit returns (Sync) or by a background worker (Async), while
+reads continue to come from the primary:
+
+	commit, refresh, cleanup := mirror.Create(mirror.Options{Secondary: postgres, Compare: true})
+	mongo.Use(commit, refresh, cleanup)
+
+Failures to write to the secondary never fail the commit, as the primary remains the
+source of truth, but are reported through OnError. With Compare set, every refresh is
+repeated against the secondary and differences in the resulting sequence are reported
+through OnMismatch; in Async mode the secondary may briefly lag, so such mismatches
+can be transient. Before cutting over, Diff compares the events of each stream in
+full.
+
+Streams that existed before mirroring began must be copied to the secondary
+separately, as commits to them are only mirrored once the secondary holds their
+earlier events.
+*/
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// DefaultQueueSize is the number of commits held for the background worker before
+// commits block, if no other size is specified.
+const DefaultQueueSize = 1000
+
+// errClosed is reported for commits once the middleware has been closed
+var errClosed = fmt.Errorf("mirror: middleware is closed")
+
+// Mode decides when commits are written to the secondary store.
+type Mode int
+
+// Modes of mirroring.
+const (
+	Async Mode = iota // Commits are queued, and written by a background worker
+	Sync              // Commits are written before the commit returns
+)
+
+// Mismatch describes a difference between the primary and secondary stores.
+type Mismatch struct {
+	Key               string // Aggregate key
+	PrimarySequence   int64  // Sequence in the primary store
+	SecondarySequence int64  // Sequence in the secondary store
+	Detail            string // Description of the difference
+}
+
+// Options configures the mirroring middleware.
+type Options struct {
+	Secondary  eventsourcing.EventStore    // Store commits are mirrored to, which is required
+	Mode       Mode                        // When commits are mirrored, Async by default
+	QueueSize  int                         // Commits held for the background worker, DefaultQueueSize by default
+	Compare    bool                        // Repeat refreshes against the secondary, and report mismatches
+	OnError    func(key string, err error) // Called when a commit can't be mirrored, logged by default
+	OnMismatch func(mismatch Mismatch)     // Called when a refresh differs, logged by default
+	Logger     eventsourcing.Logger        // Logger for the default OnError and OnMismatch, eventsourcing.DefaultLogger() by default
+}
+
+// mirror holds the state of the middleware
+type mirror struct {
+	options Options
+	lock    sync.RWMutex
+	closed  bool
+	queue   chan *frozenWriter
+	done    chan struct{}
+}
+
+// Create a new mirroring middleware. Closing it waits for queued commits to be
+// mirrored, but does not close the secondary store.
+func Create(options Options) (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
+	if options.Secondary == nil {
+		panic("mirror: a secondary store is required")
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultQueueSize
+	}
+	if options.Logger == nil {
+		options.Logger = eventsourcing.DefaultLogger()
+	}
+	logger := options.Logger
+	if options.OnError == nil {
+		options.OnError = func(key string, err error) {
+			logger.Error("mirror_commit_error", eventsourcing.LogFields{
+				"key":   key,
+				"error": err,
+			})
+		}
+	}
+	if options.OnMismatch == nil {
+		options.OnMismatch = func(mismatch Mismatch) {
+			logger.Warn("mirror_mismatch: "+mismatch.Detail, eventsourcing.LogFields{
+				"key":                mismatch.Key,
+				"primary_sequence":   mismatch.PrimarySequence,
+				"secondary_sequence": mismatch.SecondarySequence,
+			})
+		}
+	}
+
+	instance := &mirror{
+		options: options,
+		done:    make(chan struct{}),
+	}
+	if options.Mode == Async {
+		instance.queue = make(chan *frozenWriter, options.QueueSize)
+		go instance.run()
+	} else {
+		close(instance.done)
+	}
+
+	return instance.commit, instance.refresh, instance.close
+}
+
+// commit mirrors events once the primary store has accepted them.
+func (instance *mirror) commit(writer eventsourcing.StoreWriterAdapter, next eventsourcing.NextHandler) error {
+	if eventsourcing.IsNoOp(writer) {
+		return next()
+	}
+
+	errNext := next()
+	if errNext != nil {
+		return errNext
+	}
+
+	frozen, errFreeze := freeze(writer, instance.options.Mode == Async)
+	if errFreeze != nil {
+		instance.options.OnError(writer.GetKey(), errFreeze)
+		return nil
+	}
+
+	if instance.options.Mode == Sync {
+		instance.write(frozen)
+		return nil
+	}
+
+	instance.lock.RLock()
+	defer instance.lock.RUnlock()
+	if instance.closed {
+		instance.options.OnError(frozen.key, errClosed)
+		return nil
+	}
+	instance.queue <- frozen
+	return nil
+}
+
+// refresh loads from the primary store, and compares the result with the secondary
+// if required.
+func (instance *mirror) refresh(loader eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+	if !instance.options.Compare {
+		return next()
+	}
+
+	from := loader.SequenceNumber()
+	errNext := next()
+	if errNext != nil {
+		return errNext
+	}
+
+	secondary := newRecorder(loader.GetKey(), loader.GetEventRegistry(), from)
+	errSecondary := instance.options.Secondary.Refresh(secondary)
+	if errSecondary != nil {
+		instance.options.OnError(loader.GetKey(), errSecondary)
+		return nil
+	}
+
+	if secondary.sequence != loader.SequenceNumber() {
+		instance.options.OnMismatch(Mismatch{
+			Key:               loader.GetKey(),
+			PrimarySequence:   loader.SequenceNumber(),
+			SecondarySequence: secondary.sequence,
+			Detail:            "Sequence differs",
+		})
+	}
+	return nil
+}
+
+// write commits events to the secondary store, reporting any failure
+func (instance *mirror) write(frozen *frozenWriter) {
+	errCommit := instance.options.Secondary.CommitEvents(frozen)
+	if errCommit != nil {
+		instance.options.OnError(frozen.key, errCommit)
+	}
+}
+
+// run mirrors queued commits in the order they were made.
+func (instance *mirror) run() {
+	defer close(instance.done)
+	for frozen := range instance.queue {
+		instance.write(frozen)
+	}
+}
+
+// close stops accepting commits, and waits for queued commits to be mirrored.
+func (instance *mirror) close() error {
+	instance.lock.Lock()
+	if !instance.closed && instance.queue != nil {
+		close(instance.queue)
+	}
+	instance.closed = true
+	instance.lock.Unlock()
+
+	<-instance.done
+	return nil
+}
+
+// frozenWriter is a copy of a commit, which remains unchanged after the aggregate
+// moves on.
+type frozenWriter struct {
+	key      string
+	registry eventsourcing.EventRegistry
+	sequence int64
+	events   []eventsourcing.Event
+	state    interface{}
+	metadata map[string]interface{}
+}
+
+// freeze copies a commit. Asynchronous copies also take a copy of the state, as
+// the aggregate may change before they are written.
+func freeze(writer eventsourcing.StoreWriterAdapter, copyState bool) (*frozenWriter, error) {
+	sequence, events := writer.GetUncommittedEvents()
+	frozen := &frozenWriter{
+		key:      writer.GetKey(),
+		registry: writer.GetEventRegistry(),
+		sequence: sequence,
+		events:   append([]eventsourcing.Event{}, events...),
+		state:    writer.GetState(),
+	}
+	if adapter, ok := writer.(eventsourcing.MetadataAdapter); ok {
+		frozen.metadata = adapter.GetEventMetadata()
+	}
+
+	if copyState {
+		encoded, errEncode := json.Marshal(frozen.state)
+		if errEncode != nil {
+			return nil, errEncode
+		}
+		state := make(map[string]interface{})
+		errDecode := json.Unmarshal(encoded, &state)
+		if errDecode != nil {
+			return nil, errDecode
+		}
+		frozen.state = state
+	}
+
+	return frozen, nil
+}
+
+// GetKey gets the key of the aggregate
+func (frozen *frozenWriter) GetKey() string {
+	return frozen.key
+}
+
+// GetEventRegistry gets the event registry of the aggregate
+func (frozen *frozenWriter) GetEventRegistry() eventsourcing.EventRegistry {
+	return frozen.registry
+}
+
+// SequenceNumber gets the sequence of the aggregate, including the events
+func (frozen *frozenWriter) SequenceNumber() int64 {
+	return frozen.sequence + int64(len(frozen.events))
+}
+
+// IsDirty returns true, as the events are uncommitted in the secondary
+func (frozen *frozenWriter) IsDirty() bool {
+	return true
+}
+
+// GetUncommittedEvents gets the events to mirror
+func (frozen *frozenWriter) GetUncommittedEvents() (int64, []eventsourcing.Event) {
+	return frozen.sequence, frozen.events
+}
+
+// GetState gets the state of the aggregate after the events
+func (frozen *frozenWriter) GetState() interface{} {
+	return frozen.state
+}
+
+// GetEventMetadata gets the metadata recorded with the events
+func (frozen *frozenWriter) GetEventMetadata() map[string]interface{} {
+	return frozen.metadata
+}
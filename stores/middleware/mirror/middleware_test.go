@@ -0,0 +1,132 @@
+package mirror
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+)
+
+func provider() (eventsourcing.EventStore, func(), error) {
+	base := memory.NewStore()
+	wrapped := eventsourcing.NewMiddlewareWrapper(base)
+	wrapped.Use(Create(Options{Secondary: memory.NewStore(), Mode: Sync, Compare: true}))
+
+	return wrapped, func() {
+		wrapped.Close()
+	}, nil
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Mirror Middleware", provider)
+}
+
+// failingStore is a store that rejects commits
+type failingStore struct {
+	eventsourcing.EventStore
+}
+
+func (store *failingStore) CommitEvents(writer eventsourcing.StoreWriterAdapter) error {
+	return errors.New("Secondary unavailable")
+}
+
+// increment commits events to an aggregate through a store
+func increment(t *testing.T, store eventsourcing.EventStore, key string, by ...int) *test.SimpleAggregate {
+	agg := &test.SimpleAggregate{}
+	agg.Initialize(key, test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	for _, value := range by {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: value})
+	}
+	assert.Nil(t, agg.Commit())
+	return agg
+}
+
+// load refreshes an aggregate from a store
+func load(t *testing.T, store eventsourcing.EventStore, key string) *test.SimpleAggregate {
+	agg := &test.SimpleAggregate{}
+	agg.Initialize(key, test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	return agg
+}
+
+// TestMirrorModes checks commits reach the secondary in both modes
+func TestMirrorModes(t *testing.T) {
+	for _, mode := range []Mode{Sync, Async} {
+		primary := memory.NewStore()
+		secondary := memory.NewStore()
+		store := eventsourcing.NewMiddlewareWrapper(primary)
+		commit, refresh, cleanup := Create(Options{Secondary: secondary, Mode: mode})
+		store.Use(commit, refresh, nil)
+
+		increment(t, store, "mirrored", 1, 2)
+		increment(t, store, "mirrored", 3)
+		assert.Nil(t, cleanup(), "Closing should wait for queued commits")
+
+		mirrored := load(t, secondary, "mirrored")
+		assert.Equal(t, 6, mirrored.CurrentCount)
+		assert.Equal(t, int64(3), mirrored.SequenceNumber())
+
+		mismatch, errDiff := Diff(primary, secondary, test.GetTestRegistry(), "mirrored")
+		assert.Nil(t, errDiff)
+		assert.Nil(t, mismatch)
+	}
+}
+
+// TestMirrorFailure checks secondary failures are reported, not returned
+func TestMirrorFailure(t *testing.T) {
+	failed := make([]string, 0)
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(Options{
+		Secondary: &failingStore{EventStore: memory.NewStore()},
+		Mode:      Sync,
+		OnError:   func(key string, err error) { failed = append(failed, key) },
+	}))
+
+	agg := increment(t, store, "unmirrored", 1)
+	assert.Equal(t, int64(1), agg.SequenceNumber())
+	assert.Equal(t, []string{"unmirrored"}, failed)
+}
+
+// TestCompareMismatch checks refreshes report a secondary that is behind
+func TestCompareMismatch(t *testing.T) {
+	primary := memory.NewStore()
+	increment(t, primary, "behind", 1, 1)
+
+	mismatches := make([]Mismatch, 0)
+	store := eventsourcing.NewMiddlewareWrapper(primary)
+	store.Use(Create(Options{
+		Secondary:  memory.NewStore(),
+		Mode:       Sync,
+		Compare:    true,
+		OnMismatch: func(mismatch Mismatch) { mismatches = append(mismatches, mismatch) },
+	}))
+
+	agg := load(t, store, "behind")
+	assert.Equal(t, 2, agg.CurrentCount, "Reads should come from the primary")
+	assert.Equal(t, []Mismatch{{Key: "behind", PrimarySequence: 2, SecondarySequence: 0, Detail: "Sequence differs"}}, mismatches)
+}
+
+// TestDiff checks differences in event data are found
+func TestDiff(t *testing.T) {
+	primary := memory.NewStore()
+	secondary := memory.NewStore()
+	increment(t, primary, "diverged", 1, 2)
+	increment(t, secondary, "diverged", 1, 5)
+
+	mismatch, errDiff := Diff(primary, secondary, test.GetTestRegistry(), "diverged")
+	assert.Nil(t, errDiff)
+	assert.NotNil(t, mismatch)
+	assert.Contains(t, mismatch.Detail, "Event 2 has data")
+
+	increment(t, primary, "short", 1, 2)
+	increment(t, secondary, "short", 1)
+	mismatch, errDiff = Diff(primary, secondary, test.GetTestRegistry(), "short")
+	assert.Nil(t, errDiff)
+	assert.Equal(t, "Primary has 2 events, secondary has 1", mismatch.Detail)
+}
@@ -1,16 +1,17 @@
 package mongosnap
 
 import (
-	mgo "github.com/globalsign/mgo"
-	"github.com/globalsign/mgo/bson"
+	"context"
+	"time"
+
 	"github.com/go-gadgets/eventsourcing"
 	"github.com/go-gadgets/eventsourcing/stores/middleware/snapbase"
+	"github.com/go-gadgets/eventsourcing/utilities/mongodoc"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func init() {
-	bson.SetJSONTagFallback(true)
-}
-
 // Snapshot is the current snapshot for an entity, a JSON structure
 // that can be persisted to the Mongo instance.
 type snapshot struct {
@@ -20,75 +21,153 @@ type snapshot struct {
 
 // Endpoint configuration
 type Endpoint struct {
-	DialURL        string `json:"dial_url"`        // DialURL is the mgo URL to use when connecting to the cluster
-	DatabaseName   string `json:"database_name"`   // DatabaseName is the database to create/connect to.
-	CollectionName string `json:"collection_name"` // CollectionName is the collection name to put new documents in to
+	DialURL        string        `json:"dial_url"`        // DialURL is the connection string to use when connecting to the cluster
+	DatabaseName   string        `json:"database_name"`   // DatabaseName is the database to create/connect to.
+	CollectionName string        `json:"collection_name"` // CollectionName is the collection name to put new documents in to
+	Timeout        time.Duration `json:"timeout"`         // Timeout is the longest an operation may take, zero for no limit
 }
 
 // Parameters describes the parameters that can be
 // used to cofigure a MongoDB snap store.
 type Parameters struct {
-	Lazy         bool  // Lazy mode?
-	SnapInterval int64 `json:"snap_interval"` // SnapInterval is the number of events between snaps
+	Lazy             bool                      // Lazy mode?
+	SnapInterval     int64                     `json:"snap_interval"`      // SnapInterval is the number of events between snaps
+	Strategy         snapbase.SnapshotStrategy `json:"-"`                  // Strategy decides when to snap, every SnapInterval events by default
+	MaxSnapshotBytes int64                     `json:"max_snapshot_bytes"` // MaxSnapshotBytes is the largest snapshot to write or restore, zero for no limit
+	OnTooLarge       snapbase.TooLargeCallback `json:"-"`                  // OnTooLarge decides what happens to oversized snapshots on refresh
+	Compressor       snapbase.Compressor       `json:"-"`                  // Compressor compresses snapshots before they are written (snapbase.Gzip, snapbase.Zstd), nil for none
+	Keys             snapbase.KeyProvider      `json:"-"`                  // Keys encrypt snapshots before they are written (see snapbase.KeyProvider), nil for none
+	Async            bool                      `json:"async"`              // Async writes snapshots in the background, coalescing them by key
+	OnError          snapbase.ErrorCallback    `json:"-"`                  // OnError is called when a background snapshot write fails
+	SnapOnReadAfter  int64                     `json:"snap_on_read_after"` // SnapOnReadAfter snaps after a refresh that replays more events than this, zero to snap only on commit
+	Singleflight     bool                      `json:"singleflight"`       // Singleflight shares the work of concurrent refreshes of the same aggregate, so only one reads the snapshot and replays events
+	Admin            *snapbase.Admin           `json:"-"`                  // Admin administers the snapshots of the provider (see snapbase.NewAdmin), nil for none
+	Cloner           snapbase.Cloner           `json:"-"`                  // Cloner copies states into snapshots (snapbase.CloneJSON, snapbase.CloneReflect), CloneJSON by default
+	Metrics          *snapbase.Metrics         `json:"-"`                  // Metrics counts how refreshes use snapshots (see snapbase.NewMetrics), nil for none
+	Transactions     *mongodoc.Transactions    `json:"-"`                  // Transactions commit snapshots with the events of a Mongo store sharing them (see mongo.NewStoreWithTransactions), nil to write them after
 }
 
 // instance is our storage provider for managing snapshots in memory
 type instance struct {
-	session    *mgo.Session
-	collection *mgo.Collection
+	collection *mongo.Collection
 	params     Parameters
+	ctx        context.Context // Context of operations, cancelled when the provider is closed
 }
 
 // Create provisions a new instance of the memory-snap provider.
 func Create(params Parameters, endpoint Endpoint) (eventsourcing.MiddlewareFactory, error) {
 	// Connect to the MongoDB services
-	session, errSession := mgo.Dial(endpoint.DialURL)
-	if errSession != nil {
-		return nil, errSession
+	client, errDial := mongodoc.Dial(endpoint.DialURL, endpoint.Timeout)
+	if errDial != nil {
+		return nil, errDial
+	}
+
+	collection := mongodoc.Collection(client.Database(endpoint.DatabaseName), endpoint.CollectionName)
+	return CreateWithConnection(params, client, collection), nil
+}
+
+// CreateMiddleware provisions a new instance of the mongo-snap provider, described
+// for eventsourcing.UseMiddleware.
+func CreateMiddleware(params Parameters, endpoint Endpoint) (eventsourcing.Middleware, error) {
+	factory, errFactory := Create(params, endpoint)
+	if errFactory != nil {
+		return eventsourcing.Middleware{}, errFactory
 	}
+	return describe(params, factory), nil
+}
 
-	database := session.DB(endpoint.DatabaseName)
-	collection := database.C(endpoint.CollectionName)
+// CreateMiddlewareWithConnection provisions a new instance of the mongo-snap
+// provider using an existing client and collection, described for
+// eventsourcing.UseMiddleware.
+func CreateMiddlewareWithConnection(params Parameters, client *mongo.Client, collection *mongo.Collection) eventsourcing.Middleware {
+	return describe(params, CreateWithConnection(params, client, collection))
+}
 
-	return CreateWithConnection(params, session, collection), nil
+// describe describes the middleware of a provider: snapshots kept in MongoDB are
+// Durable, and Caching when lazy.
+func describe(params Parameters, factory eventsourcing.MiddlewareFactory) eventsourcing.Middleware {
+	capabilities := eventsourcing.Durable
+	if params.Lazy {
+		capabilities |= eventsourcing.Caching
+	}
+	commit, refresh, cleanup := factory()
+	return eventsourcing.Describe("mongosnap", capabilities, commit, refresh, cleanup)
 }
 
 // CreateWithConnection provisions a new instance of the memory-snap provider using
-// an existing connection and session
-func CreateWithConnection(params Parameters, session *mgo.Session, collection *mgo.Collection) eventsourcing.MiddlewareFactory {
+// an existing client and collection. Snapshots are written in the format of earlier
+// versions (see mongodoc), whatever the registry of the client.
+func CreateWithConnection(params Parameters, client *mongo.Client, collection *mongo.Collection) eventsourcing.MiddlewareFactory {
+	ctx, cancel := context.WithCancel(context.Background())
 	snaps := &instance{
-		session:    session,
-		collection: collection,
+		collection: mongodoc.Adopt(collection),
 		params:     params,
+		ctx:        ctx,
 	}
 
 	return func() (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, eventsourcing.CloseMiddleware) {
-		return snapbase.Create(snapbase.Parameters{
-			Lazy:         params.Lazy,
-			SnapInterval: params.SnapInterval,
+		commit, refresh, cleanup := snapbase.Create(snapbase.Parameters{
+			Lazy:             params.Lazy,
+			SnapInterval:     params.SnapInterval,
+			Strategy:         params.Strategy,
+			MaxSnapshotBytes: params.MaxSnapshotBytes,
+			OnTooLarge:       params.OnTooLarge,
+			Compressor:       params.Compressor,
+			Keys:             params.Keys,
+			Async:            params.Async,
+			OnError:          params.OnError,
+			SnapOnReadAfter:  params.SnapOnReadAfter,
+			Singleflight:     params.Singleflight,
+			Admin:            params.Admin,
+			Cloner:           params.Cloner,
+			Metrics:          params.Metrics,
 			Close: func() error {
-				session.Close()
-				return nil
+				cancel()
+				return disconnect(client)
 			},
 			Get:   snaps.get,
 			Purge: snaps.purge,
 			Put:   snaps.put,
 		})
+
+		// Snapshots written in the background can't join the commit
+		if !params.Transactions.Supported() || params.Async {
+			return commit, refresh, cleanup
+		}
+		return transactional(params.Transactions, commit), refresh, cleanup
+	}
+}
+
+// transactional runs commits in a transaction, which the events written by the
+// store and the snapshot written after them both join.
+func transactional(transactions *mongodoc.Transactions, commit eventsourcing.CommitMiddleware) eventsourcing.CommitMiddleware {
+	return func(writer eventsourcing.StoreWriterAdapter, next eventsourcing.NextHandler) error {
+		sequence, events := writer.GetUncommittedEvents()
+		return transactions.Run(writer.GetKey(), sequence+int64(len(events)), func() error {
+			return commit(writer, next)
+		})
 	}
 }
 
+// disconnect disconnects a client, unless the store sharing it already has.
+func disconnect(client *mongo.Client) error {
+	errDisconnect := client.Disconnect(context.Background())
+	if errDisconnect == mongo.ErrClientDisconnected {
+		return nil
+	}
+	return errDisconnect
+}
+
 // get a key from the cache
 func (mw *instance) get(key string) (interface{}, int64, error) {
 	var loaded snapshot
-	errLoad := mw.collection.Find(
+	errLoad := mw.collection.FindOne(mw.ctx,
 		bson.M{
 			"_id": key,
 		},
-	).
-		Sort("-sequence").
-		One(&loaded)
+	).Decode(&loaded)
 
-	if errLoad != nil && errLoad != mgo.ErrNotFound {
+	if errLoad != nil && errLoad != mongo.ErrNoDocuments {
 		return nil, 0, errLoad
 	}
 
@@ -97,7 +176,7 @@ func (mw *instance) get(key string) (interface{}, int64, error) {
 
 // purge a key from the cache
 func (mw *instance) purge(key string) error {
-	errPurge := mw.collection.Remove(
+	_, errPurge := mw.collection.DeleteOne(mw.ctx,
 		bson.M{
 			"_id": key,
 		},
@@ -105,12 +184,66 @@ func (mw *instance) purge(key string) error {
 	return errPurge
 }
 
-// put an item into the cache
+// put an item into the cache, unless a newer snapshot is held
 func (mw *instance) put(key string, seq int64, data interface{}) error {
-	_, errSnap := mw.collection.UpsertId(key, snapshot{
-		Sequence: seq,
-		State:    data,
-	})
+	ctx := mw.params.Transactions.Context(key, seq, mw.ctx)
+	if ctx != mw.ctx {
+		return mw.putInTransaction(ctx, key, seq, data)
+	}
 
+	_, errSnap := mw.collection.ReplaceOne(mw.ctx,
+		bson.M{
+			"_id":      key,
+			"sequence": bson.M{"$lte": seq},
+		},
+		snapshot{
+			Sequence: seq,
+			State:    data,
+		},
+		options.Replace().SetUpsert(true),
+	)
+
+	// A newer snapshot doesn't match, so the upsert collides with it
+	if mongo.IsDuplicateKeyError(errSnap) {
+		return nil
+	}
+	return errSnap
+}
+
+// putInTransaction puts an item into the cache within the transaction of a commit.
+// A colliding upsert would abort the transaction, so the held snapshot is read
+// first, and only replaced if it is older.
+func (mw *instance) putInTransaction(ctx context.Context, key string, seq int64, data interface{}) error {
+	held := snapshot{}
+	errHeld := mw.collection.FindOne(ctx,
+		bson.M{
+			"_id": key,
+		},
+		options.FindOne().SetProjection(bson.M{"sequence": 1}),
+	).Decode(&held)
+
+	switch {
+	case errHeld == mongo.ErrNoDocuments:
+		_, errInsert := mw.collection.InsertOne(ctx, bson.M{
+			"_id":      key,
+			"sequence": seq,
+			"state":    data,
+		})
+		return errInsert
+	case errHeld != nil:
+		return errHeld
+	case held.Sequence > seq:
+		return nil
+	}
+
+	_, errSnap := mw.collection.ReplaceOne(ctx,
+		bson.M{
+			"_id": key,
+		},
+		snapshot{
+			Sequence: seq,
+			State:    data,
+		},
+	)
 	return errSnap
 }
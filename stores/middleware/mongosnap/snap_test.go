@@ -1,17 +1,25 @@
 package mongosnap
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
 
 	"github.com/go-gadgets/eventsourcing"
 	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/snapbase"
+	"github.com/go-gadgets/eventsourcing/utilities/mongodoc"
 	"github.com/go-gadgets/eventsourcing/utilities/test"
 	uuid "github.com/satori/go.uuid"
 )
 
 func provider() (eventsourcing.EventStore, func(), error) {
+	return compressedProvider(nil)
+}
+
+// compressedProvider creates a store whose snapshots are compressed
+func compressedProvider(compressor snapbase.Compressor) (eventsourcing.EventStore, func(), error) {
 	collectionName := fmt.Sprintf("%s", uuid.NewV4())
 	dial := os.Getenv("MONGO_TEST_HOST")
 	if dial == "" {
@@ -22,6 +30,7 @@ func provider() (eventsourcing.EventStore, func(), error) {
 	wrapped := eventsourcing.NewMiddlewareWrapper(base)
 	mw, err := Create(Parameters{
 		SnapInterval: 5,
+		Compressor:   compressor,
 	}, Endpoint{
 		DialURL:        dial,
 		DatabaseName:   "TestDatabase",
@@ -42,6 +51,13 @@ func TestStoreCompliance(t *testing.T) {
 	test.CheckStandardSuite(t, "MongoDB Snap Middleware", provider)
 }
 
+// TestCompressedCompliance checks compressed snapshots round-trip through MongoDB
+func TestCompressedCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "MongoDB Snap Middleware (gzip)", func() (eventsourcing.EventStore, func(), error) {
+		return compressedProvider(snapbase.Gzip())
+	})
+}
+
 // BenchmarkIndividualCommmits tests how fast we can apply events to an aggregate
 func BenchmarkIndividualCommmits(b *testing.B) {
 	test.MeasureIndividualCommits(b, provider)
@@ -52,3 +68,38 @@ func BenchmarkIndividualCommmits(b *testing.B) {
 func BenchmarkBulkInsertAndLoad(b *testing.B) {
 	test.MeasureBulkInsertAndReload(b, provider)
 }
+
+// TestSnapshotCompliance checks MongoDB against the snapshot suite
+func TestSnapshotCompliance(t *testing.T) {
+	test.CheckSnapshotSuite(t, "MongoDB Snap Middleware", func(options test.SnapshotOptions) (test.SnapshotStorage, func(), error) {
+		dial := os.Getenv("MONGO_TEST_HOST")
+		if dial == "" {
+			dial = "mongodb://localhost:27017"
+		}
+		client, errDial := mongodoc.Dial(dial, 0)
+		if errDial != nil {
+			return test.SnapshotStorage{}, nil, errDial
+		}
+
+		params := Parameters{
+			Lazy:         options.Lazy,
+			SnapInterval: options.SnapInterval,
+		}
+		collection := mongodoc.Collection(client.Database("TestDatabase"), fmt.Sprintf("%s", uuid.NewV4()))
+		snaps := &instance{collection: collection, params: params, ctx: context.Background()}
+		base := memory.NewStore()
+		wrapped := eventsourcing.NewMiddlewareWrapper(base)
+		wrapped.Use(CreateWithConnection(params, client, collection)())
+
+		return test.SnapshotStorage{
+			Store: wrapped,
+			Inner: base,
+			Get:   snaps.get,
+			Put:   snaps.put,
+			Purge: snaps.purge,
+		}, func() {
+			collection.Drop(context.Background())
+			wrapped.Close()
+		}, nil
+	})
+}
@@ -0,0 +1,116 @@
+package outbox
+
+import (
+	"fmt"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// Options configures the outbox middleware.
+type Options struct {
+	OnError func(error)          // Called when an entry can't be published or removed, logs by default
+	Logger  eventsourcing.Logger // Logger for the default OnError, eventsourcing.DefaultLogger() by default
+	Clock   eventsourcing.Clock  // Source of time for entries, the system clock by default
+}
+
+// Create a new outbox middleware. The events of a commit are added to the outbox
+// before the commit is written, and a commit whose entries can't be added fails
+// without being written. Once the commit succeeds the events are published, and
+// their entries removed; if the commit fails the entries are removed unpublished.
+//
+// Entries are left in the outbox if publishing fails, or the process dies during a
+// commit, for the relay to confirm and publish (see CreateRelay). Failures to
+// publish are reported to OnError rather than failing the commit, since the events
+// have been committed.
+func Create(outbox Outbox, publisher eventsourcing.EventPublisher, options Options) (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
+	if options.Logger == nil {
+		options.Logger = eventsourcing.DefaultLogger()
+	}
+	if options.OnError == nil {
+		logger := options.Logger
+		options.OnError = func(err error) {
+			logger.Error("outbox_publish_error", eventsourcing.LogFields{"error": err})
+		}
+	}
+	if options.Clock == nil {
+		options.Clock = eventsourcing.SystemClock
+	}
+
+	return func(writer eventsourcing.StoreWriterAdapter, next eventsourcing.NextHandler) error {
+			if eventsourcing.IsNoOp(writer) {
+				return next()
+			}
+
+			// Record the publications ahead of the commit
+			entries := newEntries(writer, options.Clock)
+			errAdd := outbox.Add(entries)
+			if errAdd != nil {
+				return errAdd
+			}
+
+			errNext := next()
+			if errNext != nil {
+				errRemove := outbox.Remove(entryIDs(entries))
+				if errRemove != nil {
+					options.OnError(errRemove)
+				}
+				return errNext
+			}
+
+			// Publish in order, leaving the rest to the relay if one fails
+			published := 0
+			for _, entry := range entries {
+				errPublish := publisher.Publish(entry.Key, entry.Sequence, entry.Event)
+				if errPublish != nil {
+					options.OnError(errPublish)
+					break
+				}
+				published++
+			}
+
+			errRemove := outbox.Remove(entryIDs(entries[:published]))
+			if errRemove != nil {
+				options.OnError(errRemove)
+			}
+			return nil
+		}, func(reader eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+			// Call next directly
+			return next()
+		}, func() error {
+			return nil
+		}
+}
+
+// newEntries creates the outbox entries for the events of a commit. IDs are unique
+// to the attempt, so that a failed attempt can't remove the entries of another
+// writer that commits the same sequence.
+func newEntries(writer eventsourcing.StoreWriterAdapter, clock eventsourcing.Clock) []Entry {
+	key := writer.GetKey()
+	seq, events := writer.GetUncommittedEvents()
+	attempt := uuid.NewV4()
+	added := clock.Now()
+
+	entries := make([]Entry, 0, len(events))
+	for index, event := range events {
+		sequence := seq + int64(1+index)
+		entries = append(entries, Entry{
+			ID:       fmt.Sprintf("%v/%v/%v", key, sequence, attempt),
+			Key:      key,
+			Sequence: sequence,
+			Event:    event,
+			Added:    added,
+		})
+	}
+	return entries
+}
+
+// entryIDs gets the IDs of entries
+func entryIDs(entries []Entry) []string {
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
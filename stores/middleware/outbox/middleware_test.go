@@ -0,0 +1,188 @@
+package outbox
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/simclock"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// publication is an event received by a publisher
+type publication struct {
+	key      string
+	sequence int64
+}
+
+// recordingPublisher records publications, and can be set to fail
+type recordingPublisher struct {
+	lock      sync.Mutex
+	published []publication
+	fail      bool
+}
+
+func (publisher *recordingPublisher) Publish(key string, sequence int64, event eventsourcing.Event) error {
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+	if publisher.fail {
+		return errors.New("Publisher unavailable")
+	}
+	publisher.published = append(publisher.published, publication{key: key, sequence: sequence})
+	return nil
+}
+
+func (publisher *recordingPublisher) received() []publication {
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+	return append([]publication{}, publisher.published...)
+}
+
+// rejectingStore is a store that rejects commits
+type rejectingStore struct {
+	eventsourcing.EventStore
+}
+
+func (store rejectingStore) CommitEvents(writer eventsourcing.StoreWriterAdapter) error {
+	return errors.New("Store unavailable")
+}
+
+// wrap attaches the outbox middleware to a store
+func wrap(inner eventsourcing.EventStore, outbox Outbox, publisher eventsourcing.EventPublisher, clock eventsourcing.Clock) eventsourcing.EventStore {
+	store := eventsourcing.NewMiddlewareWrapper(inner)
+	store.Use(Create(outbox, publisher, Options{Clock: clock, OnError: func(error) {}}))
+	return store
+}
+
+// commit commits increments to an aggregate
+func commit(store eventsourcing.EventStore, key string, by ...int) error {
+	agg := &test.SimpleAggregate{}
+	agg.Initialize(key, test.GetTestRegistry(), store)
+	if errRefresh := agg.Refresh(); errRefresh != nil {
+		return errRefresh
+	}
+	for _, value := range by {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: value})
+	}
+	return agg.Commit()
+}
+
+// pending gets every entry in an outbox
+func pending(t *testing.T, outbox Outbox) []Entry {
+	entries, errPending := outbox.Pending(time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC), 100)
+	assert.Nil(t, errPending)
+	return entries
+}
+
+// TestPublishOnCommit checks committed events are published, and their entries
+// removed
+func TestPublishOnCommit(t *testing.T) {
+	outbox := NewMemoryOutbox()
+	publisher := &recordingPublisher{}
+	store := wrap(memory.NewStore(), outbox, publisher, nil)
+
+	assert.Nil(t, commit(store, "published", 1, 2))
+	assert.Equal(t, []publication{{"published", 1}, {"published", 2}}, publisher.received())
+	assert.Empty(t, pending(t, outbox))
+}
+
+// TestFailedCommit checks the entries of a failed commit are removed unpublished
+func TestFailedCommit(t *testing.T) {
+	outbox := NewMemoryOutbox()
+	publisher := &recordingPublisher{}
+	store := wrap(rejectingStore{memory.NewStore()}, outbox, publisher, nil)
+
+	assert.NotNil(t, commit(store, "rejected", 1))
+	assert.Empty(t, publisher.received())
+	assert.Empty(t, pending(t, outbox))
+}
+
+// TestRelayAfterPublishFailure checks events that couldn't be published are left
+// in the outbox, and relayed once they are older than the grace period
+func TestRelayAfterPublishFailure(t *testing.T) {
+	clock := simclock.New(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	inner := memory.NewStore()
+	outbox := NewMemoryOutbox()
+	publisher := &recordingPublisher{fail: true}
+	store := wrap(inner, outbox, publisher, clock)
+
+	assert.Nil(t, commit(store, "unpublished", 1, 2), "Commits succeed when publishing fails")
+	assert.Equal(t, 2, len(pending(t, outbox)))
+
+	publisher.fail = false
+	options := RelayOptions{Outbox: outbox, Store: inner, Registry: test.GetTestRegistry(), Publisher: publisher, Clock: clock}
+	relayed, errDrain := Drain(options)
+	assert.Nil(t, errDrain)
+	assert.Equal(t, 0, relayed, "Entries within the grace period are left alone")
+
+	clock.Advance(DefaultGrace + time.Second)
+	relayed, errDrain = Drain(options)
+	assert.Nil(t, errDrain)
+	assert.Equal(t, 2, relayed)
+	assert.Equal(t, []publication{{"unpublished", 1}, {"unpublished", 2}}, publisher.received())
+	assert.Empty(t, pending(t, outbox))
+}
+
+// TestRelayConfirmsCommits checks abandoned entries are only published if their
+// events were committed
+func TestRelayConfirmsCommits(t *testing.T) {
+	clock := simclock.New(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	inner := memory.NewStore()
+	outbox := NewMemoryOutbox()
+	publisher := &recordingPublisher{}
+	assert.Nil(t, commit(inner, "crashed", 1, 2))
+
+	// Entries left by a process that died during its commits
+	assert.Nil(t, outbox.Add([]Entry{
+		{ID: "committed", Key: "crashed", Sequence: 2, Event: test.IncrementEvent{IncrementBy: 2}, Added: clock.Now()},
+		{ID: "different", Key: "crashed", Sequence: 1, Event: test.IncrementEvent{IncrementBy: 5}, Added: clock.Now()},
+		{ID: "missing", Key: "crashed", Sequence: 3, Event: test.IncrementEvent{IncrementBy: 3}, Added: clock.Now()},
+	}))
+
+	clock.Advance(time.Minute)
+	relayed, errDrain := Drain(RelayOptions{Outbox: outbox, Store: inner, Registry: test.GetTestRegistry(), Publisher: publisher, Clock: clock})
+	assert.Nil(t, errDrain)
+	assert.Equal(t, 3, relayed)
+	assert.Equal(t, []publication{{"crashed", 2}}, publisher.received())
+	assert.Empty(t, pending(t, outbox))
+}
+
+// TestRelayInterval checks the relay drains the outbox every interval
+func TestRelayInterval(t *testing.T) {
+	clock := simclock.New(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	inner := memory.NewStore()
+	outbox := NewMemoryOutbox()
+	publisher := &recordingPublisher{fail: true}
+	assert.Nil(t, commit(wrap(inner, outbox, publisher, clock), "interval", 1))
+	publisher.fail = false
+
+	stop, errRelay := CreateRelay(RelayOptions{
+		Outbox:    outbox,
+		Store:     inner,
+		Registry:  test.GetTestRegistry(),
+		Publisher: publisher,
+		Interval:  time.Minute,
+		Grace:     time.Second,
+		Clock:     clock,
+	})
+	require.Nil(t, errRelay)
+	defer stop()
+
+	clock.BlockUntil(1)
+	assert.Empty(t, publisher.received())
+
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+	assert.Equal(t, []publication{{"interval", 1}}, publisher.received())
+}
+
+// TestCreateRelayValidation checks the relay needs all of its collaborators
+func TestCreateRelayValidation(t *testing.T) {
+	_, errRelay := CreateRelay(RelayOptions{Outbox: NewMemoryOutbox()})
+	assert.NotNil(t, errRelay)
+}
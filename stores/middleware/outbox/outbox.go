@@ -0,0 +1,99 @@
+/*
+Package outbox contains a middleware that records the publications of a commit in
+an outbox before the commit is written, and a relay that drains the outbox to a
+publisher. Unlike the publish middleware, events are not lost if the process dies
+between the commit and the publish: the relay confirms against the store that the
+events of a leftover entry were committed, and publishes them (at least once) if so.
+*/
+package outbox
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// Entry is a pending publication of an event.
+type Entry struct {
+	ID       string              `json:"id"`       // Unique ID of the entry
+	Key      string              `json:"key"`      // Key of the aggregate
+	Sequence int64               `json:"sequence"` // Sequence of the event
+	Event    eventsourcing.Event `json:"event"`    // Event to publish
+	Added    time.Time           `json:"added"`    // Time the entry was added
+}
+
+// Outbox is an interface that describes storage for pending publications. For the
+// outbox to survive the process, it should be durable, and ideally kept in the same
+// database as the events (see mongo.NewOutbox).
+type Outbox interface {
+	// Add records pending publications.
+	Add(entries []Entry) error
+
+	// Pending gets up to limit entries added before a time, oldest first.
+	Pending(before time.Time, limit int) ([]Entry, error)
+
+	// Remove removes entries by ID, ignoring those that don't exist.
+	Remove(ids []string) error
+}
+
+// memoryOutbox is an outbox held in memory.
+type memoryOutbox struct {
+	lock    sync.Mutex
+	entries map[string]Entry
+}
+
+// NewMemoryOutbox creates an outbox held in memory. It doesn't survive the process,
+// so it is only suitable for tests, or alongside an in-memory store.
+func NewMemoryOutbox() Outbox {
+	return &memoryOutbox{
+		entries: make(map[string]Entry),
+	}
+}
+
+// Add records pending publications
+func (outbox *memoryOutbox) Add(entries []Entry) error {
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	for _, entry := range entries {
+		outbox.entries[entry.ID] = entry
+	}
+	return nil
+}
+
+// Pending gets the oldest entries added before a time
+func (outbox *memoryOutbox) Pending(before time.Time, limit int) ([]Entry, error) {
+	outbox.lock.Lock()
+	result := make([]Entry, 0, len(outbox.entries))
+	for _, entry := range outbox.entries {
+		if entry.Added.Before(before) {
+			result = append(result, entry)
+		}
+	}
+	outbox.lock.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Added.Equal(result[j].Added) {
+			return result[i].Added.Before(result[j].Added)
+		}
+		if result[i].Key != result[j].Key {
+			return result[i].Key < result[j].Key
+		}
+		return result[i].Sequence < result[j].Sequence
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// Remove removes entries by ID
+func (outbox *memoryOutbox) Remove(ids []string) error {
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	for _, id := range ids {
+		delete(outbox.entries, id)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package outbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// DefaultBatchSize is the number of entries relayed at a time.
+const DefaultBatchSize = 100
+
+// DefaultInterval is the time waited between drains of the outbox.
+const DefaultInterval = time.Second
+
+// DefaultGrace is the age an entry must reach before the relay handles it, so that
+// commits still in progress aren't mistaken for abandoned ones.
+const DefaultGrace = 30 * time.Second
+
+// RelayOptions configures the relay.
+type RelayOptions struct {
+	Outbox    Outbox                       // Outbox to drain
+	Store     eventsourcing.EventStore     // Store the events were committed to, without snapshot middleware
+	Registry  eventsourcing.EventRegistry  // Registry of the events
+	Publisher eventsourcing.EventPublisher // Publisher to relay events to
+	BatchSize int                          // Entries relayed at a time, DefaultBatchSize by default
+	Interval  time.Duration                // Wait between drains, DefaultInterval by default
+	Grace     time.Duration                // Age of entries before they are relayed, DefaultGrace by default
+	OnError   func(error)                  // Called when a drain fails, logs by default
+	Logger    eventsourcing.Logger         // Logger for the default OnError, eventsourcing.DefaultLogger() by default
+	Clock     eventsourcing.Clock          // Source of time, the system clock by default
+}
+
+// withDefaults fills in the defaults of the options
+func (options RelayOptions) withDefaults() RelayOptions {
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBatchSize
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
+	if options.Grace <= 0 {
+		options.Grace = DefaultGrace
+	}
+	if options.Logger == nil {
+		options.Logger = eventsourcing.DefaultLogger()
+	}
+	if options.OnError == nil {
+		logger := options.Logger
+		options.OnError = func(err error) {
+			logger.Error("outbox_relay_error", eventsourcing.LogFields{"error": err})
+		}
+	}
+	if options.Clock == nil {
+		options.Clock = eventsourcing.SystemClock
+	}
+	return options
+}
+
+// CreateRelay creates a relay that drains the outbox every interval, until the
+// returned function is called to stop it.
+func CreateRelay(options RelayOptions) (func() error, error) {
+	if options.Outbox == nil || options.Store == nil || options.Registry == nil || options.Publisher == nil {
+		return nil, fmt.Errorf("outbox: the relay needs an outbox, store, registry and publisher")
+	}
+	options = options.withDefaults()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-options.Clock.After(options.Interval):
+			}
+
+			for {
+				relayed, errDrain := Drain(options)
+				if errDrain != nil {
+					options.OnError(errDrain)
+				}
+				if errDrain != nil || relayed < options.BatchSize {
+					break
+				}
+			}
+		}
+	}()
+
+	return func() error {
+		close(stop)
+		<-done
+		return nil
+	}, nil
+}
+
+// Drain relays a batch of entries older than the grace period, returning the
+// number handled. Each entry is confirmed by reading the event at its sequence
+// from the store: if the event was committed it is published and the entry
+// removed, otherwise the commit failed and the entry is discarded. Entries are
+// published in sequence order per aggregate, and an aggregate whose entry fails
+// to publish is left for the next drain.
+func Drain(options RelayOptions) (int, error) {
+	options = options.withDefaults()
+	entries, errPending := options.Outbox.Pending(options.Clock.Now().Add(-options.Grace), options.BatchSize)
+	if errPending != nil {
+		return 0, errPending
+	}
+
+	// Group entries by aggregate, in sequence order
+	keys := make([]string, 0)
+	byKey := make(map[string][]Entry)
+	for _, entry := range entries {
+		if _, seen := byKey[entry.Key]; !seen {
+			keys = append(keys, entry.Key)
+		}
+		byKey[entry.Key] = append(byKey[entry.Key], entry)
+	}
+
+	var failure error
+	for _, key := range keys {
+		errRelay := relay(options, key, sortBySequence(byKey[key]))
+		if errRelay != nil && failure == nil {
+			failure = errRelay
+		}
+	}
+
+	return len(entries), failure
+}
+
+// relay confirms and publishes the entries of an aggregate
+func relay(options RelayOptions, key string, entries []Entry) error {
+	committed := newConfirmer(key, options.Registry, entries[0].Sequence-1)
+	errRefresh := options.Store.Refresh(committed)
+	if errRefresh != nil {
+		return errRefresh
+	}
+	if committed.snapshot {
+		return fmt.Errorf("outbox: cannot confirm events of %v, a snapshot was restored", key)
+	}
+
+	handled := make([]string, 0, len(entries))
+	var failure error
+	for _, entry := range entries {
+		if committed.matches(entry) {
+			errPublish := options.Publisher.Publish(entry.Key, entry.Sequence, entry.Event)
+			if errPublish != nil {
+				failure = errPublish
+				break
+			}
+		}
+		handled = append(handled, entry.ID)
+	}
+
+	errRemove := options.Outbox.Remove(handled)
+	if failure != nil {
+		return failure
+	}
+	return errRemove
+}
+
+// sortBySequence sorts entries in sequence order
+func sortBySequence(entries []Entry) []Entry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Sequence < entries[j].Sequence
+	})
+	return entries
+}
+
+// confirmer is a loader adapter that records the type and data of the events it
+// is given, so that entries can be checked against what was committed.
+type confirmer struct {
+	key      string
+	registry eventsourcing.EventRegistry
+	sequence int64
+	events   map[int64]string
+	snapshot bool // Set if a snapshot was restored
+}
+
+// newConfirmer creates a confirmer that loads from a sequence
+func newConfirmer(key string, registry eventsourcing.EventRegistry, sequence int64) *confirmer {
+	return &confirmer{
+		key:      key,
+		registry: registry,
+		sequence: sequence,
+		events:   make(map[int64]string),
+	}
+}
+
+// matches checks that the event of an entry was committed at its sequence
+func (loader *confirmer) matches(entry Entry) bool {
+	committed, found := loader.events[entry.Sequence]
+	return found && committed == loader.describe(entry.Event)
+}
+
+// describe gets the type and data of an event, for comparison
+func (loader *confirmer) describe(event eventsourcing.Event) string {
+	eventType, _ := loader.registry.GetEventType(event)
+	data, errData := json.Marshal(event)
+	if errData != nil {
+		data = []byte(errData.Error())
+	}
+	return fmt.Sprintf("%v:%s", eventType, data)
+}
+
+// GetKey gets the key of the aggregate
+func (loader *confirmer) GetKey() string {
+	return loader.key
+}
+
+// GetEventRegistry gets the event registry of the aggregate
+func (loader *confirmer) GetEventRegistry() eventsourcing.EventRegistry {
+	return loader.registry
+}
+
+// SequenceNumber gets the sequence loaded up to
+func (loader *confirmer) SequenceNumber() int64 {
+	return loader.sequence
+}
+
+// IsDirty returns false, as nothing is modified
+func (loader *confirmer) IsDirty() bool {
+	return false
+}
+
+// ReplayEvent records an event
+func (loader *confirmer) ReplayEvent(event eventsourcing.Event) {
+	loader.sequence++
+	loader.events[loader.sequence] = loader.describe(event)
+}
+
+// AdvanceSequence skips forward over a gap in the stream
+func (loader *confirmer) AdvanceSequence(sequence int64) error {
+	if sequence < loader.sequence {
+		return fmt.Errorf("Cannot move aggregate %v backwards from %v to %v", loader.key, loader.sequence, sequence)
+	}
+	loader.sequence = sequence
+	return nil
+}
+
+// RestoreSnapshot moves to the sequence of a snapshot
+func (loader *confirmer) RestoreSnapshot(sequence int64, snapshot interface{}) error {
+	loader.sequence = sequence
+	loader.snapshot = true
+	return nil
+}
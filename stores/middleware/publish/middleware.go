@@ -4,9 +4,20 @@ import (
 	"github.com/go-gadgets/eventsourcing"
 )
 
+// CreateMiddleware creates a new publishing middleware, described for
+// eventsourcing.UseMiddleware.
+func CreateMiddleware(publisher eventsourcing.EventPublisher) eventsourcing.Middleware {
+	commit, refresh, cleanup := Create(publisher)
+	return eventsourcing.Describe("publish", eventsourcing.Publishing, commit, refresh, cleanup)
+}
+
 // Create a new publishing middleware
 func Create(publisher eventsourcing.EventPublisher) (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
 	return func(writer eventsourcing.StoreWriterAdapter, next eventsourcing.NextHandler) error {
+			if eventsourcing.IsNoOp(writer) {
+				return next()
+			}
+
 			// Get the events we're about to publish
 			key := writer.GetKey()
 			seq, events := writer.GetUncommittedEvents()
@@ -0,0 +1,210 @@
+/*
+Package ratelimit contains a middleware that bounds the load an application puts
+on a store, so bursts of traffic (i.e. from an API) queue briefly or fail fast
+rather than exceeding the capacity provisioned for the backend.
+
+Two limits are applied, either of which can be left unset:
+
+  - Concurrency: at most MaxConcurrent commits and refreshes are in flight at once.
+  - Commit rate: commits are admitted at CommitsPerSecond on average, from a token
+    bucket that holds up to Burst commits.
+
+Callers that can't proceed immediately wait in a queue for up to Timeout. Callers
+that would wait longer, or that arrive when MaxQueue callers are already waiting,
+are rejected with an eventsourcing.StoreUnavailableFault (mapped to 503 by
+httpfault), whose RetryAfter suggests when capacity should be available.
+
+	limiter := ratelimit.NewLimiter(ratelimit.Options{MaxConcurrent: 20, CommitsPerSecond: 100})
+	store.Use(limiter.Middleware())
+*/
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// DefaultTimeout is the longest a caller waits for capacity, if no other timeout
+// is specified.
+const DefaultTimeout = time.Second
+
+// Options configures a limiter.
+type Options struct {
+	MaxConcurrent    int                 // Commits and refreshes in flight at once, zero for no limit
+	CommitsPerSecond float64             // Average rate commits are admitted at, zero for no limit
+	Burst            int                 // Commits admitted at once after a quiet period, the rate (at least one) by default
+	MaxQueue         int                 // Callers that may wait for capacity, zero for no limit
+	Timeout          time.Duration       // Longest a caller waits, DefaultTimeout by default, negative to never wait
+	Clock            eventsourcing.Clock // Source of time, the system clock by default
+}
+
+// Stats describes the current load on a limiter.
+type Stats struct {
+	InFlight int   // Operations in progress
+	Waiting  int   // Callers waiting for capacity
+	Rejected int64 // Callers rejected since the limiter was created
+}
+
+// Limiter bounds concurrent operations and the commit rate. It can be shared by
+// the middleware of several stores on the same backend.
+type Limiter struct {
+	options  Options
+	slots    chan struct{} // Semaphore of in-flight operations, nil for no limit
+	lock     sync.Mutex
+	tokens   float64   // Commits available in the bucket, negative when reserved by waiters
+	filledAt time.Time // Time the bucket was last filled
+	waiting  int       // Callers waiting for capacity
+	rejected int64     // Callers rejected
+}
+
+// NewLimiter creates a limiter with a full token bucket.
+func NewLimiter(options Options) *Limiter {
+	if options.Burst <= 0 {
+		options.Burst = int(math.Max(1, math.Ceil(options.CommitsPerSecond)))
+	}
+	if options.Timeout == 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.Clock == nil {
+		options.Clock = eventsourcing.SystemClock
+	}
+
+	limiter := &Limiter{
+		options:  options,
+		tokens:   float64(options.Burst),
+		filledAt: options.Clock.Now(),
+	}
+	if options.MaxConcurrent > 0 {
+		limiter.slots = make(chan struct{}, options.MaxConcurrent)
+	}
+	return limiter
+}
+
+// Create a new rate-limiting middleware, with a limiter of its own.
+func Create(options Options) (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
+	return NewLimiter(options).Middleware()
+}
+
+// Middleware creates a middleware that admits commits and refreshes through the
+// limiter. Commits without events write nothing, so are not limited.
+func (limiter *Limiter) Middleware() (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
+	return func(writer eventsourcing.StoreWriterAdapter, next eventsourcing.NextHandler) error {
+			if eventsourcing.IsNoOp(writer) {
+				return next()
+			}
+			return limiter.Call(true, next)
+		}, func(reader eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+			return limiter.Call(false, next)
+		}, nil
+}
+
+// Stats gets the current load on the limiter, i.e. for metrics.
+func (limiter *Limiter) Stats() Stats {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	return Stats{
+		InFlight: len(limiter.slots),
+		Waiting:  limiter.waiting,
+		Rejected: limiter.rejected,
+	}
+}
+
+// Call runs an operation once the limiter admits it, taking a token from the
+// bucket if it is a commit. Calls that are not admitted in time fail with an
+// eventsourcing.StoreUnavailableFault.
+func (limiter *Limiter) Call(commit bool, body func() error) error {
+	deadline := limiter.options.Clock.Now().Add(limiter.options.Timeout)
+
+	if commit && limiter.options.CommitsPerSecond > 0 {
+		errToken := limiter.takeToken()
+		if errToken != nil {
+			return errToken
+		}
+	}
+
+	if limiter.slots != nil {
+		errSlot := limiter.takeSlot(deadline)
+		if errSlot != nil {
+			return errSlot
+		}
+		defer func() { <-limiter.slots }()
+	}
+
+	return body()
+}
+
+// takeToken reserves a commit from the bucket, waiting until the reservation is
+// due. Reservations are made in arrival order, so waiters are admitted fairly.
+func (limiter *Limiter) takeToken() error {
+	limiter.lock.Lock()
+	now := limiter.options.Clock.Now()
+	rate := limiter.options.CommitsPerSecond
+	limiter.tokens = math.Min(float64(limiter.options.Burst), limiter.tokens+now.Sub(limiter.filledAt).Seconds()*rate)
+	limiter.filledAt = now
+
+	if limiter.tokens >= 1 {
+		limiter.tokens--
+		limiter.lock.Unlock()
+		return nil
+	}
+
+	wait := time.Duration((1 - limiter.tokens) / rate * float64(time.Second))
+	if wait > limiter.options.Timeout || !limiter.canQueue() {
+		limiter.rejected++
+		limiter.lock.Unlock()
+		return eventsourcing.NewStoreUnavailableFault("Commit rate limit exceeded", wait)
+	}
+
+	limiter.tokens--
+	limiter.waiting++
+	limiter.lock.Unlock()
+
+	<-limiter.options.Clock.After(wait)
+
+	limiter.lock.Lock()
+	limiter.waiting--
+	limiter.lock.Unlock()
+	return nil
+}
+
+// takeSlot claims an in-flight slot, waiting until the deadline for one to free up.
+func (limiter *Limiter) takeSlot(deadline time.Time) error {
+	select {
+	case limiter.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	limiter.lock.Lock()
+	remaining := deadline.Sub(limiter.options.Clock.Now())
+	if remaining <= 0 || !limiter.canQueue() {
+		limiter.rejected++
+		limiter.lock.Unlock()
+		return eventsourcing.NewStoreUnavailableFault("Concurrency limit exceeded", limiter.options.Timeout)
+	}
+	limiter.waiting++
+	limiter.lock.Unlock()
+
+	var errSlot error
+	select {
+	case limiter.slots <- struct{}{}:
+	case <-limiter.options.Clock.After(remaining):
+		errSlot = eventsourcing.NewStoreUnavailableFault("Concurrency limit exceeded", limiter.options.Timeout)
+	}
+
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.waiting--
+	if errSlot != nil {
+		limiter.rejected++
+	}
+	return errSlot
+}
+
+// canQueue checks if another caller may wait. The lock must be held.
+func (limiter *Limiter) canQueue() bool {
+	return limiter.options.Timeout > 0 && (limiter.options.MaxQueue <= 0 || limiter.waiting < limiter.options.MaxQueue)
+}
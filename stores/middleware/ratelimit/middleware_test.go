@@ -0,0 +1,174 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/simclock"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+)
+
+func provider() (eventsourcing.EventStore, func(), error) {
+	base := memory.NewStore()
+	wrapped := eventsourcing.NewMiddlewareWrapper(base)
+	wrapped.Use(Create(Options{MaxConcurrent: 4, CommitsPerSecond: 10000}))
+
+	return wrapped, func() {
+		wrapped.Close()
+	}, nil
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Rate Limit Middleware", provider)
+}
+
+// blockingStore is a store whose refreshes wait to be released
+type blockingStore struct {
+	eventsourcing.EventStore
+	entered chan bool
+	release chan bool
+}
+
+func (store *blockingStore) Refresh(loader eventsourcing.StoreLoaderAdapter) error {
+	store.entered <- true
+	<-store.release
+	return store.EventStore.Refresh(loader)
+}
+
+// setup creates a store guarded by a limiter on a virtual clock.
+func setup(options Options) (*blockingStore, *Limiter, *simclock.Clock, eventsourcing.EventStore) {
+	clock := simclock.New(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	options.Clock = clock
+	limiter := NewLimiter(options)
+
+	blocking := &blockingStore{
+		EventStore: memory.NewStore(),
+		entered:    make(chan bool, 10),
+		release:    make(chan bool, 10),
+	}
+	wrapped := eventsourcing.NewMiddlewareWrapper(blocking)
+	wrapped.Use(limiter.Middleware())
+	return blocking, limiter, clock, wrapped
+}
+
+// commit commits an event to a new aggregate
+func commit(store eventsourcing.EventStore, key string) error {
+	agg := test.SimpleAggregate{}
+	agg.Initialize(key, test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	return agg.Commit()
+}
+
+// refresh refreshes an aggregate
+func refresh(store eventsourcing.EventStore) error {
+	agg := test.SimpleAggregate{}
+	agg.Initialize("limited", test.GetTestRegistry(), store)
+	return agg.Refresh()
+}
+
+// TestCommitRate checks commits beyond the burst wait for tokens, and those that
+// would wait too long are rejected
+func TestCommitRate(t *testing.T) {
+	_, limiter, clock, store := setup(Options{CommitsPerSecond: 1, Burst: 2})
+	assert.Nil(t, commit(store, "a"))
+	assert.Nil(t, commit(store, "b"))
+
+	done := make(chan error)
+	go func() { done <- commit(store, "c") }()
+	clock.BlockUntil(1)
+	assert.Equal(t, 1, limiter.Stats().Waiting)
+
+	// The next token is reserved, so a further commit would wait two seconds
+	errRejected := commit(store, "d")
+	isUnavailable, fault := eventsourcing.IsStoreUnavailableFault(errRejected)
+	assert.True(t, isUnavailable)
+	assert.Equal(t, 2*time.Second, fault.RetryAfter)
+
+	clock.Advance(time.Second)
+	assert.Nil(t, <-done)
+	assert.Equal(t, Stats{Rejected: 1}, limiter.Stats())
+}
+
+// TestCommitRateRefill checks the bucket refills over time, up to the burst
+func TestCommitRateRefill(t *testing.T) {
+	_, _, clock, store := setup(Options{CommitsPerSecond: 2, Timeout: -1})
+	assert.Nil(t, commit(store, "a"))
+	assert.Nil(t, commit(store, "b"))
+	isUnavailable, _ := eventsourcing.IsStoreUnavailableFault(commit(store, "c"))
+	assert.True(t, isUnavailable, "Commits should not wait with a negative timeout")
+
+	clock.Advance(time.Minute)
+	assert.Nil(t, commit(store, "d"))
+	assert.Nil(t, commit(store, "e"))
+	isUnavailable, _ = eventsourcing.IsStoreUnavailableFault(commit(store, "f"))
+	assert.True(t, isUnavailable, "The bucket should hold no more than the burst")
+}
+
+// TestEmptyCommitNotLimited checks commits without events pass straight through
+func TestEmptyCommitNotLimited(t *testing.T) {
+	_, limiter, _, store := setup(Options{CommitsPerSecond: 1, Timeout: -1})
+	for i := 0; i < 3; i++ {
+		agg := test.SimpleAggregate{}
+		agg.Initialize("empty", test.GetTestRegistry(), store)
+		assert.Nil(t, agg.Commit())
+	}
+	assert.Equal(t, int64(0), limiter.Stats().Rejected)
+}
+
+// TestConcurrencyQueue checks callers queue for a slot, and time out
+func TestConcurrencyQueue(t *testing.T) {
+	blocking, limiter, clock, store := setup(Options{MaxConcurrent: 1})
+
+	first := make(chan error)
+	go func() { first <- refresh(store) }()
+	<-blocking.entered
+	assert.Equal(t, 1, limiter.Stats().InFlight)
+
+	// The second caller waits, and runs once the first finishes
+	second := make(chan error)
+	go func() { second <- refresh(store) }()
+	clock.BlockUntil(1)
+	assert.Equal(t, 1, limiter.Stats().Waiting)
+	blocking.release <- true
+	assert.Nil(t, <-first)
+	<-blocking.entered
+
+	// A third caller times out while the second holds the slot
+	third := make(chan error)
+	go func() { third <- refresh(store) }()
+	clock.BlockUntil(2)
+	clock.Advance(DefaultTimeout)
+	isUnavailable, _ := eventsourcing.IsStoreUnavailableFault(<-third)
+	assert.True(t, isUnavailable)
+
+	blocking.release <- true
+	assert.Nil(t, <-second)
+	assert.Equal(t, Stats{Rejected: 1}, limiter.Stats())
+}
+
+// TestMaxQueue checks callers are rejected once the queue is full
+func TestMaxQueue(t *testing.T) {
+	blocking, limiter, clock, store := setup(Options{MaxConcurrent: 1, MaxQueue: 1})
+
+	first := make(chan error)
+	go func() { first <- refresh(store) }()
+	<-blocking.entered
+
+	second := make(chan error)
+	go func() { second <- refresh(store) }()
+	clock.BlockUntil(1)
+
+	isUnavailable, _ := eventsourcing.IsStoreUnavailableFault(refresh(store))
+	assert.True(t, isUnavailable, "The queue should be full")
+
+	blocking.release <- true
+	blocking.release <- true
+	assert.Nil(t, <-first)
+	assert.Nil(t, <-second)
+	assert.Equal(t, int64(1), limiter.Stats().Rejected)
+}
@@ -4,16 +4,11 @@ import (
 	"encoding/json"
 	"time"
 
-	"github.com/globalsign/mgo/bson"
 	"github.com/go-gadgets/eventsourcing"
 	"github.com/go-gadgets/eventsourcing/stores/middleware/snapbase"
 	"github.com/go-redis/redis"
 )
 
-func init() {
-	bson.SetJSONTagFallback(true)
-}
-
 // Snapshot is the current snapshot for an entity, a JSON structure
 // that can be persisted to the Redis instance.
 type snapshot struct {
@@ -24,18 +19,30 @@ type snapshot struct {
 // Parameters describes the parameters that can be
 // used to cofigure a Redis snap store.
 type Parameters struct {
-	Lazy            bool  // Lazy mode?
-	SnapInterval    int64 `json:"snap_interval"` // SnapInterval is the number of events between snaps
-	DefaultDuration time.Duration
+	Lazy             bool                      // Lazy mode?
+	SnapInterval     int64                     `json:"snap_interval"` // SnapInterval is the number of events between snaps
+	Strategy         snapbase.SnapshotStrategy `json:"-"`             // Strategy decides when to snap, every SnapInterval events by default
+	DefaultDuration  time.Duration
+	MaxSnapshotBytes int64                     `json:"max_snapshot_bytes"` // MaxSnapshotBytes is the largest snapshot to write or restore, zero for no limit
+	OnTooLarge       snapbase.TooLargeCallback `json:"-"`                  // OnTooLarge decides what happens to oversized snapshots on refresh
+	Compressor       snapbase.Compressor       `json:"-"`                  // Compressor compresses snapshots before they are written (snapbase.Gzip, snapbase.Zstd), nil for none
+	Keys             snapbase.KeyProvider      `json:"-"`                  // Keys encrypt snapshots before they are written (see snapbase.KeyProvider), nil for none
+	Async            bool                      `json:"async"`              // Async writes snapshots in the background, coalescing them by key
+	OnError          snapbase.ErrorCallback    `json:"-"`                  // OnError is called when a background snapshot write fails
+	SnapOnReadAfter  int64                     `json:"snap_on_read_after"` // SnapOnReadAfter snaps after a refresh that replays more events than this, zero to snap only on commit
+	Singleflight     bool                      `json:"singleflight"`       // Singleflight shares the work of concurrent refreshes of the same aggregate, so only one reads the snapshot and replays events
+	Admin            *snapbase.Admin           `json:"-"`                  // Admin administers the snapshots of the provider (see snapbase.NewAdmin), nil for none
+	Cloner           snapbase.Cloner           `json:"-"`                  // Cloner copies states into snapshots (snapbase.CloneJSON, snapbase.CloneReflect), CloneJSON by default
+	Metrics          *snapbase.Metrics         `json:"-"`                  // Metrics counts how refreshes use snapshots (see snapbase.NewMetrics), nil for none
 }
 
 // instance is our storage provider for managing snapshots in redis
 type instance struct {
-	client *redis.Client
+	client redis.UniversalClient
 	params Parameters
 }
 
-// Create a snap provider using the default connection (localhost)
+// Create a snap provider using a single Redis server
 func Create(params Parameters, address string) (eventsourcing.MiddlewareFactory, error) {
 	client := redis.NewClient(&redis.Options{
 		Addr: address,
@@ -44,9 +51,18 @@ func Create(params Parameters, address string) (eventsourcing.MiddlewareFactory,
 	return CreateWithClient(params, client)
 }
 
-// CreateWithClient provisions a new instance of the dynamo-snap provider using
-// an existing client
-func CreateWithClient(params Parameters, client *redis.Client) (eventsourcing.MiddlewareFactory, error) {
+// CreateWithOptions creates a snap provider for a single server, a cluster (when
+// several addresses are given) or a Sentinel failover group (when a master name is
+// given), with authentication and database selection. Servers that need TLS can be
+// reached with a client of their own (redis.Options.TLSConfig), through
+// CreateWithClient.
+func CreateWithOptions(params Parameters, options *redis.UniversalOptions) (eventsourcing.MiddlewareFactory, error) {
+	return CreateWithClient(params, redis.NewUniversalClient(options))
+}
+
+// CreateWithClient provisions a new instance of the redis-snap provider using
+// an existing client, which may be a single-server, cluster or failover client
+func CreateWithClient(params Parameters, client redis.UniversalClient) (eventsourcing.MiddlewareFactory, error) {
 	snaps := &instance{
 		client: client,
 		params: params,
@@ -54,19 +70,73 @@ func CreateWithClient(params Parameters, client *redis.Client) (eventsourcing.Mi
 
 	return func() (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, eventsourcing.CloseMiddleware) {
 		return snapbase.Create(snapbase.Parameters{
-			Lazy:         params.Lazy,
-			SnapInterval: params.SnapInterval,
+			Lazy:             params.Lazy,
+			SnapInterval:     params.SnapInterval,
+			Strategy:         params.Strategy,
+			MaxSnapshotBytes: params.MaxSnapshotBytes,
+			OnTooLarge:       params.OnTooLarge,
+			Compressor:       params.Compressor,
+			Keys:             params.Keys,
+			Async:            params.Async,
+			OnError:          params.OnError,
+			SnapOnReadAfter:  params.SnapOnReadAfter,
+			Singleflight:     params.Singleflight,
+			Admin:            params.Admin,
+			Cloner:           params.Cloner,
+			Metrics:          params.Metrics,
 			Close: func() error {
 				client.Close()
 				return nil
 			},
-			Get:   snaps.get,
-			Purge: snaps.purge,
-			Put:   snaps.put,
+			Get:     snaps.get,
+			Purge:   snaps.purge,
+			Put:     snaps.put,
+			PutMany: snaps.putMany,
 		})
 	}, nil
 }
 
+// CreateMiddleware creates a snap provider using a single Redis server, described
+// for eventsourcing.UseMiddleware.
+func CreateMiddleware(params Parameters, address string) (eventsourcing.Middleware, error) {
+	factory, errFactory := Create(params, address)
+	if errFactory != nil {
+		return eventsourcing.Middleware{}, errFactory
+	}
+	return describe(params, factory), nil
+}
+
+// CreateMiddlewareWithOptions creates a snap provider as CreateWithOptions does,
+// described for eventsourcing.UseMiddleware.
+func CreateMiddlewareWithOptions(params Parameters, options *redis.UniversalOptions) (eventsourcing.Middleware, error) {
+	factory, errFactory := CreateWithOptions(params, options)
+	if errFactory != nil {
+		return eventsourcing.Middleware{}, errFactory
+	}
+	return describe(params, factory), nil
+}
+
+// CreateMiddlewareWithClient creates a snap provider using an existing client,
+// described for eventsourcing.UseMiddleware.
+func CreateMiddlewareWithClient(params Parameters, client redis.UniversalClient) (eventsourcing.Middleware, error) {
+	factory, errFactory := CreateWithClient(params, client)
+	if errFactory != nil {
+		return eventsourcing.Middleware{}, errFactory
+	}
+	return describe(params, factory), nil
+}
+
+// describe describes the middleware of a provider: snapshots kept in Redis are
+// Durable, and Caching when lazy.
+func describe(params Parameters, factory eventsourcing.MiddlewareFactory) eventsourcing.Middleware {
+	capabilities := eventsourcing.Durable
+	if params.Lazy {
+		capabilities |= eventsourcing.Caching
+	}
+	commit, refresh, cleanup := factory()
+	return eventsourcing.Describe("redissnap", capabilities, commit, refresh, cleanup)
+}
+
 // get a key from the cache
 func (mw *instance) get(key string) (interface{}, int64, error) {
 	var loaded snapshot
@@ -96,8 +166,63 @@ func (mw *instance) purge(key string) error {
 	return errDelete
 }
 
-// put an item into the cache
+// putScript sets a snapshot unless a newer one is held. The sequence of the held
+// snapshot is read from the start of its JSON, where encode writes it, falling
+// back to decoding the JSON. A TTL of zero keeps the snapshot forever.
+var putScript = redis.NewScript(`
+local held = redis.call("GET", KEYS[1])
+if held then
+	local seq = string.match(held, '^{"seq":(%-?%d+)')
+	if not seq then
+		seq = cjson.decode(held).seq
+	end
+	if tonumber(seq) > tonumber(ARGV[2]) then
+		return 0
+	end
+end
+if ARGV[3] == "0" then
+	redis.call("SET", KEYS[1], ARGV[1])
+else
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[3])
+end
+return 1
+`)
+
+// putArgs gets the arguments of putScript for a snapshot
+func (mw *instance) putArgs(seq int64, text string) []interface{} {
+	ttl := int64(mw.params.DefaultDuration / time.Millisecond)
+	return []interface{}{text, seq, ttl}
+}
+
+// put an item into the cache, unless a newer snapshot is held
 func (mw *instance) put(key string, seq int64, data interface{}) error {
+	text, errMarshal := encode(seq, data)
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	return putScript.Run(mw.client, []string{key}, mw.putArgs(seq, text)...).Err()
+}
+
+// putMany puts several items into the cache in a single pipeline
+func (mw *instance) putMany(entries []snapbase.Entry) error {
+	pipeline := mw.client.Pipeline()
+	defer pipeline.Close()
+
+	for _, entry := range entries {
+		text, errMarshal := encode(entry.Sequence, entry.State)
+		if errMarshal != nil {
+			return errMarshal
+		}
+		putScript.Eval(pipeline, []string{entry.Key}, mw.putArgs(entry.Sequence, text)...)
+	}
+
+	_, errExec := pipeline.Exec()
+	return errExec
+}
+
+// encode marshals a snapshot for storage
+func encode(seq int64, data interface{}) (string, error) {
 	snap := snapshot{
 		Sequence: seq,
 		State:    data,
@@ -106,11 +231,8 @@ func (mw *instance) put(key string, seq int64, data interface{}) error {
 	// Marshal the items
 	buf, errMarshal := json.Marshal(&snap)
 	if errMarshal != nil {
-		return errMarshal
+		return "", errMarshal
 	}
 
-	text := string(buf)
-	errPut := mw.client.Set(key, text, mw.params.DefaultDuration).Err()
-
-	return errPut
+	return string(buf), nil
 }
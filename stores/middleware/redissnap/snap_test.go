@@ -6,15 +6,25 @@ import (
 
 	"github.com/go-gadgets/eventsourcing"
 	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/snapbase"
 	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
 )
 
 func provider() (eventsourcing.EventStore, func(), error) {
+	return sealedProvider(nil, nil)
+}
+
+// sealedProvider creates a store whose snapshots are compressed and/or encrypted
+func sealedProvider(compressor snapbase.Compressor, keys snapbase.KeyProvider) (eventsourcing.EventStore, func(), error) {
 	base := memory.NewStore()
 	wrapped := eventsourcing.NewMiddlewareWrapper(base)
 	mw, err := Create(Parameters{
 		SnapInterval:    5,
 		DefaultDuration: time.Hour * 24,
+		Compressor:      compressor,
+		Keys:            keys,
 	}, "localhost:6379")
 	if err != nil {
 		return nil, nil, err
@@ -26,11 +36,57 @@ func provider() (eventsourcing.EventStore, func(), error) {
 	}, nil
 }
 
+// describedProvider registers the middleware described, through UseMiddleware
+func describedProvider() (eventsourcing.EventStore, func(), error) {
+	base := memory.NewStore()
+	wrapped := eventsourcing.NewMiddlewareWrapper(base)
+	mw, err := CreateMiddleware(Parameters{
+		SnapInterval:    5,
+		DefaultDuration: time.Hour * 24,
+	}, "localhost:6379")
+	if err != nil {
+		return nil, nil, err
+	}
+	if errUse := eventsourcing.UseMiddleware(wrapped, mw); errUse != nil {
+		return nil, nil, errUse
+	}
+
+	return wrapped, func() {
+		wrapped.Close()
+	}, nil
+}
+
 // TestStoreCompliance
 func TestStoreCompliance(t *testing.T) {
 	test.CheckStandardSuite(t, "Redis Snap Middleware", provider)
 }
 
+// TestDescribedCompliance checks the described middleware behaves the same
+func TestDescribedCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Redis Snap Middleware (described)", describedProvider)
+}
+
+// TestCompressedCompliance checks compressed snapshots round-trip through Redis
+func TestCompressedCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Redis Snap Middleware (zstd)", func() (eventsourcing.EventStore, func(), error) {
+		return sealedProvider(snapbase.Zstd(), nil)
+	})
+}
+
+// TestEncryptedCompliance checks encrypted snapshots round-trip through Redis
+func TestEncryptedCompliance(t *testing.T) {
+	keys, errKeys := snapbase.StaticKeys("test", map[string][]byte{
+		"test": []byte("0123456789abcdef0123456789abcdef"),
+	})
+	if errKeys != nil {
+		t.Fatal(errKeys)
+	}
+
+	test.CheckStandardSuite(t, "Redis Snap Middleware (encrypted)", func() (eventsourcing.EventStore, func(), error) {
+		return sealedProvider(nil, keys)
+	})
+}
+
 // BenchmarkIndividualCommmits tests how fast we can apply events to an aggregate
 func BenchmarkIndividualCommmits(b *testing.B) {
 	test.MeasureIndividualCommits(b, provider)
@@ -41,3 +97,104 @@ func BenchmarkIndividualCommmits(b *testing.B) {
 func BenchmarkBulkInsertAndLoad(b *testing.B) {
 	test.MeasureBulkInsertAndReload(b, provider)
 }
+
+// TestUniversalCompliance checks snapshots through a client created from universal
+// options, written in the background in pipelined batches
+func TestUniversalCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Redis Snap Middleware (universal, async)", func() (eventsourcing.EventStore, func(), error) {
+		wrapped := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+		mw, err := CreateWithOptions(Parameters{
+			SnapInterval:    5,
+			DefaultDuration: time.Hour * 24,
+			Async:           true,
+		}, &redis.UniversalOptions{
+			Addrs: []string{"localhost:6379"},
+			DB:    1,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		wrapped.Use(mw())
+
+		return wrapped, func() {
+			wrapped.Close()
+		}, nil
+	})
+}
+
+// TestPutMany checks batches of snapshots are written in a pipeline
+func TestPutMany(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	defer client.Close()
+	snaps := &instance{client: client, params: Parameters{DefaultDuration: time.Minute}}
+
+	assert.Nil(t, snaps.putMany([]snapbase.Entry{
+		{Key: "pipelined-a", Sequence: 5, State: map[string]interface{}{"current_count": 1}},
+		{Key: "pipelined-b", Sequence: 7, State: map[string]interface{}{"current_count": 2}},
+	}))
+
+	state, seq, errGet := snaps.get("pipelined-b")
+	assert.Nil(t, errGet)
+	assert.Equal(t, int64(7), seq)
+	assert.Equal(t, map[string]interface{}{"current_count": float64(2)}, state)
+	assert.Nil(t, snaps.purge("pipelined-a"))
+	assert.Nil(t, snaps.purge("pipelined-b"))
+}
+
+// TestConditionalPut checks older snapshots never replace newer ones, whether
+// they are written alone or in a pipeline
+func TestConditionalPut(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	defer client.Close()
+	snaps := &instance{client: client, params: Parameters{DefaultDuration: time.Minute}}
+	defer snaps.purge("raced")
+
+	assert.Nil(t, snaps.put("raced", 5, map[string]interface{}{"current_count": 5}))
+	assert.Nil(t, snaps.put("raced", 3, map[string]interface{}{"current_count": 3}))
+	assert.Nil(t, snaps.putMany([]snapbase.Entry{
+		{Key: "raced", Sequence: 4, State: map[string]interface{}{"current_count": 4}},
+	}))
+
+	state, seq, errGet := snaps.get("raced")
+	assert.Nil(t, errGet)
+	assert.Equal(t, int64(5), seq, "The older snapshots should be skipped")
+	assert.Equal(t, map[string]interface{}{"current_count": float64(5)}, state)
+
+	assert.Nil(t, snaps.put("raced", 5, map[string]interface{}{"current_count": 50}))
+	assert.Nil(t, snaps.putMany([]snapbase.Entry{
+		{Key: "raced", Sequence: 9, State: map[string]interface{}{"current_count": 9}},
+	}))
+	_, seq, _ = snaps.get("raced")
+	assert.Equal(t, int64(9), seq)
+	assert.True(t, client.PTTL("raced").Val() > 0, "The snapshot should still expire")
+}
+
+// TestSnapshotCompliance checks Redis against the snapshot suite
+func TestSnapshotCompliance(t *testing.T) {
+	test.CheckSnapshotSuite(t, "Redis Snap Middleware", func(options test.SnapshotOptions) (test.SnapshotStorage, func(), error) {
+		params := Parameters{
+			Lazy:            options.Lazy,
+			SnapInterval:    options.SnapInterval,
+			DefaultDuration: time.Hour,
+		}
+		client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+		snaps := &instance{client: client, params: params}
+		mw, err := CreateWithClient(params, client)
+		if err != nil {
+			return test.SnapshotStorage{}, nil, err
+		}
+		base := memory.NewStore()
+		wrapped := eventsourcing.NewMiddlewareWrapper(base)
+		wrapped.Use(mw())
+
+		return test.SnapshotStorage{
+			Store: wrapped,
+			Inner: base,
+			Get:   snaps.get,
+			Put:   snaps.put,
+			Purge: snaps.purge,
+		}, func() {
+			wrapped.Close()
+		}, nil
+	})
+}
@@ -0,0 +1,54 @@
+package reporting
+
+import (
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// Create a middleware that reports failed commits and refreshes, and any panics
+// beneath it, to a reporter. Panics are returned as errors. Concurrency faults and
+// validation faults arise during normal operation, so they aren't reported. To
+// capture faults in other middleware, use this middleware last.
+func Create(reporter eventsourcing.Reporter) (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
+	return func(writer eventsourcing.StoreWriterAdapter, next eventsourcing.NextHandler) error {
+			registry := writer.GetEventRegistry()
+			committed, events := writer.GetUncommittedEvents()
+			report := eventsourcing.ErrorReport{
+				Operation: eventsourcing.OperationCommit,
+				Domain:    registry.Domain(),
+				Key:       writer.GetKey(),
+				Sequence:  committed,
+			}
+
+			// Identify the commit by its first event
+			if len(events) > 0 {
+				report.EventType, _ = registry.GetEventType(events[0])
+			}
+
+			return run(reporter, report, next)
+		}, func(reader eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+			report := eventsourcing.ErrorReport{
+				Operation: eventsourcing.OperationRefresh,
+				Domain:    reader.GetEventRegistry().Domain(),
+				Key:       reader.GetKey(),
+				Sequence:  reader.SequenceNumber(),
+			}
+
+			return run(reporter, report, next)
+		}, nil
+}
+
+// run calls the next handler, reporting any unexpected error or panic.
+func run(reporter eventsourcing.Reporter, report eventsourcing.ErrorReport, next eventsourcing.NextHandler) error {
+	panicked := false
+	errNext := eventsourcing.RecoverPanics(eventsourcing.ReporterFunc(func(report eventsourcing.ErrorReport) {
+		panicked = true
+		reporter.Report(report)
+	}), report, next)
+
+	if errNext != nil && !panicked && !eventsourcing.IsExpectedFault(errNext) {
+		report.Err = errNext
+		reporter.Report(report)
+	}
+
+	return errNext
+}
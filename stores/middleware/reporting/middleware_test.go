@@ -0,0 +1,91 @@
+package reporting
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+)
+
+// recordingReporter collects the reports it receives.
+type recordingReporter struct {
+	lock    sync.Mutex
+	reports []eventsourcing.ErrorReport
+}
+
+func (reporter *recordingReporter) Report(report eventsourcing.ErrorReport) {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	reporter.reports = append(reporter.reports, report)
+}
+
+func provider() (eventsourcing.EventStore, func(), error) {
+	base := memory.NewStore()
+	wrapped := eventsourcing.NewMiddlewareWrapper(base)
+	wrapped.Use(Create(&recordingReporter{}))
+
+	return wrapped, func() {
+		wrapped.Close()
+	}, nil
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Reporting Middleware", provider)
+}
+
+// TestReportFaults checks that failed commits and refreshes are reported with
+// the context of the aggregate, and that panics are recovered.
+func TestReportFaults(t *testing.T) {
+	reporter := &recordingReporter{}
+	var fault error
+	wrapped := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	wrapped.HandleCommit(func(writer eventsourcing.StoreWriterAdapter, next eventsourcing.NextHandler) error {
+		if fault != nil {
+			return fault
+		}
+		return next()
+	})
+	wrapped.HandleRefresh(func(reader eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+		panic("refresh failed")
+	})
+	wrapped.Use(Create(reporter))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("report-key", test.GetTestRegistry(), wrapped)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+	assert.Empty(t, reporter.reports)
+
+	// Unexpected errors are reported
+	fault = errors.New("commit failed")
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Equal(t, fault, agg.Commit())
+	assert.Equal(t, 1, len(reporter.reports))
+	report := reporter.reports[0]
+	assert.Equal(t, eventsourcing.OperationCommit, report.Operation)
+	assert.Equal(t, "report-key", report.Key)
+	assert.Equal(t, int64(1), report.Sequence)
+	assert.Equal(t, eventsourcing.EventType("IncrementEvent"), report.EventType)
+	assert.Equal(t, fault, report.Err)
+
+	// Concurrency faults are not
+	fault = eventsourcing.NewConcurrencyFault("report-key", 2)
+	assert.NotNil(t, agg.Commit())
+	assert.Equal(t, 1, len(reporter.reports))
+
+	// Panics are reported once, and returned as errors
+	loaded := test.SimpleAggregate{}
+	loaded.Initialize("report-key", test.GetTestRegistry(), wrapped)
+	assert.NotNil(t, loaded.Refresh())
+	assert.Equal(t, 2, len(reporter.reports))
+	report = reporter.reports[1]
+	assert.Equal(t, eventsourcing.OperationRefresh, report.Operation)
+	assert.Equal(t, "refresh failed", report.Panic)
+	assert.NotEmpty(t, report.Stack)
+}
@@ -0,0 +1,227 @@
+/*
+Package s3snap is snapshot middleware that keeps snapshots in an S3 bucket, as one
+object per aggregate key, with the sequence number of the snapshot held in the
+object metadata. Objects have no practical size limit, so this suits aggregates
+whose state is too large for the items of a database.
+*/
+package s3snap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/snapbase"
+	"github.com/go-gadgets/eventsourcing/utilities/s3client"
+)
+
+// sequenceHeader is the object metadata that holds the sequence of a snapshot
+const sequenceHeader = "X-Amz-Meta-Sequence"
+
+// Parameters describes the parameters that can be
+// used to cofigure an S3 snap store.
+type Parameters struct {
+	Lazy             bool                      // Lazy mode?
+	SnapInterval     int64                     `json:"snap_interval"`      // SnapInterval is the number of events between snaps
+	Strategy         snapbase.SnapshotStrategy `json:"-"`                  // Strategy decides when to snap, every SnapInterval events by default
+	Prefix           string                    `json:"prefix"`             // Prefix is prepended to the aggregate key to name each object
+	MaxSnapshotBytes int64                     `json:"max_snapshot_bytes"` // MaxSnapshotBytes is the largest snapshot to write or restore, zero for no limit
+	OnTooLarge       snapbase.TooLargeCallback `json:"-"`                  // OnTooLarge decides what happens to oversized snapshots on refresh
+	Compressor       snapbase.Compressor       `json:"-"`                  // Compressor compresses snapshots before they are written (snapbase.Gzip, snapbase.Zstd), nil for none
+	Keys             snapbase.KeyProvider      `json:"-"`                  // Keys encrypt snapshots before they are written (see snapbase.KeyProvider), nil for none
+	Async            bool                      `json:"async"`              // Async writes snapshots in the background, coalescing them by key
+	OnError          snapbase.ErrorCallback    `json:"-"`                  // OnError is called when a background snapshot write fails
+	SnapOnReadAfter  int64                     `json:"snap_on_read_after"` // SnapOnReadAfter snaps after a refresh that replays more events than this, zero to snap only on commit
+	Singleflight     bool                      `json:"singleflight"`       // Singleflight shares the work of concurrent refreshes of the same aggregate, so only one reads the snapshot and replays events
+	Admin            *snapbase.Admin           `json:"-"`                  // Admin administers the snapshots of the provider (see snapbase.NewAdmin), nil for none
+	Cloner           snapbase.Cloner           `json:"-"`                  // Cloner copies states into snapshots (snapbase.CloneJSON, snapbase.CloneReflect), CloneJSON by default
+	Metrics          *snapbase.Metrics         `json:"-"`                  // Metrics counts how refreshes use snapshots (see snapbase.NewMetrics), nil for none
+}
+
+// instance is our storage provider for managing snapshots in S3
+type instance struct {
+	objects *s3client.Client
+	params  Parameters
+}
+
+// Create a snap provider using the default AWS session context
+func Create(params Parameters, bucket string) (eventsourcing.MiddlewareFactory, error) {
+	session, errSession := session.NewSession()
+	if errSession != nil {
+		return nil, errSession
+	}
+
+	return CreateWithSession(params, session, bucket)
+}
+
+// CreateWithSession provisions a new instance of the S3-snap provider using an
+// existing session. Credentials, region, endpoint and HTTP client are taken from
+// the session. If the session specifies an endpoint (i.e. for a local
+// S3-compatible server) path-style addressing is used.
+func CreateWithSession(params Parameters, session *session.Session, bucket string) (eventsourcing.MiddlewareFactory, error) {
+	snaps := &instance{
+		objects: s3client.New(session, bucket),
+		params:  params,
+	}
+
+	return func() (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, eventsourcing.CloseMiddleware) {
+		return snapbase.Create(snapbase.Parameters{
+			Lazy:             params.Lazy,
+			SnapInterval:     params.SnapInterval,
+			Strategy:         params.Strategy,
+			MaxSnapshotBytes: params.MaxSnapshotBytes,
+			OnTooLarge:       params.OnTooLarge,
+			Compressor:       params.Compressor,
+			Keys:             params.Keys,
+			Async:            params.Async,
+			OnError:          params.OnError,
+			SnapOnReadAfter:  params.SnapOnReadAfter,
+			Singleflight:     params.Singleflight,
+			Admin:            params.Admin,
+			Cloner:           params.Cloner,
+			Metrics:          params.Metrics,
+			Close: func() error {
+				return nil
+			},
+			Get:   snaps.get,
+			Purge: snaps.purge,
+			Put:   snaps.put,
+		})
+	}, nil
+}
+
+// do signs and sends a request for the snapshot of an aggregate
+func (mw *instance) do(method string, key string, body []byte, headers map[string]string) (*http.Response, error) {
+	return mw.objects.Do(method, mw.params.Prefix+key, body, headers)
+}
+
+// failed describes a request that failed
+func (mw *instance) failed(response *http.Response, action string, key string) error {
+	detail, _ := ioutil.ReadAll(response.Body)
+	return fmt.Errorf("s3snap: %v %v/%v failed with status %v: %s", action, mw.objects.Bucket(), mw.params.Prefix+key, response.StatusCode, detail)
+}
+
+// get a key from the bucket
+func (mw *instance) get(key string) (interface{}, int64, error) {
+	response, errGet := mw.do(http.MethodGet, key, nil, nil)
+	if errGet != nil {
+		return nil, 0, errGet
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, 0, nil
+	}
+	if response.StatusCode/100 != 2 {
+		return nil, 0, mw.failed(response, "get", key)
+	}
+
+	seq, errSeq := strconv.ParseInt(response.Header.Get(sequenceHeader), 10, 64)
+	if errSeq != nil {
+		return nil, 0, fmt.Errorf("s3snap: snapshot of %v has no sequence: %v", key, errSeq)
+	}
+
+	var state interface{}
+	decoder := json.NewDecoder(response.Body)
+	decoder.UseNumber()
+	errDecode := decoder.Decode(&state)
+	if errDecode != nil {
+		return nil, 0, errDecode
+	}
+
+	return state, seq, nil
+}
+
+// purge a key from the bucket
+func (mw *instance) purge(key string) error {
+	response, errDelete := mw.do(http.MethodDelete, key, nil, nil)
+	if errDelete != nil {
+		return errDelete
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 && response.StatusCode != http.StatusNotFound {
+		return mw.failed(response, "delete", key)
+	}
+	return nil
+}
+
+// putAttempts is the number of times a conditional put is tried, when other
+// writers change the object between it being checked and written
+const putAttempts = 3
+
+// put an item into the bucket, unless a newer snapshot is held. The object is
+// checked, and then written only if it hasn't changed since (If-Match), or still
+// doesn't exist (If-None-Match).
+func (mw *instance) put(key string, seq int64, data interface{}) error {
+	body, errMarshal := json.Marshal(data)
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	for attempt := 1; ; attempt++ {
+		held, etag, errHead := mw.head(key)
+		if errHead != nil {
+			return errHead
+		}
+		if held > seq {
+			return nil
+		}
+
+		headers := map[string]string{
+			"Content-Type": "application/json",
+			sequenceHeader: strconv.FormatInt(seq, 10),
+		}
+		if etag == "" {
+			headers["If-None-Match"] = "*"
+		} else {
+			headers["If-Match"] = etag
+		}
+
+		response, errPut := mw.do(http.MethodPut, key, body, headers)
+		if errPut != nil {
+			return errPut
+		}
+		if response.StatusCode/100 == 2 {
+			response.Body.Close()
+			return nil
+		}
+
+		// Another writer got there first, so check the object again
+		changed := response.StatusCode == http.StatusPreconditionFailed || response.StatusCode == http.StatusConflict
+		if changed && attempt < putAttempts {
+			response.Body.Close()
+			continue
+		}
+
+		defer response.Body.Close()
+		return mw.failed(response, "put", key)
+	}
+}
+
+// head gets the sequence and ETag of the snapshot of an aggregate, or an empty
+// ETag if there is none
+func (mw *instance) head(key string) (int64, string, error) {
+	response, errHead := mw.do(http.MethodHead, key, nil, nil)
+	if errHead != nil {
+		return 0, "", errHead
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return 0, "", nil
+	}
+	if response.StatusCode/100 != 2 {
+		return 0, "", mw.failed(response, "head", key)
+	}
+
+	seq, errSeq := strconv.ParseInt(response.Header.Get(sequenceHeader), 10, 64)
+	if errSeq != nil {
+		return 0, "", fmt.Errorf("s3snap: snapshot of %v has no sequence: %v", key, errSeq)
+	}
+	return seq, response.Header.Get("ETag"), nil
+}
@@ -0,0 +1,223 @@
+package s3snap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/s3client"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// object is an object held by the fake bucket
+type object struct {
+	body     []byte
+	sequence string
+	etag     string
+}
+
+// fakeBucket is an in-memory S3 bucket, serving signed object requests
+type fakeBucket struct {
+	lock    sync.Mutex
+	objects map[string]object
+	writes  int
+}
+
+// ServeHTTP handles an object request
+func (bucket *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	found, exists := bucket.objects[r.URL.Path]
+	switch r.Method {
+	case http.MethodPut:
+		if (r.Header.Get("If-None-Match") == "*" && exists) ||
+			(r.Header.Get("If-Match") != "" && r.Header.Get("If-Match") != found.etag) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bucket.writes++
+		bucket.objects[r.URL.Path] = object{
+			body:     body,
+			sequence: r.Header.Get(sequenceHeader),
+			etag:     fmt.Sprintf(`"%v"`, bucket.writes),
+		}
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(sequenceHeader, found.sequence)
+		w.Header().Set("ETag", found.etag)
+		w.Write(found.body)
+	case http.MethodDelete:
+		delete(bucket.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// testSession creates a session against a fake server
+func testSession(t *testing.T, server *httptest.Server) *session.Session {
+	session, errSession := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	require.Nil(t, errSession)
+	return session
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	server := httptest.NewServer(&fakeBucket{objects: make(map[string]object)})
+	defer server.Close()
+	session := testSession(t, server)
+
+	test.CheckStandardSuite(t, "S3 Snap Middleware", func() (eventsourcing.EventStore, func(), error) {
+		wrapped := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+		mw, err := CreateWithSession(Parameters{
+			SnapInterval: 5,
+		}, session, "snapshots")
+		if err != nil {
+			return nil, nil, err
+		}
+		wrapped.Use(mw())
+
+		return wrapped, func() {
+			wrapped.Close()
+		}, nil
+	})
+}
+
+// TestObjects checks snapshots are written as one object per key, with the
+// sequence in the object metadata
+func TestObjects(t *testing.T) {
+	bucket := &fakeBucket{objects: make(map[string]object)}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+
+	factory, errCreate := CreateWithSession(Parameters{
+		Lazy:         true,
+		SnapInterval: 1,
+		Prefix:       "counters/",
+	}, testSession(t, server), "snapshots")
+	require.Nil(t, errCreate)
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(factory())
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("big", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 5})
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 2})
+	assert.Nil(t, agg.Commit())
+
+	written, found := bucket.objects["/snapshots/counters/big"]
+	assert.True(t, found)
+	assert.Equal(t, "2", written.sequence)
+	assert.Contains(t, string(written.body), `"current_count":7`)
+
+	loaded := test.SimpleAggregate{}
+	loaded.Initialize("big", test.GetTestRegistry(), store)
+	assert.Nil(t, loaded.Refresh())
+	assert.Equal(t, 7, loaded.CurrentCount)
+	assert.Equal(t, int64(2), loaded.SequenceNumber())
+
+	// Failures are reported
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	failing := test.SimpleAggregate{}
+	failing.Initialize("big", test.GetTestRegistry(), store)
+	assert.NotNil(t, failing.Refresh())
+}
+
+// TestSnapshotCompliance checks S3 against the snapshot suite
+func TestSnapshotCompliance(t *testing.T) {
+	server := httptest.NewServer(&fakeBucket{objects: make(map[string]object)})
+	defer server.Close()
+	session := testSession(t, server)
+
+	test.CheckSnapshotSuite(t, "S3 Snap Middleware", func(options test.SnapshotOptions) (test.SnapshotStorage, func(), error) {
+		params := Parameters{
+			Lazy:         options.Lazy,
+			SnapInterval: options.SnapInterval,
+		}
+		snaps := &instance{
+			objects: s3client.New(session, "snapshots"),
+			params:  params,
+		}
+		mw, err := CreateWithSession(params, session, "snapshots")
+		if err != nil {
+			return test.SnapshotStorage{}, nil, err
+		}
+		base := memory.NewStore()
+		wrapped := eventsourcing.NewMiddlewareWrapper(base)
+		wrapped.Use(mw())
+
+		return test.SnapshotStorage{
+			Store: wrapped,
+			Inner: base,
+			Get:   snaps.get,
+			Put:   snaps.put,
+			Purge: snaps.purge,
+		}, func() {
+			wrapped.Close()
+		}, nil
+	})
+}
+
+// TestConditionalPut checks older snapshots never replace newer ones
+func TestConditionalPut(t *testing.T) {
+	bucket := &fakeBucket{objects: make(map[string]object)}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+	snaps := &instance{
+		objects: s3client.New(testSession(t, server), "snapshots"),
+	}
+
+	assert.Nil(t, snaps.put("raced", 5, map[string]interface{}{"count": 5}))
+	assert.Nil(t, snaps.put("raced", 3, map[string]interface{}{"count": 3}))
+	state, seq, errGet := snaps.get("raced")
+	assert.Nil(t, errGet)
+	assert.Equal(t, int64(5), seq, "The older snapshot should be skipped")
+	assert.Equal(t, "5", fmt.Sprint(state.(map[string]interface{})["count"]))
+
+	assert.Nil(t, snaps.put("raced", 5, map[string]interface{}{"count": 50}))
+	assert.Nil(t, snaps.put("raced", 8, map[string]interface{}{"count": 8}))
+	_, seq, _ = snaps.get("raced")
+	assert.Equal(t, int64(8), seq)
+
+	// A writer that changes the object between the check and the write is retried
+	raced := false
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && !raced {
+			raced = true
+			bucket.lock.Lock()
+			bucket.writes++
+			bucket.objects["/snapshots/raced"] = object{body: []byte(`{"count":20}`), sequence: "20", etag: "\"raced\""}
+			bucket.lock.Unlock()
+		}
+		bucket.ServeHTTP(w, r)
+	})
+	assert.Nil(t, snaps.put("raced", 10, map[string]interface{}{"count": 10}))
+	_, seq, _ = snaps.get("raced")
+	assert.Equal(t, int64(20), seq, "The racing writer's newer snapshot should be kept")
+}
@@ -0,0 +1,148 @@
+package snapbase
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// Admin administers the snapshots of the middleware created with it (see
+// Parameters.Admin), so that operators can purge or rebuild the snapshot of an
+// aggregate, i.e. after a bad deploy wrote corrupt snapshots. It implements
+// eventsourcing.SnapshotAdmin, and can be registered with a middleware wrapper
+// (HandleSnapshots) so that eventsourcing.PurgeSnapshot and
+// eventsourcing.RebuildSnapshot reach it through the store.
+type Admin struct {
+	lock        sync.Mutex
+	middlewares []*middleware
+}
+
+// NewAdmin creates an admin, to be passed to snapshot providers.
+func NewAdmin() *Admin {
+	return &Admin{}
+}
+
+// PurgeSnapshot deletes the snapshot of an aggregate, along with any snapshot
+// waiting to be written in the background.
+func (admin *Admin) PurgeSnapshot(key string) error {
+	return admin.each(func(mw *middleware) error {
+		return mw.purgeSnapshot(key)
+	})
+}
+
+// RebuildSnapshot purges the snapshot of an aggregate, and writes a fresh snapshot
+// of its full history the next time it is refreshed by this process.
+func (admin *Admin) RebuildSnapshot(key string) error {
+	return admin.each(func(mw *middleware) error {
+		mw.lock.Lock()
+		mw.rebuilds[key] = true
+		mw.lock.Unlock()
+		return mw.purgeSnapshot(key)
+	})
+}
+
+// RekeySnapshot re-encrypts the data key of the stored snapshot of an aggregate
+// under the current master key, in place, so that snapshots written under an old
+// key no longer need it once every aggregate has been rekeyed (see the rekey
+// utility). The state itself is not decrypted. It returns true if a snapshot was
+// rewritten, and false if there was none, or it was already under the current key.
+func (admin *Admin) RekeySnapshot(key string) (bool, error) {
+	rewritten := false
+	errRekey := admin.each(func(mw *middleware) error {
+		rekeyed, errSnapshot := mw.rekeySnapshot(key)
+		rewritten = rewritten || rekeyed
+		return errSnapshot
+	})
+	return rewritten, errRekey
+}
+
+// each runs an operation against every attached middleware
+func (admin *Admin) each(operation func(mw *middleware) error) error {
+	admin.lock.Lock()
+	middlewares := append([]*middleware(nil), admin.middlewares...)
+	admin.lock.Unlock()
+
+	if len(middlewares) == 0 {
+		return errors.New("Snap error: No snapshot middleware is using this admin")
+	}
+	for _, mw := range middlewares {
+		errOperation := operation(mw)
+		if errOperation != nil {
+			return errOperation
+		}
+	}
+	return nil
+}
+
+// attach adds a middleware to be administered
+func (admin *Admin) attach(mw *middleware) {
+	admin.lock.Lock()
+	defer admin.lock.Unlock()
+	admin.middlewares = append(admin.middlewares, mw)
+}
+
+// detach removes a middleware that has been closed
+func (admin *Admin) detach(mw *middleware) {
+	admin.lock.Lock()
+	defer admin.lock.Unlock()
+	for index, attached := range admin.middlewares {
+		if attached == mw {
+			admin.middlewares = append(admin.middlewares[:index], admin.middlewares[index+1:]...)
+			return
+		}
+	}
+}
+
+// purgeSnapshot deletes the stored and queued snapshots of an aggregate
+func (mw *middleware) purgeSnapshot(key string) error {
+	mw.discard(key)
+	return mw.params.Purge(key)
+}
+
+// rekeySnapshot re-encrypts the data key of a stored snapshot. The snapshot is put
+// back at the sequence it was read at, so a newer snapshot written meanwhile is
+// kept rather than replaced.
+func (mw *middleware) rekeySnapshot(key string) (bool, error) {
+	if mw.params.Keys == nil {
+		return false, errors.New("Snap error: Snapshots can't be rekeyed, as no keys are configured")
+	}
+
+	snap, seq, errGet := mw.params.Get(key)
+	if errGet != nil || snap == nil {
+		return false, errGet
+	}
+
+	sealed, changed, errRewrap := rewrap(mw.params.Keys, snap)
+	if errRewrap != nil || !changed {
+		return false, errRewrap
+	}
+	return true, mw.params.Put(key, seq, sealed)
+}
+
+// rebuildRequested checks if an aggregate should be snapped on refresh
+func (mw *middleware) rebuildRequested(key string) bool {
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+	return mw.rebuilds[key]
+}
+
+// rebuild replays the full history of an aggregate whose snapshot was purged by
+// RebuildSnapshot, and snaps the result. The rebuild stays pending until a
+// snapshot is written, so loaders that can't expose their state don't consume it,
+// and failed writes are retried on the next refresh.
+func (mw *middleware) rebuild(adapter eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+	errNext := next()
+	if errNext != nil {
+		return errNext
+	}
+
+	if adapter.SequenceNumber() > 0 && !mw.snapRead(adapter) {
+		return nil
+	}
+
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+	delete(mw.rebuilds, adapter.GetKey())
+	return nil
+}
@@ -0,0 +1,114 @@
+package snapbase
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// mapStorage is snapshot storage backed by a map
+type mapStorage struct {
+	snaps map[string]interface{}
+	seqs  map[string]int64
+}
+
+// parameters creates parameters that keep snapshots in the map
+func (storage *mapStorage) parameters() Parameters {
+	storage.snaps = make(map[string]interface{})
+	storage.seqs = make(map[string]int64)
+	return Parameters{
+		SnapInterval: 100,
+		Close:        func() error { return nil },
+		Get: func(key string) (interface{}, int64, error) {
+			return storage.snaps[key], storage.seqs[key], nil
+		},
+		Purge: func(key string) error {
+			delete(storage.snaps, key)
+			delete(storage.seqs, key)
+			return nil
+		},
+		Put: func(key string, seq int64, snap interface{}) error {
+			storage.snaps[key] = snap
+			storage.seqs[key] = seq
+			return nil
+		},
+	}
+}
+
+// TestAdminUnattached checks an admin without middleware reports an error
+func TestAdminUnattached(t *testing.T) {
+	admin := NewAdmin()
+	assert.NotNil(t, admin.PurgeSnapshot("key"))
+
+	params := fixedSnapshot(nil, 0)
+	params.Admin = admin
+	_, _, closer := Create(params)
+	assert.Nil(t, admin.PurgeSnapshot("key"))
+	assert.Nil(t, closer())
+	assert.NotNil(t, admin.PurgeSnapshot("key"), "Closed middleware should be detached")
+}
+
+// TestAdminPurge checks purged snapshots are replaced by replaying the events
+func TestAdminPurge(t *testing.T) {
+	storage := &mapStorage{}
+	params := storage.parameters()
+	params.SnapInterval = 1
+	params.Admin = NewAdmin()
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(params))
+	assert.Nil(t, eventsourcing.HandleSnapshots(store, params.Admin))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("purged", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 2})
+	assert.Nil(t, agg.Commit())
+	assert.Contains(t, storage.snaps, "purged")
+
+	// Corrupt the snapshot, and purge it
+	storage.snaps["purged"] = map[string]interface{}{"current_count": 1000}
+	assert.Nil(t, eventsourcing.PurgeSnapshot(store, "purged"))
+	assert.NotContains(t, storage.snaps, "purged")
+
+	reloaded := test.SimpleAggregate{}
+	reloaded.Initialize("purged", test.GetTestRegistry(), store)
+	assert.Nil(t, reloaded.Refresh())
+	assert.Equal(t, 2, reloaded.CurrentCount)
+}
+
+// TestAdminRebuild checks rebuilt snapshots are written on the next refresh
+func TestAdminRebuild(t *testing.T) {
+	storage := &mapStorage{}
+	params := storage.parameters()
+	params.Admin = NewAdmin()
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(params))
+	assert.Nil(t, eventsourcing.HandleSnapshots(store, params.Admin))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("rebuilt", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 2})
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 3})
+	assert.Nil(t, agg.Commit())
+	params.Put("rebuilt", 1, map[string]interface{}{"current_count": 1000})
+
+	assert.Nil(t, eventsourcing.RebuildSnapshot(store, "rebuilt"))
+	assert.NotContains(t, storage.snaps, "rebuilt")
+
+	reloaded := test.SimpleAggregate{}
+	reloaded.Initialize("rebuilt", test.GetTestRegistry(), store)
+	assert.Nil(t, reloaded.Refresh())
+	assert.Equal(t, 5, reloaded.CurrentCount)
+	assert.Equal(t, int64(2), storage.seqs["rebuilt"], "A fresh snapshot should be written")
+	assert.Equal(t, "5", string(storage.snaps["rebuilt"].(map[string]interface{})["current_count"].(json.Number)))
+
+	// Later refreshes restore the snapshot as normal
+	delete(storage.snaps, "rebuilt")
+	again := test.SimpleAggregate{}
+	again.Initialize("rebuilt", test.GetTestRegistry(), store)
+	assert.Nil(t, again.Refresh())
+	assert.NotContains(t, storage.snaps, "rebuilt", "The rebuild should only happen once")
+}
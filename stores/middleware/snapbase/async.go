@@ -0,0 +1,155 @@
+package snapbase
+
+import (
+	"sync"
+)
+
+// queued is a snapshot waiting to be written
+type queued struct {
+	sequence int64
+	state    map[string]interface{}
+}
+
+// worker writes snapshots in the background, so that commits don't wait on the
+// snapshot storage. Snapshots are coalesced by key: if an aggregate is snapped
+// again before its last snapshot was written, only the latest is written.
+type worker struct {
+	lock    sync.Mutex
+	queue   map[string]queued
+	write   func(batch map[string]queued)
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// startWorker starts a background writer of snapshots
+func startWorker(write func(batch map[string]queued)) *worker {
+	w := &worker{
+		queue:   make(map[string]queued),
+		write:   write,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// run writes snapshots as they are queued, until stopped
+func (w *worker) run() {
+	defer close(w.stopped)
+	for {
+		select {
+		case <-w.wake:
+			w.flush()
+		case <-w.done:
+			w.flush()
+			return
+		}
+	}
+}
+
+// flush writes every queued snapshot as a batch. Snapshots stay queued until they
+// are written, so that lazy refreshes see them while the write is in flight.
+func (w *worker) flush() {
+	w.lock.Lock()
+	batch := make(map[string]queued, len(w.queue))
+	for key, snap := range w.queue {
+		batch[key] = snap
+	}
+	w.lock.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+	w.write(batch)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for key, snap := range batch {
+		if current, found := w.queue[key]; found && current.sequence == snap.sequence {
+			delete(w.queue, key)
+		}
+	}
+}
+
+// stop writes any queued snapshots, and stops the worker
+func (w *worker) stop() {
+	close(w.done)
+	<-w.stopped
+}
+
+// enqueue queues a snapshot to be written, replacing any older one for the key
+func (mw *middleware) enqueue(key string, seq int64, snap map[string]interface{}) {
+	w := mw.worker
+	w.lock.Lock()
+	if existing, found := w.queue[key]; !found || existing.sequence < seq {
+		w.queue[key] = queued{sequence: seq, state: snap}
+	}
+	w.lock.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// writeBatch writes a batch of queued snapshots, in one call to the storage if it
+// can put many snapshots at once. Failures are reported rather than returned.
+func (mw *middleware) writeBatch(batch map[string]queued) {
+	if mw.params.PutMany == nil {
+		for key, snap := range batch {
+			if errWrite := mw.write(key, snap.sequence, snap.state); errWrite != nil {
+				mw.reportError(key, errWrite)
+			}
+		}
+		return
+	}
+
+	entries := make([]Entry, 0, len(batch))
+	for key, snap := range batch {
+		stored, tooLarge, errPrepare := mw.prepare(key, snap.state)
+		switch {
+		case errPrepare != nil:
+			mw.reportError(key, errPrepare)
+		case tooLarge:
+			if errPurge := mw.params.Purge(key); errPurge != nil {
+				mw.reportError(key, errPurge)
+			}
+		default:
+			entries = append(entries, Entry{Key: key, Sequence: snap.sequence, State: stored})
+		}
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+	if errPut := mw.params.PutMany(entries); errPut != nil {
+		for _, entry := range entries {
+			mw.reportError(entry.Key, errPut)
+		}
+	}
+}
+
+// discard drops any queued snapshot for a key
+func (mw *middleware) discard(key string) {
+	if mw.worker == nil {
+		return
+	}
+
+	mw.worker.lock.Lock()
+	defer mw.worker.lock.Unlock()
+	delete(mw.worker.queue, key)
+}
+
+// pending gets the queued snapshot for a key, if there is one
+func (mw *middleware) pending(key string) (map[string]interface{}, int64, bool) {
+	if mw.worker == nil {
+		return nil, 0, false
+	}
+
+	mw.worker.lock.Lock()
+	defer mw.worker.lock.Unlock()
+	snap, found := mw.worker.queue[key]
+	return snap.state, snap.sequence, found
+}
@@ -0,0 +1,144 @@
+package snapbase
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedStorage is snapshot storage whose writes wait until released
+type gatedStorage struct {
+	lock    sync.Mutex
+	gate    chan struct{}
+	started chan int64
+	written []int64
+	fail    bool
+}
+
+// parameters creates asynchronous parameters over the storage
+func (storage *gatedStorage) parameters() Parameters {
+	return Parameters{
+		Lazy:         true,
+		Async:        true,
+		SnapInterval: 1,
+		Close:        func() error { return nil },
+		Get:          func(string) (interface{}, int64, error) { return nil, 0, nil },
+		Purge:        func(string) error { return nil },
+		Put: func(key string, seq int64, snap interface{}) error {
+			storage.started <- seq
+			<-storage.gate
+			storage.lock.Lock()
+			defer storage.lock.Unlock()
+			if storage.fail {
+				return errors.New("Storage unavailable")
+			}
+			storage.written = append(storage.written, seq)
+			return nil
+		},
+	}
+}
+
+// TestAsyncSnapshots checks commits don't wait for snapshot writes, that queued
+// snapshots are coalesced and seen by refreshes, and that closing flushes them
+func TestAsyncSnapshots(t *testing.T) {
+	storage := &gatedStorage{
+		gate:    make(chan struct{}),
+		started: make(chan int64, 10),
+	}
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	commit, refresh, closer := Create(storage.parameters())
+	store.Use(commit, refresh, closer)
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("async", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+	assert.Equal(t, int64(1), <-storage.started, "The first snapshot should be in flight")
+
+	// Later snapshots queue up behind it, and are coalesced
+	for i := 0; i < 3; i++ {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+		assert.Nil(t, agg.Commit())
+	}
+
+	// Lazy refreshes restore the newest snapshot, even though it isn't written
+	loaded := test.SimpleAggregate{}
+	loaded.Initialize("async", test.GetTestRegistry(), store)
+	assert.Nil(t, loaded.Refresh())
+	assert.Equal(t, 4, loaded.CurrentCount)
+	assert.Equal(t, int64(4), loaded.SequenceNumber())
+
+	go func() {
+		for range storage.started {
+			storage.gate <- struct{}{}
+		}
+	}()
+	storage.gate <- struct{}{}
+	assert.Nil(t, closer())
+	assert.Equal(t, []int64{1, 4}, storage.written)
+	close(storage.started)
+}
+
+// TestAsyncErrors checks failed background writes are reported
+func TestAsyncErrors(t *testing.T) {
+	storage := &gatedStorage{
+		gate:    make(chan struct{}),
+		started: make(chan int64, 10),
+		fail:    true,
+	}
+	failed := make(chan string, 1)
+	params := storage.parameters()
+	params.OnError = func(key string, err error) {
+		failed <- key
+	}
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(params))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("failing", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit(), "Snapshot failures shouldn't fail the commit")
+	<-storage.started
+	storage.gate <- struct{}{}
+	assert.Equal(t, "failing", <-failed)
+	assert.Nil(t, store.Close())
+}
+
+// TestAsyncBatches checks background snapshots are put in batches, when the
+// storage can put many at once
+func TestAsyncBatches(t *testing.T) {
+	var lock sync.Mutex
+	written := make(map[string]int64)
+	params := fixedSnapshot(nil, 0)
+	params.Lazy = true
+	params.Async = true
+	params.Put = func(string, int64, interface{}) error {
+		t.Error("Snapshots should be put in batches")
+		return nil
+	}
+	params.PutMany = func(entries []Entry) error {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, entry := range entries {
+			written[entry.Key] = entry.Sequence
+		}
+		return nil
+	}
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(params))
+
+	for _, key := range []string{"batch-a", "batch-b", "batch-c"} {
+		agg := test.SimpleAggregate{}
+		agg.Initialize(key, test.GetTestRegistry(), store)
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+		assert.Nil(t, agg.Commit())
+	}
+
+	assert.Nil(t, store.Close())
+	assert.Equal(t, map[string]int64{"batch-a": 1, "batch-b": 1, "batch-c": 1}, written)
+}
@@ -0,0 +1,321 @@
+package snapbase
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Cloner copies the state of an aggregate into a snapshot, which must not share
+// any memory with the state, as aggregates keep changing after they are snapped
+// while snapshots may be held in memory.
+type Cloner func(state interface{}) (map[string]interface{}, error)
+
+// SnapshotCloner is implemented by aggregate states that copy themselves into
+// snapshots, i.e. by hand for states that are snapped very often. The snapshot
+// should be shaped like the JSON encoding of the state, so that it restores
+// through the codec of the aggregate.
+type SnapshotCloner interface {
+	// CloneSnapshot copies the state into a new snapshot.
+	CloneSnapshot() (map[string]interface{}, error)
+}
+
+// CloneJSON copies a state by encoding it as JSON and decoding the result, which
+// is the default. Numbers are decoded as json.Number, so they aren't rounded.
+func CloneJSON(state interface{}) (map[string]interface{}, error) {
+	snapped, errMarshal := json.Marshal(state)
+	if errMarshal != nil {
+		return nil, errMarshal
+	}
+	cloned := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(snapped))
+	decoder.UseNumber()
+	errClone := decoder.Decode(&cloned)
+	if errClone != nil {
+		return nil, errClone
+	}
+	return cloned, nil
+}
+
+// CloneReflect copies a state by walking it, building the same shape of snapshot
+// as CloneJSON without encoding the state, so that states snapped on every commit
+// (i.e. lazily) don't allocate a copy of their JSON each time. Fields are named
+// and omitted by their json tags, and embedded structs are flattened, while
+// values that encode themselves (json.Marshaler, encoding.TextMarshaler, or
+// fields tagged ",string") fall back to JSON. Numbers keep their Go types.
+func CloneReflect(state interface{}) (map[string]interface{}, error) {
+	cloned, errClone := cloneValue(reflect.ValueOf(state))
+	if errClone != nil {
+		return nil, errClone
+	}
+
+	snap, ok := cloned.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Snap error: State of type %T is not an object", state)
+	}
+	return snap, nil
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// cloneValue copies a value into its JSON-like form
+func cloneValue(value reflect.Value) (interface{}, error) {
+	if !value.IsValid() {
+		return nil, nil
+	}
+	if marshaler, ok := selfEncoding(value); ok {
+		return cloneEncoded(marshaler)
+	}
+
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return nil, nil
+		}
+		return cloneValue(value.Elem())
+	case reflect.Struct:
+		return cloneStruct(value)
+	case reflect.Map:
+		return cloneMap(value)
+	case reflect.Slice:
+		if value.IsNil() {
+			return nil, nil
+		}
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			return base64.StdEncoding.EncodeToString(value.Bytes()), nil
+		}
+		return cloneList(value)
+	case reflect.Array:
+		return cloneList(value)
+	case reflect.Bool:
+		return value.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return value.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), nil
+	case reflect.String:
+		return value.String(), nil
+	default:
+		return nil, &json.UnsupportedTypeError{Type: value.Type()}
+	}
+}
+
+// selfEncoding checks if a value encodes itself, as JSON would find it
+func selfEncoding(value reflect.Value) (interface{}, bool) {
+	if value.Kind() == reflect.Ptr && value.IsNil() {
+		return nil, false
+	}
+	if value.Type().Implements(jsonMarshalerType) || value.Type().Implements(textMarshalerType) {
+		return value.Interface(), true
+	}
+	if value.CanAddr() {
+		pointer := reflect.PtrTo(value.Type())
+		if pointer.Implements(jsonMarshalerType) || pointer.Implements(textMarshalerType) {
+			return value.Addr().Interface(), true
+		}
+	}
+	return nil, false
+}
+
+// cloneEncoded copies a value that encodes itself through JSON
+func cloneEncoded(value interface{}) (interface{}, error) {
+	encoded, errMarshal := json.Marshal(value)
+	if errMarshal != nil {
+		return nil, errMarshal
+	}
+
+	var cloned interface{}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	errDecode := decoder.Decode(&cloned)
+	return cloned, errDecode
+}
+
+// cloneList copies the elements of a slice or array
+func cloneList(value reflect.Value) (interface{}, error) {
+	cloned := make([]interface{}, value.Len())
+	for i := range cloned {
+		element, errElement := cloneValue(value.Index(i))
+		if errElement != nil {
+			return nil, errElement
+		}
+		cloned[i] = element
+	}
+	return cloned, nil
+}
+
+// cloneMap copies a map, which must have keys that JSON can encode as strings
+func cloneMap(value reflect.Value) (interface{}, error) {
+	if value.IsNil() {
+		return nil, nil
+	}
+	if value.Type().Key().Kind() != reflect.String {
+		return cloneEncoded(value.Interface())
+	}
+
+	cloned := make(map[string]interface{}, value.Len())
+	for _, key := range value.MapKeys() {
+		element, errElement := cloneValue(value.MapIndex(key))
+		if errElement != nil {
+			return nil, errElement
+		}
+		cloned[key.String()] = element
+	}
+	return cloned, nil
+}
+
+// cloneStruct copies the encoded fields of a struct
+func cloneStruct(value reflect.Value) (interface{}, error) {
+	fields, plain := structFields(value.Type())
+	if !plain {
+		return cloneEncoded(value.Interface())
+	}
+
+	cloned := make(map[string]interface{}, len(fields))
+	errFields := cloneFields(value, fields, cloned)
+	if errFields != nil {
+		return nil, errFields
+	}
+	return cloned, nil
+}
+
+// cloneFields copies the fields of a struct into a snapshot, with fields of
+// embedded structs added after (and so losing to) the fields of the struct itself
+func cloneFields(value reflect.Value, fields []cloneField, cloned map[string]interface{}) error {
+	embedded := make([]reflect.Value, 0)
+	for _, field := range fields {
+		fieldValue := value.Field(field.index)
+		if field.embedded {
+			if fieldValue.Kind() == reflect.Ptr {
+				if fieldValue.IsNil() {
+					continue
+				}
+				fieldValue = fieldValue.Elem()
+			}
+			embedded = append(embedded, fieldValue)
+			continue
+		}
+		if field.omitEmpty && isEmptyValue(fieldValue) {
+			continue
+		}
+
+		element, errElement := cloneValue(fieldValue)
+		if errElement != nil {
+			return errElement
+		}
+		cloned[field.name] = element
+	}
+
+	for _, inner := range embedded {
+		promoted := make(map[string]interface{})
+		innerFields, _ := structFields(inner.Type())
+		errInner := cloneFields(inner, innerFields, promoted)
+		if errInner != nil {
+			return errInner
+		}
+		for name, element := range promoted {
+			if _, found := cloned[name]; !found {
+				cloned[name] = element
+			}
+		}
+	}
+	return nil
+}
+
+// cloneField describes how a field of a struct is encoded
+type cloneField struct {
+	index     int
+	name      string
+	omitEmpty bool
+	embedded  bool // Untagged embedded struct, whose fields are promoted
+}
+
+// cloneFieldCache holds the encoded fields of each struct type
+var cloneFieldCache sync.Map
+
+// cachedFields is the cached description of a struct type
+type cachedFields struct {
+	fields []cloneField
+	plain  bool // False if a field is encoded as a string (",string")
+}
+
+// structFields describes the encoded fields of a struct type
+func structFields(structType reflect.Type) ([]cloneField, bool) {
+	if cached, found := cloneFieldCache.Load(structType); found {
+		return cached.(cachedFields).fields, cached.(cachedFields).plain
+	}
+
+	described := cachedFields{plain: true}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, options = tag[:comma], tag[comma+1:]
+		}
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			if _, innerPlain := structFields(fieldType); !innerPlain {
+				described.plain = false
+			}
+			described.fields = append(described.fields, cloneField{index: i, embedded: true})
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		for _, option := range strings.Split(options, ",") {
+			if option == "string" {
+				described.plain = false
+			}
+		}
+		described.fields = append(described.fields, cloneField{
+			index:     i,
+			name:      name,
+			omitEmpty: strings.Contains(","+options+",", ",omitempty,"),
+		})
+	}
+
+	cloneFieldCache.Store(structType, described)
+	return described.fields, described.plain
+}
+
+// isEmptyValue checks if a value is omitted by omitempty
+func isEmptyValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return value.Len() == 0
+	case reflect.Bool:
+		return !value.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return value.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return value.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return value.IsNil()
+	}
+	return false
+}
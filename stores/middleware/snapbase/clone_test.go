@@ -0,0 +1,181 @@
+package snapbase
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// cloneStatus is a named string type
+type cloneStatus string
+
+// cloneAudit is embedded in cloneState
+type cloneAudit struct {
+	CreatedBy string    `json:"created_by"`
+	Created   time.Time `json:"created"`
+	Name      string    `json:"name"`
+}
+
+// cloneLine is a nested struct
+type cloneLine struct {
+	SKU      string  `json:"sku"`
+	Quantity int     `json:"quantity"`
+	Price    float64 `json:"price,omitempty"`
+}
+
+// cloneQuoted has a number encoded as a string
+type cloneQuoted struct {
+	Value int64 `json:"value,string"`
+}
+
+// cloneState has most of the shapes a state can take
+type cloneState struct {
+	cloneAudit
+	Name     string                 `json:"name"`
+	Status   cloneStatus            `json:"status"`
+	Lines    []cloneLine            `json:"lines"`
+	Totals   map[string]int64       `json:"totals"`
+	Counts   map[int]string         `json:"counts"`
+	Extra    map[string]interface{} `json:"extra"`
+	Blob     []byte                 `json:"blob"`
+	Parent   *cloneLine             `json:"parent"`
+	Optional string                 `json:"optional,omitempty"`
+	Quoted   cloneQuoted            `json:"quoted"`
+	Ignored  string                 `json:"-"`
+	Untagged bool
+	hidden   int
+}
+
+// sample creates a populated state
+func sample() *cloneState {
+	return &cloneState{
+		cloneAudit: cloneAudit{CreatedBy: "admin", Created: time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC), Name: "shadowed"},
+		Name:       "order",
+		Status:     "open",
+		Lines:      []cloneLine{{SKU: "a", Quantity: 2, Price: 1.5}, {SKU: "b", Quantity: 1}},
+		Totals:     map[string]int64{"net": 300},
+		Counts:     map[int]string{1: "one"},
+		Extra:      map[string]interface{}{"nested": []interface{}{"x", 1}},
+		Blob:       []byte("binary"),
+		Quoted:     cloneQuoted{Value: 42},
+		Ignored:    "ignored",
+		Untagged:   true,
+		hidden:     7,
+	}
+}
+
+// normalize encodes a snapshot as JSON, so that differences in number types
+// don't matter
+func normalize(t *testing.T, snap map[string]interface{}) string {
+	encoded, errEncode := json.Marshal(snap)
+	assert.Nil(t, errEncode)
+	return string(encoded)
+}
+
+// TestCloneReflect checks reflective clones match JSON clones
+func TestCloneReflect(t *testing.T) {
+	state := sample()
+	expected, errJSON := CloneJSON(state)
+	assert.Nil(t, errJSON)
+	cloned, errReflect := CloneReflect(state)
+	assert.Nil(t, errReflect)
+	assert.Equal(t, normalize(t, expected), normalize(t, cloned))
+
+	assert.Equal(t, "order", cloned["name"], "Fields should shadow embedded fields")
+	assert.Equal(t, int64(2), cloned["lines"].([]interface{})[0].(map[string]interface{})["quantity"])
+	assert.NotContains(t, cloned, "optional")
+	assert.NotContains(t, cloned, "hidden")
+}
+
+// TestCloneReflectCopies checks clones share no memory with the state
+func TestCloneReflectCopies(t *testing.T) {
+	state := sample()
+	cloned, errReflect := CloneReflect(state)
+	assert.Nil(t, errReflect)
+
+	state.Lines[0].Quantity = 100
+	state.Totals["net"] = 0
+	state.Extra["nested"].([]interface{})[0] = "changed"
+	assert.Equal(t, int64(2), cloned["lines"].([]interface{})[0].(map[string]interface{})["quantity"])
+	assert.Equal(t, int64(300), cloned["totals"].(map[string]interface{})["net"])
+	assert.Equal(t, "x", cloned["extra"].(map[string]interface{})["nested"].([]interface{})[0])
+}
+
+// TestCloneReflectErrors checks states JSON can't encode are rejected
+func TestCloneReflectErrors(t *testing.T) {
+	_, errScalar := CloneReflect(5)
+	assert.NotNil(t, errScalar)
+	_, errChannel := CloneReflect(map[string]interface{}{"events": make(chan int)})
+	assert.NotNil(t, errChannel)
+}
+
+// selfCloning is a state that clones itself
+type selfCloning struct {
+	test.SimpleAggregate
+	clones int
+}
+
+// CloneSnapshot copies the count by hand
+func (agg *selfCloning) CloneSnapshot() (map[string]interface{}, error) {
+	agg.clones++
+	return map[string]interface{}{"current_count": agg.CurrentCount}, nil
+}
+
+// TestCloners checks the cloner is used to snap, unless the state clones itself
+func TestCloners(t *testing.T) {
+	var snapped interface{}
+	params := fixedSnapshot(nil, 0)
+	params.SnapInterval = 1
+	params.Cloner = CloneReflect
+	params.Put = func(key string, seq int64, snap interface{}) error {
+		snapped = snap
+		return nil
+	}
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(params))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("reflected", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 2})
+	assert.Nil(t, agg.Commit())
+	assert.Equal(t, int64(2), snapped.(map[string]interface{})["current_count"])
+
+	custom := &selfCloning{}
+	custom.AggregateBase.Initialize("custom", test.GetTestRegistry(), store, func() interface{} { return custom })
+	custom.AggregateBase.AutomaticWireup(custom)
+	custom.ApplyEvent(test.IncrementEvent{IncrementBy: 3})
+	assert.Nil(t, custom.Commit())
+	assert.Equal(t, 1, custom.clones)
+	assert.Equal(t, 3, snapped.(map[string]interface{})["current_count"])
+}
+
+// benchmarkState is a plain state with many nested values
+func benchmarkState() interface{} {
+	state := &cloneState{Totals: map[string]int64{}}
+	for i := 0; i < 100; i++ {
+		state.Lines = append(state.Lines, cloneLine{SKU: "sku", Quantity: i, Price: 1.5})
+		state.Totals[string(rune('a'+i%26))] = int64(i)
+	}
+	return state
+}
+
+// BenchmarkCloneJSON measures cloning through JSON
+func BenchmarkCloneJSON(b *testing.B) {
+	state := benchmarkState()
+	for i := 0; i < b.N; i++ {
+		CloneJSON(state)
+	}
+}
+
+// BenchmarkCloneReflect measures cloning by reflection
+func BenchmarkCloneReflect(b *testing.B) {
+	state := benchmarkState()
+	for i := 0; i < b.N; i++ {
+		CloneReflect(state)
+	}
+}
@@ -0,0 +1,111 @@
+package snapbase
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor compresses the state of snapshots before they are persisted, so
+// that the snapshots of large aggregates fit within the item limits of the
+// snapshot storage (such as the 400KB limit of DynamoDB).
+type Compressor interface {
+	// Name identifies the compression, and is stored with each snapshot
+	Name() string
+
+	// Compress compresses the JSON of a state
+	Compress(data []byte) ([]byte, error)
+
+	// Decompress reverses Compress
+	Decompress(data []byte) ([]byte, error)
+}
+
+// gzipCompressor compresses snapshots with gzip
+type gzipCompressor struct{}
+
+// Gzip gets a compressor that uses gzip.
+func Gzip() Compressor {
+	return gzipCompressor{}
+}
+
+// Name identifies the compression
+func (gzipCompressor) Name() string {
+	return "gzip"
+}
+
+// Compress compresses the JSON of a state
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, errWrite := writer.Write(data); errWrite != nil {
+		return nil, errWrite
+	}
+	if errClose := writer.Close(); errClose != nil {
+		return nil, errClose
+	}
+	return buffer.Bytes(), nil
+}
+
+// Decompress reverses Compress
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	reader, errReader := gzip.NewReader(bytes.NewReader(data))
+	if errReader != nil {
+		return nil, errReader
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// zstdCompressor compresses snapshots with zstd, sharing an encoder and decoder
+// between all snapshots.
+type zstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+// sharedZstd is the zstd compressor
+var sharedZstd = &zstdCompressor{}
+
+// Zstd gets a compressor that uses zstd, which is faster than gzip and usually
+// compresses state further.
+func Zstd() Compressor {
+	return sharedZstd
+}
+
+// Name identifies the compression
+func (compressor *zstdCompressor) Name() string {
+	return "zstd"
+}
+
+// init creates the encoder and decoder when first used
+func (compressor *zstdCompressor) init() error {
+	compressor.once.Do(func() {
+		compressor.encoder, compressor.err = zstd.NewWriter(nil)
+		if compressor.err != nil {
+			return
+		}
+		compressor.decoder, compressor.err = zstd.NewReader(nil)
+	})
+	return compressor.err
+}
+
+// Compress compresses the JSON of a state
+func (compressor *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	if errInit := compressor.init(); errInit != nil {
+		return nil, errInit
+	}
+	return compressor.encoder.EncodeAll(data, nil), nil
+}
+
+// Decompress reverses Compress
+func (compressor *zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	if errInit := compressor.init(); errInit != nil {
+		return nil, errInit
+	}
+	return compressor.decoder.DecodeAll(data, nil)
+}
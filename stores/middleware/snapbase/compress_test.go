@@ -0,0 +1,93 @@
+package snapbase
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCompressors checks each compressor round-trips
+func TestCompressors(t *testing.T) {
+	data := []byte(strings.Repeat(`{"current_count":50}`, 100))
+	for _, compressor := range []Compressor{Gzip(), Zstd()} {
+		compressed, errCompress := compressor.Compress(data)
+		assert.Nil(t, errCompress, compressor.Name())
+		assert.True(t, len(compressed) < len(data), compressor.Name())
+
+		decompressed, errDecompress := compressor.Decompress(compressed)
+		assert.Nil(t, errDecompress, compressor.Name())
+		assert.Equal(t, data, decompressed, compressor.Name())
+	}
+}
+
+// TestCompressedSnapshots checks snapshots are written compressed, and restored
+func TestCompressedSnapshots(t *testing.T) {
+	var written interface{}
+	params := fixedSnapshot(nil, 0)
+	params.Lazy = true
+	params.Compressor = Zstd()
+	params.Put = func(key string, seq int64, snap interface{}) error {
+		written = snap
+		return nil
+	}
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(params))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("compressed", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 7})
+	assert.Nil(t, agg.Commit())
+
+	snap := written.(map[string]interface{})
+	assert.Equal(t, "zstd", snap[CompressionKey])
+	assert.IsType(t, []byte{}, snap[PayloadKey])
+
+	// Storage that keeps snapshots as JSON holds the payload as base64, and
+	// snapshots written with another compressor can still be read
+	stored := map[string]interface{}{
+		CompressionKey: "zstd",
+		PayloadKey:     base64.StdEncoding.EncodeToString(snap[PayloadKey].([]byte)),
+	}
+	reader := fixedSnapshot(stored, 1)
+	reader.Lazy = true
+	reader.Compressor = Gzip()
+	restoring := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	restoring.Use(Create(reader))
+
+	restored := test.SimpleAggregate{}
+	restored.Initialize("compressed", test.GetTestRegistry(), restoring)
+	assert.Nil(t, restored.Refresh())
+	assert.Equal(t, 7, restored.CurrentCount)
+	assert.Equal(t, int64(1), restored.SequenceNumber())
+}
+
+// TestOpenCompressed checks uncompressed snapshots pass through, and unknown
+// compression fails
+func TestOpenCompressed(t *testing.T) {
+	mw := &middleware{params: Parameters{Compressor: Gzip()}}
+	plain := map[string]interface{}{"current_count": 50}
+	passed, errPlain := mw.open("key", plain)
+	assert.Nil(t, errPlain)
+	assert.Equal(t, plain, passed)
+
+	sealed, errSeal := mw.seal("key", plain)
+	assert.Nil(t, errSeal)
+	opened, errOpen := (&middleware{}).open("key", sealed)
+	assert.Nil(t, errOpen)
+	assert.Equal(t, map[string]interface{}{"current_count": json.Number("50")}, opened)
+
+	_, errUnknown := mw.open("key", map[string]interface{}{CompressionKey: "brotli", PayloadKey: []byte{}})
+	assert.NotNil(t, errUnknown)
+}
+
+// TestMeasureBinary checks binary payloads are measured as base64
+func TestMeasureBinary(t *testing.T) {
+	assert.Equal(t, int64(2+4), measure(make([]byte, 3), 100))
+	assert.Equal(t, int64(2+8), measure(make([]byte, 4), 100))
+}
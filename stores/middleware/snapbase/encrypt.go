@@ -0,0 +1,241 @@
+package snapbase
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// KeyProvider supplies the master keys that snapshots are encrypted under. Each
+// snapshot is encrypted with a fresh data key, which is itself encrypted with the
+// current master key and stored alongside it, along with the ID of the master key.
+// Keys are rotated by changing the current key: new snapshots are written under
+// the new key, while older snapshots are still decrypted with the key they name,
+// until they are next rewritten (or rebuilt with RebuildSnapshot or prewarm.Run).
+// Providers backed by a key management service can wrap data keys remotely by
+// implementing KeyWrapper.
+type KeyProvider interface {
+	// CurrentKey gets the ID and the key that new snapshots are encrypted under.
+	CurrentKey() (string, []byte, error)
+
+	// Key gets a key by its ID, to decrypt snapshots written under it.
+	Key(id string) ([]byte, error)
+}
+
+// KeyWrapper is implemented by key providers that encrypt data keys themselves,
+// rather than handing out master keys, such as those backed by a key management
+// service.
+type KeyWrapper interface {
+	// WrapKey encrypts a data key under the current master key, returning the ID
+	// of the master key and the encrypted data key.
+	WrapKey(dataKey []byte) (string, []byte, error)
+
+	// UnwrapKey decrypts a data key encrypted under the identified master key.
+	UnwrapKey(id string, wrapped []byte) ([]byte, error)
+}
+
+// StaticKeyProvider is a key provider with a fixed set of keys, created with
+// StaticKeys.
+type StaticKeyProvider struct {
+	lock    sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// StaticKeys creates a key provider from a set of AES keys (16, 24 or 32 bytes),
+// keyed by ID, encrypting new snapshots under the current key. Rotate switches
+// the current key.
+func StaticKeys(current string, keys map[string][]byte) (*StaticKeyProvider, error) {
+	provider := &StaticKeyProvider{
+		keys: make(map[string][]byte),
+	}
+	for id, key := range keys {
+		provider.keys[id] = key
+	}
+
+	errRotate := provider.Rotate(current)
+	if errRotate != nil {
+		return nil, errRotate
+	}
+	return provider, nil
+}
+
+// Add adds a key, without making it current.
+func (provider *StaticKeyProvider) Add(id string, key []byte) {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+	provider.keys[id] = key
+}
+
+// Rotate makes a known key the current key.
+func (provider *StaticKeyProvider) Rotate(id string) error {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+	if _, found := provider.keys[id]; !found {
+		return fmt.Errorf("Snap error: Unknown key %v", id)
+	}
+	provider.current = id
+	return nil
+}
+
+// CurrentKey gets the ID and the key that new snapshots are encrypted under.
+func (provider *StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	provider.lock.RLock()
+	defer provider.lock.RUnlock()
+	return provider.current, provider.keys[provider.current], nil
+}
+
+// Key gets a key by its ID, to decrypt snapshots written under it.
+func (provider *StaticKeyProvider) Key(id string) ([]byte, error) {
+	provider.lock.RLock()
+	defer provider.lock.RUnlock()
+	key, found := provider.keys[id]
+	if !found {
+		return nil, fmt.Errorf("Snap error: Unknown key %v", id)
+	}
+	return key, nil
+}
+
+// dataKeySize is the size of the AES-256 data keys snapshots are encrypted with
+const dataKeySize = 32
+
+// encrypt encrypts a snapshot payload under a fresh data key, returning the ID of
+// the master key, the wrapped data key, and the encrypted payload. The aggregate
+// key is authenticated with the payload, so that snapshots can't be swapped
+// between aggregates.
+func encrypt(provider KeyProvider, aggregateKey string, payload []byte) (string, []byte, []byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, errRandom := io.ReadFull(rand.Reader, dataKey); errRandom != nil {
+		return "", nil, nil, errRandom
+	}
+
+	id, wrapped, errWrap := wrapKey(provider, dataKey)
+	if errWrap != nil {
+		return "", nil, nil, errWrap
+	}
+
+	sealed, errSeal := sealGCM(dataKey, payload, []byte(aggregateKey))
+	if errSeal != nil {
+		return "", nil, nil, errSeal
+	}
+	return id, wrapped, sealed, nil
+}
+
+// decrypt reverses encrypt
+func decrypt(provider KeyProvider, aggregateKey string, id string, wrapped []byte, sealed []byte) ([]byte, error) {
+	dataKey, errUnwrap := unwrapKey(provider, id, wrapped)
+	if errUnwrap != nil {
+		return nil, errUnwrap
+	}
+	return openGCM(dataKey, sealed, []byte(aggregateKey))
+}
+
+// wrapKey encrypts a data key under the current master key
+func wrapKey(provider KeyProvider, dataKey []byte) (string, []byte, error) {
+	if wrapper, ok := provider.(KeyWrapper); ok {
+		return wrapper.WrapKey(dataKey)
+	}
+
+	id, master, errKey := provider.CurrentKey()
+	if errKey != nil {
+		return "", nil, errKey
+	}
+	wrapped, errSeal := sealGCM(master, dataKey, []byte(id))
+	return id, wrapped, errSeal
+}
+
+// unwrapKey decrypts a data key encrypted under a master key
+func unwrapKey(provider KeyProvider, id string, wrapped []byte) ([]byte, error) {
+	if wrapper, ok := provider.(KeyWrapper); ok {
+		return wrapper.UnwrapKey(id, wrapped)
+	}
+
+	master, errKey := provider.Key(id)
+	if errKey != nil {
+		return nil, errKey
+	}
+	return openGCM(master, wrapped, []byte(id))
+}
+
+// sealGCM encrypts with AES-GCM, prefixing the output with a random nonce
+func sealGCM(key []byte, plain []byte, additional []byte) ([]byte, error) {
+	aead, errAEAD := newGCM(key)
+	if errAEAD != nil {
+		return nil, errAEAD
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, errRandom := io.ReadFull(rand.Reader, nonce); errRandom != nil {
+		return nil, errRandom
+	}
+	return aead.Seal(nonce, nonce, plain, additional), nil
+}
+
+// openGCM reverses sealGCM
+func openGCM(key []byte, sealed []byte, additional []byte) ([]byte, error) {
+	aead, errAEAD := newGCM(key)
+	if errAEAD != nil {
+		return nil, errAEAD
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Snap error: Encrypted snapshot is truncated")
+	}
+	nonce, body := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, body, additional)
+}
+
+// newGCM creates an AES-GCM cipher for a key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, errBlock := aes.NewCipher(key)
+	if errBlock != nil {
+		return nil, errBlock
+	}
+	return cipher.NewGCM(block)
+}
+
+// rewrap re-encrypts the data key of a sealed snapshot under the current master
+// key, leaving the encrypted payload as it is, so that the master key can be
+// retired without decrypting any state. It returns false if the snapshot isn't
+// encrypted, or its data key is already encrypted under the current key.
+func rewrap(provider KeyProvider, snap interface{}) (map[string]interface{}, bool, error) {
+	keyID, encrypted := field(snap, EncryptionKey)
+	if !encrypted {
+		return nil, false, nil
+	}
+
+	wrapped, errWrapped := binaryField(snap, DataKey)
+	if errWrapped != nil {
+		return nil, false, corruptSnapshot{errWrapped}
+	}
+	payload, errPayload := binaryField(snap, PayloadKey)
+	if errPayload != nil {
+		return nil, false, corruptSnapshot{errPayload}
+	}
+
+	dataKey, errUnwrap := unwrapKey(provider, fmt.Sprint(keyID), wrapped)
+	if errUnwrap != nil {
+		return nil, false, errUnwrap
+	}
+	id, rewrapped, errWrap := wrapKey(provider, dataKey)
+	if errWrap != nil {
+		return nil, false, errWrap
+	}
+	if id == fmt.Sprint(keyID) {
+		return nil, false, nil
+	}
+
+	sealed := map[string]interface{}{
+		EncryptionKey: id,
+		DataKey:       rewrapped,
+		PayloadKey:    payload,
+	}
+	if compression, compressed := field(snap, CompressionKey); compressed {
+		sealed[CompressionKey] = compression
+	}
+	return sealed, true, nil
+}
@@ -0,0 +1,144 @@
+package snapbase
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// testKeys creates a key provider with two keys
+func testKeys(t *testing.T) *StaticKeyProvider {
+	keys, errKeys := StaticKeys("2018-01", map[string][]byte{
+		"2018-01": bytes.Repeat([]byte{1}, 32),
+		"2018-02": bytes.Repeat([]byte{2}, 32),
+	})
+	assert.Nil(t, errKeys)
+	return keys
+}
+
+// TestStaticKeys checks keys can be added and rotated
+func TestStaticKeys(t *testing.T) {
+	_, errMissing := StaticKeys("absent", nil)
+	assert.NotNil(t, errMissing)
+
+	keys := testKeys(t)
+	assert.NotNil(t, keys.Rotate("2018-03"), "Unknown keys can't be made current")
+	keys.Add("2018-03", bytes.Repeat([]byte{3}, 32))
+	assert.Nil(t, keys.Rotate("2018-03"))
+
+	id, key, errCurrent := keys.CurrentKey()
+	assert.Nil(t, errCurrent)
+	assert.Equal(t, "2018-03", id)
+	assert.Equal(t, bytes.Repeat([]byte{3}, 32), key)
+}
+
+// TestEncryptedSnapshots checks snapshots are written encrypted, restored after
+// the keys are rotated, and can't be restored over another aggregate
+func TestEncryptedSnapshots(t *testing.T) {
+	keys := testKeys(t)
+	var written map[string]interface{}
+	params := fixedSnapshot(nil, 0)
+	params.Lazy = true
+	params.Keys = keys
+	params.Compressor = Gzip()
+	params.Put = func(key string, seq int64, snap interface{}) error {
+		written = snap.(map[string]interface{})
+		return nil
+	}
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(params))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("encrypted", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 7})
+	assert.Nil(t, agg.Commit())
+	assert.Equal(t, "2018-01", written[EncryptionKey])
+	assert.Equal(t, "gzip", written[CompressionKey])
+	assert.NotContains(t, string(written[PayloadKey].([]byte)), "current_count")
+
+	// Older snapshots are still read after rotation
+	assert.Nil(t, keys.Rotate("2018-02"))
+	restore := func(key string, params Parameters) (*test.SimpleAggregate, error) {
+		params.Lazy = true
+		restoring := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+		restoring.Use(Create(params))
+		restored := &test.SimpleAggregate{}
+		restored.Initialize(key, test.GetTestRegistry(), restoring)
+		return restored, restored.Refresh()
+	}
+
+	reader := fixedSnapshot(written, 1)
+	reader.Keys = keys
+	restored, errRestore := restore("encrypted", reader)
+	assert.Nil(t, errRestore)
+	assert.Equal(t, 7, restored.CurrentCount)
+
+	_, errSwapped := restore("another", reader)
+	assert.NotNil(t, errSwapped, "Snapshots should be bound to their aggregate")
+
+	_, errNoKeys := restore("encrypted", fixedSnapshot(written, 1))
+	assert.NotNil(t, errNoKeys)
+}
+
+// TestRekeySnapshot checks snapshots are rekeyed under the current key without
+// changing their state, and can then be restored without the old key
+func TestRekeySnapshot(t *testing.T) {
+	keys := testKeys(t)
+	storage := &mapStorage{}
+	params := storage.parameters()
+	params.SnapInterval = 1
+	params.Keys = keys
+	params.Compressor = Gzip()
+	params.Admin = NewAdmin()
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(params))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("rekeyed", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 7})
+	assert.Nil(t, agg.Commit())
+	payload := storage.snaps["rekeyed"].(map[string]interface{})[PayloadKey]
+
+	rekeyed, errCurrent := params.Admin.RekeySnapshot("rekeyed")
+	assert.Nil(t, errCurrent)
+	assert.False(t, rekeyed, "Snapshots under the current key should be left alone")
+
+	missing, errMissing := params.Admin.RekeySnapshot("missing")
+	assert.Nil(t, errMissing)
+	assert.False(t, missing)
+
+	assert.Nil(t, keys.Rotate("2018-02"))
+	rekeyed, errRekey := params.Admin.RekeySnapshot("rekeyed")
+	assert.Nil(t, errRekey)
+	assert.True(t, rekeyed)
+	assert.Equal(t, int64(1), storage.seqs["rekeyed"])
+	written := storage.snaps["rekeyed"].(map[string]interface{})
+	assert.Equal(t, "2018-02", written[EncryptionKey])
+	assert.Equal(t, "gzip", written[CompressionKey])
+	assert.Equal(t, payload, written[PayloadKey], "The state should not be re-encrypted")
+
+	// The old key is no longer needed
+	retired, errRetired := StaticKeys("2018-02", map[string][]byte{
+		"2018-02": bytes.Repeat([]byte{2}, 32),
+	})
+	assert.Nil(t, errRetired)
+	reader := fixedSnapshot(written, 1)
+	reader.Lazy = true
+	reader.Keys = retired
+	restoring := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	restoring.Use(Create(reader))
+	restored := test.SimpleAggregate{}
+	restored.Initialize("rekeyed", test.GetTestRegistry(), restoring)
+	assert.Nil(t, restored.Refresh())
+	assert.Equal(t, 7, restored.CurrentCount)
+
+	unkeyed := storage.parameters()
+	unkeyed.Admin = NewAdmin()
+	Create(unkeyed)
+	_, errUnkeyed := unkeyed.Admin.RekeySnapshot("rekeyed")
+	assert.NotNil(t, errUnkeyed)
+}
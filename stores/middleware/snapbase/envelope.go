@@ -0,0 +1,156 @@
+package snapbase
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// The fields of a sealed snapshot, which is stored in place of the state when it
+// is compressed or encrypted. The payload holds the JSON of the state, compressed
+// and then encrypted.
+const (
+	CompressionKey = "_compression"    // Name of the compressor
+	EncryptionKey  = "_encryption_key" // ID of the master key the data key is encrypted under
+	DataKey        = "_data_key"       // Encrypted data key
+	PayloadKey     = "_payload"        // Compressed and/or encrypted state
+)
+
+// seal replaces a snapshot with its compressed and/or encrypted form
+func (mw *middleware) seal(aggregateKey string, snap map[string]interface{}) (map[string]interface{}, error) {
+	if mw.params.Compressor == nil && mw.params.Keys == nil {
+		return snap, nil
+	}
+
+	payload, errEncode := json.Marshal(snap)
+	if errEncode != nil {
+		return nil, errEncode
+	}
+
+	sealed := make(map[string]interface{})
+	if mw.params.Compressor != nil {
+		compressed, errCompress := mw.params.Compressor.Compress(payload)
+		if errCompress != nil {
+			return nil, errCompress
+		}
+		sealed[CompressionKey] = mw.params.Compressor.Name()
+		payload = compressed
+	}
+
+	if mw.params.Keys != nil {
+		id, wrapped, encrypted, errEncrypt := encrypt(mw.params.Keys, aggregateKey, payload)
+		if errEncrypt != nil {
+			return nil, errEncrypt
+		}
+		sealed[EncryptionKey] = id
+		sealed[DataKey] = wrapped
+		payload = encrypted
+	}
+
+	sealed[PayloadKey] = payload
+	return sealed, nil
+}
+
+// corruptSnapshot is an error opening a sealed snapshot whose contents are damaged,
+// rather than one that can't be opened with the configured keys or compressors
+type corruptSnapshot struct {
+	err error
+}
+
+// Error describes the damage
+func (corrupt corruptSnapshot) Error() string {
+	return fmt.Sprintf("Snap error: Snapshot is corrupt: %v", corrupt.err)
+}
+
+// open restores a snapshot from its sealed form. Snapshots that aren't sealed are
+// returned as they are, so that compression or encryption can be turned on or
+// changed without discarding existing snapshots.
+func (mw *middleware) open(aggregateKey string, snap interface{}) (interface{}, error) {
+	compression, compressed := field(snap, CompressionKey)
+	keyID, encrypted := field(snap, EncryptionKey)
+	if !compressed && !encrypted {
+		return snap, nil
+	}
+
+	payload, errPayload := binaryField(snap, PayloadKey)
+	if errPayload != nil {
+		return nil, corruptSnapshot{errPayload}
+	}
+
+	if encrypted {
+		if mw.params.Keys == nil {
+			return nil, fmt.Errorf("Snap error: Snapshot of %v is encrypted, but no keys are configured", aggregateKey)
+		}
+		wrapped, errWrapped := binaryField(snap, DataKey)
+		if errWrapped != nil {
+			return nil, corruptSnapshot{errWrapped}
+		}
+		decrypted, errDecrypt := decrypt(mw.params.Keys, aggregateKey, fmt.Sprint(keyID), wrapped, payload)
+		if errDecrypt != nil {
+			return nil, errDecrypt
+		}
+		payload = decrypted
+	}
+
+	if compressed {
+		compressor := mw.compressor(fmt.Sprint(compression))
+		if compressor == nil {
+			return nil, fmt.Errorf("Snap error: Unknown compression %v", compression)
+		}
+		decompressed, errDecompress := compressor.Decompress(payload)
+		if errDecompress != nil {
+			return nil, corruptSnapshot{errDecompress}
+		}
+		payload = decompressed
+	}
+
+	state := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	errState := decoder.Decode(&state)
+	if errState != nil {
+		return nil, corruptSnapshot{errState}
+	}
+	return state, nil
+}
+
+// compressor finds a compressor by name, from the configured and built-in ones
+func (mw *middleware) compressor(name string) Compressor {
+	for _, candidate := range []Compressor{mw.params.Compressor, Gzip(), Zstd()} {
+		if candidate != nil && candidate.Name() == name {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// binaryField reads a binary field from a sealed snapshot. Storage that keeps
+// snapshots as JSON holds binary fields as base64.
+func binaryField(snap interface{}, name string) ([]byte, error) {
+	value, _ := field(snap, name)
+	switch typed := value.(type) {
+	case []byte:
+		return typed, nil
+	case string:
+		return base64.StdEncoding.DecodeString(typed)
+	default:
+		return nil, fmt.Errorf("Snap error: Unexpected %v in sealed snapshot: %T", name, value)
+	}
+}
+
+// field reads a field from a stored snapshot, which may have been revived as any
+// kind of map by the snapshot storage.
+func field(snap interface{}, name string) (interface{}, bool) {
+	value := reflect.ValueOf(snap)
+	if value.Kind() != reflect.Map || value.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+
+	stored := value.MapIndex(reflect.ValueOf(name).Convert(value.Type().Key()))
+	if !stored.IsValid() {
+		return nil, false
+	}
+	return stored.Interface(), true
+}
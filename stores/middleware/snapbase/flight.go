@@ -0,0 +1,107 @@
+package snapbase
+
+import (
+	"sync"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// flight is a refresh in progress, whose result is shared with the refreshes of
+// the same aggregate that arrive while it runs
+type flight struct {
+	done  chan struct{}          // Closed once the refresh finishes
+	state map[string]interface{} // State that was loaded, nil if the refresh failed
+	seq   int64                  // Sequence of the state
+}
+
+// flights deduplicates concurrent refreshes of the same aggregate (see
+// Parameters.Singleflight): the first refresh of a key loads it, while refreshes
+// that arrive meanwhile wait and restore what it loaded, rather than each reading
+// the snapshot and replaying the events.
+type flights struct {
+	lock  sync.Mutex
+	calls map[string]*flight
+}
+
+// newFlights creates an empty set of refreshes in progress
+func newFlights() *flights {
+	return &flights{
+		calls: make(map[string]*flight),
+	}
+}
+
+// join gets the refresh in progress for a key, or starts one if there is none,
+// returning true when the caller should load the aggregate
+func (group *flights) join(key string) (*flight, bool) {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+
+	if current, found := group.calls[key]; found {
+		return current, false
+	}
+	current := &flight{done: make(chan struct{})}
+	group.calls[key] = current
+	return current, true
+}
+
+// land finishes the refresh in progress for a key, releasing its followers
+func (group *flights) land(key string, current *flight) {
+	group.lock.Lock()
+	delete(group.calls, key)
+	group.lock.Unlock()
+	close(current.done)
+}
+
+// shared refreshes an aggregate, sharing the work with concurrent refreshes of
+// the same key
+func (mw *middleware) shared(adapter eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+	key := adapter.GetKey()
+	current, leader := mw.flights.join(key)
+	if !leader {
+		<-current.done
+		return mw.follow(current, adapter, next)
+	}
+	defer mw.flights.land(key, current)
+
+	errLoad := mw.load(adapter, next)
+	if errLoad != nil {
+		return errLoad
+	}
+
+	// Followers restore a copy of the loaded state, or load it themselves if it
+	// can't be shared
+	reader, ok := adapter.(eventsourcing.StateAdapter)
+	if ok && adapter.SequenceNumber() > 0 {
+		state, errCapture := mw.capture(reader.GetState(), "")
+		if errCapture == nil {
+			current.state, current.seq = state, adapter.SequenceNumber()
+		}
+	}
+	return nil
+}
+
+// follow restores an aggregate from the state loaded by another refresh, and
+// replays any events committed since (unless lazy). Refreshes that failed, or
+// whose state can't be restored, are repeated.
+func (mw *middleware) follow(current *flight, adapter eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+	if current.state == nil {
+		return mw.load(adapter, next)
+	}
+
+	// Every follower restores a copy of its own, so they share no mutable state
+	state, errClone := mw.params.Cloner(current.state)
+	if errClone != nil {
+		return mw.load(adapter, next)
+	}
+	errRestore := adapter.RestoreSnapshot(current.seq, state)
+	if errRestore != nil {
+		return mw.load(adapter, next)
+	}
+
+	mw.params.Metrics.hit()
+	if mw.params.Lazy {
+		mw.params.Metrics.replay(0)
+		return nil
+	}
+	return mw.replay(adapter, next)
+}
@@ -0,0 +1,72 @@
+package snapbase
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSingleflight checks concurrent refreshes of an aggregate share one load
+func TestSingleflight(t *testing.T) {
+	base := memory.NewStore()
+	direct := test.SimpleAggregate{}
+	direct.Initialize("popular", test.GetTestRegistry(), base)
+	for x := 0; x < 3; x++ {
+		direct.ApplyEvent(test.IncrementEvent{IncrementBy: 2})
+		assert.Nil(t, direct.Commit())
+	}
+
+	var gets int64
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	params := fixedSnapshot(nil, 0)
+	params.Singleflight = true
+	params.Get = func(string) (interface{}, int64, error) {
+		if atomic.AddInt64(&gets, 1) == 1 {
+			entered <- struct{}{}
+			<-release
+		}
+		return nil, 0, nil
+	}
+	store := eventsourcing.NewMiddlewareWrapper(base)
+	store.Use(Create(params))
+
+	const refreshes = 10
+	loaded := make([]*test.SimpleAggregate, refreshes)
+	var wait sync.WaitGroup
+	refresh := func(index int) {
+		defer wait.Done()
+		loaded[index] = &test.SimpleAggregate{}
+		loaded[index].Initialize("popular", test.GetTestRegistry(), store)
+		assert.Nil(t, loaded[index].Refresh())
+	}
+
+	// Hold the first refresh in the snapshot storage, until the rest have joined it
+	wait.Add(refreshes)
+	go refresh(0)
+	<-entered
+	for index := 1; index < refreshes; index++ {
+		go refresh(index)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wait.Wait()
+
+	assert.Equal(t, int64(1), atomic.LoadInt64(&gets), "Only one refresh should read the snapshot")
+	for _, agg := range loaded {
+		assert.Equal(t, 6, agg.CurrentCount)
+		assert.Equal(t, int64(3), agg.SequenceNumber())
+	}
+
+	// Refreshes that don't overlap each do their own work
+	later := test.SimpleAggregate{}
+	later.Initialize("popular", test.GetTestRegistry(), store)
+	assert.Nil(t, later.Refresh())
+	assert.Equal(t, int64(2), atomic.LoadInt64(&gets))
+}
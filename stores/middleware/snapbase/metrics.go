@@ -0,0 +1,108 @@
+package snapbase
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// DefaultReplayBuckets are the upper bounds of the buckets that the events
+// replayed by each refresh are counted in, unless others are given to NewMetrics.
+var DefaultReplayBuckets = []int64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000, 5000}
+
+// Metrics counts how refreshes of the middleware created with it (see
+// Parameters.Metrics) use their snapshots, so that the snap interval can be tuned
+// from data: an interval that is too long shows up as refreshes replaying many
+// events, one that is too short as snapshots written for few replayed events.
+// Metrics can be shared by several middlewares, and are safe for concurrent use.
+type Metrics struct {
+	hits     int64 // Refreshes restored from a snapshot, first for atomic alignment
+	misses   int64 // Refreshes without a snapshot
+	stale    int64 // Snapshots that were found, but couldn't be used
+	sum      int64 // Events replayed by every refresh
+	bounds   []int64
+	replayed []int64 // Refreshes in each bucket, the last counting those past every bound
+}
+
+// Stats describes how refreshes have used their snapshots.
+type Stats struct {
+	Hits     int64     // Refreshes restored from a snapshot
+	Misses   int64     // Refreshes without a snapshot, replaying the full history
+	Stale    int64     // Snapshots that were discarded (too large, another schema version, or unrestorable)
+	Replayed Histogram // Events replayed by each refresh, after any snapshot was restored
+}
+
+// Histogram counts observations in buckets, like a Prometheus histogram.
+type Histogram struct {
+	Bounds []int64 // Upper bounds of the buckets, inclusive
+	Counts []int64 // Observations in each bucket, not cumulative, with one more bucket for those past the last bound
+	Count  int64   // Observations
+	Sum    int64   // Sum of the observations
+}
+
+// NewMetrics creates metrics, counting replayed events in buckets with the given
+// upper bounds, or DefaultReplayBuckets when none are given.
+func NewMetrics(buckets ...int64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultReplayBuckets
+	}
+	bounds := append([]int64(nil), buckets...)
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	return &Metrics{
+		bounds:   bounds,
+		replayed: make([]int64, len(bounds)+1),
+	}
+}
+
+// Stats gets the counts so far, i.e. for metrics.
+func (metrics *Metrics) Stats() Stats {
+	stats := Stats{
+		Hits:   atomic.LoadInt64(&metrics.hits),
+		Misses: atomic.LoadInt64(&metrics.misses),
+		Stale:  atomic.LoadInt64(&metrics.stale),
+		Replayed: Histogram{
+			Bounds: append([]int64(nil), metrics.bounds...),
+			Counts: make([]int64, len(metrics.replayed)),
+			Sum:    atomic.LoadInt64(&metrics.sum),
+		},
+	}
+	for index := range metrics.replayed {
+		stats.Replayed.Counts[index] = atomic.LoadInt64(&metrics.replayed[index])
+		stats.Replayed.Count += stats.Replayed.Counts[index]
+	}
+	return stats
+}
+
+// hit records a refresh restored from a snapshot
+func (metrics *Metrics) hit() {
+	if metrics != nil {
+		atomic.AddInt64(&metrics.hits, 1)
+	}
+}
+
+// miss records a refresh without a snapshot
+func (metrics *Metrics) miss() {
+	if metrics != nil {
+		atomic.AddInt64(&metrics.misses, 1)
+	}
+}
+
+// discarded records a snapshot that couldn't be used
+func (metrics *Metrics) discarded() {
+	if metrics != nil {
+		atomic.AddInt64(&metrics.stale, 1)
+	}
+}
+
+// replay records the events replayed by a refresh
+func (metrics *Metrics) replay(events int64) {
+	if metrics == nil {
+		return
+	}
+
+	bucket := sort.Search(len(metrics.bounds), func(index int) bool {
+		return events <= metrics.bounds[index]
+	})
+	atomic.AddInt64(&metrics.replayed[bucket], 1)
+	atomic.AddInt64(&metrics.sum, events)
+}
@@ -0,0 +1,67 @@
+package snapbase
+
+import (
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMetricsBuckets checks replayed events are counted in sorted buckets
+func TestMetricsBuckets(t *testing.T) {
+	metrics := NewMetrics(10, 1)
+	for _, events := range []int64{0, 1, 5, 10, 50} {
+		metrics.replay(events)
+	}
+
+	replayed := metrics.Stats().Replayed
+	assert.Equal(t, []int64{1, 10}, replayed.Bounds)
+	assert.Equal(t, []int64{2, 2, 1}, replayed.Counts)
+	assert.Equal(t, int64(5), replayed.Count)
+	assert.Equal(t, int64(66), replayed.Sum)
+	assert.Equal(t, len(DefaultReplayBuckets), len(NewMetrics().Stats().Replayed.Bounds))
+
+	// Middleware without metrics records nothing
+	var disabled *Metrics
+	disabled.hit()
+	disabled.replay(1)
+}
+
+// TestMetrics checks refreshes are counted as hits, misses or stale snapshots
+func TestMetrics(t *testing.T) {
+	storage := &mapStorage{}
+	params := storage.parameters()
+	params.SnapInterval = 5
+	params.MaxSnapshotBytes = 100
+	params.OnTooLarge = ReplayWhenTooLarge
+	params.Metrics = NewMetrics()
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(params))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("counted", test.GetTestRegistry(), store)
+	for x := 0; x < 7; x++ {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+		assert.Nil(t, agg.Commit())
+	}
+	assert.Equal(t, int64(0), params.Metrics.Stats().Replayed.Count, "Commits should not be counted")
+
+	refresh := func(key string) {
+		loaded := test.SimpleAggregate{}
+		loaded.Initialize(key, test.GetTestRegistry(), store)
+		assert.Nil(t, loaded.Refresh())
+	}
+	refresh("counted")
+	refresh("missing")
+	storage.snaps["counted"] = oversized
+	refresh("counted")
+
+	stats := params.Metrics.Stats()
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Equal(t, int64(1), stats.Stale)
+	assert.Equal(t, int64(3), stats.Replayed.Count)
+	assert.Equal(t, int64(2+0+7), stats.Replayed.Sum, "The snapshot should save replaying 5 events")
+}
@@ -1,9 +1,8 @@
 package snapbase
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
+	"sync"
 
 	"github.com/go-gadgets/eventsourcing"
 )
@@ -12,12 +11,26 @@ import (
 // are required for a snap-provider to work correctly, as well as any additional
 // parameters.
 type Parameters struct {
-	Lazy         bool          // Lazy provider
-	SnapInterval int64         // Frequency between snaps
-	Close        CloseCallback // Close callback
-	Get          GetCallback   // Get entry from snapshot storage
-	Purge        PurgeCallback // Purge an entr
-	Put          PutCallback   // Put entry into the snapshot storage
+	Lazy             bool                 // Lazy provider
+	SnapInterval     int64                // Frequency between snaps, when there is no strategy
+	Strategy         SnapshotStrategy     // Decides when to snap, Interval(SnapInterval) by default
+	MaxSnapshotBytes int64                // Largest snapshot to write or restore, zero for no limit
+	OnTooLarge       TooLargeCallback     // Decides what to do with an oversized snapshot on refresh
+	Compressor       Compressor           // Compresses snapshots before they are written, nil for none
+	Keys             KeyProvider          // Encrypts snapshots before they are written, nil for none
+	Async            bool                 // Write snapshots in the background, rather than during the commit
+	OnError          ErrorCallback        // Called when a background snapshot write fails, logged when nil
+	Logger           eventsourcing.Logger // Logger for snapshots that are replaced or fail, eventsourcing.DefaultLogger() by default
+	SnapOnReadAfter  int64                // Snap after a refresh that replays more events than this, zero to snap only on commit
+	Singleflight     bool                 // Share the work of concurrent refreshes of the same aggregate
+	Admin            *Admin               // Administers the snapshots of the provider, i.e. for operators, optional
+	Cloner           Cloner               // Copies states into snapshots, CloneJSON by default
+	Metrics          *Metrics             // Counts how refreshes use snapshots, i.e. for tuning the interval, optional
+	Close            CloseCallback        // Close callback
+	Get              GetCallback          // Get entry from snapshot storage
+	Purge            PurgeCallback        // Purge an entr
+	Put              PutCallback          // Put entry into the snapshot storage
+	PutMany          PutManyCallback      // Put several entries at once (i.e. pipelined), optional
 }
 
 // CloseCallback is a callback that closes the inner provider
@@ -29,22 +42,97 @@ type GetCallback func(string) (interface{}, int64, error)
 // PurgeCallback purges an entry from the store.
 type PurgeCallback func(string) error
 
-// PutCallback is the callback that writes to the store
+// PutCallback is the callback that writes to the store. Writes must be conditional
+// on the sequence: a snapshot is never replaced by one of an earlier sequence, so
+// that a node that snaps an aggregate late can't overwrite the newer snapshot of
+// another. Such writes are skipped without an error. Snapshots of the same
+// sequence are replaced, so that they can be rebuilt.
 type PutCallback func(string, int64, interface{}) error
 
+// PutManyCallback writes several entries to the store at once, i.e. in a single
+// round trip, conditionally as PutCallback does. Snapshots written in the
+// background are put in batches when the storage has this callback.
+type PutManyCallback func([]Entry) error
+
+// Entry is a snapshot to put into the store
+type Entry struct {
+	Key      string      // Aggregate key
+	Sequence int64       // Sequence of the snapshot
+	State    interface{} // Snapshot state, as it should be stored
+}
+
+// ErrorCallback is called when a snapshot written in the background, or after a
+// refresh, fails.
+type ErrorCallback func(key string, err error)
+
+// TooLargeCallback is called when a stored snapshot is over the size limit. Returning
+// nil discards the snapshot and replays the aggregate from its events, while returning
+// an error fails the refresh. When no callback is set, the refresh fails with an
+// eventsourcing.SnapshotTooLargeFault.
+type TooLargeCallback func(fault eventsourcing.SnapshotTooLargeFault) error
+
+// ReplayWhenTooLarge is a TooLargeCallback that logs the oversized snapshot to the
+// default logger (see eventsourcing.DefaultLogger), and falls back to replaying the
+// aggregate's events from the store.
+func ReplayWhenTooLarge(fault eventsourcing.SnapshotTooLargeFault) error {
+	eventsourcing.DefaultLogger().Warn("Snapshot too large, replaying events", eventsourcing.LogFields{
+		"key":      fault.AggregateKey,
+		"sequence": fault.Sequence,
+		"limit":    fault.Limit,
+	})
+	return nil
+}
+
+// VersionKey is the field of a snapshot that holds the schema version of the state
+// it was taken from. Snapshots of another version are discarded on refresh, and the
+// aggregate is replayed from its events, rather than being restored with renamed or
+// retyped fields silently dropped. Snapshots taken before versioning (without the
+// field) are still restored.
+const VersionKey = "_snapshot_version"
+
 // middleware is a structure that brings together a few elements and lets
 // us use function references for the commit, refresh operations etc.
 type middleware struct {
-	params Parameters
+	params   Parameters
+	worker   *worker         // Background writer of snapshots, when asynchronous
+	flights  *flights        // Refreshes in progress, when they are shared
+	lock     sync.Mutex      // Guards rebuilds
+	rebuilds map[string]bool // Aggregates to snap on their next refresh
 }
 
 // Create a snapbase middleware with the specified parameters
 func Create(parameters Parameters) (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
+	if parameters.Strategy == nil {
+		parameters.Strategy = Interval(parameters.SnapInterval)
+	}
+	if parameters.Cloner == nil {
+		parameters.Cloner = CloneJSON
+	}
+	if parameters.Logger == nil {
+		parameters.Logger = eventsourcing.DefaultLogger()
+	}
+
 	mw := &middleware{
-		params: parameters,
+		params:   parameters,
+		rebuilds: make(map[string]bool),
+	}
+	if parameters.Async {
+		mw.worker = startWorker(mw.writeBatch)
+	}
+	if parameters.Singleflight {
+		mw.flights = newFlights()
+	}
+	if parameters.Admin != nil {
+		parameters.Admin.attach(mw)
 	}
 
 	return mw.commit, mw.refresh, func() error {
+		if parameters.Admin != nil {
+			parameters.Admin.detach(mw)
+		}
+		if mw.worker != nil {
+			mw.worker.stop()
+		}
 		return parameters.Close()
 	}
 }
@@ -52,6 +140,12 @@ func Create(parameters Parameters) (eventsourcing.CommitMiddleware, eventsourcin
 // CommitEvents stores any events for the specified aggregate that are uncommitted
 // at this point in time.
 func (mw *middleware) commit(writer eventsourcing.StoreWriterAdapter, next eventsourcing.NextHandler) error {
+	// Nothing changed, so there's nothing to snap, unless a rebuild asks for one
+	rebuild := eventsourcing.IsRebuildingSnapshot(writer)
+	if eventsourcing.IsNoOp(writer) && !rebuild {
+		return next()
+	}
+
 	// Store the inner provider first.
 	errInner := next()
 
@@ -60,6 +154,7 @@ func (mw *middleware) commit(writer eventsourcing.StoreWriterAdapter, next event
 		fault, _ := eventsourcing.IsConcurrencyFault(errInner)
 		if fault && mw.params.Lazy {
 			key := writer.GetKey()
+			mw.discard(key)
 			errPurge := mw.params.Purge(key)
 			if errPurge != nil {
 				return errPurge
@@ -72,29 +167,87 @@ func (mw *middleware) commit(writer eventsourcing.StoreWriterAdapter, next event
 	// Snap time?
 	currentSequenceNumber, events := writer.GetUncommittedEvents()
 	eventCount := int64(len(events))
-	nextSnap := currentSequenceNumber - (currentSequenceNumber % mw.params.SnapInterval) + mw.params.SnapInterval
-	writeSnap := mw.params.Lazy || currentSequenceNumber+eventCount >= nextSnap
+	key := writer.GetKey()
+	writeSnap := rebuild || mw.params.Lazy || mw.params.Strategy.ShouldSnap(CommitInfo{
+		Key:      key,
+		Sequence: currentSequenceNumber,
+		Events:   eventCount,
+		State:    writer.GetState(),
+	})
 	if !writeSnap {
 		return nil
 	}
 
 	// Finally, write the snap if needed
-	key := writer.GetKey()
+	recordSnapped(mw.params.Strategy, key)
+	cloned, errCapture := mw.capture(writer.GetState(), eventsourcing.SnapshotVersionOf(writer))
+	if errCapture != nil {
+		return errCapture
+	}
 
-	snapped, errMarshal := json.Marshal(writer.GetState())
-	if errMarshal != nil {
-		return errMarshal
+	// Rebuilds are written straight away, so that they're done when they return
+	if mw.params.Async && !rebuild {
+		mw.enqueue(key, currentSequenceNumber+eventCount, cloned)
+		return nil
+	}
+
+	return mw.write(key, currentSequenceNumber+eventCount, cloned)
+}
+
+// capture copies the state of an aggregate into a snapshot, recording the schema
+// version of the state
+func (mw *middleware) capture(state interface{}, version string) (map[string]interface{}, error) {
+	var cloned map[string]interface{}
+	var errClone error
+	if cloner, ok := state.(SnapshotCloner); ok {
+		cloned, errClone = cloner.CloneSnapshot()
+	} else {
+		cloned, errClone = mw.params.Cloner(state)
 	}
-	cloned := make(map[string]interface{})
-	decoder := json.NewDecoder(bytes.NewReader(snapped))
-	decoder.UseNumber()
-	errClone := decoder.Decode(&cloned)
 	if errClone != nil {
-		return errClone
+		return nil, errClone
+	}
+
+	if version != "" {
+		cloned[VersionKey] = version
+	}
+	return cloned, nil
+}
+
+// write seals a snapshot and puts it into the snapshot storage
+func (mw *middleware) write(key string, seq int64, snap map[string]interface{}) error {
+	stored, tooLarge, errPrepare := mw.prepare(key, snap)
+	if errPrepare != nil {
+		return errPrepare
+	}
+
+	// Oversized snapshots are discarded, so the aggregate is replayed instead
+	if tooLarge {
+		return mw.params.Purge(key)
+	}
+
+	return mw.params.Put(key, seq, stored)
+}
+
+// prepare seals a snapshot to be stored, and checks if it is too large
+func (mw *middleware) prepare(key string, snap map[string]interface{}) (map[string]interface{}, bool, error) {
+	stored, errSeal := mw.seal(key, snap)
+	if errSeal != nil {
+		return nil, false, errSeal
+	}
+
+	_, tooLarge := mw.measure(stored)
+	return stored, tooLarge, nil
+}
+
+// measure estimates the size of a snapshot, and checks if it exceeds the limit
+func (mw *middleware) measure(snap interface{}) (int64, bool) {
+	if mw.params.MaxSnapshotBytes <= 0 {
+		return 0, false
 	}
 
-	errSnap := mw.params.Put(key, currentSequenceNumber+eventCount, cloned)
-	return errSnap
+	size := measure(snap, mw.params.MaxSnapshotBytes)
+	return size, size > mw.params.MaxSnapshotBytes
 }
 
 // refresh the state of an aggregate from the store.
@@ -106,24 +259,228 @@ func (mw *middleware) refresh(adapter eventsourcing.StoreLoaderAdapter, next eve
 		return fmt.Errorf("Snap errror: Aggregate %v is modified", key)
 	}
 
+	// Rebuilds replay the full history, so the stored snapshot is ignored
+	if eventsourcing.IsRebuildingSnapshot(adapter) {
+		return next()
+	}
+	if mw.rebuildRequested(key) {
+		return mw.rebuild(adapter, next)
+	}
+
+	if mw.flights != nil {
+		return mw.shared(adapter, next)
+	}
+	return mw.load(adapter, next)
+}
+
+// load restores an aggregate from its snapshot, if there is one that can be used,
+// and replays the events after it (unless lazy).
+func (mw *middleware) load(adapter eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+	key := adapter.GetKey()
+
+	// Snapshots waiting to be written are newer than any in the storage
+	if pending, seq, found := mw.pending(key); found {
+		errSnap := adapter.RestoreSnapshot(seq, pending)
+		if errSnap != nil {
+			mw.params.Metrics.discarded()
+			return mw.replay(adapter, next)
+		}
+
+		mw.params.Metrics.hit()
+		if mw.params.Lazy {
+			mw.params.Metrics.replay(0)
+			return nil
+		}
+		return mw.replay(adapter, next)
+	}
+
 	snap, seq, errLoad := mw.params.Get(key)
 	if errLoad != nil {
 		return errLoad
 	}
 
+	// Check the snapshot size before decoding it over the aggregate
+	size, tooLarge := mw.measure(snap)
+	if snap == nil {
+		mw.params.Metrics.miss()
+	}
+	if snap != nil && tooLarge {
+		mw.params.Metrics.discarded()
+		fault := eventsourcing.SnapshotTooLargeFault{
+			AggregateKey: key,
+			Sequence:     seq,
+			Size:         size,
+			Limit:        mw.params.MaxSnapshotBytes,
+		}
+		if mw.params.OnTooLarge == nil {
+			return fault
+		}
+
+		errHandle := mw.params.OnTooLarge(fault)
+		if errHandle != nil {
+			return errHandle
+		}
+
+		// Replay all events, rather than restoring from the snapshot
+		return mw.replay(adapter, next)
+	}
+
+	if snap != nil {
+		opened, errOpen := mw.open(key, snap)
+		if _, corrupt := errOpen.(corruptSnapshot); corrupt {
+			return mw.repair(adapter, next, errOpen)
+		}
+		if errOpen != nil {
+			return errOpen
+		}
+		snap = opened
+	}
+
+	// Snapshots of another schema version can't be trusted, so replay instead
+	if snap != nil && !mw.matchesVersion(adapter, snap) {
+		mw.params.Metrics.discarded()
+		errPurge := mw.params.Purge(key)
+		if errPurge != nil {
+			return errPurge
+		}
+		return mw.replay(adapter, next)
+	}
+
 	if snap != nil {
 		errSnap := adapter.RestoreSnapshot(seq, snap)
 		if errSnap != nil {
-			return nil
+			// Snapshots that don't fit the state are replaced by replaying events
+			return mw.repair(adapter, next, errSnap)
 		}
 
 		// If we're lazy, then don't call the rest of the refresh
+		mw.params.Metrics.hit()
 		if mw.params.Lazy {
+			mw.params.Metrics.replay(0)
 			return nil
 		}
 	}
 
 	// Now we can run the inner adapters refresh, andload in any
 	// subsequent events that are not part of the snap.
-	return next()
+	return mw.replay(adapter, next)
+}
+
+// replay runs the rest of the refresh, and snaps the aggregate if more than the
+// configured number of events were replayed to bring it up to date, so that
+// aggregates that are read often but rarely written still benefit from snapshots.
+// Failing to snap doesn't fail the refresh.
+func (mw *middleware) replay(adapter eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+	from := adapter.SequenceNumber()
+	errNext := next()
+	if errNext != nil {
+		return errNext
+	}
+
+	mw.params.Metrics.replay(adapter.SequenceNumber() - from)
+	if mw.params.SnapOnReadAfter <= 0 {
+		return nil
+	}
+
+	if adapter.SequenceNumber()-from > mw.params.SnapOnReadAfter {
+		mw.snapRead(adapter)
+	}
+	return nil
+}
+
+// repair replaces a snapshot that can't be decoded or restored: the snapshot is
+// purged, the aggregate is replayed from its events, and a fresh snapshot is
+// written from the result. Failing to write it doesn't fail the refresh.
+func (mw *middleware) repair(adapter eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler, errCorrupt error) error {
+	key := adapter.GetKey()
+	mw.params.Logger.Warn("Snapshot could not be restored, replaying events to repair it", eventsourcing.LogFields{
+		"key":   key,
+		"error": errCorrupt,
+	})
+	mw.params.Metrics.discarded()
+
+	errPurge := mw.params.Purge(key)
+	if errPurge != nil {
+		return errPurge
+	}
+
+	from := adapter.SequenceNumber()
+	errNext := next()
+	if errNext != nil {
+		return errNext
+	}
+
+	mw.params.Metrics.replay(adapter.SequenceNumber() - from)
+	if adapter.SequenceNumber() > 0 {
+		mw.snapRead(adapter)
+	}
+	return nil
+}
+
+// snapRead snaps an aggregate that has just been loaded, reporting rather than
+// returning any failure. Returns true if the snapshot was written (or queued).
+func (mw *middleware) snapRead(adapter eventsourcing.StoreLoaderAdapter) bool {
+	reader, ok := adapter.(eventsourcing.StateAdapter)
+	if !ok {
+		return false
+	}
+
+	key := adapter.GetKey()
+	seq := adapter.SequenceNumber()
+	recordSnapped(mw.params.Strategy, key)
+	cloned, errCapture := mw.capture(reader.GetState(), eventsourcing.SnapshotVersionOf(adapter))
+	if errCapture != nil {
+		mw.reportError(key, errCapture)
+		return false
+	}
+
+	if mw.params.Async {
+		mw.enqueue(key, seq, cloned)
+		return true
+	}
+
+	if errWrite := mw.write(key, seq, cloned); errWrite != nil {
+		mw.reportError(key, errWrite)
+		return false
+	}
+	return true
+}
+
+// reportError reports a snapshot that couldn't be written
+func (mw *middleware) reportError(key string, err error) {
+	if mw.params.OnError != nil {
+		mw.params.OnError(key, err)
+		return
+	}
+	mw.params.Logger.Warn("Snapshot write failed", eventsourcing.LogFields{
+		"key":   key,
+		"error": err,
+	})
+}
+
+// matchesVersion checks if a snapshot was taken from the current schema version of
+// the aggregate state. Unversioned snapshots, or aggregates that can't report a
+// version, are assumed to match.
+func (mw *middleware) matchesVersion(adapter eventsourcing.StoreLoaderAdapter, snap interface{}) bool {
+	current := eventsourcing.SnapshotVersionOf(adapter)
+	stored, versioned := snapshotVersion(snap)
+	if current == "" || !versioned || stored == current {
+		return true
+	}
+
+	mw.params.Logger.Info("Snapshot schema version changed, replaying events", eventsourcing.LogFields{
+		"key":      adapter.GetKey(),
+		"snapshot": stored,
+		"state":    current,
+	})
+	return false
+}
+
+// snapshotVersion reads the schema version from a stored snapshot
+func snapshotVersion(snap interface{}) (string, bool) {
+	stored, versioned := field(snap, VersionKey)
+	if !versioned {
+		return "", false
+	}
+	return fmt.Sprint(stored), true
 }
@@ -0,0 +1,303 @@
+package snapbase
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// fixedSnapshot creates parameters whose storage always holds one snapshot
+func fixedSnapshot(snap map[string]interface{}, seq int64) Parameters {
+	return Parameters{
+		SnapInterval: 100,
+		Close:        func() error { return nil },
+		Get: func(string) (interface{}, int64, error) {
+			return snap, seq, nil
+		},
+		Purge: func(string) error { return nil },
+		Put:   func(string, int64, interface{}) error { return nil },
+	}
+}
+
+// oversized is a snapshot with a large, unbounded field
+var oversized = map[string]interface{}{
+	"current_count": 50,
+	"padding":       strings.Repeat("x", 1000),
+}
+
+// TestMeasure checks size estimates are comparable to JSON, and stop early
+func TestMeasure(t *testing.T) {
+	assert.Equal(t, int64(4), measure(nil, 100))
+	assert.Equal(t, int64(7), measure("hello", 100))
+	assert.Equal(t, int64(2+(7+8+2)), measure(map[string]interface{}{"count": 1}, 100))
+	assert.Equal(t, int64(2+(5+1)*2), measure([]interface{}{true, false}, 100))
+	assert.True(t, measure(oversized, 100) > 100)
+	assert.True(t, measure(map[string]interface{}{"items": make([]interface{}, 1000000)}, 100) < 200, "Measurement should stop at the limit")
+}
+
+// TestRefreshTooLarge checks oversized snapshots fail the refresh by default
+func TestRefreshTooLarge(t *testing.T) {
+	params := fixedSnapshot(oversized, 10)
+	params.MaxSnapshotBytes = 100
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(params))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("too-large", test.GetTestRegistry(), store)
+	errRefresh := agg.Refresh()
+
+	isTooLarge, fault := eventsourcing.IsSnapshotTooLargeFault(errRefresh)
+	assert.True(t, isTooLarge)
+	assert.Equal(t, "too-large", fault.AggregateKey)
+	assert.Equal(t, int64(10), fault.Sequence)
+	assert.Equal(t, int64(100), fault.Limit)
+	assert.Equal(t, 0, agg.CurrentCount, "The snapshot should not be restored")
+}
+
+// TestRefreshTooLargeReplays checks the callback can fall back to the events
+func TestRefreshTooLargeReplays(t *testing.T) {
+	base := memory.NewStore()
+	direct := test.SimpleAggregate{}
+	direct.Initialize("replayed", test.GetTestRegistry(), base)
+	direct.ApplyEvent(test.IncrementEvent{IncrementBy: 3})
+	assert.Nil(t, direct.Commit())
+
+	params := fixedSnapshot(oversized, 1)
+	params.MaxSnapshotBytes = 100
+	params.OnTooLarge = ReplayWhenTooLarge
+	store := eventsourcing.NewMiddlewareWrapper(base)
+	store.Use(Create(params))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("replayed", test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	assert.Equal(t, 3, agg.CurrentCount, "The events should be replayed")
+}
+
+// TestRefreshWithinLimit checks snapshots under the limit are restored
+func TestRefreshWithinLimit(t *testing.T) {
+	params := fixedSnapshot(map[string]interface{}{"current_count": 50}, 10)
+	params.MaxSnapshotBytes = 100
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(params))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("small", test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	assert.Equal(t, 50, agg.CurrentCount)
+	assert.Equal(t, int64(10), agg.SequenceNumber())
+}
+
+// TestCommitTooLarge checks oversized states are purged rather than written
+func TestCommitTooLarge(t *testing.T) {
+	puts := 0
+	purges := 0
+	params := fixedSnapshot(nil, 0)
+	params.Lazy = true
+	params.MaxSnapshotBytes = 10
+	params.Put = func(string, int64, interface{}) error {
+		puts++
+		return nil
+	}
+	params.Purge = func(string) error {
+		purges++
+		return nil
+	}
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(params))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("commit", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+
+	assert.Equal(t, 0, puts)
+	assert.Equal(t, 1, purges)
+}
+
+// TestRebuildSnapshot checks rebuilds ignore the stored snapshot, and write a fresh
+// one even though nothing was committed
+func TestRebuildSnapshot(t *testing.T) {
+	base := memory.NewStore()
+	direct := test.SimpleAggregate{}
+	direct.Initialize("rebuilt", test.GetTestRegistry(), base)
+	direct.ApplyEvent(test.IncrementEvent{IncrementBy: 3})
+	assert.Nil(t, direct.Commit())
+
+	var written interface{}
+	var writtenSeq int64
+	params := fixedSnapshot(map[string]interface{}{"current_count": 50}, 1)
+	params.Put = func(key string, seq int64, snap interface{}) error {
+		written = snap
+		writtenSeq = seq
+		return nil
+	}
+	store := eventsourcing.NewMiddlewareWrapper(base)
+	store.Use(Create(params))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("rebuilt", test.GetTestRegistry(), store)
+	assert.Nil(t, agg.RebuildSnapshot())
+	assert.Equal(t, 3, agg.CurrentCount, "The events should be replayed")
+	assert.Equal(t, int64(1), writtenSeq)
+	assert.Equal(t, json.Number("3"), written.(map[string]interface{})["current_count"])
+}
+
+// TestCommitVersion checks snapshots record the schema version of the state
+func TestCommitVersion(t *testing.T) {
+	var written interface{}
+	params := fixedSnapshot(nil, 0)
+	params.Lazy = true
+	params.Put = func(key string, seq int64, snap interface{}) error {
+		written = snap
+		return nil
+	}
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(params))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("versioned", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, agg.Commit())
+	assert.Equal(t, eventsourcing.StateVersion(&agg), written.(map[string]interface{})[VersionKey])
+}
+
+// TestRefreshVersion checks snapshots of another schema version are discarded, and
+// the aggregate replayed from its events
+func TestRefreshVersion(t *testing.T) {
+	base := memory.NewStore()
+	direct := test.SimpleAggregate{}
+	direct.Initialize("versioned", test.GetTestRegistry(), base)
+	direct.ApplyEvent(test.IncrementEvent{IncrementBy: 3})
+	assert.Nil(t, direct.Commit())
+	version := eventsourcing.StateVersion(&direct)
+
+	cases := []struct {
+		name     string
+		snap     map[string]interface{}
+		expected int
+		purged   bool
+	}{
+		{"matching", map[string]interface{}{"current_count": 50, VersionKey: version}, 50, false},
+		{"unversioned", map[string]interface{}{"current_count": 50}, 50, false},
+		{"mismatched", map[string]interface{}{"count": 50, VersionKey: "fields:0"}, 3, true},
+	}
+
+	for _, c := range cases {
+		purged := false
+		params := fixedSnapshot(c.snap, 1)
+		params.Purge = func(string) error {
+			purged = true
+			return nil
+		}
+		store := eventsourcing.NewMiddlewareWrapper(base)
+		store.Use(Create(params))
+
+		agg := test.SimpleAggregate{}
+		agg.Initialize("versioned", test.GetTestRegistry(), store)
+		assert.Nil(t, agg.Refresh(), c.name)
+		assert.Equal(t, c.expected, agg.CurrentCount, c.name)
+		assert.Equal(t, c.purged, purged, c.name)
+	}
+}
+
+// TestSnapOnRead checks refreshes that replay a long history write a snapshot
+func TestSnapOnRead(t *testing.T) {
+	base := memory.NewStore()
+	direct := test.SimpleAggregate{}
+	direct.Initialize("read-often", test.GetTestRegistry(), base)
+	for i := 0; i < 10; i++ {
+		direct.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	}
+	assert.Nil(t, direct.Commit())
+
+	cases := []struct {
+		name     string
+		snap     map[string]interface{}
+		seq      int64
+		after    int64
+		expected int64
+	}{
+		{"long replay", nil, 0, 5, 10},
+		{"short replay", nil, 0, 10, 0},
+		{"after snapshot", map[string]interface{}{"current_count": 8}, 8, 5, 0},
+		{"disabled", nil, 0, 0, 0},
+	}
+
+	for _, c := range cases {
+		written := int64(0)
+		params := fixedSnapshot(c.snap, c.seq)
+		params.SnapOnReadAfter = c.after
+		params.Put = func(key string, seq int64, snap interface{}) error {
+			written = seq
+			assert.Equal(t, json.Number("10"), snap.(map[string]interface{})["current_count"], c.name)
+			return nil
+		}
+		store := eventsourcing.NewMiddlewareWrapper(base)
+		store.Use(Create(params))
+
+		agg := test.SimpleAggregate{}
+		agg.Initialize("read-often", test.GetTestRegistry(), store)
+		assert.Nil(t, agg.Refresh(), c.name)
+		assert.Equal(t, 10, agg.CurrentCount, c.name)
+		assert.Equal(t, c.expected, written, c.name)
+	}
+}
+
+// repairedRefresh refreshes an aggregate of 3 over a snapshot that can't be
+// restored, returning the aggregate, whether the snapshot was purged, and the
+// state of any snapshot written in its place
+func repairedRefresh(t *testing.T, key string, snap map[string]interface{}) (test.SimpleAggregate, bool, map[string]interface{}) {
+	base := memory.NewStore()
+	direct := test.SimpleAggregate{}
+	direct.Initialize(key, test.GetTestRegistry(), base)
+	direct.ApplyEvent(test.IncrementEvent{IncrementBy: 3})
+	assert.Nil(t, direct.Commit())
+
+	purged := false
+	var rewritten map[string]interface{}
+	params := fixedSnapshot(snap, 1)
+	params.Purge = func(string) error {
+		purged = true
+		return nil
+	}
+	params.Put = func(key string, seq int64, snap interface{}) error {
+		assert.Equal(t, int64(1), seq)
+		rewritten = snap.(map[string]interface{})
+		return nil
+	}
+	store := eventsourcing.NewMiddlewareWrapper(base)
+	store.Use(Create(params))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize(key, test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	return agg, purged, rewritten
+}
+
+// TestRefreshUnrestorable checks snapshots that fail to restore are purged, the
+// events replayed instead, and a fresh snapshot written
+func TestRefreshUnrestorable(t *testing.T) {
+	agg, purged, rewritten := repairedRefresh(t, "unrestorable", map[string]interface{}{"current_count": "lots"})
+	assert.Equal(t, 3, agg.CurrentCount, "The events should be replayed")
+	assert.True(t, purged)
+	assert.Equal(t, "3", fmt.Sprint(rewritten["current_count"]), "The snapshot should be rewritten")
+}
+
+// TestRefreshCorrupt checks sealed snapshots whose payload is damaged are
+// repaired in the same way
+func TestRefreshCorrupt(t *testing.T) {
+	agg, purged, rewritten := repairedRefresh(t, "corrupt", map[string]interface{}{
+		CompressionKey: "gzip",
+		PayloadKey:     []byte("not gzip"),
+	})
+	assert.Equal(t, 3, agg.CurrentCount, "The events should be replayed")
+	assert.True(t, purged)
+	assert.Equal(t, "3", fmt.Sprint(rewritten["current_count"]), "The snapshot should be rewritten")
+}
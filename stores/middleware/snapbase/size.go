@@ -0,0 +1,78 @@
+package snapbase
+
+import (
+	"math"
+	"reflect"
+)
+
+// Size estimates the size of a snapshot in bytes, comparable to the size of its
+// JSON encoding.
+func Size(snapshot interface{}) int64 {
+	return measure(snapshot, math.MaxInt64)
+}
+
+// measure estimates the size of a snapshot in bytes, comparable to the size of
+// its JSON encoding. Measurement stops once the limit is exceeded, so that
+// pathological snapshots are not walked in full.
+func measure(snapshot interface{}, limit int64) int64 {
+	size := int64(0)
+	measureValue(reflect.ValueOf(snapshot), &size, limit)
+	return size
+}
+
+// measureValue adds the size of a value to the running total
+func measureValue(value reflect.Value, size *int64, limit int64) {
+	if *size > limit {
+		return
+	}
+
+	switch value.Kind() {
+	case reflect.Invalid:
+		*size += 4
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			*size += 4
+			return
+		}
+		measureValue(value.Elem(), size, limit)
+	case reflect.String:
+		*size += int64(value.Len()) + 2
+	case reflect.Bool:
+		*size += 5
+	case reflect.Map:
+		*size += 2
+		for _, key := range value.MapKeys() {
+			measureValue(key, size, limit)
+			measureValue(value.MapIndex(key), size, limit)
+			*size += 2
+			if *size > limit {
+				return
+			}
+		}
+	case reflect.Slice:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			// Binary data is measured as base64, as it would be in JSON
+			*size += int64((value.Len()+2)/3*4) + 2
+			return
+		}
+		fallthrough
+	case reflect.Array:
+		*size += 2
+		for i := 0; i < value.Len(); i++ {
+			measureValue(value.Index(i), size, limit)
+			*size++
+			if *size > limit {
+				return
+			}
+		}
+	case reflect.Struct:
+		*size += 2
+		for i := 0; i < value.NumField(); i++ {
+			measureValue(value.Field(i), size, limit)
+			*size++
+		}
+	default:
+		// Numbers and anything else we can't see inside
+		*size += 8
+	}
+}
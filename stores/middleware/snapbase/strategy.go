@@ -0,0 +1,151 @@
+package snapbase
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// CommitInfo describes a successful commit, for a strategy to decide whether the
+// aggregate should be snapped.
+type CommitInfo struct {
+	Key      string      // Aggregate key
+	Sequence int64       // Sequence of the aggregate before the commit
+	Events   int64       // Events in the commit
+	State    interface{} // State of the aggregate after the commit
+}
+
+// SnapshotStrategy decides when the snapshot of an aggregate should be written.
+// Lazy providers snap on every commit, regardless of their strategy.
+type SnapshotStrategy interface {
+	// ShouldSnap checks if a snapshot should be written after a commit.
+	ShouldSnap(commit CommitInfo) bool
+}
+
+// SnapshotRecorder is implemented by strategies that need to know when snapshots
+// are written, whichever strategy triggered them.
+type SnapshotRecorder interface {
+	// Snapped records that a snapshot was written for an aggregate.
+	Snapped(key string)
+}
+
+// StrategyFunc adapts a predicate into a strategy.
+type StrategyFunc func(commit CommitInfo) bool
+
+// ShouldSnap checks if a snapshot should be written after a commit.
+func (strategy StrategyFunc) ShouldSnap(commit CommitInfo) bool {
+	return strategy(commit)
+}
+
+// Interval snaps an aggregate each time its sequence crosses a multiple of the
+// interval, which is the default strategy.
+func Interval(events int64) SnapshotStrategy {
+	return StrategyFunc(func(commit CommitInfo) bool {
+		if events <= 0 {
+			return false
+		}
+		nextSnap := commit.Sequence - (commit.Sequence % events) + events
+		return commit.Sequence+commit.Events >= nextSnap
+	})
+}
+
+// LargerThan snaps an aggregate whenever its state is estimated to be larger than
+// the threshold, so that only aggregates that are expensive to rebuild are snapped.
+func LargerThan(bytes int64) SnapshotStrategy {
+	return StrategyFunc(func(commit CommitInfo) bool {
+		return measure(commit.State, bytes) > bytes
+	})
+}
+
+// Any snaps an aggregate when any of the strategies would. Every strategy sees
+// every commit.
+func Any(strategies ...SnapshotStrategy) SnapshotStrategy {
+	return combined{strategies: strategies, all: false}
+}
+
+// All snaps an aggregate only when all of the strategies would. Every strategy
+// sees every commit.
+func All(strategies ...SnapshotStrategy) SnapshotStrategy {
+	return combined{strategies: strategies, all: true}
+}
+
+// combined is a combination of strategies
+type combined struct {
+	strategies []SnapshotStrategy
+	all        bool
+}
+
+// ShouldSnap checks if a snapshot should be written after a commit.
+func (strategy combined) ShouldSnap(commit CommitInfo) bool {
+	some, every := false, true
+	for _, inner := range strategy.strategies {
+		snap := inner.ShouldSnap(commit)
+		some = some || snap
+		every = every && snap
+	}
+	if strategy.all {
+		return every
+	}
+	return some
+}
+
+// Snapped records that a snapshot was written for an aggregate.
+func (strategy combined) Snapped(key string) {
+	for _, inner := range strategy.strategies {
+		recordSnapped(inner, key)
+	}
+}
+
+// recordSnapped tells a strategy that a snapshot was written, if it cares.
+func recordSnapped(strategy SnapshotStrategy, key string) {
+	recorder, ok := strategy.(SnapshotRecorder)
+	if ok {
+		recorder.Snapped(key)
+	}
+}
+
+// elapsed snaps aggregates once a duration has passed since they were last snapped
+type elapsed struct {
+	lock     sync.Mutex
+	duration time.Duration
+	clock    eventsourcing.Clock
+	last     map[string]time.Time
+}
+
+// Elapsed snaps an aggregate on the first commit after the duration has passed
+// since it was last snapped (or first committed, by this process), so that
+// aggregates written slowly are snapped eventually. The clock is the system clock
+// if nil. Times are kept in memory for each aggregate that is committed.
+func Elapsed(duration time.Duration, clock eventsourcing.Clock) SnapshotStrategy {
+	if clock == nil {
+		clock = eventsourcing.SystemClock
+	}
+
+	return &elapsed{
+		duration: duration,
+		clock:    clock,
+		last:     make(map[string]time.Time),
+	}
+}
+
+// ShouldSnap checks if a snapshot should be written after a commit.
+func (strategy *elapsed) ShouldSnap(commit CommitInfo) bool {
+	strategy.lock.Lock()
+	defer strategy.lock.Unlock()
+
+	now := strategy.clock.Now()
+	last, found := strategy.last[commit.Key]
+	if !found {
+		strategy.last[commit.Key] = now
+		return false
+	}
+	return now.Sub(last) >= strategy.duration
+}
+
+// Snapped records that a snapshot was written for an aggregate.
+func (strategy *elapsed) Snapped(key string) {
+	strategy.lock.Lock()
+	defer strategy.lock.Unlock()
+	strategy.last[key] = strategy.clock.Now()
+}
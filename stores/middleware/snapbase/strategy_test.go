@@ -0,0 +1,85 @@
+package snapbase
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/simclock"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestInterval checks snaps are taken as the sequence crosses each interval
+func TestInterval(t *testing.T) {
+	strategy := Interval(5)
+	assert.False(t, strategy.ShouldSnap(CommitInfo{Sequence: 0, Events: 4}))
+	assert.True(t, strategy.ShouldSnap(CommitInfo{Sequence: 4, Events: 1}))
+	assert.True(t, strategy.ShouldSnap(CommitInfo{Sequence: 3, Events: 10}))
+	assert.False(t, strategy.ShouldSnap(CommitInfo{Sequence: 5, Events: 1}))
+	assert.False(t, Interval(0).ShouldSnap(CommitInfo{Sequence: 5, Events: 1}))
+}
+
+// TestLargerThan checks snaps are taken for large states
+func TestLargerThan(t *testing.T) {
+	strategy := LargerThan(100)
+	assert.False(t, strategy.ShouldSnap(CommitInfo{State: map[string]interface{}{"count": 1}}))
+	assert.True(t, strategy.ShouldSnap(CommitInfo{State: map[string]interface{}{"padding": strings.Repeat("x", 100)}}))
+}
+
+// TestCombinedStrategies checks strategies can be combined
+func TestCombinedStrategies(t *testing.T) {
+	yes := StrategyFunc(func(CommitInfo) bool { return true })
+	no := StrategyFunc(func(CommitInfo) bool { return false })
+	assert.True(t, Any(no, yes).ShouldSnap(CommitInfo{}))
+	assert.False(t, Any(no, no).ShouldSnap(CommitInfo{}))
+	assert.True(t, All(yes, yes).ShouldSnap(CommitInfo{}))
+	assert.False(t, All(yes, no).ShouldSnap(CommitInfo{}))
+}
+
+// TestElapsed checks aggregates are snapped once the duration has passed since
+// they were last snapped, by whichever strategy
+func TestElapsed(t *testing.T) {
+	clock := simclock.New(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	strategy := Any(Interval(10), Elapsed(time.Hour, clock))
+	commit := CommitInfo{Key: "slow", Sequence: 0, Events: 1}
+
+	assert.False(t, strategy.ShouldSnap(commit), "The clock starts at the first commit")
+	clock.Advance(59 * time.Minute)
+	assert.False(t, strategy.ShouldSnap(commit))
+	clock.Advance(time.Minute)
+	assert.True(t, strategy.ShouldSnap(commit))
+
+	recordSnapped(strategy, "slow")
+	assert.False(t, strategy.ShouldSnap(commit))
+	clock.Advance(30 * time.Minute)
+	recordSnapped(strategy, "slow")
+	clock.Advance(30 * time.Minute)
+	assert.False(t, strategy.ShouldSnap(commit), "Snaps by other strategies reset the clock")
+}
+
+// TestStrategy checks the middleware snaps when its strategy says so
+func TestStrategy(t *testing.T) {
+	puts := 0
+	params := fixedSnapshot(nil, 0)
+	params.Strategy = StrategyFunc(func(commit CommitInfo) bool {
+		return commit.State.(*test.SimpleAggregate).CurrentCount >= 10
+	})
+	params.Put = func(string, int64, interface{}) error {
+		puts++
+		return nil
+	}
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(Create(params))
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("strategic", test.GetTestRegistry(), store)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 5})
+	assert.Nil(t, agg.Commit())
+	assert.Equal(t, 0, puts)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 5})
+	assert.Nil(t, agg.Commit())
+	assert.Equal(t, 1, puts)
+}
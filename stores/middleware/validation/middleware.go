@@ -0,0 +1,147 @@
+/*
+Package validation contains a commit middleware that validates events before they are
+written, rejecting the commit with an eventsourcing.EventValidationFault if any event is
+malformed. Events are checked against `validate` struct tags (using go-playground's
+validator), and against any functions registered for their event type:
+
+	type DepositEvent struct {
+		Amount   int    `json:"amount" validate:"min=1,max=10000"`
+		Currency string `json:"currency" validate:"required,oneof=AUD NZD USD"`
+	}
+
+	rules := validation.NewRules()
+	rules.Register("DepositEvent", func(event eventsourcing.Event) error { ... })
+	store.Use(validation.Create(rules))
+
+In addition to the standard validator tags, `oneof` checks membership of a
+space-separated set of values.
+*/
+package validation
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/go-gadgets/eventsourcing"
+	validator "gopkg.in/go-playground/validator.v8"
+)
+
+// TagName is the struct tag that holds validation rules
+const TagName = "validate"
+
+// ValidateFunc is a function that validates an event, returning an error
+// describing the problem if the event is invalid.
+type ValidateFunc func(event eventsourcing.Event) error
+
+// Rules is a set of validation rules for events.
+type Rules struct {
+	funcs   map[eventsourcing.EventType][]ValidateFunc // Functions per event type
+	structs *validator.Validate                        // Struct tag validator
+}
+
+// NewRules creates a new set of rules, which validates struct tags.
+func NewRules() *Rules {
+	structs := validator.New(&validator.Config{
+		TagName: TagName,
+	})
+	structs.RegisterValidation("oneof", isOneOf)
+
+	return &Rules{
+		funcs:   make(map[eventsourcing.EventType][]ValidateFunc),
+		structs: structs,
+	}
+}
+
+// Register adds a validation function for an event type.
+func (rules *Rules) Register(eventType eventsourcing.EventType, fn ValidateFunc) {
+	rules.funcs[eventType] = append(rules.funcs[eventType], fn)
+}
+
+// RegisterTag adds a custom struct tag validation (i.e. `validate:"currency"`).
+func (rules *Rules) RegisterTag(tag string, fn validator.Func) error {
+	return rules.structs.RegisterValidation(tag, fn)
+}
+
+// Validate checks an event, returning a description of each failed rule.
+func (rules *Rules) Validate(eventType eventsourcing.EventType, event eventsourcing.Event) []string {
+	violations := make([]string, 0)
+
+	value := reflect.ValueOf(event)
+	for value.Kind() == reflect.Ptr && !value.IsNil() {
+		value = value.Elem()
+	}
+	if value.Kind() == reflect.Struct {
+		errStruct := rules.structs.Struct(value.Interface())
+		if errs, ok := errStruct.(validator.ValidationErrors); ok {
+			fields := make([]string, 0, len(errs))
+			for _, fieldError := range errs {
+				fields = append(fields, describe(fieldError))
+			}
+			sort.Strings(fields)
+			violations = append(violations, fields...)
+		} else if errStruct != nil {
+			violations = append(violations, errStruct.Error())
+		}
+	}
+
+	for _, fn := range rules.funcs[eventType] {
+		errFunc := fn(event)
+		if errFunc != nil {
+			violations = append(violations, errFunc.Error())
+		}
+	}
+
+	return violations
+}
+
+// Create a new validating middleware, which rejects commits containing events
+// that break the specified rules.
+func Create(rules *Rules) (eventsourcing.CommitMiddleware, eventsourcing.RefreshMiddleware, func() error) {
+	return func(writer eventsourcing.StoreWriterAdapter, next eventsourcing.NextHandler) error {
+			key := writer.GetKey()
+			registry := writer.GetEventRegistry()
+			seq, events := writer.GetUncommittedEvents()
+
+			for index, event := range events {
+				// Unknown types are rejected by the store itself
+				eventType, found := registry.GetEventType(event)
+				if !found {
+					continue
+				}
+
+				violations := rules.Validate(eventType, event)
+				if len(violations) > 0 {
+					return eventsourcing.NewEventValidationFault(key, seq+int64(1+index), eventType, violations)
+				}
+			}
+
+			return next()
+		}, func(reader eventsourcing.StoreLoaderAdapter, next eventsourcing.NextHandler) error {
+			return next()
+		}, func() error {
+			return nil
+		}
+}
+
+// describe formats a field error as a violation.
+func describe(fieldError *validator.FieldError) string {
+	if fieldError.Param != "" {
+		return fmt.Sprintf("%v: %v=%v", fieldError.NameNamespace, fieldError.Tag, fieldError.Param)
+	}
+
+	return fmt.Sprintf("%v: %v", fieldError.NameNamespace, fieldError.Tag)
+}
+
+// isOneOf checks that a field's value is within a space-separated set.
+func isOneOf(v *validator.Validate, topStruct reflect.Value, currentStruct reflect.Value, field reflect.Value, fieldType reflect.Type, fieldKind reflect.Kind, param string) bool {
+	value := fmt.Sprintf("%v", field.Interface())
+	for _, option := range strings.Fields(param) {
+		if value == option {
+			return true
+		}
+	}
+
+	return false
+}
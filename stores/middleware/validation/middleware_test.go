@@ -0,0 +1,79 @@
+package validation
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// depositEvent is an event with tag-based rules
+type depositEvent struct {
+	Amount   int    `json:"amount" validate:"min=1,max=100"`
+	Currency string `json:"currency" validate:"required,oneof=AUD NZD"`
+}
+
+func provider() (eventsourcing.EventStore, func(), error) {
+	base := memory.NewStore()
+	wrapped := eventsourcing.NewMiddlewareWrapper(base)
+	wrapped.Use(Create(NewRules()))
+
+	return wrapped, func() {
+		wrapped.Close()
+	}, nil
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Validation Middleware", provider)
+}
+
+// TestTagRules checks struct tags are enforced.
+func TestTagRules(t *testing.T) {
+	rules := NewRules()
+	assert.Empty(t, rules.Validate("depositEvent", depositEvent{Amount: 5, Currency: "AUD"}))
+	assert.Empty(t, rules.Validate("depositEvent", &depositEvent{Amount: 100, Currency: "NZD"}))
+
+	violations := rules.Validate("depositEvent", depositEvent{Amount: 0, Currency: "GBP"})
+	assert.Equal(t, []string{"Amount: min=1", "Currency: oneof=AUD NZD"}, violations)
+
+	violations = rules.Validate("depositEvent", depositEvent{Amount: 5})
+	assert.Equal(t, []string{"Currency: required"}, violations)
+}
+
+// TestCommitRejected checks invalid events never reach the store.
+func TestCommitRejected(t *testing.T) {
+	rules := NewRules()
+	rules.Register("IncrementEvent", func(event eventsourcing.Event) error {
+		if event.(test.IncrementEvent).IncrementBy <= 0 {
+			return errors.New("IncrementBy must be positive")
+		}
+		return nil
+	})
+
+	base := memory.NewStore()
+	wrapped := eventsourcing.NewMiddlewareWrapper(base)
+	wrapped.Use(Create(rules))
+	defer wrapped.Close()
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("validated", test.GetTestRegistry(), wrapped)
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: -1})
+	errCommit := agg.Commit()
+
+	isFault, fault := eventsourcing.IsEventValidationFault(errCommit)
+	assert.True(t, isFault)
+	assert.Equal(t, "validated", fault.AggregateKey)
+	assert.Equal(t, int64(2), fault.EventSequence)
+	assert.Equal(t, eventsourcing.EventType("IncrementEvent"), fault.EventType)
+	assert.Equal(t, []string{"IncrementBy must be positive"}, fault.Violations)
+
+	reloaded := test.SimpleAggregate{}
+	reloaded.Initialize("validated", test.GetTestRegistry(), base)
+	assert.Nil(t, reloaded.Refresh())
+	assert.Equal(t, int64(0), reloaded.SequenceNumber(), "No events should have been written")
+}
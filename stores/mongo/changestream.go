@@ -0,0 +1,246 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	keyvalue "github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/utilities/mongodoc"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ResumeTokenTracker is an interface implemented by progress trackers that can
+// also store the resume token of a change stream, which is needed to resume one.
+// The tracker returned by CreateTracker implements it.
+type ResumeTokenTracker interface {
+	ProgressTracker
+
+	// ResumeToken fetches the stored resume token, or nil if there is none
+	ResumeToken() (bson.Raw, error)
+
+	// UpdateResumeToken stores a resume token, and the cluster time of the change
+	// it follows as the position
+	UpdateResumeToken(token bson.Raw, position int64) error
+}
+
+// ChangeStreamOptions contains the options for publishing from a change stream.
+type ChangeStreamOptions struct {
+	TargetDatabase string                       // TargetDatabase is the database to read
+	CollectionName string                       // Collection name
+	Publisher      eventsourcing.EventPublisher // Event publisher
+	Registry       eventsourcing.EventRegistry  // Event registry
+	Tracker        ProgressTracker              // Progress tracker, which must be a ResumeTokenTracker to resume
+	Start          eventsourcing.StartMode      // Where to start, defaults to the tracker's resume token
+	MaxAwait       time.Duration                // Longest to wait for changes before checking for shutdown, a second by default
+	Codecs         []keyvalue.Codec             // Codecs events may be encoded with, besides JSON (see keyvalue.Codec)
+}
+
+// changeStreamPublisher publishes the events inserted into a collection, as
+// reported by a change stream.
+type changeStreamPublisher struct {
+	collection *mongo.Collection
+	options    ChangeStreamOptions
+	token      bson.Raw        // Resume token of the last change handled
+	ctx        context.Context // Context of the publisher, cancelled to stop it
+	done       chan struct{}   // Closed once the publisher has stopped
+}
+
+// changeDocument is a change reported by a change stream.
+type changeDocument struct {
+	ID            bson.Raw            `bson:"_id"`
+	OperationType string              `bson:"operationType"`
+	FullDocument  bson.M              `bson:"fullDocument"`
+	ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+}
+
+// CreateChangeStreamPublisher creates a new publisher that consumes the events
+// inserted into a collection from a change stream, and propegates them to a
+// target. Unlike the oplog publisher it needs no access to the oplog, and works
+// against sharded clusters, but it requires a replica set or sharded cluster.
+func CreateChangeStreamPublisher(dialURL string, options ChangeStreamOptions) (func() error, error) {
+	client, err := mongodoc.Dial(dialURL, 0)
+	if err != nil {
+		return nil, err
+	}
+	return CreateChangeStreamPublisherFromClient(client, options)
+}
+
+// CreateChangeStreamPublisherFromClient creates a new publisher that consumes the
+// events inserted into a collection from a change stream, and propegates them to a
+// target. This version allows BYO clients.
+//
+// Change streams resume from a token rather than a position, so they can start
+// from the latest change or resume from the token stored by a ResumeTokenTracker,
+// but not from the beginning, a timestamp or a position. Positions are still
+// recorded with the tracker, as the cluster time of each change published.
+func CreateChangeStreamPublisherFromClient(client *mongo.Client, options ChangeStreamOptions) (func() error, error) {
+	if options.MaxAwait <= 0 {
+		options.MaxAwait = time.Second
+	}
+
+	token, errToken := changeStreamStart(options.Start, options.Tracker)
+	if errToken != nil {
+		return nil, errToken
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pub := &changeStreamPublisher{
+		collection: mongodoc.Collection(client.Database(options.TargetDatabase), options.CollectionName),
+		options:    options,
+		token:      token,
+		ctx:        ctx,
+		done:       make(chan struct{}),
+	}
+
+	// Open the stream up front, so that a standalone server fails here
+	stream, errWatch := pub.watch()
+	if errWatch != nil {
+		cancel()
+		return nil, errWatch
+	}
+
+	go pub.run(stream)
+
+	terminator := func() error {
+		cancel()
+		<-pub.done
+		return nil
+	}
+	return terminator, nil
+}
+
+// changeStreamStart determines the resume token to start a change stream from,
+// nil meaning the latest change.
+func changeStreamStart(start eventsourcing.StartMode, tracker ProgressTracker) (bson.Raw, error) {
+	switch start.Kind {
+	case eventsourcing.StartLatest:
+		return nil, nil
+	case eventsourcing.StartCheckpoint:
+		tokens, ok := tracker.(ResumeTokenTracker)
+		if !ok {
+			return nil, fmt.Errorf("mongo: change streams can only resume from a checkpoint with a ResumeTokenTracker")
+		}
+		return tokens.ResumeToken()
+	}
+
+	return nil, fmt.Errorf("mongo: change streams cannot start from %v", start)
+}
+
+// watch opens the change stream, after the last change handled
+func (pub *changeStreamPublisher) watch() (*mongo.ChangeStream, error) {
+	streamOptions := options.ChangeStream().SetMaxAwaitTime(pub.options.MaxAwait)
+	if pub.token != nil {
+		streamOptions.SetResumeAfter(pub.token)
+	}
+
+	return pub.collection.Watch(pub.ctx, []bson.M{
+		{"$match": bson.M{"operationType": "insert"}},
+	}, streamOptions)
+}
+
+// run publishes changes until terminated
+func (pub *changeStreamPublisher) run(stream *mongo.ChangeStream) {
+	defer close(pub.done)
+	logrus.Info("Starting to follow MongoDB change stream...")
+
+	for {
+		// Stop once terminated
+		if pub.ctx.Err() != nil {
+			logrus.Info("Recieved shutdown signal, exiting.")
+			if stream != nil {
+				stream.Close(context.Background())
+			}
+			return
+		}
+
+		// Reopen streams that failed, after the last change handled
+		if stream == nil {
+			reopened, errWatch := pub.watch()
+			if errWatch != nil {
+				if pub.ctx.Err() == nil {
+					logrus.Error(errWatch)
+				}
+				select {
+				case <-pub.ctx.Done():
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+			stream = reopened
+		}
+
+		if stream.TryNext(pub.ctx) {
+			change := changeDocument{}
+			errDecode := stream.Decode(&change)
+			if errDecode != nil {
+				logrus.Error(errDecode)
+				continue
+			}
+			pub.handle(change)
+			continue
+		}
+
+		// No changes arrived in time, or the stream failed
+		if errStream := stream.Err(); errStream != nil {
+			if pub.ctx.Err() == nil {
+				logrus.Error(errStream)
+			}
+			stream.Close(context.Background())
+			stream = nil
+		}
+	}
+}
+
+// handle publishes the event inserted by a change, and records the progress
+func (pub *changeStreamPublisher) handle(change changeDocument) {
+	token := change.ID
+	event, publish, errEvent := decodeChange(change, pub.options.Registry, pub.options.Codecs)
+	if errEvent != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": errEvent,
+		}).Warn("Skipping event (Unable to decode)")
+	}
+
+	if publish {
+		errPublish := pub.options.Publisher.Publish(event.Key, event.Sequence, event.EventData)
+		if errPublish != nil {
+			// Leave the change to be handled again when the stream is reopened
+			logrus.Error(errPublish)
+			return
+		}
+	}
+
+	pub.token = token
+	var errUpdate error
+	if tokens, ok := pub.options.Tracker.(ResumeTokenTracker); ok {
+		errUpdate = tokens.UpdateResumeToken(token, timestampPosition(change.ClusterTime))
+	} else if pub.options.Tracker != nil {
+		errUpdate = pub.options.Tracker.UpdatePosition(timestampPosition(change.ClusterTime))
+	}
+	if errUpdate != nil {
+		logrus.Error(errUpdate)
+	}
+}
+
+// decodeChange decodes the event inserted by a change, reporting whether it should
+// be published. Gap records are not events, so are not published.
+func decodeChange(change changeDocument, registry eventsourcing.EventRegistry, codecs []keyvalue.Codec) (keyvalue.KeyedEvent, bool, error) {
+	if change.OperationType != "insert" || change.FullDocument == nil {
+		return keyvalue.KeyedEvent{}, false, nil
+	}
+	if eventsourcing.EventType(fmt.Sprint(change.FullDocument["type"])) == keyvalue.GapEventType {
+		return keyvalue.KeyedEvent{}, false, nil
+	}
+
+	event, errEvent := decodeOpLogEntry(change.FullDocument, registry, codecs)
+	if errEvent != nil {
+		return event, false, errEvent
+	}
+	return event, true, nil
+}
@@ -0,0 +1,84 @@
+package mongo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	keyvalue "github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// tokenTracker is a tracker with a fixed resume token
+type tokenTracker struct {
+	fixedTracker
+	token bson.Raw
+}
+
+func (tracker tokenTracker) ResumeToken() (bson.Raw, error) {
+	return tracker.token, nil
+}
+
+func (tracker tokenTracker) UpdateResumeToken(bson.Raw, int64) error {
+	return nil
+}
+
+// TestChangeStreamStart checks change streams resume from stored tokens, and
+// refuse start modes they can't honour
+func TestChangeStreamStart(t *testing.T) {
+	token := bson.Raw{5, 0, 0, 0, 0}
+
+	resumed, errResumed := changeStreamStart(eventsourcing.FromCheckpoint(), tokenTracker{token: token})
+	assert.Nil(t, errResumed)
+	assert.Equal(t, token, resumed)
+
+	latest, errLatest := changeStreamStart(eventsourcing.FromLatest(), tokenTracker{token: token})
+	assert.Nil(t, errLatest)
+	assert.Nil(t, latest)
+
+	_, errPositions := changeStreamStart(eventsourcing.FromCheckpoint(), fixedTracker(1234))
+	assert.NotNil(t, errPositions, "Trackers without tokens can't be resumed")
+
+	unsupported := []eventsourcing.StartMode{
+		eventsourcing.FromBeginning(),
+		eventsourcing.FromTimestamp(time.Unix(1519905600, 0)),
+		eventsourcing.FromPosition(5678),
+	}
+	for _, start := range unsupported {
+		_, errStart := changeStreamStart(start, tokenTracker{token: token})
+		assert.NotNil(t, errStart, "%v", start)
+	}
+}
+
+// TestDecodeChange checks inserted events are decoded, and gaps are skipped
+func TestDecodeChange(t *testing.T) {
+	registry := test.GetTestRegistry()
+
+	event, publish, errDecode := decodeChange(changeDocument{
+		OperationType: "insert",
+		FullDocument: bson.M{
+			"key":      "change-key",
+			"sequence": 3,
+			"type":     "IncrementEvent",
+			"data":     bson.M{"increment_by": 2},
+		},
+	}, registry, nil)
+	assert.Nil(t, errDecode)
+	assert.True(t, publish)
+	assert.Equal(t, "change-key", event.Key)
+	assert.Equal(t, int64(3), event.Sequence)
+	assert.IsType(t, &test.IncrementEvent{}, event.EventData)
+
+	_, publishGap, errGap := decodeChange(changeDocument{
+		OperationType: "insert",
+		FullDocument: bson.M{
+			"key":      "change-key",
+			"sequence": 4,
+			"type":     string(keyvalue.GapEventType),
+		},
+	}, registry, nil)
+	assert.Nil(t, errGap)
+	assert.False(t, publishGap)
+}
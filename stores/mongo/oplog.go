@@ -1,29 +1,42 @@
 package mongo
 
 import (
+	"context"
 	"fmt"
 	"time"
 
-	"github.com/globalsign/mgo"
-	"github.com/globalsign/mgo/bson"
 	"github.com/go-gadgets/eventsourcing"
 	keyvalue "github.com/go-gadgets/eventsourcing/stores/key-value"
-	"github.com/go-gadgets/eventsourcing/utilities/mapping"
+	"github.com/go-gadgets/eventsourcing/utilities/mongodoc"
 	"github.com/mitchellh/mapstructure"
-	"github.com/rwynn/gtm"
 	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// oplogPublisher is a MongDB oplog tailer that chases the MongoDB oplog for a set
-// of collections and pushes them into a target event publisher.
+// oplogPublisher is a MongDB oplog tailer that chases the MongoDB oplog for a
+// collection and pushes its inserts into a target event publisher.
 type oplogPublisher struct {
-	ctx        *gtm.OpCtx                   // Oplog context
-	collection string                       // Collection to watch
-	database   string                       // Database to watch
-	inner      eventsourcing.EventPublisher // Event publisher
-	registry   eventsourcing.EventRegistry  // Event registry
-	terminate  chan bool                    // Termination channel
-	tracker    ProgressTracker              // Position tracker
+	oplog     *mongo.Collection            // The oplog of the replica set
+	namespace string                       // Namespace (database.collection) to watch
+	after     primitive.Timestamp          // Timestamp of the last entry handled
+	maxAwait  time.Duration                // Longest to wait for entries before checking for shutdown
+	inner     eventsourcing.EventPublisher // Event publisher
+	registry  eventsourcing.EventRegistry  // Event registry
+	codecs    []keyvalue.Codec             // Codecs events may be encoded with
+	tracker   ProgressTracker              // Position tracker
+	ctx       context.Context              // Context of the tailer, cancelled to stop it
+	done      chan struct{}                // Closed once the tailer has stopped
+}
+
+// oplogEntry is an entry of the oplog.
+type oplogEntry struct {
+	Timestamp primitive.Timestamp `bson:"ts"`
+	Operation string              `bson:"op"`
+	Namespace string              `bson:"ns"`
+	Object    bson.M              `bson:"o"`
 }
 
 // OplogOptions contains the options for tailing an oplog.
@@ -33,131 +46,233 @@ type OplogOptions struct {
 	Publisher      eventsourcing.EventPublisher // Event publisher
 	Registry       eventsourcing.EventRegistry  // Event registry
 	Tracker        ProgressTracker              // Progress tracker
+	Start          eventsourcing.StartMode      // Where to start tailing, defaults to the tracker position
+	MaxAwait       time.Duration                // Longest to wait for entries before checking for shutdown, a second by default
+	Codecs         []keyvalue.Codec             // Codecs events may be encoded with, besides JSON (see keyvalue.Codec)
 }
 
 // CreateOplogPublisher creates a new publisher that consumes events from a MongoDB
 // oplog and propegates them to a target.
 func CreateOplogPublisher(dialURL string, options OplogOptions) (func() error, error) {
 	// Check we can comnnect to the dial URL
-	session, err := mgo.Dial(dialURL)
+	client, err := mongodoc.Dial(dialURL, 0)
 	if err != nil {
 		return nil, err
 	}
-	return CreateOpLogPublisherFromSession(session, options)
+	return CreateOpLogPublisherFromClient(client, options)
 }
 
-// CreateOpLogPublisherFromSession creates a new publisher that consumes events from a MongoDB
-// oplog and propegates them to a target. This version allows BYO sessions.
-func CreateOpLogPublisherFromSession(session *mgo.Session, options OplogOptions) (func() error, error) {
-	// Validate BSON tag fallback global state
-	if !bson.JSONTagFallbackState() {
-		return nil, fmt.Errorf("You must configure bson.SetJSONTagFallback(true) to use this driver")
+// CreateOpLogPublisherFromClient creates a new publisher that consumes events from a
+// MongoDB oplog and propegates them to a target. This version allows BYO clients.
+func CreateOpLogPublisherFromClient(client *mongo.Client, options OplogOptions) (func() error, error) {
+	if options.MaxAwait <= 0 {
+		options.MaxAwait = time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pub := &oplogPublisher{
+		oplog:     mongodoc.Collection(client.Database("local"), "oplog.rs"),
+		namespace: options.TargetDatabase + "." + options.CollectionName,
+		maxAwait:  options.MaxAwait,
+		inner:     options.Publisher,
+		registry:  options.Registry,
+		codecs:    options.Codecs,
+		tracker:   options.Tracker,
+		ctx:       ctx,
+		done:      make(chan struct{}),
 	}
 
-	session.SetMode(mgo.Monotonic, true)
-	initial, errInitial := options.Tracker.StartPosition()
+	initial, errInitial := oplogStart(options.Start, options.Tracker)
 	if errInitial != nil {
+		cancel()
 		return nil, errInitial
 	}
+	after, errAfter := pub.startTimestamp(initial)
+	if errAfter != nil {
+		cancel()
+		return nil, errAfter
+	}
+	pub.after = after
 
-	// Start listening, filtering to the specific collecton
-	ctx := gtm.Start(session, &gtm.Options{
-		After: func(session *mgo.Session, options *gtm.Options) bson.MongoTimestamp {
-			if initial == InitialPositionTrimHorizon {
-				return bson.MongoTimestamp(0)
-			} else if initial == InitialPositionEdge {
-				return gtm.LastOpTimestamp(session, nil)
-			}
-			return bson.MongoTimestamp(initial)
-		},
-		WorkerCount: 8,         // defaults to 1. number of go routines batch fetching concurrently
-		Ordering:    gtm.Oplog, // defaults to gtm.Oplog. ordering guarantee of events on the output channel
-	})
+	go pub.runOpLogPublisher()
 
-	// Shutdown signaller
-	signals := make(chan bool, 1)
 	terminator := func() error {
-		signals <- true
+		cancel()
+		<-pub.done
 		return nil
 	}
+	return terminator, nil
+}
 
-	pub := &oplogPublisher{
-		ctx:        ctx,
-		collection: options.CollectionName,
-		database:   options.TargetDatabase,
-		inner:      options.Publisher,
-		registry:   options.Registry,
-		terminate:  signals,
-		tracker:    options.Tracker,
+// startTimestamp resolves a start position to the timestamp of the oplog entry to
+// tail after.
+func (pub *oplogPublisher) startTimestamp(initial int64) (primitive.Timestamp, error) {
+	switch initial {
+	case InitialPositionTrimHorizon:
+		return primitive.Timestamp{}, nil
+	case InitialPositionEdge:
+		latest := oplogEntry{}
+		errLatest := pub.oplog.FindOne(pub.ctx, bson.M{}, options.FindOne().
+			SetSort(bson.D{{Key: "$natural", Value: -1}}).
+			SetProjection(bson.M{"ts": 1}),
+		).Decode(&latest)
+		if errLatest == mongo.ErrNoDocuments {
+			return primitive.Timestamp{}, nil
+		}
+		return latest.Timestamp, errLatest
 	}
 
-	go pub.runOpLogPublisher()
+	return positionTimestamp(initial), nil
+}
 
-	return terminator, nil
+// tail opens a tailable cursor over the inserts into the collection, made on their
+// own or within transactions, after the last entry handled.
+func (pub *oplogPublisher) tail() (*mongo.Cursor, error) {
+	return pub.oplog.Find(pub.ctx, bson.M{
+		"$or": bson.A{
+			bson.M{"ns": pub.namespace, "op": "i"},
+			bson.M{"op": "c", "o.applyOps.ns": pub.namespace},
+		},
+		"ts": bson.M{"$gt": pub.after},
+	}, options.Find().
+		SetCursorType(options.TailableAwait).
+		SetMaxAwaitTime(pub.maxAwait),
+	)
 }
 
 func (pub *oplogPublisher) runOpLogPublisher() {
+	defer close(pub.done)
 	logrus.Info("Starting to tail MongoDB oplog...")
 
+	var cursor *mongo.Cursor
 	for {
-		// loop forever receiving events
-		select {
-		case <-pub.terminate:
+		// Stop once terminated
+		if pub.ctx.Err() != nil {
 			logrus.Info("Recieved shutdown signal, exiting.")
+			if cursor != nil {
+				cursor.Close(context.Background())
+			}
 			return
+		}
 
-		case err := <-pub.ctx.ErrC:
-			// handle errors
-			logrus.Error(err)
-			time.Sleep(time.Second)
-
-		case op := <-pub.ctx.OpC:
-			switch {
-			// If we're not interested, skip it
-			case op.Data == nil:
-				fallthrough
-			case !op.IsInsert():
-				fallthrough
-			case op.GetDatabase() != pub.database:
-				fallthrough
-			case op.GetCollection() != pub.collection:
+		// Reopen cursors that died or failed, after the last entry handled
+		if cursor == nil {
+			reopened, errTail := pub.tail()
+			if errTail != nil {
+				if pub.ctx.Err() == nil {
+					logrus.Error(errTail)
+				}
+				pub.pause()
 				continue
-			default:
-				break
-			}
-
-			event, errEvent := decodeOpLogEntry(op.Data, pub.registry)
-			if errEvent != nil {
-				logrus.WithFields(logrus.Fields{
-					"error": errEvent,
-				}).Warn("Skipping event (Unable to decode)")
-				break
 			}
+			cursor = reopened
+		}
 
-			errPublish := pub.inner.Publish(event.Key, event.Sequence, event.EventData)
-			if errPublish != nil {
-				logrus.Error(errPublish)
+		if cursor.TryNext(pub.ctx) {
+			entry := oplogEntry{}
+			errDecode := cursor.Decode(&entry)
+			if errDecode != nil {
+				logrus.Error(errDecode)
 				continue
 			}
+			pub.handle(entry)
+			continue
+		}
 
-			errUpdate := pub.tracker.UpdatePosition(int64(op.Timestamp))
-			if errUpdate != nil {
-				logrus.Error(errUpdate)
-				continue
-			}
+		// No entries arrived in time, or the cursor died, i.e. when the oplog held
+		// nothing to tail after
+		errCursor := cursor.Err()
+		if errCursor == nil && cursor.ID() != 0 {
+			continue
+		}
+		if errCursor != nil && pub.ctx.Err() == nil {
+			logrus.Error(errCursor)
+		}
+		cursor.Close(context.Background())
+		cursor = nil
+		pub.pause()
+	}
+}
+
+// pause waits a second before the cursor is reopened, or until terminated
+func (pub *oplogPublisher) pause() {
+	select {
+	case <-pub.ctx.Done():
+	case <-time.After(time.Second):
+	}
+}
+
+// handle publishes the events inserted by an oplog entry, and records the progress
+func (pub *oplogPublisher) handle(entry oplogEntry) {
+	pub.after = entry.Timestamp
+	inserted := entry.inserts(pub.namespace)
+	if len(inserted) == 0 {
+		return
+	}
+
+	for _, document := range inserted {
+		event, errEvent := decodeOpLogEntry(document, pub.registry, pub.codecs)
+		if errEvent != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": errEvent,
+			}).Warn("Skipping event (Unable to decode)")
+			continue
 		}
+
+		errPublish := pub.inner.Publish(event.Key, event.Sequence, event.EventData)
+		if errPublish != nil {
+			logrus.Error(errPublish)
+			return
+		}
+	}
+
+	errUpdate := pub.tracker.UpdatePosition(timestampPosition(entry.Timestamp))
+	if errUpdate != nil {
+		logrus.Error(errUpdate)
 	}
 }
 
+// inserts gets the documents an oplog entry inserted into a namespace: the object
+// of an insert, or those of the inserts applied by the commit of a transaction.
+func (entry oplogEntry) inserts(namespace string) []bson.M {
+	if entry.Operation == "i" {
+		if entry.Object == nil {
+			return nil
+		}
+		return []bson.M{entry.Object}
+	}
+
+	var operations []interface{}
+	switch applied := entry.Object["applyOps"].(type) {
+	case []interface{}:
+		operations = applied
+	case bson.A:
+		operations = applied
+	}
+
+	inserted := make([]bson.M, 0, len(operations))
+	for _, operation := range operations {
+		nested, isEntry := operation.(bson.M)
+		if !isEntry || nested["op"] != "i" || nested["ns"] != namespace {
+			continue
+		}
+		document, isDocument := nested["o"].(bson.M)
+		if isDocument {
+			inserted = append(inserted, document)
+		}
+	}
+	return inserted
+}
+
 // decodeOpLogEntry decodes an event. This involves taking the BSON decoded structure we've
 // got from the OpLog, then performing a parse into KeyedEvent. From this we can sniff the
 // event type and then perform a final pass to revive the real type under the hood.
-func decodeOpLogEntry(data map[string]interface{}, registry eventsourcing.EventRegistry) (keyvalue.KeyedEvent, error) {
+func decodeOpLogEntry(data map[string]interface{}, registry eventsourcing.EventRegistry, codecs []keyvalue.Codec) (keyvalue.KeyedEvent, error) {
 	event := keyvalue.KeyedEvent{}
 
 	// Decode the wrapper
 	wrapperConfig := &mapstructure.DecoderConfig{
-		DecodeHook:       mapping.MapTimeFromJSON,
+		DecodeHook:       eventsourcing.DecodeHookFor(registry),
 		TagName:          "json",
 		Result:           &event,
 		WeaklyTypedInput: true,
@@ -172,17 +287,7 @@ func decodeOpLogEntry(data map[string]interface{}, registry eventsourcing.EventR
 	}
 
 	// Create the target type and decode into it
-	summoned := registry.CreateEvent(event.EventType)
-	config := &mapstructure.DecoderConfig{
-		TagName:          "json",
-		Result:           summoned,
-		WeaklyTypedInput: true,
-	}
-	decoder, errDecoderInner := mapstructure.NewDecoder(config)
-	if errDecoderInner != nil {
-		return event, errDecoderInner
-	}
-	errDecode := decoder.Decode(event.EventData)
+	summoned, errDecode := keyvalue.DecodeData(registry, event.EventType, event.EventData, codecs)
 	if errDecode != nil {
 		return event, errDecode
 	}
@@ -191,6 +296,37 @@ func decodeOpLogEntry(data map[string]interface{}, registry eventsourcing.EventR
 	return event, nil
 }
 
+// oplogStart determines the oplog timestamp to start tailing from. Positions are
+// oplog timestamps, as recorded by a ProgressTracker.
+func oplogStart(start eventsourcing.StartMode, tracker ProgressTracker) (int64, error) {
+	switch start.Kind {
+	case eventsourcing.StartCheckpoint:
+		return tracker.StartPosition()
+	case eventsourcing.StartBeginning:
+		return InitialPositionTrimHorizon, nil
+	case eventsourcing.StartLatest:
+		return InitialPositionEdge, nil
+	case eventsourcing.StartTimestamp:
+		// Oplog timestamps hold the seconds in the high 32 bits
+		return start.Timestamp.Unix() << 32, nil
+	case eventsourcing.StartPosition:
+		return start.Position, nil
+	}
+
+	return 0, fmt.Errorf("mongo: unsupported start mode %v", start)
+}
+
+// timestampPosition converts an oplog timestamp to a position, holding the seconds
+// in the high 32 bits and the ordinal in the low 32 bits as mgo did.
+func timestampPosition(timestamp primitive.Timestamp) int64 {
+	return int64(timestamp.T)<<32 | int64(timestamp.I)
+}
+
+// positionTimestamp converts a position back to an oplog timestamp.
+func positionTimestamp(position int64) primitive.Timestamp {
+	return primitive.Timestamp{T: uint32(position >> 32), I: uint32(position)}
+}
+
 // InitialPosition of the tracker
 type InitialPosition int64
 
@@ -216,35 +352,31 @@ type ProgressTracker interface {
 // CreateTracker creates a new MongoDB backed oplog tracker
 func CreateTracker(endpoint Endpoint, key string, initialPosition int64) (ProgressTracker, error) {
 	// Connect to the MongoDB services
-	session, errSession := mgo.Dial(endpoint.DialURL)
-	if errSession != nil {
-		return nil, errSession
+	client, collection, errDial := dial(endpoint)
+	if errDial != nil {
+		return nil, errDial
 	}
 
-	database := session.DB(endpoint.DatabaseName)
-	collection := database.C(endpoint.CollectionName)
-
-	return CreateTrackerWithConnection(session, collection, key, initialPosition)
+	return CreateTrackerWithConnection(client, collection, key, initialPosition)
 }
 
-// CreateTrackerWithConnection creates a new MGO-backed tracker with a specific connection
-// and collection. Clients assume shutdown responsibility.
-func CreateTrackerWithConnection(session *mgo.Session, collection *mgo.Collection, key string, initialPosition int64) (ProgressTracker, error) {
+// CreateTrackerWithConnection creates a new MongoDB backed tracker with a specific
+// client and collection. Clients assume shutdown responsibility.
+func CreateTrackerWithConnection(client *mongo.Client, collection *mongo.Collection, key string, initialPosition int64) (ProgressTracker, error) {
+	collection = mongodoc.Adopt(collection)
+
 	// Ensure the index exists
-	errIndex := collection.EnsureIndex(mgo.Index{
-		Key:        []string{"key"},
-		Unique:     true,
-		DropDups:   false,
-		Background: false,
+	_, errIndex := collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "key", Value: 1}},
+		Options: options.Index().SetUnique(true),
 	})
 	if errIndex != nil {
-		session.Close()
+		client.Disconnect(context.Background())
 		return nil, errIndex
 	}
 
 	instance := &tracker{
 		initial:    initialPosition,
-		session:    session,
 		collection: collection,
 		key:        key,
 	}
@@ -256,40 +388,72 @@ func CreateTrackerWithConnection(session *mgo.Session, collection *mgo.Collectio
 // stores information into MongoDB.
 type tracker struct {
 	initial    int64
-	session    *mgo.Session
-	collection *mgo.Collection
+	collection *mongo.Collection
 	key        string
 }
 
 // trackerRecord is a structure that represents the tracker position data in Mongo.
 type trackerRecord struct {
-	Key      string `json:"key"`      // Key (worker ID)
-	Position int64  `json:"position"` // Last stored position
+	Key         string   `json:"key"`                    // Key (worker ID)
+	Position    int64    `json:"position"`               // Last stored position
+	ResumeToken bson.Raw `json:"resume_token,omitempty"` // Last stored change stream resume token
+}
+
+// find gets the record of the worker, reporting whether there is one
+func (tracker *tracker) find() (trackerRecord, bool, error) {
+	result := trackerRecord{}
+	errFind := tracker.collection.FindOne(context.Background(), bson.M{
+		"key": tracker.key,
+	}).Decode(&result)
+	if errFind == mongo.ErrNoDocuments {
+		return result, false, nil
+	}
+
+	return result, errFind == nil, errFind
 }
 
 // StartPosition gets the starting position for a worker
 func (tracker *tracker) StartPosition() (int64, error) {
-	var result []trackerRecord
-	errSequence := tracker.collection.Find(bson.M{
-		"key": tracker.key,
-	}).All(&result)
+	result, found, errSequence := tracker.find()
 	if errSequence != nil {
 		return 0, errSequence
 	}
 
-	if len(result) == 0 {
+	if !found {
 		return tracker.initial, nil
 	}
-	return result[0].Position, nil
+	return result.Position, nil
 }
 
 // UpdatePosition stores the current position
 func (tracker *tracker) UpdatePosition(position int64) error {
-	_, errUpsert := tracker.collection.Upsert(bson.M{
+	_, errUpsert := tracker.collection.ReplaceOne(context.Background(), bson.M{
 		"key": tracker.key,
 	}, bson.M{
 		"key":      tracker.key,
 		"position": position,
-	})
+	}, options.Replace().SetUpsert(true))
+	return errUpsert
+}
+
+// ResumeToken gets the change stream resume token for a worker
+func (tracker *tracker) ResumeToken() (bson.Raw, error) {
+	result, _, errToken := tracker.find()
+	if errToken != nil {
+		return nil, errToken
+	}
+
+	return result.ResumeToken, nil
+}
+
+// UpdateResumeToken stores the current change stream resume token and position
+func (tracker *tracker) UpdateResumeToken(token bson.Raw, position int64) error {
+	_, errUpsert := tracker.collection.ReplaceOne(context.Background(), bson.M{
+		"key": tracker.key,
+	}, bson.M{
+		"key":          tracker.key,
+		"position":     position,
+		"resume_token": token,
+	}, options.Replace().SetUpsert(true))
 	return errUpsert
 }
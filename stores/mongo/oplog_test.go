@@ -4,16 +4,16 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
-	"github.com/globalsign/mgo/bson"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/mongodoc"
 	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func init() {
-	bson.SetJSONTagFallback(true)
-}
-
 // TestTrackerWriteRead checks the oplog tracker can write then read back
 func TestTrackerWriteRead(t *testing.T) {
 	collectionName := fmt.Sprintf("%s", uuid.NewV4())
@@ -27,7 +27,9 @@ func TestTrackerWriteRead(t *testing.T) {
 		DatabaseName:   "TestDatabase",
 		CollectionName: collectionName,
 	}, "test-tracker", InitialPositionEdge)
-	assert.Nil(t, errCreate)
+	if !assert.Nil(t, errCreate) {
+		return
+	}
 
 	initial, errInitial := result.StartPosition()
 	assert.Nil(t, errInitial)
@@ -41,6 +43,78 @@ func TestTrackerWriteRead(t *testing.T) {
 	assert.Equal(t, int64(1234), updated)
 }
 
+// fixedTracker is a tracker with a fixed start position
+type fixedTracker int64
+
+func (tracker fixedTracker) StartPosition() (int64, error) {
+	return int64(tracker), nil
+}
+
+func (tracker fixedTracker) UpdatePosition(int64) error {
+	return nil
+}
+
+// TestOplogStart checks each start mode resolves to the right oplog timestamp
+func TestOplogStart(t *testing.T) {
+	tracker := fixedTracker(1234)
+	at := time.Unix(1519905600, 0)
+
+	cases := map[string]struct {
+		start    eventsourcing.StartMode
+		expected int64
+	}{
+		"checkpoint": {eventsourcing.FromCheckpoint(), 1234},
+		"beginning":  {eventsourcing.FromBeginning(), InitialPositionTrimHorizon},
+		"latest":     {eventsourcing.FromLatest(), InitialPositionEdge},
+		"timestamp":  {eventsourcing.FromTimestamp(at), 1519905600 << 32},
+		"position":   {eventsourcing.FromPosition(5678), 5678},
+	}
+
+	for name, c := range cases {
+		position, errStart := oplogStart(c.start, tracker)
+		assert.Nil(t, errStart, name)
+		assert.Equal(t, c.expected, position, name)
+	}
+}
+
+// TestTimestampPosition checks oplog timestamps convert to the positions mgo
+// recorded, and back
+func TestTimestampPosition(t *testing.T) {
+	timestamp := primitive.Timestamp{T: 1519905600, I: 7}
+	assert.Equal(t, int64(1519905600)<<32|7, timestampPosition(timestamp))
+	assert.Equal(t, timestamp, positionTimestamp(timestampPosition(timestamp)))
+}
+
+// TestOplogInserts checks the events inserted by an oplog entry are found, whether
+// inserted on their own or within a transaction
+func TestOplogInserts(t *testing.T) {
+	decode := func(raw bson.D) oplogEntry {
+		data, _ := bson.Marshal(raw)
+		entry := oplogEntry{}
+		assert.Nil(t, bson.UnmarshalWithRegistry(mongodoc.Registry, data, &entry))
+		return entry
+	}
+
+	single := decode(bson.D{
+		{Key: "op", Value: "i"},
+		{Key: "ns", Value: "db.events"},
+		{Key: "o", Value: bson.D{{Key: "key", Value: "a"}}},
+	})
+	assert.Equal(t, []bson.M{{"key": "a"}}, single.inserts("db.events"))
+
+	transaction := decode(bson.D{
+		{Key: "op", Value: "c"},
+		{Key: "ns", Value: "admin.$cmd"},
+		{Key: "o", Value: bson.D{{Key: "applyOps", Value: bson.A{
+			bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "db.events"}, {Key: "o", Value: bson.D{{Key: "key", Value: "a"}}}},
+			bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "db.snapshots"}, {Key: "o", Value: bson.D{{Key: "_id", Value: "a"}}}},
+			bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "db.events"}, {Key: "o", Value: bson.D{{Key: "key", Value: "b"}}}},
+		}}}},
+	})
+	assert.Equal(t, []bson.M{{"key": "a"}, {"key": "b"}}, transaction.inserts("db.events"))
+	assert.Empty(t, transaction.inserts("db.other"))
+}
+
 // BenchmarkOpLogTracker checks how many position updates we can do in a given
 // time, allowing us to be confident when we tail a log.
 func BenchmarkOplogTracker(b *testing.B) {
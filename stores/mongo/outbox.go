@@ -0,0 +1,131 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/outbox"
+	"github.com/go-gadgets/eventsourcing/utilities/mongodoc"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// outboxRecord is an outbox entry as stored in MongoDB.
+type outboxRecord struct {
+	ID       string                  `bson:"_id"`
+	Key      string                  `bson:"key"`
+	Sequence int64                   `bson:"sequence"`
+	Type     eventsourcing.EventType `bson:"type"`
+	Data     interface{}             `bson:"data"`
+	Added    time.Time               `bson:"added"`
+}
+
+// mongoOutbox is an outbox (see outbox.Outbox) kept in a MongoDB collection.
+type mongoOutbox struct {
+	collection *mongo.Collection
+	registry   eventsourcing.EventRegistry
+}
+
+// NewOutbox creates an outbox for the outbox middleware, kept in a MongoDB
+// collection. Keeping it in the same database as the events means the outbox is
+// as available as the store.
+func NewOutbox(endpoint Endpoint, registry eventsourcing.EventRegistry) (outbox.Outbox, error) {
+	client, collection, errDial := dial(endpoint)
+	if errDial != nil {
+		return nil, errDial
+	}
+
+	return NewOutboxWithConnection(client, collection, registry)
+}
+
+// NewOutboxWithConnection creates an outbox kept in a specific collection. Clients
+// assume shutdown responsibility.
+func NewOutboxWithConnection(client *mongo.Client, collection *mongo.Collection, registry eventsourcing.EventRegistry) (outbox.Outbox, error) {
+	collection = mongodoc.Adopt(collection)
+
+	_, errIndex := collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "added", Value: 1}},
+	})
+	if errIndex != nil {
+		client.Disconnect(context.Background())
+		return nil, errIndex
+	}
+
+	return &mongoOutbox{
+		collection: collection,
+		registry:   registry,
+	}, nil
+}
+
+// Add records pending publications
+func (store *mongoOutbox) Add(entries []outbox.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	records := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		eventType, _ := store.registry.GetEventType(entry.Event)
+		records = append(records, outboxRecord{
+			ID:       entry.ID,
+			Key:      entry.Key,
+			Sequence: entry.Sequence,
+			Type:     eventType,
+			Data:     entry.Event,
+			Added:    entry.Added,
+		})
+	}
+
+	_, errInsert := store.collection.InsertMany(context.Background(), records)
+	return errInsert
+}
+
+// Pending gets the oldest entries added before a time
+func (store *mongoOutbox) Pending(before time.Time, limit int) ([]outbox.Entry, error) {
+	cursor, errFind := store.collection.Find(context.Background(), bson.M{
+		"added": bson.M{"$lt": before},
+	}, options.Find().
+		SetSort(bson.D{{Key: "added", Value: 1}, {Key: "key", Value: 1}, {Key: "sequence", Value: 1}}).
+		SetLimit(int64(limit)),
+	)
+	if errFind != nil {
+		return nil, errFind
+	}
+
+	var records []outboxRecord
+	errAll := cursor.All(context.Background(), &records)
+	if errAll != nil {
+		return nil, errAll
+	}
+
+	entries := make([]outbox.Entry, 0, len(records))
+	for _, record := range records {
+		event, errDecode := eventsourcing.DecodeEvent(store.registry, record.Type, record.Data)
+		if errDecode != nil {
+			return nil, errDecode
+		}
+
+		entries = append(entries, outbox.Entry{
+			ID:       record.ID,
+			Key:      record.Key,
+			Sequence: record.Sequence,
+			Event:    event,
+			Added:    record.Added,
+		})
+	}
+	return entries, nil
+}
+
+// Remove removes entries by ID
+func (store *mongoOutbox) Remove(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, errRemove := store.collection.DeleteMany(context.Background(), bson.M{
+		"_id": bson.M{"$in": ids},
+	})
+	return errRemove
+}
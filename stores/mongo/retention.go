@@ -0,0 +1,224 @@
+package mongo
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/utilities/mongodoc"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// pruneEvents removes the events of a stream that a retention policy doesn't keep.
+// The age of an event is taken from its ObjectId, which records when it was inserted.
+func (store *mongoDBEventStore) pruneEvents(key string, snapshot int64, policy eventsourcing.RetentionPolicy) (int64, error) {
+	latest := keyvalue.KeyedEvent{}
+	errLatest := store.collection.FindOne(store.ctx, bson.M{"key": key}, options.FindOne().
+		SetSort(bson.D{{Key: "sequence", Value: -1}}),
+	).Decode(&latest)
+	if errLatest == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if errLatest != nil {
+		return 0, errLatest
+	}
+
+	selector := pruneSelector(key, policy.Horizon(snapshot, latest.Sequence), policy, time.Now())
+	if selector == nil {
+		return 0, nil
+	}
+
+	result, errRemove := store.collection.DeleteMany(store.ctx, selector)
+	if errRemove != nil {
+		return 0, errRemove
+	}
+	return result.DeletedCount, nil
+}
+
+// compactEvents replaces the event at the sequence of a baseline with the
+// baseline, and then removes the events before it.
+func (store *mongoDBEventStore) compactEvents(baseline keyvalue.KeyedEvent) (int64, error) {
+	selector := bson.M{"key": baseline.Key, "sequence": baseline.Sequence}
+	replaced := keyvalue.KeyedEvent{}
+	errFind := store.collection.FindOne(store.ctx, selector).Decode(&replaced)
+	if errFind == mongo.ErrNoDocuments {
+		return 0, fmt.Errorf("StoreError: Key %v has no event at sequence %v to compact", baseline.Key, baseline.Sequence)
+	}
+	if errFind != nil {
+		return 0, errFind
+	}
+
+	_, errUpdate := store.collection.UpdateOne(store.ctx, selector, bson.M{
+		"$set": bson.M{
+			"type": baseline.EventType,
+			"data": baseline.EventData,
+		},
+	})
+	if errUpdate != nil {
+		return 0, errUpdate
+	}
+
+	result, errRemove := store.collection.DeleteMany(store.ctx, bson.M{
+		"key":      baseline.Key,
+		"sequence": bson.M{"$lt": baseline.Sequence},
+	})
+	if errRemove != nil {
+		return 0, errRemove
+	}
+
+	removed := result.DeletedCount
+	if replaced.EventType != keyvalue.BaselineEventType {
+		removed++
+	}
+	return removed, nil
+}
+
+// pruneSelector builds the selector for events that can be removed, or nil if
+// there are none.
+func pruneSelector(key string, horizon int64, policy eventsourcing.RetentionPolicy, now time.Time) bson.M {
+	if horizon <= 0 {
+		return nil
+	}
+
+	selector := bson.M{
+		"key": key,
+		"sequence": bson.M{
+			"$lte": horizon,
+		},
+	}
+	if policy.KeepFor > 0 {
+		selector["_id"] = bson.M{
+			"$lt": objectIDWithTime(now.Add(-policy.KeepFor)),
+		}
+	}
+	return selector
+}
+
+// objectIDWithTime builds the lowest ObjectId of a time, to select the documents
+// inserted before it.
+func objectIDWithTime(at time.Time) primitive.ObjectID {
+	id := primitive.ObjectID{}
+	binary.BigEndian.PutUint32(id[0:4], uint32(at.Unix()))
+	return id
+}
+
+// snapshotRecord is the part of a mongosnap snapshot the reaper needs
+type snapshotRecord struct {
+	Key      string `bson:"_id"`
+	Sequence int64  `bson:"sequence"`
+}
+
+// Reaper periodically removes events that a retention policy no longer keeps, from
+// every stream that has a snapshot in a mongosnap snapshot collection. Streams are
+// only pruned up to their snapshot, so snapshots must not be removed (i.e. by the
+// MaxSnapshotBytes limit) once their events have been reaped.
+type Reaper struct {
+	store     eventsourcing.RetentionStore
+	snapshots *mongo.Collection
+	policy    eventsourcing.RetentionPolicy
+	interval  time.Duration
+	OnError   func(error)         // Called when a pass fails, logs by default
+	Clock     eventsourcing.Clock // Source of time for the interval, the system clock by default
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewReaper creates a reaper for a Mongo event store, using the snapshots of a
+// mongosnap snapshot collection. Passes run on the interval once started.
+func NewReaper(store eventsourcing.EventStore, snapshots *mongo.Collection, policy eventsourcing.RetentionPolicy, interval time.Duration) (*Reaper, error) {
+	retention, ok := store.(eventsourcing.RetentionStore)
+	if !ok {
+		return nil, fmt.Errorf("Store %T does not support pruning events", store)
+	}
+
+	return &Reaper{
+		store:     retention,
+		snapshots: mongodoc.Adopt(snapshots),
+		policy:    policy,
+		interval:  interval,
+		OnError: func(err error) {
+			logrus.WithError(err).Error("mongo_reaper_error")
+		},
+		Clock: eventsourcing.SystemClock,
+	}, nil
+}
+
+// Reap runs a single pass over all snapshotted streams, returning the number of
+// events removed.
+func (reaper *Reaper) Reap() (int64, error) {
+	return reaper.ReapContext(context.Background())
+}
+
+// ReapContext runs a single pass over all snapshotted streams, stopping early if
+// the context is cancelled, returning the number of events removed.
+func (reaper *Reaper) ReapContext(ctx context.Context) (int64, error) {
+	cursor, errFind := reaper.snapshots.Find(ctx, bson.M{}, options.Find().
+		SetProjection(bson.M{"_id": 1, "sequence": 1}),
+	)
+	if errFind != nil {
+		return 0, errFind
+	}
+	defer cursor.Close(context.Background())
+
+	removed := int64(0)
+	for cursor.Next(ctx) {
+		record := snapshotRecord{}
+		errDecode := cursor.Decode(&record)
+		if errDecode != nil {
+			return removed, errDecode
+		}
+
+		count, errPrune := reaper.store.Prune(record.Key, record.Sequence, reaper.policy)
+		if errPrune != nil {
+			return removed, errPrune
+		}
+		removed += count
+	}
+
+	return removed, cursor.Err()
+}
+
+// Start running passes in the background.
+func (reaper *Reaper) Start() {
+	reaper.stop = make(chan struct{})
+	reaper.done = make(chan struct{})
+	go reaper.run()
+}
+
+// run reaps on the interval, until stopped
+func (reaper *Reaper) run() {
+	defer close(reaper.done)
+	ticker := reaper.Clock.NewTicker(reaper.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-reaper.stop:
+			return
+		case <-ticker.C():
+			_, errReap := reaper.Reap()
+			if errReap != nil {
+				reaper.OnError(errReap)
+			}
+		}
+	}
+}
+
+// Stop running passes, waiting for any pass in progress to finish.
+func (reaper *Reaper) Stop() error {
+	if reaper.stop == nil {
+		return nil
+	}
+
+	close(reaper.stop)
+	<-reaper.done
+	reaper.stop = nil
+	return nil
+}
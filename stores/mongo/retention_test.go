@@ -0,0 +1,34 @@
+package mongo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestPruneSelector checks events are selected by sequence, and by age when kept for a time.
+func TestPruneSelector(t *testing.T) {
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, pruneSelector("key", 0, eventsourcing.RetentionPolicy{}, now))
+
+	assert.Equal(t, bson.M{
+		"key":      "key",
+		"sequence": bson.M{"$lte": int64(7)},
+	}, pruneSelector("key", 7, eventsourcing.RetentionPolicy{KeepEvents: 3}, now))
+
+	aged := pruneSelector("key", 7, eventsourcing.RetentionPolicy{KeepFor: time.Hour}, now)
+	cutoff := aged["_id"].(bson.M)["$lt"].(primitive.ObjectID)
+	assert.Equal(t, now.Add(-time.Hour), cutoff.Timestamp().UTC())
+	assert.Equal(t, "5a97dd300000000000000000", cutoff.Hex(), "The rest of the ObjectId is zero")
+}
+
+// TestReaperRequiresRetention checks stores must support pruning.
+func TestReaperRequiresRetention(t *testing.T) {
+	_, errReaper := NewReaper(eventsourcing.NewMiddlewareWrapper(memory.NewStore()), nil, eventsourcing.RetentionPolicy{}, time.Minute)
+	assert.NotNil(t, errReaper)
+}
@@ -1,78 +1,126 @@
 package mongo
 
 import (
+	"context"
 	"fmt"
-	"strings"
+	"time"
 
-	"github.com/globalsign/mgo"
-	"github.com/globalsign/mgo/bson"
 	"github.com/go-gadgets/eventsourcing"
 	"github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-gadgets/eventsourcing/utilities/mongodoc"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // mongoDBEventStore is a type that represents a MongoDB backed
 // EventStore implementation
 type mongoDBEventStore struct {
-	session    *mgo.Session
-	collection *mgo.Collection
+	client       *mongo.Client
+	collection   *mongo.Collection
+	transactions *mongodoc.Transactions // Transactions that commits join, nil for none
+	ctx          context.Context        // Context of operations, cancelled when the store is closed
+	cancel       context.CancelFunc     // Cancels the context of operations
 }
 
 // Endpoint are parameters for the MongoDB event store
 // to use when initializing.
 type Endpoint struct {
-	DialURL        string `json:"dial_url"`        // DialURL is the mgo URL to use when connecting to the cluster
-	DatabaseName   string `json:"database_name"`   // DatabaseName is the database to create/connect to.
-	CollectionName string `json:"collection_name"` // CollectionName is the collection name to put new documents in to
+	DialURL        string        `json:"dial_url"`        // DialURL is the connection string to use when connecting to the cluster
+	DatabaseName   string        `json:"database_name"`   // DatabaseName is the database to create/connect to.
+	CollectionName string        `json:"collection_name"` // CollectionName is the collection name to put new documents in to
+	Timeout        time.Duration `json:"timeout"`         // Timeout is the longest an operation may take, zero for no limit
+}
+
+// dial connects to the deployment of an endpoint, and gets its collection.
+func dial(endpoint Endpoint) (*mongo.Client, *mongo.Collection, error) {
+	client, errDial := mongodoc.Dial(endpoint.DialURL, endpoint.Timeout)
+	if errDial != nil {
+		return nil, nil, errDial
+	}
+
+	collection := mongodoc.Collection(client.Database(endpoint.DatabaseName), endpoint.CollectionName)
+	return client, collection, nil
 }
 
 // NewStore creates a new MongoDB backed event store for an
 // application to use.
 func NewStore(endpoint Endpoint) (eventsourcing.EventStore, error) {
 	// Connect to the MongoDB services
-	session, errSession := mgo.Dial(endpoint.DialURL)
-	if errSession != nil {
-		return nil, errSession
+	client, collection, errDial := dial(endpoint)
+	if errDial != nil {
+		return nil, errDial
 	}
 
-	database := session.DB(endpoint.DatabaseName)
-	collection := database.C(endpoint.CollectionName)
+	return NewStoreWithConnection(client, collection)
+}
 
-	return NewStoreWithConnection(session, collection)
+// NewStoreWithConnection creates a new MongoDB backed store with a specific client
+// and collection. The collection is used to store the records, the client is
+// disconnected to clean up afterward. Documents are written in the format of earlier
+// versions (see mongodoc), whatever the registry of the client.
+//
+// Operations are made with a context that is cancelled when the store is closed;
+// limit how long they may take with the timeout of the client.
+func NewStoreWithConnection(client *mongo.Client, collection *mongo.Collection) (eventsourcing.EventStore, error) {
+	return NewStoreWithTransactions(client, collection, nil)
 }
 
-// NewStoreWithConnection creates a new MGO-backed store with a specific session
-// and collection. The collection is used to store the records, the session is used
-// to clean up afterward.
-func NewStoreWithConnection(session *mgo.Session, collection *mgo.Collection) (eventsourcing.EventStore, error) {
-	// Validate BSON tag fallback global state
-	if !bson.JSONTagFallbackState() {
-		return nil, fmt.Errorf("You must configure mgo with bson.SetJSONTagFallback(true) to use this driver")
-	}
+// NewStoreWithTransactions creates a new MongoDB backed store whose commits join
+// the transactions of a coordinator, so that the snapshot written by mongosnap
+// middleware sharing the coordinator (see mongosnap.Parameters) is committed with
+// the events, or not at all. The client must be the one of the coordinator.
+//
+// On a standalone server there are no transactions, and events are inserted in
+// bulk, with the snapshot written after them.
+func NewStoreWithTransactions(client *mongo.Client, collection *mongo.Collection, transactions *mongodoc.Transactions) (eventsourcing.EventStore, error) {
+	collection = mongodoc.Adopt(collection)
 
-	// Ensure the index exists
-	errIndex := collection.EnsureIndex(mgo.Index{
-		Key:        []string{"key", "sequence"},
-		Unique:     true,
-		DropDups:   false,
-		Background: false,
+	// Ensure the indexes exist: the key/sequence index, then categories and
+	// business transactions by their correlation ID, which are read in feed order
+	_, errIndex := collection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key", Value: 1}, {Key: "sequence", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "metadata.category", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "metadata." + eventsourcing.MetadataCorrelationID, Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
 	})
 	if errIndex != nil {
-		session.Close()
+		client.Disconnect(context.Background())
 		return nil, errIndex
 	}
 
 	engine := &mongoDBEventStore{
-		session:    session,
-		collection: collection,
+		client:       client,
+		collection:   collection,
+		transactions: transactions,
 	}
+	engine.ctx, engine.cancel = context.WithCancel(context.Background())
 
 	store := keyvalue.NewStore(keyvalue.Options{
-		CheckSequence: engine.checkExists,
-		FetchEvents:   engine.fetchEvents,
-		PutEvents:     engine.putEvents,
+		CheckSequence:   engine.checkExists,
+		FetchPages:      engine.fetchPages,
+		PutEvents:       engine.putEvents,
+		PruneEvents:     engine.pruneEvents,
+		CompactEvents:   engine.compactEvents,
+		LatestSequence:  engine.latestSequence,
+		ReadAll:         engine.readAll,
+		ReadCategory:    engine.readCategory,
+		ReadCorrelation: engine.readCorrelation,
+		Ping: func(ctx context.Context) error {
+			return client.Ping(ctx, nil)
+		},
 		Close: func() error {
-			session.Close()
-			return nil
+			engine.cancel()
+			return disconnect(client)
 		},
 	})
 
@@ -81,47 +129,190 @@ func NewStoreWithConnection(session *mgo.Session, collection *mgo.Collection) (e
 
 // checkExists checks that a particular sequence number exists in the store.
 func (store *mongoDBEventStore) checkExists(key string, seq int64) (bool, error) {
-	var result []interface{}
-	errSequence := store.collection.Find(bson.M{
+	count, errSequence := store.collection.CountDocuments(store.ctx, bson.M{
 		"key":      key,
 		"sequence": seq,
-	}).All(&result)
+	})
+
+	return count == 1, errSequence
+}
 
-	return result != nil && len(result) == 1, errSequence
+// latestSequence gets the sequence of the latest event for a key, reading only the
+// highest entry of the key/sequence index.
+func (store *mongoDBEventStore) latestSequence(key string) (int64, error) {
+	result := struct {
+		Sequence int64 `bson:"sequence"`
+	}{}
+	errFind := store.collection.FindOne(store.ctx, bson.M{"key": key}, options.FindOne().
+		SetSort(bson.D{{Key: "sequence", Value: -1}}).
+		SetProjection(bson.M{"sequence": 1}),
+	).Decode(&result)
+	if errFind == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+
+	return result.Sequence, errFind
 }
 
-// putEvents writes events to the backing store.
+// disconnect disconnects a client, unless the middleware sharing it already has.
+func disconnect(client *mongo.Client) error {
+	errDisconnect := client.Disconnect(context.Background())
+	if errDisconnect == mongo.ErrClientDisconnected {
+		return nil
+	}
+	return errDisconnect
+}
+
+// putEvents writes events to the backing store, within the transaction open for
+// the commit if there is one.
 func (store *mongoDBEventStore) putEvents(events []keyvalue.KeyedEvent) error {
-	bulk := store.collection.Bulk()
+	documents := make([]interface{}, 0, len(events))
 	for _, event := range events {
-		bulk.Insert(event)
+		documents = append(documents, event)
 	}
-	_, errBulk := bulk.Run()
+	last := events[len(events)-1]
+	ctx := store.transactions.Context(last.Key, last.Sequence, store.ctx)
+	_, errInsert := store.collection.InsertMany(ctx, documents)
 
-	if errBulk != nil && strings.HasPrefix(errBulk.Error(), "E11000") {
+	// Concurrent commits collide on the key/sequence index, or on each other's
+	// writes when they commit in transactions
+	if mongo.IsDuplicateKeyError(errInsert) || mongodoc.IsWriteConflict(errInsert) {
 		firstEvent := events[0]
 		return eventsourcing.NewConcurrencyFault(firstEvent.Key, firstEvent.Sequence)
 	}
 
-	return errBulk
+	return errInsert
 }
 
-// Fetch events from the Mongo store
-func (store *mongoDBEventStore) fetchEvents(key string, seq int64) ([]keyvalue.KeyedEvent, error) {
-	// Load the events from mgo
-	var loaded []keyvalue.KeyedEvent
-	errLoad := store.collection.Find(
+// Fetch events from the Mongo store, a batch at a time
+func (store *mongoDBEventStore) fetchPages(key string, seq int64, page keyvalue.PageCallback) error {
+	cursor, errFind := store.collection.Find(store.ctx,
 		bson.M{
 			"key": key,
 			"sequence": bson.M{
 				"$gt": seq,
 			},
 		},
-	).Sort("sequence").All(&loaded)
+		options.Find().
+			SetSort(bson.D{{Key: "sequence", Value: 1}}).
+			SetBatchSize(keyvalue.DefaultPageSize),
+	)
+	if errFind != nil {
+		return errFind
+	}
+	defer cursor.Close(context.Background())
+
+	loaded := make([]keyvalue.KeyedEvent, 0, keyvalue.DefaultPageSize)
+	for cursor.Next(store.ctx) {
+		event := keyvalue.KeyedEvent{}
+		errDecode := cursor.Decode(&event)
+		if errDecode != nil {
+			return errDecode
+		}
+		loaded = append(loaded, event)
 
-	if errLoad != nil {
-		return nil, errLoad
+		if len(loaded) == keyvalue.DefaultPageSize {
+			errPage := page(loaded)
+			if errPage != nil {
+				return errPage
+			}
+			loaded = make([]keyvalue.KeyedEvent, 0, keyvalue.DefaultPageSize)
+		}
 	}
 
-	return loaded, nil
+	errCursor := cursor.Err()
+	if errCursor != nil {
+		return errCursor
+	}
+
+	if len(loaded) == 0 {
+		return nil
+	}
+	return page(loaded)
+}
+
+// feedDocument is an event document, as read from the global feed.
+type feedDocument struct {
+	ID                  primitive.ObjectID `bson:"_id"`
+	keyvalue.KeyedEvent `bson:",inline"`
+}
+
+// readAll reads events from the global feed in _id order. Object IDs begin with
+// the time they were generated, so the feed is approximately in commit order, but
+// events committed concurrently within the same second may be written out of order.
+// Readers that follow the end of the feed should lag behind it to avoid skipping them.
+func (store *mongoDBEventStore) readAll(from string, limit int) ([]keyvalue.PositionedEvent, error) {
+	selector, errSelector := feedSelector(from)
+	if errSelector != nil {
+		return nil, errSelector
+	}
+
+	return store.readFeed(selector, limit)
+}
+
+// readCategory reads the events of a category from the global feed, in _id order.
+func (store *mongoDBEventStore) readCategory(category string, from string, limit int) ([]keyvalue.PositionedEvent, error) {
+	selector, errSelector := feedSelector(from)
+	if errSelector != nil {
+		return nil, errSelector
+	}
+	selector["metadata.category"] = category
+
+	return store.readFeed(selector, limit)
+}
+
+// readCorrelation reads the events of a business transaction from the global feed,
+// in _id order.
+func (store *mongoDBEventStore) readCorrelation(correlationID string, from string, limit int) ([]keyvalue.PositionedEvent, error) {
+	selector, errSelector := feedSelector(from)
+	if errSelector != nil {
+		return nil, errSelector
+	}
+	selector["metadata."+eventsourcing.MetadataCorrelationID] = correlationID
+
+	return store.readFeed(selector, limit)
+}
+
+// readFeed reads the events matching a selector, in _id order.
+func (store *mongoDBEventStore) readFeed(selector bson.M, limit int) ([]keyvalue.PositionedEvent, error) {
+	cursor, errFind := store.collection.Find(store.ctx, selector, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(int64(limit)),
+	)
+	if errFind != nil {
+		return nil, errFind
+	}
+
+	documents := make([]feedDocument, 0, limit)
+	errAll := cursor.All(store.ctx, &documents)
+	if errAll != nil {
+		return nil, errAll
+	}
+
+	result := make([]keyvalue.PositionedEvent, 0, len(documents))
+	for _, document := range documents {
+		result = append(result, keyvalue.PositionedEvent{
+			KeyedEvent: document.KeyedEvent,
+			Position:   document.ID.Hex(),
+		})
+	}
+
+	return result, nil
+}
+
+// feedSelector builds the selector for events that follow a position in the feed.
+func feedSelector(from string) (bson.M, error) {
+	if from == "" {
+		return bson.M{}, nil
+	}
+	id, errID := primitive.ObjectIDFromHex(from)
+	if errID != nil {
+		return nil, fmt.Errorf("StoreError: Invalid feed position %q", from)
+	}
+
+	return bson.M{
+		"_id": bson.M{
+			"$gt": id,
+		},
+	}, nil
 }
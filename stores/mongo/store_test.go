@@ -1,21 +1,23 @@
 package mongo
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
-	mgo "github.com/globalsign/mgo"
-	"github.com/globalsign/mgo/bson"
 	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/outbox"
+	"github.com/go-gadgets/eventsourcing/utilities/mongodoc"
 	"github.com/go-gadgets/eventsourcing/utilities/test"
 	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func init() {
-	bson.SetJSONTagFallback(true)
-}
-
 func provider() (eventsourcing.EventStore, func(), error) {
 	collectionName := fmt.Sprintf("%s", uuid.NewV4())
 	dial := os.Getenv("MONGO_TEST_HOST")
@@ -31,11 +33,12 @@ func provider() (eventsourcing.EventStore, func(), error) {
 
 	return result, func() {
 		// Connect to the MongoDB services
-		session, errSession := mgo.Dial(dial)
-		if errSession != nil {
+		client, errDial := mongodoc.Dial(dial, 0)
+		if errDial != nil {
 			return
 		}
-		session.DB("TestDatabase").DropDatabase()
+		defer client.Disconnect(context.Background())
+		client.Database("TestDatabase").Drop(context.Background())
 	}, err
 }
 
@@ -44,6 +47,47 @@ func TestStoreCompliance(t *testing.T) {
 	test.CheckStandardSuite(t, "MongoDB Store", provider)
 }
 
+// TestGlobalFeed checks every event can be read in _id order.
+func TestGlobalFeed(t *testing.T) {
+	test.CheckGlobalFeed(t, provider)
+}
+
+// TestCategoryFeed checks the events of a category can be read in _id order.
+func TestCategoryFeed(t *testing.T) {
+	test.CheckCategoryFeed(t, provider)
+}
+
+// TestCorrelationFeed checks the events of a business transaction can be read
+// across aggregates.
+func TestCorrelationFeed(t *testing.T) {
+	test.CheckCorrelationFeed(t, provider)
+}
+
+// TestIdempotentCommits checks retried commits with the same ID succeed
+func TestIdempotentCommits(t *testing.T) {
+	test.CheckIdempotentCommits(t, provider)
+}
+
+// TestVersion checks versions are read from the highest sequence of a key.
+func TestVersion(t *testing.T) {
+	test.CheckVersion(t, provider)
+}
+
+// TestFeedSelector checks the feed is read after a position, which must be an ObjectId.
+func TestFeedSelector(t *testing.T) {
+	all, errAll := feedSelector("")
+	assert.Nil(t, errAll)
+	assert.Equal(t, bson.M{}, all)
+
+	id := primitive.NewObjectID()
+	after, errAfter := feedSelector(id.Hex())
+	assert.Nil(t, errAfter)
+	assert.Equal(t, bson.M{"_id": bson.M{"$gt": id}}, after)
+
+	_, errInvalid := feedSelector("42")
+	assert.NotNil(t, errInvalid)
+}
+
 // BenchmarkIndividualCommmits tests how fast we can apply events to an aggregate
 func BenchmarkIndividualCommmits(b *testing.B) {
 	test.MeasureIndividualCommits(b, provider)
@@ -54,3 +98,35 @@ func BenchmarkIndividualCommmits(b *testing.B) {
 func BenchmarkBulkInsertAndLoad(b *testing.B) {
 	test.MeasureBulkInsertAndReload(b, provider)
 }
+
+// TestOutbox checks outbox entries are stored, listed oldest first and removed
+func TestOutbox(t *testing.T) {
+	dial := os.Getenv("MONGO_TEST_HOST")
+	if dial == "" {
+		dial = "mongodb://localhost:27017"
+	}
+
+	store, errOutbox := NewOutbox(Endpoint{
+		DialURL:        dial,
+		DatabaseName:   "TestDatabase",
+		CollectionName: fmt.Sprintf("%s", uuid.NewV4()),
+	}, test.GetTestRegistry())
+	require.Nil(t, errOutbox)
+
+	added := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Nil(t, store.Add([]outbox.Entry{
+		{ID: "second", Key: "outbox", Sequence: 2, Event: test.IncrementEvent{IncrementBy: 2}, Added: added.Add(time.Second)},
+		{ID: "first", Key: "outbox", Sequence: 1, Event: test.IncrementEvent{IncrementBy: 1}, Added: added},
+	}))
+
+	entries, errPending := store.Pending(added.Add(time.Minute), 10)
+	assert.Nil(t, errPending)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "first", entries[0].ID)
+	assert.Equal(t, &test.IncrementEvent{IncrementBy: 1}, entries[0].Event)
+
+	assert.Nil(t, store.Remove([]string{"first"}))
+	remaining, _ := store.Pending(added.Add(time.Minute), 10)
+	assert.Equal(t, 1, len(remaining))
+	assert.Equal(t, "second", remaining[0].ID)
+}
@@ -0,0 +1,330 @@
+package redisstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-gadgets/eventsourcing"
+	keyvalue "github.com/go-gadgets/eventsourcing/stores/key-value"
+	"github.com/go-redis/redis"
+)
+
+const (
+	// DefaultPrefix is the prefix applied to aggregate keys to form stream names.
+	DefaultPrefix = "es:"
+
+	// fetchPageSize is the number of entries to read per XRANGE call.
+	fetchPageSize = 500
+
+	// conflictPrefix is the error prefix raised by the append script when the
+	// stream has moved on beyond the expected sequence.
+	conflictPrefix = "CONFLICT"
+
+	// gapPrefix is the error prefix raised by the append script when the
+	// events would be written past the end of the stream.
+	gapPrefix = "GAP"
+)
+
+// appendScript appends events to a stream, using entry IDs of 0-{seq} so that
+// the stream ID doubles as the sequence number. The script enforces that the
+// first event is exactly one past the current end of the stream.
+//
+// KEYS[1] = stream name
+// ARGV[1] = sequence number of the first event
+// ARGV[2..] = triples of (event type, event data, event metadata), with the
+// metadata empty when an event has none
+var appendScript = redis.NewScript(`
+local first = tonumber(ARGV[1])
+local last = 0
+local tail = redis.call('XREVRANGE', KEYS[1], '+', '-', 'COUNT', 1)
+if #tail > 0 then
+	last = tonumber(string.match(tail[1][1], '%-(%d+)$'))
+end
+if last >= first then
+	return redis.error_reply('CONFLICT ' .. last)
+end
+if last ~= first - 1 then
+	return redis.error_reply('GAP ' .. last)
+end
+for index = 2, #ARGV, 3 do
+	local seq = first + (index - 2) / 3
+	if ARGV[index + 2] == '' then
+		redis.call('XADD', KEYS[1], '0-' .. seq, 'type', ARGV[index], 'data', ARGV[index + 1])
+	else
+		redis.call('XADD', KEYS[1], '0-' .. seq, 'type', ARGV[index], 'data', ARGV[index + 1], 'metadata', ARGV[index + 2])
+	end
+end
+return first + (#ARGV - 1) / 3 - 1
+`)
+
+// Endpoint are parameters for the Redis streams event store to use when
+// initializing.
+type Endpoint struct {
+	Address string `json:"address"` // Address of the Redis server
+	Prefix  string `json:"prefix"`  // Prefix to apply to stream names
+}
+
+// redisStreamStore is a type that represents a Redis Streams backed
+// EventStore implementation
+type redisStreamStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewStore creates a new Redis Streams backed event store for an application
+// to use.
+func NewStore(endpoint Endpoint) (eventsourcing.EventStore, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr: endpoint.Address,
+	})
+
+	return NewStoreWithClient(client, endpoint.Prefix)
+}
+
+// NewStoreWithClient creates a new Redis Streams backed event store using an
+// existing client. If the prefix is empty, DefaultPrefix is used.
+func NewStoreWithClient(client *redis.Client, prefix string) (eventsourcing.EventStore, error) {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+
+	engine := &redisStreamStore{
+		client: client,
+		prefix: prefix,
+	}
+
+	store := keyvalue.NewStore(keyvalue.Options{
+		CheckSequence: engine.checkExists,
+		FetchEvents:   engine.fetchEvents,
+		PutEvents:     engine.putEvents,
+		Ping: func(ctx context.Context) error {
+			return client.WithContext(ctx).Ping().Err()
+		},
+		Close: func() error {
+			return client.Close()
+		},
+	})
+
+	return store, nil
+}
+
+// streamName gets the name of the stream for an aggregate key
+func (store *redisStreamStore) streamName(key string) string {
+	return store.prefix + key
+}
+
+// checkExists checks that a particular sequence number exists in the store.
+func (store *redisStreamStore) checkExists(key string, seq int64) (bool, error) {
+	id := entryID(seq)
+	entries, errRange := store.xrange(store.streamName(key), id, id, 1)
+	if errRange != nil {
+		return false, errRange
+	}
+
+	return len(entries) == 1, nil
+}
+
+// putEvents writes events to the backing store, grouping them by key so
+// each aggregate's batch is appended atomically by the script.
+func (store *redisStreamStore) putEvents(events []keyvalue.KeyedEvent) error {
+	start := 0
+	for start < len(events) {
+		end := start + 1
+		for end < len(events) && events[end].Key == events[start].Key {
+			end++
+		}
+
+		errAppend := store.appendBatch(events[start:end])
+		if errAppend != nil {
+			return errAppend
+		}
+		start = end
+	}
+
+	return nil
+}
+
+// appendBatch appends a batch of events for a single key.
+func (store *redisStreamStore) appendBatch(batch []keyvalue.KeyedEvent) error {
+	first := batch[0]
+	args := []interface{}{first.Sequence}
+	for _, event := range batch {
+		buff, errMarshal := json.Marshal(event.EventData)
+		if errMarshal != nil {
+			return errMarshal
+		}
+
+		metadata := ""
+		if len(event.Metadata) > 0 {
+			encoded, errMetadata := json.Marshal(event.Metadata)
+			if errMetadata != nil {
+				return errMetadata
+			}
+			metadata = string(encoded)
+		}
+
+		args = append(args, string(event.EventType), string(buff), metadata)
+	}
+
+	errScript := appendScript.Run(store.client, []string{store.streamName(first.Key)}, args...).Err()
+	if errScript == nil {
+		return nil
+	}
+
+	message := errScript.Error()
+	switch {
+	case strings.HasPrefix(message, conflictPrefix):
+		return eventsourcing.NewConcurrencyFault(first.Key, first.Sequence)
+	case strings.HasPrefix(message, gapPrefix):
+		return fmt.Errorf(
+			"StoreError: Cannot store at index %v for key %v, stream is at %v",
+			first.Sequence,
+			first.Key,
+			strings.TrimSpace(strings.TrimPrefix(message, gapPrefix)),
+		)
+	}
+
+	return errScript
+}
+
+// fetchEvents loads all events beyond the specified sequence number.
+func (store *redisStreamStore) fetchEvents(key string, seq int64) ([]keyvalue.KeyedEvent, error) {
+	stream := store.streamName(key)
+	loaded := make([]keyvalue.KeyedEvent, 0)
+	next := seq + 1
+
+	for {
+		entries, errRange := store.xrange(stream, entryID(next), "+", fetchPageSize)
+		if errRange != nil {
+			return nil, errRange
+		}
+
+		for _, entry := range entries {
+			event, errDecode := decodeEntry(key, entry)
+			if errDecode != nil {
+				return nil, errDecode
+			}
+			loaded = append(loaded, event)
+			next = event.Sequence + 1
+		}
+
+		if len(entries) < fetchPageSize {
+			return loaded, nil
+		}
+	}
+}
+
+// streamEntry is a single entry read from a stream.
+type streamEntry struct {
+	id     string
+	fields map[string]string
+}
+
+// xrange reads a range of entries from a stream. The go-redis v6 client does not
+// have native stream support, so the command is issued directly.
+func (store *redisStreamStore) xrange(stream string, start string, end string, count int) ([]streamEntry, error) {
+	cmd := redis.NewCmd("XRANGE", stream, start, end, "COUNT", count)
+	errProcess := store.client.Process(cmd)
+	if errProcess != nil {
+		return nil, errProcess
+	}
+
+	raw, errResult := cmd.Result()
+	if errResult != nil {
+		return nil, errResult
+	}
+
+	return parseEntries(raw)
+}
+
+// parseEntries converts a raw XRANGE reply into stream entries.
+func parseEntries(raw interface{}) ([]streamEntry, error) {
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected XRANGE reply: %v", raw)
+	}
+
+	entries := make([]streamEntry, len(items))
+	for index, item := range items {
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("Unexpected stream entry: %v", item)
+		}
+
+		id, ok := pair[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected stream entry ID: %v", pair[0])
+		}
+
+		values, ok := pair[1].([]interface{})
+		if !ok || len(values)%2 != 0 {
+			return nil, fmt.Errorf("Unexpected stream entry fields: %v", pair[1])
+		}
+
+		fields := make(map[string]string)
+		for field := 0; field < len(values); field += 2 {
+			fields[fmt.Sprintf("%v", values[field])] = fmt.Sprintf("%v", values[field+1])
+		}
+
+		entries[index] = streamEntry{
+			id:     id,
+			fields: fields,
+		}
+	}
+
+	return entries, nil
+}
+
+// decodeEntry converts a stream entry into a keyed event.
+func decodeEntry(key string, entry streamEntry) (keyvalue.KeyedEvent, error) {
+	seq, errSeq := sequenceOf(entry.id)
+	if errSeq != nil {
+		return keyvalue.KeyedEvent{}, errSeq
+	}
+
+	// Rehydrate the JSON
+	target := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader([]byte(entry.fields["data"])))
+	decoder.UseNumber()
+	errUnmarshal := decoder.Decode(&target)
+	if errUnmarshal != nil {
+		return keyvalue.KeyedEvent{}, errUnmarshal
+	}
+
+	event := keyvalue.KeyedEvent{
+		Key:       key,
+		Sequence:  seq,
+		EventType: eventsourcing.EventType(entry.fields["type"]),
+		EventData: target,
+	}
+
+	// Entries written before metadata was stored, or without any, have no field
+	metadata, hasMetadata := entry.fields["metadata"]
+	if hasMetadata && metadata != "" {
+		errMetadata := json.Unmarshal([]byte(metadata), &event.Metadata)
+		if errMetadata != nil {
+			return keyvalue.KeyedEvent{}, errMetadata
+		}
+	}
+
+	return event, nil
+}
+
+// entryID gets the stream entry ID for a sequence number
+func entryID(seq int64) string {
+	return fmt.Sprintf("0-%d", seq)
+}
+
+// sequenceOf extracts the sequence number from a stream entry ID
+func sequenceOf(id string) (int64, error) {
+	separator := strings.LastIndex(id, "-")
+	if separator < 0 {
+		return 0, fmt.Errorf("Invalid stream entry ID: %v", id)
+	}
+
+	return strconv.ParseInt(id[separator+1:], 10, 64)
+}
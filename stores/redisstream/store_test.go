@@ -0,0 +1,78 @@
+package redisstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func provider() (eventsourcing.EventStore, func(), error) {
+	address := os.Getenv("REDIS_TEST_HOST")
+	if address == "" {
+		address = "localhost:6379"
+	}
+
+	result, err := NewStore(Endpoint{
+		Address: address,
+		Prefix:  fmt.Sprintf("test-%s:", uuid.NewV4()),
+	})
+
+	return result, func() {
+		if result != nil {
+			result.Close()
+		}
+	}, err
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Redis Streams Store", provider)
+}
+
+// TestDecodeEntry checks entries are read back with their data and metadata
+func TestDecodeEntry(t *testing.T) {
+	event, errDecode := decodeEntry("a", streamEntry{
+		id: "0-2",
+		fields: map[string]string{
+			"type":     "IncrementEvent",
+			"data":     `{"increment_by":3}`,
+			"metadata": `{"commit_id":"x"}`,
+		},
+	})
+	assert.Nil(t, errDecode)
+	assert.Equal(t, int64(2), event.Sequence)
+	assert.Equal(t, eventsourcing.EventType("IncrementEvent"), event.EventType)
+	assert.Equal(t, json.Number("3"), event.EventData.(map[string]interface{})["increment_by"])
+	assert.Equal(t, map[string]interface{}{"commit_id": "x"}, event.Metadata)
+
+	// Entries without metadata have none
+	event, errDecode = decodeEntry("a", streamEntry{
+		id:     "0-3",
+		fields: map[string]string{"type": "IncrementEvent", "data": `{}`},
+	})
+	assert.Nil(t, errDecode)
+	assert.Nil(t, event.Metadata)
+
+	_, errDecode = decodeEntry("a", streamEntry{
+		id:     "0-4",
+		fields: map[string]string{"type": "IncrementEvent", "data": `{}`, "metadata": "not json"},
+	})
+	assert.NotNil(t, errDecode)
+}
+
+// BenchmarkIndividualCommmits tests how fast we can apply events to an aggregate
+func BenchmarkIndividualCommmits(b *testing.B) {
+	test.MeasureIndividualCommits(b, provider)
+}
+
+// BenchmarkBulkInsertAndLoad tests how fast we can write
+// and then load/refresh 1000 events from an aggregate
+func BenchmarkBulkInsertAndLoad(b *testing.B) {
+	test.MeasureBulkInsertAndReload(b, provider)
+}
@@ -0,0 +1,277 @@
+/*
+Package tenancy contains event store wrappers for multi-tenant applications, which
+take the tenant from the aggregate key and keep each tenant's streams apart:
+
+	// Tenants share a store, with their tenant as a prefix of every stored key
+	store := tenancy.NewSharedStore(inner, tenancy.Options{})
+
+	// Tenants each have their own store (i.e. a database or table per tenant)
+	store := tenancy.NewDedicatedStore(func(tenant string) (eventsourcing.EventStore, error) {
+		return mongo.NewStore(mongo.Endpoint{
+			DialURL:        "localhost",
+			DatabaseName:   "events_" + tenant,
+			CollectionName: "events",
+		})
+	}, tenancy.Options{})
+
+	agg.Initialize("acme/order-1", registry, store)
+
+Keys without a tenant are rejected, so a stream can't be written outside of a
+tenant by mistake. Dedicated stores are created the first time a tenant is used,
+and store the key without its tenant. Faults report the key as the aggregate knows
+it, including the tenant.
+*/
+package tenancy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// DefaultSeparator separates the tenant from the rest of an aggregate key, if no
+// other resolver is specified.
+const DefaultSeparator = "/"
+
+// Resolver splits an aggregate key into a tenant, and the key within the tenant.
+type Resolver func(key string) (tenant string, tenantKey string, err error)
+
+// SplitPrefix gets a resolver for keys of the form tenant<separator>key.
+func SplitPrefix(separator string) Resolver {
+	return func(key string) (string, string, error) {
+		parts := strings.SplitN(key, separator, 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return "", "", fmt.Errorf("tenancy: key %v does not have a tenant (expected tenant%vkey)", key, separator)
+		}
+		return parts[0], parts[1], nil
+	}
+}
+
+// StoreFactory creates the store for a tenant.
+type StoreFactory func(tenant string) (eventsourcing.EventStore, error)
+
+// Options configures a tenancy wrapper.
+type Options struct {
+	Resolver Resolver                   // Splits keys into tenants, defaults to SplitPrefix(DefaultSeparator)
+	Prefix   func(tenant string) string // Prefix of keys in a shared store, defaults to the tenant and DefaultSeparator
+}
+
+// route finds the store and storage key for a tenant's key
+type route func(tenant string, tenantKey string) (eventsourcing.EventStore, string, error)
+
+// tenantStore routes aggregates to stores by tenant.
+type tenantStore struct {
+	resolve Resolver
+	route   route
+	ping    func(ctx context.Context) error
+	close   func() error
+}
+
+// NewSharedStore creates a store in which all tenants share the inner store, and
+// keys are stored with a prefix for their tenant.
+func NewSharedStore(inner eventsourcing.EventStore, options Options) eventsourcing.EventStore {
+	options = defaults(options)
+	return &tenantStore{
+		resolve: options.Resolver,
+		route: func(tenant string, tenantKey string) (eventsourcing.EventStore, string, error) {
+			return inner, options.Prefix(tenant) + tenantKey, nil
+		},
+		ping: func(ctx context.Context) error {
+			return eventsourcing.Ping(ctx, inner)
+		},
+		close: inner.Close,
+	}
+}
+
+// NewDedicatedStore creates a store in which each tenant has a store of its own,
+// created by the factory when the tenant is first used.
+func NewDedicatedStore(factory StoreFactory, options Options) eventsourcing.EventStore {
+	options = defaults(options)
+	lock := sync.Mutex{}
+	stores := make(map[string]eventsourcing.EventStore)
+
+	return &tenantStore{
+		resolve: options.Resolver,
+		route: func(tenant string, tenantKey string) (eventsourcing.EventStore, string, error) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			store, exists := stores[tenant]
+			if !exists {
+				created, errCreate := factory(tenant)
+				if errCreate != nil {
+					return nil, "", errCreate
+				}
+				store = created
+				stores[tenant] = store
+			}
+
+			return store, tenantKey, nil
+		},
+		ping: func(ctx context.Context) error {
+			lock.Lock()
+			created := make([]eventsourcing.EventStore, 0, len(stores))
+			for _, store := range stores {
+				created = append(created, store)
+			}
+			lock.Unlock()
+
+			for _, store := range created {
+				errPing := eventsourcing.Ping(ctx, store)
+				if errPing != nil {
+					return errPing
+				}
+			}
+			return nil
+		},
+		close: func() error {
+			lock.Lock()
+			defer lock.Unlock()
+
+			var errClose error
+			for tenant, store := range stores {
+				errStore := store.Close()
+				if errStore != nil && errClose == nil {
+					errClose = errStore
+				}
+				delete(stores, tenant)
+			}
+			return errClose
+		},
+	}
+}
+
+// defaults fills in any options that aren't specified
+func defaults(options Options) Options {
+	if options.Resolver == nil {
+		options.Resolver = SplitPrefix(DefaultSeparator)
+	}
+	if options.Prefix == nil {
+		options.Prefix = func(tenant string) string {
+			return tenant + DefaultSeparator
+		}
+	}
+	return options
+}
+
+// find resolves the store and storage key for an aggregate key
+func (store *tenantStore) find(key string) (eventsourcing.EventStore, string, error) {
+	tenant, tenantKey, errResolve := store.resolve(key)
+	if errResolve != nil {
+		return nil, "", errResolve
+	}
+
+	return store.route(tenant, tenantKey)
+}
+
+// CommitEvents writes events to the tenant's store.
+func (store *tenantStore) CommitEvents(writer eventsourcing.StoreWriterAdapter) error {
+	target, storageKey, errFind := store.find(writer.GetKey())
+	if errFind != nil {
+		return errFind
+	}
+
+	errCommit := target.CommitEvents(&writerAdapter{
+		StoreWriterAdapter: writer,
+		key:                storageKey,
+	})
+	return rekey(errCommit, writer.GetKey())
+}
+
+// Refresh reads events from the tenant's store.
+func (store *tenantStore) Refresh(loader eventsourcing.StoreLoaderAdapter) error {
+	target, storageKey, errFind := store.find(loader.GetKey())
+	if errFind != nil {
+		return errFind
+	}
+
+	errRefresh := target.Refresh(&loaderAdapter{
+		StoreLoaderAdapter: loader,
+		key:                storageKey,
+	})
+	return rekey(errRefresh, loader.GetKey())
+}
+
+// Compact compacts a stream in the tenant's store.
+func (store *tenantStore) Compact(key string, sequence int64, state interface{}) (int64, error) {
+	target, storageKey, errFind := store.find(key)
+	if errFind != nil {
+		return 0, errFind
+	}
+
+	return eventsourcing.Compact(target, storageKey, sequence, state)
+}
+
+// Ping checks the health of the underlying stores. Dedicated stores are only
+// checked once they have been created.
+func (store *tenantStore) Ping(ctx context.Context) error {
+	return store.ping(ctx)
+}
+
+// Close closes the underlying stores.
+func (store *tenantStore) Close() error {
+	return store.close()
+}
+
+// rekey reports faults against the key the aggregate knows.
+func rekey(err error, key string) error {
+	isConcurrency, concurrency := eventsourcing.IsConcurrencyFault(err)
+	if isConcurrency {
+		return eventsourcing.NewConcurrencyFault(key, concurrency.EventSequence)
+	}
+
+	return err
+}
+
+// writerAdapter presents the storage key to the underlying store.
+type writerAdapter struct {
+	eventsourcing.StoreWriterAdapter
+	key string
+}
+
+// GetKey gets the storage key
+func (adapter *writerAdapter) GetKey() string {
+	return adapter.key
+}
+
+// GetEventMetadata gets the metadata of the aggregate, if it has any
+func (adapter *writerAdapter) GetEventMetadata() map[string]interface{} {
+	metadata, ok := adapter.StoreWriterAdapter.(eventsourcing.MetadataAdapter)
+	if !ok {
+		return nil
+	}
+	return metadata.GetEventMetadata()
+}
+
+// RebuildingSnapshot returns true if the aggregate is rebuilding its snapshot
+func (adapter *writerAdapter) RebuildingSnapshot() bool {
+	return eventsourcing.IsRebuildingSnapshot(adapter.StoreWriterAdapter)
+}
+
+// loaderAdapter presents the storage key to the underlying store.
+type loaderAdapter struct {
+	eventsourcing.StoreLoaderAdapter
+	key string
+}
+
+// GetKey gets the storage key
+func (adapter *loaderAdapter) GetKey() string {
+	return adapter.key
+}
+
+// AdvanceSequence moves the aggregate forward, if it supports it
+func (adapter *loaderAdapter) AdvanceSequence(sequence int64) error {
+	advancer, ok := adapter.StoreLoaderAdapter.(eventsourcing.SequenceAdvancer)
+	if !ok {
+		return fmt.Errorf("StoreError: Aggregate %v does not support skipping to sequence %v", adapter.StoreLoaderAdapter.GetKey(), sequence)
+	}
+	return advancer.AdvanceSequence(sequence)
+}
+
+// RebuildingSnapshot returns true if the aggregate is rebuilding its snapshot
+func (adapter *loaderAdapter) RebuildingSnapshot() bool {
+	return eventsourcing.IsRebuildingSnapshot(adapter.StoreLoaderAdapter)
+}
@@ -0,0 +1,135 @@
+package tenancy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func sharedProvider() (eventsourcing.EventStore, func(), error) {
+	store := NewSharedStore(memory.NewStore(), Options{
+		Resolver: func(key string) (string, string, error) {
+			return "suite", key, nil
+		},
+	})
+	return store, func() {
+		store.Close()
+	}, nil
+}
+
+func dedicatedProvider() (eventsourcing.EventStore, func(), error) {
+	store := NewDedicatedStore(func(tenant string) (eventsourcing.EventStore, error) {
+		return memory.NewStore(), nil
+	}, Options{
+		Resolver: func(key string) (string, string, error) {
+			return "suite", key, nil
+		},
+	})
+	return store, func() {
+		store.Close()
+	}, nil
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Tenancy (Shared)", sharedProvider)
+	test.CheckStandardSuite(t, "Tenancy (Dedicated)", dedicatedProvider)
+}
+
+// commit writes an increment to an aggregate
+func commit(store eventsourcing.EventStore, key string, by int) error {
+	agg := test.SimpleAggregate{}
+	agg.Initialize(key, test.GetTestRegistry(), store)
+	errRefresh := agg.Refresh()
+	if errRefresh != nil {
+		return errRefresh
+	}
+	agg.ApplyEvent(test.IncrementEvent{IncrementBy: by})
+	return agg.Commit()
+}
+
+// load reads the count of an aggregate
+func load(store eventsourcing.EventStore, key string) (int, error) {
+	agg := test.SimpleAggregate{}
+	agg.Initialize(key, test.GetTestRegistry(), store)
+	errRefresh := agg.Refresh()
+	return agg.CurrentCount, errRefresh
+}
+
+// TestSharedStore checks tenants are kept apart by prefix in a shared store.
+func TestSharedStore(t *testing.T) {
+	inner := memory.NewStore()
+	store := NewSharedStore(inner, Options{
+		Prefix: func(tenant string) string {
+			return "tenant-" + tenant + ":"
+		},
+	})
+
+	assert.Nil(t, commit(store, "acme/order", 1))
+	assert.Nil(t, commit(store, "globex/order", 2))
+
+	acme, _ := load(store, "acme/order")
+	assert.Equal(t, 1, acme)
+	globex, _ := load(store, "globex/order")
+	assert.Equal(t, 2, globex)
+
+	// The inner store sees the prefixed keys
+	stored, _ := load(inner, "tenant-acme:order")
+	assert.Equal(t, 1, stored)
+
+	// Keys without a tenant are rejected
+	assert.NotNil(t, commit(store, "order", 1))
+	_, errLoad := load(store, "/order")
+	assert.NotNil(t, errLoad)
+}
+
+// TestDedicatedStore checks each tenant gets a store of its own.
+func TestDedicatedStore(t *testing.T) {
+	stores := make(map[string]eventsourcing.EventStore)
+	store := NewDedicatedStore(func(tenant string) (eventsourcing.EventStore, error) {
+		if tenant == "broken" {
+			return nil, fmt.Errorf("no database for %v", tenant)
+		}
+		stores[tenant] = memory.NewStore()
+		return stores[tenant], nil
+	}, Options{
+		Resolver: SplitPrefix(":"),
+	})
+
+	assert.Nil(t, commit(store, "acme:order", 1))
+	assert.Nil(t, commit(store, "acme:order", 1))
+	assert.Nil(t, commit(store, "globex:order", 5))
+	assert.Equal(t, 2, len(stores))
+
+	stored, _ := load(stores["acme"], "order")
+	assert.Equal(t, 2, stored)
+	stored, _ = load(stores["globex"], "order")
+	assert.Equal(t, 5, stored)
+
+	assert.NotNil(t, commit(store, "broken:order", 1))
+	assert.Nil(t, store.Close())
+}
+
+// TestConcurrencyFaultKey checks faults report the key the aggregate uses.
+func TestConcurrencyFaultKey(t *testing.T) {
+	store := NewDedicatedStore(func(tenant string) (eventsourcing.EventStore, error) {
+		return memory.NewStore(), nil
+	}, Options{})
+
+	first := test.SimpleAggregate{}
+	first.Initialize("acme/order", test.GetTestRegistry(), store)
+	second := test.SimpleAggregate{}
+	second.Initialize("acme/order", test.GetTestRegistry(), store)
+
+	first.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, first.Commit())
+	second.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+
+	isFault, fault := eventsourcing.IsConcurrencyFault(second.Commit())
+	assert.True(t, isFault)
+	assert.Equal(t, "acme/order", fault.AggregateKey)
+}
@@ -0,0 +1,219 @@
+/*
+Package tiered composes a fast local store (i.e. memory or Redis) with the remote
+store that is the authority for events, so that aggregates are read mostly from the
+fast tier:
+
+	store := tiered.NewStore(memory.NewStore(), remote, tiered.Options{})
+
+Committed events never change, so the fast tier holds a prefix of each stream that
+is always valid. Refreshes read that prefix from the fast tier, and then only the
+events that follow it from the remote store, which are written back into the fast
+tier for next time. Commits are written to the remote store first and then through
+to the fast tier, so the fast tier only ever holds events the remote store has
+accepted.
+
+Failures to write to the fast tier never fail a refresh or commit: the stream is
+simply read from the remote store until the fast tier catches up. Snapshots
+restored from the remote store are not copied, so snapshot middleware should wrap
+the tiered store rather than the remote store.
+*/
+package tiered
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// Options configures a tiered store.
+type Options struct {
+	OnError func(key string, err error) // Called when the fast tier can't be written, logged by default
+	Logger  eventsourcing.Logger        // Logger for the default OnError, eventsourcing.DefaultLogger() by default
+}
+
+// store is a tiered store
+type store struct {
+	fast    eventsourcing.EventStore
+	remote  eventsourcing.EventStore
+	options Options
+}
+
+// NewStore creates a store that reads through a fast tier to a remote store.
+func NewStore(fast eventsourcing.EventStore, remote eventsourcing.EventStore, options Options) eventsourcing.EventStore {
+	if options.Logger == nil {
+		options.Logger = eventsourcing.DefaultLogger()
+	}
+	if options.OnError == nil {
+		logger := options.Logger
+		options.OnError = func(key string, err error) {
+			logger.Warn("tiered_fill_error", eventsourcing.LogFields{
+				"key":   key,
+				"error": err,
+			})
+		}
+	}
+
+	return &store{
+		fast:    fast,
+		remote:  remote,
+		options: options,
+	}
+}
+
+// CommitEvents writes events to the remote store, and then through to the fast tier.
+func (tiers *store) CommitEvents(writer eventsourcing.StoreWriterAdapter) error {
+	errRemote := tiers.remote.CommitEvents(writer)
+	if errRemote != nil {
+		return errRemote
+	}
+
+	if eventsourcing.IsNoOp(writer) {
+		return nil
+	}
+
+	errFast := tiers.fast.CommitEvents(writer)
+	if errFast != nil {
+		tiers.options.OnError(writer.GetKey(), errFast)
+	}
+	return nil
+}
+
+// Refresh reads the events held by the fast tier, and then the remainder from the
+// remote store, filling the fast tier with them.
+func (tiers *store) Refresh(loader eventsourcing.StoreLoaderAdapter) error {
+	errFast := tiers.fast.Refresh(loader)
+	if errFast != nil {
+		return errFast
+	}
+
+	recorder := &recordingLoader{
+		StoreLoaderAdapter: loader,
+		from:               loader.SequenceNumber(),
+		events:             make([]eventsourcing.Event, 0),
+	}
+	errRemote := tiers.remote.Refresh(recorder)
+	if errRemote != nil {
+		return errRemote
+	}
+
+	// Streams with gaps, or restored from a snapshot, can't be copied event by event
+	if len(recorder.events) == 0 || recorder.skipped {
+		return nil
+	}
+
+	errFill := tiers.fast.CommitEvents(&fillWriter{
+		key:      loader.GetKey(),
+		registry: loader.GetEventRegistry(),
+		sequence: recorder.from,
+		events:   recorder.events,
+	})
+	if errFill != nil {
+		tiers.options.OnError(loader.GetKey(), errFill)
+	}
+	return nil
+}
+
+// Version gets the version of an aggregate from the remote store.
+func (tiers *store) Version(key string) (int64, error) {
+	return eventsourcing.Version(tiers.remote, key)
+}
+
+// Ping checks the health of the remote store. Like any other failure of the fast
+// tier, a failed health check of the fast tier is reported but not returned.
+func (tiers *store) Ping(ctx context.Context) error {
+	errRemote := eventsourcing.Ping(ctx, tiers.remote)
+	if errRemote != nil {
+		return errRemote
+	}
+
+	errFast := eventsourcing.Ping(ctx, tiers.fast)
+	if errFast != nil {
+		tiers.options.OnError("", errFast)
+	}
+	return nil
+}
+
+// Close closes both tiers.
+func (tiers *store) Close() error {
+	errFast := tiers.fast.Close()
+	errRemote := tiers.remote.Close()
+	if errRemote != nil {
+		return errRemote
+	}
+	return errFast
+}
+
+// recordingLoader records the events read from the remote store, as they are
+// replayed onto the aggregate.
+type recordingLoader struct {
+	eventsourcing.StoreLoaderAdapter
+	from    int64                 // Sequence the remote store read from
+	events  []eventsourcing.Event // Events replayed from the remote store
+	skipped bool                  // Set if the stream skipped ahead
+}
+
+// ReplayEvent records and replays an event
+func (loader *recordingLoader) ReplayEvent(event eventsourcing.Event) {
+	loader.events = append(loader.events, event)
+	loader.StoreLoaderAdapter.ReplayEvent(event)
+}
+
+// RestoreSnapshot restores a snapshot, which can't be copied to the fast tier
+func (loader *recordingLoader) RestoreSnapshot(sequence int64, snapshot interface{}) error {
+	loader.skipped = true
+	return loader.StoreLoaderAdapter.RestoreSnapshot(sequence, snapshot)
+}
+
+// AdvanceSequence moves the aggregate forward, if it supports it
+func (loader *recordingLoader) AdvanceSequence(sequence int64) error {
+	loader.skipped = true
+	advancer, ok := loader.StoreLoaderAdapter.(eventsourcing.SequenceAdvancer)
+	if !ok {
+		return fmt.Errorf("StoreError: Aggregate %v does not support skipping to sequence %v", loader.GetKey(), sequence)
+	}
+	return advancer.AdvanceSequence(sequence)
+}
+
+// RebuildingSnapshot returns true if the aggregate is rebuilding its snapshot
+func (loader *recordingLoader) RebuildingSnapshot() bool {
+	return eventsourcing.IsRebuildingSnapshot(loader.StoreLoaderAdapter)
+}
+
+// fillWriter writes events read from the remote store into the fast tier.
+type fillWriter struct {
+	key      string
+	registry eventsourcing.EventRegistry
+	sequence int64
+	events   []eventsourcing.Event
+}
+
+// GetKey gets the key of the aggregate
+func (writer *fillWriter) GetKey() string {
+	return writer.key
+}
+
+// GetEventRegistry gets the event registry of the aggregate
+func (writer *fillWriter) GetEventRegistry() eventsourcing.EventRegistry {
+	return writer.registry
+}
+
+// SequenceNumber gets the sequence after the events
+func (writer *fillWriter) SequenceNumber() int64 {
+	return writer.sequence + int64(len(writer.events))
+}
+
+// IsDirty returns true, as the events are not in the fast tier
+func (writer *fillWriter) IsDirty() bool {
+	return true
+}
+
+// GetUncommittedEvents gets the events to fill
+func (writer *fillWriter) GetUncommittedEvents() (int64, []eventsourcing.Event) {
+	return writer.sequence, writer.events
+}
+
+// GetState returns nil, as the state of the aggregate isn't copied
+func (writer *fillWriter) GetState() interface{} {
+	return nil
+}
@@ -0,0 +1,118 @@
+package tiered
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func provider() (eventsourcing.EventStore, func(), error) {
+	store := NewStore(memory.NewStore(), memory.NewStore(), Options{})
+	return store, func() {
+		store.Close()
+	}, nil
+}
+
+// TestStoreCompliance
+func TestStoreCompliance(t *testing.T) {
+	test.CheckStandardSuite(t, "Tiered Store", provider)
+}
+
+// TestVersion checks versions come from the remote store
+func TestVersion(t *testing.T) {
+	test.CheckVersion(t, provider)
+}
+
+// countingStore counts the events read from a store
+type countingStore struct {
+	eventsourcing.EventStore
+	read int64
+}
+
+func (store *countingStore) Refresh(loader eventsourcing.StoreLoaderAdapter) error {
+	from := loader.SequenceNumber()
+	errRefresh := store.EventStore.Refresh(loader)
+	store.read += loader.SequenceNumber() - from
+	return errRefresh
+}
+
+// rejectingStore is a store that can be set to reject commits
+type rejectingStore struct {
+	eventsourcing.EventStore
+	reject bool
+}
+
+func (store *rejectingStore) CommitEvents(writer eventsourcing.StoreWriterAdapter) error {
+	if store.reject {
+		return errors.New("Fast tier unavailable")
+	}
+	return store.EventStore.CommitEvents(writer)
+}
+
+// increment commits increments to an aggregate through a store
+func increment(t *testing.T, store eventsourcing.EventStore, key string, by ...int) {
+	agg := load(t, store, key)
+	for _, value := range by {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: value})
+	}
+	assert.Nil(t, agg.Commit())
+}
+
+// load refreshes an aggregate from a store
+func load(t *testing.T, store eventsourcing.EventStore, key string) *test.SimpleAggregate {
+	agg := &test.SimpleAggregate{}
+	agg.Initialize(key, test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	return agg
+}
+
+// TestReadThrough checks events read from the remote store fill the fast tier
+func TestReadThrough(t *testing.T) {
+	fast := memory.NewStore()
+	remote := &countingStore{EventStore: memory.NewStore()}
+	increment(t, remote, "read-through", 1, 2, 3)
+	remote.read = 0
+
+	store := NewStore(fast, remote, Options{})
+	assert.Equal(t, 6, load(t, store, "read-through").CurrentCount)
+	assert.Equal(t, int64(3), remote.read)
+	assert.Equal(t, 6, load(t, fast, "read-through").CurrentCount, "The fast tier should be filled")
+
+	// Later reads only take new events from the remote store
+	increment(t, remote, "read-through", 4)
+	remote.read = 0
+	agg := load(t, store, "read-through")
+	assert.Equal(t, 10, agg.CurrentCount)
+	assert.Equal(t, int64(4), agg.SequenceNumber())
+	assert.Equal(t, int64(1), remote.read)
+}
+
+// TestWriteThrough checks commits reach both tiers, and a fast tier that missed a
+// commit catches up on the next refresh
+func TestWriteThrough(t *testing.T) {
+	fast := &rejectingStore{EventStore: memory.NewStore()}
+	remote := memory.NewStore()
+	failed := make([]string, 0)
+	store := NewStore(fast, remote, Options{
+		OnError: func(key string, err error) { failed = append(failed, key) },
+	})
+
+	increment(t, store, "written", 1, 2)
+	assert.Equal(t, 3, load(t, fast, "written").CurrentCount)
+	assert.Equal(t, 3, load(t, remote, "written").CurrentCount)
+	assert.Empty(t, failed)
+
+	// Commits succeed when the fast tier can't be written
+	fast.reject = true
+	increment(t, store, "missed", 1, 2)
+	assert.Equal(t, []string{"missed"}, failed)
+	assert.Equal(t, 0, load(t, fast, "missed").CurrentCount)
+
+	fast.reject = false
+	assert.Equal(t, 3, load(t, store, "missed").CurrentCount)
+	assert.Equal(t, 3, load(t, fast, "missed").CurrentCount, "The fast tier should catch up")
+}
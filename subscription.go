@@ -0,0 +1,70 @@
+package eventsourcing
+
+// Subscriber is implemented by event handlers that handle only some event types.
+// Consumers use the subscriptions to avoid decoding and dispatching events that
+// no handler is interested in. Handlers that don't implement it receive every
+// event.
+type Subscriber interface {
+	// Subscriptions gets the event types the handler handles, or nil if it
+	// handles every type (i.e. a wrapper of a handler without subscriptions).
+	Subscriptions() []EventType
+}
+
+// SubscriptionsFor gets the event types a handler subscribes to, and false if the
+// handler receives every event.
+func SubscriptionsFor(handler EventHandler) ([]EventType, bool) {
+	subscriber, ok := handler.(Subscriber)
+	if !ok {
+		return nil, false
+	}
+
+	types := subscriber.Subscriptions()
+	return types, types != nil
+}
+
+// SubscriptionFilter decides which of a consumer's handlers should receive each
+// event type, built from the subscriptions of the handlers.
+type SubscriptionFilter struct {
+	handlers []map[EventType]bool // Types of each handler, nil for every type
+	wanted   map[EventType]bool   // Types wanted by any handler, nil for every type
+}
+
+// NewSubscriptionFilter creates a filter for a set of handlers. Handlers must be
+// initialized before the filter is created, as their subscriptions are read once.
+func NewSubscriptionFilter(handlers []EventHandler) SubscriptionFilter {
+	filter := SubscriptionFilter{
+		handlers: make([]map[EventType]bool, len(handlers)),
+		wanted:   make(map[EventType]bool),
+	}
+
+	for index, handler := range handlers {
+		types, subscribed := SubscriptionsFor(handler)
+		if !subscribed {
+			filter.wanted = nil
+			continue
+		}
+
+		filter.handlers[index] = make(map[EventType]bool)
+		for _, eventType := range types {
+			filter.handlers[index][eventType] = true
+			if filter.wanted != nil {
+				filter.wanted[eventType] = true
+			}
+		}
+	}
+
+	return filter
+}
+
+// Wanted returns true if any handler should receive events of a type.
+func (filter SubscriptionFilter) Wanted(eventType EventType) bool {
+	return filter.wanted == nil || filter.wanted[eventType]
+}
+
+// Handles returns true if the handler at an index should receive events of a type.
+func (filter SubscriptionFilter) Handles(index int, eventType EventType) bool {
+	if index >= len(filter.handlers) || filter.handlers[index] == nil {
+		return true
+	}
+	return filter.handlers[index][eventType]
+}
@@ -0,0 +1,59 @@
+package eventsourcing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// incrementHandler handles only increment events
+type incrementHandler struct {
+	EventHandlerBase
+	total int
+}
+
+// HandleIncrementEvent adds to the total
+func (handler *incrementHandler) HandleIncrementEvent(key string, seq int64, event IncrementEvent) error {
+	handler.total += event.IncrementBy
+	return nil
+}
+
+// TestHandlerBaseSubscriptions checks the handled event types are reported
+func TestHandlerBaseSubscriptions(t *testing.T) {
+	handler := &incrementHandler{}
+	handler.Initialize(counterRegistry, handler)
+
+	types, subscribed := SubscriptionsFor(handler)
+	assert.True(t, subscribed)
+	assert.Equal(t, []EventType{"IncrementEvent"}, types)
+
+	// Wrappers pass on the subscriptions of the handler, if it has any
+	types, subscribed = SubscriptionsFor(ReportingHandler(handler, NoOpReporter{}))
+	assert.True(t, subscribed)
+	assert.Equal(t, []EventType{"IncrementEvent"}, types)
+
+	_, subscribed = SubscriptionsFor(ReportingHandler(handlerFunc(nil), NoOpReporter{}))
+	assert.False(t, subscribed, "Wrapped handlers without subscriptions receive every event")
+}
+
+// TestSubscriptionFilter checks events are routed to subscribed handlers
+func TestSubscriptionFilter(t *testing.T) {
+	subscribed := &incrementHandler{}
+	subscribed.Initialize(counterRegistry, subscribed)
+
+	filter := NewSubscriptionFilter([]EventHandler{subscribed})
+	assert.True(t, filter.Wanted("IncrementEvent"))
+	assert.False(t, filter.Wanted("InitializeEvent"))
+	assert.True(t, filter.Handles(0, "IncrementEvent"))
+	assert.False(t, filter.Handles(0, "InitializeEvent"))
+
+	// Handlers without subscriptions want every event
+	filter = NewSubscriptionFilter([]EventHandler{subscribed, handlerFunc(nil)})
+	assert.True(t, filter.Wanted("InitializeEvent"))
+	assert.False(t, filter.Handles(0, "InitializeEvent"))
+	assert.True(t, filter.Handles(1, "InitializeEvent"))
+
+	// An empty filter passes everything through
+	assert.True(t, SubscriptionFilter{}.Wanted("InitializeEvent"))
+	assert.True(t, SubscriptionFilter{}.Handles(0, "InitializeEvent"))
+}
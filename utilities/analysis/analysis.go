@@ -0,0 +1,345 @@
+/*
+Package analysis reports how storage is distributed across an event store, so
+that compaction, archiving and snapshot intervals can be planned with real data
+rather than guesses:
+
+	report, errAnalyze := analysis.Analyze(store.(eventsourcing.GlobalReader), analysis.Options{
+		Snapshots: analysis.SnapshotList(snapshots),
+	})
+	report.WriteText(os.Stdout)
+
+The global feed is read to the end, and events are counted and measured (by the
+size of their JSON body) per group of streams and per event type. Streams are
+grouped by the prefix of their key by default ("order" for "order-123"), or by
+their category (see AggregateBase.UseCategory) using ByCategory. If the
+snapshots held are listed, the report also includes snapshots whose stream no
+longer exists, and streams that have gone more than a threshold of events without
+a snapshot. Snapshot stores can't list their snapshots, so they must be listed by
+the caller (i.e. from the snapshot collection or bucket).
+*/
+package analysis
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// DefaultBatchSize is the number of events read from the feed at a time, if no
+// other size is specified.
+const DefaultBatchSize = 1000
+
+// DefaultSnapshotThreshold is the number of events after the latest snapshot at
+// which a stream is reported, if no other threshold is specified.
+const DefaultSnapshotThreshold = 100
+
+// DefaultSeparator is the separator of the key prefix that streams are grouped
+// by, if no other grouping is specified.
+const DefaultSeparator = "-"
+
+// DefaultMaxKeys is the number of streams and snapshots listed in each part of the
+// report, if no other limit is specified.
+const DefaultMaxKeys = 100
+
+// Uncategorized is the group of streams without a category or key prefix.
+const Uncategorized = "(uncategorized)"
+
+// Snapshot describes a stored snapshot.
+type Snapshot struct {
+	Key      string `json:"key"`      // Key of the aggregate
+	Sequence int64  `json:"sequence"` // Sequence the snapshot was taken at
+	Bytes    int64  `json:"bytes"`    // Size of the stored snapshot
+}
+
+// SnapshotLister lists stored snapshots, visiting each in turn. Returning an
+// error from the visit stops the listing, and should be returned.
+type SnapshotLister func(visit func(snapshot Snapshot) error) error
+
+// SnapshotList is a SnapshotLister of a fixed list of snapshots.
+func SnapshotList(snapshots []Snapshot) SnapshotLister {
+	return func(visit func(snapshot Snapshot) error) error {
+		for _, snapshot := range snapshots {
+			errVisit := visit(snapshot)
+			if errVisit != nil {
+				return errVisit
+			}
+		}
+		return nil
+	}
+}
+
+// Grouper gets the group that the stream of an event is reported in. Streams are
+// grouped by their first event.
+type Grouper func(event eventsourcing.GlobalEvent) string
+
+// ByKeyPrefix groups streams by their key up to the first separator, i.e. "order"
+// for "order-123".
+func ByKeyPrefix(separator string) Grouper {
+	return func(event eventsourcing.GlobalEvent) string {
+		index := strings.Index(event.Key, separator)
+		if index < 0 {
+			return Uncategorized
+		}
+		return event.Key[:index]
+	}
+}
+
+// ByCategory groups streams by their category (see AggregateBase.UseCategory).
+// Events in the global feed don't carry their category, so the feed of each
+// category is read up front to find the streams in it.
+func ByCategory(reader eventsourcing.CategoryReader, categories ...string) (Grouper, error) {
+	keys := make(map[string]string)
+	for _, category := range categories {
+		position := ""
+		for {
+			events, errRead := reader.ReadCategory(category, position, DefaultBatchSize)
+			if errRead != nil {
+				return nil, errRead
+			}
+
+			for _, event := range events {
+				position = event.Position
+				keys[event.Key] = category
+			}
+
+			if len(events) < DefaultBatchSize {
+				break
+			}
+		}
+	}
+
+	return func(event eventsourcing.GlobalEvent) string {
+		category, found := keys[event.Key]
+		if !found {
+			return Uncategorized
+		}
+		return category
+	}, nil
+}
+
+// Options configures an analysis.
+type Options struct {
+	Group             Grouper        // Groups streams, by key prefix if not set
+	Snapshots         SnapshotLister // Lists the stored snapshots, if known
+	SnapshotThreshold int64          // Events after the latest snapshot at which a stream is reported
+	BatchSize         int            // Events read from the feed at a time
+	MaxKeys           int            // Streams and snapshots listed in each part of the report
+}
+
+// TypeUsage is the storage used by an event type.
+type TypeUsage struct {
+	Events int64 `json:"events"` // Events of the type
+	Bytes  int64 `json:"bytes"`  // Size of the event bodies
+}
+
+// GroupUsage is the storage used by a group of streams.
+type GroupUsage struct {
+	Streams       int64                                  `json:"streams"`        // Streams in the group
+	Events        int64                                  `json:"events"`         // Events across the streams
+	Bytes         int64                                  `json:"bytes"`          // Size of the event bodies
+	LongestStream int64                                  `json:"longest_stream"` // Most events in a single stream
+	Snapshots     int64                                  `json:"snapshots"`      // Snapshots of streams in the group
+	SnapshotBytes int64                                  `json:"snapshot_bytes"` // Size of the snapshots
+	Types         map[eventsourcing.EventType]*TypeUsage `json:"types"`          // Storage used by each event type
+}
+
+// Stream describes a stream that has gone too long without a snapshot.
+type Stream struct {
+	Key      string `json:"key"`      // Key of the aggregate
+	Group    string `json:"group"`    // Group the stream is reported in
+	Sequence int64  `json:"sequence"` // Sequence of the latest event
+	Snapshot int64  `json:"snapshot"` // Sequence of the latest snapshot, zero if none
+}
+
+// Unsnapshotted gets the number of events after the latest snapshot.
+func (stream Stream) Unsnapshotted() int64 {
+	return stream.Sequence - stream.Snapshot
+}
+
+// Report is the result of an analysis.
+type Report struct {
+	Streams            int64                  `json:"streams"`             // Streams in the store
+	Events             int64                  `json:"events"`              // Events in the store
+	Bytes              int64                  `json:"bytes"`               // Size of the event bodies
+	Snapshots          int64                  `json:"snapshots"`           // Snapshots listed
+	SnapshotBytes      int64                  `json:"snapshot_bytes"`      // Size of the snapshots listed
+	Groups             map[string]*GroupUsage `json:"groups"`              // Storage used by each group
+	Orphaned           []Snapshot             `json:"orphaned"`            // Snapshots without a stream, up to the limit
+	OrphanedCount      int                    `json:"orphaned_count"`      // Snapshots without a stream
+	Unsnapshotted      []Stream               `json:"unsnapshotted"`       // Streams beyond the snapshot threshold, longest first, up to the limit
+	UnsnapshottedCount int                    `json:"unsnapshotted_count"` // Streams beyond the snapshot threshold
+}
+
+// streamUsage tracks a stream while the feed is read
+type streamUsage struct {
+	group    string
+	events   int64
+	sequence int64
+	snapshot int64
+}
+
+// Analyze reads the global feed of a store, and reports the storage it uses.
+func Analyze(reader eventsourcing.GlobalReader, options Options) (Report, error) {
+	options = defaults(options)
+	report := Report{
+		Groups:        make(map[string]*GroupUsage),
+		Orphaned:      make([]Snapshot, 0),
+		Unsnapshotted: make([]Stream, 0),
+	}
+	streams := make(map[string]*streamUsage)
+
+	position := ""
+	for {
+		events, errRead := reader.ReadAll(position, options.BatchSize)
+		if errRead != nil {
+			return Report{}, errRead
+		}
+
+		for _, event := range events {
+			position = event.Position
+			report.add(streams, event, options.Group)
+		}
+
+		if len(events) < options.BatchSize {
+			break
+		}
+	}
+
+	if options.Snapshots != nil {
+		errList := options.Snapshots(func(snapshot Snapshot) error {
+			report.addSnapshot(streams, snapshot, options.MaxKeys)
+			return nil
+		})
+		if errList != nil {
+			return Report{}, errList
+		}
+	}
+
+	report.findUnsnapshotted(streams, options.SnapshotThreshold, options.MaxKeys)
+	return report, nil
+}
+
+// defaults applies the default options
+func defaults(options Options) Options {
+	if options.Group == nil {
+		options.Group = ByKeyPrefix(DefaultSeparator)
+	}
+	if options.SnapshotThreshold <= 0 {
+		options.SnapshotThreshold = DefaultSnapshotThreshold
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBatchSize
+	}
+	if options.MaxKeys <= 0 {
+		options.MaxKeys = DefaultMaxKeys
+	}
+	return options
+}
+
+// add counts an event against its stream, group and type
+func (report *Report) add(streams map[string]*streamUsage, event eventsourcing.GlobalEvent, group Grouper) {
+	stream, exists := streams[event.Key]
+	if !exists {
+		stream = &streamUsage{group: group(event)}
+		streams[event.Key] = stream
+		report.Streams++
+		report.group(stream.group).Streams++
+	}
+
+	size := measure(event.Data)
+	stream.events++
+	if event.Sequence > stream.sequence {
+		stream.sequence = event.Sequence
+	}
+
+	usage := report.group(stream.group)
+	usage.Events++
+	usage.Bytes += size
+	if stream.events > usage.LongestStream {
+		usage.LongestStream = stream.events
+	}
+
+	typeUsage, found := usage.Types[event.Type]
+	if !found {
+		typeUsage = &TypeUsage{}
+		usage.Types[event.Type] = typeUsage
+	}
+	typeUsage.Events++
+	typeUsage.Bytes += size
+
+	report.Events++
+	report.Bytes += size
+}
+
+// addSnapshot counts a snapshot against its stream, or as an orphan if it has none
+func (report *Report) addSnapshot(streams map[string]*streamUsage, snapshot Snapshot, maxKeys int) {
+	report.Snapshots++
+	report.SnapshotBytes += snapshot.Bytes
+
+	stream, exists := streams[snapshot.Key]
+	if !exists {
+		report.OrphanedCount++
+		if len(report.Orphaned) < maxKeys {
+			report.Orphaned = append(report.Orphaned, snapshot)
+		}
+		return
+	}
+
+	if snapshot.Sequence > stream.snapshot {
+		stream.snapshot = snapshot.Sequence
+	}
+	usage := report.group(stream.group)
+	usage.Snapshots++
+	usage.SnapshotBytes += snapshot.Bytes
+}
+
+// findUnsnapshotted lists the streams beyond the snapshot threshold, longest first
+func (report *Report) findUnsnapshotted(streams map[string]*streamUsage, threshold int64, maxKeys int) {
+	for key, stream := range streams {
+		if stream.sequence-stream.snapshot <= threshold {
+			continue
+		}
+		report.Unsnapshotted = append(report.Unsnapshotted, Stream{
+			Key:      key,
+			Group:    stream.group,
+			Sequence: stream.sequence,
+			Snapshot: stream.snapshot,
+		})
+	}
+
+	sort.Slice(report.Unsnapshotted, func(i, j int) bool {
+		left, right := report.Unsnapshotted[i], report.Unsnapshotted[j]
+		if left.Unsnapshotted() != right.Unsnapshotted() {
+			return left.Unsnapshotted() > right.Unsnapshotted()
+		}
+		return left.Key < right.Key
+	})
+
+	report.UnsnapshottedCount = len(report.Unsnapshotted)
+	if len(report.Unsnapshotted) > maxKeys {
+		report.Unsnapshotted = report.Unsnapshotted[:maxKeys]
+	}
+}
+
+// group gets the usage of a group, creating it if needed
+func (report *Report) group(name string) *GroupUsage {
+	usage, exists := report.Groups[name]
+	if !exists {
+		usage = &GroupUsage{
+			Types: make(map[eventsourcing.EventType]*TypeUsage),
+		}
+		report.Groups[name] = usage
+	}
+	return usage
+}
+
+// measure gets the size of the JSON body of an event
+func measure(data interface{}) int64 {
+	body, errMarshal := json.Marshal(data)
+	if errMarshal != nil {
+		return 0
+	}
+	return int64(len(body))
+}
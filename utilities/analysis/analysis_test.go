@@ -0,0 +1,106 @@
+package analysis
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// commit writes increments to a stream, in a category
+func commit(t *testing.T, store eventsourcing.EventStore, category string, key string, count int) {
+	agg := &test.SimpleAggregate{}
+	agg.Initialize(key, test.GetTestRegistry(), store)
+	agg.UseCategory(category)
+	assert.Nil(t, agg.Refresh())
+	for index := 0; index < count; index++ {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	}
+	assert.Nil(t, agg.Commit())
+}
+
+// newStore creates a store with streams in two categories
+func newStore(t *testing.T) eventsourcing.EventStore {
+	store := memory.NewStore()
+	commit(t, store, "Counter", "counter-1", 3)
+	commit(t, store, "Counter", "counter-2", 5)
+	commit(t, store, "Order", "order-1", 1)
+	commit(t, store, "", "other", 2)
+	return store
+}
+
+// analyze analyzes a store
+func analyze(store eventsourcing.EventStore, options Options) (Report, error) {
+	return Analyze(store.(eventsourcing.GlobalReader), options)
+}
+
+// TestAnalyzeGroups checks events are counted and measured per group and type
+func TestAnalyzeGroups(t *testing.T) {
+	store := newStore(t)
+	group, errGroup := ByCategory(store.(eventsourcing.CategoryReader), "Counter", "Order")
+	assert.Nil(t, errGroup)
+	report, errAnalyze := analyze(store, Options{BatchSize: 2, Group: group})
+	assert.Nil(t, errAnalyze)
+
+	size := measure(map[string]interface{}{"increment_by": 1})
+	assert.Equal(t, int64(4), report.Streams)
+	assert.Equal(t, int64(11), report.Events)
+	assert.Equal(t, 11*size, report.Bytes)
+	assert.Equal(t, []string{"Counter", Uncategorized, "Order"}, report.GroupNames())
+
+	counters := report.Groups["Counter"]
+	assert.Equal(t, int64(2), counters.Streams)
+	assert.Equal(t, int64(8), counters.Events)
+	assert.Equal(t, int64(5), counters.LongestStream)
+	assert.Equal(t, &TypeUsage{Events: 8, Bytes: 8 * size}, counters.Types["IncrementEvent"])
+	assert.Equal(t, int64(2), report.Groups[Uncategorized].Events)
+}
+
+// TestAnalyzeByKeyPrefix checks streams are grouped by key by default
+func TestAnalyzeByKeyPrefix(t *testing.T) {
+	report, errAnalyze := analyze(newStore(t), Options{})
+	assert.Nil(t, errAnalyze)
+	assert.Equal(t, []string{"counter", Uncategorized, "order"}, report.GroupNames())
+	assert.Equal(t, int64(2), report.Groups["counter"].Streams)
+}
+
+// TestAnalyzeSnapshots checks orphaned snapshots and streams beyond the threshold
+// are reported
+func TestAnalyzeSnapshots(t *testing.T) {
+	report, errAnalyze := analyze(newStore(t), Options{
+		SnapshotThreshold: 2,
+		Snapshots: SnapshotList([]Snapshot{
+			{Key: "counter-1", Sequence: 3, Bytes: 40},
+			{Key: "counter-2", Sequence: 2, Bytes: 40},
+			{Key: "deleted", Sequence: 10, Bytes: 100},
+		}),
+	})
+	assert.Nil(t, errAnalyze)
+
+	assert.Equal(t, int64(3), report.Snapshots)
+	assert.Equal(t, int64(180), report.SnapshotBytes)
+	assert.Equal(t, int64(80), report.Groups["counter"].SnapshotBytes)
+	assert.Equal(t, 1, report.OrphanedCount)
+	assert.Equal(t, []Snapshot{{Key: "deleted", Sequence: 10, Bytes: 100}}, report.Orphaned)
+	assert.Equal(t, 1, report.UnsnapshottedCount)
+	assert.Equal(t, []Stream{{Key: "counter-2", Group: "counter", Sequence: 5, Snapshot: 2}}, report.Unsnapshotted)
+
+	out := &bytes.Buffer{}
+	assert.Nil(t, report.WriteText(out))
+	assert.Contains(t, out.String(), "1 snapshots without a stream")
+	assert.Contains(t, out.String(), "counter-2 (counter, 3 events since sequence 2)")
+}
+
+// TestAnalyzeListError checks listing errors are returned
+func TestAnalyzeListError(t *testing.T) {
+	_, errAnalyze := analyze(newStore(t), Options{
+		Snapshots: func(visit func(snapshot Snapshot) error) error {
+			return errors.New("Bucket unavailable")
+		},
+	})
+	assert.NotNil(t, errAnalyze)
+}
@@ -0,0 +1,82 @@
+package analysis
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// GroupNames gets the names of the groups, largest first.
+func (report Report) GroupNames() []string {
+	names := make([]string, 0, len(report.Groups))
+	for name := range report.Groups {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		left, right := report.Groups[names[i]], report.Groups[names[j]]
+		if left.Bytes+left.SnapshotBytes != right.Bytes+right.SnapshotBytes {
+			return left.Bytes+left.SnapshotBytes > right.Bytes+right.SnapshotBytes
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// WriteText writes the report as tables, for operators.
+func (report Report) WriteText(out io.Writer) error {
+	groups := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(groups, "group\tstreams\tevents\tbytes\tbytes/event\tlongest\tsnapshots\tsnapshot bytes\t")
+	for _, name := range report.GroupNames() {
+		usage := report.Groups[name]
+		fmt.Fprintf(groups, "%v\t%v\t%v\t%v\t%.1f\t%v\t%v\t%v\t\n",
+			name,
+			usage.Streams,
+			usage.Events,
+			usage.Bytes,
+			float64(usage.Bytes)/float64(usage.Events),
+			usage.LongestStream,
+			usage.Snapshots,
+			usage.SnapshotBytes,
+		)
+	}
+	fmt.Fprintf(groups, "total\t%v\t%v\t%v\t\t\t%v\t%v\t\n", report.Streams, report.Events, report.Bytes, report.Snapshots, report.SnapshotBytes)
+	errFlush := groups.Flush()
+	if errFlush != nil {
+		return errFlush
+	}
+
+	fmt.Fprintln(out)
+	types := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(types, "group\ttype\tevents\tbytes\t")
+	for _, name := range report.GroupNames() {
+		usage := report.Groups[name]
+		eventTypes := make([]eventsourcing.EventType, 0, len(usage.Types))
+		for eventType := range usage.Types {
+			eventTypes = append(eventTypes, eventType)
+		}
+		sort.Slice(eventTypes, func(i, j int) bool { return eventTypes[i] < eventTypes[j] })
+		for _, eventType := range eventTypes {
+			typeUsage := usage.Types[eventType]
+			fmt.Fprintf(types, "%v\t%v\t%v\t%v\t\n", name, eventType, typeUsage.Events, typeUsage.Bytes)
+		}
+	}
+	errFlush = types.Flush()
+	if errFlush != nil {
+		return errFlush
+	}
+
+	fmt.Fprintf(out, "\n%v snapshots without a stream\n", report.OrphanedCount)
+	for _, snapshot := range report.Orphaned {
+		fmt.Fprintf(out, "  %v (sequence %v, %v bytes)\n", snapshot.Key, snapshot.Sequence, snapshot.Bytes)
+	}
+
+	fmt.Fprintf(out, "\n%v streams beyond the snapshot threshold\n", report.UnsnapshottedCount)
+	for _, stream := range report.Unsnapshotted {
+		fmt.Fprintf(out, "  %v (%v, %v events since sequence %v)\n", stream.Key, stream.Group, stream.Unsnapshotted(), stream.Snapshot)
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+/*
+Package catalog serves the event and command contract of a service over HTTP, so
+that other teams can discover the events a service raises and the commands it
+accepts at runtime. Each type is described by its fields and an example payload,
+generated from the zero value of the type and its struct tags:
+
+	docs := catalog.New()
+	docs.AddEvents(eventRegistry)
+	docs.AddCommands(commandRegistry)
+	router.GET("/catalog", docs.Handler())
+
+Fields are named by their json tags. An example tag overrides the example value of
+a field (JSON values are decoded, anything else is used as a string), a doc tag
+describes the field and a validate tag is reported as-is. Registries must implement
+eventsourcing.EventCatalog or eventsourcing.CommandCatalog to be listed, as the
+standard registries do.
+*/
+package catalog
+
+import (
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// Document is the catalog served to clients.
+type Document struct {
+	Domains []Domain `json:"domains"` // Domains, in name order
+}
+
+// Domain describes the events and commands of a domain.
+type Domain struct {
+	Name     string  `json:"name"`     // Name of the domain
+	Events   []Entry `json:"events"`   // Events, in name order
+	Commands []Entry `json:"commands"` // Commands, in name order
+}
+
+// Entry describes an event or command type.
+type Entry struct {
+	Type        string      `json:"type"`                  // Event or command type
+	Deprecated  bool        `json:"deprecated,omitempty"`  // Set if the event type is deprecated
+	Replacement string      `json:"replacement,omitempty"` // Event type replacing a deprecated event type
+	Fields      []Field     `json:"fields"`                // Fields of the payload
+	Example     interface{} `json:"example"`               // Example payload
+}
+
+// Field describes a field of a payload.
+type Field struct {
+	Name        string `json:"name"`                  // Name of the field, from its json tag
+	Type        string `json:"type"`                  // JSON type (string, integer, number, boolean, array, object)
+	Optional    bool   `json:"optional,omitempty"`    // Set if the field is omitted when empty
+	Validate    string `json:"validate,omitempty"`    // Validation rules, from the validate tag
+	Description string `json:"description,omitempty"` // Description, from the doc tag
+}
+
+// Catalog collects the registries to describe.
+type Catalog struct {
+	events   []eventsourcing.EventRegistry
+	commands []eventsourcing.CommandRegistry
+}
+
+// New creates an empty catalog.
+func New() *Catalog {
+	return &Catalog{
+		events:   make([]eventsourcing.EventRegistry, 0),
+		commands: make([]eventsourcing.CommandRegistry, 0),
+	}
+}
+
+// AddEvents adds the events of a registry to the catalog.
+func (cat *Catalog) AddEvents(registry eventsourcing.EventRegistry) {
+	cat.events = append(cat.events, registry)
+}
+
+// AddCommands adds the commands of a registry to the catalog.
+func (cat *Catalog) AddCommands(registry eventsourcing.CommandRegistry) {
+	cat.commands = append(cat.commands, registry)
+}
+
+// Document describes the registries as they currently are.
+func (cat *Catalog) Document() Document {
+	domains := make(map[string]*Domain)
+	domain := func(name string) *Domain {
+		found, exists := domains[name]
+		if !exists {
+			found = &Domain{
+				Name:     name,
+				Events:   make([]Entry, 0),
+				Commands: make([]Entry, 0),
+			}
+			domains[name] = found
+		}
+		return found
+	}
+
+	for _, registry := range cat.events {
+		listing, ok := registry.(eventsourcing.EventCatalog)
+		if !ok {
+			continue
+		}
+
+		target := domain(registry.Domain())
+		deprecations := eventsourcing.DeprecationsFor(registry)
+		for _, eventType := range listing.EventTypes() {
+			entry := describe(string(eventType), registry.CreateEvent(eventType))
+			replacement, deprecated := deprecations[eventType]
+			entry.Deprecated = deprecated
+			entry.Replacement = string(replacement)
+			target.Events = append(target.Events, entry)
+		}
+	}
+
+	for _, registry := range cat.commands {
+		listing, ok := registry.(eventsourcing.CommandCatalog)
+		if !ok {
+			continue
+		}
+
+		target := domain(registry.Domain())
+		for _, commandType := range listing.CommandTypes() {
+			target.Commands = append(target.Commands, describe(string(commandType), registry.CreateCommand(commandType)))
+		}
+	}
+
+	result := Document{
+		Domains: make([]Domain, 0, len(domains)),
+	}
+	for _, found := range domains {
+		sort.Slice(found.Events, func(i, j int) bool { return found.Events[i].Type < found.Events[j].Type })
+		sort.Slice(found.Commands, func(i, j int) bool { return found.Commands[i].Type < found.Commands[j].Type })
+		result.Domains = append(result.Domains, *found)
+	}
+	sort.Slice(result.Domains, func(i, j int) bool { return result.Domains[i].Name < result.Domains[j].Name })
+
+	return result
+}
+
+// Handler gets a gin handler that serves the catalog.
+func (cat *Catalog) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, cat.Document())
+	}
+}
+
+// ServeHTTP serves the catalog, for use without gin.
+func (cat *Catalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(cat.Document())
+}
+
+// describe builds the entry for an instance of an event or command.
+func describe(name string, instance interface{}) Entry {
+	value := reflect.ValueOf(instance)
+	for value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+
+	entry := Entry{
+		Type:    name,
+		Fields:  make([]Field, 0),
+		Example: example(value.Type(), map[reflect.Type]bool{}),
+	}
+
+	if value.Kind() == reflect.Struct {
+		eachField(value.Type(), func(field reflect.StructField, name string, optional bool) {
+			entry.Fields = append(entry.Fields, Field{
+				Name:        name,
+				Type:        jsonType(field.Type),
+				Optional:    optional,
+				Validate:    field.Tag.Get("validate"),
+				Description: field.Tag.Get("doc"),
+			})
+		})
+	}
+
+	return entry
+}
+
+// eachField visits the fields of a struct that are encoded as JSON, flattening
+// embedded structs as encoding/json does.
+func eachField(structType reflect.Type, visit func(field reflect.StructField, name string, optional bool)) {
+	for index := 0; index < structType.NumField(); index++ {
+		field := structType.Field(index)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+		optional := false
+		for _, option := range parts[1:] {
+			optional = optional || option == "omitempty"
+		}
+
+		// Embedded structs without a name are flattened into their parent
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				eachField(embedded, visit)
+				continue
+			}
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		visit(field, name, optional)
+	}
+}
+
+var (
+	jsonMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// marshals reports if a type controls its own encoding.
+func marshals(valueType reflect.Type) bool {
+	return valueType.Implements(jsonMarshaler) || valueType.Implements(textMarshaler) ||
+		reflect.PtrTo(valueType).Implements(jsonMarshaler) || reflect.PtrTo(valueType).Implements(textMarshaler)
+}
+
+// jsonType names the JSON type a Go type is encoded as.
+func jsonType(valueType reflect.Type) string {
+	for valueType.Kind() == reflect.Ptr {
+		valueType = valueType.Elem()
+	}
+
+	if marshals(valueType) {
+		return "string"
+	}
+
+	switch valueType.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		if valueType.Elem().Kind() == reflect.Uint8 {
+			return "string"
+		}
+		return "array"
+	case reflect.Array:
+		return "array"
+	case reflect.Interface:
+		return "any"
+	}
+
+	return "object"
+}
+
+// example builds an example value for a type from its zero value. Types seen
+// further up the tree are not expanded again, so recursive types terminate.
+func example(valueType reflect.Type, seen map[reflect.Type]bool) interface{} {
+	for valueType.Kind() == reflect.Ptr {
+		valueType = valueType.Elem()
+	}
+
+	// Types with their own encoding are shown as they encode
+	if marshals(valueType) {
+		var decoded interface{}
+		encoded, errMarshal := json.Marshal(reflect.New(valueType).Interface())
+		if errMarshal == nil && json.Unmarshal(encoded, &decoded) == nil {
+			return decoded
+		}
+		return nil
+	}
+
+	switch valueType.Kind() {
+	case reflect.Struct:
+		if seen[valueType] {
+			return nil
+		}
+		seen[valueType] = true
+		defer delete(seen, valueType)
+
+		result := make(map[string]interface{})
+		eachField(valueType, func(field reflect.StructField, name string, optional bool) {
+			override, hasExample := field.Tag.Lookup("example")
+			if !hasExample {
+				result[name] = example(field.Type, seen)
+				return
+			}
+
+			var decoded interface{}
+			if json.Unmarshal([]byte(override), &decoded) == nil {
+				result[name] = decoded
+				return
+			}
+			result[name] = override
+		})
+		return result
+	case reflect.Slice:
+		if valueType.Elem().Kind() == reflect.Uint8 {
+			return ""
+		}
+		return []interface{}{example(valueType.Elem(), seen)}
+	case reflect.Array:
+		return []interface{}{example(valueType.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{}
+	case reflect.Interface:
+		return nil
+	}
+
+	return reflect.Zero(valueType).Interface()
+}
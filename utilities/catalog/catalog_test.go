@@ -0,0 +1,125 @@
+package catalog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/stretchr/testify/assert"
+)
+
+// Address is a nested value.
+type Address struct {
+	Street string `json:"street" example:"1 Main St"`
+	Next   *Address
+}
+
+// Audit is embedded into events.
+type Audit struct {
+	User string `json:"user" doc:"User that made the change"`
+}
+
+// CustomerCreatedEvent is an event with a variety of field types.
+type CustomerCreatedEvent struct {
+	Audit
+	Name     string            `json:"name" validate:"required"`
+	Age      int               `json:"age,omitempty" example:"42"`
+	Active   bool              `json:"active"`
+	Created  time.Time         `json:"created"`
+	Tags     []string          `json:"tags"`
+	Labels   map[string]string `json:"labels"`
+	Address  Address           `json:"address"`
+	Internal string            `json:"-"`
+	hidden   string
+}
+
+// CreateCustomerCommand is a command.
+type CreateCustomerCommand struct {
+	Name string `json:"name"`
+}
+
+func newCatalog() *Catalog {
+	events := eventsourcing.NewStandardEventRegistry("Customers")
+	events.RegisterEvent(CustomerCreatedEvent{})
+	events.RegisterEvent(Audit{})
+	events.(eventsourcing.DeprecationRegistry).DeprecateEvent("Audit", "CustomerCreatedEvent")
+
+	commands := eventsourcing.NewStandardCommandRegistry("Customers")
+	commands.RegisterCommand(CreateCustomerCommand{})
+
+	docs := New()
+	docs.AddEvents(events)
+	docs.AddEvents(eventsourcing.NewStandardEventRegistry("Billing"))
+	docs.AddCommands(commands)
+	return docs
+}
+
+// TestDocument checks fields and examples are described from types and tags.
+func TestDocument(t *testing.T) {
+	document := newCatalog().Document()
+	assert.Equal(t, 2, len(document.Domains))
+	assert.Equal(t, "Billing", document.Domains[0].Name)
+	assert.Empty(t, document.Domains[0].Events)
+
+	customers := document.Domains[1]
+	assert.Equal(t, 2, len(customers.Events))
+	assert.Equal(t, "Audit", customers.Events[0].Type)
+	assert.True(t, customers.Events[0].Deprecated)
+	assert.Equal(t, "CustomerCreatedEvent", customers.Events[0].Replacement)
+
+	created := customers.Events[1]
+	assert.False(t, created.Deprecated)
+	assert.Equal(t, []Field{
+		{Name: "user", Type: "string", Description: "User that made the change"},
+		{Name: "name", Type: "string", Validate: "required"},
+		{Name: "age", Type: "integer", Optional: true},
+		{Name: "active", Type: "boolean"},
+		{Name: "created", Type: "string"},
+		{Name: "tags", Type: "array"},
+		{Name: "labels", Type: "object"},
+		{Name: "address", Type: "object"},
+	}, created.Fields)
+
+	assert.Equal(t, map[string]interface{}{
+		"user":    "",
+		"name":    "",
+		"age":     float64(42),
+		"active":  false,
+		"created": "0001-01-01T00:00:00Z",
+		"tags":    []interface{}{""},
+		"labels":  map[string]interface{}{},
+		"address": map[string]interface{}{
+			"street": "1 Main St",
+			"Next":   nil,
+		},
+	}, created.Example)
+
+	assert.Equal(t, []Entry{{
+		Type:    "CreateCustomerCommand",
+		Fields:  []Field{{Name: "name", Type: "string"}},
+		Example: map[string]interface{}{"name": ""},
+	}}, customers.Commands)
+}
+
+// TestHandler checks the catalog is served through gin and net/http.
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	docs := newCatalog()
+	router := gin.New()
+	router.GET("/catalog", docs.Handler())
+
+	for _, handler := range []http.Handler{router, docs} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/catalog", nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		document := Document{}
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &document))
+		assert.Equal(t, "Customers", document.Domains[1].Name)
+		assert.Equal(t, "CustomerCreatedEvent", document.Domains[1].Events[1].Type)
+	}
+}
@@ -0,0 +1,279 @@
+/*
+Package commandbus runs commands asynchronously, for slow commands behind
+request/response APIs with tight timeouts. Submitting a command puts it into an
+inbox and returns a token straight away, while a pool of workers takes commands
+from the inbox and runs them. Callers use the token to poll the status of the
+command, or to await its completion:
+
+	bus := commandbus.Create(func(key string, command eventsourcing.Command) error {
+		agg := &Counter{}
+		agg.Initialize(key, registry, store)
+		if err := agg.Refresh(); err != nil {
+			return err
+		}
+		if err := agg.Handle(command); err != nil {
+			return err
+		}
+		return agg.Commit()
+	}, commandbus.Options{Workers: 4})
+	bus.Start()
+
+	token, err := bus.Submit("counter-1", IncrementCommand{IncrementBy: 1})
+	status, err := bus.Await(ctx, token)
+
+Commands for the same aggregate run one at a time, in the order they were
+submitted, while commands for different aggregates run concurrently. A command
+that still conflicts with another writer (see eventsourcing.ConcurrencyFault) is
+retried, up to Options.Retries times, before it fails.
+
+Commands wait in memory by default, and are lost if the process stops. A durable
+inbox (see the redisinbox module) keeps commands that haven't run across restarts,
+and lets several processes share the work. Workers hold a lease on the commands they run,
+which they renew until the command completes, so the commands of a worker that
+stops are taken again once the lease expires - commands run at least once, and
+handlers should tolerate running a command again.
+*/
+package commandbus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	// DefaultWorkers is the number of commands run at a time.
+	DefaultWorkers = 1
+
+	// DefaultInterval is the time waited between checks of the inbox for commands
+	// submitted elsewhere, and between polls of the status of an awaited command.
+	DefaultInterval = 100 * time.Millisecond
+
+	// DefaultLease is the time a worker holds a command for before it's taken
+	// again, unless the worker renews the lease.
+	DefaultLease = 30 * time.Second
+
+	// DefaultRetries is the number of times a command that conflicts is retried.
+	DefaultRetries = 3
+)
+
+// Handler runs a command against the aggregate with a key, i.e. by refreshing the
+// aggregate, handling the command and committing the result.
+type Handler func(key string, command eventsourcing.Command) error
+
+// Options contains the options for running commands.
+type Options struct {
+	Workers  int                 // Commands run at a time, DefaultWorkers by default
+	Inbox    Inbox               // Commands waiting to run, in memory by default
+	Interval time.Duration       // Wait between checks of the inbox, DefaultInterval by default
+	Lease    time.Duration       // Time commands are held for between renewals, DefaultLease by default
+	Retries  int                 // Retries of commands that conflict, DefaultRetries by default, negative for none
+	OnError  func(error)         // Called when the inbox fails, ignored by default
+	Clock    eventsourcing.Clock // Source of time, the system clock by default
+}
+
+// Bus runs submitted commands in the background.
+type Bus struct {
+	handler Handler        // Runs commands
+	options Options        // Options
+	wake    chan struct{}  // Wakes a worker once a command is submitted
+	lock    sync.Mutex     // Guards the worker state
+	stop    chan struct{}  // Stops the workers
+	done    sync.WaitGroup // Waits for the workers to exit
+}
+
+// Create creates a bus running commands with a handler. Commands are only run once
+// the bus is started, until then they wait in the inbox.
+func Create(handler Handler, options Options) *Bus {
+	if options.Workers <= 0 {
+		options.Workers = DefaultWorkers
+	}
+	if options.Inbox == nil {
+		options.Inbox = NewMemoryInbox()
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
+	if options.Lease <= 0 {
+		options.Lease = DefaultLease
+	}
+	if options.Retries == 0 {
+		options.Retries = DefaultRetries
+	}
+	if options.OnError == nil {
+		options.OnError = func(error) {}
+	}
+	if options.Clock == nil {
+		options.Clock = eventsourcing.SystemClock
+	}
+
+	return &Bus{
+		handler: handler,
+		options: options,
+		wake:    make(chan struct{}, options.Workers),
+	}
+}
+
+// Submit puts a command for the aggregate with a key into the inbox, returning the
+// token its status is tracked by.
+func (bus *Bus) Submit(key string, command eventsourcing.Command) (string, error) {
+	token := fmt.Sprintf("%v", uuid.NewV4())
+	errPut := bus.options.Inbox.Put(Submission{
+		Token:     token,
+		Key:       key,
+		Command:   command,
+		Submitted: bus.options.Clock.Now(),
+	})
+	if errPut != nil {
+		return "", errPut
+	}
+
+	select {
+	case bus.wake <- struct{}{}:
+	default:
+	}
+	return token, nil
+}
+
+// Status gets the status of a submitted command
+func (bus *Bus) Status(token string) (Status, error) {
+	return bus.options.Inbox.Status(token)
+}
+
+// Await waits for a submitted command to run, returning its final status, or
+// fails once the context is done.
+func (bus *Bus) Await(ctx context.Context, token string) (Status, error) {
+	for {
+		status, errStatus := bus.Status(token)
+		if errStatus != nil || status.State.Done() {
+			return status, errStatus
+		}
+
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-bus.options.Clock.After(bus.options.Interval):
+		}
+	}
+}
+
+// Start running commands in the background
+func (bus *Bus) Start() error {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	if bus.stop != nil {
+		return nil
+	}
+
+	bus.stop = make(chan struct{})
+	for worker := 0; worker < bus.options.Workers; worker++ {
+		bus.done.Add(1)
+		go bus.run(bus.stop)
+	}
+	return nil
+}
+
+// Stop running commands, waiting for those in progress to finish
+func (bus *Bus) Stop() error {
+	bus.lock.Lock()
+	stop := bus.stop
+	bus.stop = nil
+	bus.lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		bus.done.Wait()
+	}
+	return nil
+}
+
+// run takes commands from the inbox and runs them until stopped, waiting for a
+// submission or the interval once the inbox is empty.
+func (bus *Bus) run(stop chan struct{}) {
+	defer bus.done.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		ran, errRun := bus.RunNext()
+		if errRun != nil {
+			bus.options.OnError(errRun)
+		}
+		if ran && errRun == nil {
+			continue
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-bus.wake:
+		case <-bus.options.Clock.After(bus.options.Interval):
+		}
+	}
+}
+
+// RunNext takes the next command from the inbox and runs it, returning false if
+// the inbox had no commands waiting for an idle aggregate. The lease on the command
+// is renewed while it runs. Commands that conflict are retried, while those that
+// fail otherwise are completed with their error.
+func (bus *Bus) RunNext() (bool, error) {
+	now := bus.options.Clock.Now()
+	submission, found, errTake := bus.options.Inbox.Take(now, now.Add(bus.options.Lease))
+	if errTake != nil || !found {
+		return false, errTake
+	}
+
+	renewed := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		bus.renew(submission.Token, finished)
+	}()
+
+	errHandle := bus.handle(submission)
+	for retry := 0; retry < bus.options.Retries; retry++ {
+		if conflict, _ := eventsourcing.IsConcurrencyFault(errHandle); !conflict {
+			break
+		}
+		errHandle = bus.handle(submission)
+	}
+
+	close(finished)
+	<-renewed
+	return true, bus.options.Inbox.Complete(submission.Token, errHandle)
+}
+
+// renew extends the lease on a running command every half lease, until it's
+// finished.
+func (bus *Bus) renew(token string, finished chan struct{}) {
+	for {
+		select {
+		case <-finished:
+			return
+		case <-bus.options.Clock.After(bus.options.Lease / 2):
+		}
+
+		errExtend := bus.options.Inbox.Extend(token, bus.options.Clock.Now().Add(bus.options.Lease))
+		if errExtend != nil {
+			bus.options.OnError(errExtend)
+		}
+	}
+}
+
+// handle runs a command, treating a panic as a failure
+func (bus *Bus) handle(submission Submission) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("commandbus: command panicked: %v", recovered)
+		}
+	}()
+
+	return bus.handler(submission.Key, submission.Command)
+}
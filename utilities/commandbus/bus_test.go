@@ -0,0 +1,183 @@
+package commandbus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSubmitAwait checks submitted commands run in the background, and their
+// outcome is reported through their token
+func TestSubmitAwait(t *testing.T) {
+	store := memory.NewStore()
+	bus := Create(func(key string, command eventsourcing.Command) error {
+		agg := test.SimpleAggregate{}
+		agg.Initialize(key, test.GetTestRegistry(), store)
+		if errRefresh := agg.Refresh(); errRefresh != nil {
+			return errRefresh
+		}
+		if command == "fail" {
+			return errors.New("rejected")
+		}
+		agg.ApplyEvent(command)
+		return agg.Commit()
+	}, Options{Workers: 2, Interval: 10 * time.Millisecond})
+
+	token, errSubmit := bus.Submit("a", test.IncrementEvent{IncrementBy: 2})
+	assert.Nil(t, errSubmit)
+	status, errStatus := bus.Status(token)
+	assert.Nil(t, errStatus)
+	assert.Equal(t, Pending, status.State, "Commands wait until the bus is started")
+
+	assert.Nil(t, bus.Start())
+	defer bus.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	status, errAwait := bus.Await(ctx, token)
+	assert.Nil(t, errAwait)
+	assert.Equal(t, Succeeded, status.State)
+
+	failing, _ := bus.Submit("a", "fail")
+	status, errAwait = bus.Await(ctx, failing)
+	assert.Nil(t, errAwait)
+	assert.Equal(t, Failed, status.State)
+	assert.Equal(t, "rejected", status.Error)
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("a", test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	assert.Equal(t, 2, agg.CurrentCount)
+
+	_, errUnknown := bus.Status("missing")
+	assert.NotNil(t, errUnknown)
+}
+
+// TestAwaitTimeout checks awaiting a command gives up once the context is done,
+// with the command's status so far
+func TestAwaitTimeout(t *testing.T) {
+	release := make(chan struct{})
+	bus := Create(func(key string, command eventsourcing.Command) error {
+		<-release
+		return nil
+	}, Options{Interval: 10 * time.Millisecond})
+	assert.Nil(t, bus.Start())
+	defer bus.Stop()
+	defer close(release)
+
+	token, _ := bus.Submit("a", "slow")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	status, errAwait := bus.Await(ctx, token)
+	assert.Equal(t, context.DeadlineExceeded, errAwait)
+	assert.False(t, status.State.Done())
+}
+
+// TestRunNext checks commands run in the order they were submitted, and panics
+// are recorded as failures
+func TestRunNext(t *testing.T) {
+	var lock sync.Mutex
+	ran := make([]string, 0)
+	bus := Create(func(key string, command eventsourcing.Command) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if command == "panic" {
+			panic("boom")
+		}
+		ran = append(ran, key)
+		return nil
+	}, Options{})
+
+	first, _ := bus.Submit("first", "ok")
+	second, _ := bus.Submit("second", "panic")
+	bus.Submit("third", "ok")
+	for index := 0; index < 3; index++ {
+		found, errRun := bus.RunNext()
+		assert.True(t, found)
+		assert.Nil(t, errRun)
+	}
+	found, _ := bus.RunNext()
+	assert.False(t, found)
+
+	assert.Equal(t, []string{"first", "third"}, ran)
+	status, _ := bus.Status(first)
+	assert.Equal(t, Succeeded, status.State)
+	status, _ = bus.Status(second)
+	assert.Equal(t, Failed, status.State)
+	assert.Contains(t, status.Error, "boom")
+	assert.Equal(t, "failed", status.State.String())
+}
+
+// TestSameKey checks commands for the same aggregate run one at a time, even with
+// several workers, so that neither conflicts with the other
+func TestSameKey(t *testing.T) {
+	store := memory.NewStore()
+	var lock sync.Mutex
+	running, overlapped := 0, false
+	bus := Create(func(key string, command eventsourcing.Command) error {
+		lock.Lock()
+		running++
+		overlapped = overlapped || running > 1
+		lock.Unlock()
+		defer func() {
+			lock.Lock()
+			running--
+			lock.Unlock()
+		}()
+
+		agg := test.SimpleAggregate{}
+		agg.Initialize(key, test.GetTestRegistry(), store)
+		if errRefresh := agg.Refresh(); errRefresh != nil {
+			return errRefresh
+		}
+		time.Sleep(20 * time.Millisecond)
+		agg.ApplyEvent(command)
+		return agg.Commit()
+	}, Options{Workers: 4, Interval: 10 * time.Millisecond, Retries: -1})
+
+	first, _ := bus.Submit("counter-1", test.IncrementEvent{IncrementBy: 1})
+	second, _ := bus.Submit("counter-1", test.IncrementEvent{IncrementBy: 2})
+	assert.Nil(t, bus.Start())
+	defer bus.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, token := range []string{first, second} {
+		status, errAwait := bus.Await(ctx, token)
+		assert.Nil(t, errAwait)
+		assert.Equal(t, Succeeded, status.State, status.Error)
+	}
+	assert.False(t, overlapped)
+
+	agg := test.SimpleAggregate{}
+	agg.Initialize("counter-1", test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	assert.Equal(t, 3, agg.CurrentCount)
+}
+
+// TestRetryConflicts checks commands that conflict with another writer are retried
+func TestRetryConflicts(t *testing.T) {
+	attempts := 0
+	bus := Create(func(key string, command eventsourcing.Command) error {
+		attempts++
+		if attempts < 3 {
+			return eventsourcing.NewConcurrencyFault(key, 1)
+		}
+		return nil
+	}, Options{})
+
+	token, _ := bus.Submit("a", "ok")
+	found, errRun := bus.RunNext()
+	assert.True(t, found)
+	assert.Nil(t, errRun)
+	assert.Equal(t, 3, attempts)
+	status, _ := bus.Status(token)
+	assert.Equal(t, Succeeded, status.State)
+}
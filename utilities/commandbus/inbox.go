@@ -0,0 +1,241 @@
+package commandbus
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// State is the progress of a submitted command.
+type State int
+
+const (
+	// Pending commands are waiting in the inbox.
+	Pending State = iota
+
+	// Running commands have been taken from the inbox by a worker.
+	Running
+
+	// Succeeded commands ran without error.
+	Succeeded
+
+	// Failed commands ran, and failed.
+	Failed
+)
+
+// Done returns true once a command has run, successfully or not.
+func (state State) Done() bool {
+	return state == Succeeded || state == Failed
+}
+
+// String gets the name of a state
+func (state State) String() string {
+	switch state {
+	case Pending:
+		return "pending"
+	case Running:
+		return "running"
+	case Succeeded:
+		return "succeeded"
+	case Failed:
+		return "failed"
+	}
+	return fmt.Sprintf("State(%d)", int(state))
+}
+
+// Submission is a command submitted to run against an aggregate.
+type Submission struct {
+	Token     string                // Token the command's status is tracked by
+	Key       string                // Key of the aggregate
+	Command   eventsourcing.Command // Command to run
+	Submitted time.Time             // Time the command was submitted
+	Attempts  int                   // Times the command has been taken, including this one
+}
+
+// Status is the status of a submitted command.
+type Status struct {
+	Token string // Token of the command
+	State State  // Progress of the command
+	Error string // Why the command failed, if it did
+}
+
+// Inbox is an interface that describes storage for submitted commands and their
+// status. For commands to survive the process the inbox should be durable, and
+// encode commands so that they can be revived (see eventsourcing.CommandRegistry).
+//
+// Commands are taken under a lease, which the worker running them extends until
+// they complete. A command whose lease expires, because its worker stopped, is
+// pending again, and is taken by the next worker - so commands run at least once.
+// Only one command for each aggregate is running at a time, so that commands for
+// the same aggregate don't conflict with each other.
+type Inbox interface {
+	// Put adds a pending command.
+	Put(submission Submission) error
+
+	// Take claims the earliest pending command for an aggregate with no command
+	// running, marking it running until the lease expires, or returns false if no
+	// such commands are pending. Running commands with leases that expired before
+	// now are pending again.
+	Take(now time.Time, until time.Time) (Submission, bool, error)
+
+	// Extend renews the lease of a running command.
+	Extend(token string, until time.Time) error
+
+	// Complete records the outcome of a running command, failed if err is set.
+	Complete(token string, err error) error
+
+	// Status gets the status of a command, failing if the token isn't known.
+	Status(token string) (Status, error)
+}
+
+// lease is a command that has been taken from the memory inbox.
+type lease struct {
+	submission Submission // Command being run
+	until      time.Time  // Time the lease expires
+}
+
+// memoryInbox is an inbox held in memory.
+type memoryInbox struct {
+	lock    sync.Mutex
+	pending []Submission
+	running map[string]lease  // Running commands, by token
+	busy    map[string]string // Tokens of running commands, by aggregate key
+	status  map[string]Status
+}
+
+// NewMemoryInbox creates an inbox held in memory. It doesn't survive the process,
+// so commands that haven't run are lost on restart, and the status of every command
+// is kept for the life of the inbox.
+func NewMemoryInbox() Inbox {
+	return &memoryInbox{
+		pending: make([]Submission, 0),
+		running: make(map[string]lease),
+		busy:    make(map[string]string),
+		status:  make(map[string]Status),
+	}
+}
+
+// Put adds a pending command
+func (inbox *memoryInbox) Put(submission Submission) error {
+	inbox.lock.Lock()
+	defer inbox.lock.Unlock()
+	inbox.enqueue(submission)
+	return nil
+}
+
+// enqueue adds a command to the pending list, in order of submission
+func (inbox *memoryInbox) enqueue(submission Submission) {
+	inbox.pending = append(inbox.pending, submission)
+	sort.SliceStable(inbox.pending, func(i, j int) bool {
+		return inbox.pending[i].Submitted.Before(inbox.pending[j].Submitted)
+	})
+	inbox.status[submission.Token] = Status{
+		Token: submission.Token,
+		State: Pending,
+	}
+}
+
+// Take claims the earliest pending command for an idle aggregate
+func (inbox *memoryInbox) Take(now time.Time, until time.Time) (Submission, bool, error) {
+	inbox.lock.Lock()
+	defer inbox.lock.Unlock()
+
+	// Commands whose workers have gone away are pending again
+	for token, held := range inbox.running {
+		if held.until.Before(now) {
+			inbox.release(token)
+			inbox.enqueue(held.submission)
+		}
+	}
+
+	for index, submission := range inbox.pending {
+		if _, busy := inbox.busy[submission.Key]; busy {
+			continue
+		}
+
+		inbox.pending = append(inbox.pending[:index:index], inbox.pending[index+1:]...)
+		submission.Attempts++
+		inbox.running[submission.Token] = lease{
+			submission: submission,
+			until:      until,
+		}
+		inbox.busy[submission.Key] = submission.Token
+		inbox.status[submission.Token] = Status{
+			Token: submission.Token,
+			State: Running,
+		}
+		return submission, true, nil
+	}
+
+	return Submission{}, false, nil
+}
+
+// Extend renews the lease of a running command
+func (inbox *memoryInbox) Extend(token string, until time.Time) error {
+	inbox.lock.Lock()
+	defer inbox.lock.Unlock()
+	held, running := inbox.running[token]
+	if !running {
+		return fmt.Errorf("commandbus: command %v is not running", token)
+	}
+
+	held.until = until
+	inbox.running[token] = held
+	return nil
+}
+
+// release forgets a running command, freeing its aggregate
+func (inbox *memoryInbox) release(token string) {
+	held, running := inbox.running[token]
+	if !running {
+		return
+	}
+
+	delete(inbox.running, token)
+	if inbox.busy[held.submission.Key] == token {
+		delete(inbox.busy, held.submission.Key)
+	}
+}
+
+// Complete records the outcome of a command
+func (inbox *memoryInbox) Complete(token string, err error) error {
+	inbox.lock.Lock()
+	defer inbox.lock.Unlock()
+	if _, known := inbox.status[token]; !known {
+		return fmt.Errorf("commandbus: unknown token %v", token)
+	}
+
+	// A command completed after its lease expired needn't run again
+	inbox.release(token)
+	for index, submission := range inbox.pending {
+		if submission.Token == token {
+			inbox.pending = append(inbox.pending[:index:index], inbox.pending[index+1:]...)
+			break
+		}
+	}
+
+	status := Status{
+		Token: token,
+		State: Succeeded,
+	}
+	if err != nil {
+		status.State = Failed
+		status.Error = err.Error()
+	}
+	inbox.status[token] = status
+	return nil
+}
+
+// Status gets the status of a command
+func (inbox *memoryInbox) Status(token string) (Status, error) {
+	inbox.lock.Lock()
+	defer inbox.lock.Unlock()
+	status, known := inbox.status[token]
+	if !known {
+		return Status{}, fmt.Errorf("commandbus: unknown token %v", token)
+	}
+	return status, nil
+}
@@ -0,0 +1,14 @@
+package commandbus_test
+
+import (
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing/utilities/commandbus"
+	"github.com/go-gadgets/eventsourcing/utilities/commandbus/inboxtest"
+)
+
+// TestMemoryInbox checks the memory inbox
+func TestMemoryInbox(t *testing.T) {
+	inboxtest.CheckInbox(t, commandbus.NewMemoryInbox())
+	inboxtest.CheckBacklog(t, commandbus.NewMemoryInbox())
+}
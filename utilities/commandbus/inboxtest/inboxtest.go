@@ -0,0 +1,120 @@
+// Package inboxtest holds the checks every commandbus.Inbox is expected to pass,
+// so that inboxes kept elsewhere are tested the same way as the built-in ones.
+package inboxtest
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing/utilities/commandbus"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// CheckInbox checks an inbox takes commands in order, one per aggregate at a time,
+// and takes them again once their lease expires
+func CheckInbox(t *testing.T, inbox commandbus.Inbox) {
+	start := time.Now()
+	for index, key := range []string{"a", "a", "b"} {
+		errPut := inbox.Put(commandbus.Submission{
+			Token:     fmt.Sprintf("token-%v", index),
+			Key:       key,
+			Command:   test.IncrementEvent{IncrementBy: index + 1},
+			Submitted: start.Add(time.Duration(index) * time.Millisecond),
+		})
+		assert.Nil(t, errPut)
+	}
+
+	now := start.Add(time.Second)
+	first, found, errTake := inbox.Take(now, now.Add(time.Minute))
+	assert.Nil(t, errTake)
+	assert.True(t, found)
+	assert.Equal(t, "token-0", first.Token)
+	assert.Equal(t, test.IncrementEvent{IncrementBy: 1}, first.Command)
+	assert.Equal(t, 1, first.Attempts)
+
+	// The second command for "a" waits for the first
+	other, found, _ := inbox.Take(now, now.Add(time.Minute))
+	assert.True(t, found)
+	assert.Equal(t, "token-2", other.Token)
+	_, found, _ = inbox.Take(now, now.Add(time.Minute))
+	assert.False(t, found)
+
+	status, _ := inbox.Status("token-0")
+	assert.Equal(t, commandbus.Running, status.State)
+	assert.Nil(t, inbox.Complete("token-0", nil))
+	status, _ = inbox.Status("token-0")
+	assert.Equal(t, commandbus.Succeeded, status.State)
+
+	second, found, _ := inbox.Take(now, now.Add(time.Minute))
+	assert.True(t, found)
+	assert.Equal(t, "token-1", second.Token)
+
+	// A renewed lease is kept, while an expired one is taken again
+	assert.Nil(t, inbox.Extend("token-1", now.Add(time.Hour)))
+	later := now.Add(2 * time.Minute)
+	again, found, _ := inbox.Take(later, later.Add(time.Minute))
+	assert.True(t, found)
+	assert.Equal(t, "token-2", again.Token)
+	assert.Equal(t, 2, again.Attempts)
+	_, found, _ = inbox.Take(later, later.Add(time.Minute))
+	assert.False(t, found)
+
+	assert.Nil(t, inbox.Complete("token-2", errors.New("rejected")))
+	status, _ = inbox.Status("token-2")
+	assert.Equal(t, commandbus.Failed, status.State)
+	assert.Equal(t, "rejected", status.Error)
+
+	assert.NotNil(t, inbox.Extend("token-2", later), "Completed commands can't be renewed")
+	_, errUnknown := inbox.Status("missing")
+	assert.NotNil(t, errUnknown)
+	assert.NotNil(t, inbox.Complete("missing", nil))
+}
+
+// Backlog is the number of commands queued for a busy aggregate by CheckBacklog,
+// more than a take once looked through
+const Backlog = 250
+
+// CheckBacklog checks commands for idle aggregates are taken while a long backlog
+// of commands waits for a busy one
+func CheckBacklog(t *testing.T, inbox commandbus.Inbox) {
+	start := time.Now()
+	for index := 0; index < Backlog; index++ {
+		errPut := inbox.Put(commandbus.Submission{
+			Token:     fmt.Sprintf("hot-%v", index),
+			Key:       "hot",
+			Command:   test.IncrementEvent{IncrementBy: 1},
+			Submitted: start.Add(time.Duration(index) * time.Microsecond),
+		})
+		assert.Nil(t, errPut)
+	}
+	errPut := inbox.Put(commandbus.Submission{
+		Token:     "idle-0",
+		Key:       "idle",
+		Command:   test.IncrementEvent{IncrementBy: 1},
+		Submitted: start.Add(time.Second),
+	})
+	assert.Nil(t, errPut)
+
+	now := start.Add(time.Minute)
+	first, found, errTake := inbox.Take(now, now.Add(time.Minute))
+	assert.Nil(t, errTake)
+	assert.True(t, found)
+	assert.Equal(t, "hot-0", first.Token)
+
+	// The idle aggregate isn't held up behind the busy one
+	idle, found, errTake := inbox.Take(now, now.Add(time.Minute))
+	assert.Nil(t, errTake)
+	assert.True(t, found)
+	assert.Equal(t, "idle-0", idle.Token)
+	_, found, _ = inbox.Take(now, now.Add(time.Minute))
+	assert.False(t, found)
+
+	// Once the busy aggregate is free, its backlog continues in order
+	assert.Nil(t, inbox.Complete("hot-0", nil))
+	next, found, _ := inbox.Take(now, now.Add(time.Minute))
+	assert.True(t, found)
+	assert.Equal(t, "hot-1", next.Token)
+}
@@ -0,0 +1,336 @@
+// Package redisinbox holds a commandbus.Inbox kept in Redis. It is a module of its
+// own, so that only users of the inbox depend on the Redis client.
+package redisinbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/commandbus"
+	"github.com/go-redis/redis"
+)
+
+// redisInbox is an inbox held in Redis, shared by every process using the same
+// prefix.
+type redisInbox struct {
+	client   redis.UniversalClient         // Redis connection
+	prefix   string                        // Prefix of the inbox's keys
+	registry eventsourcing.CommandRegistry // Registry commands are encoded with
+	retain   time.Duration                 // Time statuses are kept for once complete
+}
+
+// NewInbox creates an inbox held in Redis, so that commands survive restarts
+// and several processes can share the work. The pending commands of each aggregate
+// are held in a sorted set of their own, and the aggregates with none running in a
+// ready set scored by their earliest pending command, so a take never looks past
+// the commands of busy aggregates. Running commands are held in another sorted set
+// scored by the expiry of their lease, and each command in a hash of its own, all
+// under keys starting with the prefix. The prefix is used as a hash tag, so that
+// the keys of an inbox share a slot of a cluster.
+//
+// Commands are encoded as JSON, and revived by the registry, so their types must be
+// registered with it. The status of completed commands is kept for the retain
+// duration, or for as long as the keys are, if retain is 0.
+func NewInbox(client redis.UniversalClient, prefix string, registry eventsourcing.CommandRegistry, retain time.Duration) (commandbus.Inbox, error) {
+	if prefix == "" {
+		return nil, fmt.Errorf("redisinbox: a key prefix is required")
+	}
+
+	return &redisInbox{
+		client:   client,
+		prefix:   "{" + prefix + "}",
+		registry: registry,
+		retain:   retain,
+	}, nil
+}
+
+// keys gets the keys of the ready set, the running set, and the hash of the tokens
+// of running commands by aggregate key.
+func (inbox *redisInbox) keys() []string {
+	return []string{
+		inbox.prefix + ":ready",
+		inbox.prefix + ":running",
+		inbox.prefix + ":busy",
+	}
+}
+
+// queuePrefix gets the prefix of the keys of the sets of pending commands of each
+// aggregate
+func (inbox *redisInbox) queuePrefix() string {
+	return inbox.prefix + ":queue:"
+}
+
+// commandKey gets the key of the hash holding a command
+func (inbox *redisInbox) commandKey(token string) string {
+	return inbox.commandPrefix() + token
+}
+
+// commandPrefix gets the prefix of the keys of command hashes
+func (inbox *redisInbox) commandPrefix() string {
+	return inbox.prefix + ":command:"
+}
+
+// millis gets a time as milliseconds since the epoch
+func millis(at time.Time) int64 {
+	return at.UnixNano() / int64(time.Millisecond)
+}
+
+// readyFunction defines ready(queues, key), which scores an aggregate in the ready
+// set by its earliest pending command, or takes it out if it has a command running
+// or none pending.
+const readyFunction = `
+local function ready(queues, key)
+	if redis.call("HEXISTS", KEYS[3], key) == 1 then
+		redis.call("ZREM", KEYS[1], key)
+		return
+	end
+	local head = redis.call("ZRANGE", queues .. key, 0, 0, "WITHSCORES")
+	if head[1] then
+		redis.call("ZADD", KEYS[1], head[2], key)
+	else
+		redis.call("ZREM", KEYS[1], key)
+	end
+end
+`
+
+// putScript stores a pending command, and adds it to the pending set of its
+// aggregate in order of submission.
+var putScript = redis.NewScript(readyFunction + `
+redis.call("HMSET", KEYS[4], "key", ARGV[2], "type", ARGV[3], "data", ARGV[4], "submitted", ARGV[5], "order", ARGV[6], "attempts", 0, "state", "pending")
+redis.call("ZADD", ARGV[7] .. ARGV[2], ARGV[6], ARGV[1])
+ready(ARGV[7], ARGV[2])
+return 1
+`)
+
+// Put adds a pending command
+func (inbox *redisInbox) Put(submission commandbus.Submission) error {
+	commandType, found := inbox.registry.GetCommandType(submission.Command)
+	if !found {
+		return fmt.Errorf("redisinbox: could not find command type: %T", submission.Command)
+	}
+
+	data, errMarshal := json.Marshal(submission.Command)
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	keys := append(inbox.keys(), inbox.commandKey(submission.Token))
+	return putScript.Run(inbox.client, keys,
+		submission.Token,
+		submission.Key,
+		string(commandType),
+		string(data),
+		submission.Submitted.Format(time.RFC3339Nano),
+		submission.Submitted.UnixNano()/int64(time.Microsecond),
+		inbox.queuePrefix(),
+	).Err()
+}
+
+// takeScript returns running commands with expired leases to the pending sets of
+// their aggregates, then claims the earliest pending command of the aggregate first
+// in the ready set, dropping aggregates that are busy or have nothing pending.
+var takeScript = redis.NewScript(readyFunction + `
+local expired = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", "(" .. ARGV[1])
+for _, token in ipairs(expired) do
+	local command = ARGV[3] .. token
+	redis.call("ZREM", KEYS[2], token)
+	local key = redis.call("HGET", command, "key")
+	if key then
+		if redis.call("HGET", KEYS[3], key) == token then
+			redis.call("HDEL", KEYS[3], key)
+		end
+		redis.call("HSET", command, "state", "pending")
+		redis.call("ZADD", ARGV[4] .. key, redis.call("HGET", command, "order"), token)
+		ready(ARGV[4], key)
+	end
+end
+
+while true do
+	local first = redis.call("ZRANGE", KEYS[1], 0, 0)
+	local key = first[1]
+	if not key then
+		return false
+	end
+
+	local queue = ARGV[4] .. key
+	local token = redis.call("ZRANGE", queue, 0, 0)[1]
+	if token and redis.call("EXISTS", ARGV[3] .. token) == 0 then
+		redis.call("ZREM", queue, token)
+		ready(ARGV[4], key)
+	elseif not token or redis.call("HEXISTS", KEYS[3], key) == 1 then
+		ready(ARGV[4], key)
+	else
+		local command = ARGV[3] .. token
+		redis.call("ZREM", queue, token)
+		redis.call("ZREM", KEYS[1], key)
+		redis.call("ZADD", KEYS[2], ARGV[2], token)
+		redis.call("HSET", KEYS[3], key, token)
+		redis.call("HSET", command, "state", "running")
+		redis.call("HINCRBY", command, "attempts", 1)
+		return token
+	end
+end
+`)
+
+// Take claims the earliest pending command for an idle aggregate
+func (inbox *redisInbox) Take(now time.Time, until time.Time) (commandbus.Submission, bool, error) {
+	taken, errTake := takeScript.Run(inbox.client, inbox.keys(), millis(now), millis(until), inbox.commandPrefix(), inbox.queuePrefix()).Result()
+	if errTake == redis.Nil {
+		return commandbus.Submission{}, false, nil
+	}
+	if errTake != nil {
+		return commandbus.Submission{}, false, errTake
+	}
+	token := fmt.Sprintf("%v", taken)
+
+	fields, errFields := inbox.client.HGetAll(inbox.commandKey(token)).Result()
+	if errFields != nil {
+		return commandbus.Submission{}, false, errFields
+	}
+
+	submission, errRevive := inbox.revive(token, fields)
+	if errRevive != nil {
+		// Commands that can't be revived never will be, so fail them
+		errComplete := inbox.Complete(token, errRevive)
+		if errComplete != nil {
+			return commandbus.Submission{}, false, errComplete
+		}
+		return commandbus.Submission{}, false, errRevive
+	}
+	return submission, true, nil
+}
+
+// revive rebuilds a submission from the fields of its hash
+func (inbox *redisInbox) revive(token string, fields map[string]string) (commandbus.Submission, error) {
+	submitted, errSubmitted := time.Parse(time.RFC3339Nano, fields["submitted"])
+	if errSubmitted != nil {
+		return commandbus.Submission{}, errSubmitted
+	}
+	attempts, errAttempts := strconv.Atoi(fields["attempts"])
+	if errAttempts != nil {
+		return commandbus.Submission{}, errAttempts
+	}
+
+	var data interface{}
+	errUnmarshal := json.Unmarshal([]byte(fields["data"]), &data)
+	if errUnmarshal != nil {
+		return commandbus.Submission{}, errUnmarshal
+	}
+
+	// Commands are created as pointers to decode into, but handled as values
+	command := inbox.registry.CreateCommand(eventsourcing.CommandType(fields["type"]))
+	target := reflect.ValueOf(command)
+	if target.Kind() != reflect.Ptr {
+		holder := reflect.New(target.Type())
+		holder.Elem().Set(target)
+		target = holder
+	}
+	errDecode := eventsourcing.CodecFor(inbox.registry).Decode(data, target.Interface())
+	if errDecode != nil {
+		return commandbus.Submission{}, errDecode
+	}
+
+	return commandbus.Submission{
+		Token:     token,
+		Key:       fields["key"],
+		Command:   target.Elem().Interface(),
+		Submitted: submitted,
+		Attempts:  attempts,
+	}, nil
+}
+
+// extendScript renews the lease of a running command
+var extendScript = redis.NewScript(`
+if not redis.call("ZSCORE", KEYS[2], ARGV[1]) then
+	return 0
+end
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+return 1
+`)
+
+// Extend renews the lease of a running command
+func (inbox *redisInbox) Extend(token string, until time.Time) error {
+	extended, errExtend := extendScript.Run(inbox.client, inbox.keys(), token, millis(until)).Result()
+	if errExtend != nil {
+		return errExtend
+	}
+	if extended != int64(1) {
+		return fmt.Errorf("redisinbox: command %v is not running", token)
+	}
+	return nil
+}
+
+// completeScript records the outcome of a command, freeing its aggregate. A command
+// completed after its lease expired is taken out of the pending set of its
+// aggregate, since it needn't run again.
+var completeScript = redis.NewScript(readyFunction + `
+local key = redis.call("HGET", KEYS[4], "key")
+if not key then
+	return 0
+end
+redis.call("ZREM", ARGV[5] .. key, ARGV[1])
+redis.call("ZREM", KEYS[2], ARGV[1])
+if redis.call("HGET", KEYS[3], key) == ARGV[1] then
+	redis.call("HDEL", KEYS[3], key)
+end
+ready(ARGV[5], key)
+redis.call("HMSET", KEYS[4], "state", ARGV[2], "error", ARGV[3])
+redis.call("HDEL", KEYS[4], "data")
+if tonumber(ARGV[4]) > 0 then
+	redis.call("PEXPIRE", KEYS[4], ARGV[4])
+end
+return 1
+`)
+
+// Complete records the outcome of a command
+func (inbox *redisInbox) Complete(token string, err error) error {
+	state, message := commandbus.Succeeded, ""
+	if err != nil {
+		state, message = commandbus.Failed, err.Error()
+	}
+
+	keys := append(inbox.keys(), inbox.commandKey(token))
+	completed, errComplete := completeScript.Run(inbox.client, keys, token, state.String(), message, int64(inbox.retain/time.Millisecond), inbox.queuePrefix()).Result()
+	if errComplete != nil {
+		return errComplete
+	}
+	if completed != int64(1) {
+		return fmt.Errorf("redisinbox: unknown token %v", token)
+	}
+	return nil
+}
+
+// Status gets the status of a command
+func (inbox *redisInbox) Status(token string) (commandbus.Status, error) {
+	fields, errFields := inbox.client.HMGet(inbox.commandKey(token), "state", "error").Result()
+	if errFields != nil {
+		return commandbus.Status{}, errFields
+	}
+	if fields[0] == nil {
+		return commandbus.Status{}, fmt.Errorf("redisinbox: unknown token %v", token)
+	}
+
+	status := commandbus.Status{
+		Token: token,
+	}
+	switch fields[0] {
+	case commandbus.Pending.String():
+		status.State = commandbus.Pending
+	case commandbus.Running.String():
+		status.State = commandbus.Running
+	case commandbus.Succeeded.String():
+		status.State = commandbus.Succeeded
+	case commandbus.Failed.String():
+		status.State = commandbus.Failed
+	default:
+		return commandbus.Status{}, fmt.Errorf("redisinbox: unknown state %v of %v", fields[0], token)
+	}
+	if message, ok := fields[1].(string); ok {
+		status.Error = message
+	}
+	return status, nil
+}
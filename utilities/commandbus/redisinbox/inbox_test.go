@@ -0,0 +1,52 @@
+package redisinbox
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/commandbus"
+	"github.com/go-gadgets/eventsourcing/utilities/commandbus/inboxtest"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/go-redis/redis"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRedisInbox creates an inbox under a fresh prefix on the test server
+func testRedisInbox(t *testing.T) commandbus.Inbox {
+	address := os.Getenv("REDIS_TEST_HOST")
+	if address == "" {
+		address = "localhost:6379"
+	}
+
+	registry := eventsourcing.NewStandardCommandRegistry("Testing")
+	registry.RegisterCommand(test.IncrementEvent{})
+	client := redis.NewClient(&redis.Options{
+		Addr: address,
+	})
+	inbox, errInbox := NewInbox(client, fmt.Sprintf("test-%s", uuid.NewV4()), registry, time.Minute)
+	require.Nil(t, errInbox)
+	return inbox
+}
+
+// TestRedisInbox checks the Redis inbox
+func TestRedisInbox(t *testing.T) {
+	inboxtest.CheckInbox(t, testRedisInbox(t))
+	inboxtest.CheckBacklog(t, testRedisInbox(t))
+}
+
+// TestRedisInboxUnregistered checks commands must be registered to be submitted
+func TestRedisInboxUnregistered(t *testing.T) {
+	inbox := testRedisInbox(t)
+	errPut := inbox.Put(commandbus.Submission{
+		Token:     "unregistered",
+		Key:       "a",
+		Command:   "unregistered",
+		Submitted: time.Now(),
+	})
+	assert.NotNil(t, errPut)
+}
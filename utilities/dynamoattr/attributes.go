@@ -0,0 +1,231 @@
+/*
+Package dynamoattr converts between Go values and DynamoDB attribute values for
+the aws-sdk-go-v2 client. It's shared by the packages that keep items in DynamoDB
+(events, snapshots), and writes items in the format the dynamodbattribute package
+of the original SDK did, so that tables written by earlier versions can still be
+read, and vice versa:
+
+  - Strings, numbers and booleans are written as S, N and BOOL values, with empty
+    strings written as NULL.
+  - Byte slices are written as B values, and other slices and arrays as lists.
+  - Maps with string keys are written as M values.
+  - Structs are written as maps, following their JSON encoding (and so their json
+    field tags).
+
+Values are read as the types encoding/json reads into an interface{}: strings,
+float64 numbers, booleans, nil, []interface{} and map[string]interface{}, as well
+as []byte for binary values.
+*/
+package dynamoattr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// null is the value written for nil values and empty strings
+var null = &types.AttributeValueMemberNULL{Value: true}
+
+// Marshal converts a value to an attribute value.
+func Marshal(value interface{}) (types.AttributeValue, error) {
+	return marshal(reflect.ValueOf(value))
+}
+
+// MarshalMap converts a value that encodes as a map (a struct or a map with string
+// keys) to the attributes of an item.
+func MarshalMap(value interface{}) (map[string]types.AttributeValue, error) {
+	av, errMarshal := Marshal(value)
+	if errMarshal != nil {
+		return nil, errMarshal
+	}
+
+	item, ok := av.(*types.AttributeValueMemberM)
+	if !ok {
+		return nil, fmt.Errorf("dynamoattr: %T doesn't encode as a map", value)
+	}
+	return item.Value, nil
+}
+
+// marshal converts a reflected value to an attribute value
+func marshal(value reflect.Value) (types.AttributeValue, error) {
+	if !value.IsValid() {
+		return null, nil
+	}
+
+	// Types with their own JSON encoding are written as they encode
+	if value.Type() != reflect.TypeOf(json.Number("")) && value.Type().Implements(reflect.TypeOf((*json.Marshaler)(nil)).Elem()) {
+		return marshalJSON(value)
+	}
+
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return null, nil
+		}
+		return marshal(value.Elem())
+	case reflect.Bool:
+		return &types.AttributeValueMemberBOOL{Value: value.Bool()}, nil
+	case reflect.String:
+		if value.Type() == reflect.TypeOf(json.Number("")) {
+			return &types.AttributeValueMemberN{Value: value.String()}, nil
+		}
+		if value.Len() == 0 {
+			return null, nil
+		}
+		return &types.AttributeValueMemberS{Value: value.String()}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &types.AttributeValueMemberN{Value: strconv.FormatInt(value.Int(), 10)}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return &types.AttributeValueMemberN{Value: strconv.FormatUint(value.Uint(), 10)}, nil
+	case reflect.Float32, reflect.Float64:
+		return &types.AttributeValueMemberN{Value: strconv.FormatFloat(value.Float(), 'f', -1, value.Type().Bits())}, nil
+	case reflect.Slice:
+		if value.IsNil() {
+			return null, nil
+		}
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			if value.Len() == 0 {
+				return null, nil
+			}
+			return &types.AttributeValueMemberB{Value: value.Bytes()}, nil
+		}
+		return marshalList(value)
+	case reflect.Array:
+		return marshalList(value)
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			return marshalJSON(value)
+		}
+		if value.IsNil() {
+			return null, nil
+		}
+
+		item := make(map[string]types.AttributeValue, value.Len())
+		iterator := value.MapRange()
+		for iterator.Next() {
+			av, errMarshal := marshal(iterator.Value())
+			if errMarshal != nil {
+				return nil, errMarshal
+			}
+			item[iterator.Key().String()] = av
+		}
+		return &types.AttributeValueMemberM{Value: item}, nil
+	case reflect.Struct:
+		return marshalJSON(value)
+	}
+
+	return nil, fmt.Errorf("dynamoattr: unsupported type %v", value.Type())
+}
+
+// marshalList converts a slice or array to a list
+func marshalList(value reflect.Value) (types.AttributeValue, error) {
+	list := make([]types.AttributeValue, 0, value.Len())
+	for index := 0; index < value.Len(); index++ {
+		av, errMarshal := marshal(value.Index(index))
+		if errMarshal != nil {
+			return nil, errMarshal
+		}
+		list = append(list, av)
+	}
+	return &types.AttributeValueMemberL{Value: list}, nil
+}
+
+// marshalJSON converts a value by way of its JSON encoding, keeping numbers exact
+func marshalJSON(value reflect.Value) (types.AttributeValue, error) {
+	encoded, errEncode := json.Marshal(value.Interface())
+	if errEncode != nil {
+		return nil, errEncode
+	}
+
+	var decoded interface{}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	errDecode := decoder.Decode(&decoded)
+	if errDecode != nil {
+		return nil, errDecode
+	}
+
+	return marshal(reflect.ValueOf(decoded))
+}
+
+// Unmarshal converts an attribute value to the value it holds.
+func Unmarshal(av types.AttributeValue) (interface{}, error) {
+	switch typed := av.(type) {
+	case nil:
+		return nil, nil
+	case *types.AttributeValueMemberNULL:
+		return nil, nil
+	case *types.AttributeValueMemberS:
+		return typed.Value, nil
+	case *types.AttributeValueMemberN:
+		return strconv.ParseFloat(typed.Value, 64)
+	case *types.AttributeValueMemberBOOL:
+		return typed.Value, nil
+	case *types.AttributeValueMemberB:
+		return typed.Value, nil
+	case *types.AttributeValueMemberM:
+		return UnmarshalMap(typed.Value)
+	case *types.AttributeValueMemberL:
+		list := make([]interface{}, 0, len(typed.Value))
+		for _, element := range typed.Value {
+			value, errUnmarshal := Unmarshal(element)
+			if errUnmarshal != nil {
+				return nil, errUnmarshal
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case *types.AttributeValueMemberSS:
+		return typed.Value, nil
+	case *types.AttributeValueMemberNS:
+		numbers := make([]float64, 0, len(typed.Value))
+		for _, element := range typed.Value {
+			number, errParse := strconv.ParseFloat(element, 64)
+			if errParse != nil {
+				return nil, errParse
+			}
+			numbers = append(numbers, number)
+		}
+		return numbers, nil
+	case *types.AttributeValueMemberBS:
+		return typed.Value, nil
+	}
+
+	return nil, fmt.Errorf("dynamoattr: unsupported attribute value %T", av)
+}
+
+// UnmarshalMap converts the attributes of an item to a map.
+func UnmarshalMap(item map[string]types.AttributeValue) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(item))
+	for name, av := range item {
+		value, errUnmarshal := Unmarshal(av)
+		if errUnmarshal != nil {
+			return nil, errUnmarshal
+		}
+		result[name] = value
+	}
+	return result, nil
+}
+
+// String gets the value of a string attribute, or an empty string if the attribute
+// is missing, NULL or of another type.
+func String(av types.AttributeValue) string {
+	if typed, ok := av.(*types.AttributeValueMemberS); ok {
+		return typed.Value
+	}
+	return ""
+}
+
+// Int64 gets the value of a number attribute that holds an integer.
+func Int64(av types.AttributeValue) (int64, error) {
+	typed, ok := av.(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, fmt.Errorf("dynamoattr: expected a number, not %T", av)
+	}
+	return strconv.ParseInt(typed.Value, 10, 64)
+}
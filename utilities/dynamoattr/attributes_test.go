@@ -0,0 +1,97 @@
+package dynamoattr
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// sample is a struct written through its JSON encoding
+type sample struct {
+	Name    string            `json:"name"`
+	Count   int64             `json:"count"`
+	Skipped string            `json:"skipped,omitempty"`
+	Tags    []string          `json:"tags"`
+	Labels  map[string]string `json:"labels"`
+	At      time.Time         `json:"at"`
+}
+
+// TestMarshal checks values are written as the original SDK wrote them
+func TestMarshal(t *testing.T) {
+	item, errMarshal := MarshalMap(sample{
+		Name:   "example",
+		Count:  9007199254740993,
+		Tags:   []string{"a", ""},
+		Labels: map[string]string{"k": "v"},
+		At:     time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	assert.Nil(t, errMarshal)
+	assert.Equal(t, map[string]types.AttributeValue{
+		"name":  &types.AttributeValueMemberS{Value: "example"},
+		"count": &types.AttributeValueMemberN{Value: "9007199254740993"},
+		"tags": &types.AttributeValueMemberL{Value: []types.AttributeValue{
+			&types.AttributeValueMemberS{Value: "a"},
+			&types.AttributeValueMemberNULL{Value: true},
+		}},
+		"labels": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			"k": &types.AttributeValueMemberS{Value: "v"},
+		}},
+		"at": &types.AttributeValueMemberS{Value: "2018-01-02T03:04:05Z"},
+	}, item)
+
+	av, _ := Marshal([]byte("raw"))
+	assert.Equal(t, &types.AttributeValueMemberB{Value: []byte("raw")}, av)
+	av, _ = Marshal(1.5)
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "1.5"}, av)
+	av, _ = Marshal(json.Number("12"))
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "12"}, av)
+	av, _ = Marshal(nil)
+	assert.Equal(t, &types.AttributeValueMemberNULL{Value: true}, av)
+	av, _ = Marshal(map[int]string{1: "one"})
+	assert.Equal(t, &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+		"1": &types.AttributeValueMemberS{Value: "one"},
+	}}, av)
+
+	_, errMarshal = MarshalMap("not a map")
+	assert.NotNil(t, errMarshal)
+	_, errMarshal = Marshal(make(chan int))
+	assert.NotNil(t, errMarshal)
+}
+
+// TestUnmarshal checks attribute values are read as encoding/json reads them
+func TestUnmarshal(t *testing.T) {
+	value, errUnmarshal := UnmarshalMap(map[string]types.AttributeValue{
+		"name":   &types.AttributeValueMemberS{Value: "example"},
+		"count":  &types.AttributeValueMemberN{Value: "3"},
+		"empty":  &types.AttributeValueMemberNULL{Value: true},
+		"flag":   &types.AttributeValueMemberBOOL{Value: true},
+		"raw":    &types.AttributeValueMemberB{Value: []byte("raw")},
+		"list":   &types.AttributeValueMemberL{Value: []types.AttributeValue{&types.AttributeValueMemberN{Value: "1.5"}}},
+		"nested": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{"k": &types.AttributeValueMemberS{Value: "v"}}},
+		"set":    &types.AttributeValueMemberNS{Value: []string{"1", "2"}},
+	})
+	assert.Nil(t, errUnmarshal)
+	assert.Equal(t, map[string]interface{}{
+		"name":   "example",
+		"count":  float64(3),
+		"empty":  nil,
+		"flag":   true,
+		"raw":    []byte("raw"),
+		"list":   []interface{}{1.5},
+		"nested": map[string]interface{}{"k": "v"},
+		"set":    []float64{1, 2},
+	}, value)
+
+	_, errUnmarshal = Unmarshal(&types.AttributeValueMemberN{Value: "not a number"})
+	assert.NotNil(t, errUnmarshal)
+
+	seq, errSeq := Int64(&types.AttributeValueMemberN{Value: "42"})
+	assert.Nil(t, errSeq)
+	assert.Equal(t, int64(42), seq)
+	_, errSeq = Int64(&types.AttributeValueMemberS{Value: "42"})
+	assert.NotNil(t, errSeq)
+	assert.Equal(t, "", String(nil))
+}
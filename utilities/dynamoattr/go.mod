@@ -0,0 +1,17 @@
+module github.com/go-gadgets/eventsourcing/utilities/dynamoattr
+
+go 1.24.0
+
+require (
+	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.53.5
+	github.com/stretchr/testify v1.5.1
+)
+
+require (
+	github.com/aws/smithy-go v1.24.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/kr/pretty v0.3.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
+	gopkg.in/yaml.v2 v2.3.0 // indirect
+)
@@ -0,0 +1,133 @@
+/*
+Package features contains feature flag providers that source their flags from
+remote services, for use with AggregateBase.UseFeatureFlags.
+*/
+package features
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RemoteProvider is a feature flag provider that periodically fetches a JSON
+// document of flags from a URL. The document is an object of flag names to
+// booleans, optionally with per-aggregate overrides:
+//
+//	{
+//	  "flags": {"new-pricing": true},
+//	  "overrides": {"new-pricing": {"customer-123": false}}
+//	}
+type RemoteProvider struct {
+	url     string        // URL of the flag document
+	client  *http.Client  // HTTP client to use
+	lock    sync.RWMutex  // Guards the current document
+	current document      // Most recently fetched document
+	stop    chan struct{} // Stops the refresh loop
+	done    chan struct{} // Closed once the refresh loop exits
+}
+
+// document is the JSON structure served by the remote endpoint.
+type document struct {
+	Flags     map[string]bool            `json:"flags"`
+	Overrides map[string]map[string]bool `json:"overrides"`
+}
+
+// NewRemoteProvider creates a provider that fetches flags from the URL, and then
+// refreshes them on the specified interval. The initial fetch must succeed; if
+// later refreshes fail, the last known flags continue to be used.
+func NewRemoteProvider(url string, interval time.Duration) (*RemoteProvider, error) {
+	return NewRemoteProviderWithClient(url, interval, http.DefaultClient)
+}
+
+// NewRemoteProviderWithClient creates a remote provider using a specific HTTP
+// client (BYO-instance).
+func NewRemoteProviderWithClient(url string, interval time.Duration, client *http.Client) (*RemoteProvider, error) {
+	provider := &RemoteProvider{
+		url:    url,
+		client: client,
+	}
+
+	errFetch := provider.Refresh()
+	if errFetch != nil {
+		return nil, errFetch
+	}
+
+	if interval > 0 {
+		provider.stop = make(chan struct{})
+		provider.done = make(chan struct{})
+		go provider.run(interval)
+	}
+
+	return provider, nil
+}
+
+// FeatureEnabled determines if a flag is enabled for the specified aggregate.
+func (provider *RemoteProvider) FeatureEnabled(flag string, aggregateKey string) (bool, error) {
+	provider.lock.RLock()
+	defer provider.lock.RUnlock()
+
+	if override, found := provider.current.Overrides[flag][aggregateKey]; found {
+		return override, nil
+	}
+
+	return provider.current.Flags[flag], nil
+}
+
+// Refresh fetches the flag document immediately.
+func (provider *RemoteProvider) Refresh() error {
+	response, errGet := provider.client.Get(provider.url)
+	if errGet != nil {
+		return errGet
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("features: fetching %v returned status %v", provider.url, response.StatusCode)
+	}
+
+	fetched := document{}
+	errDecode := json.NewDecoder(response.Body).Decode(&fetched)
+	if errDecode != nil {
+		return errDecode
+	}
+
+	provider.lock.Lock()
+	provider.current = fetched
+	provider.lock.Unlock()
+	return nil
+}
+
+// Close stops refreshing flags.
+func (provider *RemoteProvider) Close() error {
+	if provider.stop != nil {
+		close(provider.stop)
+		<-provider.done
+		provider.stop = nil
+	}
+
+	return nil
+}
+
+// run refreshes the flags on an interval.
+func (provider *RemoteProvider) run(interval time.Duration) {
+	defer close(provider.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-provider.stop:
+			return
+		case <-ticker.C:
+			errRefresh := provider.Refresh()
+			if errRefresh != nil {
+				logrus.WithError(errRefresh).WithField("url", provider.url).Warn("feature_refresh_error")
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package features
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRemoteProvider checks flags and overrides are read from the document.
+func TestRemoteProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"flags": {"new-pricing": true}, "overrides": {"new-pricing": {"legacy": false}}}`))
+	}))
+	defer server.Close()
+
+	provider, errCreate := NewRemoteProvider(server.URL, 0)
+	require.Nil(t, errCreate)
+	defer provider.Close()
+
+	enabled, _ := provider.FeatureEnabled("new-pricing", "customer")
+	assert.True(t, enabled)
+	enabled, _ = provider.FeatureEnabled("new-pricing", "legacy")
+	assert.False(t, enabled, "Overrides should take precedence")
+	enabled, _ = provider.FeatureEnabled("unknown", "customer")
+	assert.False(t, enabled)
+}
+
+// TestRemoteProviderRefresh checks flags are refreshed on the interval, and the
+// last known flags survive a failed refresh.
+func TestRemoteProviderRefresh(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.Write([]byte(`{"flags": {"a": false}}`))
+		case 2:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(`{"flags": {"a": true}}`))
+		}
+	}))
+	defer server.Close()
+
+	provider, errCreate := NewRemoteProvider(server.URL, 5*time.Millisecond)
+	require.Nil(t, errCreate)
+	defer provider.Close()
+
+	deadline := time.Now().Add(time.Second)
+	enabled := false
+	for !enabled && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		enabled, _ = provider.FeatureEnabled("a", "key")
+	}
+	assert.True(t, enabled)
+}
+
+// TestRemoteProviderUnavailable checks the initial fetch must succeed.
+func TestRemoteProviderUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, errCreate := NewRemoteProvider(server.URL, 0)
+	assert.NotNil(t, errCreate)
+}
@@ -0,0 +1,133 @@
+/*
+Package health serves the health of event stores (and any other component that
+implements eventsourcing.HealthChecker) over HTTP, so that services can wire their
+stores into readiness probes rather than discovering a broken connection on the
+first commit:
+
+	probe := health.New(2 * time.Second)
+	probe.Add("events", store)
+	probe.Add("snapshots", snapshotStore)
+	router.GET("/ready", probe.Handler())
+
+Components are checked concurrently, each within the timeout. The probe responds
+with 200 OK if every component is healthy, and 503 Service Unavailable with the
+error of each unhealthy component otherwise. Components that can't check their
+health are reported as healthy.
+*/
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// DefaultTimeout is the time each component has to respond, if no timeout is set.
+const DefaultTimeout = 5 * time.Second
+
+// Report is the health of the components, as served to clients.
+type Report struct {
+	Healthy bool              `json:"healthy"` // Set if every component is healthy
+	Checks  map[string]string `json:"checks"`  // "ok", or the error, by component name
+}
+
+// Probe checks the health of a set of named components.
+type Probe struct {
+	timeout    time.Duration
+	lock       sync.Mutex
+	names      []string
+	components map[string]interface{}
+}
+
+// New creates a probe with no components, which gives each component the timeout
+// to respond.
+func New(timeout time.Duration) *Probe {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	return &Probe{
+		timeout:    timeout,
+		names:      make([]string, 0),
+		components: make(map[string]interface{}),
+	}
+}
+
+// Add adds a named component to the probe, replacing any with the same name.
+func (probe *Probe) Add(name string, component interface{}) {
+	probe.lock.Lock()
+	defer probe.lock.Unlock()
+
+	if _, exists := probe.components[name]; !exists {
+		probe.names = append(probe.names, name)
+	}
+	probe.components[name] = component
+}
+
+// Check checks the health of every component.
+func (probe *Probe) Check(ctx context.Context) Report {
+	probe.lock.Lock()
+	names := append([]string{}, probe.names...)
+	components := make([]interface{}, len(names))
+	for index, name := range names {
+		components[index] = probe.components[name]
+	}
+	probe.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, probe.timeout)
+	defer cancel()
+
+	results := make([]error, len(names))
+	wait := sync.WaitGroup{}
+	for index := range components {
+		wait.Add(1)
+		go func(index int) {
+			defer wait.Done()
+			results[index] = eventsourcing.Ping(ctx, components[index])
+		}(index)
+	}
+	wait.Wait()
+
+	report := Report{
+		Healthy: true,
+		Checks:  make(map[string]string, len(names)),
+	}
+	for index, name := range names {
+		if results[index] != nil {
+			report.Healthy = false
+			report.Checks[name] = results[index].Error()
+		} else {
+			report.Checks[name] = "ok"
+		}
+	}
+	return report
+}
+
+// status gets the HTTP status of a report
+func (report Report) status() int {
+	if report.Healthy {
+		return http.StatusOK
+	}
+	return http.StatusServiceUnavailable
+}
+
+// Handler gets a gin handler that serves the health of the components.
+func (probe *Probe) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := probe.Check(c.Request.Context())
+		c.JSON(report.status(), report)
+	}
+}
+
+// ServeHTTP serves the health of the components, for use without gin.
+func (probe *Probe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := probe.Check(r.Context())
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(report.status())
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,77 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+// pingFunc is a component that checks its health with a function
+type pingFunc func(ctx context.Context) error
+
+func (ping pingFunc) Ping(ctx context.Context) error {
+	return ping(ctx)
+}
+
+// TestCheck checks each component is reported
+func TestCheck(t *testing.T) {
+	probe := New(time.Second)
+	probe.Add("memory", memory.NewStore())
+	probe.Add("unchecked", struct{}{})
+	assert.Equal(t, Report{Healthy: true, Checks: map[string]string{"memory": "ok", "unchecked": "ok"}}, probe.Check(context.Background()))
+
+	probe.Add("broken", pingFunc(func(ctx context.Context) error { return errors.New("Connection refused") }))
+	report := probe.Check(context.Background())
+	assert.False(t, report.Healthy)
+	assert.Equal(t, "Connection refused", report.Checks["broken"])
+	assert.Equal(t, "ok", report.Checks["memory"])
+}
+
+// TestCheckTimeout checks components that don't respond in time are unhealthy
+func TestCheckTimeout(t *testing.T) {
+	probe := New(10 * time.Millisecond)
+	probe.Add("hung", pingFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+
+	report := probe.Check(context.Background())
+	assert.False(t, report.Healthy)
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks["hung"])
+}
+
+// TestHandler checks the health is served through gin and net/http.
+func TestHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := memory.NewStore()
+	probe := New(time.Second)
+	probe.Add("events", store)
+	router := gin.New()
+	router.GET("/ready", probe.Handler())
+
+	for _, handler := range []http.Handler{router, probe} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	}
+
+	store.Close()
+	for _, handler := range []http.Handler{router, probe} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+		report := Report{}
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+		assert.False(t, report.Healthy)
+		assert.Contains(t, report.Checks["events"], "closed")
+	}
+}
@@ -0,0 +1,66 @@
+package httpfault
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RequestFactory builds a request to send. It is called for every attempt, since
+// request bodies cannot be re-read.
+type RequestFactory func() (*http.Request, error)
+
+// Do sends a request, retrying up to limit attempts whilst the server responds
+// with a concurrency fault (409 or 412). The suggested backoff in the response
+// is honored between attempts. The final response is returned to the caller,
+// who is responsible for closing its body.
+func Do(client *http.Client, limit int, factory RequestFactory) (*http.Response, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	attempt := 1
+	for {
+		request, errRequest := factory()
+		if errRequest != nil {
+			return nil, errRequest
+		}
+
+		response, errResponse := client.Do(request)
+		if errResponse != nil {
+			return nil, errResponse
+		}
+
+		if !isRetryable(response) || attempt >= limit {
+			return response, nil
+		}
+
+		backoff := retryAfter(response)
+		response.Body.Close()
+		time.Sleep(backoff)
+		attempt++
+	}
+}
+
+// isRetryable checks if a response indicates a concurrency fault.
+func isRetryable(response *http.Response) bool {
+	return response.StatusCode == http.StatusConflict || response.StatusCode == http.StatusPreconditionFailed
+}
+
+// retryAfter determines the backoff requested by the server, preferring the
+// precise value in the body over the Retry-After header.
+func retryAfter(response *http.Response) time.Duration {
+	var body FaultResponse
+	errDecode := json.NewDecoder(response.Body).Decode(&body)
+	if errDecode == nil && body.RetryAfterMS > 0 {
+		return time.Duration(body.RetryAfterMS) * time.Millisecond
+	}
+
+	seconds, errParse := strconv.Atoi(response.Header.Get("Retry-After"))
+	if errParse == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	return DefaultRetryBackoff
+}
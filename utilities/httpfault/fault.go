@@ -0,0 +1,148 @@
+/*
+Package httpfault maps eventsourcing faults onto HTTP responses, giving clients a
+well-defined optimistic-concurrency protocol:
+
+	409 Conflict            - A ConcurrencyFault occurred, the command can be retried.
+	412 Precondition Failed - A ConcurrencyFault occurred for a request with an If-Match header.
+	422 Unprocessable       - A DomainFault occurred, the command was rejected by the model,
+	                          or an EventValidationFault occurred, an event failed validation.
+	503 Service Unavailable - A StoreUnavailableFault occurred, the store is failing fast.
+	500 Internal Error      - Any other error.
+
+Concurrency responses carry a Retry-After header and a machine readable body that
+includes the sequence another writer took first (which is not necessarily the
+latest) and a suggested backoff, which the Do client helper honors when retrying. Unavailable responses carry the time until the
+store will be tried again in the same way.
+*/
+package httpfault
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+const (
+	// DefaultRetryBackoff is the base backoff suggested to clients after a
+	// concurrency fault.
+	DefaultRetryBackoff = 50 * time.Millisecond
+
+	// ErrorConcurrency is the error code for concurrency faults
+	ErrorConcurrency = "concurrency_fault"
+
+	// ErrorDomain is the error code for domain faults
+	ErrorDomain = "domain_fault"
+
+	// ErrorValidation is the error code for event validation faults
+	ErrorValidation = "validation_fault"
+
+	// ErrorUnavailable is the error code for store unavailable faults
+	ErrorUnavailable = "store_unavailable"
+
+	// ErrorInternal is the error code for all other errors
+	ErrorInternal = "internal_error"
+)
+
+// FaultResponse is the body written for a failed request.
+type FaultResponse struct {
+	Error               string   `json:"error"`                          // Error code (concurrency_fault, domain_fault, validation_fault, store_unavailable, internal_error)
+	Message             string   `json:"message"`                        // Human readable message
+	AggregateKey        string   `json:"aggregate_key,omitempty"`        // Aggregate that faulted
+	ConflictingSequence int64    `json:"conflicting_sequence,omitempty"` // Sequence another writer took first, not the latest (concurrency faults)
+	EventSequence       int64    `json:"event_sequence,omitempty"`       // Sequence the rejected event would have been written at (validation faults)
+	FaultCode           string   `json:"fault_code,omitempty"`           // Fault code (domain faults)
+	Violations          []string `json:"violations,omitempty"`           // Failed rules (validation faults)
+	RetryAfterMS        int64    `json:"retry_after_ms,omitempty"`       // Suggested backoff before retrying, in milliseconds
+}
+
+// Translate converts an error into an HTTP status code and response body. The
+// backoff is the suggested delay to include in concurrency fault responses.
+func Translate(request *http.Request, err error, backoff time.Duration) (int, FaultResponse) {
+	isConcurrency, concurrency := eventsourcing.IsConcurrencyFault(err)
+	if isConcurrency {
+		status := http.StatusConflict
+		if request != nil && request.Header.Get("If-Match") != "" {
+			status = http.StatusPreconditionFailed
+		}
+
+		return status, FaultResponse{
+			Error:               ErrorConcurrency,
+			Message:             err.Error(),
+			AggregateKey:        concurrency.AggregateKey,
+			ConflictingSequence: concurrency.EventSequence,
+			RetryAfterMS:        jitter(backoff).Nanoseconds() / int64(time.Millisecond),
+		}
+	}
+
+	isDomain, domain := eventsourcing.IsDomainFault(err)
+	if isDomain {
+		return http.StatusUnprocessableEntity, FaultResponse{
+			Error:        ErrorDomain,
+			Message:      err.Error(),
+			AggregateKey: domain.AggregateKey,
+			FaultCode:    domain.FaultCode,
+		}
+	}
+
+	isValidation, validation := eventsourcing.IsEventValidationFault(err)
+	if isValidation {
+		return http.StatusUnprocessableEntity, FaultResponse{
+			Error:         ErrorValidation,
+			Message:       err.Error(),
+			AggregateKey:  validation.AggregateKey,
+			EventSequence: validation.EventSequence,
+			FaultCode:     string(validation.EventType),
+			Violations:    validation.Violations,
+		}
+	}
+
+	isUnavailable, unavailable := eventsourcing.IsStoreUnavailableFault(err)
+	if isUnavailable {
+		return http.StatusServiceUnavailable, FaultResponse{
+			Error:        ErrorUnavailable,
+			Message:      err.Error(),
+			RetryAfterMS: unavailable.RetryAfter.Nanoseconds() / int64(time.Millisecond),
+		}
+	}
+
+	return http.StatusInternalServerError, FaultResponse{
+		Error:   ErrorInternal,
+		Message: err.Error(),
+	}
+}
+
+// WriteFault writes an error to a response, using DefaultRetryBackoff as the
+// suggested backoff for concurrency faults.
+func WriteFault(writer http.ResponseWriter, request *http.Request, err error) {
+	WriteFaultWithBackoff(writer, request, err, DefaultRetryBackoff)
+}
+
+// WriteFaultWithBackoff writes an error to a response, suggesting the specified
+// backoff for concurrency faults.
+func WriteFaultWithBackoff(writer http.ResponseWriter, request *http.Request, err error, backoff time.Duration) {
+	status, body := Translate(request, err, backoff)
+
+	if body.RetryAfterMS > 0 {
+		// Retry-After is in whole seconds, so round up
+		seconds := (body.RetryAfterMS + 999) / 1000
+		writer.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(&body)
+}
+
+// jitter randomizes a backoff between 50% and 150% of its value, so that
+// clients that conflicted together don't retry together.
+func jitter(backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return 0
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+}
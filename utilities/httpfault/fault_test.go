@@ -0,0 +1,111 @@
+package httpfault
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestTranslateConcurrencyFault checks concurrency faults map to 409 with retry hints.
+func TestTranslateConcurrencyFault(t *testing.T) {
+	fault := eventsourcing.NewConcurrencyFault("dummy-key", 12)
+	request := httptest.NewRequest("POST", "/dummy-key/increment", nil)
+
+	status, body := Translate(request, fault, time.Second)
+
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, ErrorConcurrency, body.Error)
+	assert.Equal(t, "dummy-key", body.AggregateKey)
+	assert.Equal(t, int64(12), body.ConflictingSequence)
+	assert.True(t, body.RetryAfterMS >= 500 && body.RetryAfterMS <= 1500)
+	assert.Equal(t, int64(0), body.EventSequence)
+
+	request.Header.Set("If-Match", "11")
+	status, _ = Translate(request, fault, time.Second)
+	assert.Equal(t, http.StatusPreconditionFailed, status)
+}
+
+// TestTranslateOtherFaults checks domain faults and other errors are mapped.
+func TestTranslateOtherFaults(t *testing.T) {
+	status, body := Translate(nil, eventsourcing.NewDomainFault("dummy-key", "limit_reached"), time.Second)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Equal(t, "limit_reached", body.FaultCode)
+	assert.Equal(t, int64(0), body.RetryAfterMS)
+
+	status, body = Translate(nil, eventsourcing.NewEventValidationFault("dummy-key", 4, "IncrementEvent", []string{"IncrementBy: min=1"}), time.Second)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Equal(t, ErrorValidation, body.Error)
+	assert.Equal(t, []string{"IncrementBy: min=1"}, body.Violations)
+
+	status, body = Translate(nil, eventsourcing.NewStoreUnavailableFault("no reachable servers", 2*time.Second), time.Second)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, ErrorUnavailable, body.Error)
+	assert.Equal(t, int64(2000), body.RetryAfterMS)
+
+	status, body = Translate(nil, errors.New("broken"), time.Second)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, ErrorInternal, body.Error)
+}
+
+// TestWriteFault checks the response headers and body are written.
+func TestWriteFault(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/dummy-key/increment", nil)
+
+	WriteFaultWithBackoff(recorder, request, eventsourcing.NewConcurrencyFault("dummy-key", 3), 1500*time.Millisecond)
+
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.NotEmpty(t, recorder.Header().Get("Retry-After"))
+
+	var body FaultResponse
+	assert.Nil(t, json.NewDecoder(recorder.Body).Decode(&body))
+	assert.Equal(t, int64(3), body.ConflictingSequence)
+}
+
+// TestClientRetries checks the client retries concurrency faults and then succeeds.
+func TestClientRetries(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls++
+		if calls < 3 {
+			WriteFaultWithBackoff(writer, request, eventsourcing.NewConcurrencyFault("dummy-key", int64(calls)), time.Millisecond)
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	response, errDo := Do(nil, 5, func() (*http.Request, error) {
+		return http.NewRequest("POST", server.URL, nil)
+	})
+	assert.Nil(t, errDo)
+	defer response.Body.Close()
+
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, 3, calls)
+}
+
+// TestClientRetryLimit checks the client gives up at the limit.
+func TestClientRetryLimit(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls++
+		WriteFaultWithBackoff(writer, request, eventsourcing.NewConcurrencyFault("dummy-key", 1), time.Millisecond)
+	}))
+	defer server.Close()
+
+	response, errDo := Do(nil, 2, func() (*http.Request, error) {
+		return http.NewRequest("POST", server.URL, nil)
+	})
+	assert.Nil(t, errDo)
+	defer response.Body.Close()
+
+	assert.Equal(t, http.StatusConflict, response.StatusCode)
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,102 @@
+/*
+Package invalidation contains an event handler that keeps external read-side caches
+consistent with the event stream, by mapping selected events onto cache keys that
+should be invalidated.
+
+Cache keys are described with text/template templates, which are executed against
+the eventsourcing.PublishedEvent, i.e:
+
+	handler := invalidation.Create(invalidation.NewRedisInvalidator(client))
+	handler.On("IncrementEvent", "counter:{{.Key}}", "counters:all")
+	consumer.AddHandler(handler)
+*/
+package invalidation
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-redis/redis"
+)
+
+// Invalidator is an interface for a cache that can have keys removed.
+type Invalidator interface {
+	// Invalidate removes the specified keys from the cache.
+	Invalidate(keys ...string) error
+}
+
+// InvalidatorFunc is a function that acts as an Invalidator, allowing any cache
+// client (i.e. memcached, groupcache) to be adapted.
+type InvalidatorFunc func(keys ...string) error
+
+// Invalidate removes the specified keys from the cache.
+func (fn InvalidatorFunc) Invalidate(keys ...string) error {
+	return fn(keys...)
+}
+
+// Handler is an event handler that invalidates cache keys for events.
+type Handler struct {
+	invalidator Invalidator                                      // Cache to invalidate
+	rules       map[eventsourcing.EventType][]*template.Template // Key templates per event type
+}
+
+// Create a new invalidation handler that removes keys from the specified cache.
+func Create(invalidator Invalidator) *Handler {
+	return &Handler{
+		invalidator: invalidator,
+		rules:       make(map[eventsourcing.EventType][]*template.Template),
+	}
+}
+
+// On registers the key templates to invalidate when an event of the specified
+// type is handled. Templates are executed against the PublishedEvent.
+func (handler *Handler) On(eventType eventsourcing.EventType, keyTemplates ...string) error {
+	for _, text := range keyTemplates {
+		parsed, errParse := template.New(string(eventType)).Option("missingkey=error").Parse(text)
+		if errParse != nil {
+			return errParse
+		}
+
+		handler.rules[eventType] = append(handler.rules[eventType], parsed)
+	}
+
+	return nil
+}
+
+// Handle an event, invalidating any keys configured for its type.
+func (handler *Handler) Handle(event eventsourcing.PublishedEvent) error {
+	templates, found := handler.rules[event.Type]
+	if !found {
+		return nil
+	}
+
+	keys := make([]string, len(templates))
+	for index, keyTemplate := range templates {
+		var buff bytes.Buffer
+		errExecute := keyTemplate.Execute(&buff, event)
+		if errExecute != nil {
+			return errExecute
+		}
+		keys[index] = buff.String()
+	}
+
+	return handler.invalidator.Invalidate(keys...)
+}
+
+// redisInvalidator is an invalidator that deletes keys from Redis.
+type redisInvalidator struct {
+	client *redis.Client
+}
+
+// NewRedisInvalidator creates an invalidator that deletes keys from Redis.
+func NewRedisInvalidator(client *redis.Client) Invalidator {
+	return &redisInvalidator{
+		client: client,
+	}
+}
+
+// Invalidate deletes the keys from Redis.
+func (invalidator *redisInvalidator) Invalidate(keys ...string) error {
+	return invalidator.client.Del(keys...).Err()
+}
@@ -0,0 +1,71 @@
+package invalidation
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/distribution/inproc"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/go-redis/redis"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestHandlerInvalidatesKeys checks templates are expanded for matching events.
+func TestHandlerInvalidatesKeys(t *testing.T) {
+	// Arrange
+	invalidated := make([]string, 0)
+	handler := Create(InvalidatorFunc(func(keys ...string) error {
+		invalidated = append(invalidated, keys...)
+		return nil
+	}))
+	errOn := handler.On("IncrementEvent", "counter:{{.Key}}", "counter:{{.Key}}:{{.Data.IncrementBy}}")
+	assert.Nil(t, errOn)
+
+	dist := inproc.Create(test.GetTestRegistry())
+	dist.AddHandler(handler)
+	dist.Start()
+	defer dist.Stop()
+
+	// Act
+	dist.Publish("dummy", 1, test.IncrementEvent{IncrementBy: 5})
+	dist.Publish("dummy", 2, test.InitializeEvent{TargetValue: 5})
+
+	// Assert
+	assert.Equal(t, []string{"counter:dummy", "counter:dummy:5"}, invalidated)
+}
+
+// TestHandlerInvalidTemplate checks that bad templates are rejected.
+func TestHandlerInvalidTemplate(t *testing.T) {
+	handler := Create(InvalidatorFunc(func(keys ...string) error { return nil }))
+	assert.NotNil(t, handler.On("IncrementEvent", "counter:{{.Key"))
+}
+
+// TestRedisInvalidator checks keys are deleted from Redis.
+func TestRedisInvalidator(t *testing.T) {
+	address := os.Getenv("REDIS_TEST_HOST")
+	if address == "" {
+		address = "localhost:6379"
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr: address,
+	})
+	defer client.Close()
+
+	key := fmt.Sprintf("test-%s", uuid.NewV4())
+	assert.Nil(t, client.Set(key, "cached", 0).Err())
+
+	handler := Create(NewRedisInvalidator(client))
+	handler.On("IncrementEvent", "{{.Key}}")
+	errHandle := handler.Handle(eventsourcing.PublishedEvent{
+		Type: "IncrementEvent",
+		Key:  key,
+	})
+	assert.Nil(t, errHandle)
+
+	exists, errExists := client.Exists(key).Result()
+	assert.Nil(t, errExists)
+	assert.Equal(t, int64(0), exists)
+}
@@ -0,0 +1,44 @@
+package logadapter
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// logrusLogger is a Logger that writes to logrus.
+type logrusLogger struct {
+	logger logrus.FieldLogger
+}
+
+// NewLogrusLogger creates a Logger that writes to a logrus logger or entry, or to
+// the standard logrus logger if nil.
+func NewLogrusLogger(logger logrus.FieldLogger) eventsourcing.Logger {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+
+	return &logrusLogger{
+		logger: logger,
+	}
+}
+
+// Debug logs a diagnostic message
+func (wrapped *logrusLogger) Debug(message string, fields eventsourcing.LogFields) {
+	wrapped.logger.WithFields(logrus.Fields(fields)).Debug(message)
+}
+
+// Info logs an informational message
+func (wrapped *logrusLogger) Info(message string, fields eventsourcing.LogFields) {
+	wrapped.logger.WithFields(logrus.Fields(fields)).Info(message)
+}
+
+// Warn logs a message about a recoverable problem
+func (wrapped *logrusLogger) Warn(message string, fields eventsourcing.LogFields) {
+	wrapped.logger.WithFields(logrus.Fields(fields)).Warn(message)
+}
+
+// Error logs a message about a failure
+func (wrapped *logrusLogger) Error(message string, fields eventsourcing.LogFields) {
+	wrapped.logger.WithFields(logrus.Fields(fields)).Error(message)
+}
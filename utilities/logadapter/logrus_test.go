@@ -0,0 +1,47 @@
+package logadapter
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// recordingHook collects the entries logged.
+type recordingHook struct {
+	entries []*logrus.Entry
+}
+
+func (hook *recordingHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook *recordingHook) Fire(entry *logrus.Entry) error {
+	hook.entries = append(hook.entries, entry)
+	return nil
+}
+
+// TestLogrusLogger checks messages reach logrus at their level, with their fields.
+func TestLogrusLogger(t *testing.T) {
+	hook := &recordingHook{}
+	base := logrus.New()
+	base.Out = ioutil.Discard
+	base.SetLevel(logrus.DebugLevel)
+	base.AddHook(hook)
+	logger := NewLogrusLogger(base)
+
+	logger.Debug("debug", eventsourcing.LogFields{"key": "abc"})
+	logger.Info("info", nil)
+	logger.Warn("warn", nil)
+	logger.Error("error", eventsourcing.LogFields{"seq": 3})
+
+	assert.Len(t, hook.entries, 4)
+	assert.Equal(t, logrus.DebugLevel, hook.entries[0].Level)
+	assert.Equal(t, "abc", hook.entries[0].Data["key"])
+	assert.Equal(t, logrus.WarnLevel, hook.entries[2].Level)
+	assert.Equal(t, "error", hook.entries[3].Message)
+	assert.Equal(t, 3, hook.entries[3].Data["seq"])
+}
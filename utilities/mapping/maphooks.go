@@ -1,8 +1,12 @@
 package mapping
 
 import (
+	"encoding"
+	"fmt"
 	"reflect"
 	"time"
+
+	"github.com/mitchellh/mapstructure"
 )
 
 // MapTimeFromJSON is a decoder hook that maps time data from JSON values, avoiding the issue
@@ -15,3 +19,67 @@ func MapTimeFromJSON(f reflect.Type, t reflect.Type, data interface{}) (interfac
 
 	return data, nil
 }
+
+// MapTextUnmarshaler is a decoder hook that revives types implementing encoding.TextUnmarshaler
+// (i.e. UUID wrappers) from the string form they were serialized to.
+func MapTextUnmarshaler(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+	if f == nil || f.Kind() != reflect.String || t.Kind() == reflect.String {
+		return data, nil
+	}
+
+	target := reflect.New(t)
+	unmarshaler, ok := target.Interface().(encoding.TextUnmarshaler)
+	if !ok {
+		return data, nil
+	}
+
+	errUnmarshal := unmarshaler.UnmarshalText([]byte(reflect.ValueOf(data).String()))
+	if errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+
+	return target.Elem().Interface(), nil
+}
+
+// TypeAdapter converts a serialized value (string, number etc.) into an instance
+// of a custom type, such as a value-object identifier.
+type TypeAdapter func(data interface{}) (interface{}, error)
+
+// TypeAdapters is a set of type adapters, keyed by the type they produce.
+type TypeAdapters map[reflect.Type]TypeAdapter
+
+// Register adds an adapter that produces values of the same type as the
+// example value.
+func (adapters TypeAdapters) Register(example interface{}, adapter TypeAdapter) {
+	adapters[reflect.TypeOf(example)] = adapter
+}
+
+// MapAdapters is a decoder hook that applies any registered type adapters.
+func (adapters TypeAdapters) MapAdapters(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+	adapter, found := adapters[t]
+	if !found || f == t || data == nil {
+		return data, nil
+	}
+
+	result, errAdapt := adapter(data)
+	if errAdapt != nil {
+		return nil, fmt.Errorf("Could not adapt %v to %v: %v", data, t, errAdapt)
+	}
+
+	return result, nil
+}
+
+// DecodeHook builds the complete decoder hook for the adapters, which includes
+// the standard time and text-unmarshaling hooks.
+func (adapters TypeAdapters) DecodeHook() mapstructure.DecodeHookFunc {
+	return mapstructure.ComposeDecodeHookFunc(
+		adapters.MapAdapters,
+		MapTimeFromJSON,
+		MapTextUnmarshaler,
+	)
+}
+
+// DefaultDecodeHook is the decoder hook to use when no type adapters are available.
+func DefaultDecodeHook() mapstructure.DecodeHookFunc {
+	return TypeAdapters{}.DecodeHook()
+}
@@ -0,0 +1,304 @@
+/*
+Package migrate copies every stream from one event store to another, for moving
+between backends or seeding an environment:
+
+	report, errMigrate := migrate.Run(prewarm.FeedKeys(source.(eventsourcing.GlobalReader), 0), source, target, registry, migrate.Options{
+		Tracker:          tracker,
+		CommitsPerSecond: 200,
+		Verify:           true,
+	})
+
+Streams are copied one at a time, in the order the key source visits them, keeping
+their sequence numbers. Progress is recorded in the tracker (the same interface as
+mongo.ProgressTracker) as the number of keys finished, so an interrupted migration
+resumes after the last stream it finished, and a stream that was partly copied
+continues after the last event the target holds. Key sources must visit keys in a
+stable order for progress to be meaningful, as the feed does.
+
+Events are copied in commits of up to BatchSize events, admitted at the rate
+given. Once copied, a stream can be verified by comparing it event by event with
+the source (see mirror.Diff). Streams are read from the source without an
+aggregate, so neither store should have snapshot middleware attached, and event
+metadata (such as the category) is not copied.
+*/
+package migrate
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/mirror"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/ratelimit"
+	"github.com/go-gadgets/eventsourcing/utilities/prewarm"
+)
+
+// DefaultBatchSize is the most events written in a single commit, if no other
+// size is specified.
+const DefaultBatchSize = 500
+
+// Tracker stores the progress of a migration, as the number of keys finished. A
+// mongo.ProgressTracker can be used, and negative start positions (such as
+// mongo.InitialPositionTrimHorizon) start from the first key.
+type Tracker interface {
+	// StartPosition gets the number of keys finished by earlier runs
+	StartPosition() (int64, error)
+
+	// UpdatePosition records the number of keys finished
+	UpdatePosition(int64) error
+}
+
+// ErrorCallback decides what happens when a stream can't be copied. Returning nil
+// skips the stream and carries on, returning an error stops the migration.
+type ErrorCallback func(key string, err error) error
+
+// Options configures a migration.
+type Options struct {
+	Tracker          Tracker                     // Records progress, so the migration can resume, if set
+	BatchSize        int                         // Most events written in a single commit
+	CommitsPerSecond float64                     // Average rate commits are written at, zero for no limit
+	Verify           bool                        // Compare each stream with the source once copied
+	OnError          ErrorCallback               // Decides what to do with failures, defaults to stopping
+	OnProgress       func(key string, err error) // Called after each stream, if set
+	Clock            eventsourcing.Clock         // Source of time for the rate limit, the system clock by default
+}
+
+// Report describes the result of a migration.
+type Report struct {
+	Streams int              // Streams visited, including those finished by earlier runs
+	Resumed int              // Streams skipped as finished by earlier runs
+	Copied  int              // Streams that had events copied
+	Events  int64            // Events copied
+	Failed  map[string]error // Failures that were skipped, by key
+}
+
+// Run copies the stream of every key from the source store to the target store.
+// The report covers the streams visited before any error stopped the migration.
+func Run(keys prewarm.KeySource, source eventsourcing.EventStore, target eventsourcing.EventStore, registry eventsourcing.EventRegistry, options Options) (Report, error) {
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBatchSize
+	}
+	if options.OnError == nil {
+		options.OnError = func(key string, err error) error {
+			return fmt.Errorf("Migration error: Stream %v failed to copy: %v", key, err)
+		}
+	}
+
+	var limiter *ratelimit.Limiter
+	if options.CommitsPerSecond > 0 {
+		limiter = ratelimit.NewLimiter(ratelimit.Options{
+			CommitsPerSecond: options.CommitsPerSecond,
+			Timeout:          time.Duration(math.MaxInt64),
+			Clock:            options.Clock,
+		})
+	}
+
+	start := int64(0)
+	if options.Tracker != nil {
+		position, errStart := options.Tracker.StartPosition()
+		if errStart != nil {
+			return Report{}, errStart
+		}
+		if position > 0 {
+			start = position
+		}
+	}
+
+	report := Report{Failed: make(map[string]error)}
+	errKeys := keys(func(key string) error {
+		report.Streams++
+		if int64(report.Streams) <= start {
+			report.Resumed++
+			return nil
+		}
+
+		copier := &copier{
+			key:      key,
+			source:   source,
+			target:   target,
+			registry: registry,
+			options:  options,
+			limiter:  limiter,
+		}
+		copied, errCopy := copier.run()
+		if options.OnProgress != nil {
+			options.OnProgress(key, errCopy)
+		}
+		if errCopy != nil {
+			errStop := options.OnError(key, errCopy)
+			if errStop != nil {
+				return errStop
+			}
+			report.Failed[key] = errCopy
+		} else if copied > 0 {
+			report.Copied++
+			report.Events += copied
+		}
+
+		if options.Tracker != nil {
+			return options.Tracker.UpdatePosition(int64(report.Streams))
+		}
+		return nil
+	})
+
+	return report, errKeys
+}
+
+// copier copies a single stream
+type copier struct {
+	key      string
+	source   eventsourcing.EventStore
+	target   eventsourcing.EventStore
+	registry eventsourcing.EventRegistry
+	options  Options
+	limiter  *ratelimit.Limiter
+}
+
+// run copies the events the target doesn't hold yet, and verifies the stream,
+// returning the number of events copied.
+func (copier *copier) run() (int64, error) {
+	from, errVersion := eventsourcing.Version(copier.target, copier.key)
+	if errVersion != nil {
+		return 0, errVersion
+	}
+
+	loader := &streamLoader{
+		key:      copier.key,
+		registry: copier.registry,
+		sequence: from,
+		events:   make([]eventsourcing.Event, 0),
+	}
+	errRefresh := copier.source.Refresh(loader)
+	if errRefresh != nil {
+		return 0, errRefresh
+	}
+
+	// Some middleware ignores a refused snapshot, so check for one here
+	if loader.snapshot > 0 {
+		return 0, errSnapshot(copier.key, loader.snapshot)
+	}
+
+	for offset := 0; offset < len(loader.events); offset += copier.options.BatchSize {
+		end := offset + copier.options.BatchSize
+		if end > len(loader.events) {
+			end = len(loader.events)
+		}
+
+		errCommit := copier.commit(&streamWriter{
+			key:      copier.key,
+			registry: copier.registry,
+			sequence: from + int64(offset),
+			events:   loader.events[offset:end],
+		})
+		if errCommit != nil {
+			return int64(offset), errCommit
+		}
+	}
+
+	if copier.options.Verify {
+		mismatch, errDiff := mirror.Diff(copier.source, copier.target, copier.registry, copier.key)
+		if errDiff != nil {
+			return int64(len(loader.events)), errDiff
+		}
+		if mismatch != nil {
+			return int64(len(loader.events)), fmt.Errorf("Migration error: Stream %v differs after copying: %v", copier.key, mismatch.Detail)
+		}
+	}
+
+	return int64(len(loader.events)), nil
+}
+
+// commit writes a batch of events to the target, at the rate allowed
+func (copier *copier) commit(writer *streamWriter) error {
+	if copier.limiter == nil {
+		return copier.target.CommitEvents(writer)
+	}
+	return copier.limiter.Call(true, func() error {
+		return copier.target.CommitEvents(writer)
+	})
+}
+
+// streamLoader is a loader adapter that collects the events of a stream, rather
+// than applying them to an aggregate.
+type streamLoader struct {
+	key      string
+	registry eventsourcing.EventRegistry
+	sequence int64
+	snapshot int64 // Sequence of any snapshot offered
+	events   []eventsourcing.Event
+}
+
+// GetKey gets the key of the stream
+func (loader *streamLoader) GetKey() string {
+	return loader.key
+}
+
+// GetEventRegistry gets the registry events are revived with
+func (loader *streamLoader) GetEventRegistry() eventsourcing.EventRegistry {
+	return loader.registry
+}
+
+// SequenceNumber gets the sequence loaded up to
+func (loader *streamLoader) SequenceNumber() int64 {
+	return loader.sequence + int64(len(loader.events))
+}
+
+// IsDirty returns false, as nothing is modified
+func (loader *streamLoader) IsDirty() bool {
+	return false
+}
+
+// ReplayEvent collects an event
+func (loader *streamLoader) ReplayEvent(event eventsourcing.Event) {
+	loader.events = append(loader.events, event)
+}
+
+// RestoreSnapshot refuses snapshots, since the events they replace can't be copied
+func (loader *streamLoader) RestoreSnapshot(sequence int64, snapshot interface{}) error {
+	loader.snapshot = sequence
+	return errSnapshot(loader.key, sequence)
+}
+
+// errSnapshot is the error for a stream restored from a snapshot
+func errSnapshot(key string, sequence int64) error {
+	return fmt.Errorf("Migration error: Stream %v was restored from a snapshot at %v, detach snapshot middleware from the source", key, sequence)
+}
+
+// streamWriter writes a batch of copied events to the target.
+type streamWriter struct {
+	key      string
+	registry eventsourcing.EventRegistry
+	sequence int64
+	events   []eventsourcing.Event
+}
+
+// GetKey gets the key of the stream
+func (writer *streamWriter) GetKey() string {
+	return writer.key
+}
+
+// GetEventRegistry gets the registry of the events
+func (writer *streamWriter) GetEventRegistry() eventsourcing.EventRegistry {
+	return writer.registry
+}
+
+// SequenceNumber gets the sequence after the events
+func (writer *streamWriter) SequenceNumber() int64 {
+	return writer.sequence + int64(len(writer.events))
+}
+
+// IsDirty returns true, as the events are not in the target
+func (writer *streamWriter) IsDirty() bool {
+	return true
+}
+
+// GetUncommittedEvents gets the events to write
+func (writer *streamWriter) GetUncommittedEvents() (int64, []eventsourcing.Event) {
+	return writer.sequence, writer.events
+}
+
+// GetState returns nil, as there is no aggregate state to snapshot
+func (writer *streamWriter) GetState() interface{} {
+	return nil
+}
@@ -0,0 +1,159 @@
+package migrate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/utilities/prewarm"
+	"github.com/go-gadgets/eventsourcing/utilities/simclock"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryTracker is a tracker that keeps its position in memory
+type memoryTracker struct {
+	position int64
+	updates  []int64
+}
+
+func (tracker *memoryTracker) StartPosition() (int64, error) {
+	return tracker.position, nil
+}
+
+func (tracker *memoryTracker) UpdatePosition(position int64) error {
+	tracker.position = position
+	tracker.updates = append(tracker.updates, position)
+	return nil
+}
+
+// countingStore counts the commits made to a store
+type countingStore struct {
+	eventsourcing.EventStore
+	commits int
+}
+
+func (store *countingStore) CommitEvents(writer eventsourcing.StoreWriterAdapter) error {
+	store.commits++
+	return store.EventStore.CommitEvents(writer)
+}
+
+// increment commits increments to an aggregate
+func increment(t *testing.T, store eventsourcing.EventStore, key string, by ...int) {
+	agg := load(t, store, key)
+	for _, value := range by {
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: value})
+	}
+	assert.Nil(t, agg.Commit())
+}
+
+// load refreshes an aggregate from a store
+func load(t *testing.T, store eventsourcing.EventStore, key string) *test.SimpleAggregate {
+	agg := &test.SimpleAggregate{}
+	agg.Initialize(key, test.GetTestRegistry(), store)
+	assert.Nil(t, agg.Refresh())
+	return agg
+}
+
+// newSource creates a store with three streams
+func newSource(t *testing.T) eventsourcing.EventStore {
+	source := memory.NewStore()
+	increment(t, source, "a", 1, 2, 3)
+	increment(t, source, "b", 4, 5)
+	increment(t, source, "c", 6)
+	return source
+}
+
+// TestRun checks every stream is copied and verified
+func TestRun(t *testing.T) {
+	source := newSource(t)
+	target := &countingStore{EventStore: memory.NewStore()}
+	tracker := &memoryTracker{}
+
+	report, errRun := Run(prewarm.FeedKeys(source.(eventsourcing.GlobalReader), 0), source, target, test.GetTestRegistry(), Options{
+		Tracker:   tracker,
+		BatchSize: 2,
+		Verify:    true,
+	})
+	assert.Nil(t, errRun)
+	assert.Equal(t, Report{Streams: 3, Copied: 3, Events: 6, Failed: map[string]error{}}, report)
+	assert.Equal(t, []int64{1, 2, 3}, tracker.updates)
+	assert.Equal(t, 4, target.commits, "Streams should be copied in batches")
+
+	for key, count := range map[string]int{"a": 6, "b": 9, "c": 6} {
+		agg := load(t, target, key)
+		assert.Equal(t, count, agg.CurrentCount)
+	}
+	assert.Equal(t, int64(3), load(t, target, "a").SequenceNumber())
+}
+
+// TestResume checks finished streams are skipped, and partly copied streams
+// continue after the events the target holds
+func TestResume(t *testing.T) {
+	source := newSource(t)
+	target := memory.NewStore()
+	increment(t, target, "b", 4)
+	tracker := &memoryTracker{position: 1}
+
+	report, errRun := Run(prewarm.Keys("a", "b", "c"), source, target, test.GetTestRegistry(), Options{
+		Tracker: tracker,
+		Verify:  true,
+	})
+	assert.Nil(t, errRun)
+	assert.Equal(t, Report{Streams: 3, Resumed: 1, Copied: 2, Events: 2, Failed: map[string]error{}}, report)
+	assert.Equal(t, 0, load(t, target, "a").CurrentCount, "Finished streams should be skipped")
+	assert.Equal(t, 9, load(t, target, "b").CurrentCount)
+	assert.Equal(t, int64(3), tracker.position)
+}
+
+// TestVerifyMismatch checks streams that differ after copying are failures
+func TestVerifyMismatch(t *testing.T) {
+	source := newSource(t)
+	_, errStop := Run(prewarm.Keys("a", "b"), source, memoryWith(t, "a", 10), test.GetTestRegistry(), Options{Verify: true})
+	assert.NotNil(t, errStop, "Failures should stop the migration by default")
+
+	skipped := make([]string, 0)
+	report, errRun := Run(prewarm.Keys("a", "b"), source, memoryWith(t, "a", 10), test.GetTestRegistry(), Options{
+		Verify: true,
+		OnError: func(key string, err error) error {
+			skipped = append(skipped, key)
+			return nil
+		},
+	})
+	assert.Nil(t, errRun)
+	assert.Equal(t, []string{"a"}, skipped)
+	assert.Contains(t, report.Failed, "a")
+	assert.Equal(t, 1, report.Copied)
+}
+
+// memoryWith creates a memory store with one stream
+func memoryWith(t *testing.T, key string, by ...int) eventsourcing.EventStore {
+	store := memory.NewStore()
+	increment(t, store, key, by...)
+	return store
+}
+
+// TestRateLimit checks commits are admitted at the rate given
+func TestRateLimit(t *testing.T) {
+	source := newSource(t)
+	target := memory.NewStore()
+	clock := simclock.New(time.Unix(0, 0))
+
+	done := make(chan error)
+	go func() {
+		_, errRun := Run(prewarm.Keys("a", "b"), source, target, test.GetTestRegistry(), Options{
+			CommitsPerSecond: 1,
+			Clock:            clock,
+		})
+		done <- errRun
+	}()
+
+	clock.BlockUntil(1)
+	assert.Equal(t, 6, load(t, target, "a").CurrentCount)
+	assert.Equal(t, 0, load(t, target, "b").CurrentCount, "The second commit should wait")
+
+	clock.Advance(time.Second)
+	assert.Nil(t, <-done)
+	assert.Equal(t, 9, load(t, target, "b").CurrentCount)
+}
@@ -0,0 +1,91 @@
+/*
+Package mongodoc connects to MongoDB with the official driver, reading and writing
+documents in the format the mgo driver wrote them in with JSON tag fallback on.
+It's shared by the packages that keep documents in MongoDB (events, snapshots,
+trackers, outboxes), so that collections written by earlier versions can still be
+read, and vice versa:
+
+  - Struct fields are named by their bson tag, or their json tag if they have no
+    bson tag, as bson.SetJSONTagFallback(true) did for mgo.
+  - Documents are read into interface{} values as bson.M, arrays as []interface{},
+    32-bit integers as int and dates as time.Time, as mgo read them.
+  - Nil slices, maps and byte slices are written as empty values, and unsigned
+    integers in the smallest type that holds them, as mgo wrote them.
+
+Packages sharing a client can also join their writes for a commit into a single
+transaction (see Transactions).
+*/
+package mongodoc
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonoptions"
+	"go.mongodb.org/mongo-driver/bson/mgocompat"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DialTimeout is the longest Dial waits to reach a server, as mgo.Dial did.
+const DialTimeout = 10 * time.Second
+
+// Registry encodes and decodes documents in the format mgo did, with JSON tag
+// fallback on.
+var Registry = newRegistry()
+
+// newRegistry builds the mgo compatible registry of the driver, naming fields by
+// their json tags when they have no bson tag.
+func newRegistry() *bsoncodec.Registry {
+	builder := mgocompat.NewRegistryBuilder()
+	structCodec, _ := bsoncodec.NewStructCodec(bsoncodec.JSONFallbackStructTagParser,
+		bsonoptions.StructCodec().
+			SetDecodeZeroStruct(true).
+			SetEncodeOmitDefaultStruct(true).
+			SetOverwriteDuplicatedInlinedFields(false).
+			SetAllowUnexportedFields(true))
+	builder.RegisterDefaultEncoder(reflect.Struct, structCodec).
+		RegisterDefaultDecoder(reflect.Struct, structCodec)
+
+	return builder.Build()
+}
+
+// Dial connects to a MongoDB deployment, failing if no server can be reached
+// within DialTimeout. Operations are limited to the timeout, if one is set.
+func Dial(dialURL string, timeout time.Duration) (*mongo.Client, error) {
+	clientOptions := options.Client().ApplyURI(dialURL).SetRegistry(Registry)
+	if timeout > 0 {
+		clientOptions.SetTimeout(timeout)
+	}
+
+	client, errConnect := mongo.Connect(context.Background(), clientOptions)
+	if errConnect != nil {
+		return nil, errConnect
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+	errPing := client.Ping(ctx, nil)
+	if errPing != nil {
+		client.Disconnect(context.Background())
+		return nil, errPing
+	}
+
+	return client, nil
+}
+
+// Collection gets a collection of a database that reads and writes documents in
+// the mgo format, whatever the registry of the client.
+func Collection(database *mongo.Database, name string) *mongo.Collection {
+	return database.Collection(name, options.Collection().SetRegistry(Registry))
+}
+
+// Adopt gets a copy of a collection that reads and writes documents in the mgo
+// format, keeping its other options, for collections the caller created.
+func Adopt(collection *mongo.Collection) *mongo.Collection {
+	// Cloning never fails, the error is only there for future use
+	adopted, _ := collection.Clone(options.Collection().SetRegistry(Registry))
+	return adopted
+}
@@ -0,0 +1,59 @@
+package mongodoc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// sample is a struct named by its JSON tags, with a bson tag taking precedence
+type sample struct {
+	Name     string                 `json:"name"`
+	Count    int64                  `json:"count"`
+	Renamed  string                 `json:"json_name" bson:"bson_name"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	Tags     []string               `json:"tags"`
+}
+
+// TestMarshal checks fields are named by their json tags unless they have a bson
+// tag, and nil slices are written as empty arrays, as mgo wrote them
+func TestMarshal(t *testing.T) {
+	data, errMarshal := bson.MarshalWithRegistry(Registry, sample{Name: "example", Count: 3, Renamed: "renamed"})
+	assert.Nil(t, errMarshal)
+
+	document := bson.D{}
+	assert.Nil(t, bson.Unmarshal(data, &document))
+	assert.Equal(t, bson.D{
+		{Key: "name", Value: "example"},
+		{Key: "count", Value: int64(3)},
+		{Key: "bson_name", Value: "renamed"},
+		{Key: "tags", Value: bson.A{}},
+	}, document)
+}
+
+// TestUnmarshal checks documents are read into interface{} values as mgo read them
+func TestUnmarshal(t *testing.T) {
+	at := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	data, _ := bson.Marshal(bson.D{
+		{Key: "key", Value: "example"},
+		{Key: "data", Value: bson.D{
+			{Key: "count", Value: int32(7)},
+			{Key: "list", Value: bson.A{"a", int64(2)}},
+			{Key: "at", Value: at},
+		}},
+	})
+
+	decoded := struct {
+		Key  string      `json:"key"`
+		Data interface{} `json:"data"`
+	}{}
+	assert.Nil(t, bson.UnmarshalWithRegistry(Registry, data, &decoded))
+	assert.Equal(t, "example", decoded.Key)
+	assert.Equal(t, bson.M{
+		"count": 7,
+		"list":  []interface{}{"a", int64(2)},
+		"at":    at,
+	}, decoded.Data)
+}
@@ -0,0 +1,194 @@
+package mongodoc
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/go-gadgets/eventsourcing"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxCommitAttempts is the most times committing a transaction is tried, when the
+// outcome of an attempt is unknown.
+const maxCommitAttempts = 3
+
+// unknownCommitResult labels the errors of commits that may or may not have applied
+const unknownCommitResult = "UnknownTransactionCommitResult"
+
+// transientTransactionError labels the errors of transactions that can be retried
+// as a whole, such as those that collided with another
+const transientTransactionError = "TransientTransactionError"
+
+// writeConflictCode is the code of the error raised when a write in a transaction
+// collides with one made by another
+const writeConflictCode = 112
+
+// IsWriteConflict checks whether an error is a write that collided with one made
+// by a concurrent transaction, which the caller can retry after refreshing.
+func IsWriteConflict(err error) bool {
+	var server mongo.ServerError
+	if !errors.As(err, &server) {
+		return false
+	}
+	return server.HasErrorCode(writeConflictCode) || server.HasErrorLabel(transientTransactionError)
+}
+
+// Transactions joins the writes made for a commit by packages sharing a client,
+// such as the events written by the Mongo store and the snapshot written by the
+// mongosnap middleware around it, into a single transaction, so that a crash can't
+// leave one written without the other.
+//
+// Transactions need a replica set or sharded cluster. Against a standalone server,
+// Run just runs the commit, and each write is made on its own as before.
+//
+// Commits are keyed by aggregate and the sequence they bring it up to, and only
+// writes made for both join the transaction, so that others (i.e. snapshots taken
+// on refresh) don't. Concurrent commits of the same aggregate run one at a time.
+// A nil *Transactions runs every commit without a transaction.
+type Transactions struct {
+	client    *mongo.Client
+	supported bool
+	lock      sync.Mutex
+	open      map[string]*transaction
+}
+
+// transaction is the transaction open for the commit of a key
+type transaction struct {
+	sequence int64           // Sequence the commit brings the key up to
+	ctx      context.Context // Session context of the transaction, nil until started
+	done     chan struct{}   // Closed once the transaction has finished
+}
+
+// NewTransactions creates a coordinator for the transactions of a client,
+// detecting whether it is connected to a deployment that supports them.
+func NewTransactions(ctx context.Context, client *mongo.Client) (*Transactions, error) {
+	supported, errDetect := supportsTransactions(ctx, client)
+	if errDetect != nil {
+		return nil, errDetect
+	}
+
+	return &Transactions{
+		client:    client,
+		supported: supported,
+		open:      make(map[string]*transaction),
+	}, nil
+}
+
+// supportsTransactions checks if a client is connected to a replica set or to the
+// mongos of a sharded cluster, rather than to a standalone server.
+func supportsTransactions(ctx context.Context, client *mongo.Client) (bool, error) {
+	hello := struct {
+		SetName string `bson:"setName"`
+		Message string `bson:"msg"`
+	}{}
+
+	admin := client.Database("admin")
+	errHello := admin.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if errHello != nil {
+		// Servers before 4.4.2 only know the legacy name of the command
+		errHello = admin.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello)
+	}
+	if errHello != nil {
+		return false, errHello
+	}
+
+	return hello.SetName != "" || hello.Message == "isdbgrid", nil
+}
+
+// Supported reports whether commits run in transactions.
+func (transactions *Transactions) Supported() bool {
+	return transactions != nil && transactions.supported
+}
+
+// Run runs the commit of a key up to a sequence in a transaction, which the writes
+// made for the key at that sequence during the commit join (see Context). The
+// transaction is aborted if the commit fails, and committed otherwise. Transactions
+// that collide with a concurrent commit of the key fail with a ConcurrencyFault.
+func (transactions *Transactions) Run(key string, sequence int64, commit func() error) error {
+	if !transactions.Supported() {
+		return commit()
+	}
+
+	entry := transactions.acquire(key, sequence)
+	defer transactions.release(key, entry)
+
+	session, errSession := transactions.client.StartSession()
+	if errSession != nil {
+		return errSession
+	}
+	defer session.EndSession(context.Background())
+
+	errStart := session.StartTransaction()
+	if errStart != nil {
+		return errStart
+	}
+	transactions.lock.Lock()
+	entry.ctx = mongo.NewSessionContext(context.Background(), session)
+	transactions.lock.Unlock()
+
+	errCommit := commit()
+	if errCommit != nil {
+		session.AbortTransaction(context.Background())
+		if IsWriteConflict(errCommit) {
+			return eventsourcing.NewConcurrencyFault(key, sequence)
+		}
+		return errCommit
+	}
+
+	var errTransaction error
+	for attempt := 0; attempt < maxCommitAttempts; attempt++ {
+		errTransaction = session.CommitTransaction(context.Background())
+		var labeled mongo.LabeledError
+		if errTransaction == nil || !errors.As(errTransaction, &labeled) || !labeled.HasErrorLabel(unknownCommitResult) {
+			break
+		}
+	}
+	if IsWriteConflict(errTransaction) {
+		return eventsourcing.NewConcurrencyFault(key, sequence)
+	}
+	return errTransaction
+}
+
+// Context gets the context the writes for a key at a sequence are made with: the
+// session of the transaction open for the commit up to it, or the fallback if there
+// is none.
+func (transactions *Transactions) Context(key string, sequence int64, fallback context.Context) context.Context {
+	if transactions == nil {
+		return fallback
+	}
+
+	transactions.lock.Lock()
+	defer transactions.lock.Unlock()
+	entry, open := transactions.open[key]
+	if !open || entry.ctx == nil || entry.sequence != sequence {
+		return fallback
+	}
+	return entry.ctx
+}
+
+// acquire opens the transaction of a key, waiting for any that is already open
+func (transactions *Transactions) acquire(key string, sequence int64) *transaction {
+	for {
+		transactions.lock.Lock()
+		current, open := transactions.open[key]
+		if !open {
+			entry := &transaction{sequence: sequence, done: make(chan struct{})}
+			transactions.open[key] = entry
+			transactions.lock.Unlock()
+			return entry
+		}
+		transactions.lock.Unlock()
+
+		<-current.done
+	}
+}
+
+// release closes the transaction of a key
+func (transactions *Transactions) release(key string, entry *transaction) {
+	transactions.lock.Lock()
+	delete(transactions.open, key)
+	transactions.lock.Unlock()
+	close(entry.done)
+}
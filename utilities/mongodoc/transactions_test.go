@@ -0,0 +1,204 @@
+package mongodoc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// dialTransactions connects to the deployment named by MONGO_TEST_HOST, skipping
+// the test unless it is set to a deployment that supports transactions
+func dialTransactions(t *testing.T) (*mongo.Client, *mongo.Collection) {
+	dial := os.Getenv("MONGO_TEST_HOST")
+	if dial == "" {
+		t.Skip("MONGO_TEST_HOST is not set")
+	}
+
+	client, errDial := Dial(dial, 0)
+	require.NoError(t, errDial)
+	transactions, errDetect := NewTransactions(context.Background(), client)
+	require.NoError(t, errDetect)
+	if !transactions.Supported() {
+		client.Disconnect(context.Background())
+		t.Skip("MONGO_TEST_HOST is not a replica set or sharded cluster")
+	}
+
+	collection := Collection(client.Database("TestDatabase"), fmt.Sprintf("%s", uuid.NewV4()))
+	t.Cleanup(func() {
+		collection.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return client, collection
+}
+
+// TestTransactionsNil checks a nil coordinator runs commits without a transaction
+func TestTransactionsNil(t *testing.T) {
+	var transactions *Transactions
+	assert.False(t, transactions.Supported())
+
+	ran := false
+	errRun := transactions.Run("key", 1, func() error {
+		ran = true
+		return nil
+	})
+	assert.Nil(t, errRun)
+	assert.True(t, ran)
+
+	fallback := context.Background()
+	assert.Equal(t, fallback, transactions.Context("key", 1, fallback))
+}
+
+// TestTransactionsUnsupported checks commits against standalone servers run on
+// their own, returning their errors
+func TestTransactionsUnsupported(t *testing.T) {
+	transactions := &Transactions{open: make(map[string]*transaction)}
+	errCommit := errors.New("Commit failed")
+	assert.Equal(t, errCommit, transactions.Run("key", 1, func() error {
+		return errCommit
+	}))
+}
+
+// TestTransactionsContext checks only writes for the key and sequence of the open
+// transaction join it
+func TestTransactionsContext(t *testing.T) {
+	transactions := &Transactions{open: make(map[string]*transaction)}
+	fallback := context.Background()
+	joined, cancel := context.WithCancel(fallback)
+	defer cancel()
+
+	entry := transactions.acquire("key", 3)
+	assert.Equal(t, fallback, transactions.Context("key", 3, fallback), "Not started yet")
+
+	entry.ctx = joined
+	assert.Equal(t, joined, transactions.Context("key", 3, fallback))
+	assert.Equal(t, fallback, transactions.Context("key", 2, fallback))
+	assert.Equal(t, fallback, transactions.Context("other", 3, fallback))
+
+	transactions.release("key", entry)
+	assert.Equal(t, fallback, transactions.Context("key", 3, fallback))
+}
+
+// TestTransactionsSerialized checks commits of the same key wait for each other
+func TestTransactionsSerialized(t *testing.T) {
+	transactions := &Transactions{open: make(map[string]*transaction)}
+	first := transactions.acquire("key", 1)
+
+	acquired := make(chan *transaction)
+	go func() {
+		acquired <- transactions.acquire("key", 2)
+	}()
+
+	select {
+	case <-acquired:
+		assert.Fail(t, "Acquired while the first transaction was open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	other := transactions.acquire("other", 1)
+	transactions.release("other", other)
+
+	transactions.release("key", first)
+	select {
+	case second := <-acquired:
+		assert.Equal(t, int64(2), second.sequence)
+		transactions.release("key", second)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Not acquired once the first transaction finished")
+	}
+}
+
+// TestIsWriteConflict checks write conflicts and transient transaction errors are
+// recognised, and other errors aren't
+func TestIsWriteConflict(t *testing.T) {
+	assert.True(t, IsWriteConflict(mongo.CommandError{Code: 112, Name: "WriteConflict"}))
+	assert.True(t, IsWriteConflict(mongo.CommandError{Labels: []string{"TransientTransactionError"}}))
+	assert.True(t, IsWriteConflict(fmt.Errorf("Insert failed: %w", mongo.CommandError{Code: 112})))
+	assert.False(t, IsWriteConflict(mongo.CommandError{Code: 11000}))
+	assert.False(t, IsWriteConflict(errors.New("Storage unavailable")))
+	assert.False(t, IsWriteConflict(nil))
+}
+
+// TestTransactionsSession checks writes made in a session commit together when the
+// commit succeeds, and not at all when it fails
+func TestTransactionsSession(t *testing.T) {
+	client, collection := dialTransactions(t)
+	transactions, _ := NewTransactions(context.Background(), client)
+
+	errRun := transactions.Run("key", 1, func() error {
+		ctx := transactions.Context("key", 1, context.Background())
+		_, errInsert := collection.InsertOne(ctx, bson.M{"_id": "committed"})
+		if errInsert != nil {
+			return errInsert
+		}
+
+		// Uncommitted writes aren't seen outside the transaction
+		outside, _ := collection.CountDocuments(context.Background(), bson.M{"_id": "committed"})
+		assert.Equal(t, int64(0), outside)
+		return nil
+	})
+	assert.Nil(t, errRun)
+	committed, _ := collection.CountDocuments(context.Background(), bson.M{"_id": "committed"})
+	assert.Equal(t, int64(1), committed)
+
+	errCommit := errors.New("Commit failed")
+	errAborted := transactions.Run("key", 2, func() error {
+		ctx := transactions.Context("key", 2, context.Background())
+		_, errInsert := collection.InsertOne(ctx, bson.M{"_id": "aborted"})
+		assert.Nil(t, errInsert)
+		return errCommit
+	})
+	assert.Equal(t, errCommit, errAborted)
+	aborted, _ := collection.CountDocuments(context.Background(), bson.M{"_id": "aborted"})
+	assert.Equal(t, int64(0), aborted)
+}
+
+// TestTransactionsWriteConflict checks a transaction colliding with the open one
+// of another process fails with a ConcurrencyFault, leaving the first to commit
+func TestTransactionsWriteConflict(t *testing.T) {
+	client, collection := dialTransactions(t)
+	_, errInsert := collection.InsertOne(context.Background(), bson.M{"_id": "contended", "n": 0})
+	require.NoError(t, errInsert)
+
+	// Each process has a coordinator of its own
+	first, _ := NewTransactions(context.Background(), client)
+	second, _ := NewTransactions(context.Background(), client)
+	update := func(transactions *Transactions, n int) error {
+		ctx := transactions.Context("key", 1, context.Background())
+		_, errUpdate := collection.UpdateOne(ctx, bson.M{"_id": "contended"}, bson.M{"$set": bson.M{"n": n}})
+		return errUpdate
+	}
+
+	errFirst := first.Run("key", 1, func() error {
+		errUpdate := update(first, 1)
+		if errUpdate != nil {
+			return errUpdate
+		}
+
+		errSecond := second.Run("key", 1, func() error {
+			return update(second, 2)
+		})
+		conflict, fault := eventsourcing.IsConcurrencyFault(errSecond)
+		assert.True(t, conflict, "Expected a ConcurrencyFault, got %v", errSecond)
+		if conflict {
+			assert.Equal(t, "key", fault.AggregateKey)
+		}
+		return nil
+	})
+	assert.Nil(t, errFirst)
+
+	stored := struct {
+		N int `bson:"n"`
+	}{}
+	assert.Nil(t, collection.FindOne(context.Background(), bson.M{"_id": "contended"}).Decode(&stored))
+	assert.Equal(t, 1, stored.N)
+}
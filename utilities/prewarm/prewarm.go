@@ -0,0 +1,232 @@
+/*
+Package prewarm rebuilds the snapshots of many aggregates in bulk. After replay
+logic changes, stored snapshots no longer match what a full replay would produce,
+and the first request for each aggregate would otherwise pay for a full replay. A
+pre-warm walks every aggregate, replays it ignoring its snapshot, and writes a
+fresh snapshot through the snapshot middleware installed on the store:
+
+	report, err := prewarm.Run(prewarm.FeedKeys(store, 0), func(key string) prewarm.Rebuilder {
+		agg := &Counter{}
+		agg.Initialize(key, registry, store)
+		return agg
+	}, prewarm.Options{Workers: 8})
+
+Stores can't list their streams, so keys are enumerated from the global feed (or
+the feed of a category), or supplied from elsewhere with Keys.
+
+The same run generates the first snapshots when snapshotting is enabled on an
+existing dataset. Most aggregates of a large dataset are usually short, and cheap
+enough to replay that snapshotting them only costs storage, so MinEvents skips
+aggregates whose version (read from Options.Store) is below a threshold.
+*/
+package prewarm
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// DefaultBatchSize is the number of events read from a feed at a time, if no other
+// size is specified.
+const DefaultBatchSize = 500
+
+// KeySource enumerates aggregate keys, calling visit once for each key. Enumeration
+// stops at the first error returned by visit.
+type KeySource func(visit func(key string) error) error
+
+// Rebuilder is an aggregate that can rebuild its snapshot, such as any aggregate
+// built on eventsourcing.AggregateBase.
+type Rebuilder interface {
+	// RebuildSnapshot replays the full history and writes a fresh snapshot.
+	RebuildSnapshot() error
+}
+
+// Factory creates a newly initialized aggregate for a key, attached to the store
+// whose snapshots are being rebuilt.
+type Factory func(key string) Rebuilder
+
+// ErrorCallback is called when an aggregate fails to rebuild. Returning nil skips
+// the aggregate and continues, while returning an error stops the pre-warm.
+type ErrorCallback func(key string, err error) error
+
+// Options configures a pre-warm.
+type Options struct {
+	Workers    int                         // Aggregates rebuilt concurrently, defaults to one
+	OnError    ErrorCallback               // Decides what to do with failures, defaults to stopping
+	OnProgress func(key string, err error) // Called after each aggregate, if set
+	MinEvents  int64                       // Aggregates with fewer events are skipped, zero to rebuild every aggregate
+	Store      eventsourcing.EventStore    // Store to read the versions of aggregates from, required by MinEvents
+}
+
+// Report describes the result of a pre-warm.
+type Report struct {
+	Aggregates int              // Aggregates visited
+	Rebuilt    int              // Aggregates whose snapshot was rebuilt
+	Skipped    int              // Aggregates with fewer events than MinEvents
+	Failed     map[string]error // Failures that were skipped, by key
+}
+
+// Keys is a KeySource of a fixed set of keys.
+func Keys(keys ...string) KeySource {
+	return func(visit func(key string) error) error {
+		for _, key := range keys {
+			errVisit := visit(key)
+			if errVisit != nil {
+				return errVisit
+			}
+		}
+		return nil
+	}
+}
+
+// FeedKeys is a KeySource of the distinct keys in the global feed of a store, in
+// the order they first appear. A batch size of zero uses DefaultBatchSize.
+func FeedKeys(reader eventsourcing.GlobalReader, batchSize int) KeySource {
+	return feedKeys(reader.ReadAll, batchSize)
+}
+
+// CategoryKeys is a KeySource of the distinct keys of a category, in the order
+// they first appear. A batch size of zero uses DefaultBatchSize.
+func CategoryKeys(reader eventsourcing.CategoryReader, category string, batchSize int) KeySource {
+	return feedKeys(func(from string, limit int) ([]eventsourcing.GlobalEvent, error) {
+		return reader.ReadCategory(category, from, limit)
+	}, batchSize)
+}
+
+// feedKeys reads a feed to the end, visiting each key the first time it is seen
+func feedKeys(read func(from string, limit int) ([]eventsourcing.GlobalEvent, error), batchSize int) KeySource {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	return func(visit func(key string) error) error {
+		seen := make(map[string]bool)
+		position := ""
+		for {
+			events, errRead := read(position, batchSize)
+			if errRead != nil {
+				return errRead
+			}
+
+			for _, event := range events {
+				position = event.Position
+				if seen[event.Key] {
+					continue
+				}
+				seen[event.Key] = true
+
+				errVisit := visit(event.Key)
+				if errVisit != nil {
+					return errVisit
+				}
+			}
+
+			if len(events) < batchSize {
+				return nil
+			}
+		}
+	}
+}
+
+// Run rebuilds the snapshot of every aggregate from a source. The report covers
+// the aggregates visited before any error stopped the pre-warm.
+func Run(source KeySource, factory Factory, options Options) (Report, error) {
+	if options.Workers <= 0 {
+		options.Workers = 1
+	}
+	if options.MinEvents > 0 && options.Store == nil {
+		return Report{}, errors.New("Prewarm error: MinEvents requires a store to read versions from")
+	}
+	if options.OnError == nil {
+		options.OnError = func(key string, err error) error {
+			return fmt.Errorf("Prewarm error: Aggregate %v failed to rebuild: %v", key, err)
+		}
+	}
+
+	report := Report{Failed: make(map[string]error)}
+	var mutex sync.Mutex
+	var stopped error
+
+	// finish records the outcome of an aggregate, stopping the run if required
+	finish := func(key string, skipped bool, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if options.OnProgress != nil {
+			options.OnProgress(key, err)
+		}
+		if err == nil && skipped {
+			report.Skipped++
+			return
+		}
+		if err == nil {
+			report.Rebuilt++
+			return
+		}
+		if stopped != nil {
+			return
+		}
+
+		stopped = options.OnError(key, err)
+		if stopped == nil {
+			report.Failed[key] = err
+		}
+	}
+
+	// isStopped checks if a worker has stopped the run
+	isStopped := func() error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return stopped
+	}
+
+	keys := make(chan string)
+	var workers sync.WaitGroup
+	for i := 0; i < options.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for key := range keys {
+				skipped, errSkip := options.skip(key)
+				if skipped || errSkip != nil {
+					finish(key, skipped, errSkip)
+					continue
+				}
+				finish(key, false, factory(key).RebuildSnapshot())
+			}
+		}()
+	}
+
+	errSource := source(func(key string) error {
+		if errStopped := isStopped(); errStopped != nil {
+			return errStopped
+		}
+
+		report.Aggregates++
+		keys <- key
+		return nil
+	})
+	close(keys)
+	workers.Wait()
+
+	if errStopped := isStopped(); errStopped != nil {
+		return report, errStopped
+	}
+	return report, errSource
+}
+
+// skip checks if an aggregate has too few events to be worth snapping
+func (options Options) skip(key string) (bool, error) {
+	if options.MinEvents <= 0 {
+		return false, nil
+	}
+
+	version, errVersion := eventsourcing.Version(options.Store, key)
+	if errVersion != nil {
+		return false, errVersion
+	}
+	return version < options.MinEvents, nil
+}
@@ -0,0 +1,174 @@
+package prewarm
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/memorysnap"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// doublingAggregate is the counter with changed replay logic, where every
+// increment counts twice
+type doublingAggregate struct {
+	eventsourcing.AggregateBase
+	CurrentCount int `json:"current_count"`
+}
+
+// Initialize the aggregate
+func (agg *doublingAggregate) Initialize(key string, registry eventsourcing.EventRegistry, store eventsourcing.EventStore) {
+	agg.AggregateBase.Initialize(key, registry, store, func() interface{} { return agg })
+	agg.AggregateBase.AutomaticWireup(agg)
+}
+
+// ReplayIncrementEvent applies an IncrementEvent to the model.
+func (agg *doublingAggregate) ReplayIncrementEvent(event test.IncrementEvent) {
+	agg.CurrentCount += event.IncrementBy * 2
+}
+
+// failingRebuilder fails to rebuild
+type failingRebuilder struct{}
+
+// RebuildSnapshot fails
+func (failingRebuilder) RebuildSnapshot() error {
+	return errors.New("Rebuild failed")
+}
+
+// populate commits events to a set of keys, some in a category
+func populate(t *testing.T, store eventsourcing.EventStore, keys []string) {
+	for round := 0; round < 2; round++ {
+		for index, key := range keys {
+			agg := test.SimpleAggregate{}
+			agg.Initialize(key, test.GetTestRegistry(), store)
+			if index%2 == 0 {
+				agg.UseCategory("Even")
+			}
+			assert.Nil(t, agg.Refresh())
+			agg.ApplyEvent(test.IncrementEvent{IncrementBy: index + 1})
+			assert.Nil(t, agg.Commit())
+		}
+	}
+}
+
+// collect enumerates the keys of a source
+func collect(source KeySource) ([]string, error) {
+	keys := make([]string, 0)
+	err := source(func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
+
+// TestFeedKeys checks each key in the feed is visited once, in order
+func TestFeedKeys(t *testing.T) {
+	store := memory.NewStore()
+	populate(t, store, []string{"a", "b", "c"})
+
+	keys, errKeys := collect(FeedKeys(store.(eventsourcing.GlobalReader), 2))
+	assert.Nil(t, errKeys)
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+
+	keys, errKeys = collect(CategoryKeys(store.(eventsourcing.CategoryReader), "Even", 0))
+	assert.Nil(t, errKeys)
+	assert.Equal(t, []string{"a", "c"}, keys)
+}
+
+// TestRunRebuildsSnapshots checks snapshots written by old replay logic are replaced
+// with those of the new logic
+func TestRunRebuildsSnapshots(t *testing.T) {
+	base := memory.NewStore()
+	store := eventsourcing.NewMiddlewareWrapper(base)
+	store.Use(memorysnap.Create(memorysnap.Parameters{Lazy: true, SnapInterval: 1}))
+	populate(t, store, []string{"a", "b", "c"})
+
+	factory := func(key string) Rebuilder {
+		agg := &doublingAggregate{}
+		agg.Initialize(key, test.GetTestRegistry(), store)
+		return agg
+	}
+	report, errRun := Run(FeedKeys(base.(eventsourcing.GlobalReader), 0), factory, Options{Workers: 2})
+	assert.Nil(t, errRun)
+	assert.Equal(t, 3, report.Aggregates)
+	assert.Equal(t, 3, report.Rebuilt)
+	assert.Empty(t, report.Failed)
+
+	// Lazy snapshots are restored without replaying, so must have been rebuilt
+	for index, key := range []string{"a", "b", "c"} {
+		agg := factory(key).(*doublingAggregate)
+		assert.Nil(t, agg.Refresh())
+		assert.Equal(t, (index+1)*4, agg.CurrentCount, fmt.Sprintf("Snapshot of %v should use the new logic", key))
+		assert.Equal(t, int64(2), agg.SequenceNumber())
+	}
+}
+
+// TestRunStopsOnError checks the first failure stops the run by default
+func TestRunStopsOnError(t *testing.T) {
+	factory := func(key string) Rebuilder {
+		return failingRebuilder{}
+	}
+
+	report, errRun := Run(Keys("a", "b", "c"), factory, Options{})
+	assert.NotNil(t, errRun)
+	assert.Equal(t, 0, report.Rebuilt)
+	assert.True(t, report.Aggregates < 3, "The run should stop before visiting every key")
+}
+
+// TestRunSkipsErrors checks failures can be skipped
+func TestRunSkipsErrors(t *testing.T) {
+	store := memory.NewStore()
+	populate(t, store, []string{"a", "b"})
+	factory := func(key string) Rebuilder {
+		if key == "b" {
+			return failingRebuilder{}
+		}
+		agg := &test.SimpleAggregate{}
+		agg.Initialize(key, test.GetTestRegistry(), store)
+		return agg
+	}
+
+	progress := 0
+	report, errRun := Run(Keys("a", "b"), factory, Options{
+		OnError:    func(key string, err error) error { return nil },
+		OnProgress: func(key string, err error) { progress++ },
+	})
+	assert.Nil(t, errRun)
+	assert.Equal(t, 2, report.Aggregates)
+	assert.Equal(t, 1, report.Rebuilt)
+	assert.Equal(t, 2, progress)
+	assert.Contains(t, report.Failed, "b")
+}
+
+// TestRunSkipsShortAggregates checks aggregates below MinEvents aren't snapped
+func TestRunSkipsShortAggregates(t *testing.T) {
+	base := memory.NewStore()
+	populate(t, base, []string{"a", "b"})
+	long := test.SimpleAggregate{}
+	long.Initialize("a", test.GetTestRegistry(), base)
+	assert.Nil(t, long.Refresh())
+	long.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+	assert.Nil(t, long.Commit())
+
+	cache := memorysnap.NewCache(memorysnap.Parameters{SnapInterval: 100})
+	store := eventsourcing.NewMiddlewareWrapper(base)
+	store.Use(cache.Middleware())
+
+	factory := func(key string) Rebuilder {
+		agg := &test.SimpleAggregate{}
+		agg.Initialize(key, test.GetTestRegistry(), store)
+		return agg
+	}
+	_, errStore := Run(Keys("a", "b"), factory, Options{MinEvents: 3})
+	assert.NotNil(t, errStore, "MinEvents should require a store")
+
+	report, errRun := Run(Keys("a", "b"), factory, Options{MinEvents: 3, Store: base})
+	assert.Nil(t, errRun)
+	assert.Equal(t, 2, report.Aggregates)
+	assert.Equal(t, 1, report.Rebuilt)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, 1, cache.Stats().Entries, "Only the long aggregate should be snapped")
+}
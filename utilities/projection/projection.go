@@ -0,0 +1,267 @@
+/*
+Package projection allows in-memory projections (leaderboards, counters, lookup
+tables) to periodically checkpoint their full state, and to restore it on startup
+rather than replaying the entire event history.
+
+Each checkpoint records the state of the projection alongside the last sequence
+handled for every aggregate key. Once restored, events that were already applied
+to the checkpointed state are skipped, so the projection can safely resume from an
+earlier position in the event stream (i.e. a Kafka consumer-group offset):
+
+	runner := projection.Create("leaderboard", &board, projection.NewFileStore("/var/lib/app"), time.Minute)
+	if err := runner.Start(); err != nil {
+		return err
+	}
+	defer runner.Close()
+	consumer.AddHandler(runner)
+
+Handlers built on eventsourcing.EventHandlerBase are projections once they declare
+their state with UseState. Checkpoints can also record the position of the
+consumer, so that a consumer of the global feed resumes from the checkpoint after
+a restart, rather than reading the whole feed again:
+
+	consumer, err := feed.CreateConsumer(store, feed.Options{
+		From:       runner.Resume(),
+		OnPosition: runner.Advance,
+	})
+*/
+package projection
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/sirupsen/logrus"
+)
+
+// Projection is an event handler that holds its state in memory.
+type Projection interface {
+	eventsourcing.EventHandler
+
+	// State returns a pointer to the state of the projection. The state is
+	// serialized as JSON when checkpointing, and decoded into the same
+	// pointer when restoring.
+	State() interface{}
+}
+
+// Checkpoint is a point-in-time copy of a projection.
+type Checkpoint struct {
+	Positions map[string]int64 `json:"positions"`          // Last sequence handled per aggregate key
+	Position  string           `json:"position,omitempty"` // Position of the consumer in its feed, if recorded with Advance
+	State     json.RawMessage  `json:"state"`              // Serialized projection state
+	Timestamp time.Time        `json:"timestamp"`          // Time the checkpoint was taken
+}
+
+// Store is a storage provider for projection checkpoints.
+type Store interface {
+	// Get the latest checkpoint for the named projection, if one exists.
+	Get(name string) (Checkpoint, bool, error)
+
+	// Put replaces the checkpoint for the named projection.
+	Put(name string, checkpoint Checkpoint) error
+}
+
+// Runner wraps a projection, tracking positions and writing checkpoints.
+type Runner struct {
+	name       string              // Name of the projection
+	projection Projection          // Projection being checkpointed
+	store      Store               // Checkpoint storage
+	interval   time.Duration       // Time between checkpoints, zero to disable
+	clock      eventsourcing.Clock // Source of time for the interval and checkpoints
+	lock       sync.Mutex          // Guards the projection state and positions
+	positions  map[string]int64    // Last sequence handled per aggregate key
+	position   string              // Position of the consumer in its feed
+	dirty      bool                // True if events have been handled since the last checkpoint
+	stop       chan struct{}       // Signals the checkpoint loop to stop
+	done       chan struct{}       // Closed once the checkpoint loop exits
+}
+
+// Create a new runner for a projection, which checkpoints to the store on the
+// specified interval.
+func Create(name string, projection Projection, store Store, interval time.Duration) *Runner {
+	return &Runner{
+		name:       name,
+		projection: projection,
+		store:      store,
+		interval:   interval,
+		clock:      eventsourcing.SystemClock,
+		positions:  make(map[string]int64),
+	}
+}
+
+// UseClock sets the source of time for the checkpoint interval and timestamps,
+// i.e. a virtual clock in tests. It must be called before Start.
+func (runner *Runner) UseClock(clock eventsourcing.Clock) {
+	runner.clock = clock
+}
+
+// Start restores the latest checkpoint, if there is one, and begins writing
+// checkpoints on the configured interval. Start should be called before any
+// events are handled.
+func (runner *Runner) Start() error {
+	if runner.projection.State() == nil {
+		return fmt.Errorf("projection: %v has no state to checkpoint", runner.name)
+	}
+
+	errRestore := runner.restore()
+	if errRestore != nil {
+		return errRestore
+	}
+
+	if runner.interval > 0 && runner.stop == nil {
+		runner.stop = make(chan struct{})
+		runner.done = make(chan struct{})
+		go runner.run()
+	}
+
+	return nil
+}
+
+// Handle passes events to the projection, skipping any that are already
+// reflected in the restored state.
+func (runner *Runner) Handle(event eventsourcing.PublishedEvent) error {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+
+	if event.Sequence <= runner.positions[event.Key] {
+		return nil
+	}
+
+	errHandle := runner.projection.Handle(event)
+	if errHandle != nil {
+		return errHandle
+	}
+
+	runner.positions[event.Key] = event.Sequence
+	runner.dirty = true
+	return nil
+}
+
+// Subscriptions gets the event types of the projection, if it has any.
+func (runner *Runner) Subscriptions() []eventsourcing.EventType {
+	types, _ := eventsourcing.SubscriptionsFor(runner.projection)
+	return types
+}
+
+// Position returns the last sequence handled for an aggregate key.
+func (runner *Runner) Position(key string) int64 {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+	return runner.positions[key]
+}
+
+// Advance records the position of the consumer in its feed, once the events up to
+// it have been handled, so that checkpoints resume from it. It can be used as the
+// OnPosition callback of a feed consumer.
+func (runner *Runner) Advance(position string) error {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+	if runner.position != position {
+		runner.position = position
+		runner.dirty = true
+	}
+	return nil
+}
+
+// Resume gets the position of the consumer recorded in the restored checkpoint
+// (or by Advance since), to start the consumer from, or an empty position to
+// start from the beginning.
+func (runner *Runner) Resume() string {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+	return runner.position
+}
+
+// Checkpoint writes the current state of the projection to the store.
+func (runner *Runner) Checkpoint() error {
+	runner.lock.Lock()
+	if !runner.dirty {
+		runner.lock.Unlock()
+		return nil
+	}
+
+	state, errMarshal := json.Marshal(runner.projection.State())
+	if errMarshal != nil {
+		runner.lock.Unlock()
+		return errMarshal
+	}
+
+	positions := make(map[string]int64, len(runner.positions))
+	for key, seq := range runner.positions {
+		positions[key] = seq
+	}
+	position := runner.position
+	runner.dirty = false
+	runner.lock.Unlock()
+
+	errPut := runner.store.Put(runner.name, Checkpoint{
+		Positions: positions,
+		Position:  position,
+		State:     state,
+		Timestamp: runner.clock.Now().UTC(),
+	})
+	if errPut != nil {
+		runner.lock.Lock()
+		runner.dirty = true
+		runner.lock.Unlock()
+	}
+
+	return errPut
+}
+
+// Close stops the checkpoint loop and writes a final checkpoint.
+func (runner *Runner) Close() error {
+	if runner.stop != nil {
+		close(runner.stop)
+		<-runner.done
+		runner.stop = nil
+	}
+
+	return runner.Checkpoint()
+}
+
+// restore loads the latest checkpoint into the projection.
+func (runner *Runner) restore() error {
+	checkpoint, found, errGet := runner.store.Get(runner.name)
+	if errGet != nil || !found {
+		return errGet
+	}
+
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+
+	errState := json.Unmarshal(checkpoint.State, runner.projection.State())
+	if errState != nil {
+		return errState
+	}
+
+	runner.positions = make(map[string]int64, len(checkpoint.Positions))
+	for key, seq := range checkpoint.Positions {
+		runner.positions[key] = seq
+	}
+	runner.position = checkpoint.Position
+
+	return nil
+}
+
+// run writes checkpoints on the configured interval.
+func (runner *Runner) run() {
+	defer close(runner.done)
+	ticker := runner.clock.NewTicker(runner.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-runner.stop:
+			return
+		case <-ticker.C():
+			errCheckpoint := runner.Checkpoint()
+			if errCheckpoint != nil {
+				logrus.WithError(errCheckpoint).WithField("projection", runner.name).Error("projection_checkpoint_error")
+			}
+		}
+	}
+}
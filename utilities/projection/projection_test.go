@@ -0,0 +1,144 @@
+package projection
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/simclock"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+)
+
+// leaderboard is a simple projection that counts events per key.
+type leaderboard struct {
+	Scores map[string]int `json:"scores"`
+}
+
+func (board *leaderboard) Handle(event eventsourcing.PublishedEvent) error {
+	if board.Scores == nil {
+		board.Scores = make(map[string]int)
+	}
+	board.Scores[event.Key]++
+	return nil
+}
+
+func (board *leaderboard) State() interface{} {
+	return board
+}
+
+func publish(t *testing.T, runner *Runner, key string, from int64, to int64) {
+	for seq := from; seq <= to; seq++ {
+		assert.Nil(t, runner.Handle(eventsourcing.PublishedEvent{
+			Type:     "IncrementEvent",
+			Key:      key,
+			Sequence: seq,
+		}))
+	}
+}
+
+// TestStartWithoutCheckpoint checks a projection starts empty with no checkpoint
+func TestStartWithoutCheckpoint(t *testing.T) {
+	board := &leaderboard{}
+	runner := Create("empty", board, NewMemoryStore(), 0)
+	assert.Nil(t, runner.Start())
+	assert.Nil(t, board.Scores)
+	assert.Equal(t, int64(0), runner.Position("a"))
+}
+
+// notifyingStore is a checkpoint store that signals each checkpoint written.
+type notifyingStore struct {
+	Store
+	written chan Checkpoint
+}
+
+func (store *notifyingStore) Put(name string, checkpoint Checkpoint) error {
+	errPut := store.Store.Put(name, checkpoint)
+	store.written <- checkpoint
+	return errPut
+}
+
+// TestScheduledCheckpoint checks checkpoints are written on the interval
+func TestScheduledCheckpoint(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := simclock.New(start)
+	store := &notifyingStore{Store: NewMemoryStore(), written: make(chan Checkpoint, 1)}
+	runner := Create("scheduled", &leaderboard{}, store, time.Minute)
+	runner.UseClock(clock)
+	assert.Nil(t, runner.Start())
+	defer runner.Close()
+	publish(t, runner, "a", 1, 1)
+
+	// Nothing is written until the interval passes
+	clock.BlockUntil(1)
+	clock.Advance(59 * time.Second)
+	_, found, _ := store.Get("scheduled")
+	assert.False(t, found)
+
+	clock.Advance(time.Second)
+	checkpoint := <-store.written
+	assert.Equal(t, start.Add(time.Minute), checkpoint.Timestamp)
+	assert.Equal(t, int64(1), checkpoint.Positions["a"])
+}
+
+// totals is the state of a handler built on the event handler base
+type totals struct {
+	Total int `json:"total"`
+}
+
+// totalHandler adds up increments, keeping its total as declared state
+type totalHandler struct {
+	eventsourcing.EventHandlerBase
+	totals totals
+}
+
+// HandleIncrementEvent adds to the total
+func (handler *totalHandler) HandleIncrementEvent(key string, seq int64, event test.IncrementEvent) error {
+	handler.totals.Total += event.IncrementBy
+	return nil
+}
+
+// newTotalHandler creates a handler whose total can be checkpointed
+func newTotalHandler() *totalHandler {
+	handler := &totalHandler{}
+	handler.Initialize(test.GetTestRegistry(), handler)
+	handler.UseState(&handler.totals)
+	return handler
+}
+
+// TestHandlerState checks handlers built on the event handler base are
+// checkpointed, along with the position of their consumer
+func TestHandlerState(t *testing.T) {
+	store := NewMemoryStore()
+	increment := func(runner *Runner, seq int64) {
+		assert.Nil(t, runner.Handle(eventsourcing.PublishedEvent{
+			Type:     "IncrementEvent",
+			Key:      "counter",
+			Sequence: seq,
+			Data:     map[string]interface{}{"increment_by": 2},
+		}))
+	}
+
+	first := newTotalHandler()
+	runner := Create("totals", first, store, 0)
+	assert.Nil(t, runner.Start())
+	assert.Equal(t, "", runner.Resume())
+	increment(runner, 1)
+	increment(runner, 2)
+	assert.Nil(t, runner.Advance("feed-2"))
+	assert.Nil(t, runner.Close())
+
+	second := newTotalHandler()
+	restored := Create("totals", second, store, 0)
+	assert.Nil(t, restored.Start())
+	assert.Equal(t, 4, second.totals.Total)
+	assert.Equal(t, "feed-2", restored.Resume(), "The consumer should resume from the checkpoint")
+	increment(restored, 2)
+	increment(restored, 3)
+	assert.Equal(t, 6, second.totals.Total)
+
+	stateless := &totalHandler{}
+	stateless.Initialize(test.GetTestRegistry(), stateless)
+	assert.NotNil(t, Create("stateless", stateless, store, 0).Start())
+}
@@ -0,0 +1,54 @@
+// Package redisstore holds a projection.Store that keeps checkpoints in Redis. It is
+// a module of its own, so that only users of the store depend on the Redis client.
+package redisstore
+
+import (
+	"encoding/json"
+
+	"github.com/go-gadgets/eventsourcing/utilities/projection"
+	"github.com/go-redis/redis"
+)
+
+// redisStore keeps checkpoints as JSON strings in Redis.
+type redisStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewStore creates a checkpoint store that writes one key per projection,
+// with the specified key prefix.
+func NewStore(client redis.UniversalClient, prefix string) projection.Store {
+	return &redisStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+// Get the latest checkpoint for the named projection
+func (store *redisStore) Get(name string) (projection.Checkpoint, bool, error) {
+	checkpoint := projection.Checkpoint{}
+	data, errGet := store.client.Get(store.prefix + name).Bytes()
+	if errGet == redis.Nil {
+		return checkpoint, false, nil
+	}
+	if errGet != nil {
+		return checkpoint, false, errGet
+	}
+
+	errDecode := json.Unmarshal(data, &checkpoint)
+	if errDecode != nil {
+		return checkpoint, false, errDecode
+	}
+
+	return checkpoint, true, nil
+}
+
+// Put replaces the checkpoint for the named projection
+func (store *redisStore) Put(name string, checkpoint projection.Checkpoint) error {
+	data, errEncode := json.Marshal(checkpoint)
+	if errEncode != nil {
+		return errEncode
+	}
+
+	return store.client.Set(store.prefix+name, data, 0).Err()
+}
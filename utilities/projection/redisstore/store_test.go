@@ -0,0 +1,23 @@
+package redisstore
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing/utilities/projection/storetest"
+	"github.com/go-redis/redis"
+)
+
+// TestRedisStore checks checkpoints round-trip through Redis
+func TestRedisStore(t *testing.T) {
+	address := os.Getenv("REDIS_TEST_HOST")
+	if address == "" {
+		address = "localhost:6379"
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr: address,
+	})
+	defer client.Close()
+
+	storetest.CheckStore(t, NewStore(client, "test:projection:"))
+}
@@ -0,0 +1,97 @@
+package projection
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// memoryStore keeps checkpoints in memory, which is useful for testing.
+type memoryStore struct {
+	lock        sync.Mutex
+	checkpoints map[string]Checkpoint
+}
+
+// NewMemoryStore creates a checkpoint store that is held in memory.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		checkpoints: make(map[string]Checkpoint),
+	}
+}
+
+// Get the latest checkpoint for the named projection
+func (store *memoryStore) Get(name string) (Checkpoint, bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	checkpoint, found := store.checkpoints[name]
+	return checkpoint, found, nil
+}
+
+// Put replaces the checkpoint for the named projection
+func (store *memoryStore) Put(name string, checkpoint Checkpoint) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.checkpoints[name] = checkpoint
+	return nil
+}
+
+// fileStore keeps checkpoints as JSON files within a directory.
+type fileStore struct {
+	directory string
+}
+
+// NewFileStore creates a checkpoint store that writes one file per projection
+// into the specified directory.
+func NewFileStore(directory string) Store {
+	return &fileStore{
+		directory: directory,
+	}
+}
+
+// Get the latest checkpoint for the named projection
+func (store *fileStore) Get(name string) (Checkpoint, bool, error) {
+	checkpoint := Checkpoint{}
+	data, errRead := ioutil.ReadFile(store.path(name))
+	if os.IsNotExist(errRead) {
+		return checkpoint, false, nil
+	}
+	if errRead != nil {
+		return checkpoint, false, errRead
+	}
+
+	errDecode := json.Unmarshal(data, &checkpoint)
+	if errDecode != nil {
+		return checkpoint, false, errDecode
+	}
+
+	return checkpoint, true, nil
+}
+
+// Put replaces the checkpoint for the named projection. The checkpoint is written
+// to a temporary file first, so a crash never leaves a partial checkpoint behind.
+func (store *fileStore) Put(name string, checkpoint Checkpoint) error {
+	data, errEncode := json.Marshal(checkpoint)
+	if errEncode != nil {
+		return errEncode
+	}
+
+	errDir := os.MkdirAll(store.directory, 0755)
+	if errDir != nil {
+		return errDir
+	}
+
+	target := store.path(name)
+	errWrite := ioutil.WriteFile(target+".tmp", data, 0644)
+	if errWrite != nil {
+		return errWrite
+	}
+
+	return os.Rename(target+".tmp", target)
+}
+
+// path determines the file a checkpoint is written to
+func (store *fileStore) path(name string) string {
+	return filepath.Join(store.directory, filepath.Base(name)+".checkpoint.json")
+}
@@ -0,0 +1,25 @@
+package projection_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing/utilities/projection"
+	"github.com/go-gadgets/eventsourcing/utilities/projection/storetest"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMemoryStore checks checkpoints round-trip through memory
+func TestMemoryStore(t *testing.T) {
+	storetest.CheckStore(t, projection.NewMemoryStore())
+}
+
+// TestFileStore checks checkpoints round-trip through a directory
+func TestFileStore(t *testing.T) {
+	directory, errTemp := ioutil.TempDir("", "projection")
+	assert.Nil(t, errTemp)
+	defer os.RemoveAll(directory)
+
+	storetest.CheckStore(t, projection.NewFileStore(directory))
+}
@@ -0,0 +1,66 @@
+// Package storetest holds the checks every projection.Store is expected to pass, so
+// that checkpoint stores kept elsewhere are tested the same way as the built-in
+// ones.
+package storetest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/projection"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// leaderboard is a simple projection that counts events per key.
+type leaderboard struct {
+	Scores map[string]int `json:"scores"`
+}
+
+func (board *leaderboard) Handle(event eventsourcing.PublishedEvent) error {
+	if board.Scores == nil {
+		board.Scores = make(map[string]int)
+	}
+	board.Scores[event.Key]++
+	return nil
+}
+
+func (board *leaderboard) State() interface{} {
+	return board
+}
+
+func publish(t *testing.T, runner *projection.Runner, key string, from int64, to int64) {
+	for seq := from; seq <= to; seq++ {
+		assert.Nil(t, runner.Handle(eventsourcing.PublishedEvent{
+			Type:     "IncrementEvent",
+			Key:      key,
+			Sequence: seq,
+		}))
+	}
+}
+
+// CheckStore validates a store by checkpointing a projection, then restoring
+// it into a fresh instance and replaying overlapping events.
+func CheckStore(t *testing.T, store projection.Store) {
+	name := fmt.Sprintf("board-%s", uuid.NewV4())
+
+	first := &leaderboard{}
+	runner := projection.Create(name, first, store, 0)
+	assert.Nil(t, runner.Start())
+	publish(t, runner, "a", 1, 3)
+	publish(t, runner, "b", 1, 2)
+	assert.Nil(t, runner.Close())
+
+	second := &leaderboard{}
+	restored := projection.Create(name, second, store, 0)
+	assert.Nil(t, restored.Start())
+	assert.Equal(t, 3, second.Scores["a"])
+	assert.Equal(t, 2, second.Scores["b"])
+	assert.Equal(t, int64(3), restored.Position("a"))
+
+	// Resuming from an earlier point in the stream should not double-count
+	publish(t, restored, "a", 1, 5)
+	assert.Equal(t, 5, second.Scores["a"])
+	assert.Nil(t, restored.Close())
+}
@@ -0,0 +1,111 @@
+/*
+Package rekey rotates the master key of encrypted snapshots (see snapbase.KeyProvider)
+across a whole store, so that an old key can be retired without waiting for every
+aggregate to be snapped again:
+
+	keys.Rotate("2019-01")
+	report, errRekey := rekey.Run(prewarm.FeedKeys(store.(eventsourcing.GlobalReader), 0), admin, rekey.Options{
+		Tracker: tracker,
+	})
+
+The admin is the snapbase.Admin the snapshot provider was created with, and must
+be given the same key provider, holding both the old and the new keys. Only the
+data key of each snapshot is re-encrypted under the current key, and the snapshot
+is written back in place, so the state is never decrypted and the snapshot storage
+doesn't need to be migrated.
+
+Progress is recorded in the tracker (the same interface as mongo.ProgressTracker)
+as the number of keys finished, so an interrupted rotation resumes after the last
+aggregate it finished. Key sources must visit keys in a stable order for progress
+to be meaningful, as the feed does. Snapshots already under the current key are
+left alone, so running a rotation again is harmless.
+*/
+package rekey
+
+import (
+	"fmt"
+
+	"github.com/go-gadgets/eventsourcing/stores/middleware/snapbase"
+	"github.com/go-gadgets/eventsourcing/utilities/prewarm"
+)
+
+// Tracker stores the progress of a rotation, as the number of keys finished. A
+// mongo.ProgressTracker can be used, and negative start positions (such as
+// mongo.InitialPositionTrimHorizon) start from the first key.
+type Tracker interface {
+	// StartPosition gets the number of keys finished by earlier runs
+	StartPosition() (int64, error)
+
+	// UpdatePosition records the number of keys finished
+	UpdatePosition(int64) error
+}
+
+// ErrorCallback decides what happens when a snapshot can't be rekeyed. Returning
+// nil skips the snapshot and carries on, returning an error stops the rotation.
+type ErrorCallback func(key string, err error) error
+
+// Options configures a rotation.
+type Options struct {
+	Tracker    Tracker                     // Records progress, so the rotation can resume, if set
+	OnError    ErrorCallback               // Decides what to do with failures, defaults to stopping
+	OnProgress func(key string, err error) // Called after each aggregate, if set
+}
+
+// Report describes the result of a rotation.
+type Report struct {
+	Aggregates int              // Aggregates visited, including those finished by earlier runs
+	Resumed    int              // Aggregates skipped as finished by earlier runs
+	Rekeyed    int              // Snapshots rewritten under the current key
+	Failed     map[string]error // Failures that were skipped, by key
+}
+
+// Run rekeys the snapshot of every aggregate a key source visits. The report covers
+// the aggregates visited before any error stopped the rotation.
+func Run(keys prewarm.KeySource, admin *snapbase.Admin, options Options) (Report, error) {
+	if options.OnError == nil {
+		options.OnError = func(key string, err error) error {
+			return fmt.Errorf("Rekey error: Snapshot of %v failed to rekey: %v", key, err)
+		}
+	}
+
+	start := int64(0)
+	if options.Tracker != nil {
+		position, errStart := options.Tracker.StartPosition()
+		if errStart != nil {
+			return Report{}, errStart
+		}
+		if position > 0 {
+			start = position
+		}
+	}
+
+	report := Report{Failed: make(map[string]error)}
+	errKeys := keys(func(key string) error {
+		report.Aggregates++
+		if int64(report.Aggregates) <= start {
+			report.Resumed++
+			return nil
+		}
+
+		rekeyed, errRekey := admin.RekeySnapshot(key)
+		if options.OnProgress != nil {
+			options.OnProgress(key, errRekey)
+		}
+		if errRekey != nil {
+			errStop := options.OnError(key, errRekey)
+			if errStop != nil {
+				return errStop
+			}
+			report.Failed[key] = errRekey
+		} else if rekeyed {
+			report.Rekeyed++
+		}
+
+		if options.Tracker != nil {
+			return options.Tracker.UpdatePosition(int64(report.Aggregates))
+		}
+		return nil
+	})
+
+	return report, errKeys
+}
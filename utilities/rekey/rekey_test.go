@@ -0,0 +1,132 @@
+package rekey
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/snapbase"
+	"github.com/go-gadgets/eventsourcing/utilities/prewarm"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryTracker is a tracker that keeps its position in memory
+type memoryTracker struct {
+	position int64
+}
+
+func (tracker *memoryTracker) StartPosition() (int64, error) {
+	return tracker.position, nil
+}
+
+func (tracker *memoryTracker) UpdatePosition(position int64) error {
+	tracker.position = position
+	return nil
+}
+
+// fixture is a store with encrypted snapshots of three aggregates, kept in a map
+type fixture struct {
+	keys  *snapbase.StaticKeyProvider
+	admin *snapbase.Admin
+	snaps map[string]interface{}
+	fail  string // Key whose snapshot can't be read
+}
+
+// newFixture snaps three aggregates under the first key, then rotates to the second
+func newFixture(t *testing.T) *fixture {
+	keys, errKeys := snapbase.StaticKeys("2018-01", map[string][]byte{
+		"2018-01": bytes.Repeat([]byte{1}, 32),
+		"2018-02": bytes.Repeat([]byte{2}, 32),
+	})
+	assert.Nil(t, errKeys)
+
+	fixture := &fixture{
+		keys:  keys,
+		admin: snapbase.NewAdmin(),
+		snaps: make(map[string]interface{}),
+	}
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(snapbase.Create(snapbase.Parameters{
+		SnapInterval: 1,
+		Keys:         keys,
+		Admin:        fixture.admin,
+		Close:        func() error { return nil },
+		Get: func(key string) (interface{}, int64, error) {
+			if key == fixture.fail {
+				return nil, 0, errors.New("unavailable")
+			}
+			return fixture.snaps[key], 1, nil
+		},
+		Purge: func(key string) error {
+			delete(fixture.snaps, key)
+			return nil
+		},
+		Put: func(key string, seq int64, snap interface{}) error {
+			fixture.snaps[key] = snap
+			return nil
+		},
+	}))
+
+	for _, key := range []string{"a", "b", "c"} {
+		agg := test.SimpleAggregate{}
+		agg.Initialize(key, test.GetTestRegistry(), store)
+		agg.ApplyEvent(test.IncrementEvent{IncrementBy: 1})
+		assert.Nil(t, agg.Commit())
+	}
+	assert.Nil(t, keys.Rotate("2018-02"))
+	return fixture
+}
+
+// keyOf gets the ID of the master key a snapshot is encrypted under
+func (fixture *fixture) keyOf(key string) interface{} {
+	return fixture.snaps[key].(map[string]interface{})[snapbase.EncryptionKey]
+}
+
+// TestRun checks every snapshot is rekeyed, and a second run changes nothing
+func TestRun(t *testing.T) {
+	fixture := newFixture(t)
+	report, errRun := Run(prewarm.Keys("a", "b", "c", "unsnapped"), fixture.admin, Options{})
+	assert.Nil(t, errRun)
+	assert.Equal(t, Report{Aggregates: 4, Rekeyed: 3, Failed: map[string]error{}}, report)
+	for _, key := range []string{"a", "b", "c"} {
+		assert.Equal(t, "2018-02", fixture.keyOf(key))
+	}
+
+	again, errAgain := Run(prewarm.Keys("a", "b", "c"), fixture.admin, Options{})
+	assert.Nil(t, errAgain)
+	assert.Equal(t, 0, again.Rekeyed)
+}
+
+// TestResume checks finished aggregates are skipped, and progress is recorded
+func TestResume(t *testing.T) {
+	fixture := newFixture(t)
+	tracker := &memoryTracker{position: 1}
+	report, errRun := Run(prewarm.Keys("a", "b", "c"), fixture.admin, Options{Tracker: tracker})
+	assert.Nil(t, errRun)
+	assert.Equal(t, Report{Aggregates: 3, Resumed: 1, Rekeyed: 2, Failed: map[string]error{}}, report)
+	assert.Equal(t, "2018-01", fixture.keyOf("a"), "Finished aggregates should be skipped")
+	assert.Equal(t, "2018-02", fixture.keyOf("c"))
+	assert.Equal(t, int64(3), tracker.position)
+}
+
+// TestErrors checks failures stop the rotation, unless the callback skips them
+func TestErrors(t *testing.T) {
+	fixture := newFixture(t)
+	fixture.fail = "b"
+	tracker := &memoryTracker{}
+	_, errRun := Run(prewarm.Keys("a", "b", "c"), fixture.admin, Options{Tracker: tracker})
+	assert.NotNil(t, errRun)
+	assert.Equal(t, int64(1), tracker.position, "Progress should stop before the failure")
+
+	report, errSkip := Run(prewarm.Keys("a", "b", "c"), fixture.admin, Options{
+		Tracker: tracker,
+		OnError: func(key string, err error) error { return nil },
+	})
+	assert.Nil(t, errSkip)
+	assert.Contains(t, report.Failed, "b")
+	assert.Equal(t, 1, report.Rekeyed)
+	assert.Equal(t, "2018-02", fixture.keyOf("c"))
+}
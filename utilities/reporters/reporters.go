@@ -0,0 +1,86 @@
+/*
+Package reporters contains reporters that send faults to error-tracking services,
+for use with AggregateBase.UseReporter, eventsourcing.ReportingHandler and the
+reporting middleware. Faults are sent synchronously using the HTTP APIs of each
+service, and failures to send are logged rather than returned.
+*/
+package reporters
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// message gets the message describing a fault.
+func message(report eventsourcing.ErrorReport) string {
+	if report.Err != nil {
+		return report.Err.Error()
+	}
+	return fmt.Sprintf("Panic during %v: %v", report.Operation, report.Panic)
+}
+
+// errorType gets the type name describing a fault.
+func errorType(report eventsourcing.ErrorReport) string {
+	if report.Panic != nil {
+		return fmt.Sprintf("panic(%T)", report.Panic)
+	}
+	return fmt.Sprintf("%T", report.Err)
+}
+
+// tags gets the context of a fault as a set of name/value pairs, omitting any
+// that aren't known.
+func tags(report eventsourcing.ErrorReport) map[string]string {
+	result := map[string]string{
+		"operation": report.Operation,
+	}
+	if report.Domain != "" {
+		result["domain"] = report.Domain
+	}
+	if report.Key != "" {
+		result["key"] = report.Key
+		result["sequence"] = strconv.FormatInt(report.Sequence, 10)
+	}
+	if report.EventType != "" {
+		result["event_type"] = string(report.EventType)
+	}
+	if report.CommandType != "" {
+		result["command_type"] = string(report.CommandType)
+	}
+	return result
+}
+
+// post sends a JSON body to an endpoint.
+func post(client *http.Client, endpoint string, headers map[string]string, body interface{}) error {
+	encoded, errEncode := json.Marshal(body)
+	if errEncode != nil {
+		return errEncode
+	}
+
+	request, errRequest := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(encoded))
+	if errRequest != nil {
+		return errRequest
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	response, errPost := client.Do(request)
+	if errPost != nil {
+		return errPost
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		detail, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("reporters: posting to %v returned status %v: %s", endpoint, response.StatusCode, detail)
+	}
+
+	return nil
+}
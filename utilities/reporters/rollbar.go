@@ -0,0 +1,100 @@
+package reporters
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// RollbarEndpoint is the Rollbar API endpoint that items are posted to.
+const RollbarEndpoint = "https://api.rollbar.com/api/1/item/"
+
+// RollbarReporter is a reporter that sends faults to Rollbar.
+type RollbarReporter struct {
+	Endpoint string // Endpoint items are posted to, RollbarEndpoint by default
+
+	token       string       // Project access token (post_server_item scope)
+	environment string       // Environment the faults arose in
+	client      *http.Client // HTTP client to use
+}
+
+// NewRollbarReporter creates a reporter that sends faults to Rollbar using a
+// project access token, for the specified environment, i.e. "production".
+func NewRollbarReporter(token string, environment string) *RollbarReporter {
+	return NewRollbarReporterWithClient(token, environment, http.DefaultClient)
+}
+
+// NewRollbarReporterWithClient creates a Rollbar reporter using a specific HTTP
+// client (BYO-instance).
+func NewRollbarReporterWithClient(token string, environment string, client *http.Client) *RollbarReporter {
+	return &RollbarReporter{
+		Endpoint:    RollbarEndpoint,
+		token:       token,
+		environment: environment,
+		client:      client,
+	}
+}
+
+// rollbarItem is the body of a Rollbar item request.
+type rollbarItem struct {
+	AccessToken string      `json:"access_token"`
+	Data        rollbarData `json:"data"`
+}
+
+// rollbarData describes a single occurrence.
+type rollbarData struct {
+	Environment string            `json:"environment"`
+	Level       string            `json:"level"`
+	Timestamp   int64             `json:"timestamp"`
+	Platform    string            `json:"platform"`
+	Language    string            `json:"language"`
+	Title       string            `json:"title"`
+	Body        rollbarBody       `json:"body"`
+	Custom      map[string]string `json:"custom"`
+}
+
+// rollbarBody is the body of an occurrence, reported as a message.
+type rollbarBody struct {
+	Message rollbarMessage `json:"message"`
+}
+
+// rollbarMessage is a message occurrence.
+type rollbarMessage struct {
+	Body  string `json:"body"`
+	Stack string `json:"stack,omitempty"`
+}
+
+// Report sends a fault to Rollbar. Panics are reported as critical, with their
+// stack.
+func (reporter *RollbarReporter) Report(report eventsourcing.ErrorReport) {
+	item := rollbarItem{
+		AccessToken: reporter.token,
+		Data: rollbarData{
+			Environment: reporter.environment,
+			Level:       "error",
+			Timestamp:   time.Now().Unix(),
+			Platform:    "go",
+			Language:    "go",
+			Title:       message(report),
+			Body: rollbarBody{
+				Message: rollbarMessage{
+					Body: message(report),
+				},
+			},
+			Custom: tags(report),
+		},
+	}
+	item.Data.Custom["error_type"] = errorType(report)
+	if report.Panic != nil {
+		item.Data.Level = "critical"
+		item.Data.Body.Message.Stack = string(report.Stack)
+	}
+
+	errPost := post(reporter.client, reporter.Endpoint, nil, item)
+	if errPost != nil {
+		logrus.WithError(errPost).WithField("fault", item.Data.Title).Error("rollbar_report_error")
+	}
+}
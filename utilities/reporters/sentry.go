@@ -0,0 +1,118 @@
+package reporters
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// SentryReporter is a reporter that sends faults to Sentry.
+type SentryReporter struct {
+	Environment string // Environment the faults arose in, i.e. "production"
+	Release     string // Release of the application, if known
+
+	endpoint string       // Store endpoint for the project
+	auth     string       // Authentication header
+	client   *http.Client // HTTP client to use
+}
+
+// NewSentryReporter creates a reporter that sends faults to the Sentry project
+// identified by a DSN, i.e. https://public@sentry.example.com/1
+func NewSentryReporter(dsn string) (*SentryReporter, error) {
+	return NewSentryReporterWithClient(dsn, http.DefaultClient)
+}
+
+// NewSentryReporterWithClient creates a Sentry reporter using a specific HTTP
+// client (BYO-instance).
+func NewSentryReporterWithClient(dsn string, client *http.Client) (*SentryReporter, error) {
+	parsed, errParse := url.Parse(dsn)
+	if errParse != nil {
+		return nil, errParse
+	}
+	if parsed.User == nil || parsed.User.Username() == "" {
+		return nil, fmt.Errorf("reporters: Sentry DSN %v has no key", dsn)
+	}
+
+	project := path.Base(parsed.Path)
+	if project == "." || project == "/" {
+		return nil, fmt.Errorf("reporters: Sentry DSN %v has no project", dsn)
+	}
+
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=go-gadgets-eventsourcing/1.0, sentry_key=%v", parsed.User.Username())
+	if secret, ok := parsed.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+
+	prefix := strings.TrimSuffix(path.Dir(parsed.Path), "/")
+	return &SentryReporter{
+		endpoint: fmt.Sprintf("%v://%v%v/api/%v/store/", parsed.Scheme, parsed.Host, prefix, project),
+		auth:     auth,
+		client:   client,
+	}, nil
+}
+
+// sentryEvent is the body of a Sentry store request.
+type sentryEvent struct {
+	EventID     string                 `json:"event_id"`
+	Timestamp   string                 `json:"timestamp"`
+	Level       string                 `json:"level"`
+	Platform    string                 `json:"platform"`
+	Logger      string                 `json:"logger"`
+	Message     string                 `json:"message"`
+	Environment string                 `json:"environment,omitempty"`
+	Release     string                 `json:"release,omitempty"`
+	Tags        map[string]string      `json:"tags"`
+	Extra       map[string]interface{} `json:"extra,omitempty"`
+	Exception   sentryExceptions       `json:"exception"`
+}
+
+// sentryExceptions is the exception interface of a Sentry event.
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+// sentryException describes a single exception.
+type sentryException struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Report sends a fault to Sentry. Panics are reported as fatal, with their stack.
+func (reporter *SentryReporter) Report(report eventsourcing.ErrorReport) {
+	event := sentryEvent{
+		EventID:     strings.Replace(uuid.NewV4().String(), "-", "", -1),
+		Timestamp:   time.Now().UTC().Format("2006-01-02T15:04:05"),
+		Level:       "error",
+		Platform:    "go",
+		Logger:      "eventsourcing",
+		Message:     message(report),
+		Environment: reporter.Environment,
+		Release:     reporter.Release,
+		Tags:        tags(report),
+		Exception: sentryExceptions{
+			Values: []sentryException{{
+				Type:  errorType(report),
+				Value: message(report),
+			}},
+		},
+	}
+	if report.Panic != nil {
+		event.Level = "fatal"
+		event.Extra = map[string]interface{}{
+			"stack": string(report.Stack),
+		}
+	}
+
+	errPost := post(reporter.client, reporter.endpoint, map[string]string{"X-Sentry-Auth": reporter.auth}, event)
+	if errPost != nil {
+		logrus.WithError(errPost).WithField("fault", event.Message).Error("sentry_report_error")
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Package retirement helps event types to be retired safely. Event types are first
+marked as deprecated on the registry, so that they are no longer raised but still
+replay, and a Scanner then reports how many streams still contain them:
+
+	registry.(eventsourcing.DeprecationRegistry).DeprecateEvent("OrderPlacedEvent", "OrderSubmittedEvent")
+
+	scanner := retirement.NewScanner(store, registry)
+	for _, key := range keys {
+		scanner.Scan(key)
+	}
+	report := scanner.Report()
+
+Once a deprecated event type is found in no streams (i.e. the streams have been
+migrated or removed), its type and replay handlers can be deleted. Stores can't list
+their streams, so the keys to scan must come from elsewhere, such as a projection.
+Scans must read the full history of each stream, so snapshot middleware should not
+be attached to the store being scanned.
+*/
+package retirement
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/mapping"
+	"github.com/mitchellh/mapstructure"
+)
+
+// Usage describes how much a deprecated event type is still used.
+type Usage struct {
+	Replacement eventsourcing.EventType // Event type that replaces it
+	Streams     int                     // Streams containing at least one event of the type
+	Events      int                     // Events of the type across all streams
+	Keys        []string                // Keys of the streams containing the type, up to the scanner's limit
+}
+
+// Report describes the result of a scan.
+type Report struct {
+	Streams int                                // Streams scanned
+	Usage   map[eventsourcing.EventType]*Usage // Usage of each deprecated event type
+}
+
+// Retirable gets the deprecated event types that no scanned stream contains,
+// which can safely be removed.
+func (report Report) Retirable() []eventsourcing.EventType {
+	result := make([]eventsourcing.EventType, 0)
+	for eventType, usage := range report.Usage {
+		if usage.Streams == 0 {
+			result = append(result, eventType)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// DefaultMaxKeys is the number of stream keys recorded against each deprecated
+// event type, if no other limit is specified.
+const DefaultMaxKeys = 100
+
+// Scanner counts the streams in a store that contain deprecated event types.
+type Scanner struct {
+	store    eventsourcing.EventStore
+	registry eventsourcing.EventRegistry
+	MaxKeys  int // Keys recorded per deprecated event type
+	report   Report
+}
+
+// NewScanner creates a scanner for the deprecated event types of a registry.
+func NewScanner(store eventsourcing.EventStore, registry eventsourcing.EventRegistry) *Scanner {
+	usage := make(map[eventsourcing.EventType]*Usage)
+	for eventType, replacement := range eventsourcing.DeprecationsFor(registry) {
+		usage[eventType] = &Usage{
+			Replacement: replacement,
+			Keys:        make([]string, 0),
+		}
+	}
+
+	return &Scanner{
+		store:    store,
+		registry: registry,
+		MaxKeys:  DefaultMaxKeys,
+		report: Report{
+			Usage: usage,
+		},
+	}
+}
+
+// Scan reads the stream for a key, and counts any deprecated events in it.
+func (scanner *Scanner) Scan(key string) error {
+	loader := &scanLoader{
+		key: key,
+		registry: &countingRegistry{
+			EventRegistry: scanner.registry,
+			seen:          make(map[eventsourcing.EventType]int),
+		},
+	}
+
+	errRefresh := scanner.store.Refresh(loader)
+	if errRefresh != nil {
+		return errRefresh
+	}
+
+	// Some middleware ignores a refused snapshot, so check for one here
+	if loader.snapshot > 0 {
+		return errSnapshot(key, loader.snapshot)
+	}
+
+	scanner.report.Streams++
+	for eventType, count := range loader.registry.seen {
+		usage, deprecated := scanner.report.Usage[eventType]
+		if !deprecated {
+			continue
+		}
+
+		usage.Streams++
+		usage.Events += count
+		if len(usage.Keys) < scanner.MaxKeys {
+			usage.Keys = append(usage.Keys, key)
+		}
+	}
+
+	return nil
+}
+
+// Report gets the usage of deprecated event types across the streams scanned so far.
+func (scanner *Scanner) Report() Report {
+	return scanner.report
+}
+
+// countingRegistry is an event registry that counts the event types created,
+// which are the event types read from a stream.
+type countingRegistry struct {
+	eventsourcing.EventRegistry
+	seen map[eventsourcing.EventType]int
+}
+
+// CreateEvent records the event type, and creates it with the wrapped registry
+func (reg *countingRegistry) CreateEvent(eventType eventsourcing.EventType) eventsourcing.Event {
+	reg.seen[eventType]++
+	return reg.EventRegistry.CreateEvent(eventType)
+}
+
+// RegisterTypeAdapter registers an adapter with the wrapped registry, if supported
+func (reg *countingRegistry) RegisterTypeAdapter(example interface{}, adapter mapping.TypeAdapter) {
+	adapted, ok := reg.EventRegistry.(eventsourcing.TypeAdapterRegistry)
+	if ok {
+		adapted.RegisterTypeAdapter(example, adapter)
+	}
+}
+
+// DecodeHook gets the decoder hook of the wrapped registry
+func (reg *countingRegistry) DecodeHook() mapstructure.DecodeHookFunc {
+	return eventsourcing.DecodeHookFor(reg.EventRegistry)
+}
+
+// scanLoader is a loader adapter that reads a stream without applying it to an aggregate
+type scanLoader struct {
+	key      string
+	sequence int64
+	snapshot int64 // Sequence of any snapshot offered
+	registry *countingRegistry
+}
+
+// GetKey gets the key of the stream being scanned
+func (loader *scanLoader) GetKey() string {
+	return loader.key
+}
+
+// SequenceNumber gets the last sequence read
+func (loader *scanLoader) SequenceNumber() int64 {
+	return loader.sequence
+}
+
+// GetEventRegistry gets the counting registry
+func (loader *scanLoader) GetEventRegistry() eventsourcing.EventRegistry {
+	return loader.registry
+}
+
+// IsDirty is always false, since nothing is written
+func (loader *scanLoader) IsDirty() bool {
+	return false
+}
+
+// ReplayEvent moves past an event, which has already been counted
+func (loader *scanLoader) ReplayEvent(event eventsourcing.Event) {
+	loader.sequence++
+}
+
+// AdvanceSequence skips over sequences without events
+func (loader *scanLoader) AdvanceSequence(sequence int64) error {
+	loader.sequence = sequence
+	return nil
+}
+
+// RestoreSnapshot refuses snapshots, since they would hide the events they replace
+func (loader *scanLoader) RestoreSnapshot(sequence int64, state interface{}) error {
+	loader.snapshot = sequence
+	return errSnapshot(loader.key, sequence)
+}
+
+// errSnapshot describes a stream that can't be scanned, because of a snapshot
+func errSnapshot(key string, sequence int64) error {
+	return fmt.Errorf("retirement: cannot scan %v past a snapshot at %v, scan the store without snapshot middleware", key, sequence)
+}
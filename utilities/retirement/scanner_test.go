@@ -0,0 +1,79 @@
+package retirement
+
+import (
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/memorysnap"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// newRegistry creates a registry in which InitializeEvent is deprecated
+func newRegistry() eventsourcing.EventRegistry {
+	registry := eventsourcing.NewStandardEventRegistry("Retirement")
+	initialize := registry.RegisterEvent(test.InitializeEvent{})
+	registry.RegisterEvent(test.IncrementEvent{})
+	registry.(eventsourcing.DeprecationRegistry).DeprecateEvent(initialize, eventsourcing.EventType("TargetSetEvent"))
+	return registry
+}
+
+// commit writes events to a stream
+func commit(t *testing.T, store eventsourcing.EventStore, registry eventsourcing.EventRegistry, key string, events ...eventsourcing.Event) {
+	agg := test.SimpleAggregate{}
+	agg.Initialize(key, registry, store)
+	assert.Nil(t, agg.Refresh())
+	for _, event := range events {
+		agg.ApplyEvent(event)
+	}
+	assert.Nil(t, agg.Commit())
+}
+
+// TestScanCountsDeprecatedEvents checks streams and events are counted per type.
+func TestScanCountsDeprecatedEvents(t *testing.T) {
+	store := memory.NewStore()
+	registry := newRegistry()
+	commit(t, store, registry, "a", test.InitializeEvent{TargetValue: 5}, test.IncrementEvent{IncrementBy: 1}, test.InitializeEvent{TargetValue: 10})
+	commit(t, store, registry, "b", test.IncrementEvent{IncrementBy: 1})
+	commit(t, store, registry, "c", test.InitializeEvent{TargetValue: 5})
+
+	scanner := NewScanner(store, registry)
+	for _, key := range []string{"a", "b", "c", "missing"} {
+		assert.Nil(t, scanner.Scan(key))
+	}
+
+	report := scanner.Report()
+	assert.Equal(t, 4, report.Streams)
+	assert.Len(t, report.Usage, 1)
+
+	usage := report.Usage[eventsourcing.EventType("InitializeEvent")]
+	assert.Equal(t, eventsourcing.EventType("TargetSetEvent"), usage.Replacement)
+	assert.Equal(t, 2, usage.Streams)
+	assert.Equal(t, 3, usage.Events)
+	assert.Equal(t, []string{"a", "c"}, usage.Keys)
+	assert.Empty(t, report.Retirable())
+}
+
+// TestScanRetirable checks unused deprecated types can be retired.
+func TestScanRetirable(t *testing.T) {
+	store := memory.NewStore()
+	registry := newRegistry()
+	commit(t, store, registry, "a", test.IncrementEvent{IncrementBy: 1})
+
+	scanner := NewScanner(store, registry)
+	scanner.MaxKeys = 0
+	assert.Nil(t, scanner.Scan("a"))
+	assert.Equal(t, []eventsourcing.EventType{"InitializeEvent"}, scanner.Report().Retirable())
+}
+
+// TestScanRejectsSnapshots checks a snapshot can't hide deprecated events.
+func TestScanRejectsSnapshots(t *testing.T) {
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(memorysnap.Create(memorysnap.Parameters{SnapInterval: 1}))
+	registry := newRegistry()
+	commit(t, store, registry, "a", test.InitializeEvent{TargetValue: 5})
+
+	scanner := NewScanner(store, registry)
+	assert.NotNil(t, scanner.Scan("a"))
+}
@@ -0,0 +1,233 @@
+/*
+Package routing lets one consumer serve several independent sets of handlers, by
+routing each event to a group chosen by the key or domain of its aggregate:
+
+	router := routing.NewRouter(routing.Options{})
+	router.Route("orders", routing.KeyPrefix("order/")).AddHandler(orderTotals)
+	router.Route("customers", routing.KeyPrefix("customer/")).AddHandler(customerLookup)
+	consumer.AddHandler(router)
+
+Groups are matched in the order they were added, and each event is handled by the
+first group whose rule matches, so a failure in one group is never redelivered to
+another. Events matching no group are ignored. Groups must be set up before the
+router is added to a consumer, as consumers read the router's subscriptions when
+it is added.
+
+Handlers that checkpoint their state, such as projection.Runner, are checkpointed
+per group with Group.Checkpoint, so the projections serving each group can be
+saved (and restored) independently.
+*/
+package routing
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// Rule decides whether an event belongs to a group.
+type Rule func(event eventsourcing.PublishedEvent) bool
+
+// KeyPrefix matches events whose aggregate key starts with any of the prefixes.
+func KeyPrefix(prefixes ...string) Rule {
+	return func(event eventsourcing.PublishedEvent) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(event.Key, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Domain matches events of any of the domains.
+func Domain(domains ...string) Rule {
+	return func(event eventsourcing.PublishedEvent) bool {
+		for _, domain := range domains {
+			if event.Domain == domain {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// AllOf matches events that every rule matches.
+func AllOf(rules ...Rule) Rule {
+	return func(event eventsourcing.PublishedEvent) bool {
+		for _, rule := range rules {
+			if !rule(event) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Checkpointer is implemented by handlers that can save their state, such as
+// projection.Runner.
+type Checkpointer interface {
+	// Checkpoint saves the state of the handler.
+	Checkpoint() error
+}
+
+// ErrorCallback is called when a handler of a group fails. Returning nil skips the
+// event for the group, while returning an error fails the delivery, so the consumer
+// retries it.
+type ErrorCallback func(group string, event eventsourcing.PublishedEvent, err error) error
+
+// Options configures a router.
+type Options struct {
+	OnError ErrorCallback // Decides what to do with handler failures, failing the delivery by default
+}
+
+// Router is an event handler that routes events to groups of handlers.
+type Router struct {
+	options Options
+	groups  []*Group
+}
+
+// Group is a set of handlers that receive the events matched by a rule.
+type Group struct {
+	name     string
+	rule     Rule
+	handlers []eventsourcing.EventHandler
+	filter   eventsourcing.SubscriptionFilter
+}
+
+// NewRouter creates a router without any groups.
+func NewRouter(options Options) *Router {
+	if options.OnError == nil {
+		options.OnError = func(group string, event eventsourcing.PublishedEvent, err error) error {
+			return err
+		}
+	}
+
+	return &Router{
+		options: options,
+		groups:  make([]*Group, 0),
+	}
+}
+
+// Route adds a group that receives the events matched by a rule, and which no
+// earlier group matches.
+func (router *Router) Route(name string, rule Rule) *Group {
+	group := &Group{
+		name:     name,
+		rule:     rule,
+		handlers: make([]eventsourcing.EventHandler, 0),
+	}
+	router.groups = append(router.groups, group)
+	return group
+}
+
+// Group gets a group by name, or nil if there is no such group.
+func (router *Router) Group(name string) *Group {
+	for _, group := range router.groups {
+		if group.name == name {
+			return group
+		}
+	}
+	return nil
+}
+
+// Handle routes an event to the first group that matches it.
+func (router *Router) Handle(event eventsourcing.PublishedEvent) error {
+	for _, group := range router.groups {
+		if !group.rule(event) {
+			continue
+		}
+
+		errHandle := group.Handle(event)
+		if errHandle != nil {
+			return router.options.OnError(group.name, event, errHandle)
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// Subscriptions gets the event types any group handles, or nil if a group has a
+// handler that handles every type.
+func (router *Router) Subscriptions() []eventsourcing.EventType {
+	seen := make(map[eventsourcing.EventType]bool)
+	types := make([]eventsourcing.EventType, 0)
+	for _, group := range router.groups {
+		for _, handler := range group.handlers {
+			handled, subscribed := eventsourcing.SubscriptionsFor(handler)
+			if !subscribed {
+				return nil
+			}
+
+			for _, eventType := range handled {
+				if !seen[eventType] {
+					seen[eventType] = true
+					types = append(types, eventType)
+				}
+			}
+		}
+	}
+
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// Checkpoint checkpoints every group, returning the first failure.
+func (router *Router) Checkpoint() error {
+	var errFirst error
+	for _, group := range router.groups {
+		errCheckpoint := group.Checkpoint()
+		if errCheckpoint != nil && errFirst == nil {
+			errFirst = errCheckpoint
+		}
+	}
+	return errFirst
+}
+
+// Name gets the name of the group.
+func (group *Group) Name() string {
+	return group.name
+}
+
+// AddHandler appends a handler to the group. The handler's subscriptions are read
+// when it is added, so it must be initialized.
+func (group *Group) AddHandler(handler eventsourcing.EventHandler) {
+	group.handlers = append(group.handlers, handler)
+	group.filter = eventsourcing.NewSubscriptionFilter(group.handlers)
+}
+
+// Handle passes an event to the handlers of the group that subscribe to it,
+// regardless of the group's rule.
+func (group *Group) Handle(event eventsourcing.PublishedEvent) error {
+	for index, handler := range group.handlers {
+		if !group.filter.Handles(index, event.Type) {
+			continue
+		}
+
+		errHandle := handler.Handle(event)
+		if errHandle != nil {
+			return errHandle
+		}
+	}
+	return nil
+}
+
+// Checkpoint checkpoints the handlers of the group that can save their state,
+// returning the first failure.
+func (group *Group) Checkpoint() error {
+	var errFirst error
+	for _, handler := range group.handlers {
+		checkpointer, ok := handler.(Checkpointer)
+		if !ok {
+			continue
+		}
+
+		errCheckpoint := checkpointer.Checkpoint()
+		if errCheckpoint != nil && errFirst == nil {
+			errFirst = errCheckpoint
+		}
+	}
+	return errFirst
+}
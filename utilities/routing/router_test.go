@@ -0,0 +1,121 @@
+package routing
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// subscribedHandler is a logging handler that subscribes to some event types
+type subscribedHandler struct {
+	test.LoggingHandler
+	types []eventsourcing.EventType
+}
+
+// Subscriptions gets the event types of the handler
+func (handler *subscribedHandler) Subscriptions() []eventsourcing.EventType {
+	return handler.types
+}
+
+// failingHandler fails every event, and counts checkpoints
+type failingHandler struct {
+	checkpoints int
+}
+
+func (handler *failingHandler) Handle(event eventsourcing.PublishedEvent) error {
+	return errors.New("Handler failed")
+}
+
+func (handler *failingHandler) Checkpoint() error {
+	handler.checkpoints++
+	return nil
+}
+
+// event creates a published event
+func event(domain string, key string, eventType eventsourcing.EventType) eventsourcing.PublishedEvent {
+	return eventsourcing.PublishedEvent{Domain: domain, Key: key, Type: eventType, Sequence: 1}
+}
+
+// TestRouting checks events reach the first matching group only
+func TestRouting(t *testing.T) {
+	orders := test.CreateLoggingHandler()
+	customers := test.CreateLoggingHandler()
+	billing := test.CreateLoggingHandler()
+
+	router := NewRouter(Options{})
+	router.Route("orders", KeyPrefix("order/")).AddHandler(&orders)
+	router.Route("customers", KeyPrefix("customer/", "client/")).AddHandler(&customers)
+	router.Route("billing", Domain("Billing")).AddHandler(&billing)
+
+	assert.Nil(t, router.Handle(event("Sales", "order/1", "OrderPlaced")))
+	assert.Nil(t, router.Handle(event("Sales", "client/2", "CustomerCreated")))
+	assert.Nil(t, router.Handle(event("Billing", "order/3", "OrderPlaced")))
+	assert.Nil(t, router.Handle(event("Billing", "invoice/4", "InvoiceRaised")))
+	assert.Nil(t, router.Handle(event("Sales", "product/5", "ProductAdded")), "Unrouted events should be ignored")
+
+	assert.Equal(t, 2, len(orders.Events))
+	assert.Equal(t, 1, len(customers.Events))
+	assert.Equal(t, 1, len(billing.Events))
+	assert.Equal(t, "invoice/4", billing.Events[0].Key)
+	assert.Equal(t, "billing", router.Group("billing").Name())
+	assert.Nil(t, router.Group("missing"))
+}
+
+// TestAllOf checks rules can be combined
+func TestAllOf(t *testing.T) {
+	rule := AllOf(Domain("Sales"), KeyPrefix("order/"))
+	assert.True(t, rule(event("Sales", "order/1", "OrderPlaced")))
+	assert.False(t, rule(event("Billing", "order/1", "OrderPlaced")))
+	assert.False(t, rule(event("Sales", "customer/1", "OrderPlaced")))
+}
+
+// TestErrorIsolation checks failures can be skipped per group
+func TestErrorIsolation(t *testing.T) {
+	failing := &failingHandler{}
+	healthy := test.CreateLoggingHandler()
+	failed := make([]string, 0)
+
+	router := NewRouter(Options{})
+	router.Route("failing", KeyPrefix("order/")).AddHandler(failing)
+	assert.NotNil(t, router.Handle(event("Sales", "order/1", "OrderPlaced")), "Failures should fail the delivery by default")
+
+	router = NewRouter(Options{
+		OnError: func(group string, event eventsourcing.PublishedEvent, err error) error {
+			failed = append(failed, group)
+			return nil
+		},
+	})
+	router.Route("failing", KeyPrefix("order/")).AddHandler(failing)
+	router.Route("healthy", KeyPrefix("customer/")).AddHandler(&healthy)
+
+	assert.Nil(t, router.Handle(event("Sales", "order/1", "OrderPlaced")))
+	assert.Nil(t, router.Handle(event("Sales", "customer/1", "CustomerCreated")))
+	assert.Equal(t, []string{"failing"}, failed)
+	assert.Equal(t, 1, len(healthy.Events))
+
+	// Only handlers that can checkpoint are checkpointed
+	assert.Nil(t, router.Checkpoint())
+	assert.Equal(t, 1, failing.checkpoints)
+}
+
+// TestSubscriptions checks the router subscribes to the types of its groups
+func TestSubscriptions(t *testing.T) {
+	orders := &subscribedHandler{LoggingHandler: test.CreateLoggingHandler(), types: []eventsourcing.EventType{"OrderPlaced"}}
+	customers := &subscribedHandler{LoggingHandler: test.CreateLoggingHandler(), types: []eventsourcing.EventType{"CustomerCreated", "OrderPlaced"}}
+
+	router := NewRouter(Options{})
+	router.Route("orders", KeyPrefix("order/")).AddHandler(orders)
+	router.Route("customers", KeyPrefix("customer/")).AddHandler(customers)
+	assert.Equal(t, []eventsourcing.EventType{"CustomerCreated", "OrderPlaced"}, router.Subscriptions())
+
+	// Groups skip handlers that don't subscribe to the type
+	assert.Nil(t, router.Handle(event("Sales", "order/1", "OrderCancelled")))
+	assert.Equal(t, 0, len(orders.Events))
+
+	everything := test.CreateLoggingHandler()
+	router.Route("all", KeyPrefix("")).AddHandler(&everything)
+	assert.Nil(t, router.Subscriptions())
+}
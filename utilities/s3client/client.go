@@ -0,0 +1,90 @@
+/*
+Package s3client is a minimal client for the objects of an S3 bucket, which signs
+requests with the SigV4 signer of the AWS SDK. It's shared by the packages that
+keep objects in S3 (archive batches, snapshots), so they address and sign
+requests the same way:
+
+	objects := s3client.New(session, "bucket")
+	response, errPut := objects.Do(http.MethodPut, "name", body, nil)
+*/
+package s3client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// Client sends signed requests for the objects of a bucket.
+type Client struct {
+	session *session.Session
+	signer  *v4.Signer
+	client  *http.Client
+	bucket  string
+}
+
+// New creates a client for the objects of a bucket. Credentials, region, endpoint
+// and HTTP client are taken from the session. If the session specifies an endpoint
+// (i.e. for a local S3-compatible server) path-style addressing is used.
+func New(session *session.Session, bucket string) *Client {
+	client := session.Config.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &Client{
+		session: session,
+		signer:  v4.NewSigner(session.Config.Credentials),
+		client:  client,
+		bucket:  bucket,
+	}
+}
+
+// Bucket gets the name of the bucket
+func (objects *Client) Bucket() string {
+	return objects.bucket
+}
+
+// ObjectURL determines the URL of an object
+func (objects *Client) ObjectURL(name string) string {
+	path := (&url.URL{Path: name}).EscapedPath()
+	endpoint := aws.StringValue(objects.session.Config.Endpoint)
+	if endpoint != "" {
+		return fmt.Sprintf("%v/%v/%v", strings.TrimSuffix(endpoint, "/"), objects.bucket, path)
+	}
+
+	return fmt.Sprintf("https://%v.s3.%v.amazonaws.com/%v", objects.bucket, aws.StringValue(objects.session.Config.Region), path)
+}
+
+// Do signs and sends a request for an object, with an optional body and headers.
+// The caller must close the body of the response.
+func (objects *Client) Do(method string, name string, body []byte, headers map[string]string) (*http.Response, error) {
+	request, errRequest := http.NewRequest(method, objects.ObjectURL(name), nil)
+	if errRequest != nil {
+		return nil, errRequest
+	}
+	for header, value := range headers {
+		request.Header.Set(header, value)
+	}
+
+	var payload io.ReadSeeker
+	if body != nil {
+		payload = bytes.NewReader(body)
+		request.ContentLength = int64(len(body))
+	}
+
+	_, errSign := objects.signer.Sign(request, payload, "s3", aws.StringValue(objects.session.Config.Region), time.Now())
+	if errSign != nil {
+		return nil, errSign
+	}
+
+	return objects.client.Do(request)
+}
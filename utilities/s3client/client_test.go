@@ -0,0 +1,65 @@
+package s3client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSession creates a session for a region, with an optional endpoint
+func testSession(t *testing.T, endpoint string) *session.Session {
+	config := &aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
+
+	result, errSession := session.NewSession(config)
+	require.Nil(t, errSession)
+	return result
+}
+
+// TestObjectURL checks objects are addressed by virtual host on AWS, and by path
+// on other endpoints
+func TestObjectURL(t *testing.T) {
+	assert.Equal(t, "https://bucket.s3.us-east-1.amazonaws.com/a/b%20c", New(testSession(t, ""), "bucket").ObjectURL("a/b c"))
+	assert.Equal(t, "http://localhost:9000/bucket/a/b", New(testSession(t, "http://localhost:9000/"), "bucket").ObjectURL("a/b"))
+}
+
+// TestDo checks requests are signed, and carry their body and headers
+func TestDo(t *testing.T) {
+	var method, path, auth, contentType, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		method, path, auth, contentType, body = r.Method, r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("Content-Type"), string(data)
+	}))
+	defer server.Close()
+
+	objects := New(testSession(t, server.URL), "bucket")
+	assert.Equal(t, "bucket", objects.Bucket())
+
+	response, errDo := objects.Do(http.MethodPut, "events/batch.jsonl", []byte("{}\n"), map[string]string{"Content-Type": "application/x-ndjson"})
+	assert.Nil(t, errDo)
+	response.Body.Close()
+	assert.Equal(t, http.MethodPut, method)
+	assert.Equal(t, "/bucket/events/batch.jsonl", path)
+	assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=id/"))
+	assert.Equal(t, "application/x-ndjson", contentType)
+	assert.Equal(t, "{}\n", body)
+
+	response, errDo = objects.Do(http.MethodGet, "events/batch.jsonl", nil, nil)
+	assert.Nil(t, errDo)
+	response.Body.Close()
+	assert.Equal(t, http.MethodGet, method)
+	assert.Equal(t, "", body)
+}
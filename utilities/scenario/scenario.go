@@ -0,0 +1,316 @@
+/*
+Package scenario runs end-to-end tests of a slice of a system, wiring aggregates, an
+in-memory event store, in-process distribution and projections together. A scenario is
+a series of steps, each of which either sends a command to an aggregate or checks the
+state of an aggregate or projection:
+
+	{
+		"deposit-then-withdraw": {
+			"steps": [
+				{ "aggregate": "account", "key": "acc-1", "command": "DepositCommand", "data": { "amount": 10 } },
+				{ "aggregate": "account", "key": "acc-1", "command": "WithdrawCommand", "data": { "amount": 50 }, "error": "insufficient_funds" },
+				{ "projection": "balances", "expect": { "total": 10 } },
+				{ "aggregate": "account", "key": "acc-1", "expect": { "balance": 10 } }
+			]
+		}
+	}
+
+Every scenario starts from an empty store and freshly created projections, so
+scenarios can run in any order.
+*/
+package scenario
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/distribution/inproc"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/go-gadgets/eventsourcing/stores/middleware/publish"
+	"github.com/go-gadgets/eventsourcing/utilities/mapping"
+	"github.com/go-gadgets/eventsourcing/utilities/projection"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/mitchellh/mapstructure"
+)
+
+// AggregateFactory creates an aggregate bound to a store
+type AggregateFactory func(key string, store eventsourcing.EventStore) eventsourcing.AggregateBase
+
+// ProjectionFactory creates an empty projection
+type ProjectionFactory func() projection.Projection
+
+// Scenarios is a named set of scenarios
+type Scenarios map[string]Scenario
+
+// Scenario is a series of steps to run against the system
+type Scenario struct {
+	Steps []Step `json:"steps"` // Steps to run, in order
+}
+
+// Step is a single command, or an expectation of state
+type Step struct {
+	Aggregate  string                 `json:"aggregate"`  // Aggregate to send a command to or check
+	Key        string                 `json:"key"`        // Key of the aggregate
+	Command    string                 `json:"command"`    // Type of command to send
+	Data       map[string]interface{} `json:"data"`       // Data for the command
+	Error      string                 `json:"error"`      // Error/fault the command should fail with
+	Projection string                 `json:"projection"` // Projection to check
+	Expect     map[string]interface{} `json:"expect"`     // Expected state of the aggregate or projection
+}
+
+// aggregate is a registered aggregate type
+type aggregate struct {
+	commands eventsourcing.CommandRegistry // Commands the aggregate handles
+	factory  AggregateFactory              // Factory for instances
+}
+
+// Harness holds the aggregates and projections that make up the system under test
+type Harness struct {
+	registry    eventsourcing.EventRegistry  // Registry of all events
+	aggregates  map[string]aggregate         // Aggregates by name
+	projections map[string]ProjectionFactory // Projections by name
+}
+
+// Create a harness for a system whose events are in the specified registry
+func Create(registry eventsourcing.EventRegistry) *Harness {
+	return &Harness{
+		registry:    registry,
+		aggregates:  make(map[string]aggregate),
+		projections: make(map[string]ProjectionFactory),
+	}
+}
+
+// AddAggregate registers an aggregate that scenarios can send commands to
+func (harness *Harness) AddAggregate(name string, commands eventsourcing.CommandRegistry, factory AggregateFactory) {
+	harness.aggregates[name] = aggregate{
+		commands: commands,
+		factory:  factory,
+	}
+}
+
+// AddProjection registers a projection that receives all committed events
+func (harness *Harness) AddProjection(name string, factory ProjectionFactory) {
+	harness.projections[name] = factory
+}
+
+// RunRecursive runs all scenarios in the .json files under a folder
+func (harness *Harness) RunRecursive(t *testing.T, path string) error {
+	files := []string{}
+	errWalk := filepath.Walk(path, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !f.IsDir() && strings.HasSuffix(strings.ToLower(f.Name()), ".json") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if errWalk != nil {
+		t.Error(errWalk)
+		return errWalk
+	}
+
+	for _, file := range files {
+		errFile := harness.RunFile(t, file)
+		if errFile != nil {
+			return errFile
+		}
+	}
+
+	return nil
+}
+
+// RunFile runs all scenarios within a file
+func (harness *Harness) RunFile(t *testing.T, fileName string) error {
+	t.Logf("Starting to run scenarios from file %v", fileName)
+	data, errRead := ioutil.ReadFile(fileName)
+	if errRead != nil {
+		t.Error(errRead)
+		return errRead
+	}
+
+	scenarios := Scenarios{}
+	errUnmarshal := json.Unmarshal(data, &scenarios)
+	if errUnmarshal != nil {
+		t.Error(errUnmarshal)
+		return errUnmarshal
+	}
+
+	// Run in a stable order, so failures are reproducible
+	names := make([]string, 0, len(scenarios))
+	for name := range scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		t.Logf(" ==> %v\n", name)
+		errRun := harness.Run(t, scenarios[name])
+		if errRun != nil {
+			return errRun
+		}
+	}
+
+	return nil
+}
+
+// Run a single scenario against a fresh store and projections
+func (harness *Harness) Run(t *testing.T, scenario Scenario) error {
+	errRun := harness.runInternal(t, scenario)
+	if errRun != nil {
+		t.Error(errRun)
+	}
+	return errRun
+}
+
+// runInternal runs a scenario
+func (harness *Harness) runInternal(t *testing.T, scenario Scenario) error {
+	distributor := inproc.Create(harness.registry)
+	projections := make(map[string]projection.Projection)
+	for name, factory := range harness.projections {
+		instance := factory()
+		projections[name] = instance
+		distributor.AddHandler(instance)
+	}
+	distributor.Start()
+	defer distributor.Stop()
+
+	store := eventsourcing.NewMiddlewareWrapper(memory.NewStore())
+	store.Use(publish.Create(distributor))
+	defer store.Close()
+
+	for index, step := range scenario.Steps {
+		var errStep error
+		switch {
+		case step.Projection != "":
+			errStep = harness.checkProjection(projections, step)
+		case step.Command != "":
+			errStep = harness.runCommand(t, store, step)
+		default:
+			errStep = harness.checkAggregate(store, step)
+		}
+
+		if errStep != nil {
+			return fmt.Errorf("Step %v: %v", index+1, errStep)
+		}
+	}
+
+	return nil
+}
+
+// runCommand sends a command to an aggregate and commits the outcome
+func (harness *Harness) runCommand(t *testing.T, store eventsourcing.EventStore, step Step) error {
+	target, found := harness.aggregates[step.Aggregate]
+	if !found {
+		return fmt.Errorf("Unknown aggregate: %v", step.Aggregate)
+	}
+
+	cmd := target.commands.CreateCommand(eventsourcing.CommandType(step.Command))
+	config := &mapstructure.DecoderConfig{
+		DecodeHook:       eventsourcing.DecodeHookFor(target.commands),
+		TagName:          "json",
+		Result:           &cmd,
+		WeaklyTypedInput: true,
+	}
+	errDecode := decode(config, step.Data)
+	if errDecode != nil {
+		return errDecode
+	}
+	t.Logf("   --> %v/%v: %v, ", step.Aggregate, step.Key, step.Command)
+
+	agg := target.factory(step.Key, store)
+	errLoad := agg.Refresh()
+	if errLoad != nil {
+		return errLoad
+	}
+
+	errCmd := agg.Handle(reflect.ValueOf(cmd).Elem().Interface())
+	if step.Error != "" {
+		if errCmd == nil {
+			return fmt.Errorf("Expected %v to fail with %v, but it succeeded", step.Command, step.Error)
+		}
+		if !strings.Contains(errCmd.Error(), step.Error) {
+			return fmt.Errorf("Expected %v to fail with %v, but got: %v", step.Command, step.Error, errCmd)
+		}
+		t.Logf("       (Found error, as expected: %v)", step.Error)
+		return nil
+	}
+	if errCmd != nil {
+		return errCmd
+	}
+
+	return agg.Commit()
+}
+
+// checkAggregate compares the state of an aggregate to the expected state
+func (harness *Harness) checkAggregate(store eventsourcing.EventStore, step Step) error {
+	target, found := harness.aggregates[step.Aggregate]
+	if !found {
+		return fmt.Errorf("Unknown aggregate: %v", step.Aggregate)
+	}
+
+	agg := target.factory(step.Key, store)
+	errLoad := agg.Refresh()
+	if errLoad != nil {
+		return errLoad
+	}
+
+	return compare(fmt.Sprintf("aggregate %v/%v", step.Aggregate, step.Key), agg.State(), step.Expect)
+}
+
+// checkProjection compares the state of a projection to the expected state
+func (harness *Harness) checkProjection(projections map[string]projection.Projection, step Step) error {
+	target, found := projections[step.Projection]
+	if !found {
+		return fmt.Errorf("Unknown projection: %v", step.Projection)
+	}
+
+	return compare(fmt.Sprintf("projection %v", step.Projection), target.State(), step.Expect)
+}
+
+// compare decodes the expected state into a new instance of the actual state's
+// type, and reports any difference between the two.
+func compare(name string, actual interface{}, expect map[string]interface{}) error {
+	stateType := reflect.TypeOf(actual)
+	if stateType == nil || stateType.Kind() != reflect.Ptr {
+		return fmt.Errorf("State of %v must be a pointer, got %T", name, actual)
+	}
+
+	expected := reflect.New(stateType.Elem()).Interface()
+	config := &mapstructure.DecoderConfig{
+		DecodeHook:       mapping.DefaultDecodeHook(),
+		TagName:          "json",
+		Result:           expected,
+		WeaklyTypedInput: true,
+	}
+	errDecode := decode(config, expect)
+	if errDecode != nil {
+		return errDecode
+	}
+
+	diff := cmp.Diff(actual, expected, cmpopts.IgnoreUnexported(eventsourcing.AggregateBase{}))
+	if diff != "" {
+		return fmt.Errorf("State of %v did not match expected:\n%v", name, diff)
+	}
+
+	return nil
+}
+
+// decode runs a mapstructure decode with the specified configuration
+func decode(config *mapstructure.DecoderConfig, data map[string]interface{}) error {
+	decoder, errDecoder := mapstructure.NewDecoder(config)
+	if errDecoder != nil {
+		return errDecoder
+	}
+
+	return decoder.Decode(data)
+}
@@ -0,0 +1,117 @@
+package scenario
+
+import (
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/projection"
+	"github.com/stretchr/testify/assert"
+)
+
+var events eventsourcing.EventRegistry
+var commands eventsourcing.CommandRegistry
+
+func init() {
+	events = eventsourcing.NewStandardEventRegistry("Scenario")
+	events.RegisterEvent(depositEvent{})
+
+	commands = eventsourcing.NewStandardCommandRegistry("Scenario")
+	commands.RegisterCommand(depositCommand{})
+}
+
+// account is an aggregate that accepts deposits, up to a limit
+type account struct {
+	eventsourcing.AggregateBase `json:"-"`
+	Balance                     int `json:"balance"`
+}
+
+// depositCommand adds money to an account
+type depositCommand struct {
+	Amount int `json:"amount"`
+}
+
+// depositEvent records money added to an account
+type depositEvent struct {
+	Amount int `json:"amount"`
+}
+
+func (agg *account) HandleDepositCommand(command depositCommand) ([]eventsourcing.Event, error) {
+	if agg.Balance+command.Amount > 100 {
+		return nil, eventsourcing.NewDomainFault(agg.GetKey(), "limit_exceeded")
+	}
+
+	return []eventsourcing.Event{depositEvent{Amount: command.Amount}}, nil
+}
+
+func (agg *account) ReplayDepositEvent(event depositEvent) {
+	agg.Balance += event.Amount
+}
+
+func accountFactory(key string, store eventsourcing.EventStore) eventsourcing.AggregateBase {
+	agg := &account{}
+	agg.AggregateBase.Initialize(key, events, store, func() interface{} { return agg })
+	agg.AutomaticWireup(agg)
+	return agg.AggregateBase
+}
+
+// totals is a projection of the money held across all accounts
+type totals struct {
+	Total    int `json:"total"`
+	Accounts int `json:"accounts"`
+}
+
+func (proj *totals) Handle(event eventsourcing.PublishedEvent) error {
+	deposit := event.Data.(depositEvent)
+	if event.Sequence == 1 {
+		proj.Accounts++
+	}
+	proj.Total += deposit.Amount
+	return nil
+}
+
+func (proj *totals) State() interface{} {
+	return proj
+}
+
+func harness() *Harness {
+	harness := Create(events)
+	harness.AddAggregate("account", commands, accountFactory)
+	harness.AddProjection("totals", func() projection.Projection {
+		return &totals{}
+	})
+	return harness
+}
+
+// TestScenarioFiles runs the scenarios in testdata
+func TestScenarioFiles(t *testing.T) {
+	assert.Nil(t, harness().RunRecursive(t, "testdata"))
+}
+
+// TestScenariosAreIsolated checks each scenario starts from an empty system
+func TestScenariosAreIsolated(t *testing.T) {
+	h := harness()
+	scenario := Scenario{
+		Steps: []Step{
+			{Aggregate: "account", Key: "a", Command: "depositCommand", Data: map[string]interface{}{"amount": 5}},
+			{Projection: "totals", Expect: map[string]interface{}{"total": 5, "accounts": 1}},
+		},
+	}
+
+	assert.Nil(t, h.Run(t, scenario))
+	assert.Nil(t, h.Run(t, scenario))
+}
+
+// TestFailedExpectations checks mismatches are reported
+func TestFailedExpectations(t *testing.T) {
+	cases := []Scenario{
+		{Steps: []Step{{Projection: "totals", Expect: map[string]interface{}{"total": 1}}}},
+		{Steps: []Step{{Aggregate: "account", Key: "a", Expect: map[string]interface{}{"balance": 1}}}},
+		{Steps: []Step{{Aggregate: "account", Key: "a", Command: "depositCommand", Error: "limit_exceeded"}}},
+		{Steps: []Step{{Aggregate: "unknown", Key: "a", Command: "depositCommand"}}},
+		{Steps: []Step{{Projection: "unknown"}}},
+	}
+
+	for _, scenario := range cases {
+		assert.NotNil(t, harness().runInternal(t, scenario))
+	}
+}
@@ -0,0 +1,291 @@
+/*
+Package sequence generates gap-free business sequence numbers, such as invoice or
+ticket numbers, using an event store. Each sequence is an aggregate whose events
+record the blocks of numbers issued, so a number is only handed out once the event
+issuing it is committed:
+
+	invoices := sequence.NewGenerator(store, "invoices", sequence.Options{Start: sequence.StartAt(1000)})
+	number, errNext := invoices.Next()
+
+Every number handed out must be used, since there is no way to return one. Callers
+that need numbers at the same time within a process are batched into a single
+commit, and conflicts with other processes are retried, so a busy sequence is not
+limited to one commit per number.
+
+Each batch is tagged with an ID, so a commit whose outcome is unknown (i.e. a
+network failure after the store wrote it) is checked by reloading the sequence: if
+the batch was written its numbers are handed out, and otherwise it is retried or
+fails. A gap is only left if the outcome can't be learnt either, because reloading
+fails too, or because the store writes the commit after it has been reported as
+failed and checked. Callers that need to account for every number should record
+the failures, which name the batch and the numbers it would have issued.
+*/
+package sequence
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-gadgets/eventsourcing"
+	uuid "github.com/satori/go.uuid"
+)
+
+var registry eventsourcing.EventRegistry
+
+func init() {
+	registry = eventsourcing.NewStandardEventRegistry("Sequences")
+	registry.RegisterEvent(NumbersIssuedEvent{})
+}
+
+// DefaultRetries is the number of attempts made to issue numbers when the sequence
+// is contended by other processes, if no other limit is specified.
+const DefaultRetries = 10
+
+// DefaultMaxBatch is the most requests issued by a single commit, if no other
+// limit is specified.
+const DefaultMaxBatch = 100
+
+// recentBatches is the number of batches a sequence remembers, so that a batch
+// whose commit had an unknown outcome can be found once the sequence is reloaded.
+const recentBatches = 64
+
+// Options configures a generator.
+type Options struct {
+	Start    *int64 // First number of the sequence (see StartAt), 1 if nil
+	Retries  int    // Attempts made when other processes issue numbers concurrently
+	MaxBatch int    // Most requests issued by a single commit
+}
+
+// StartAt gets the start of a sequence, for Options.Start.
+func StartAt(first int64) *int64 {
+	return &first
+}
+
+// NumbersIssuedEvent records a block of numbers being issued.
+type NumbersIssuedEvent struct {
+	First int64  `json:"first"`           // First number issued
+	Count int64  `json:"count"`           // Count of numbers issued
+	Batch string `json:"batch,omitempty"` // ID of the batch the numbers were issued to
+}
+
+// issuedBatch is a batch of numbers that was issued recently.
+type issuedBatch struct {
+	Batch string `json:"batch"` // ID of the batch
+	First int64  `json:"first"` // First number issued to it
+}
+
+// counter is the aggregate that tracks the next number of a sequence.
+type counter struct {
+	eventsourcing.AggregateBase
+	Started bool          `json:"started"` // Set once numbers have been issued
+	Next    int64         `json:"next"`    // Next number to issue
+	Recent  []issuedBatch `json:"recent"`  // Batches issued recently, oldest first
+}
+
+// ReplayNumbersIssuedEvent moves the sequence past the issued numbers.
+func (agg *counter) ReplayNumbersIssuedEvent(event NumbersIssuedEvent) {
+	agg.Started = true
+	agg.Next = event.First + event.Count
+	if event.Batch == "" {
+		return
+	}
+
+	agg.Recent = append(agg.Recent, issuedBatch{Batch: event.Batch, First: event.First})
+	if len(agg.Recent) > recentBatches {
+		agg.Recent = agg.Recent[len(agg.Recent)-recentBatches:]
+	}
+}
+
+// issued finds the first number issued to a recent batch.
+func (agg *counter) issued(batch string) (int64, bool) {
+	for _, recent := range agg.Recent {
+		if recent.Batch == batch {
+			return recent.First, true
+		}
+	}
+	return 0, false
+}
+
+// request is a caller waiting for numbers.
+type request struct {
+	count int64         // Numbers required
+	first int64         // First number issued
+	err   error         // Error issuing numbers
+	done  chan struct{} // Closed once issued
+	lead  chan struct{} // Closed if this request should issue the next batch
+}
+
+// Generator issues numbers from a sequence.
+type Generator struct {
+	store   eventsourcing.EventStore
+	name    string
+	options Options
+	lock    sync.Mutex
+	busy    bool       // Set while a batch is being issued
+	pending []*request // Requests waiting for the next batch
+	cached  *counter   // Sequence state after the last successful commit
+}
+
+// NewGenerator creates a generator for the named sequence.
+func NewGenerator(store eventsourcing.EventStore, name string, options Options) *Generator {
+	if options.Start == nil {
+		options.Start = StartAt(1)
+	}
+	if options.Retries <= 0 {
+		options.Retries = DefaultRetries
+	}
+	if options.MaxBatch <= 0 {
+		options.MaxBatch = DefaultMaxBatch
+	}
+
+	return &Generator{
+		store:   store,
+		name:    name,
+		options: options,
+		pending: make([]*request, 0),
+	}
+}
+
+// Next issues the next number in the sequence.
+func (gen *Generator) Next() (int64, error) {
+	return gen.NextN(1)
+}
+
+// NextN issues a contiguous block of numbers, returning the first.
+func (gen *Generator) NextN(count int64) (int64, error) {
+	if count <= 0 {
+		return 0, fmt.Errorf("sequence: cannot issue %v numbers from %v", count, gen.name)
+	}
+
+	req := &request{
+		count: count,
+		done:  make(chan struct{}),
+		lead:  make(chan struct{}),
+	}
+
+	gen.lock.Lock()
+	gen.pending = append(gen.pending, req)
+	if gen.busy {
+		// Wait for another caller to issue our numbers, or to hand over to us
+		gen.lock.Unlock()
+		select {
+		case <-req.done:
+			return req.first, req.err
+		case <-req.lead:
+		}
+		gen.lock.Lock()
+	}
+	gen.busy = true
+
+	// We're at the front of the queue, so issue a batch including ourselves
+	size := len(gen.pending)
+	if size > gen.options.MaxBatch {
+		size = gen.options.MaxBatch
+	}
+	batch := gen.pending[:size]
+	gen.pending = gen.pending[size:]
+	gen.lock.Unlock()
+
+	gen.issue(batch)
+
+	// Hand over to the next caller waiting, if any
+	gen.lock.Lock()
+	if len(gen.pending) > 0 {
+		close(gen.pending[0].lead)
+	} else {
+		gen.busy = false
+	}
+	gen.lock.Unlock()
+
+	return req.first, req.err
+}
+
+// issue commits a single event issuing the numbers for a batch of requests.
+func (gen *Generator) issue(batch []*request) {
+	total := int64(0)
+	for _, req := range batch {
+		total += req.count
+	}
+
+	id := fmt.Sprintf("%v", uuid.NewV4())
+	first := int64(0)
+	errIssue := eventsourcing.Retry(gen.options.Retries, func() error {
+		agg, errLoad := gen.load()
+		if errLoad != nil {
+			return errLoad
+		}
+
+		// An earlier attempt whose outcome was unknown may have been written
+		if issued, found := agg.issued(id); found {
+			first = issued
+			return nil
+		}
+
+		first = agg.Next
+		agg.ApplyEvent(NumbersIssuedEvent{
+			First: first,
+			Count: total,
+			Batch: id,
+		})
+
+		errCommit := agg.Commit()
+		if errCommit == nil {
+			gen.cached = agg
+			return nil
+		}
+
+		// The aggregate holds the failed event, so start afresh next time
+		gen.cached = nil
+		if isConcurrency, _ := eventsourcing.IsConcurrencyFault(errCommit); isConcurrency {
+			return errCommit
+		}
+		return gen.check(id, first, total, errCommit)
+	})
+
+	for _, req := range batch {
+		if errIssue != nil {
+			req.err = errIssue
+		} else {
+			req.first = first
+			first += req.count
+		}
+		close(req.done)
+	}
+}
+
+// check learns the outcome of a commit that failed for a reason other than a
+// concurrency fault, which may have been written regardless.
+func (gen *Generator) check(id string, first int64, total int64, errCommit error) error {
+	agg, errLoad := gen.load()
+	if errLoad != nil {
+		return fmt.Errorf("sequence: numbers %v to %v of %v may have been issued to batch %v: %v (and reloading failed: %v)", first, first+total-1, gen.name, id, errCommit, errLoad)
+	}
+
+	gen.cached = agg
+	if _, found := agg.issued(id); found {
+		return nil
+	}
+	return errCommit
+}
+
+// load brings the sequence up to date, reusing the last state if possible.
+func (gen *Generator) load() (*counter, error) {
+	agg := gen.cached
+	if agg == nil {
+		agg = &counter{}
+		agg.Initialize(gen.name, registry, gen.store, func() interface{} { return agg })
+		agg.AutomaticWireup(agg)
+	}
+
+	errRefresh := agg.Refresh()
+	if errRefresh != nil {
+		gen.cached = nil
+		return nil, errRefresh
+	}
+
+	// Snapshots taken before Started was recorded only have the next number
+	if !agg.Started && agg.Next == 0 {
+		agg.Next = *gen.options.Start
+	}
+	return agg, nil
+}
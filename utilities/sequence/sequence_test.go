@@ -0,0 +1,136 @@
+package sequence
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyStore is a store whose next commit fails, before or after it is written.
+type flakyStore struct {
+	eventsourcing.EventStore
+	failBefore bool // Fail the next commit without writing it
+	failAfter  bool // Write the next commit, then fail it
+}
+
+// CommitEvents writes a commit, unless it is set to fail
+func (store *flakyStore) CommitEvents(writer eventsourcing.StoreWriterAdapter) error {
+	if store.failBefore {
+		store.failBefore = false
+		return errors.New("connection reset")
+	}
+
+	errCommit := store.EventStore.CommitEvents(writer)
+	if errCommit == nil && store.failAfter {
+		store.failAfter = false
+		return errors.New("timed out")
+	}
+	return errCommit
+}
+
+// TestNext checks numbers are issued in order from the start.
+func TestNext(t *testing.T) {
+	gen := NewGenerator(memory.NewStore(), "invoices", Options{Start: StartAt(1000)})
+
+	for expected := int64(1000); expected < 1005; expected++ {
+		number, errNext := gen.Next()
+		assert.Nil(t, errNext)
+		assert.Equal(t, expected, number)
+	}
+
+	first, errBlock := gen.NextN(10)
+	assert.Nil(t, errBlock)
+	assert.Equal(t, int64(1005), first)
+
+	number, _ := gen.Next()
+	assert.Equal(t, int64(1015), number)
+
+	_, errInvalid := gen.NextN(0)
+	assert.NotNil(t, errInvalid)
+}
+
+// TestResume checks a new generator continues where the last left off.
+func TestResume(t *testing.T) {
+	store := memory.NewStore()
+	first := NewGenerator(store, "tickets", Options{})
+	first.Next()
+	first.Next()
+
+	number, errNext := NewGenerator(store, "tickets", Options{}).Next()
+	assert.Nil(t, errNext)
+	assert.Equal(t, int64(3), number)
+}
+
+// TestStartAtZero checks a sequence can start at zero.
+func TestStartAtZero(t *testing.T) {
+	gen := NewGenerator(memory.NewStore(), "tickets", Options{Start: StartAt(0)})
+	for expected := int64(0); expected < 3; expected++ {
+		number, errNext := gen.Next()
+		assert.Nil(t, errNext)
+		assert.Equal(t, expected, number)
+	}
+}
+
+// TestUnknownOutcome checks a commit that was written but reported as failed
+// hands out its numbers, while one that wasn't written issues nothing.
+func TestUnknownOutcome(t *testing.T) {
+	store := &flakyStore{EventStore: memory.NewStore()}
+	gen := NewGenerator(store, "invoices", Options{})
+
+	store.failAfter = true
+	number, errNext := gen.Next()
+	assert.Nil(t, errNext)
+	assert.Equal(t, int64(1), number)
+
+	store.failBefore = true
+	_, errNext = gen.Next()
+	assert.NotNil(t, errNext)
+
+	number, errNext = gen.Next()
+	assert.Nil(t, errNext)
+	assert.Equal(t, int64(2), number)
+
+	number, errNext = NewGenerator(store, "invoices", Options{}).Next()
+	assert.Nil(t, errNext)
+	assert.Equal(t, int64(3), number)
+}
+
+// TestGapFree checks concurrent callers, across generators sharing a store, are
+// issued every number exactly once.
+func TestGapFree(t *testing.T) {
+	store := memory.NewStore()
+	generators := []*Generator{
+		NewGenerator(store, "orders", Options{Retries: 1000}),
+		NewGenerator(store, "orders", Options{Retries: 1000, MaxBatch: 3}),
+	}
+
+	lock := sync.Mutex{}
+	issued := make([]int64, 0)
+	wait := sync.WaitGroup{}
+	for caller := 0; caller < 50; caller++ {
+		wait.Add(1)
+		go func(gen *Generator) {
+			defer wait.Done()
+			for index := 0; index < 10; index++ {
+				number, errNext := gen.Next()
+				assert.Nil(t, errNext)
+
+				lock.Lock()
+				issued = append(issued, number)
+				lock.Unlock()
+			}
+		}(generators[caller%len(generators)])
+	}
+	wait.Wait()
+
+	sort.Slice(issued, func(i, j int) bool { return issued[i] < issued[j] })
+	for index, number := range issued {
+		assert.Equal(t, int64(1+index), number)
+	}
+	assert.Equal(t, 500, len(issued))
+}
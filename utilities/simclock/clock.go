@@ -0,0 +1,181 @@
+/*
+Package simclock contains a virtual eventsourcing.Clock for deterministic tests of
+time-dependent behaviour. Time stands still until the test advances it, at which
+point any timers and tickers that fall due are fired in order:
+
+	clock := simclock.New(time.Unix(0, 0))
+	consumer, _ := feed.CreateConsumer(store, feed.Options{Clock: clock})
+	consumer.Start()
+	clock.BlockUntil(1)          // consumer is waiting to poll again
+	clock.Advance(time.Second)   // poll immediately
+*/
+package simclock
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// Clock is a virtual clock, whose time only moves when advanced.
+type Clock struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	now     time.Time
+	waiters []*waiter
+}
+
+// waiter is a pending timer or ticker.
+type waiter struct {
+	due    time.Time      // Time the waiter next fires
+	period time.Duration  // Period of a ticker, zero for a one-shot timer
+	fire   chan time.Time // Channel that ticks are sent on
+}
+
+// New creates a virtual clock that starts at the specified time.
+func New(start time.Time) *Clock {
+	clock := &Clock{
+		now: start,
+	}
+	clock.changed = sync.NewCond(&clock.lock)
+	return clock
+}
+
+// Now gets the current virtual time.
+func (clock *Clock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+// After sends the virtual time on the returned channel once the clock has been
+// advanced by the duration. Durations of zero or less fire immediately.
+func (clock *Clock) After(d time.Duration) <-chan time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	fire := make(chan time.Time, 1)
+	if d <= 0 {
+		fire <- clock.now
+		return fire
+	}
+
+	clock.add(&waiter{
+		due:  clock.now.Add(d),
+		fire: fire,
+	})
+	return fire
+}
+
+// NewTicker creates a ticker that fires each time the clock is advanced past a
+// period. As with time.Ticker, ticks are dropped if the receiver falls behind.
+func (clock *Clock) NewTicker(d time.Duration) eventsourcing.Ticker {
+	if d <= 0 {
+		panic("simclock: non-positive interval for NewTicker")
+	}
+
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	ticker := &ticker{
+		clock: clock,
+		waiter: &waiter{
+			due:    clock.now.Add(d),
+			period: d,
+			fire:   make(chan time.Time, 1),
+		},
+	}
+	clock.add(ticker.waiter)
+	return ticker
+}
+
+// Advance moves the clock forward, firing the timers and tickers that fall due in
+// the order of their due times. The clock reads the due time of each as it fires.
+func (clock *Clock) Advance(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	target := clock.now.Add(d)
+	for len(clock.waiters) > 0 && !clock.waiters[0].due.After(target) {
+		next := clock.waiters[0]
+		clock.now = next.due
+		select {
+		case next.fire <- next.due:
+		default:
+		}
+
+		clock.waiters = clock.waiters[1:]
+		if next.period > 0 {
+			next.due = next.due.Add(next.period)
+			clock.waiters = append(clock.waiters, next)
+			clock.sort()
+		}
+	}
+
+	clock.now = target
+	clock.changed.Broadcast()
+}
+
+// Waiters gets the number of timers and tickers that are pending.
+func (clock *Clock) Waiters() int {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return len(clock.waiters)
+}
+
+// BlockUntil waits until at least the specified number of timers and tickers are
+// pending, allowing a test to know that the code under test is waiting on the
+// clock before advancing it.
+func (clock *Clock) BlockUntil(count int) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	for len(clock.waiters) < count {
+		clock.changed.Wait()
+	}
+}
+
+// add registers a waiter. The lock must be held.
+func (clock *Clock) add(pending *waiter) {
+	clock.waiters = append(clock.waiters, pending)
+	clock.sort()
+	clock.changed.Broadcast()
+}
+
+// remove unregisters a waiter. The lock must be held.
+func (clock *Clock) remove(pending *waiter) {
+	for index, candidate := range clock.waiters {
+		if candidate == pending {
+			clock.waiters = append(clock.waiters[:index], clock.waiters[index+1:]...)
+			clock.changed.Broadcast()
+			return
+		}
+	}
+}
+
+// sort orders the waiters by due time, keeping the order they were added in for
+// waiters that fall due together. The lock must be held.
+func (clock *Clock) sort() {
+	sort.SliceStable(clock.waiters, func(i, j int) bool {
+		return clock.waiters[i].due.Before(clock.waiters[j].due)
+	})
+}
+
+// ticker is a Ticker driven by a virtual clock.
+type ticker struct {
+	clock  *Clock
+	waiter *waiter
+}
+
+// C gets the channel on which ticks are delivered
+func (ticker *ticker) C() <-chan time.Time {
+	return ticker.waiter.fire
+}
+
+// Stop turns off the ticker
+func (ticker *ticker) Stop() {
+	ticker.clock.lock.Lock()
+	defer ticker.clock.lock.Unlock()
+	ticker.clock.remove(ticker.waiter)
+}
@@ -0,0 +1,106 @@
+package simclock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+var start = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// received gets a value from a channel if one is waiting.
+func received(channel <-chan time.Time) (time.Time, bool) {
+	select {
+	case value := <-channel:
+		return value, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// TestInterface checks the clock can be used as an eventsourcing.Clock.
+func TestInterface(t *testing.T) {
+	var clock eventsourcing.Clock = New(start)
+	assert.Equal(t, start, clock.Now())
+}
+
+// TestAfter checks timers fire once the clock is advanced past them.
+func TestAfter(t *testing.T) {
+	clock := New(start)
+	fired := clock.After(time.Minute)
+	assert.Equal(t, 1, clock.Waiters())
+
+	clock.Advance(30 * time.Second)
+	_, ok := received(fired)
+	assert.False(t, ok)
+
+	clock.Advance(time.Minute)
+	value, ok := received(fired)
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(time.Minute), value)
+	assert.Equal(t, start.Add(90*time.Second), clock.Now())
+	assert.Equal(t, 0, clock.Waiters())
+}
+
+// TestAfterImmediate checks timers of no duration fire without advancing.
+func TestAfterImmediate(t *testing.T) {
+	clock := New(start)
+	value, ok := received(clock.After(0))
+	assert.True(t, ok)
+	assert.Equal(t, start, value)
+	assert.Equal(t, 0, clock.Waiters())
+}
+
+// TestTicker checks tickers fire every period, dropping ticks that aren't received,
+// and stop firing once stopped.
+func TestTicker(t *testing.T) {
+	clock := New(start)
+	ticker := clock.NewTicker(time.Second)
+
+	clock.Advance(time.Second)
+	value, ok := received(ticker.C())
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(time.Second), value)
+
+	clock.Advance(3 * time.Second)
+	value, ok = received(ticker.C())
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(2*time.Second), value)
+	_, ok = received(ticker.C())
+	assert.False(t, ok)
+
+	ticker.Stop()
+	assert.Equal(t, 0, clock.Waiters())
+	clock.Advance(time.Minute)
+	_, ok = received(ticker.C())
+	assert.False(t, ok)
+}
+
+// TestOrdering checks waiters fire in the order they fall due.
+func TestOrdering(t *testing.T) {
+	clock := New(start)
+	late := clock.After(2 * time.Second)
+	early := clock.After(time.Second)
+
+	clock.Advance(time.Second)
+	_, ok := received(early)
+	assert.True(t, ok)
+	_, ok = received(late)
+	assert.False(t, ok)
+}
+
+// TestBlockUntil checks a test can wait for code to start waiting on the clock.
+func TestBlockUntil(t *testing.T) {
+	clock := New(start)
+	done := make(chan time.Time)
+	go func() {
+		done <- <-clock.After(time.Hour)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour)
+	assert.Equal(t, start.Add(time.Hour), <-done)
+}
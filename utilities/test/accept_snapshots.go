@@ -0,0 +1,317 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// SnapshotStorage is a snapshot provider under test: a store wrapped with its
+// middleware, and the callbacks it stores snapshots with (as given to snapbase).
+type SnapshotStorage struct {
+	Store eventsourcing.EventStore                             // Store wrapped with the snapshot middleware
+	Inner eventsourcing.EventStore                             // Store the middleware wraps, to commit to behind its back
+	Get   func(key string) (interface{}, int64, error)         // Get a snapshot from the storage
+	Put   func(key string, seq int64, state interface{}) error // Put a snapshot into the storage
+	Purge func(key string) error                               // Purge a snapshot from the storage
+}
+
+// SnapshotOptions are the options a snapshot provider should be created with
+type SnapshotOptions struct {
+	Lazy         bool  // Lazy snapshots
+	SnapInterval int64 // Number of events between snaps
+}
+
+// A SnapshotProvider creates a snapshot provider for a check, returning a
+// function that closes it.
+type SnapshotProvider func(options SnapshotOptions) (SnapshotStorage, func(), error)
+
+// SnapshotFunc is a test function that runs in the context of a snapshot provider
+type SnapshotFunc func(storage SnapshotStorage) error
+
+// executeSnapshots checks a behaviour for a snapshot provider using a standard
+// setup/teardown, calling a lambda closure with the provider instance
+func executeSnapshots(t *testing.T, provider SnapshotProvider, options SnapshotOptions, fn SnapshotFunc) {
+	storage, cleanup, err := provider(options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cleanup()
+
+	errFn := fn(storage)
+	if errFn != nil {
+		t.Error(errFn)
+	}
+}
+
+// CheckSnapshotSuite performs unit testing of a snapshot provider, so that every
+// backend behaves the same way as far as the snapshot middleware is concerned.
+func CheckSnapshotSuite(t *testing.T, name string, provider SnapshotProvider) {
+	fmt.Printf("Running snapshot compliance suite for %v.....\n", name)
+
+	fmt.Println("  >> Get/Put")
+	CheckSnapshotGetPut(t, provider)
+	if t.Failed() {
+		return
+	}
+
+	fmt.Println("  >> Purge")
+	CheckSnapshotPurge(t, provider)
+	if t.Failed() {
+		return
+	}
+
+	fmt.Println("  >> Conditional writes")
+	CheckSnapshotConditionalWrites(t, provider)
+	if t.Failed() {
+		return
+	}
+
+	fmt.Println("  >> Snapshot and replay")
+	CheckSnapshotReplay(t, provider)
+	if t.Failed() {
+		return
+	}
+
+	fmt.Println("  >> Lazy snapshots")
+	CheckSnapshotLazy(t, provider)
+}
+
+// sameSnapshot checks a snapshot read from the storage holds the expected state,
+// comparing them as JSON, as providers may decode numbers differently
+func sameSnapshot(expected interface{}, actual interface{}) error {
+	expectedJSON, errExpected := json.Marshal(expected)
+	if errExpected != nil {
+		return errExpected
+	}
+	actualJSON, errActual := json.Marshal(actual)
+	if errActual != nil {
+		return errActual
+	}
+
+	var expectedValue, actualValue interface{}
+	json.Unmarshal(expectedJSON, &expectedValue)
+	json.Unmarshal(actualJSON, &actualValue)
+	if fmt.Sprint(expectedValue) != fmt.Sprint(actualValue) {
+		return fmt.Errorf("Snapshot should be %s: got %s", expectedJSON, actualJSON)
+	}
+	return nil
+}
+
+// expectSnapshot gets a snapshot, and checks its sequence and state
+func expectSnapshot(storage SnapshotStorage, key string, seq int64, state interface{}) error {
+	stored, storedSeq, errGet := storage.Get(key)
+	if errGet != nil {
+		return errGet
+	}
+	if storedSeq != seq {
+		return fmt.Errorf("Snapshot sequence should be %v: got %v", seq, storedSeq)
+	}
+	return sameSnapshot(state, stored)
+}
+
+// CheckSnapshotGetPut validates snapshots read back as they were written, and
+// that missing snapshots are reported without an error.
+func CheckSnapshotGetPut(t *testing.T, provider SnapshotProvider) {
+	executeSnapshots(t, provider, SnapshotOptions{}, func(storage SnapshotStorage) error {
+		dummyKey := getDummyKey()
+		missing, seq, errMissing := storage.Get(dummyKey)
+		if errMissing != nil {
+			return fmt.Errorf("Getting a missing snapshot failed: %v", errMissing)
+		}
+		if missing != nil || seq != 0 {
+			return fmt.Errorf("Missing snapshot should be nil at 0: got %v at %v", missing, seq)
+		}
+
+		state := map[string]interface{}{
+			"current_count": 3,
+			"name":          "snapshot",
+			"flags":         []interface{}{true, false},
+			"nested":        map[string]interface{}{"value": 1.5},
+		}
+		errPut := storage.Put(dummyKey, 3, state)
+		if errPut != nil {
+			return errPut
+		}
+
+		return expectSnapshot(storage, dummyKey, 3, state)
+	})
+}
+
+// CheckSnapshotPurge validates purged snapshots are gone, and that purging a
+// missing snapshot succeeds.
+func CheckSnapshotPurge(t *testing.T, provider SnapshotProvider) {
+	executeSnapshots(t, provider, SnapshotOptions{}, func(storage SnapshotStorage) error {
+		dummyKey := getDummyKey()
+		errMissing := storage.Purge(dummyKey)
+		if errMissing != nil {
+			return fmt.Errorf("Purging a missing snapshot failed: %v", errMissing)
+		}
+
+		errPut := storage.Put(dummyKey, 2, map[string]interface{}{"current_count": 2})
+		if errPut != nil {
+			return errPut
+		}
+		errPurge := storage.Purge(dummyKey)
+		if errPurge != nil {
+			return errPurge
+		}
+
+		purged, _, errGet := storage.Get(dummyKey)
+		if errGet != nil {
+			return errGet
+		}
+		if purged != nil {
+			return fmt.Errorf("Purged snapshot should be gone: got %v", purged)
+		}
+		return nil
+	})
+}
+
+// CheckSnapshotConditionalWrites validates a snapshot is never replaced by one of
+// an earlier sequence, while one of the same sequence is, so it can be rebuilt.
+func CheckSnapshotConditionalWrites(t *testing.T, provider SnapshotProvider) {
+	executeSnapshots(t, provider, SnapshotOptions{}, func(storage SnapshotStorage) error {
+		dummyKey := getDummyKey()
+		writes := []struct {
+			seq   int64
+			count int
+		}{{5, 5}, {3, 3}, {4, 4}}
+		for _, write := range writes {
+			errPut := storage.Put(dummyKey, write.seq, map[string]interface{}{"current_count": write.count})
+			if errPut != nil {
+				return fmt.Errorf("Writing an older snapshot should be skipped, not fail: %v", errPut)
+			}
+		}
+		errOlder := expectSnapshot(storage, dummyKey, 5, map[string]interface{}{"current_count": 5})
+		if errOlder != nil {
+			return errOlder
+		}
+
+		rebuilt := map[string]interface{}{"current_count": 50}
+		errRebuild := storage.Put(dummyKey, 5, rebuilt)
+		if errRebuild != nil {
+			return errRebuild
+		}
+		errSame := expectSnapshot(storage, dummyKey, 5, rebuilt)
+		if errSame != nil {
+			return errSame
+		}
+
+		newer := map[string]interface{}{"current_count": 8}
+		errNewer := storage.Put(dummyKey, 8, newer)
+		if errNewer != nil {
+			return errNewer
+		}
+		return expectSnapshot(storage, dummyKey, 8, newer)
+	})
+}
+
+// CheckSnapshotReplay validates commits are snapped at the interval, and that
+// aggregates are restored from their snapshot and replay the events after it.
+func CheckSnapshotReplay(t *testing.T, provider SnapshotProvider) {
+	executeSnapshots(t, provider, SnapshotOptions{SnapInterval: 5}, func(storage SnapshotStorage) error {
+		dummyKey := getDummyKey()
+		agg := SimpleAggregate{}
+		agg.Initialize(dummyKey, GetTestRegistry(), storage.Store)
+		for x := 0; x < 7; x++ {
+			agg.ApplyEvent(IncrementEvent{IncrementBy: 1})
+			errCommit := agg.Commit()
+			if errCommit != nil {
+				return errCommit
+			}
+		}
+
+		_, seq, errGet := storage.Get(dummyKey)
+		if errGet != nil {
+			return errGet
+		}
+		if seq != 5 {
+			return fmt.Errorf("Aggregate should be snapped at 5: got %v", seq)
+		}
+
+		// Doctor the snapshot, so that restoring it can be told apart from replaying
+		errPut := storage.Put(dummyKey, 5, map[string]interface{}{"current_count": 100})
+		if errPut != nil {
+			return errPut
+		}
+
+		loaded := SimpleAggregate{}
+		loaded.Initialize(dummyKey, GetTestRegistry(), storage.Store)
+		errRefresh := loaded.Refresh()
+		if errRefresh != nil {
+			return errRefresh
+		}
+		if loaded.CurrentCount != 102 || loaded.SequenceNumber() != 7 {
+			return fmt.Errorf("Aggregate should be restored to 100 and replayed to 102 at 7: got %v at %v", loaded.CurrentCount, loaded.SequenceNumber())
+		}
+		return nil
+	})
+}
+
+// CheckSnapshotLazy validates lazy snapshots are restored without reading the
+// store, and are purged when a commit hits a concurrency fault, so that the next
+// refresh sees changes made behind their back.
+func CheckSnapshotLazy(t *testing.T, provider SnapshotProvider) {
+	executeSnapshots(t, provider, SnapshotOptions{Lazy: true}, func(storage SnapshotStorage) error {
+		dummyKey := getDummyKey()
+		agg := SimpleAggregate{}
+		agg.Initialize(dummyKey, GetTestRegistry(), storage.Store)
+		agg.ApplyEvent(IncrementEvent{IncrementBy: 1})
+		errCommit := agg.Commit()
+		if errCommit != nil {
+			return errCommit
+		}
+
+		// Another instance commits to the inner store
+		direct := SimpleAggregate{}
+		direct.Initialize(dummyKey, GetTestRegistry(), storage.Inner)
+		errDirect := direct.Refresh()
+		if errDirect != nil {
+			return errDirect
+		}
+		direct.ApplyEvent(IncrementEvent{IncrementBy: 1})
+		errDirectCommit := direct.Commit()
+		if errDirectCommit != nil {
+			return errDirectCommit
+		}
+
+		stale := SimpleAggregate{}
+		stale.Initialize(dummyKey, GetTestRegistry(), storage.Store)
+		errStale := stale.Refresh()
+		if errStale != nil {
+			return errStale
+		}
+		if stale.CurrentCount != 1 {
+			return fmt.Errorf("Lazy snapshot should be restored at 1: got %v", stale.CurrentCount)
+		}
+
+		stale.ApplyEvent(IncrementEvent{IncrementBy: 1})
+		errFault := stale.Commit()
+		if isFault, _ := eventsourcing.IsConcurrencyFault(errFault); !isFault {
+			return fmt.Errorf("Expected concurrency fault, got: %v", errFault)
+		}
+
+		purged, _, errGet := storage.Get(dummyKey)
+		if errGet != nil {
+			return errGet
+		}
+		if purged != nil {
+			return fmt.Errorf("Snapshot should be purged after a concurrency fault: got %v", purged)
+		}
+
+		fresh := SimpleAggregate{}
+		fresh.Initialize(dummyKey, GetTestRegistry(), storage.Store)
+		errFresh := fresh.Refresh()
+		if errFresh != nil {
+			return errFresh
+		}
+		if fresh.CurrentCount != 2 {
+			return fmt.Errorf("Aggregate should be replayed to 2 after the purge: got %v", fresh.CurrentCount)
+		}
+		return nil
+	})
+}
@@ -92,6 +92,52 @@ func CheckStandardSuite(t *testing.T, name string, provider StoreProvider) {
 
 	fmt.Println("  >> Check refresh of dirty aggregate fails")
 	CheckDirtyRefresh(t, provider)
+	if t.Failed() {
+		return
+	}
+
+	fmt.Println("  >> Check empty commits are no-ops")
+	CheckEmptyCommit(t, provider)
+}
+
+// CheckEmptyCommit validates that committing an aggregate with no new events
+// succeeds and leaves the stream unchanged, both for new and existing streams.
+func CheckEmptyCommit(t *testing.T, provider StoreProvider) {
+	execute(t, provider, func(store eventsourcing.EventStore) error {
+		dummyKey := getDummyKey()
+		instance := SimpleAggregate{}
+		instance.Initialize(dummyKey, GetTestRegistry(), store)
+
+		errEmpty := instance.Commit()
+		if errEmpty != nil {
+			return fmt.Errorf("Empty commit of a new aggregate failed: %v", errEmpty)
+		}
+
+		instance.ApplyEvent(InitializeEvent{
+			TargetValue: 3,
+		})
+		errCommit := instance.Commit()
+		if errCommit != nil {
+			return errCommit
+		}
+
+		errRepeat := instance.Commit()
+		if errRepeat != nil {
+			return fmt.Errorf("Empty commit of an existing aggregate failed: %v", errRepeat)
+		}
+
+		second := SimpleAggregate{}
+		second.Initialize(dummyKey, GetTestRegistry(), store)
+		errRefresh := second.Refresh()
+		if errRefresh != nil {
+			return errRefresh
+		}
+		if second.SequenceNumber() != 1 {
+			return fmt.Errorf("Sequence number should be 1: got %v", second.SequenceNumber())
+		}
+
+		return nil
+	})
 }
 
 // CheckStartupShutdown checks a store starts up and shuts down cleanly.
@@ -11,7 +11,6 @@ import (
 	"testing"
 
 	"github.com/go-gadgets/eventsourcing"
-	"github.com/go-gadgets/eventsourcing/utilities/mapping"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/mitchellh/mapstructure"
@@ -111,7 +110,7 @@ func (tester *aggregateTester) runInternal(t *testing.T, aggregateKey string, te
 		cmd := tester.commands.CreateCommand(eventsourcing.CommandType(step.Type))
 
 		config := &mapstructure.DecoderConfig{
-			DecodeHook:       mapping.MapTimeFromJSON,
+			DecodeHook:       eventsourcing.DecodeHookFor(tester.commands),
 			TagName:          "json",
 			Result:           &cmd,
 			WeaklyTypedInput: true,
@@ -159,11 +158,12 @@ func (tester *aggregateTester) runInternal(t *testing.T, aggregateKey string, te
 			return errLoad
 		}
 
-		// Convert JSON to target
+		// Convert JSON to target, reviving value-objects with the adapters
+		// registered for commands
 		target := tester.factory(aggregateKey, tester.store)
 		state := target.State()
 		config := &mapstructure.DecoderConfig{
-			DecodeHook:       mapping.MapTimeFromJSON,
+			DecodeHook:       eventsourcing.DecodeHookFor(tester.commands),
 			TagName:          "json",
 			Result:           &state,
 			WeaklyTypedInput: true,
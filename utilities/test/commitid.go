@@ -0,0 +1,70 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// ambiguousStore is a store whose first commit is written, but reports a failure,
+// as when a connection drops before the outcome of a write is received.
+type ambiguousStore struct {
+	eventsourcing.EventStore
+	dropped bool
+}
+
+func (store *ambiguousStore) CommitEvents(writer eventsourcing.StoreWriterAdapter) error {
+	errCommit := store.EventStore.CommitEvents(writer)
+	if errCommit != nil || store.dropped {
+		return errCommit
+	}
+	store.dropped = true
+	return errors.New("Connection reset before the commit was acknowledged")
+}
+
+// CheckIdempotentCommits checks that a store accepts the retry of a commit that was
+// written, if it has the same commit ID, and still rejects conflicting commits.
+func CheckIdempotentCommits(t *testing.T, provider StoreProvider) {
+	execute(t, provider, func(store eventsourcing.EventStore) error {
+		key := getDummyKey()
+		instance := SimpleAggregate{}
+		instance.Initialize(key, GetTestRegistry(), &ambiguousStore{EventStore: store})
+		instance.ApplyEvent(IncrementEvent{IncrementBy: 1})
+		instance.ApplyEvent(IncrementEvent{IncrementBy: 2})
+		if instance.CommitWithID("commit-1") == nil {
+			return fmt.Errorf("Expected the first attempt to report a failure")
+		}
+
+		// Retry with the same ID
+		errRetry := instance.CommitWithID("commit-1")
+		if errRetry != nil {
+			return fmt.Errorf("Expected the retry to succeed, got: %v", errRetry)
+		}
+
+		reloaded := SimpleAggregate{}
+		reloaded.Initialize(key, GetTestRegistry(), store)
+		errRefresh := reloaded.Refresh()
+		if errRefresh != nil {
+			return errRefresh
+		}
+		if reloaded.SequenceNumber() != 2 || reloaded.CurrentCount != 3 {
+			return fmt.Errorf("Expected the events to be written once, got sequence %v and count %v", reloaded.SequenceNumber(), reloaded.CurrentCount)
+		}
+
+		// Commits with another ID, or none, still conflict
+		for _, id := range []string{"commit-2", ""} {
+			conflicting := SimpleAggregate{}
+			conflicting.Initialize(key, GetTestRegistry(), store)
+			conflicting.ApplyEvent(IncrementEvent{IncrementBy: 1})
+			conflicting.ApplyEvent(IncrementEvent{IncrementBy: 2})
+			errConflict := conflicting.CommitWithID(id)
+			if isFault, _ := eventsourcing.IsConcurrencyFault(errConflict); !isFault {
+				return fmt.Errorf("Expected a concurrency fault for commit ID %q, got: %v", id, errConflict)
+			}
+		}
+
+		return nil
+	})
+}
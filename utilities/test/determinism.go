@@ -0,0 +1,240 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/google/go-cmp/cmp"
+)
+
+// DeterminismFactory creates an aggregate bound to a store, for replay checks.
+type DeterminismFactory func(key string, store eventsourcing.EventStore) eventsourcing.AggregateBase
+
+// MaxSnapshotPoints is the most sequences that CheckReplayDeterminism takes a
+// snapshot at. Streams longer than this are checked at evenly spaced sequences.
+const MaxSnapshotPoints = 50
+
+// CheckReplayDeterminism replays the stream of an aggregate several ways, and fails
+// the test if the resulting states differ:
+//
+//   - The stream is replayed twice in full, which catches replay logic that uses the
+//     clock, random values or map iteration order.
+//   - The state at a range of sequences is snapshotted (as the snapshot middleware
+//     would, via JSON) and the remaining events replayed over the restored snapshot,
+//     which catches replay logic that depends on state that isn't persisted.
+//
+// States are compared by their JSON encoding, since that is what snapshots keep.
+func CheckReplayDeterminism(t *testing.T, store eventsourcing.EventStore, key string, factory DeterminismFactory) {
+	errCheck := checkReplayDeterminism(store, key, factory)
+	if errCheck != nil {
+		t.Error(errCheck)
+	}
+}
+
+// checkReplayDeterminism runs the determinism checks, returning the first failure
+func checkReplayDeterminism(store eventsourcing.EventStore, key string, factory DeterminismFactory) error {
+	// Replay in full, recording the stream as we go
+	recorder := &recordingStore{EventStore: store}
+	first := factory(key, recorder)
+	errFirst := first.Refresh()
+	if errFirst != nil {
+		return errFirst
+	}
+	if recorder.snapshot > 0 {
+		return errSnapshotted(key, recorder.snapshot)
+	}
+	expected, errExpected := encodeState(first.State())
+	if errExpected != nil {
+		return errExpected
+	}
+
+	// Replay again, which should match exactly
+	second := factory(key, store)
+	errSecond := second.Refresh()
+	if errSecond != nil {
+		return errSecond
+	}
+	actual, errActual := encodeState(second.State())
+	if errActual != nil {
+		return errActual
+	}
+	diff := cmp.Diff(expected, actual)
+	if diff != "" {
+		return fmt.Errorf("Replay of %v is not deterministic, a second full replay differs:\n%v", key, diff)
+	}
+
+	// Snapshot at a range of sequences, and replay the rest over the snapshot
+	for _, point := range snapshotPoints(recorder.records) {
+		partial := factory(key, &replayStore{records: recorder.records, until: point})
+		errPartial := partial.Refresh()
+		if errPartial != nil {
+			return errPartial
+		}
+		snapshot, errSnapshot := encodeState(partial.State())
+		if errSnapshot != nil {
+			return errSnapshot
+		}
+
+		restored := factory(key, &replayStore{records: recorder.records, snapshot: snapshot, from: point})
+		errRestored := restored.Refresh()
+		if errRestored != nil {
+			return errRestored
+		}
+		actual, errActual := encodeState(restored.State())
+		if errActual != nil {
+			return errActual
+		}
+
+		diff := cmp.Diff(expected, actual)
+		if diff != "" {
+			return fmt.Errorf("Replay of %v is not deterministic, a snapshot at %v with the remaining events replayed differs from a full replay:\n%v", key, point, diff)
+		}
+	}
+
+	return nil
+}
+
+// encodeState round-trips a state through JSON, as snapshots are
+func encodeState(state interface{}) (map[string]interface{}, error) {
+	encoded, errMarshal := json.Marshal(state)
+	if errMarshal != nil {
+		return nil, errMarshal
+	}
+
+	decoded := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	errDecode := decoder.Decode(&decoded)
+	return decoded, errDecode
+}
+
+// snapshotPoints picks the sequences to snapshot at, within a stream
+func snapshotPoints(records []replayRecord) []int64 {
+	points := make([]int64, 0)
+	if len(records) < 2 {
+		return points
+	}
+
+	// Never snapshot after the last event, there would be nothing left to replay
+	candidates := records[:len(records)-1]
+	step := 1
+	if len(candidates) > MaxSnapshotPoints {
+		step = (len(candidates) + MaxSnapshotPoints - 1) / MaxSnapshotPoints
+	}
+	for index := 0; index < len(candidates); index += step {
+		points = append(points, candidates[index].sequence)
+	}
+	return points
+}
+
+// replayRecord is an event, or a skip over sequences, seen during a replay
+type replayRecord struct {
+	sequence int64               // Sequence after the record
+	event    eventsourcing.Event // Event replayed, nil for skips
+}
+
+// recordingStore records the events replayed by the store it wraps
+type recordingStore struct {
+	eventsourcing.EventStore
+	records  []replayRecord
+	snapshot int64 // Sequence of any snapshot offered
+}
+
+// Refresh records the events replayed into the loader
+func (store *recordingStore) Refresh(loader eventsourcing.StoreLoaderAdapter) error {
+	return store.EventStore.Refresh(&recordingLoader{
+		StoreLoaderAdapter: loader,
+		store:              store,
+	})
+}
+
+// recordingLoader is a loader that records what is replayed into it
+type recordingLoader struct {
+	eventsourcing.StoreLoaderAdapter
+	store *recordingStore
+}
+
+// ReplayEvent records and replays an event
+func (loader *recordingLoader) ReplayEvent(event eventsourcing.Event) {
+	loader.StoreLoaderAdapter.ReplayEvent(event)
+	loader.store.records = append(loader.store.records, replayRecord{
+		sequence: loader.SequenceNumber(),
+		event:    event,
+	})
+}
+
+// AdvanceSequence records and applies a skip
+func (loader *recordingLoader) AdvanceSequence(sequence int64) error {
+	advancer, ok := loader.StoreLoaderAdapter.(eventsourcing.SequenceAdvancer)
+	if !ok {
+		return fmt.Errorf("StoreError: Aggregate %v does not support skipping to sequence %v", loader.GetKey(), sequence)
+	}
+
+	errAdvance := advancer.AdvanceSequence(sequence)
+	if errAdvance == nil {
+		loader.store.records = append(loader.store.records, replayRecord{sequence: sequence})
+	}
+	return errAdvance
+}
+
+// RestoreSnapshot refuses snapshots, since the full stream must be recorded
+func (loader *recordingLoader) RestoreSnapshot(sequence int64, state interface{}) error {
+	loader.store.snapshot = sequence
+	return errSnapshotted(loader.GetKey(), sequence)
+}
+
+// errSnapshotted describes a stream that can't be checked, because of a snapshot
+func errSnapshotted(key string, sequence int64) error {
+	return fmt.Errorf("Replay determinism of %v can't be checked past a snapshot at %v, use a store without snapshots", key, sequence)
+}
+
+// replayStore replays recorded events, optionally over a snapshot
+type replayStore struct {
+	NullStore
+	records  []replayRecord
+	snapshot map[string]interface{} // Snapshot to restore, if any
+	from     int64                  // Sequence of the snapshot
+	until    int64                  // Last sequence to replay, zero for all
+}
+
+// Refresh replays the recorded events into the loader
+func (store *replayStore) Refresh(loader eventsourcing.StoreLoaderAdapter) error {
+	if store.snapshot != nil {
+		errRestore := loader.RestoreSnapshot(store.from, store.snapshot)
+		if errRestore != nil {
+			return errRestore
+		}
+	}
+
+	for _, record := range store.records {
+		if record.sequence <= store.from {
+			continue
+		}
+		if store.until > 0 && record.sequence > store.until {
+			break
+		}
+
+		if record.event == nil {
+			errAdvance := advance(loader, record.sequence)
+			if errAdvance != nil {
+				return errAdvance
+			}
+			continue
+		}
+		loader.ReplayEvent(record.event)
+	}
+
+	return nil
+}
+
+// advance moves a loader forward, if it supports it
+func advance(loader eventsourcing.StoreLoaderAdapter, sequence int64) error {
+	advancer, ok := loader.(eventsourcing.SequenceAdvancer)
+	if !ok {
+		return fmt.Errorf("StoreError: Aggregate %v does not support skipping to sequence %v", loader.GetKey(), sequence)
+	}
+	return advancer.AdvanceSequence(sequence)
+}
@@ -0,0 +1,87 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/stores/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+// simpleFactory creates SimpleAggregate instances
+func simpleFactory(key string, store eventsourcing.EventStore) eventsourcing.AggregateBase {
+	agg := &SimpleAggregate{}
+	agg.Initialize(key, GetTestRegistry(), store)
+	return agg.AggregateBase
+}
+
+// clockAggregate records the time of replay, which differs between replays
+type clockAggregate struct {
+	eventsourcing.AggregateBase
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// ReplayIncrementEvent records when the event was replayed
+func (agg *clockAggregate) ReplayIncrementEvent(event IncrementEvent) {
+	agg.LastSeen = time.Now()
+}
+
+// hiddenAggregate relies on a field that isn't persisted in snapshots
+type hiddenAggregate struct {
+	eventsourcing.AggregateBase
+	Total int `json:"total"`
+	count int
+}
+
+// ReplayIncrementEvent totals the increments, weighted by position
+func (agg *hiddenAggregate) ReplayIncrementEvent(event IncrementEvent) {
+	agg.count++
+	agg.Total += agg.count * event.IncrementBy
+}
+
+// seed writes a stream of increments
+func seed(t *testing.T, store eventsourcing.EventStore, key string, count int) {
+	agg := &SimpleAggregate{}
+	agg.Initialize(key, GetTestRegistry(), store)
+	for index := 0; index < count; index++ {
+		agg.ApplyEvent(IncrementEvent{IncrementBy: 1 + index})
+	}
+	assert.Nil(t, agg.Commit())
+}
+
+// TestReplayDeterminism checks deterministic aggregates pass.
+func TestReplayDeterminism(t *testing.T) {
+	store := memory.NewStore()
+	seed(t, store, "simple", 120)
+	CheckReplayDeterminism(t, store, "simple", simpleFactory)
+	CheckReplayDeterminism(t, store, "empty", simpleFactory)
+}
+
+// TestReplayUsingClock checks replays that depend on the clock are detected.
+func TestReplayUsingClock(t *testing.T) {
+	store := memory.NewStore()
+	seed(t, store, "clock", 3)
+
+	errCheck := checkReplayDeterminism(store, "clock", func(key string, store eventsourcing.EventStore) eventsourcing.AggregateBase {
+		agg := &clockAggregate{}
+		agg.Initialize(key, GetTestRegistry(), store, func() interface{} { return agg })
+		agg.AutomaticWireup(agg)
+		return agg.AggregateBase
+	})
+	assert.Contains(t, errCheck.Error(), "second full replay differs")
+}
+
+// TestReplayUsingHiddenState checks replays that depend on unpersisted state are detected.
+func TestReplayUsingHiddenState(t *testing.T) {
+	store := memory.NewStore()
+	seed(t, store, "hidden", 3)
+
+	errCheck := checkReplayDeterminism(store, "hidden", func(key string, store eventsourcing.EventStore) eventsourcing.AggregateBase {
+		agg := &hiddenAggregate{}
+		agg.Initialize(key, GetTestRegistry(), store, func() interface{} { return agg })
+		agg.AutomaticWireup(agg)
+		return agg.AggregateBase
+	})
+	assert.Contains(t, errCheck.Error(), "a snapshot at 1")
+}
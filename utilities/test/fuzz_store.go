@@ -0,0 +1,200 @@
+package test
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// FuzzOptions configures a randomized store conformance run.
+type FuzzOptions struct {
+	Seed       int64 // Seed for the operation choices, zero for a time-based seed
+	Workers    int   // Goroutines operating on the store concurrently
+	Operations int   // Operations run by each worker
+	Keys       int   // Distinct aggregates, fewer keys cause more conflicts
+	MaxEvents  int   // Most events raised by a single commit
+}
+
+// DefaultFuzzOptions are the options used by CheckRandomInterleavings when
+// a field is left empty.
+var DefaultFuzzOptions = FuzzOptions{
+	Workers:    4,
+	Operations: 50,
+	Keys:       3,
+	MaxEvents:  3,
+}
+
+// fuzzLedger records the commits that the store accepted for each key.
+type fuzzLedger struct {
+	lock      sync.Mutex
+	sequences map[string]int64 // Highest sequence accepted per key
+	totals    map[string]int   // Sum of increments accepted per key
+	events    map[string]int64 // Number of events accepted per key
+}
+
+// accept records a successful commit
+func (ledger *fuzzLedger) accept(key string, sequence int64, increments []int) {
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+
+	if sequence > ledger.sequences[key] {
+		ledger.sequences[key] = sequence
+	}
+	for _, increment := range increments {
+		ledger.totals[key] += increment
+	}
+	ledger.events[key] += int64(len(increments))
+}
+
+// CheckRandomInterleavings runs random commits, refreshes and stale (conflicting)
+// commits against a store from several goroutines, then checks the invariants
+// every store must hold regardless of interleaving:
+//
+//   - Commits succeed, or fail with a ConcurrencyFault - never another error
+//   - No event is lost, and no sequence number is used twice
+//   - Refreshes never go backwards, and always see the worker's own commits
+//
+// Failures report the seed, so that the operations chosen by a failing run can be
+// repeated (goroutine scheduling will still vary).
+func CheckRandomInterleavings(t *testing.T, provider StoreProvider, options FuzzOptions) {
+	if options.Seed == 0 {
+		options.Seed = time.Now().UnixNano()
+	}
+	if options.Workers <= 0 {
+		options.Workers = DefaultFuzzOptions.Workers
+	}
+	if options.Operations <= 0 {
+		options.Operations = DefaultFuzzOptions.Operations
+	}
+	if options.Keys <= 0 {
+		options.Keys = DefaultFuzzOptions.Keys
+	}
+	if options.MaxEvents <= 0 {
+		options.MaxEvents = DefaultFuzzOptions.MaxEvents
+	}
+
+	execute(t, provider, func(store eventsourcing.EventStore) error {
+		prefix := getDummyKey()
+		keys := make([]string, options.Keys)
+		for index := range keys {
+			keys[index] = fmt.Sprintf("%v-%v", prefix, index)
+		}
+
+		ledger := &fuzzLedger{
+			sequences: make(map[string]int64),
+			totals:    make(map[string]int),
+			events:    make(map[string]int64),
+		}
+
+		failures := make(chan error, options.Workers)
+		wait := sync.WaitGroup{}
+		for worker := 0; worker < options.Workers; worker++ {
+			wait.Add(1)
+			go func(worker int) {
+				defer wait.Done()
+				random := rand.New(rand.NewSource(options.Seed + int64(worker)))
+				errWorker := fuzzWorker(store, random, keys, ledger, options)
+				if errWorker != nil {
+					failures <- fmt.Errorf("Worker %v: %v", worker, errWorker)
+				}
+			}(worker)
+		}
+		wait.Wait()
+		close(failures)
+
+		for errWorker := range failures {
+			return fmt.Errorf("Random interleaving failed (seed %v): %v", options.Seed, errWorker)
+		}
+
+		// Every accepted event must be replayed exactly once
+		for _, key := range keys {
+			final := SimpleAggregate{}
+			final.Initialize(key, GetTestRegistry(), store)
+			errRefresh := final.Refresh()
+			if errRefresh != nil {
+				return errRefresh
+			}
+
+			if final.SequenceNumber() != ledger.sequences[key] || ledger.events[key] != ledger.sequences[key] {
+				return fmt.Errorf("Random interleaving failed (seed %v): %v has sequence %v, but %v events were accepted up to %v", options.Seed, key, final.SequenceNumber(), ledger.events[key], ledger.sequences[key])
+			}
+			if final.CurrentCount != ledger.totals[key] {
+				return fmt.Errorf("Random interleaving failed (seed %v): %v replayed a count of %v, but %v was committed", options.Seed, key, final.CurrentCount, ledger.totals[key])
+			}
+		}
+
+		return nil
+	})
+}
+
+// fuzzWorker runs random operations against the store.
+func fuzzWorker(store eventsourcing.EventStore, random *rand.Rand, keys []string, ledger *fuzzLedger, options FuzzOptions) error {
+	seen := make(map[string]int64)             // Highest sequence this worker has observed per key
+	stale := make(map[string]*SimpleAggregate) // Aggregates loaded earlier, for conflicting commits
+
+	for operation := 0; operation < options.Operations; operation++ {
+		key := keys[random.Intn(len(keys))]
+
+		var agg *SimpleAggregate
+		switch random.Intn(3) {
+		case 0:
+			// Refresh, checking we never move backwards
+			agg = &SimpleAggregate{}
+			agg.Initialize(key, GetTestRegistry(), store)
+			errRefresh := agg.Refresh()
+			if errRefresh != nil {
+				return errRefresh
+			}
+			if agg.SequenceNumber() < seen[key] {
+				return fmt.Errorf("Refresh of %v went backwards from %v to %v", key, seen[key], agg.SequenceNumber())
+			}
+			seen[key] = agg.SequenceNumber()
+			stale[key] = agg
+			continue
+		case 1:
+			// Commit against a fresh copy
+			agg = &SimpleAggregate{}
+			agg.Initialize(key, GetTestRegistry(), store)
+			errRefresh := agg.Refresh()
+			if errRefresh != nil {
+				return errRefresh
+			}
+			if agg.SequenceNumber() < seen[key] {
+				return fmt.Errorf("Refresh of %v went backwards from %v to %v", key, seen[key], agg.SequenceNumber())
+			}
+		case 2:
+			// Commit against a copy loaded earlier, which may conflict
+			agg = stale[key]
+			if agg == nil {
+				continue
+			}
+			delete(stale, key)
+		}
+
+		increments := make([]int, 1+random.Intn(options.MaxEvents))
+		for index := range increments {
+			increments[index] = 1 + random.Intn(100)
+			agg.ApplyEvent(IncrementEvent{IncrementBy: increments[index]})
+		}
+
+		errCommit := agg.Commit()
+		if errCommit != nil {
+			isFault, _ := eventsourcing.IsConcurrencyFault(errCommit)
+			if !isFault {
+				return fmt.Errorf("Commit to %v failed with something other than a ConcurrencyFault: %v", key, errCommit)
+			}
+			continue
+		}
+
+		ledger.accept(key, agg.SequenceNumber(), increments)
+		if agg.SequenceNumber() > seen[key] {
+			seen[key] = agg.SequenceNumber()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// CheckGlobalFeed checks that a store implementing eventsourcing.GlobalReader reads
+// every event it contains, across aggregates, with each aggregate's events in
+// sequence order, and that reading can resume from any position.
+func CheckGlobalFeed(t *testing.T, provider StoreProvider) {
+	execute(t, provider, func(store eventsourcing.EventStore) error {
+		reader, ok := store.(eventsourcing.GlobalReader)
+		if !ok {
+			return fmt.Errorf("Store %T does not implement GlobalReader", store)
+		}
+
+		// Interleave commits across aggregates
+		keys := []string{getDummyKey(), getDummyKey()}
+		for round := 0; round < 3; round++ {
+			for _, key := range keys {
+				instance := SimpleAggregate{}
+				instance.Initialize(key, GetTestRegistry(), store)
+				errRefresh := instance.Refresh()
+				if errRefresh != nil {
+					return errRefresh
+				}
+
+				instance.ApplyEvent(IncrementEvent{IncrementBy: round + 1})
+				instance.ApplyEvent(IncrementEvent{IncrementBy: round + 1})
+				errCommit := instance.Commit()
+				if errCommit != nil {
+					return errCommit
+				}
+			}
+		}
+
+		// Read the feed a page at a time
+		all := []eventsourcing.GlobalEvent{}
+		from := ""
+		for page := 0; page < 100; page++ {
+			events, errRead := reader.ReadAll(from, 4)
+			if errRead != nil {
+				return errRead
+			}
+			if len(events) > 4 {
+				return fmt.Errorf("Read %v events with a limit of 4", len(events))
+			}
+			if len(events) == 0 {
+				break
+			}
+
+			all = append(all, events...)
+			from = events[len(events)-1].Position
+		}
+
+		// Every event should be read once, in order for each aggregate
+		last := map[string]int64{keys[0]: 0, keys[1]: 0}
+		for _, event := range all {
+			if _, ours := last[event.Key]; !ours {
+				continue
+			}
+			if event.Sequence != last[event.Key]+1 {
+				return fmt.Errorf("Expected %v at sequence %v, got %v", event.Key, last[event.Key]+1, event.Sequence)
+			}
+			if event.Type != "IncrementEvent" {
+				return fmt.Errorf("Expected IncrementEvent, got %v", event.Type)
+			}
+			last[event.Key] = event.Sequence
+		}
+		for _, key := range keys {
+			if last[key] != 6 {
+				return fmt.Errorf("Expected 6 events for %v, got %v", key, last[key])
+			}
+		}
+
+		// Resuming from the middle of the feed reads the remainder
+		if len(all) > 1 {
+			middle := len(all) / 2
+			rest, errRest := reader.ReadAll(all[middle-1].Position, len(all))
+			if errRest != nil {
+				return errRest
+			}
+			if len(rest) != len(all)-middle || rest[0].Position != all[middle].Position {
+				return fmt.Errorf("Resuming from %v read %v events, expected %v", all[middle-1].Position, len(rest), len(all)-middle)
+			}
+		}
+
+		return nil
+	})
+}
+
+// CheckCategoryFeed checks that a store implementing eventsourcing.CategoryReader
+// reads the events of every aggregate in a category, and no others.
+func CheckCategoryFeed(t *testing.T, provider StoreProvider) {
+	execute(t, provider, func(store eventsourcing.EventStore) error {
+		reader, ok := store.(eventsourcing.CategoryReader)
+		if !ok {
+			return fmt.Errorf("Store %T does not implement CategoryReader", store)
+		}
+
+		// Commit to aggregates in two categories, and one without
+		category := "Counter-" + getDummyKey()
+		categories := []string{category, "Other-" + getDummyKey(), ""}
+		keys := []string{getDummyKey(), getDummyKey(), getDummyKey()}
+		for round := 0; round < 2; round++ {
+			for index, key := range keys {
+				instance := SimpleAggregate{}
+				instance.Initialize(key, GetTestRegistry(), store)
+				instance.UseCategory(categories[index%len(categories)])
+				errRefresh := instance.Refresh()
+				if errRefresh != nil {
+					return errRefresh
+				}
+
+				instance.ApplyEvent(IncrementEvent{IncrementBy: 1})
+				instance.ApplyEvent(IncrementEvent{IncrementBy: 1})
+				errCommit := instance.Commit()
+				if errCommit != nil {
+					return errCommit
+				}
+			}
+		}
+
+		// Read the category a page at a time
+		events := []eventsourcing.GlobalEvent{}
+		from := ""
+		for page := 0; page < 100; page++ {
+			read, errRead := reader.ReadCategory(category, from, 3)
+			if errRead != nil {
+				return errRead
+			}
+			if len(read) == 0 {
+				break
+			}
+
+			events = append(events, read...)
+			from = read[len(read)-1].Position
+		}
+
+		if len(events) != 4 {
+			return fmt.Errorf("Expected 4 events in category %v, got %v", category, len(events))
+		}
+		for index, event := range events {
+			if event.Key != keys[0] || event.Sequence != int64(index+1) {
+				return fmt.Errorf("Expected %v at sequence %v, got %v at %v", keys[0], index+1, event.Key, event.Sequence)
+			}
+		}
+
+		// Unknown categories are empty
+		none, errNone := reader.ReadCategory("Missing-"+getDummyKey(), "", 10)
+		if errNone != nil {
+			return errNone
+		}
+		if len(none) != 0 {
+			return fmt.Errorf("Expected no events for an unknown category, got %v", len(none))
+		}
+
+		return nil
+	})
+}
+
+// CheckCorrelationFeed checks that a store implementing eventsourcing.CorrelationReader
+// reads the events of a business transaction across aggregates, with the causation
+// recorded by each commit, and no others.
+func CheckCorrelationFeed(t *testing.T, provider StoreProvider) {
+	execute(t, provider, func(store eventsourcing.EventStore) error {
+		reader, ok := store.(eventsourcing.CorrelationReader)
+		if !ok {
+			return fmt.Errorf("Store %T does not implement CorrelationReader", store)
+		}
+
+		// A command starts the transaction, and a second aggregate reacts to it
+		correlationID := "order-" + getDummyKey()
+		first := SimpleAggregate{}
+		first.Initialize(getDummyKey(), GetTestRegistry(), store)
+		first.UseLineage(correlationID, "command-1")
+		first.ApplyEvent(IncrementEvent{IncrementBy: 1})
+		first.ApplyEvent(IncrementEvent{IncrementBy: 1})
+		errFirst := first.Commit()
+		if errFirst != nil {
+			return errFirst
+		}
+
+		unrelated := SimpleAggregate{}
+		unrelated.Initialize(getDummyKey(), GetTestRegistry(), store)
+		unrelated.UseLineage("other-"+getDummyKey(), "command-2")
+		unrelated.ApplyEvent(IncrementEvent{IncrementBy: 1})
+		errUnrelated := unrelated.Commit()
+		if errUnrelated != nil {
+			return errUnrelated
+		}
+
+		caused, errCaused := reader.ReadCorrelation(correlationID, "", 10)
+		if errCaused != nil {
+			return errCaused
+		}
+		if len(caused) != 2 {
+			return fmt.Errorf("Expected 2 events for correlation %v, got %v", correlationID, len(caused))
+		}
+
+		second := SimpleAggregate{}
+		second.Initialize(getDummyKey(), GetTestRegistry(), store)
+		second.ContinueLineage(caused[1])
+		second.ApplyEvent(IncrementEvent{IncrementBy: 1})
+		errSecond := second.Commit()
+		if errSecond != nil {
+			return errSecond
+		}
+
+		// Read the transaction a page at a time
+		events := []eventsourcing.GlobalEvent{}
+		from := ""
+		for page := 0; page < 100; page++ {
+			read, errRead := reader.ReadCorrelation(correlationID, from, 2)
+			if errRead != nil {
+				return errRead
+			}
+			if len(read) == 0 {
+				break
+			}
+
+			events = append(events, read...)
+			from = read[len(read)-1].Position
+		}
+
+		if len(events) != 3 {
+			return fmt.Errorf("Expected 3 events for correlation %v, got %v", correlationID, len(events))
+		}
+		if events[2].Key != second.GetKey() {
+			return fmt.Errorf("Expected the reaction of %v last, got %v", second.GetKey(), events[2].Key)
+		}
+		if cause := eventsourcing.CausationIDOf(events[2].Metadata); cause != eventsourcing.EventID(first.GetKey(), 2) {
+			return fmt.Errorf("Expected the reaction to be caused by %v, got %v", eventsourcing.EventID(first.GetKey(), 2), cause)
+		}
+
+		// Unknown correlations are empty
+		none, errNone := reader.ReadCorrelation("missing-"+getDummyKey(), "", 10)
+		if errNone != nil {
+			return errNone
+		}
+		if len(none) != 0 {
+			return fmt.Errorf("Expected no events for an unknown correlation, got %v", len(none))
+		}
+
+		return nil
+	})
+}
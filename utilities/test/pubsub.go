@@ -0,0 +1,84 @@
+package test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/stretchr/testify/assert"
+)
+
+// RecordingHandler is a handler that records the sequences of the increments it
+// handles, so that consumers can be checked for ordering and redelivery.
+type RecordingHandler struct {
+	eventsourcing.EventHandlerBase
+	lock  sync.Mutex
+	seen  []int64
+	fail  bool
+	fails int
+}
+
+// CreateRecordingHandler creates a recording handler, which fails the first
+// increment it is given if failOnce is set.
+func CreateRecordingHandler(failOnce bool) *RecordingHandler {
+	handler := &RecordingHandler{
+		fail: failOnce,
+	}
+	handler.Initialize(GetTestRegistry(), handler)
+	return handler
+}
+
+// HandleIncrementEvent consumes an increment event
+func (handler *RecordingHandler) HandleIncrementEvent(key string, seq int64, evt IncrementEvent) error {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if handler.fail {
+		handler.fail = false
+		handler.fails++
+		return errors.New("failed")
+	}
+	handler.seen = append(handler.seen, seq)
+	return nil
+}
+
+// Count gets the number of events handled
+func (handler *RecordingHandler) Count() int {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	return len(handler.seen)
+}
+
+// Seen gets the sequences of the events handled, in the order they were handled
+func (handler *RecordingHandler) Seen() []int64 {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	return append([]int64{}, handler.seen...)
+}
+
+// Fails gets the number of events the handler failed
+func (handler *RecordingHandler) Fails() int {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	return handler.fails
+}
+
+// WaitFor waits for a condition to hold, for up to five seconds.
+func WaitFor(condition func() bool) bool {
+	for attempt := 0; attempt < 500; attempt++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// PublishIncrements publishes a number of increments for a key, with sequences
+// starting from a number
+func PublishIncrements(t *testing.T, pub eventsourcing.EventPublisher, key string, from int64, count int64) {
+	for seq := from; seq < from+count; seq++ {
+		assert.Nil(t, pub.Publish(key, seq, IncrementEvent{IncrementBy: 1}))
+	}
+}
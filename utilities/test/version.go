@@ -0,0 +1,46 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// CheckVersion checks that a store reports the version of aggregates, both
+// directly and through a middleware wrapper.
+func CheckVersion(t *testing.T, provider StoreProvider) {
+	execute(t, provider, func(store eventsourcing.EventStore) error {
+		key := getDummyKey()
+		version, errVersion := eventsourcing.Version(store, key)
+		if errVersion != nil {
+			return errVersion
+		}
+		if version != 0 {
+			return fmt.Errorf("Expected an aggregate with no events to be at version 0, not %v", version)
+		}
+
+		instance := SimpleAggregate{}
+		instance.Initialize(key, GetTestRegistry(), store)
+		for round := 0; round < 2; round++ {
+			instance.ApplyEvent(IncrementEvent{IncrementBy: 1})
+			instance.ApplyEvent(IncrementEvent{IncrementBy: 1})
+			errCommit := instance.Commit()
+			if errCommit != nil {
+				return errCommit
+			}
+		}
+
+		for _, candidate := range []eventsourcing.EventStore{store, eventsourcing.NewMiddlewareWrapper(store)} {
+			version, errVersion = eventsourcing.Version(candidate, key)
+			if errVersion != nil {
+				return errVersion
+			}
+			if version != 4 {
+				return fmt.Errorf("Expected the aggregate to be at version 4, not %v", version)
+			}
+		}
+
+		return nil
+	})
+}
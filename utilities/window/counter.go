@@ -0,0 +1,207 @@
+/*
+Package window tracks the rate of events per aggregate key and event type over a
+sliding window, within a consumer. Handlers can consult the counts to adapt their
+behaviour while a key is hot, i.e. by batching notifications or by deferring an
+expensive recomputation until activity dies down:
+
+	counter := window.NewCounter(window.Options{Window: time.Minute})
+	consumer.AddHandler(window.Track(handler, counter))
+
+	// Within the handler
+	if counter.Hot(event.Key, 100) {
+		return handler.postpone(event)
+	}
+*/
+package window
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+)
+
+// DefaultBuckets is the number of buckets a window is divided into.
+const DefaultBuckets = 60
+
+// Options contains the options for a counter.
+type Options struct {
+	Window  time.Duration    // Length of the sliding window
+	Buckets int              // Buckets the window is divided into, DefaultBuckets by default
+	Clock   func() time.Time // Source of the current time, time.Now by default
+}
+
+// series is the count of events of a type for a key, within each bucket.
+type series struct {
+	counts []int64 // Count within each bucket, indexed by bucket modulo length
+	stamps []int64 // Bucket number that each count belongs to
+	latest int64   // Latest bucket number an event was counted in
+}
+
+// seriesKey identifies a series.
+type seriesKey struct {
+	key       string
+	eventType eventsourcing.EventType
+}
+
+// Counter counts events per key and event type over a sliding window. Counts are
+// approximate to the resolution of a bucket, and keys without events in the window
+// are forgotten. Counters are safe for use from multiple goroutines.
+type Counter struct {
+	options    Options
+	resolution int64                  // Length of a bucket, in nanoseconds
+	lock       sync.Mutex             // Guards the series
+	series     map[seriesKey]*series  // Series per key and type
+	types      map[string][]seriesKey // Series of each key
+	swept      int64                  // Bucket number of the last sweep
+}
+
+// NewCounter creates a counter over a sliding window.
+func NewCounter(options Options) *Counter {
+	if options.Buckets <= 0 {
+		options.Buckets = DefaultBuckets
+	}
+	if options.Clock == nil {
+		options.Clock = time.Now
+	}
+
+	resolution := int64(options.Window) / int64(options.Buckets)
+	if resolution <= 0 {
+		resolution = 1
+	}
+
+	return &Counter{
+		options:    options,
+		resolution: resolution,
+		series:     make(map[seriesKey]*series),
+		types:      make(map[string][]seriesKey),
+	}
+}
+
+// bucket gets the number of the current bucket.
+func (counter *Counter) bucket() int64 {
+	return counter.options.Clock().UnixNano() / counter.resolution
+}
+
+// Observe counts an event of a type for a key, at the current time.
+func (counter *Counter) Observe(key string, eventType eventsourcing.EventType) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	current := counter.bucket()
+	counter.sweep(current)
+
+	id := seriesKey{key: key, eventType: eventType}
+	entry, found := counter.series[id]
+	if !found {
+		entry = &series{
+			counts: make([]int64, counter.options.Buckets),
+			stamps: make([]int64, counter.options.Buckets),
+		}
+		counter.series[id] = entry
+		counter.types[key] = append(counter.types[key], id)
+	}
+
+	slot := int(current % int64(counter.options.Buckets))
+	if entry.stamps[slot] != current {
+		entry.stamps[slot] = current
+		entry.counts[slot] = 0
+	}
+	entry.counts[slot]++
+	entry.latest = current
+}
+
+// Count gets the number of events for a key within the window.
+func (counter *Counter) Count(key string) int64 {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	current := counter.bucket()
+	total := int64(0)
+	for _, id := range counter.types[key] {
+		total += counter.sum(counter.series[id], current)
+	}
+	return total
+}
+
+// CountOf gets the number of events of a type for a key within the window.
+func (counter *Counter) CountOf(key string, eventType eventsourcing.EventType) int64 {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	entry, found := counter.series[seriesKey{key: key, eventType: eventType}]
+	if !found {
+		return 0
+	}
+	return counter.sum(entry, counter.bucket())
+}
+
+// Rate gets the average number of events per second for a key over the window.
+func (counter *Counter) Rate(key string) float64 {
+	return float64(counter.Count(key)) / counter.options.Window.Seconds()
+}
+
+// Hot determines if a key has had at least the threshold number of events within
+// the window.
+func (counter *Counter) Hot(key string, threshold int64) bool {
+	return counter.Count(key) >= threshold
+}
+
+// sum totals the buckets of a series that are within the window.
+func (counter *Counter) sum(entry *series, current int64) int64 {
+	total := int64(0)
+	oldest := current - int64(counter.options.Buckets)
+	for slot, stamp := range entry.stamps {
+		if stamp > oldest && stamp <= current {
+			total += entry.counts[slot]
+		}
+	}
+	return total
+}
+
+// sweep forgets series without events in the window, at most once per window.
+func (counter *Counter) sweep(current int64) {
+	buckets := int64(counter.options.Buckets)
+	if current-counter.swept < buckets {
+		return
+	}
+	counter.swept = current
+
+	for key, ids := range counter.types {
+		kept := ids[:0]
+		for _, id := range ids {
+			if counter.series[id].latest > current-buckets {
+				kept = append(kept, id)
+				continue
+			}
+			delete(counter.series, id)
+		}
+
+		if len(kept) == 0 {
+			delete(counter.types, key)
+			continue
+		}
+		counter.types[key] = kept
+	}
+}
+
+// trackingHandler is an event handler that counts events before handling them.
+type trackingHandler struct {
+	handler eventsourcing.EventHandler
+	counter *Counter
+}
+
+// Track wraps an event handler so that events are counted before they are handled,
+// so the counts seen by the handler include the event being handled.
+func Track(handler eventsourcing.EventHandler, counter *Counter) eventsourcing.EventHandler {
+	return &trackingHandler{
+		handler: handler,
+		counter: counter,
+	}
+}
+
+// Handle counts the event, and then handles it
+func (tracking *trackingHandler) Handle(event eventsourcing.PublishedEvent) error {
+	tracking.counter.Observe(event.Key, event.Type)
+	return tracking.handler.Handle(event)
+}
@@ -0,0 +1,98 @@
+package window
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-gadgets/eventsourcing"
+	"github.com/go-gadgets/eventsourcing/utilities/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func newCounter() (*Counter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)}
+	return NewCounter(Options{
+		Window:  time.Minute,
+		Buckets: 6,
+		Clock:   clock.Now,
+	}), clock
+}
+
+// TestSlidingWindow checks events are counted until they leave the window.
+func TestSlidingWindow(t *testing.T) {
+	counter, clock := newCounter()
+	counter.Observe("a", "Created")
+	counter.Observe("a", "Updated")
+	clock.now = clock.now.Add(30 * time.Second)
+	counter.Observe("a", "Updated")
+	counter.Observe("b", "Created")
+
+	assert.Equal(t, int64(3), counter.Count("a"))
+	assert.Equal(t, int64(2), counter.CountOf("a", "Updated"))
+	assert.Equal(t, int64(1), counter.Count("b"))
+	assert.Equal(t, int64(0), counter.Count("c"))
+	assert.Equal(t, 0.05, counter.Rate("a"))
+	assert.True(t, counter.Hot("a", 3))
+	assert.False(t, counter.Hot("b", 3))
+
+	// The first events leave the window
+	clock.now = clock.now.Add(35 * time.Second)
+	assert.Equal(t, int64(1), counter.Count("a"))
+	assert.Equal(t, int64(1), counter.CountOf("a", "Updated"))
+	assert.Equal(t, int64(0), counter.CountOf("a", "Created"))
+
+	// Buckets are reused once their events have left the window
+	clock.now = clock.now.Add(25 * time.Second)
+	counter.Observe("a", "Created")
+	assert.Equal(t, int64(1), counter.Count("a"))
+}
+
+// TestForgetIdleKeys checks keys without events in the window are forgotten.
+func TestForgetIdleKeys(t *testing.T) {
+	counter, clock := newCounter()
+	counter.Observe("idle", "Created")
+	counter.Observe("busy", "Created")
+
+	clock.now = clock.now.Add(2 * time.Minute)
+	counter.Observe("busy", "Updated")
+
+	assert.Equal(t, 1, len(counter.series), "Stale series are dropped, whether or not their key is idle")
+	_, found := counter.types["idle"]
+	assert.False(t, found)
+	assert.Equal(t, int64(1), counter.Count("busy"))
+}
+
+// TestTrack checks that handlers see counts that include the event being handled.
+func TestTrack(t *testing.T) {
+	counter, _ := newCounter()
+	seen := []int64{}
+	handler := Track(handlerFunc(func(event eventsourcing.PublishedEvent) error {
+		seen = append(seen, counter.Count(event.Key))
+		return nil
+	}), counter)
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, handler.Handle(eventsourcing.PublishedEvent{Key: "a", Type: "IncrementEvent"}))
+	}
+	assert.Equal(t, []int64{1, 2, 3}, seen)
+
+	logging := test.CreateLoggingHandler()
+	assert.Nil(t, Track(&logging, counter).Handle(eventsourcing.PublishedEvent{Key: "b", Type: "IncrementEvent"}))
+	assert.Equal(t, 1, len(logging.Events))
+}
+
+// handlerFunc adapts a function into an event handler.
+type handlerFunc func(event eventsourcing.PublishedEvent) error
+
+func (fn handlerFunc) Handle(event eventsourcing.PublishedEvent) error {
+	return fn(event)
+}
@@ -0,0 +1,76 @@
+package eventsourcing
+
+// VersionReader is an interface implemented by stores that can report the version
+// of an aggregate, the sequence of its latest event, without fetching its events.
+type VersionReader interface {
+	// Version gets the sequence of the latest event for a key, or zero if the
+	// aggregate has no events.
+	Version(key string) (int64, error)
+}
+
+// Version gets the version of an aggregate, the sequence of its latest event, for
+// existence checks and ETags without hydrating an aggregate. Zero means the
+// aggregate doesn't exist. Stores that implement VersionReader answer this with a
+// single cheap query, and other stores are refreshed into a loader that counts
+// events without applying them.
+func Version(store EventStore, key string) (int64, error) {
+	reader, ok := store.(VersionReader)
+	if ok {
+		return reader.Version(key)
+	}
+
+	loader := &versionLoader{
+		key:      key,
+		registry: NewStandardEventRegistry(""),
+	}
+	errRefresh := store.Refresh(loader)
+	if errRefresh != nil {
+		return 0, errRefresh
+	}
+	return loader.sequence, nil
+}
+
+// versionLoader is a loader adapter that tracks the sequence of the events it is
+// given, discarding them.
+type versionLoader struct {
+	key      string
+	sequence int64
+	registry EventRegistry
+}
+
+// GetKey fetches the aggregate key
+func (loader *versionLoader) GetKey() string {
+	return loader.key
+}
+
+// SequenceNumber fetches the current sequence number
+func (loader *versionLoader) SequenceNumber() int64 {
+	return loader.sequence
+}
+
+// GetEventRegistry gets a registry, which revives every event as a map
+func (loader *versionLoader) GetEventRegistry() EventRegistry {
+	return loader.registry
+}
+
+// IsDirty returns false, since the loader has no uncommitted events
+func (loader *versionLoader) IsDirty() bool {
+	return false
+}
+
+// ReplayEvent counts an event
+func (loader *versionLoader) ReplayEvent(event Event) {
+	loader.sequence++
+}
+
+// RestoreSnapshot moves to the sequence of a snapshot
+func (loader *versionLoader) RestoreSnapshot(sequence int64, state interface{}) error {
+	loader.sequence = sequence
+	return nil
+}
+
+// AdvanceSequence moves to a later sequence without an event
+func (loader *versionLoader) AdvanceSequence(sequence int64) error {
+	loader.sequence = sequence
+	return nil
+}
@@ -0,0 +1,57 @@
+package eventsourcing
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// replayingStore is a store without version support, that replays a snapshot and
+// then a number of events.
+type replayingStore struct {
+	NullStore
+	snapshot int64
+	events   int
+	err      error
+}
+
+func (store *replayingStore) Refresh(loader StoreLoaderAdapter) error {
+	if store.err != nil {
+		return store.err
+	}
+	if store.snapshot > 0 {
+		loader.RestoreSnapshot(store.snapshot, map[string]interface{}{})
+	}
+	for index := 0; index < store.events; index++ {
+		loader.ReplayEvent(map[string]interface{}{})
+	}
+	return nil
+}
+
+// versionedStore is a store that reports versions itself.
+type versionedStore struct {
+	NullStore
+}
+
+func (store *versionedStore) Version(key string) (int64, error) {
+	return 99, nil
+}
+
+// TestVersionFallback checks stores without version support are refreshed.
+func TestVersionFallback(t *testing.T) {
+	version, errVersion := Version(&replayingStore{snapshot: 10, events: 3}, "key")
+	assert.Nil(t, errVersion)
+	assert.Equal(t, int64(13), version)
+
+	_, errVersion = Version(&replayingStore{err: errors.New("failed")}, "key")
+	assert.NotNil(t, errVersion)
+}
+
+// TestVersionReader checks stores that report versions are asked directly, even
+// through middleware.
+func TestVersionReader(t *testing.T) {
+	version, errVersion := Version(NewMiddlewareWrapper(&versionedStore{}), "key")
+	assert.Nil(t, errVersion)
+	assert.Equal(t, int64(99), version)
+}